@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// minHashPrefix is the shortest abbreviated hash that is looked up, unless
+// core.minAbbrev asks for longer ones, up to a full hash.
+const minHashPrefix = 4
+
+// AmbiguousHashError is returned when more than one object has a hash
+// starting with an abbreviated hash.
+type AmbiguousHashError struct {
+	Prefix string
+	// Candidates describe the objects, the abbreviated hash and the type
+	// followed by the date and the subject of commits or the name of
+	// tags.
+	Candidates []string
+}
+
+func (e *AmbiguousHashError) Error() string {
+	return fmt.Sprintf("short object ID %s is ambiguous, the candidates are:\n  %s", e.Prefix, strings.Join(e.Candidates, "\n  "))
+}
+
+// isHashPrefix tells whether the name can be an abbreviated hash.
+func (r *Repository) isHashPrefix(name string) (bool, error) {
+	min, err := r.config.Int("core", "", "minAbbrev", minHashPrefix)
+	if err != nil {
+		return false, fmt.Errorf("core.minAbbrev: %w", err)
+	}
+	if min < minHashPrefix || min > 40 {
+		return false, fmt.Errorf("core.minAbbrev: %d is not between %d and 40", min, minHashPrefix)
+	}
+	if int64(len(name)) < min || len(name) >= 40 {
+		return false, nil
+	}
+	for _, c := range name {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// expandHash returns the hash of the only object, loose or packed, whose
+// hash starts with the hexadecimal prefix. An *AmbiguousHashError is
+// returned if there are more such objects.
+func (r *Repository) expandHash(prefix string) ([]byte, error) {
+	prefix = strings.ToLower(prefix)
+	var found [][]byte
+	seen := make(map[string]bool)
+	match := func(sha []byte) {
+		s := hex.EncodeToString(sha)
+		if strings.HasPrefix(s, prefix) && !seen[s] {
+			seen[s] = true
+			found = append(found, append([]byte(nil), sha...))
+		}
+	}
+
+	for _, dir := range append([]string{r.objdir}, r.alternates...) {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, prefix[:2]))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read objects directory: %w", err)
+		}
+		for _, e := range entries {
+			sha, err := hex.DecodeString(prefix[:2] + e.Name())
+			if err != nil || len(sha) != 20 {
+				continue
+			}
+			match(sha)
+		}
+	}
+
+	if err := r.loadPacks(); err != nil {
+		return nil, err
+	}
+	first, _ := strconv.ParseUint(prefix[:2], 16, 8)
+	for _, p := range r.packs {
+		lo := 0
+		if first > 0 {
+			lo = int(p.index.fanout[first-1])
+		}
+		for i := lo; i < int(p.index.fanout[first]); i++ {
+			match(p.index.sha(i))
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("unknown revision %q: %w", prefix, os.ErrNotExist)
+	case 1:
+		return found[0], nil
+	}
+	sort.Slice(found, func(i, j int) bool { return bytes.Compare(found[i], found[j]) < 0 })
+	ambiguous := &AmbiguousHashError{Prefix: prefix}
+	for _, sha := range found {
+		ambiguous.Candidates = append(ambiguous.Candidates, r.describeCandidate(sha))
+	}
+	return nil, ambiguous
+}
+
+// describeCandidate describes an object matching an ambiguous hash, the same
+// way git does.
+func (r *Repository) describeCandidate(sha []byte) string {
+	desc := shortHash(sha)
+	obj, err := r.ReadObject(sha)
+	if err != nil {
+		return desc + " unknown"
+	}
+	switch obj := obj.(type) {
+	case *CommitObject:
+		desc += " commit"
+		if len(obj.Header["author"]) != 0 {
+			if id, err := parseIdent(obj.Header["author"][0]); err == nil {
+				desc += " " + id.When.Format("2006-01-02")
+			}
+		}
+		desc += " - " + commitSubject(obj)
+	case *TagObject:
+		desc += " tag"
+		if len(obj.Header["tag"]) != 0 {
+			desc += " " + obj.Header["tag"][0]
+		}
+	case *TreeObject:
+		desc += " tree"
+	case *BlobObject:
+		desc += " blob"
+	}
+	return desc
+}
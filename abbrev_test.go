@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestExpandHash(t *testing.T) {
+	repo := newTestRepository(t)
+	// Find two blobs with the same first two hexadecimal digits, one of
+	// them packed.
+	seen := make(map[string][]byte)
+	var a, b []byte
+	for i := 0; a == nil; i++ {
+		sha, err := repo.WriteObject("blob", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatalf("write blob: %s", err)
+		}
+		s := hex.EncodeToString(sha)
+		if other, ok := seen[s[:2]]; ok {
+			a, b = other, sha
+		}
+		seen[s[:2]] = sha
+	}
+	if _, err := repo.writePack([][]byte{a}); err != nil {
+		t.Fatalf("write pack: %s", err)
+	}
+
+	for _, want := range [][]byte{a, b} {
+		prefix := hex.EncodeToString(want)[:8]
+		if got, err := repo.expandHash(prefix); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: want %x, got %x, %v", prefix, want, got, err)
+		}
+	}
+	var ambiguous *AmbiguousHashError
+	if _, err := repo.expandHash(hex.EncodeToString(a)[:2]); !errors.As(err, &ambiguous) {
+		t.Fatalf("want ambiguous error, got %v", err)
+	}
+	want := []string{shortHash(a) + " blob", shortHash(b) + " blob"}
+	sort.Strings(want)
+	if !reflect.DeepEqual(ambiguous.Candidates, want) {
+		t.Errorf("want candidates %q, got %q", want, ambiguous.Candidates)
+	}
+	if _, err := repo.expandHash("0123456789"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want not exist error, got %v", err)
+	}
+
+	if _, err := repo.Resolve(hex.EncodeToString(a)[:3]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want prefix shorter than %d rejected, got %v", minHashPrefix, err)
+	}
+	if got, err := repo.Resolve(hex.EncodeToString(a)[:10]); err != nil || !bytes.Equal(got, a) {
+		t.Errorf("want %x, got %x, %v", a, got, err)
+	}
+
+	repo.config.Entries = append(repo.config.Entries, &ConfigEntry{Section: "core", Key: "minabbrev", Value: "10"})
+	if _, err := repo.Resolve(hex.EncodeToString(a)[:8]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want prefix shorter than core.minAbbrev rejected, got %v", err)
+	}
+	if got, err := repo.Resolve(hex.EncodeToString(a)[:10]); err != nil || !bytes.Equal(got, a) {
+		t.Errorf("want %x, got %x, %v", a, got, err)
+	}
+	for _, value := range []string{"3", "41"} {
+		repo.config.Entries[len(repo.config.Entries)-1].Value = value
+		if _, err := repo.Resolve(hex.EncodeToString(a)[:10]); err == nil || errors.Is(err, os.ErrNotExist) {
+			t.Errorf("want core.minAbbrev %s rejected, got %v", value, err)
+		}
+	}
+}
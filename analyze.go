@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// AnalyzeLimits are the thresholds above which Analyze reports an issue.
+// A zero limit disables the check.
+type AnalyzeLimits struct {
+	MaxBlobSize    int64
+	MaxTreeEntries int64
+	MaxPathDepth   int64
+	MaxMessageSize int64
+}
+
+// DefaultAnalyzeLimits are sizes that make a repository slow to clone or
+// to work with.
+var DefaultAnalyzeLimits = AnalyzeLimits{
+	MaxBlobSize:    10 << 20,
+	MaxTreeEntries: 1000,
+	MaxPathDepth:   20,
+	MaxMessageSize: 10000,
+}
+
+// Kinds of issues reported by Analyze.
+const (
+	issueBlobSize    = "blob-size"
+	issueTreeEntries = "tree-entries"
+	issuePathDepth   = "path-depth"
+	issueMessageSize = "message-size"
+)
+
+// AnalyzeIssue is an object over one of the limits.
+type AnalyzeIssue struct {
+	Kind string `json:"kind"`
+	Sha  string `json:"sha"`
+	// Path is where the object was first found. For path depth issues it
+	// is the deepest path of the commit tree.
+	Path  string `json:"path,omitempty"`
+	Value int64  `json:"value"`
+	Limit int64  `json:"limit"`
+}
+
+// AnalyzeReport is the result of Analyze. Maximum values are of all
+// reachable objects, regardless of the limits.
+type AnalyzeReport struct {
+	Commits        int             `json:"commits"`
+	Trees          int             `json:"trees"`
+	Blobs          int             `json:"blobs"`
+	MaxBlobSize    int64           `json:"maxBlobSize"`
+	MaxTreeEntries int64           `json:"maxTreeEntries"`
+	MaxPathDepth   int64           `json:"maxPathDepth"`
+	MaxMessageSize int64           `json:"maxMessageSize"`
+	Issues         []*AnalyzeIssue `json:"issues"`
+}
+
+// analyzedTree is the deepest path below a tree.
+type analyzedTree struct {
+	depth int64
+	path  string
+}
+
+// Analyze walks all commits reachable from the tips, with their trees and
+// blobs, and reports objects that are over the limits. Every object is
+// reported at most once, for the first path it was found at.
+func (r *Repository) Analyze(tips [][]byte, limits AnalyzeLimits) (*AnalyzeReport, error) {
+	report := &AnalyzeReport{Issues: []*AnalyzeIssue{}}
+	check := func(kind string, sha []byte, path string, value, limit int64) {
+		if limit > 0 && value > limit {
+			report.Issues = append(report.Issues, &AnalyzeIssue{
+				Kind:  kind,
+				Sha:   hex.EncodeToString(sha),
+				Path:  path,
+				Value: value,
+				Limit: limit,
+			})
+		}
+	}
+
+	trees := make(map[string]*analyzedTree)
+	blobs := make(map[string]struct{})
+	var analyzeTree func(sha []byte, prefix string) (*analyzedTree, error)
+	analyzeTree = func(sha []byte, prefix string) (*analyzedTree, error) {
+		if t, ok := trees[string(sha)]; ok {
+			return t, nil
+		}
+		tree, err := r.readTree(sha)
+		if err != nil {
+			return nil, err
+		}
+		report.Trees++
+		entries := int64(len(tree.Leafs))
+		if entries > report.MaxTreeEntries {
+			report.MaxTreeEntries = entries
+		}
+		check(issueTreeEntries, sha, prefix, entries, limits.MaxTreeEntries)
+
+		// Paths are kept relative to the tree, because the same tree can
+		// be found at different locations.
+		deepest := &analyzedTree{}
+		for _, leaf := range tree.Leafs {
+			current := &analyzedTree{depth: 1, path: leaf.Path}
+			switch leaf.Mode {
+			case modeGitlink:
+				// Submodule commits live in another repository.
+			case modeTree:
+				sub, err := analyzeTree(leaf.Sha, prefix+leaf.Path+"/")
+				if err != nil {
+					return nil, err
+				}
+				current = &analyzedTree{depth: sub.depth + 1, path: leaf.Path + "/" + sub.path}
+			default:
+				if _, ok := blobs[string(leaf.Sha)]; ok {
+					break
+				}
+				blobs[string(leaf.Sha)] = struct{}{}
+				_, content, err := r.ReadRawObject(leaf.Sha)
+				if err != nil {
+					return nil, err
+				}
+				report.Blobs++
+				size := int64(len(content))
+				if size > report.MaxBlobSize {
+					report.MaxBlobSize = size
+				}
+				check(issueBlobSize, leaf.Sha, prefix+leaf.Path, size, limits.MaxBlobSize)
+			}
+			if current.depth > deepest.depth {
+				deepest = current
+			}
+		}
+		trees[string(sha)] = deepest
+		return deepest, nil
+	}
+
+	reportedPaths := make(map[string]struct{})
+	seen := make(map[string]struct{})
+	stack := append([][]byte(nil), tips...)
+	for len(stack) != 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := seen[string(sha)]; ok {
+			continue
+		}
+		seen[string(sha)] = struct{}{}
+		c, err := r.readWalkedCommit(sha)
+		if err != nil {
+			return nil, err
+		}
+		report.Commits++
+		stack = append(stack, c.Parents...)
+
+		size := int64(len(c.Commit.Comment))
+		if size > report.MaxMessageSize {
+			report.MaxMessageSize = size
+		}
+		check(issueMessageSize, sha, "", size, limits.MaxMessageSize)
+
+		for _, tree := range c.Commit.Header["tree"] {
+			treeSha, err := hex.DecodeString(tree)
+			if err != nil {
+				return nil, fmt.Errorf("commit %x: invalid tree: %w", sha, err)
+			}
+			deepest, err := analyzeTree(treeSha, "")
+			if err != nil {
+				return nil, err
+			}
+			if deepest.depth > report.MaxPathDepth {
+				report.MaxPathDepth = deepest.depth
+			}
+			// A deep path is usually present in many commits, so it is
+			// reported only for the first one.
+			if _, ok := reportedPaths[deepest.path]; !ok {
+				reportedPaths[deepest.path] = struct{}{}
+				check(issuePathDepth, sha, deepest.path, deepest.depth, limits.MaxPathDepth)
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	repo := newTestRepository(t)
+	small, err := repo.WriteObject("blob", []byte("small\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	big, err := repo.WriteObject("blob", bytes.Repeat([]byte("big\n"), 100))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	b := NewTreeBuilder(repo, nil)
+	for path, sha := range map[string][]byte{
+		"a/b/c/small.txt": small,
+		"a/big.txt":       big,
+		"x.txt":           small,
+		"y.txt":           small,
+	} {
+		if err := b.Insert(path, modeBlob, sha); err != nil {
+			t.Fatalf("insert: %s", err)
+		}
+	}
+	tree, err := b.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	commit := func(message string, parents ...[]byte) []byte {
+		header := map[string][]string{
+			"tree":      {fmt.Sprintf("%x", tree)},
+			"author":    {"Test <test@example.com> 1600000000 +0000"},
+			"committer": {"Test <test@example.com> 1600000000 +0000"},
+		}
+		for _, p := range parents {
+			header["parent"] = append(header["parent"], fmt.Sprintf("%x", p))
+		}
+		raw, err := (&CommitObject{Header: header, Comment: message}).Serialize()
+		if err != nil {
+			t.Fatalf("serialize commit: %s", err)
+		}
+		sha, err := repo.WriteObject("commit", raw)
+		if err != nil {
+			t.Fatalf("write commit: %s", err)
+		}
+		return sha
+	}
+	base := commit("base\n")
+	top := commit("a much longer message\n", base)
+
+	report, err := repo.Analyze([][]byte{top}, AnalyzeLimits{
+		MaxBlobSize:    100,
+		MaxTreeEntries: 2,
+		MaxPathDepth:   3,
+		MaxMessageSize: 10,
+	})
+	if err != nil {
+		t.Fatalf("analyze: %s", err)
+	}
+	if report.Commits != 2 || report.Trees != 4 || report.Blobs != 2 {
+		t.Fatalf("unexpected counts %d, %d, %d", report.Commits, report.Trees, report.Blobs)
+	}
+	if report.MaxBlobSize != 400 || report.MaxTreeEntries != 3 || report.MaxPathDepth != 4 || report.MaxMessageSize != 22 {
+		t.Fatalf("unexpected maximums %+v", report)
+	}
+	// The deep path is in both commits, but reported only once.
+	want := []*AnalyzeIssue{
+		{Kind: issueMessageSize, Sha: hex.EncodeToString(top), Value: 22, Limit: 10},
+		{Kind: issueTreeEntries, Sha: hex.EncodeToString(tree), Value: 3, Limit: 2},
+		{Kind: issueBlobSize, Sha: hex.EncodeToString(big), Path: "a/big.txt", Value: 400, Limit: 100},
+		{Kind: issuePathDepth, Sha: hex.EncodeToString(top), Path: "a/b/c/small.txt", Value: 4, Limit: 3},
+	}
+	if !reflect.DeepEqual(report.Issues, want) {
+		for _, issue := range report.Issues {
+			t.Logf("got %+v", issue)
+		}
+		t.Fatal("unexpected issues")
+	}
+}
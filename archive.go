@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArchiveOptions are settings of WriteTarArchive.
+type ArchiveOptions struct {
+	// Prefix is prepended to every path. A prefix ending with a slash is a
+	// directory, which is written to the archive as well.
+	Prefix string
+	// WorktreeAttributes reads .gitattributes files from the worktree
+	// instead of the archived tree.
+	WorktreeAttributes bool
+}
+
+// Sizes of the tar format, and the largest values that fit the ustar
+// header fields.
+const (
+	tarBlockSize   = 512
+	tarRecordSize  = 20 * tarBlockSize
+	tarMaxSize     = 077777777777
+	tarDefaultMask = 002
+)
+
+// WriteTarArchive writes the tree named by the revision as a tar archive,
+// the same way git archive does. When the revision is a commit, its hash is
+// stored in the pax global header and its committer date is used as the
+// modification time of all entries. Otherwise the current time is used.
+//
+// Paths with the export-ignore attribute are not archived, and $Format:...$
+// placeholders of files with the export-subst attribute are expanded with
+// formatCommit. Content is converted as it would be when checked out.
+func (r *Repository) WriteTarArchive(w io.Writer, rev string, opts *ArchiveOptions) error {
+	sha, err := r.Resolve(rev)
+	if err != nil {
+		return err
+	}
+	var commitSha []byte
+	var commit *CommitObject
+	mtime := time.Now().Unix()
+	if sha, err := r.peelObject(sha, "commit"); err == nil {
+		if commit, err = r.readCommit(sha); err != nil {
+			return err
+		}
+		commitSha = sha
+		committer, err := parseIdent(strings.Join(commit.Header["committer"], ""))
+		if err != nil {
+			return fmt.Errorf("commit %x: %w", sha, err)
+		}
+		mtime = committer.When.Unix()
+	}
+	treeSha, err := r.peelObject(sha, "tree")
+	if err != nil {
+		return fmt.Errorf("revision %q: %w", rev, err)
+	}
+	tree, err := r.readTree(treeSha)
+	if err != nil {
+		return err
+	}
+
+	umask, err := r.tarUmask()
+	if err != nil {
+		return err
+	}
+	var attrs *attrStack
+	if opts.WorktreeAttributes {
+		attrs, err = r.worktreeAttributes()
+	} else {
+		attrs, err = r.treeAttributes(tree)
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := &tarWriter{w: bufio.NewWriter(w), mtime: mtime}
+	if commitSha != nil {
+		header := paxRecord("comment", hex.EncodeToString(commitSha))
+		if err := tw.writeHeader("pax_global_header", 0100666, 'g', int64(len(header))); err != nil {
+			return err
+		}
+		if err := tw.writeBlocks(header); err != nil {
+			return err
+		}
+	}
+	if strings.HasSuffix(opts.Prefix, "/") {
+		prefix := opts.Prefix
+		for len(prefix) > 1 && prefix[len(prefix)-2] == '/' {
+			prefix = prefix[:len(prefix)-1]
+		}
+		if err := tw.writeEntry(treeSha, prefix, 040777&^umask, nil); err != nil {
+			return err
+		}
+	}
+
+	var writeTree func(tree *TreeObject, dir string) error
+	writeTree = func(tree *TreeObject, dir string) error {
+		for _, leaf := range tree.Leafs {
+			name := dir + leaf.Path
+			isDir := leaf.Mode == modeTree || leaf.Mode == modeGitlink
+			if isDir {
+				name += "/"
+			}
+			entryAttrs, err := attrs.Lookup(name)
+			if err != nil {
+				return err
+			}
+			if entryAttrs["export-ignore"] == attrSet {
+				continue
+			}
+			if isDir {
+				if err := tw.writeEntry(leaf.Sha, opts.Prefix+name, 040777&^umask, nil); err != nil {
+					return err
+				}
+				if leaf.Mode == modeGitlink {
+					// Submodule content lives in another repository.
+					continue
+				}
+				sub, err := r.readTree(leaf.Sha)
+				if err != nil {
+					return err
+				}
+				if err := writeTree(sub, name); err != nil {
+					return err
+				}
+				continue
+			}
+
+			_, content, err := r.ReadRawObject(leaf.Sha)
+			if err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			}
+			var mode int64
+			switch leaf.Mode {
+			case modeSymlink:
+				mode = 0120777
+			case modeExec:
+				mode = 0100777 &^ umask
+			default:
+				mode = 0100666 &^ umask
+				if commit != nil && entryAttrs["export-subst"] == attrSet {
+					content = expandFormatPlaceholders(content, commitSha, commit)
+				}
+				if content, err = r.convertToWorktree(entryAttrs, name, leaf.Sha, content); err != nil {
+					return err
+				}
+			}
+			if err := tw.writeEntry(leaf.Sha, opts.Prefix+name, mode, content); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := writeTree(tree, ""); err != nil {
+		return err
+	}
+	return tw.close()
+}
+
+// tarUmask returns the tar.umask setting, the permission bits that are
+// cleared from modes of archived files.
+func (r *Repository) tarUmask() (int64, error) {
+	value, ok := r.config.Get("tar", "", "umask")
+	if !ok {
+		return tarDefaultMask, nil
+	}
+	if value == "user" {
+		return 0, errors.New("tar.umask: umask of the process is not supported")
+	}
+	umask, err := strconv.ParseInt(value, 8, 64)
+	if err != nil {
+		return 0, fmt.Errorf("tar.umask: %w", err)
+	}
+	return umask, nil
+}
+
+// expandFormatPlaceholders replaces every $Format:<format>$ of the content
+// with the format expanded for the commit.
+func expandFormatPlaceholders(content []byte, sha []byte, c *CommitObject) []byte {
+	var b bytes.Buffer
+	for {
+		start := bytes.Index(content, []byte("$Format:"))
+		if start < 0 {
+			break
+		}
+		end := bytes.IndexByte(content[start+8:], '$')
+		if end < 0 {
+			break
+		}
+		b.Write(content[:start])
+		b.WriteString(formatCommit(string(content[start+8:start+8+end]), sha, c))
+		content = content[start+8+end+1:]
+	}
+	b.Write(content)
+	return b.Bytes()
+}
+
+// paxRecord returns an extended header record, prefixed with its length
+// that includes the length itself.
+func paxRecord(keyword, value string) []byte {
+	// One digit, a space, the equal sign and a newline, plus a digit for
+	// every power of ten the length reaches.
+	size := len(keyword) + len(value) + 4
+	for n := 1; size/10 >= n; n *= 10 {
+		size++
+	}
+	return []byte(fmt.Sprintf("%d %s=%s\n", size, keyword, value))
+}
+
+// tarWriter writes a tar stream with headers in the ustar format, in
+// records of 20 blocks.
+type tarWriter struct {
+	w       *bufio.Writer
+	mtime   int64
+	written int64
+}
+
+// writeEntry writes the header and the content of a file, a directory or a
+// symbolic link. Paths and link targets that do not fit the header are
+// written to a pax extended header, named after the object hash.
+func (tw *tarWriter) writeEntry(sha []byte, name string, mode int64, content []byte) error {
+	var typeflag byte
+	switch mode &^ 07777 {
+	case 040000:
+		typeflag = '5'
+	case 0120000:
+		typeflag = '2'
+	default:
+		typeflag = '0'
+	}
+
+	var ext []byte
+	headerName, prefix := name, ""
+	if len(name) > 100 {
+		if i := tarPathPrefix(name); i > 0 && len(name)-i-1 <= 100 {
+			prefix, headerName = name[:i], name[i+1:]
+		} else {
+			headerName = fmt.Sprintf("%x.data", sha)
+			ext = append(ext, paxRecord("path", name)...)
+		}
+	}
+	var linkname string
+	size := int64(len(content))
+	if typeflag == '2' {
+		linkname = string(content)
+		if len(linkname) > 100 {
+			linkname = fmt.Sprintf("see %x.paxheader", sha)
+			ext = append(ext, paxRecord("linkpath", string(content))...)
+		}
+		size = 0
+	} else if typeflag == '0' && size > tarMaxSize {
+		ext = append(ext, paxRecord("size", strconv.FormatInt(size, 10))...)
+		size = 0
+	}
+
+	if len(ext) != 0 {
+		if err := tw.writeHeader(fmt.Sprintf("%x.paxheader", sha), 0100666, 'x', int64(len(ext))); err != nil {
+			return err
+		}
+		if err := tw.writeBlocks(ext); err != nil {
+			return err
+		}
+	}
+	header := tw.header(headerName, mode, typeflag, size)
+	copy(header[157:257], linkname)
+	copy(header[345:500], prefix)
+	if err := tw.writeBlocks(tarChecksum(header)); err != nil {
+		return err
+	}
+	if typeflag == '0' {
+		return tw.writeBlocks(content)
+	}
+	return nil
+}
+
+// tarPathPrefix returns the position of the slash that splits a long path
+// into the prefix and the name fields of the header.
+func tarPathPrefix(name string) int {
+	i := len(name)
+	if i > 1 && name[i-1] == '/' {
+		i--
+	}
+	if i > 155 {
+		i = 155
+	}
+	for i--; i > 0 && name[i] != '/'; i-- {
+	}
+	return i
+}
+
+func (tw *tarWriter) header(name string, mode int64, typeflag byte, size int64) []byte {
+	header := make([]byte, tarBlockSize)
+	copy(header[0:100], name)
+	copy(header[100:108], fmt.Sprintf("%07o", mode&07777))
+	copy(header[108:116], fmt.Sprintf("%07o", 0))
+	copy(header[116:124], fmt.Sprintf("%07o", 0))
+	copy(header[124:136], fmt.Sprintf("%011o", size))
+	copy(header[136:148], fmt.Sprintf("%011o", tw.mtime))
+	header[156] = typeflag
+	copy(header[257:263], "ustar\x00")
+	copy(header[263:265], "00")
+	copy(header[265:297], "root")
+	copy(header[297:329], "root")
+	copy(header[329:337], fmt.Sprintf("%07o", 0))
+	copy(header[337:345], fmt.Sprintf("%07o", 0))
+	return header
+}
+
+func (tw *tarWriter) writeHeader(name string, mode int64, typeflag byte, size int64) error {
+	return tw.writeBlocks(tarChecksum(tw.header(name, mode, typeflag, size)))
+}
+
+// tarChecksum sets the checksum field of the header, computed with the
+// field itself filled with spaces.
+func tarChecksum(header []byte) []byte {
+	copy(header[148:156], "        ")
+	var sum int64
+	for _, c := range header {
+		sum += int64(c)
+	}
+	copy(header[148:156], fmt.Sprintf("%07o\x00", sum))
+	return header
+}
+
+// writeBlocks writes the data padded with zeros to the block size.
+func (tw *tarWriter) writeBlocks(data []byte) error {
+	if _, err := tw.w.Write(data); err != nil {
+		return err
+	}
+	if pad := len(data) % tarBlockSize; pad != 0 {
+		if _, err := tw.w.Write(make([]byte, tarBlockSize-pad)); err != nil {
+			return err
+		}
+		tw.written += int64(tarBlockSize - pad)
+	}
+	tw.written += int64(len(data))
+	return nil
+}
+
+// close writes the end of the archive, at least two zero blocks, padded to
+// the record size.
+func (tw *tarWriter) close() error {
+	tail := tarRecordSize - tw.written%tarRecordSize
+	if tail < 2*tarBlockSize {
+		tail += tarRecordSize
+	}
+	if _, err := tw.w.Write(make([]byte, tail)); err != nil {
+		return err
+	}
+	return tw.w.Flush()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestWriteTarArchive(t *testing.T) {
+	repo := newTestRepository(t)
+
+	files := []struct {
+		path    string
+		mode    os.FileMode
+		content string
+	}{
+		{".gitattributes", modeBlob, "VERSION export-subst\nsecret export-ignore\n*.bat eol=crlf\n"},
+		{"VERSION", modeBlob, "$Format:%s by %an$\n"},
+		{"bin/run", modeExec, "#!/bin/sh\n"},
+		{"link", modeSymlink, "bin/run"},
+		{"run.bat", modeBlob, "echo\n"},
+		{"secret/key", modeBlob, "secret\n"},
+	}
+	tb := NewTreeBuilder(repo, nil)
+	for _, f := range files {
+		blob, err := repo.WriteObject("blob", []byte(f.content))
+		if err != nil {
+			t.Fatalf("write blob: %s", err)
+		}
+		if err := tb.Insert(f.path, f.mode, blob); err != nil {
+			t.Fatalf("insert: %s", err)
+		}
+	}
+	tree, err := tb.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	raw, err := (&CommitObject{
+		Header: map[string][]string{
+			"tree":      {fmt.Sprintf("%x", tree)},
+			"author":    {"Test <test@example.com> 1600000000 +0000"},
+			"committer": {"Test <test@example.com> 1600000100 +0000"},
+		},
+		Comment: "Release\n",
+	}).Serialize()
+	if err != nil {
+		t.Fatalf("serialize commit: %s", err)
+	}
+	commit, err := repo.WriteObject("commit", raw)
+	if err != nil {
+		t.Fatalf("write commit: %s", err)
+	}
+
+	var b bytes.Buffer
+	if err := repo.WriteTarArchive(&b, fmt.Sprintf("%x", commit), &ArchiveOptions{Prefix: "p/"}); err != nil {
+		t.Fatalf("write archive: %s", err)
+	}
+	if b.Len()%tarRecordSize != 0 {
+		t.Errorf("archive size %d is not a multiple of the record size", b.Len())
+	}
+
+	type entry struct {
+		name     string
+		typeflag byte
+		mode     int64
+		content  string
+	}
+	var got []entry
+	rd := tar.NewReader(&b)
+	for {
+		h, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read archive: %s", err)
+		}
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			if want := fmt.Sprintf("%x", commit); h.PAXRecords["comment"] != want {
+				t.Errorf("want commit %s in the global header, got %v", want, h.PAXRecords)
+			}
+			continue
+		}
+		if h.ModTime.Unix() != 1600000100 {
+			t.Errorf("%s: want the commit time, got %s", h.Name, h.ModTime)
+		}
+		content, err := ioutil.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("read %s: %s", h.Name, err)
+		}
+		if h.Typeflag == tar.TypeSymlink {
+			content = []byte(h.Linkname)
+		}
+		got = append(got, entry{h.Name, h.Typeflag, h.Mode, string(content)})
+	}
+	want := []entry{
+		{"p/", tar.TypeDir, 0775, ""},
+		{"p/.gitattributes", tar.TypeReg, 0664, files[0].content},
+		{"p/VERSION", tar.TypeReg, 0664, "Release by Test\n"},
+		{"p/bin/", tar.TypeDir, 0775, ""},
+		{"p/bin/run", tar.TypeReg, 0775, "#!/bin/sh\n"},
+		{"p/link", tar.TypeSymlink, 0777, "bin/run"},
+		{"p/run.bat", tar.TypeReg, 0664, "echo\r\n"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want entries\n%v\ngot\n%v", want, got)
+	}
+}
+
+func TestPaxRecord(t *testing.T) {
+	cases := map[string]struct {
+		keyword string
+		value   string
+		want    string
+	}{
+		"short": {
+			keyword: "path",
+			value:   "a",
+			want:    "9 path=a\n",
+		},
+		"length reaches two digits": {
+			keyword: "path",
+			value:   "abc",
+			want:    "12 path=abc\n",
+		},
+		"comment": {
+			keyword: "comment",
+			value:   "0d4450fec727e89faa9f81cdd1ba15f236e8ce73",
+			want:    "52 comment=0d4450fec727e89faa9f81cdd1ba15f236e8ce73\n",
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if got := string(paxRecord(tc.keyword, tc.value)); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
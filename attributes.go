@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Attribute states other than a value. An attribute that no pattern
+// mentions is unspecified and is not present in the Attributes map.
+const (
+	attrSet   = "set"
+	attrUnset = "unset"
+)
+
+// Attributes are the gitattributes of a path, mapped to attrSet, attrUnset
+// or a value.
+type Attributes map[string]string
+
+// attrRule is a single line of a gitattributes file.
+type attrRule struct {
+	filePattern
+	attrs []attrAssignment
+}
+
+type attrAssignment struct {
+	name  string
+	value string
+	// unspecify is set for "!name", which removes an attribute set by
+	// rules of lower priority.
+	unspecify bool
+}
+
+// builtinAttrMacros are the macros defined by git.
+var builtinAttrMacros = map[string][]attrAssignment{
+	"binary": {
+		{name: "diff", value: attrUnset},
+		{name: "merge", value: attrUnset},
+		{name: "text", value: attrUnset},
+	},
+}
+
+// parseAttributes parses the content of a gitattributes file found in dir.
+// Macro definitions are added to macros. Negative patterns are not allowed,
+// so they are skipped.
+func parseAttributes(content []byte, dir string, macros map[string][]attrAssignment) []*attrRule {
+	var rules []*attrRule
+	lines := bufio.NewScanner(bytes.NewReader(content))
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var attrs []attrAssignment
+		for _, f := range fields[1:] {
+			switch {
+			case strings.HasPrefix(f, "-"):
+				attrs = append(attrs, attrAssignment{name: f[1:], value: attrUnset})
+			case strings.HasPrefix(f, "!"):
+				attrs = append(attrs, attrAssignment{name: f[1:], unspecify: true})
+			case strings.Contains(f, "="):
+				i := strings.IndexByte(f, '=')
+				attrs = append(attrs, attrAssignment{name: f[:i], value: f[i+1:]})
+			default:
+				attrs = append(attrs, attrAssignment{name: f, value: attrSet})
+			}
+		}
+
+		pattern := fields[0]
+		if strings.HasPrefix(pattern, "[attr]") {
+			// Macros can only be defined at the top level.
+			if dir == "" {
+				macros[strings.TrimPrefix(pattern, "[attr]")] = attrs
+			}
+			continue
+		}
+		if strings.HasPrefix(pattern, "!") {
+			continue
+		}
+		p, ok := parseFilePattern(pattern, dir)
+		if !ok {
+			continue
+		}
+		rules = append(rules, &attrRule{filePattern: p, attrs: attrs})
+	}
+	return rules
+}
+
+// attrStack is the list of gitattributes rules that apply to a worktree,
+// ordered from the lowest to the highest priority.
+type attrStack struct {
+	macros map[string][]attrAssignment
+	// global rules are of core.attributesFile, and info rules are of
+	// $GIT_DIR/info/attributes.
+	global []*attrRule
+	info   []*attrRule
+	// dirs are rules of .gitattributes files by the directory, loaded on
+	// first use.
+	dirs map[string][]*attrRule
+	// read returns the content of the .gitattributes file in the
+	// directory, or nil if there is none.
+	read func(dir string) ([]byte, error)
+}
+
+// worktreeAttributes returns the attributes stack of the worktree, reading
+// .gitattributes files from the disk.
+func (r *Repository) worktreeAttributes() (*attrStack, error) {
+	return r.newAttrStack(func(dir string) ([]byte, error) {
+		content, err := ioutil.ReadFile(filepath.Join(r.workdir, filepath.FromSlash(dir), ".gitattributes"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return content, err
+	})
+}
+
+// treeAttributes returns the attributes stack of the tree, reading
+// .gitattributes files from the tree instead of the worktree.
+func (r *Repository) treeAttributes(tr *TreeObject) (*attrStack, error) {
+	return r.newAttrStack(func(dir string) ([]byte, error) {
+		leaf, err := r.lookupTreePath(tr, path.Join(dir, ".gitattributes"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if leaf.Mode != modeBlob && leaf.Mode != modeExec {
+			return nil, nil
+		}
+		_, content, err := r.ReadRawObject(leaf.Sha)
+		return content, err
+	})
+}
+
+// newAttrStack returns the attributes stack with .gitattributes files read
+// by the read function, together with the core.attributesFile and
+// $GIT_DIR/info/attributes files.
+func (r *Repository) newAttrStack(read func(dir string) ([]byte, error)) (*attrStack, error) {
+	s := &attrStack{
+		macros: make(map[string][]attrAssignment),
+		dirs:   make(map[string][]*attrRule),
+		read:   read,
+	}
+	for name, attrs := range builtinAttrMacros {
+		s.macros[name] = attrs
+	}
+	file, ok, err := r.config.Path("core", "", "attributesFile")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		content, err := ioutil.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read attributes: %w", err)
+		}
+		s.global = parseAttributes(content, "", s.macros)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(r.gitdir, "info", "attributes"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read attributes: %w", err)
+	}
+	s.info = parseAttributes(content, "", s.macros)
+	// Macros of the top level file must be known before any rule is
+	// applied.
+	if _, err := s.dirRules(""); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *attrStack) dirRules(dir string) ([]*attrRule, error) {
+	if rules, ok := s.dirs[dir]; ok {
+		return rules, nil
+	}
+	content, err := s.read(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path.Join(dir, ".gitattributes"), err)
+	}
+	rules := parseAttributes(content, dir, s.macros)
+	s.dirs[dir] = rules
+	return rules, nil
+}
+
+// Lookup returns attributes of the path relative to the worktree root. The
+// path of a directory must end with a slash. Rules of deeper .gitattributes
+// files take precedence, and within a file later lines take precedence over
+// earlier ones. Attributes of a directory do not apply to its content.
+func (s *attrStack) Lookup(name string) (Attributes, error) {
+	levels := [][]*attrRule{s.global}
+	dirs := []string{""}
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	for _, dir := range dirs {
+		rules, err := s.dirRules(dir)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, rules)
+	}
+	levels = append(levels, s.info)
+
+	attrs := make(Attributes)
+	for _, rules := range levels {
+		for _, rule := range rules {
+			if rule.match(name) {
+				s.apply(attrs, rule.attrs, 0)
+			}
+		}
+	}
+	return attrs, nil
+}
+
+func (s *attrStack) apply(attrs Attributes, assignments []attrAssignment, depth int) {
+	for _, a := range assignments {
+		if a.unspecify {
+			delete(attrs, a.name)
+			continue
+		}
+		attrs[a.name] = a.value
+		// Setting a macro sets all attributes it stands for. Recursion is
+		// limited in case macros refer to each other.
+		if macro, ok := s.macros[a.name]; ok && a.value == attrSet && depth < 10 {
+			s.apply(attrs, macro, depth+1)
+		}
+	}
+}
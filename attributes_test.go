@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAttributesLookup(t *testing.T) {
+	files := map[string]string{
+		"": "*.txt text\n" +
+			"*.bin binary\n" +
+			"[attr]crlf-text text eol=crlf\n" +
+			"*.bat crlf-text\n" +
+			"/top.c -text\n" +
+			"docs/*.md diff=markdown\n" +
+			"build/ -text\n",
+		"sub": "*.txt !text eol=lf\n" +
+			"[attr]ignored text\n" +
+			"*.ign ignored\n",
+	}
+	stack := &attrStack{
+		macros: map[string][]attrAssignment{"binary": builtinAttrMacros["binary"]},
+		dirs:   make(map[string][]*attrRule),
+		read: func(dir string) ([]byte, error) {
+			return []byte(files[dir]), nil
+		},
+		info: parseAttributes([]byte("*.log -diff\n"), "", nil),
+	}
+
+	cases := map[string]struct {
+		path string
+		want Attributes
+	}{
+		"basename at the top": {
+			path: "a.txt",
+			want: Attributes{"text": attrSet},
+		},
+		"basename in a subdirectory": {
+			path: "x/y/a.txt",
+			want: Attributes{"text": attrSet},
+		},
+		"builtin macro": {
+			path: "data.bin",
+			want: Attributes{"binary": attrSet, "diff": attrUnset, "merge": attrUnset, "text": attrUnset},
+		},
+		"user macro": {
+			path: "run.bat",
+			want: Attributes{"crlf-text": attrSet, "text": attrSet, "eol": "crlf"},
+		},
+		"anchored pattern": {
+			path: "top.c",
+			want: Attributes{"text": attrUnset},
+		},
+		"anchored pattern does not match below": {
+			path: "x/top.c",
+			want: Attributes{},
+		},
+		"pattern with directory": {
+			path: "docs/a.md",
+			want: Attributes{"diff": "markdown"},
+		},
+		"directory pattern does not match files": {
+			path: "build/a.o",
+			want: Attributes{},
+		},
+		"directory pattern": {
+			path: "build/",
+			want: Attributes{"text": attrUnset},
+		},
+		"deeper file overrides": {
+			path: "sub/a.txt",
+			want: Attributes{"eol": "lf"},
+		},
+		"macros are not defined in subdirectories": {
+			path: "sub/a.ign",
+			want: Attributes{"ignored": attrSet},
+		},
+		"info attributes": {
+			path: "sub/x.log",
+			want: Attributes{"diff": attrUnset},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := stack.Lookup(tc.path)
+			if err != nil {
+				t.Fatalf("lookup: %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
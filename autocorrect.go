@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+type commandFunc = func(input io.Reader, output io.Writer, args []string) error
+
+// commandConfig returns the configuration a command name is resolved with:
+// the one of the current repository, or only the global one outside of a
+// repository.
+func commandConfig() *Config {
+	if repo, err := FindRepository("."); err == nil {
+		return repo.config
+	}
+	c, err := loadConfig("")
+	if err != nil {
+		return &Config{}
+	}
+	return c
+}
+
+// lookupCommand returns the command of given name, or of the alias.<name>
+// variable, with the arguments the alias is expanded to prepended. An alias
+// starting with "!" is a shell command, run with the arguments. Aliases
+// cannot shadow commands, and cannot be expanded to other aliases.
+func lookupCommand(config *Config, name string, args []string) (commandFunc, []string, bool) {
+	if run, ok := commands[name]; ok {
+		return run, args, true
+	}
+	value, ok := config.Get("alias", "", name)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, nil, false
+	}
+	if strings.HasPrefix(value, "!") {
+		return shellAlias(value[1:]), args, true
+	}
+	fields := strings.Fields(value)
+	run, ok := commands[fields[0]]
+	if !ok {
+		return nil, nil, false
+	}
+	return run, append(fields[1:], args...), true
+}
+
+// shellAlias returns a command that runs the shell command with the
+// arguments appended, same as git does.
+func shellAlias(shell string) commandFunc {
+	return func(input io.Reader, output io.Writer, args []string) error {
+		script := shell
+		if len(args) != 0 {
+			script += ` "$@"`
+		}
+		cmd := exec.Command("sh", append([]string{"-c", script, shell}, args...)...)
+		cmd.Stdin = input
+		cmd.Stdout = output
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return exitCode(exitErr.ExitCode())
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// similarityFloor is the edit distance from which a command is not
+// suggested, same as in git.
+const similarityFloor = 7
+
+// similarCommands returns the names closest to the unknown command, or nil
+// if none is close enough. Distances are computed as in git, with
+// insertions cheaper than substitutions and deletions, transpositions for
+// free, and names starting with the unknown command being the closest.
+func similarCommands(name string, candidates []string) []string {
+	dist := make(map[string]int, len(candidates))
+	for _, c := range candidates {
+		if strings.HasPrefix(c, name) {
+			dist[c] = 0
+		} else {
+			dist[c] = levenshtein(name, c, 0, 2, 1, 3) + 1
+		}
+	}
+	sorted := append([]string(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if dist[sorted[i]] != dist[sorted[j]] {
+			return dist[sorted[i]] < dist[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+	if len(sorted) == 0 || dist[sorted[0]] >= similarityFloor {
+		return nil
+	}
+	n := 1
+	for n < len(sorted) && dist[sorted[n]] == dist[sorted[0]] {
+		n++
+	}
+	return sorted[:n]
+}
+
+// levenshtein returns the edit distance between two strings, with the given
+// costs of swapping two adjacent characters, substituting, inserting and
+// deleting one.
+func levenshtein(a, b string, swap, substitution, insertion, deletion int) int {
+	row0 := make([]int, len(b)+1)
+	row1 := make([]int, len(b)+1)
+	row2 := make([]int, len(b)+1)
+	for j := range row1 {
+		row1[j] = j * insertion
+	}
+	for i := 0; i < len(a); i++ {
+		row2[0] = (i + 1) * deletion
+		for j := 0; j < len(b); j++ {
+			row2[j+1] = row1[j]
+			if a[i] != b[j] {
+				row2[j+1] += substitution
+			}
+			if i > 0 && j > 0 && a[i-1] == b[j] && a[i] == b[j-1] && row2[j+1] > row0[j-1]+swap {
+				row2[j+1] = row0[j-1] + swap
+			}
+			if row2[j+1] > row1[j+1]+deletion {
+				row2[j+1] = row1[j+1] + deletion
+			}
+			if row2[j+1] > row2[j]+insertion {
+				row2[j+1] = row2[j] + insertion
+			}
+		}
+		row0, row1, row2 = row1, row2, row0
+	}
+	return row1[len(b)]
+}
+
+// autocorrect is the help.autocorrect setting.
+type autocorrect struct {
+	// never disables suggestions. Otherwise the only suggestion is run
+	// if immediate is set, after asking if prompt is set, or after the
+	// delay if it is positive.
+	never     bool
+	immediate bool
+	prompt    bool
+	delay     time.Duration
+}
+
+// parseAutocorrect parses help.autocorrect: a boolean, "never", "prompt",
+// "immediate" or a number of deciseconds to wait before running the
+// suggestion, where a negative number or one runs it immediately and zero
+// only suggests.
+func parseAutocorrect(config *Config) (autocorrect, error) {
+	value, ok := config.Get("help", "", "autocorrect")
+	if !ok {
+		return autocorrect{}, nil
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "immediate":
+		return autocorrect{immediate: true}, nil
+	case "false", "no", "off":
+		return autocorrect{}, nil
+	case "never":
+		return autocorrect{never: true}, nil
+	case "prompt":
+		return autocorrect{prompt: true}, nil
+	}
+	n, err := parseConfigInt(value)
+	if err != nil {
+		return autocorrect{}, fmt.Errorf("help.autocorrect: %w", err)
+	}
+	if n < 0 || n == 1 {
+		return autocorrect{immediate: true}, nil
+	}
+	return autocorrect{delay: time.Duration(n) * 100 * time.Millisecond}, nil
+}
+
+// correctCommand returns the command to run instead of an unknown one, if
+// help.autocorrect allows running the only most similar command or alias.
+// Otherwise the similar names are suggested.
+func correctCommand(config *Config, name string, args []string, input io.Reader, stderr io.Writer) (commandFunc, []string, bool) {
+	ac, err := parseAutocorrect(config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+	}
+	var similar []string
+	if !ac.never {
+		candidates := availableCmds()
+		for _, e := range config.Entries {
+			if e.Section == "alias" && e.Subsection == "" {
+				if _, ok := commands[e.Key]; !ok {
+					candidates = append(candidates, e.Key)
+				}
+			}
+		}
+		similar = similarCommands(name, candidates)
+	}
+	if len(similar) == 1 && (ac.immediate || ac.prompt || ac.delay > 0) {
+		if run, args, ok := lookupCommand(config, similar[0], args); ok {
+			fmt.Fprintf(stderr, "WARNING: You called a command named %q, which does not exist.\n", name)
+			switch {
+			case ac.immediate:
+				fmt.Fprintf(stderr, "Continuing under the assumption that you meant %q.\n", similar[0])
+				return run, args, true
+			case ac.prompt:
+				fmt.Fprintf(stderr, "Run %q instead [y/N]? ", similar[0])
+				answer, _ := bufio.NewReader(input).ReadString('\n')
+				if strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+					return run, args, true
+				}
+			default:
+				fmt.Fprintf(stderr, "Continuing in %.1f seconds, assuming that you meant %q.\n", ac.delay.Seconds(), similar[0])
+				time.Sleep(ac.delay)
+				return run, args, true
+			}
+		}
+	}
+
+	fmt.Fprintf(stderr, "Unknown command %q\n", name)
+	switch len(similar) {
+	case 0:
+		fmt.Fprintf(stderr, "\nAvailable commands are:\n\t%s\n", strings.Join(availableCmds(), "\n\t"))
+	case 1:
+		fmt.Fprintf(stderr, "\nThe most similar command is\n\t%s\n", similar[0])
+	default:
+		fmt.Fprintf(stderr, "\nThe most similar commands are\n\t%s\n", strings.Join(similar, "\n\t"))
+	}
+	return nil, nil, false
+}
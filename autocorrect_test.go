@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimilarCommands(t *testing.T) {
+	candidates := []string{"checkout", "cherry", "clone", "commit-graph", "config", "fetch", "ls-files", "ls-tree", "st"}
+	cases := map[string][]string{
+		"chekout":  {"checkout"},
+		"checkotu": {"checkout"},
+		"cofnig":   {"config"},
+		"ls":       {"ls-files", "ls-tree"},
+		"fecth":    {"fetch"},
+		"zzzzzzzz": nil,
+		"s":        {"st"},
+	}
+	for name, want := range cases {
+		if got := similarCommands(name, candidates); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "abc", 3},
+		{"abc", "", 9},
+		{"abc", "abc", 0},
+		{"abc", "abd", 2},
+		{"abc", "acb", 0},
+		{"ac", "abc", 1},
+	}
+	for _, tc := range cases {
+		if got := levenshtein(tc.a, tc.b, 0, 2, 1, 3); got != tc.want {
+			t.Errorf("%q %q: want %d, got %d", tc.a, tc.b, tc.want, got)
+		}
+	}
+}
+
+func TestParseAutocorrect(t *testing.T) {
+	cases := map[string]struct {
+		value   string
+		want    autocorrect
+		wantErr bool
+	}{
+		"unset":     {want: autocorrect{}},
+		"zero":      {value: "0", want: autocorrect{}},
+		"false":     {value: "false", want: autocorrect{}},
+		"one":       {value: "1", want: autocorrect{immediate: true}},
+		"negative":  {value: "-1", want: autocorrect{immediate: true}},
+		"true":      {value: "true", want: autocorrect{immediate: true}},
+		"immediate": {value: "immediate", want: autocorrect{immediate: true}},
+		"never":     {value: "never", want: autocorrect{never: true}},
+		"prompt":    {value: "prompt", want: autocorrect{prompt: true}},
+		"delay":     {value: "15", want: autocorrect{delay: 1500 * time.Millisecond}},
+		"invalid":   {value: "soon", wantErr: true},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			config := ""
+			if tc.value != "" {
+				config = "[help]\nautocorrect = " + tc.value + "\n"
+			}
+			c, err := ParseConfig(strings.NewReader(config))
+			if err != nil {
+				t.Fatalf("parse config: %s", err)
+			}
+			got, err := parseAutocorrect(c)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Changed-path Bloom filters are stored in the commit-graph, one for every
+// commit. A filter holds the paths that changed between the commit and its
+// first parent, together with all their leading directories, so that a
+// path limited walk can skip commits that certainly did not touch the
+// path without comparing their trees.
+//
+// The BIDX chunk has the cumulative end offset of each filter in the BDAT
+// chunk. The BDAT chunk starts with a 12 byte header: the hash version,
+// the number of hashes and the number of bits per entry.
+const (
+	bloomHashVersion     = 1
+	bloomNumHashes       = 7
+	bloomBitsPerEntry    = 10
+	bloomHeaderSize      = 12
+	bloomMaxChangedPaths = 512
+
+	bloomSeed0 = 0x293ae76f
+	bloomSeed1 = 0x7e646e2c
+)
+
+var (
+	chunkBloomIndex = chunkID("BIDX")
+	chunkBloomData  = chunkID("BDAT")
+)
+
+// bloomKey is the set of bit positions of a path, before they are reduced
+// to the size of a filter.
+type bloomKey [bloomNumHashes]uint32
+
+func newBloomKey(path string) bloomKey {
+	h0 := murmur3Seeded(bloomSeed0, path)
+	h1 := murmur3Seeded(bloomSeed1, path)
+	var k bloomKey
+	for i := range k {
+		k[i] = h0 + uint32(i)*h1
+	}
+	return k
+}
+
+// murmur3Seeded is the 32 bit MurmurHash3 as computed by git for version 1
+// filters, which sign extends bytes of the data.
+func murmur3Seeded(seed uint32, data string) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	signed := func(b byte) uint32 { return uint32(int32(int8(b))) }
+	mix := func(k uint32) uint32 {
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		return k * c2
+	}
+
+	n := len(data) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := signed(data[i]) | signed(data[i+1])<<8 | signed(data[i+2])<<16 | signed(data[i+3])<<24
+		seed ^= mix(k)
+		seed = bits.RotateLeft32(seed, 13)*5 + 0xe6546b64
+	}
+	var k uint32
+	switch len(data) - n {
+	case 3:
+		k ^= signed(data[n+2]) << 16
+		fallthrough
+	case 2:
+		k ^= signed(data[n+1]) << 8
+		fallthrough
+	case 1:
+		k ^= signed(data[n])
+		seed ^= mix(k)
+	}
+
+	seed ^= uint32(len(data))
+	seed ^= seed >> 16
+	seed *= 0x85ebca6b
+	seed ^= seed >> 13
+	seed *= 0xc2b2ae35
+	seed ^= seed >> 16
+	return seed
+}
+
+// bloomFilter is the content of a single changed-path filter.
+type bloomFilter []byte
+
+// newBloomFilter returns a filter with the paths. A filter with too many
+// paths is a single byte with all bits set, which contains every path.
+func newBloomFilter(paths []string) bloomFilter {
+	if len(paths) > bloomMaxChangedPaths {
+		return bloomFilter{0xff}
+	}
+	size := (len(paths)*bloomBitsPerEntry + 7) / 8
+	if size == 0 {
+		size = 1
+	}
+	f := make(bloomFilter, size)
+	for _, path := range paths {
+		f.add(newBloomKey(path))
+	}
+	return f
+}
+
+func (f bloomFilter) add(k bloomKey) {
+	mod := uint64(len(f)) * 8
+	for _, h := range k {
+		pos := uint64(h) % mod
+		f[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+// contains returns false if the path of the key is certainly not in the
+// filter.
+func (f bloomFilter) contains(k bloomKey) bool {
+	mod := uint64(len(f)) * 8
+	for _, h := range k {
+		pos := uint64(h) % mod
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomPaths returns the changed paths and all their leading directories,
+// which are added to the filter of a commit.
+func bloomPaths(changes []*FileChange) []string {
+	seen := make(map[string]struct{})
+	var paths []string
+	for _, c := range changes {
+		for p := c.Path; p != ""; {
+			if _, ok := seen[p]; ok {
+				break
+			}
+			seen[p] = struct{}{}
+			paths = append(paths, p)
+			end := strings.LastIndexByte(p, '/')
+			if end == -1 {
+				break
+			}
+			p = p[:end]
+		}
+	}
+	return paths
+}
+
+// changedPathsFilter computes the filter of a commit with the given root
+// tree and the root tree of its first parent, which is nil for a root
+// commit.
+func (r *Repository) changedPathsFilter(tree, parent []byte) (bloomFilter, error) {
+	b, err := r.readTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	var a *TreeObject
+	if parent != nil {
+		if a, err = r.readTree(parent); err != nil {
+			return nil, err
+		}
+	}
+	changes, err := r.DiffTrees(a, b, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newBloomFilter(bloomPaths(changes)), nil
+}
+
+// parseBloomChunks checks the changed-path chunks of a commit-graph with
+// count commits. Filters of an unknown hash version are not used.
+func parseBloomChunks(index, data []byte, count int) ([]byte, []byte, error) {
+	if len(index) != 4*count {
+		return nil, nil, fmt.Errorf("chunk %s: invalid size %d", chunkName(chunkBloomIndex), len(index))
+	}
+	if len(data) < bloomHeaderSize {
+		return nil, nil, fmt.Errorf("chunk %s: invalid size %d", chunkName(chunkBloomData), len(data))
+	}
+	version := binary.BigEndian.Uint32(data)
+	hashes := binary.BigEndian.Uint32(data[4:])
+	perEntry := binary.BigEndian.Uint32(data[8:])
+	if version != bloomHashVersion || hashes != bloomNumHashes || perEntry != bloomBitsPerEntry {
+		return nil, nil, nil
+	}
+	return index, data[bloomHeaderSize:], nil
+}
+
+// bloomFilter returns the changed-path filter of the commit at given
+// position, if it has a valid one.
+func (g *commitGraph) bloomFilter(pos int) (bloomFilter, bool) {
+	if g.bloomIndex == nil {
+		return nil, false
+	}
+	start := uint32(0)
+	if pos > 0 {
+		start = binary.BigEndian.Uint32(g.bloomIndex[4*(pos-1):])
+	}
+	end := binary.BigEndian.Uint32(g.bloomIndex[4*pos:])
+	if start >= end || int(end) > len(g.bloomData) {
+		return nil, false
+	}
+	return g.bloomData[start:end], true
+}
+
+// bloomPathspecKeys returns the keys of each pattern of the pathspec, for
+// the pattern and all its leading directories. Nil is returned if the
+// pathspec cannot be matched with filters, because a pattern is not a
+// literal path.
+func bloomPathspecKeys(ps *Pathspec) [][]bloomKey {
+	if ps.IsEmpty() {
+		return nil
+	}
+	keys := make([][]bloomKey, 0, len(ps.items))
+	for _, item := range ps.items {
+		pattern := strings.TrimSuffix(item.pattern, "/")
+		if item.exclude || item.icase || pattern == "" || pattern == "." {
+			return nil
+		}
+		if !item.literal && strings.ContainsAny(pattern, "*?[\\") {
+			return nil
+		}
+		var k []bloomKey
+		for p := pattern; ; {
+			k = append(k, newBloomKey(p))
+			end := strings.LastIndexByte(p, '/')
+			if end == -1 {
+				break
+			}
+			p = p[:end]
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// maybeChangedPaths returns false if the commit certainly did not change
+// any of the paths of the keys, compared to its first parent. Ok is false
+// if there is no filter to tell.
+func (r *Repository) maybeChangedPaths(sha []byte, keys [][]bloomKey) (maybe, ok bool) {
+	g := r.loadCommitGraph()
+	if g == nil || keys == nil {
+		return true, false
+	}
+	pos, found := g.lookup(sha)
+	if !found {
+		return true, false
+	}
+	f, found := g.bloomFilter(pos)
+	if !found {
+		return true, false
+	}
+	for _, path := range keys {
+		contains := true
+		for _, k := range path {
+			if !f.contains(k) {
+				contains = false
+				break
+			}
+		}
+		if contains {
+			return true, true
+		}
+	}
+	return false, true
+}
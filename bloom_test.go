@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMurmur3Seeded(t *testing.T) {
+	// Same values as the murmur3 tests of git.
+	cases := map[string]uint32{
+		"":             0x00000000,
+		"Hello world!": 0x627b0c2c,
+		"The quick brown fox jumps over the lazy dog": 0x2e4ff723,
+	}
+	for data, want := range cases {
+		if got := murmur3Seeded(0, data); got != want {
+			t.Errorf("%q: want %08x, got %08x", data, want, got)
+		}
+	}
+}
+
+func TestRevWalkPaths(t *testing.T) {
+	repo := newTestRepository(t)
+
+	names := make(map[string]string)
+	commit := func(name string, files map[string]string, parents ...[]byte) []byte {
+		tb := NewTreeBuilder(repo, nil)
+		for path, content := range files {
+			blob, err := repo.WriteObject("blob", []byte(content))
+			if err != nil {
+				t.Fatalf("write blob: %s", err)
+			}
+			if err := tb.Insert(path, modeBlob, blob); err != nil {
+				t.Fatalf("insert: %s", err)
+			}
+		}
+		tree, err := tb.Write()
+		if err != nil {
+			t.Fatalf("write tree: %s", err)
+		}
+		header := map[string][]string{
+			"tree":      {fmt.Sprintf("%x", tree)},
+			"author":    {"Test <test@example.com> 1600000000 +0000"},
+			"committer": {"Test <test@example.com> 1600000000 +0000"},
+		}
+		for _, p := range parents {
+			header["parent"] = append(header["parent"], fmt.Sprintf("%x", p))
+		}
+		raw, err := (&CommitObject{Header: header, Comment: name + "\n"}).Serialize()
+		if err != nil {
+			t.Fatalf("serialize commit: %s", err)
+		}
+		sha, err := repo.WriteObject("commit", raw)
+		if err != nil {
+			t.Fatalf("write commit: %s", err)
+		}
+		names[string(sha)] = name
+		return sha
+	}
+	base := commit("base", map[string]string{"a/b/c": "1", "d": "1"})
+	trunk := commit("trunk", map[string]string{"a/b/c": "2", "d": "1"}, base)
+	side := commit("side", map[string]string{"a/b/c": "1", "d": "2"}, base)
+	merge := commit("merge", map[string]string{"a/b/c": "2", "d": "2"}, trunk, side)
+	top := commit("top", map[string]string{"a/b/c": "2", "d": "2", "e": "1"}, merge)
+
+	cases := map[string]struct {
+		paths []string
+		want  []string
+	}{
+		"file":             {paths: []string{"a/b/c"}, want: []string{"trunk", "base"}},
+		"leading dir":      {paths: []string{"a"}, want: []string{"trunk", "base"}},
+		"trailing slash":   {paths: []string{"a/b/"}, want: []string{"trunk", "base"}},
+		"other parent":     {paths: []string{"d"}, want: []string{"side", "base"}},
+		"both":             {paths: []string{"a", "d"}, want: []string{"merge", "trunk", "side", "base"}},
+		"new file":         {paths: []string{"e"}, want: []string{"top"}},
+		"missing":          {paths: []string{"a/x"}, want: nil},
+		"prefix of a name": {paths: []string{"a/b/c/d"}, want: nil},
+		"glob":             {paths: []string{"?"}, want: []string{"top", "side", "base"}},
+	}
+	walk := func(t *testing.T, paths []string) []string {
+		ps, err := ParsePathspec("", paths)
+		if err != nil {
+			t.Fatalf("parse pathspec: %s", err)
+		}
+		w, err := repo.NewRevWalk([][]byte{top})
+		if err != nil {
+			t.Fatalf("new walk: %s", err)
+		}
+		w.Paths = ps
+		var got []string
+		for {
+			c, err := w.Next()
+			if err == io.EOF {
+				return got
+			}
+			if err != nil {
+				t.Fatalf("next: %s", err)
+			}
+			got = append(got, names[string(c.Sha)])
+		}
+	}
+	for _, changedPaths := range []bool{false, true} {
+		if err := repo.WriteCommitGraph([][]byte{top}, changedPaths); err != nil {
+			t.Fatalf("write commit graph: %s", err)
+		}
+		if g := repo.loadCommitGraph(); (g.bloomIndex != nil) != changedPaths {
+			t.Fatalf("want changed paths %v, got %v", changedPaths, g.bloomIndex != nil)
+		}
+		for testName, tc := range cases {
+			t.Run(fmt.Sprintf("%s changed paths %v", testName, changedPaths), func(t *testing.T) {
+				if got := walk(t, tc.paths); !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("want %q, got %q", tc.want, got)
+				}
+			})
+		}
+	}
+
+	// Filters rule out paths, so a commit that is not in its own filter
+	// is walked as if it did not change anything.
+	g := repo.loadCommitGraph()
+	keys := bloomPathspecKeys(&Pathspec{items: []pathspecItem{{pattern: "d"}}})
+	if maybe, ok := repo.maybeChangedPaths(trunk, keys); !ok || maybe {
+		t.Fatalf("trunk: want d ruled out, got maybe %v, ok %v", maybe, ok)
+	}
+	if maybe, ok := repo.maybeChangedPaths(side, keys); !ok || !maybe {
+		t.Fatalf("side: want d not ruled out, got maybe %v, ok %v", maybe, ok)
+	}
+	pos, _ := g.lookup(side)
+	f, _ := g.bloomFilter(pos)
+	for i := range f {
+		f[i] = 0
+	}
+	if got := walk(t, []string{"d"}); !reflect.DeepEqual(got, []string{"base"}) {
+		t.Fatalf("want only base with a cleared filter, got %q", got)
+	}
+}
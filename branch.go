@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errNotMerged is returned when deleting a branch with commits not in HEAD.
+var errNotMerged = errors.New("not fully merged")
+
+// validateBranchName checks that the short name can be used for a branch.
+func validateBranchName(name string) error {
+	if name == "HEAD" || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("%q is not a valid branch name", name)
+	}
+	return ValidateRefName("refs/heads/" + name)
+}
+
+// branchExists tells whether the branch, given by its short name, exists.
+func (r *Repository) branchExists(name string) (bool, error) {
+	switch _, err := r.ReadRef("refs/heads/" + name); {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// CreateBranch creates the branch, given by its short name, pointing to the
+// commit. It fails if the branch exists already.
+func (r *Repository) CreateBranch(name string, sha []byte) error {
+	if err := validateBranchName(name); err != nil {
+		return err
+	}
+	if ok, err := r.branchExists(name); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("a branch named %q already exists", name)
+	}
+	return r.UpdateRefs(&RefUpdate{Name: "refs/heads/" + name, Sha: sha})
+}
+
+// DeleteBranch removes the branch, given by its short name, and returns the
+// commit it pointed to. The branch HEAD points to cannot be deleted. Unless
+// force is set, the branch must be merged into HEAD, so that no commits are
+// lost.
+func (r *Repository) DeleteBranch(name string, force bool) ([]byte, error) {
+	ref := "refs/heads/" + name
+	sha, err := r.resolveRef(ref)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("branch %q not found", name)
+	} else if err != nil {
+		return nil, err
+	}
+	current, head, err := r.headBranch()
+	if err != nil {
+		return nil, err
+	}
+	if current == ref {
+		return nil, fmt.Errorf("cannot delete branch %q checked out at %q", name, r.workdir)
+	}
+	if !force {
+		merged := false
+		if head != nil {
+			if merged, err = r.IsAncestor(sha, head); err != nil {
+				return nil, err
+			}
+		}
+		if !merged {
+			return nil, fmt.Errorf("the branch %q is %w", name, errNotMerged)
+		}
+	}
+	if err := r.UpdateRefs(&RefUpdate{Name: ref, OldSha: sha}); err != nil {
+		return nil, err
+	}
+	return sha, nil
+}
+
+// RenameBranch renames the branch, given by short names. HEAD follows the
+// branch if it points to it, even if the branch has no commits yet. Unless
+// force is set, no branch can exist with the new name.
+func (r *Repository) RenameBranch(oldName, newName string, force bool) error {
+	if err := validateBranchName(newName); err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+	oldRef, newRef := "refs/heads/"+oldName, "refs/heads/"+newName
+	current, _, err := r.headBranch()
+	if err != nil {
+		return err
+	}
+	if ok, err := r.branchExists(newName); err != nil {
+		return err
+	} else if ok && !force {
+		return fmt.Errorf("a branch named %q already exists", newName)
+	} else if ok && current == newRef {
+		return fmt.Errorf("cannot force update the current branch %q", newName)
+	}
+
+	var updates []*RefUpdate
+	switch sha, err := r.resolveRef(oldRef); {
+	case err == nil:
+		updates = append(updates, &RefUpdate{Name: newRef, Sha: sha}, &RefUpdate{Name: oldRef, OldSha: sha})
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	case current != oldRef:
+		return fmt.Errorf("branch %q not found", oldName)
+	}
+	if current == oldRef {
+		updates = append(updates, &RefUpdate{Name: "HEAD", Target: newRef})
+	}
+	return r.UpdateRefs(updates...)
+}
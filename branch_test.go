@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestBranches(t *testing.T) {
+	repo := newTestRepository(t)
+	base := writeTestCommit(t, repo, "base")
+	side := writeTestCommit(t, repo, "side", base)
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: base}); err != nil {
+		t.Fatalf("update master: %s", err)
+	}
+	assertBranch := func(name string, want []byte) {
+		t.Helper()
+		sha, err := repo.resolveRef("refs/heads/" + name)
+		if want == nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("branch %s: want none, got %x, %v", name, sha, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("branch %s: %s", name, err)
+		}
+		if !bytes.Equal(sha, want) {
+			t.Fatalf("branch %s: want %x, got %x", name, want, sha)
+		}
+	}
+
+	if err := repo.CreateBranch("side", side); err != nil {
+		t.Fatalf("create side: %s", err)
+	}
+	assertBranch("side", side)
+	if err := repo.CreateBranch("side", base); err == nil {
+		t.Fatal("created existing branch")
+	}
+	for _, name := range []string{"HEAD", "-x", "a..b", "a.lock"} {
+		if err := repo.CreateBranch(name, base); err == nil {
+			t.Errorf("created branch %q", name)
+		}
+	}
+
+	if _, err := repo.DeleteBranch("side", false); !errors.Is(err, errNotMerged) {
+		t.Fatalf("delete unmerged branch: want not merged error, got %v", err)
+	}
+	if _, err := repo.DeleteBranch("master", true); err == nil {
+		t.Fatal("deleted the current branch")
+	}
+	if err := repo.RenameBranch("side", "master", false); err == nil {
+		t.Fatal("renamed onto an existing branch")
+	}
+	if err := repo.RenameBranch("side", "feature", false); err != nil {
+		t.Fatalf("rename side: %s", err)
+	}
+	assertBranch("side", nil)
+	assertBranch("feature", side)
+	if sha, err := repo.DeleteBranch("feature", true); err != nil {
+		t.Fatalf("delete feature: %s", err)
+	} else if !bytes.Equal(sha, side) {
+		t.Fatalf("delete feature: want %x, got %x", side, sha)
+	}
+	assertBranch("feature", nil)
+
+	if err := repo.CreateBranch("merged", base); err != nil {
+		t.Fatalf("create merged: %s", err)
+	}
+	if _, err := repo.DeleteBranch("merged", false); err != nil {
+		t.Fatalf("delete merged: %s", err)
+	}
+	assertBranch("merged", nil)
+
+	// HEAD follows the renamed current branch.
+	if err := repo.RenameBranch("master", "main", false); err != nil {
+		t.Fatalf("rename master: %s", err)
+	}
+	assertBranch("master", nil)
+	assertBranch("main", base)
+	if current, _, err := repo.headBranch(); err != nil || current != "refs/heads/main" {
+		t.Fatalf("want HEAD at refs/heads/main, got %q, %v", current, err)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Signatures that start the header of a bundle file.
+const (
+	bundleSignatureV2 = "# v2 git bundle\n"
+	bundleSignatureV3 = "# v3 git bundle\n"
+)
+
+// BundleHeader describes the content of a bundle file, which is a pack
+// stream preceded by the references it contains.
+type BundleHeader struct {
+	Version int
+	// Capabilities are given as "@key=value" lines by version 3 bundles.
+	Capabilities map[string]string
+	// Prerequisites are commits that the repository must already have
+	// for the pack to be complete.
+	Prerequisites [][]byte
+	Refs          []*Ref
+}
+
+// readBundleHeader reads the header of a bundle, leaving rd at the start of
+// the pack.
+func readBundleHeader(rd *bufio.Reader) (*BundleHeader, error) {
+	signature, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, errors.New("not a bundle")
+	}
+	h := BundleHeader{Capabilities: make(map[string]string)}
+	switch signature {
+	case bundleSignatureV2:
+		h.Version = 2
+	case bundleSignatureV3:
+		h.Version = 3
+	default:
+		return nil, errors.New("not a bundle")
+	}
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("read bundle header: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		if h.Version == 3 && strings.HasPrefix(line, "@") {
+			chunks := strings.SplitN(line[1:], "=", 2)
+			if len(chunks) == 1 {
+				chunks = append(chunks, "")
+			}
+			h.Capabilities[chunks[0]] = chunks[1]
+			continue
+		}
+		prerequisite := strings.HasPrefix(line, "-")
+		chunks := strings.SplitN(strings.TrimPrefix(line, "-"), " ", 2)
+		sha, err := hex.DecodeString(chunks[0])
+		if err != nil || len(sha) != 20 {
+			return nil, fmt.Errorf("invalid bundle header line %q", line)
+		}
+		switch {
+		case prerequisite:
+			// The rest of the line is a comment.
+			h.Prerequisites = append(h.Prerequisites, sha)
+		case len(chunks) == 2:
+			h.Refs = append(h.Refs, &Ref{Name: chunks[1], Sha: sha})
+		default:
+			return nil, fmt.Errorf("invalid bundle header line %q", line)
+		}
+	}
+	for name, value := range h.Capabilities {
+		if name != "object-format" || value != "sha1" {
+			return nil, fmt.Errorf("bundle requires unsupported capability %s=%s", name, value)
+		}
+	}
+	return &h, nil
+}
+
+// MissingPrerequisitesError is returned when a bundle cannot be unbundled
+// because the repository lacks some of its prerequisite commits.
+type MissingPrerequisitesError struct {
+	Missing [][]byte
+}
+
+func (e *MissingPrerequisitesError) Error() string {
+	return fmt.Sprintf("repository lacks %d prerequisite commits, first %x", len(e.Missing), e.Missing[0])
+}
+
+// Unbundle stores objects of a bundle in the repository and returns the
+// references it contains. References are not updated.
+func (r *Repository) Unbundle(rd io.Reader) ([]*Ref, error) {
+	br := bufio.NewReader(rd)
+	h, err := readBundleHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	var missing [][]byte
+	for _, sha := range h.Prerequisites {
+		if ok, err := r.HasObject(sha); err != nil {
+			return nil, err
+		} else if !ok {
+			missing = append(missing, sha)
+		}
+	}
+	if len(missing) != 0 {
+		return nil, &MissingPrerequisitesError{Missing: missing}
+	}
+	tips := make([][]byte, 0, len(h.Refs))
+	for _, ref := range h.Refs {
+		tips = append(tips, ref.Sha)
+	}
+	err = receiveObjects(r, tips, "fetch", func(incoming *Repository) error {
+		_, err := incoming.UnpackObjects(br)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return h.Refs, nil
+}
+
+// BundleList is a list of bundles that seed a clone, served by a bundle URI
+// or advertised by a remote repository with the bundle-uri capability.
+type BundleList struct {
+	// Mode is "all" if all bundles are needed, "any" if any of them is
+	// enough.
+	Mode    string
+	Bundles []*BundleInfo
+}
+
+// BundleInfo is an entry of a bundle list.
+type BundleInfo struct {
+	ID            string
+	URI           string
+	CreationToken uint64
+}
+
+// parseBundleList reads a list from the bundle section of a configuration.
+// Relative URIs of bundles are resolved against base.
+func parseBundleList(config *Config, base string) (*BundleList, error) {
+	if v, _ := config.Get("bundle", "", "version"); v != "1" {
+		return nil, fmt.Errorf("unsupported bundle list version %q", v)
+	}
+	list := BundleList{Mode: "all"}
+	if mode, ok := config.Get("bundle", "", "mode"); ok {
+		if mode != "all" && mode != "any" {
+			return nil, fmt.Errorf("unsupported bundle list mode %q", mode)
+		}
+		list.Mode = mode
+	}
+	byID := make(map[string]*BundleInfo)
+	for _, e := range config.Entries {
+		if e.Section != "bundle" || e.Subsection == "" {
+			continue
+		}
+		b, ok := byID[e.Subsection]
+		if !ok {
+			b = &BundleInfo{ID: e.Subsection}
+			byID[e.Subsection] = b
+			list.Bundles = append(list.Bundles, b)
+		}
+		switch e.Key {
+		case "uri":
+			b.URI = resolveBundleURI(base, e.Value)
+		case "creationtoken":
+			token, err := strconv.ParseUint(e.Value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bundle.%s.creationToken: invalid value %q", e.Subsection, e.Value)
+			}
+			b.CreationToken = token
+		}
+	}
+	bundles := list.Bundles[:0]
+	for _, b := range list.Bundles {
+		if b.URI != "" {
+			bundles = append(bundles, b)
+		}
+	}
+	list.Bundles = bundles
+	return &list, nil
+}
+
+// resolveBundleURI resolves a relative URI against the URI of the list it
+// was found in.
+func resolveBundleURI(base, uri string) string {
+	if base == "" {
+		return uri
+	}
+	if u, err := url.Parse(uri); err == nil && u.Scheme != "" {
+		return uri
+	}
+	if b, err := url.Parse(base); err == nil && (b.Scheme == "http" || b.Scheme == "https") {
+		if u, err := b.Parse(uri); err == nil {
+			return u.String()
+		}
+		return uri
+	}
+	if filepath.IsAbs(uri) {
+		return uri
+	}
+	return filepath.Join(filepath.Dir(strings.TrimPrefix(base, "file://")), uri)
+}
+
+// openBundleURI opens a local path, file:// or http(s):// URI.
+func openBundleURI(uri string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+		return os.Open(filepath.FromSlash(strings.TrimPrefix(uri, "file://")))
+	}
+	resp, err := http.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch %s: %s", uri, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// maxBundleListDepth limits how deep bundle lists can refer to other lists.
+const maxBundleListDepth = 4
+
+// FetchBundleURI downloads the bundle, or the bundles of the bundle list,
+// served by the URI and unbundles them. Branches of the bundles are stored
+// as refs/bundles/<branch>, which makes a fetch that follows skip objects
+// the bundles already provided.
+func (r *Repository) FetchBundleURI(uri string) error {
+	return r.fetchBundleURI(uri, 0)
+}
+
+func (r *Repository) fetchBundleURI(uri string, depth int) error {
+	if depth > maxBundleListDepth {
+		return fmt.Errorf("bundle list at %s is nested too deep", uri)
+	}
+	rc, err := openBundleURI(uri)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("download %s: %w", uri, err)
+	}
+	if bytes.HasPrefix(raw, []byte(bundleSignatureV2)) || bytes.HasPrefix(raw, []byte(bundleSignatureV3)) {
+		return r.unbundleBranches(bytes.NewReader(raw))
+	}
+	config, err := ParseConfig(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("%s is neither a bundle nor a bundle list: %w", uri, err)
+	}
+	list, err := parseBundleList(config, uri)
+	if err != nil {
+		return fmt.Errorf("%s: %w", uri, err)
+	}
+	return r.fetchBundleList(list, depth+1)
+}
+
+// FetchBundleList downloads and unbundles bundles of the list. In the "all"
+// mode bundles are unbundled once their prerequisites are present, and in
+// the "any" mode the first bundle that can be unbundled is used.
+func (r *Repository) FetchBundleList(list *BundleList) error {
+	return r.fetchBundleList(list, 0)
+}
+
+func (r *Repository) fetchBundleList(list *BundleList, depth int) error {
+	pending := append([]*BundleInfo(nil), list.Bundles...)
+	// Bundles with a creation token build on the bundles with lower
+	// tokens.
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].CreationToken < pending[j].CreationToken
+	})
+	if list.Mode == "any" {
+		var err error
+		for _, b := range pending {
+			if err = r.fetchBundleURI(b.URI, depth); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+	for len(pending) != 0 {
+		var (
+			retry   []*BundleInfo
+			missing *MissingPrerequisitesError
+		)
+		for _, b := range pending {
+			err := r.fetchBundleURI(b.URI, depth)
+			switch {
+			case err == nil:
+				// Unbundled.
+			case errors.As(err, &missing):
+				retry = append(retry, b)
+			default:
+				return fmt.Errorf("bundle %s: %w", b.ID, err)
+			}
+		}
+		if len(retry) == len(pending) {
+			return fmt.Errorf("bundle %s: %w", retry[0].ID, missing)
+		}
+		pending = retry
+	}
+	return nil
+}
+
+// unbundleBranches unbundles the bundle and stores its branches below
+// refs/bundles.
+func (r *Repository) unbundleBranches(rd io.Reader) error {
+	refs, err := r.Unbundle(rd)
+	if err != nil {
+		return err
+	}
+	var updates []*RefUpdate
+	for _, ref := range refs {
+		if strings.HasPrefix(ref.Name, "refs/heads/") {
+			updates = append(updates, &RefUpdate{Name: "refs/bundles/" + strings.TrimPrefix(ref.Name, "refs/heads/"), Sha: ref.Sha})
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return r.UpdateRefs(updates...)
+}
+
+// BundleURITransport is implemented by transports of remote repositories
+// that advertise bundle URIs with the bundle-uri capability.
+type BundleURITransport interface {
+	// BundleList returns the advertised bundles, or nil if the remote
+	// repository does not advertise any.
+	BundleList() (*BundleList, error)
+}
+
+// BundleList returns bundles configured in the bundle section of the remote
+// repository, if it enables uploadpack.advertiseBundleURIs.
+func (t *localTransport) BundleList() (*BundleList, error) {
+	if ok, err := t.remote.config.Bool("uploadpack", "", "advertiseBundleURIs", false); err != nil || !ok {
+		return nil, err
+	}
+	if _, ok := t.remote.config.Get("bundle", "", "version"); !ok {
+		return nil, nil
+	}
+	return parseBundleList(t.remote.config, "")
+}
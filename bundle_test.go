@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchBundleURI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream, err := CreateRepository(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatalf("create upstream repository: %s", err)
+	}
+	local, err := CreateRepository(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatalf("create local repository: %s", err)
+	}
+	base := writeTestCommit(t, upstream, "base")
+	head := writeTestCommit(t, upstream, "head", base)
+
+	reachable := func(tip []byte) [][]byte {
+		var shas [][]byte
+		err := upstream.WalkObjects([][]byte{tip}, func(o *WalkedObject) error {
+			shas = append(shas, o.Sha)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("walk objects: %s", err)
+		}
+		return shas
+	}
+	writeBundle := func(name, header string, shas [][]byte) {
+		var b bytes.Buffer
+		b.WriteString(header + "\n")
+		if _, _, err := upstream.writePackData(&b, shas); err != nil {
+			t.Fatalf("write pack: %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b.Bytes(), 0644); err != nil {
+			t.Fatalf("write bundle: %s", err)
+		}
+	}
+	writeBundle("base.bundle", fmt.Sprintf("# v2 git bundle\n%x refs/heads/base\n", base), reachable(base))
+	known := make(map[string]bool)
+	for _, sha := range reachable(base) {
+		known[string(sha)] = true
+	}
+	var rest [][]byte
+	for _, sha := range reachable(head) {
+		if !known[string(sha)] {
+			rest = append(rest, sha)
+		}
+	}
+	writeBundle("head.bundle", fmt.Sprintf("# v3 git bundle\n@object-format=sha1\n-%x base\n%x refs/heads/main\n", base, head), rest)
+
+	// The bundle that needs the other one comes first.
+	list := "[bundle]\n\tversion = 1\n\tmode = all\n" +
+		"[bundle \"head\"]\n\turi = head.bundle\n" +
+		"[bundle \"base\"]\n\turi = " + filepath.Join(dir, "base.bundle") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "list"), []byte(list), 0644); err != nil {
+		t.Fatalf("write bundle list: %s", err)
+	}
+
+	var missing *MissingPrerequisitesError
+	if err := local.FetchBundleURI(filepath.Join(dir, "head.bundle")); !errors.As(err, &missing) {
+		t.Fatalf("want missing prerequisites, got %v", err)
+	}
+	if err := local.FetchBundleURI(filepath.Join(dir, "list")); err != nil {
+		t.Fatalf("fetch bundle list: %s", err)
+	}
+	assertRef(t, local, "refs/bundles/base", base)
+	assertRef(t, local, "refs/bundles/main", head)
+	if err := local.CheckConnectivity([][]byte{head}); err != nil {
+		t.Fatalf("unbundled history is incomplete: %s", err)
+	}
+}
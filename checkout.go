@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkoutObstacle is an existing path that a checkout would overwrite or
+// that must be removed first, because an entry of a different type is
+// checked out in its place.
+type checkoutObstacle struct {
+	// Path is slash separated and relative to the checkout directory.
+	Path   string
+	Remove bool
+	// Clean is set if the content can be lost without harm, because it is
+	// stored in the repository already.
+	Clean bool
+}
+
+// findCheckoutObstacles compares the tree with the content of the dir
+// directory and returns every path that checking out the pathspec matching
+// files would clobber. A file is clean if it has the content of the base
+// tree at the same path. Base is the tree the directory was checked out
+// from and can be nil, in which case every file not matching the checked
+// out content is considered untracked, like git does.
+func findCheckoutObstacles(repo *Repository, tr, base *TreeObject, dir, prefix string, ps *Pathspec) ([]*checkoutObstacle, error) {
+	var found []*checkoutObstacle
+	for _, leaf := range tr.Leafs {
+		if leaf.Mode == modeGitlink {
+			continue
+		}
+		rel := prefix + leaf.Path
+		dest := filepath.Join(dir, filepath.FromSlash(rel))
+		info, err := os.Lstat(dest)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("stat %q: %w", dest, err)
+		}
+
+		if leaf.Mode == modeTree {
+			sub, err := repo.readTree(leaf.Sha)
+			if err != nil {
+				return nil, err
+			}
+			if info.IsDir() {
+				more, err := findCheckoutObstacles(repo, sub, base, dir, rel+"/", ps)
+				if err != nil {
+					return nil, err
+				}
+				found = append(found, more...)
+				continue
+			}
+			// A file is in place of a directory with files to check out.
+			if ok, err := treeMatches(repo, sub, rel+"/", ps); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+			clean, err := matchesTreePath(repo, base, rel, dest, info)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, &checkoutObstacle{Path: rel, Remove: true, Clean: clean})
+			continue
+		}
+
+		if !ps.Match(rel) {
+			continue
+		}
+		if info.IsDir() {
+			entries, err := ioutil.ReadDir(dest)
+			if err != nil {
+				return nil, fmt.Errorf("read dir %q: %w", dest, err)
+			}
+			found = append(found, &checkoutObstacle{Path: rel, Remove: true, Clean: len(entries) == 0})
+			continue
+		}
+		content, err := readWorktreeFile(dest, info)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(hashObject("blob", content), leaf.Sha) {
+			// Already checked out.
+			continue
+		}
+		clean, err := matchesTreePath(repo, base, rel, dest, info)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, &checkoutObstacle{Path: rel, Clean: clean})
+	}
+	return found, nil
+}
+
+// treeMatches returns true if any file within the tree matches the
+// pathspec.
+func treeMatches(repo *Repository, tr *TreeObject, prefix string, ps *Pathspec) (bool, error) {
+	for _, leaf := range tr.Leafs {
+		switch leaf.Mode {
+		case modeGitlink:
+			// Not checked out.
+		case modeTree:
+			sub, err := repo.readTree(leaf.Sha)
+			if err != nil {
+				return false, err
+			}
+			if ok, err := treeMatches(repo, sub, prefix+leaf.Path+"/", ps); err != nil || ok {
+				return ok, err
+			}
+		default:
+			if ps.Match(prefix + leaf.Path) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matchesTreePath returns true if the file has the content stored in the
+// tree at given path.
+func matchesTreePath(repo *Repository, tr *TreeObject, treePath, file string, info os.FileInfo) (bool, error) {
+	if tr == nil {
+		return false, nil
+	}
+	leaf, err := repo.lookupTreePath(tr, treePath)
+	switch {
+	case err == nil:
+		// Compare below.
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+	if leaf.Mode == modeTree || leaf.Mode == modeGitlink {
+		return false, nil
+	}
+	content, err := readWorktreeFile(file, info)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hashObject("blob", content), leaf.Sha), nil
+}
+
+// readWorktreeFile returns the content of a file the way it is stored in a
+// blob. Symbolic links are stored as their target.
+func readWorktreeFile(file string, info os.FileInfo) ([]byte, error) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(file)
+		if err != nil {
+			return nil, fmt.Errorf("read link: %w", err)
+		}
+		return []byte(target), nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+	return content, nil
+}
+
+// checkoutConflictError lists files with content that a checkout would
+// lose.
+type checkoutConflictError struct {
+	Paths []string
+}
+
+func (e *checkoutConflictError) Error() string {
+	return fmt.Sprintf("the following untracked or modified files would be overwritten by checkout:\n\t%s\nmove or remove them, or use --force or --backup", strings.Join(e.Paths, "\n\t"))
+}
+
+// SwitchHead checks out the commit into the index and the worktree, and
+// points HEAD to the branch, a full reference name, or detaches HEAD at the
+// commit if the branch is empty. Like git, local changes of paths that are
+// the same in both commits are kept, and the switch fails without changing
+// anything if other local changes or untracked files would be lost. With
+// force, tracked files are reset to the commit instead.
+func (r *Repository) SwitchHead(commit []byte, branch string, force bool) error {
+	c, err := r.readCommit(commit)
+	if err != nil {
+		return err
+	}
+	to, err := r.commitTree(c)
+	if err != nil {
+		return err
+	}
+	from, err := r.headTree()
+	if err != nil {
+		return err
+	}
+	unlock, err := r.LockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	idx, err := r.ReadIndex()
+	if err != nil {
+		return err
+	}
+	changes, err := r.DiffTrees(from, to, true, nil)
+	if err != nil {
+		return err
+	}
+	staged, err := r.DiffTreeIndex(from, idx, false, nil)
+	if err != nil {
+		return err
+	}
+	unstaged, err := r.DiffIndexWorktree(idx, nil)
+	if err != nil {
+		return err
+	}
+	dirty := make(map[string]bool)
+	for _, c := range append(staged, unstaged...) {
+		if c.Status == 'U' && !force {
+			return errors.New("you need to resolve your current index first")
+		}
+		dirty[c.Path] = true
+	}
+
+	update := make(map[string]bool)
+	var conflicts []string
+	for _, c := range changes {
+		update[c.Path] = true
+		if force {
+			continue
+		}
+		if dirty[c.Path] {
+			conflicts = append(conflicts, c.Path)
+			continue
+		}
+		if c.OldSha != nil {
+			continue
+		}
+		// An untracked file is lost, unless it has the new content.
+		full := filepath.Join(r.workdir, filepath.FromSlash(c.Path))
+		info, err := os.Lstat(full)
+		switch {
+		case errors.Is(err, os.ErrNotExist) || isNotDir(err):
+			continue
+		case err != nil:
+			return fmt.Errorf("stat %s: %w", c.Path, err)
+		case info.IsDir():
+			conflicts = append(conflicts, c.Path)
+			continue
+		}
+		if ok, err := matchesTreePath(r, to, c.Path, full, info); err != nil {
+			return err
+		} else if !ok {
+			conflicts = append(conflicts, c.Path)
+		}
+	}
+	if len(conflicts) != 0 {
+		return fmt.Errorf("your local changes to the following files would be overwritten by checkout:\n\t%s\ncommit them, or use --force", strings.Join(conflicts, "\n\t"))
+	}
+	if force {
+		for name := range dirty {
+			update[name] = true
+		}
+	}
+
+	attrs, err := r.worktreeAttributes()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(update))
+	for name := range update {
+		names = append(names, name)
+	}
+	// Files are removed before others are written, so that a file can
+	// replace a directory and the other way around.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	var write []*TreeLeaf
+	for _, name := range names {
+		leaf, err := r.lookupTreePath(to, name)
+		switch {
+		case err == nil:
+			write = append(write, &TreeLeaf{Mode: leaf.Mode, Path: name, Sha: leaf.Sha})
+			continue
+		case !errors.Is(err, os.ErrNotExist):
+			return err
+		}
+		skip := false
+		if i, ok := idx.entry(name); ok {
+			skip = idx.Entries[i].SkipWorktree
+		}
+		setIndexEntry(idx, name, nil)
+		if skip {
+			continue
+		}
+		// Files that were not committed are kept as untracked files.
+		if tracked, err := r.lookupTreePath(from, name); err == nil && tracked.Mode != modeGitlink {
+			if err := removeWorktreeFile(r.workdir, name); err != nil {
+				return err
+			}
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	for i := len(write) - 1; i >= 0; i-- {
+		leaf := write[i]
+		var prev *IndexEntry
+		if i, ok := idx.entry(leaf.Path); ok {
+			prev = idx.Entries[i]
+		}
+		if prev != nil && prev.SkipWorktree {
+			setIndexEntry(idx, leaf.Path, &IndexEntry{Mode: leaf.Mode, Sha: leaf.Sha, Path: leaf.Path, SkipWorktree: true})
+			continue
+		}
+		e, err := r.checkoutLeaf(attrs, leaf)
+		if err != nil {
+			return err
+		}
+		setIndexEntry(idx, leaf.Path, e)
+	}
+	if err := r.WriteIndex(idx); err != nil {
+		return err
+	}
+
+	head := &RefUpdate{Name: "HEAD", Target: branch, Message: "checkout: moving to " + shortRefName(branch)}
+	if branch == "" {
+		head.Sha = commit
+		head.Message = fmt.Sprintf("checkout: moving to %x", commit)
+	}
+	return r.UpdateRefs(head)
+}
+
+// checkoutLeaf writes the blob of the leaf into the worktree, converted by
+// the attributes, and returns the index entry for it. For a gitlink only
+// the directory is created.
+func (r *Repository) checkoutLeaf(attrs *attrStack, leaf *TreeLeaf) (*IndexEntry, error) {
+	full := filepath.Join(r.workdir, filepath.FromSlash(leaf.Path))
+	if err := os.MkdirAll(filepath.Dir(full), newDirPerm); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+	e := &IndexEntry{Mode: leaf.Mode, Sha: leaf.Sha, Path: leaf.Path}
+	if leaf.Mode == modeGitlink {
+		if err := os.MkdirAll(full, newDirPerm); err != nil {
+			return nil, fmt.Errorf("mkdir: %w", err)
+		}
+		return e, nil
+	}
+	_, content, err := r.ReadRawObject(leaf.Sha)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", leaf.Path, err)
+	}
+	if err := os.Remove(full); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("remove %s: %w", leaf.Path, err)
+	}
+	switch leaf.Mode {
+	case modeSymlink:
+		if err := os.Symlink(string(content), full); err != nil {
+			return nil, fmt.Errorf("write %s symlink: %w", leaf.Path, err)
+		}
+	default:
+		fileAttrs, err := attrs.Lookup(leaf.Path)
+		if err != nil {
+			return nil, err
+		}
+		if content, err = r.convertToWorktree(fileAttrs, leaf.Path, leaf.Sha, content); err != nil {
+			return nil, err
+		}
+		perm := os.FileMode(0644)
+		if leaf.Mode == modeExec {
+			perm = 0755
+		}
+		if err := ioutil.WriteFile(full, content, perm); err != nil {
+			return nil, fmt.Errorf("write %s: %w", leaf.Path, err)
+		}
+	}
+	info, err := os.Lstat(full)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", leaf.Path, err)
+	}
+	e.Mtime, e.Size = info.ModTime(), uint32(info.Size())
+	setStatData(e, info)
+	return e, nil
+}
+
+// removeWorktreeFile removes the file and the directories that it leaves
+// empty.
+func removeWorktreeFile(workdir, name string) error {
+	full := filepath.Join(workdir, filepath.FromSlash(name))
+	if err := os.Remove(full); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", name, err)
+	}
+	for dir := filepath.Dir(full); dir != workdir && strings.HasPrefix(dir, workdir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// OrphanedCommits returns the commits reachable from a detached HEAD that
+// would not be reachable anymore after HEAD is moved to the next commit,
+// because no reference points to them. Commits are ordered newest first.
+func (r *Repository) OrphanedCommits(head, next []byte) ([]*WalkedCommit, error) {
+	w, err := r.NewRevWalk([][]byte{head})
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Hide(next); err != nil {
+		return nil, err
+	}
+	refs, err := r.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("list refs: %w", err)
+	}
+	for _, sha := range refs {
+		// References of other objects do not keep commits.
+		if sha, err := r.peelObject(sha, "commit"); err == nil {
+			if err := w.Hide(sha); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var lost []*WalkedCommit
+	for {
+		c, err := w.Next()
+		if errors.Is(err, io.EOF) {
+			return lost, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		lost = append(lost, c)
+	}
+}
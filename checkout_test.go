@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindCheckoutObstacles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := CreateRepository(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatalf("create repository: %s", err)
+	}
+	writeTree := func(files map[string]string) *TreeObject {
+		t.Helper()
+		tb := NewTreeBuilder(repo, nil)
+		for name, content := range files {
+			blob, err := repo.WriteObject("blob", []byte(content))
+			if err != nil {
+				t.Fatalf("write blob: %s", err)
+			}
+			if err := tb.Insert(name, modeBlob, blob); err != nil {
+				t.Fatalf("insert: %s", err)
+			}
+		}
+		sha, err := tb.Write()
+		if err != nil {
+			t.Fatalf("write tree: %s", err)
+		}
+		tr, err := repo.readTree(sha)
+		if err != nil {
+			t.Fatalf("read tree: %s", err)
+		}
+		return tr
+	}
+	base := writeTree(map[string]string{"a.txt": "old", "b.txt": "old", "d": "file"})
+	target := writeTree(map[string]string{"a.txt": "new", "b.txt": "new", "c.txt": "new", "d/e.txt": "new", "f.txt": "new", "same.txt": "same"})
+
+	cases := map[string]struct {
+		files map[string]string
+		dirs  []string
+		base  *TreeObject
+		want  []*checkoutObstacle
+	}{
+		"empty destination": {},
+		"clean tracked files": {
+			files: map[string]string{"a.txt": "old", "b.txt": "old"},
+			base:  base,
+			want: []*checkoutObstacle{
+				{Path: "a.txt", Clean: true},
+				{Path: "b.txt", Clean: true},
+			},
+		},
+		"modified and untracked files": {
+			files: map[string]string{"a.txt": "modified", "c.txt": "untracked", "same.txt": "same"},
+			base:  base,
+			want: []*checkoutObstacle{
+				{Path: "a.txt"},
+				{Path: "c.txt"},
+			},
+		},
+		"without base": {
+			files: map[string]string{"a.txt": "old"},
+			want:  []*checkoutObstacle{{Path: "a.txt"}},
+		},
+		"file in place of directory": {
+			files: map[string]string{"d": "file"},
+			base:  base,
+			want:  []*checkoutObstacle{{Path: "d", Remove: true, Clean: true}},
+		},
+		"directory in place of file": {
+			dirs: []string{"f.txt"},
+			want: []*checkoutObstacle{{Path: "f.txt", Remove: true, Clean: true}},
+		},
+		"non empty directory in place of file": {
+			files: map[string]string{"f.txt/x": "x"},
+			want:  []*checkoutObstacle{{Path: "f.txt", Remove: true}},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			dest, err := ioutil.TempDir(dir, "dest-")
+			if err != nil {
+				t.Fatalf("temp dir: %s", err)
+			}
+			for _, name := range tc.dirs {
+				if err := os.MkdirAll(filepath.Join(dest, name), 0755); err != nil {
+					t.Fatalf("mkdir: %s", err)
+				}
+			}
+			for name, content := range tc.files {
+				full := filepath.Join(dest, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+					t.Fatalf("mkdir: %s", err)
+				}
+				if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+					t.Fatalf("write file: %s", err)
+				}
+			}
+			ps, err := ParsePathspec("", nil)
+			if err != nil {
+				t.Fatalf("pathspec: %s", err)
+			}
+			got, err := findCheckoutObstacles(repo, target, tc.base, dest, "", ps)
+			if err != nil {
+				t.Fatalf("find obstacles: %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("unexpected obstacles: %+v", got)
+			}
+		})
+	}
+}
+
+func TestSwitchHead(t *testing.T) {
+	repo := newTestRepository(t)
+	dir := repo.workdir
+	repo.config.Entries = append(repo.config.Entries,
+		&ConfigEntry{Section: "user", Key: "name", Value: "Test"},
+		&ConfigEntry{Section: "user", Key: "email", Value: "test@example.com"})
+	write := func(name, content string) {
+		t.Helper()
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	commit := func(parents ...[]byte) []byte {
+		t.Helper()
+		idx, err := repo.ReadIndex()
+		if err != nil {
+			t.Fatalf("read index: %s", err)
+		}
+		if err := repo.AddPaths(idx, "", []string{"."}, false); err != nil {
+			t.Fatalf("add: %s", err)
+		}
+		if err := repo.WriteIndex(idx); err != nil {
+			t.Fatalf("write index: %s", err)
+		}
+		tree, err := repo.WriteIndexTree(idx)
+		if err != nil {
+			t.Fatalf("write tree: %s", err)
+		}
+		sha, err := repo.CreateCommit(tree, parents, "commit\n", nil)
+		if err != nil {
+			t.Fatalf("commit: %s", err)
+		}
+		return sha
+	}
+	assertFile := func(name, want string) {
+		t.Helper()
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if want == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("want %s removed, got %v", name, err)
+			}
+			return
+		}
+		if err != nil || string(got) != want {
+			t.Errorf("want %s with %q, got %q (%v)", name, want, got, err)
+		}
+	}
+
+	write("a", "one\n")
+	write("kept", "kept\n")
+	first := commit()
+	write("a", "two\n")
+	write("dir/b", "two\n")
+	second := commit(first)
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: second}); err != nil {
+		t.Fatalf("update ref: %s", err)
+	}
+
+	// Local changes of paths that do not change are kept.
+	write("kept", "local\n")
+	if err := repo.SwitchHead(first, "", false); err != nil {
+		t.Fatalf("detach: %s", err)
+	}
+	assertFile("a", "one\n")
+	assertFile("dir/b", "")
+	assertFile("kept", "local\n")
+	if _, err := os.Stat(filepath.Join(dir, "dir")); !os.IsNotExist(err) {
+		t.Errorf("want empty directory removed, got %v", err)
+	}
+	head, err := repo.ReadRef("HEAD")
+	if err != nil {
+		t.Fatalf("read HEAD: %s", err)
+	}
+	if head.Target != "" || !bytes.Equal(head.Sha, first) {
+		t.Fatalf("want HEAD detached at %x, got %+v", first, head)
+	}
+	entries, err := repo.Status(UntrackedAll)
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "kept" || entries[0].Unstaged != 'M' {
+		t.Fatalf("want only kept modified, got %+v", entries)
+	}
+
+	// Commits made on the detached HEAD are lost when leaving it.
+	write("a", "three\n")
+	third := commit(first)
+	if err := repo.UpdateRefs(&RefUpdate{Name: "HEAD", Sha: third}); err != nil {
+		t.Fatalf("update HEAD: %s", err)
+	}
+	lost, err := repo.OrphanedCommits(third, second)
+	if err != nil {
+		t.Fatalf("orphaned commits: %s", err)
+	}
+	if len(lost) != 1 || !bytes.Equal(lost[0].Sha, third) {
+		t.Fatalf("want %x lost, got %d commits", third, len(lost))
+	}
+
+	write("dir/b", "untracked\n")
+	err = repo.SwitchHead(second, "refs/heads/master", false)
+	if err == nil || !strings.Contains(err.Error(), "dir/b") {
+		t.Fatalf("want untracked dir/b to stop the switch, got %v", err)
+	}
+	assertFile("a", "three\n")
+	if err := repo.SwitchHead(second, "refs/heads/master", true); err != nil {
+		t.Fatalf("switch: %s", err)
+	}
+	assertFile("a", "two\n")
+	assertFile("dir/b", "two\n")
+	assertFile("kept", "kept\n")
+	if head, err = repo.ReadRef("HEAD"); err != nil || head.Target != "refs/heads/master" {
+		t.Fatalf("want HEAD on master, got %+v (%v)", head, err)
+	}
+}
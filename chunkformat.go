@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Chunk based files, such as commit-graph and multi-pack-index, start with
+// a file specific header followed by a table of contents. Each table entry
+// is a 4 byte chunk id and an 8 byte offset of the chunk from the start of
+// the file. The table ends with an entry of id zero and the offset where
+// the last chunk ends. Chunks follow the table in the same order.
+const chunkTOCEntrySize = 12
+
+// chunkID returns the id of a chunk named with four ASCII characters, as
+// in chunkID("OIDF").
+func chunkID(name string) uint32 {
+	return binary.BigEndian.Uint32([]byte(name))
+}
+
+// chunkName returns the printable name of a chunk id.
+func chunkName(id uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	return fmt.Sprintf("%q", b[:])
+}
+
+// chunkFile is the table of contents of a chunk based file.
+type chunkFile struct {
+	ids    []uint32
+	chunks map[uint32][]byte
+}
+
+// parseChunkFile reads a table of contents with count chunks, starting at
+// tocOffset. Data must not include the trailing checksum, so that chunks
+// are checked to end before it. Returned chunks point into data.
+func parseChunkFile(data []byte, tocOffset, count int) (*chunkFile, error) {
+	if tocOffset < 0 || count < 0 {
+		return nil, errors.New("invalid chunk table of contents")
+	}
+	tocEnd := tocOffset + (count+1)*chunkTOCEntrySize
+	if tocEnd > len(data) || tocEnd < tocOffset {
+		return nil, errors.New("chunk table of contents is truncated")
+	}
+	f := &chunkFile{chunks: make(map[uint32][]byte, count)}
+	toc := data[tocOffset:tocEnd]
+	for i := 0; i < count; i++ {
+		entry := toc[i*chunkTOCEntrySize:]
+		id := binary.BigEndian.Uint32(entry)
+		start := binary.BigEndian.Uint64(entry[4:])
+		end := binary.BigEndian.Uint64(entry[4+chunkTOCEntrySize:])
+		if id == 0 {
+			return nil, fmt.Errorf("chunk %d: terminating id before the end of the table of contents", i)
+		}
+		if _, ok := f.chunks[id]; ok {
+			return nil, fmt.Errorf("chunk %s: duplicate id", chunkName(id))
+		}
+		if start < uint64(tocEnd) || end < start || end > uint64(len(data)) {
+			return nil, fmt.Errorf("chunk %s: invalid offsets %d-%d", chunkName(id), start, end)
+		}
+		f.ids = append(f.ids, id)
+		f.chunks[id] = data[start:end:end]
+	}
+	if id := binary.BigEndian.Uint32(toc[count*chunkTOCEntrySize:]); id != 0 {
+		return nil, fmt.Errorf("chunk table of contents does not end with a zero id, got %s", chunkName(id))
+	}
+	return f, nil
+}
+
+// chunk returns the content of a chunk and true if the chunk exists.
+func (f *chunkFile) chunk(id uint32) ([]byte, bool) {
+	data, ok := f.chunks[id]
+	return data, ok
+}
+
+// chunkRecords returns the content of a chunk made of fixed size records.
+// The chunk is required and must have exactly count records.
+func (f *chunkFile) chunkRecords(id uint32, recordSize, count int) ([]byte, error) {
+	data, ok := f.chunks[id]
+	if !ok {
+		return nil, fmt.Errorf("missing required chunk %s", chunkName(id))
+	}
+	if len(data) != recordSize*count {
+		return nil, fmt.Errorf("chunk %s: want %d bytes, got %d", chunkName(id), recordSize*count, len(data))
+	}
+	return data, nil
+}
+
+// chunkWriter collects chunks of a new chunk based file.
+type chunkWriter struct {
+	ids    []uint32
+	chunks [][]byte
+}
+
+// add appends a chunk. Chunks are written in the order they were added.
+func (w *chunkWriter) add(id uint32, data []byte) {
+	w.ids = append(w.ids, id)
+	w.chunks = append(w.chunks, data)
+}
+
+// writeTo writes the table of contents and all chunks. Offset is the
+// number of bytes already written to the file, which is the size of the
+// file header.
+func (w *chunkWriter) writeTo(out io.Writer, offset int) (int64, error) {
+	var b bytes.Buffer
+	pos := uint64(offset + (len(w.chunks)+1)*chunkTOCEntrySize)
+	for i, data := range w.chunks {
+		binary.Write(&b, binary.BigEndian, w.ids[i])
+		binary.Write(&b, binary.BigEndian, pos)
+		pos += uint64(len(data))
+	}
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	binary.Write(&b, binary.BigEndian, pos)
+	for _, data := range w.chunks {
+		b.Write(data)
+	}
+	return b.WriteTo(out)
+}
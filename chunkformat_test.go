@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// gitCommitGraph is a gzip compressed commit-graph file written by git
+// 2.39 for a history of two commits.
+const gitCommitGraph = `
+H4sIAAAAAAACA3N2D/BgZGRh8Pd0cWOAABcg2wfCZHFxdnEMgbJz3F0cjaDsLQxwwLKHYRSM
+glGADzAOEcxEDj4xRawsPVRYYL5iZqCwl2gA/x5bxU+GHduaJIvUk3yKj+zK46usPLrw4Kr/
+JTN8zlwMW5K5fvnN1QJPyqtfqxQADSiAFiTxcQIMZs0/Cva55NQciP/1fv6CFFH1PAkNBoQa
+DpAaWJjGPY7j7QqaHfRWVP/hKtHXmzVq2v4DANVU5yHQBAAA`
+
+func TestChunkFileGit(t *testing.T) {
+	compressed, err := base64.StdEncoding.DecodeString(gitCommitGraph)
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("gzip: %s", err)
+	}
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("gzip: %s", err)
+	}
+
+	// The commit-graph header is 8 bytes, with the chunk count at offset 6.
+	const headerSize = 8
+	data := raw[:len(raw)-sha1.Size]
+	f, err := parseChunkFile(data, headerSize, int(raw[6]))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	wantIDs := []uint32{chunkID("OIDF"), chunkID("OIDL"), chunkID("CDAT"), chunkID("GDA2")}
+	if !reflect.DeepEqual(f.ids, wantIDs) {
+		t.Fatalf("want chunks %x, got %x", wantIDs, f.ids)
+	}
+	if _, err := f.chunkRecords(chunkID("OIDF"), 4, 256); err != nil {
+		t.Fatalf("fanout: %s", err)
+	}
+	oids, err := f.chunkRecords(chunkID("OIDL"), sha1.Size, 2)
+	if err != nil {
+		t.Fatalf("oid lookup: %s", err)
+	}
+	if got := oids[:2]; !bytes.Equal(got, []byte{0xc8, 0x94}) {
+		t.Fatalf("unexpected first commit %x", oids[:sha1.Size])
+	}
+	if _, err := f.chunkRecords(chunkID("CDAT"), sha1.Size+16, 3); err == nil {
+		t.Fatal("want chunk size error")
+	}
+	if _, ok := f.chunk(chunkID("BIDX")); ok {
+		t.Fatal("unexpected bloom filter index chunk")
+	}
+
+	// Writing the same chunks produces the same file.
+	var w chunkWriter
+	for _, id := range f.ids {
+		data, _ := f.chunk(id)
+		w.add(id, data)
+	}
+	var b bytes.Buffer
+	b.Write(raw[:headerSize])
+	if _, err := w.writeTo(&b, headerSize); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+	if !bytes.Equal(b.Bytes(), raw) {
+		t.Fatal("written file differs from the one written by git")
+	}
+}
+
+func TestParseChunkFileErrors(t *testing.T) {
+	toc := func(entries ...interface{}) []byte {
+		var b bytes.Buffer
+		for i := 0; i < len(entries); i += 2 {
+			binary.Write(&b, binary.BigEndian, chunkID(entries[i].(string)))
+			binary.Write(&b, binary.BigEndian, uint64(entries[i+1].(int)))
+		}
+		return b.Bytes()
+	}
+	pad := func(b []byte, size int) []byte {
+		return append(b, make([]byte, size-len(b))...)
+	}
+
+	cases := map[string]struct {
+		data  []byte
+		count int
+	}{
+		"truncated table": {
+			data:  toc("AAAA", 24)[:20],
+			count: 1,
+		},
+		"missing terminator": {
+			data:  pad(toc("AAAA", 24, "BBBB", 28), 28),
+			count: 1,
+		},
+		"early terminator": {
+			data:  pad(toc("AAAA", 36, "\x00\x00\x00\x00", 36, "\x00\x00\x00\x00", 36), 36),
+			count: 2,
+		},
+		"duplicate id": {
+			data:  pad(toc("AAAA", 36, "AAAA", 38, "\x00\x00\x00\x00", 40), 40),
+			count: 2,
+		},
+		"offset within table": {
+			data:  pad(toc("AAAA", 4, "\x00\x00\x00\x00", 30), 30),
+			count: 1,
+		},
+		"decreasing offsets": {
+			data:  pad(toc("AAAA", 40, "BBBB", 38, "\x00\x00\x00\x00", 44), 44),
+			count: 2,
+		},
+		"chunk past the end": {
+			data:  pad(toc("AAAA", 24, "\x00\x00\x00\x00", 100), 30),
+			count: 1,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if _, err := parseChunkFile(tc.data, 0, tc.count); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
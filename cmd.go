@@ -1,32 +1,73 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func cmdInit(input io.Reader, output io.Writer, args []string) error {
-	switch len(args) {
-	case 0:
-		_, err := CreateRepository(".")
+	fl := flag.NewFlagSet("init", flag.ContinueOnError)
+	var opts InitOptions
+	fl.BoolVar(&opts.Bare, "bare", false, "Create a repository without a worktree.")
+	fl.StringVar(&opts.InitialBranch, "initial-branch", "", "Name of the branch HEAD points to.")
+	fl.StringVar(&opts.InitialBranch, "b", "", "Same as -initial-branch.")
+	fl.StringVar(&opts.TemplateDir, "template", "", "Directory with files copied into the git directory.")
+	quiet := fl.Bool("quiet", false, "Do not print the path of the created repository.")
+	fl.BoolVar(quiet, "q", false, "Same as -quiet.")
+	if err := fl.Parse(args); err != nil {
 		return err
+	}
+	dir := "."
+	switch fl.NArg() {
+	case 0:
+		// Current directory.
 	case 1:
-		_, err := CreateRepository(args[0])
-		return err
+		dir = fl.Arg(0)
 	default:
-		return errors.New("usage: init [<dir>]")
+		return errors.New("usage: init [-q | --quiet] [--bare] [--template=<dir>] [-b <branch> | --initial-branch=<branch>] [<dir>]")
+	}
+	repo, err := InitRepository(dir, &opts)
+	if err != nil {
+		return err
+	}
+	if *quiet {
+		return nil
+	}
+	gitdir, err := filepath.Abs(repo.gitdir)
+	if err != nil {
+		return err
 	}
+	_, err = fmt.Fprintf(output, "Initialized empty Git repository in %s/\n", gitdir)
+	return err
 }
 
 func cmdHashObject(input io.Reader, output io.Writer, args []string) error {
-	if len(args) != 2 {
-		return errors.New("usage: hash-object <kind> <path>")
+	fl := flag.NewFlagSet("hash-object", flag.ContinueOnError)
+	attrPath := fl.String("path", "", "Hash the blob as if it was located at the given path.")
+	noFilters := fl.Bool("no-filters", false, "Hash the content as is, without any conversion.")
+	literally := fl.Bool("literally", false, "Write the object even if it is malformed.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	args = fl.Args()
+	if len(args) != 2 || (*noFilters && *attrPath != "") {
+		return errors.New("usage: hash-object [--path=<path> | --no-filters] [--literally] <kind> <path>")
 	}
 	switch args[0] {
 	case "commit", "tree", "tag", "blob":
@@ -42,27 +83,115 @@ func cmdHashObject(input io.Reader, output io.Writer, args []string) error {
 	if err != nil {
 		return fmt.Errorf("read file: %w", err)
 	}
+	// Blobs are converted as they would be when added from the worktree,
+	// unless the filters are disabled.
+	if args[0] == "blob" && !*noFilters {
+		name := *attrPath
+		if name == "" {
+			name = args[1]
+		}
+		if name, err = filepath.Abs(name); err != nil {
+			return err
+		}
+		if name, err = filepath.Rel(repo.workdir, name); err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		attrs := make(Attributes)
+		// Attributes of the worktree do not apply to files outside of it.
+		if !strings.HasPrefix(name, "../") {
+			stack, err := repo.worktreeAttributes()
+			if err != nil {
+				return err
+			}
+			if attrs, err = stack.Lookup(name); err != nil {
+				return err
+			}
+		}
+		if content, err = repo.convertToGit(attrs, name, content); err != nil {
+			return err
+		}
+	}
+	if !*literally {
+		if err := repo.verifyNewObject(args[0], content); err != nil {
+			return err
+		}
+	}
 	if sha, err := repo.WriteObject(args[0], content); err != nil {
 		return fmt.Errorf("write object: %w", err)
 	} else {
-		fmt.Println(hex.EncodeToString(sha))
+		fmt.Fprintln(output, hex.EncodeToString(sha))
+	}
+	return nil
+}
+
+// batchFlag enables a batch mode of cat-file, with an optional output
+// format.
+type batchFlag struct {
+	enabled bool
+	format  string
+}
+
+func (f *batchFlag) String() string { return f.format }
+
+func (f *batchFlag) Set(value string) error {
+	f.enabled = true
+	if value != "true" {
+		f.format = value
 	}
 	return nil
 }
 
+func (f *batchFlag) IsBoolFlag() bool { return true }
+
 func cmdCatFile(input io.Reader, output io.Writer, args []string) error {
-	if len(args) != 1 {
-		return errors.New("usage: cat-file <sha>")
+	fl := flag.NewFlagSet("cat-file", flag.ContinueOnError)
+	pretty := fl.Bool("p", false, "Pretty-print the object content.")
+	var batch, batchCheck, batchCommand batchFlag
+	fl.Var(&batch, "batch", "Print information and content of objects named on the input, optionally in given format.")
+	fl.Var(&batchCheck, "batch-check", "Print information of objects named on the input, optionally in given format.")
+	fl.Var(&batchCommand, "batch-command", "Run info and contents commands read from the input, optionally printing information in given format.")
+	buffer := fl.Bool("buffer", false, "Buffer the batch output, which is flushed by the flush command of --batch-command.")
+	if err := fl.Parse(args); err != nil {
+		return err
 	}
-	hash := args[0]
-	sha, err := hex.DecodeString(hash)
-	if err != nil {
-		return fmt.Errorf("invalid hash value: %w", err)
+	modes := 0
+	for _, f := range []batchFlag{batch, batchCheck, batchCommand} {
+		if f.enabled {
+			modes++
+		}
+	}
+	if modes != 0 {
+		if fl.NArg() != 0 || *pretty || modes > 1 {
+			return errors.New("usage: cat-file (--batch | --batch-check | --batch-command)[=<format>] [--buffer]")
+		}
+		repo, err := FindRepository(".")
+		if err != nil {
+			return fmt.Errorf("cannot open git repository: %w", err)
+		}
+		switch {
+		case batch.enabled:
+			return catFileBatch(input, output, repo, batch.format, true, *buffer)
+		case batchCheck.enabled:
+			return catFileBatch(input, output, repo, batchCheck.format, false, *buffer)
+		default:
+			return catFileBatchCommand(input, output, repo, batchCommand.format, *buffer)
+		}
+	}
+	if fl.NArg() != 1 {
+		return errors.New("usage: cat-file [-p] <object>\n   or: cat-file (--batch | --batch-check | --batch-command)[=<format>] [--buffer]")
 	}
 	repo, err := FindRepository(".")
 	if err != nil {
 		return fmt.Errorf("cannot open git repository: %w", err)
 	}
+	sha, err := repo.Resolve(fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *pretty {
+		return prettyPrintObject(output, repo, sha)
+	}
 	obj, err := repo.ReadObject(sha)
 	if err != nil {
 		return fmt.Errorf("cannot read object: %w", err)
@@ -71,206 +200,4686 @@ func cmdCatFile(input io.Reader, output io.Writer, args []string) error {
 	return nil
 }
 
-func cmdLog(input io.Reader, output io.Writer, args []string) error {
-	if len(args) != 1 {
-		return errors.New("usage: log <sha>")
-	}
-	hash := args[0]
-	sha, err := hex.DecodeString(hash)
-	if err != nil {
-		return fmt.Errorf("invalid hash value: %w", err)
+// catFileBatch reads object names from the input, one per line, and
+// writes information about every object in git's batch format. The default
+// format is "%(objectname) %(objecttype) %(objectsize)". With contents, the
+// object content and a new line follow. Objects that do not exist are
+// reported with the name followed by "missing". With buffer, output is not
+// flushed after every object.
+func catFileBatch(input io.Reader, output io.Writer, repo *Repository, format string, contents, buffer bool) error {
+	// The rest of the line after the object name is only split when it is
+	// used, so that names with spaces such as "HEAD:a b" can be given.
+	splitRest := strings.Contains(format, "%(rest)")
+	w := bufio.NewWriter(output)
+	lines := bufio.NewScanner(input)
+	lines.Buffer(nil, 1<<20)
+	for lines.Scan() {
+		name, rest := lines.Text(), ""
+		if splitRest {
+			if i := strings.IndexAny(name, " \t"); i >= 0 {
+				name, rest = name[:i], strings.TrimLeft(name[i:], " \t")
+			}
+		}
+		if err := writeBatchObject(w, repo, format, name, rest, contents); err != nil {
+			return err
+		}
+		// Output is flushed after every object, so that the caller can
+		// read the answer before sending another name.
+		if !buffer {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
 	}
-	repo, err := FindRepository(".")
-	if err != nil {
-		return fmt.Errorf("cannot open git repository: %w", err)
+	if err := lines.Err(); err != nil {
+		return err
 	}
+	return w.Flush()
+}
 
-	var b bytes.Buffer
-	fmt.Fprintln(&b, "digraph gogitlog{")
-	seen := map[string]struct{}{}
-	if err := writeGraphviz(&b, repo, seen, sha); err != nil {
+// catFileBatchCommand runs commands read from the input, one per line:
+// "contents <object>" and "info <object>" print the object as catFileBatch
+// does with and without contents. With buffer, output is written only by
+// the "flush" command and at the end of the input.
+func catFileBatchCommand(input io.Reader, output io.Writer, repo *Repository, format string, buffer bool) error {
+	w := bufio.NewWriter(output)
+	lines := bufio.NewScanner(input)
+	lines.Buffer(nil, 1<<20)
+	for lines.Scan() {
+		line := lines.Text()
+		if line == "" {
+			return errors.New("empty command in input")
+		}
+		if strings.TrimLeft(line, " \t") != line {
+			return fmt.Errorf("whitespace before command: '%s'", line)
+		}
+		command, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			command, arg = line[:i], line[i+1:]
+		}
+		switch command {
+		case "contents", "info":
+			if arg == "" {
+				return fmt.Errorf("%s requires arguments", command)
+			}
+			if err := writeBatchObject(w, repo, format, arg, "", command == "contents"); err != nil {
+				return err
+			}
+			if buffer {
+				continue
+			}
+		case "flush":
+			if !buffer {
+				return errors.New("flush is only for --buffer mode")
+			}
+			if arg != "" {
+				return errors.New("flush takes no arguments")
+			}
+		default:
+			return fmt.Errorf("unknown command: '%s'", line)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := lines.Err(); err != nil {
 		return err
 	}
-	fmt.Fprintln(&b, "}")
-	_, err = b.WriteTo(output)
-	return err
+	return w.Flush()
 }
 
-func writeGraphviz(w io.Writer, repo *Repository, seen map[string]struct{}, sha []byte) error {
-	obj, err := repo.ReadObject(sha)
+// writeBatchObject writes information about the named object in the batch
+// format, followed by the object content if contents is set.
+func writeBatchObject(w *bufio.Writer, repo *Repository, format, name, rest string, contents bool) error {
+	if format == "" {
+		format = "%(objectname) %(objecttype) %(objectsize)"
+	}
+	var kind string
+	var content []byte
+	sha, err := repo.Resolve(name)
+	if err == nil {
+		kind, content, err = repo.ReadRawObject(sha)
+	}
+	var ambiguous *AmbiguousHashError
+	if errors.As(err, &ambiguous) {
+		fmt.Fprintf(w, "%s ambiguous\n", name)
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("read %q object: %w", sha, err)
+		fmt.Fprintf(w, "%s missing\n", name)
+		return nil
 	}
-	c, ok := obj.(*CommitObject)
-	if !ok {
-		return fmt.Errorf("not a commit object: %T", obj)
+	header, err := expandBatchFormat(repo, format, sha, kind, len(content), rest)
+	if err != nil {
+		return err
 	}
+	w.WriteString(header)
+	w.WriteByte('\n')
+	if contents {
+		w.Write(content)
+		w.WriteByte('\n')
+	}
+	return nil
+}
 
-	for _, parent := range c.Header["parent"] {
-		fmt.Fprintf(w, "\"%x\" -> \"%s\";\n", sha, parent)
-		parentSha, err := hex.DecodeString(parent)
-		if err != nil {
-			return fmt.Errorf("invalid %q parent sha: %w", parent, err)
+// expandBatchFormat replaces %(atom) placeholders of a cat-file batch
+// format.
+func expandBatchFormat(repo *Repository, format string, sha []byte, kind string, size int, rest string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(format, "%(")
+		if start < 0 {
+			b.WriteString(format)
+			return b.String(), nil
 		}
-		if err := writeGraphviz(w, repo, seen, parentSha); err != nil {
-			return err
+		end := strings.IndexByte(format[start:], ')')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated format element %q", format[start:])
+		}
+		b.WriteString(format[:start])
+		atom := format[start+2 : start+end]
+		format = format[start+end+1:]
+		switch atom {
+		case "objectname":
+			fmt.Fprintf(&b, "%x", sha)
+		case "objecttype":
+			b.WriteString(kind)
+		case "objectsize":
+			b.WriteString(strconv.Itoa(size))
+		case "objectsize:disk":
+			size, _, err := repo.objectDiskInfo(sha)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(strconv.FormatInt(size, 10))
+		case "deltabase":
+			_, base, err := repo.objectDiskInfo(sha)
+			if err != nil {
+				return "", err
+			}
+			if base == nil {
+				base = make([]byte, 20)
+			}
+			fmt.Fprintf(&b, "%x", base)
+		case "rest":
+			b.WriteString(rest)
+		default:
+			return "", fmt.Errorf("unknown format element: %s", atom)
 		}
 	}
-	return nil
 }
 
-func cmdLsTree(input io.Reader, output io.Writer, args []string) error {
-	if len(args) != 1 {
-		return errors.New("usage: ls-tree <sha>")
-	}
-	hash := args[0]
-	sha, err := hex.DecodeString(hash)
+// prettyPrintObject writes the object content the way git cat-file -p
+// does. Trees are listed, all other objects are written as they are.
+func prettyPrintObject(w io.Writer, repo *Repository, sha []byte) error {
+	kind, content, err := repo.ReadRawObject(sha)
 	if err != nil {
-		return fmt.Errorf("invalid hash value: %w", err)
+		return fmt.Errorf("cannot read object: %w", err)
 	}
-	repo, err := FindRepository(".")
-	if err != nil {
-		return fmt.Errorf("cannot open git repository: %w", err)
+	if kind != "tree" {
+		_, err := w.Write(content)
+		return err
 	}
-
-	obj, err := repo.ReadObject(sha)
-	if err != nil {
-		return fmt.Errorf("read %q object: %w", sha, err)
+	var tr TreeObject
+	if err := tr.Deserialize(content); err != nil {
+		return fmt.Errorf("deserialize tree: %w", err)
 	}
-	tr, ok := obj.(*TreeObject)
-	if !ok {
-		return fmt.Errorf("not a tree object: %T", obj)
+	quote, err := repo.pathQuoter()
+	if err != nil {
+		return err
 	}
+	var b bytes.Buffer
 	for _, leaf := range tr.Leafs {
-		fmt.Printf("%s\t%q\t%x\n", leaf.Mode, leaf.Path, leaf.Sha)
+		leafKind := "blob"
+		switch leaf.Mode {
+		case modeTree:
+			leafKind = "tree"
+		case modeGitlink:
+			leafKind = "commit"
+		}
+		fmt.Fprintf(&b, "%06d %s %x\t%s\n", leaf.Mode, leafKind, leaf.Sha, quote(leaf.Path))
 	}
-	return nil
-
+	_, err = b.WriteTo(w)
+	return err
 }
 
-func cmdCheckout(input io.Reader, output io.Writer, args []string) error {
-	if len(args) != 2 {
-		return errors.New("usage: checkout <commit> <path>")
+func cmdLog(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("log", flag.ContinueOnError)
+	showSignature := fl.Bool("show-signature", false, "Verify signed commits and annotate them with the result.")
+	patch := fl.Bool("p", false, "Show the patch of each commit against its first parent.")
+	fl.BoolVar(patch, "patch", false, "Same as -p.")
+	perParent := fl.Bool("m", false, "Show the patch of merge commits against each parent.")
+	combined := fl.Bool("cc", false, "Show the dense combined diff of merge commits.")
+	decorate := fl.Bool("decorate", false, "Show the names of references pointing to the commits.")
+	format := fl.String("format", "medium", "Show commits in the medium, oneline or dot format, or with a format:<string>.")
+	oneline := fl.Bool("oneline", false, "Show each commit on a single line, with an abbreviated hash.")
+	graph := fl.Bool("graph", false, "Draw the history graph next to the commits.")
+	maxCount := fl.Int("n", -1, "Show at most this number of commits.")
+	fl.IntVar(maxCount, "max-count", -1, "Same as -n.")
+	walkFlags := addRevWalkFlags(fl)
+	// -<number> and -n<number> are the same as -n <number>.
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if len(arg) > 1 && arg[0] == '-' && arg[1] >= '0' && arg[1] <= '9' {
+			args[i] = "-n=" + arg[1:]
+		} else if strings.HasPrefix(arg, "-n") && len(arg) > 2 && arg[2] >= '0' && arg[2] <= '9' {
+			args[i] = "-n=" + arg[2:]
+		}
 	}
-
-	sha, err := hex.DecodeString(args[0])
-	if err != nil {
-		return fmt.Errorf("invalid hash value: %w", err)
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	revs, paths := fl.Args(), []string(nil)
+	for i, arg := range revs {
+		if arg == "--" {
+			revs, paths = revs[:i], revs[i+1:]
+			break
+		}
+	}
+	if len(revs) == 0 {
+		revs = []string{"HEAD"}
 	}
 	repo, err := FindRepository(".")
 	if err != nil {
 		return fmt.Errorf("cannot open git repository: %w", err)
 	}
-
-	obj, err := repo.ReadObject(sha)
+	rng, err := repo.ResolveRevisionRange(revs)
 	if err != nil {
-		return fmt.Errorf("read %q object: %w", sha, err)
+		return err
+	}
+	ps, err := repo.parseCwdPathspec(paths)
+	if err != nil {
+		return err
 	}
 
-	var tr *TreeObject
-	switch obj := obj.(type) {
-	case *CommitObject:
-		sha, err := hex.DecodeString(obj.Header["tree"][0]) // Can not exist?
-		if err != nil {
-			return fmt.Errorf("invalid tree hash value: %w", err)
+	if *format == "dot" && !*oneline {
+		// Limited history is not a graph, so it cannot be shown as one.
+		if *patch || *combined || *decorate || *graph || *maxCount >= 0 || walkFlags.isSet() || !ps.IsEmpty() || len(rng.Include) != 1 || len(rng.Exclude) != 0 {
+			return errors.New("usage: log --format=dot [--show-signature] <revision>")
 		}
-		tobj, err := repo.ReadObject(sha)
-		if err != nil {
-			return fmt.Errorf("read %q tree object: %w", sha, err)
+		var b bytes.Buffer
+		fmt.Fprintln(&b, "digraph gogitlog{")
+		seen := map[string]struct{}{}
+		if err := writeGraphviz(&b, repo, seen, rng.Include[0], *showSignature); err != nil {
+			return err
 		}
-		tr = tobj.(*TreeObject)
-	case *TreeObject:
-		tr = obj
-	default:
-		return fmt.Errorf("unexpected %T", obj)
+		fmt.Fprintln(&b, "}")
+		_, err = b.WriteTo(output)
+		return err
 	}
 
-	destDir, err := filepath.Abs(args[1])
-	if err != nil {
-		return fmt.Errorf("absolute path for %q: %w", args[1], err)
+	opts := logOptions{
+		showSignature: *showSignature,
+		patch:         *patch || *combined,
+		perParent:     *perParent,
+		combined:      *combined,
+		walk:          walkFlags,
+		paths:         ps,
+		graph:         *graph,
+		maxCount:      *maxCount,
+	}
+	if *oneline {
+		opts.format = logFormat{name: "oneline", abbrev: true, terminated: true}
+	} else if opts.format, err = parseLogFormat(*format); err != nil {
+		return err
+	}
+	if *decorate {
+		if opts.decorations, err = repo.refDecorations(); err != nil {
+			return err
+		}
 	}
+	return writeLogText(output, repo, rng, opts)
+}
 
-	_ = os.MkdirAll(destDir, newDirPerm)
+type logOptions struct {
+	showSignature bool
+	patch         bool
+	format        logFormat
+	walk          *revWalkFlags
+	// paths limits the history to commits that change them, and the
+	// patches to those paths.
+	paths *Pathspec
+	// perParent shows merges against each of their parents, and combined
+	// shows the combined diff. Otherwise merges have no patch.
+	perParent bool
+	combined  bool
+	// decorations are the names of references by the commit they point
+	// to, shown next to the commit hash.
+	decorations map[string][]string
+	// graph draws the history graph next to the commits.
+	graph bool
+	// maxCount limits the number of commits shown, unless negative.
+	maxCount int
+}
 
-	// Use path instead of repo path to allow to checkout in any directory.
-	// This is better for testing.
-	return treeCheckout(repo, tr, destDir)
+// logFormat is the format commits are shown in by log.
+type logFormat struct {
+	// name is medium, oneline or format, in which case user is the format
+	// string.
+	name string
+	user string
+	// abbrev shortens the commit hash in the oneline format.
+	abbrev bool
+	// terminated entries end with a newline. Other entries are separated
+	// by one.
+	terminated bool
 }
 
-func treeCheckout(repo *Repository, tr *TreeObject, path string) error {
-	for _, leaf := range tr.Leafs {
-		obj, err := repo.ReadObject(leaf.Sha)
+// parseLogFormat parses the value of log --format. Same as git, a value
+// with placeholders is taken as tformat:<value>.
+func parseLogFormat(s string) (logFormat, error) {
+	switch {
+	case s == "medium":
+		return logFormat{name: "medium"}, nil
+	case s == "oneline":
+		return logFormat{name: "oneline", terminated: true}, nil
+	case strings.HasPrefix(s, "format:"):
+		return logFormat{name: "format", user: strings.TrimPrefix(s, "format:")}, nil
+	case strings.HasPrefix(s, "tformat:"):
+		return logFormat{name: "format", user: strings.TrimPrefix(s, "tformat:"), terminated: true}, nil
+	case strings.Contains(s, "%"):
+		return logFormat{name: "format", user: s, terminated: true}, nil
+	}
+	return logFormat{}, fmt.Errorf("invalid --format: %s", s)
+}
+
+// writeLogText writes the history in the text format, optionally with the
+// patch of every commit. Output is written as commits are walked, so that no
+// more than a single commit is kept in memory, unless the graph is drawn.
+// The graph needs the whole history to put children before their parents.
+func writeLogText(output io.Writer, repo *Repository, rng *RevisionRange, opts logOptions) error {
+	lw := &logWriter{w: bufio.NewWriter(output), repo: repo, opts: &opts}
+	walk, err := opts.walk.newWalk(repo, rng)
+	if err != nil {
+		return err
+	}
+	ps := opts.paths
+	walk.Paths = ps
+	next := walk.Next
+	var parents map[string][][]byte
+	if opts.graph {
+		lw.graph = &logGraph{}
+		var commits []*WalkedCommit
+		for {
+			c, err := walk.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			commits = append(commits, c)
+		}
+		commits, parents = sortForGraph(commits, walk.FirstParent)
+		next = func() (*WalkedCommit, error) {
+			if len(commits) == 0 {
+				return nil, io.EOF
+			}
+			c := commits[0]
+			commits = commits[1:]
+			return c, nil
+		}
+	}
+
+	for n := 0; opts.maxCount < 0 || n < opts.maxCount; n++ {
+		c, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
 		if err != nil {
-			return fmt.Errorf("read %x: %w", leaf.Sha, err)
+			return err
 		}
-		dest := filepath.Join(path, leaf.Path)
-		switch obj := obj.(type) {
-		case *TreeObject:
-			if err := os.MkdirAll(dest, newDirPerm); err != nil {
-				return fmt.Errorf("mkdir %q: %w", dest, err)
+		if lw.graph != nil {
+			lw.graph.update(c.Sha, parents[string(c.Sha)])
+		}
+		if !opts.patch {
+			if err := lw.writeCommit(c, nil); err != nil {
+				return err
 			}
-			treeCheckout(repo, obj, dest)
-		case *BlobObject:
-			if err := ioutil.WriteFile(dest, obj.Data, 0644); err != nil {
-				return fmt.Errorf("write %q blob: %w", dest, err)
+			continue
+		}
+		tree, err := repo.commitTree(c.Commit)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(c.Parents) < 2:
+			var parent *TreeObject
+			if len(c.Parents) == 1 {
+				if parent, err = repo.readTreeish(hex.EncodeToString(c.Parents[0])); err != nil {
+					return err
+				}
+			}
+			if err := lw.writeCommit(c, nil); err != nil {
+				return err
+			}
+			var b bytes.Buffer
+			if err := writeLogPatch(&b, repo, parent, tree, ps); err != nil {
+				return err
+			}
+			lw.writePatch(b.Bytes())
+		case opts.combined:
+			var parents []*TreeObject
+			for _, p := range c.Parents {
+				tr, err := repo.readTreeish(hex.EncodeToString(p))
+				if err != nil {
+					return err
+				}
+				parents = append(parents, tr)
+			}
+			if err := lw.writeCommit(c, nil); err != nil {
+				return err
+			}
+			var b bytes.Buffer
+			if err := repo.WriteCombinedPatch(&b, parents, tree, true, ps); err != nil {
+				return err
+			}
+			lw.writePatch(b.Bytes())
+		case opts.perParent:
+			for _, p := range c.Parents {
+				parent, err := repo.readTreeish(hex.EncodeToString(p))
+				if err != nil {
+					return err
+				}
+				if err := lw.writeCommit(c, p); err != nil {
+					return err
+				}
+				var b bytes.Buffer
+				if err := writeLogPatch(&b, repo, parent, tree, ps); err != nil {
+					return err
+				}
+				lw.writePatch(b.Bytes())
 			}
 		default:
-			return fmt.Errorf("unexpected %T", obj)
+			if err := lw.writeCommit(c, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return lw.w.Flush()
+}
+
+// logWriter writes the commits of log in their format, next to the graph if
+// one is drawn.
+type logWriter struct {
+	w     *bufio.Writer
+	repo  *Repository
+	opts  *logOptions
+	graph *logGraph
+	shown bool
+	// missingNewline is set if the last message did not end with a
+	// newline, so that no graph goes before the separator.
+	missingNewline bool
+}
+
+// writeCommit writes the commit. From is the parent the following patch is
+// computed against, if the commit is a merge shown with a patch against each
+// parent.
+func (lw *logWriter) writeCommit(c *WalkedCommit, from []byte) error {
+	format := lw.opts.format
+	if lw.shown && !format.terminated {
+		if lw.graph != nil && !lw.missingNewline {
+			lw.w.WriteString(lw.graph.paddingLine())
+		}
+		lw.w.WriteByte('\n')
+	}
+	lw.shown = true
+
+	var head, msg string
+	switch format.name {
+	case "oneline":
+		sha := hex.EncodeToString(c.Sha)
+		if format.abbrev {
+			sha = shortHash(c.Sha)
+		}
+		head = sha
+		if from != nil {
+			if format.abbrev {
+				head += fmt.Sprintf(" (from %s)", shortHash(from))
+			} else {
+				head += fmt.Sprintf(" (from %x)", from)
+			}
 		}
+		if names := lw.opts.decorations[string(c.Sha)]; len(names) != 0 {
+			head += fmt.Sprintf(" (%s)", strings.Join(names, ", "))
+		}
+		head += " "
+		msg = commitSubject(lw.repo.displayCommit(c.Commit))
+	case "format":
+		msg = formatCommit(format.user, c.Sha, lw.repo.displayCommit(c.Commit))
+	default:
+		var b bytes.Buffer
+		if err := writeLogCommit(&b, lw.repo, c, from, lw.opts); err != nil {
+			return err
+		}
+		text := b.String()
+		i := strings.IndexByte(text, '\n')
+		head, msg = text[:i], text[i+1:]
+	}
+
+	if lw.graph == nil {
+		lw.w.WriteString(head)
+		if format.name == "medium" {
+			lw.w.WriteByte('\n')
+		}
+		lw.w.WriteString(msg)
+	} else {
+		lw.graph.writeCommit(lw.w)
+		lw.w.WriteString(head)
+		if format.name == "medium" {
+			lw.w.WriteByte('\n')
+			line, _ := lw.graph.nextLine()
+			lw.w.WriteString(line)
+		}
+		lw.graph.writeMessage(lw.w, msg)
+	}
+	lw.missingNewline = !strings.HasSuffix(msg, "\n")
+	if format.terminated {
+		if lw.graph != nil && !lw.missingNewline {
+			lw.w.WriteString(lw.graph.paddingLine())
+		}
+		lw.w.WriteByte('\n')
 	}
 	return nil
 }
 
-func cmdShowRef(input io.Reader, output io.Writer, args []string) error {
-	if len(args) != 0 {
-		return errors.New("usage: show-ref")
+// writePatch writes the patch following a commit. Except in the oneline
+// format, it is separated from the message by an empty line.
+func (lw *logWriter) writePatch(patch []byte) {
+	if len(patch) == 0 {
+		return
+	}
+	if lw.opts.format.name != "oneline" {
+		lw.writePatchLine([]byte("\n"))
+	}
+	for len(patch) != 0 {
+		i := bytes.IndexByte(patch, '\n') + 1
+		if i == 0 {
+			i = len(patch)
+		}
+		lw.writePatchLine(patch[:i])
+		patch = patch[i:]
 	}
+}
 
-	repo, err := FindRepository(".")
-	if err != nil {
-		return fmt.Errorf("cannot open git repository: %w", err)
+func (lw *logWriter) writePatchLine(line []byte) {
+	if lw.graph != nil {
+		lw.w.WriteString(lw.graph.paddingLine())
 	}
+	lw.w.Write(line)
+}
 
+// writeLogCommit writes the commit header and message in the medium format.
+// From is the parent the following patch is computed against, if the commit
+// is a merge shown with a patch against each parent.
+func writeLogCommit(w io.Writer, repo *Repository, c *WalkedCommit, from []byte, opts *logOptions) error {
 	var b bytes.Buffer
-	err = filepath.Walk(filepath.Join(repo.gitdir, "refs"), func(path string, info os.FileInfo, err error) error {
+	fmt.Fprintf(&b, "commit %x", c.Sha)
+	if from != nil {
+		fmt.Fprintf(&b, " (from %x)", from)
+	}
+	if names := opts.decorations[string(c.Sha)]; len(names) != 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(names, ", "))
+	}
+	b.WriteByte('\n')
+	if opts.showSignature {
+		v, err := repo.VerifyCommit(c.Commit)
 		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
+			return fmt.Errorf("verify %x signature: %w", c.Sha, err)
 		}
-		content, err := ioutil.ReadFile(path)
-		if err != nil {
-			return fmt.Errorf("read %q: %w", path, err)
+		b.WriteString(v.Output)
+	}
+	if len(c.Parents) > 1 {
+		short := make([]string, len(c.Parents))
+		for i, p := range c.Parents {
+			short[i] = shortHash(p)
 		}
-		ref := string(bytes.TrimSpace(content))
-		if _, err := fmt.Fprintf(&b, "%s %s\n", ref, path[len(repo.gitdir)+1:]); err != nil {
-			return fmt.Errorf("write: %w", err)
+		fmt.Fprintf(&b, "Merge: %s\n", strings.Join(short, " "))
+	}
+	commit := repo.displayCommit(c.Commit)
+	if author := commit.Header["author"]; len(author) != 0 {
+		if id, err := parseIdent(author[0]); err == nil {
+			fmt.Fprintf(&b, "Author: %s <%s>\n", id.Name, id.Email)
+			fmt.Fprintf(&b, "Date:   %s\n", id.When.Format(logDateFormat))
+		} else {
+			fmt.Fprintf(&b, "Author: %s\n", author[0])
 		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("walk: %w", err)
 	}
-	if _, err := b.WriteTo(output); err != nil {
-		return fmt.Errorf("write to stdout: %w", err)
+	b.WriteByte('\n')
+	for _, line := range strings.Split(strings.TrimRight(commit.Comment, "\n"), "\n") {
+		fmt.Fprintf(&b, "    %s\n", line)
 	}
-	return nil
+	_, err := b.WriteTo(w)
+	return err
 }
 
-func cmdTag(input io.Reader, output io.Writer, args []string) error {
-	if len(args) != 2 {
-		// Only a single format is supported. Lazy.
-		return errors.New("usage: tag <name> <hash>")
-	}
+// logDateFormat is the default date format of git log.
+const logDateFormat = "Mon Jan 2 15:04:05 2006 -0700"
 
-	repo, err := FindRepository(".")
+// writeLogPatch writes the patch between two trees. Parent tree can be nil.
+func writeLogPatch(w io.Writer, repo *Repository, parent, tree *TreeObject, ps *Pathspec) error {
+	changes, err := repo.DiffTrees(parent, tree, true, ps)
 	if err != nil {
-		return fmt.Errorf("cannot open git repository: %w", err)
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
 	}
+	return repo.WritePatch(w, changes)
+}
 
-	if err := repo.WriteFile(true, []byte(args[1]+"\n"), "refs", "tags", args[0]); err != nil {
-		return fmt.Errorf("write tag file: %w", err)
+func writeGraphviz(w io.Writer, repo *Repository, seen map[string]struct{}, sha []byte, showSignature bool) error {
+	if _, ok := seen[string(sha)]; ok {
+		return nil
 	}
-	return nil
+	seen[string(sha)] = struct{}{}
+
+	obj, err := repo.ReadObject(sha)
+	if err != nil {
+		return fmt.Errorf("read %q object: %w", sha, err)
+	}
+	c, ok := obj.(*CommitObject)
+	if !ok {
+		return fmt.Errorf("not a commit object: %T", obj)
+	}
+
+	if showSignature {
+		v, err := repo.VerifyCommit(c)
+		if err != nil {
+			return fmt.Errorf("verify %x signature: %w", sha, err)
+		}
+		color := "black"
+		switch {
+		case v.Valid():
+			color = "green"
+		case v.Status != SignatureNone:
+			color = "red"
+		}
+		fmt.Fprintf(w, "\"%x\" [color=%s label=%q];\n", sha, color, fmt.Sprintf("%x\n%s %s", sha, v.Status, v.Signer))
+	}
+
+	for _, parent := range c.Header["parent"] {
+		fmt.Fprintf(w, "\"%x\" -> \"%s\";\n", sha, parent)
+		parentSha, err := hex.DecodeString(parent)
+		if err != nil {
+			return fmt.Errorf("invalid %q parent sha: %w", parent, err)
+		}
+		if err := writeGraphviz(w, repo, seen, parentSha, showSignature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stringsFlag is a flag that can be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ", ") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// revWalkFlags registers flags limiting walked commits, shared by log and
+// rev-list.
+type revWalkFlags struct {
+	author, committer, grep stringsFlag
+	invertGrep              *bool
+	ignoreCase              *bool
+	merges                  *bool
+	noMerges                *bool
+	firstParent             *bool
+	ancestryPath            *string
+}
+
+func addRevWalkFlags(fl *flag.FlagSet) *revWalkFlags {
+	f := &revWalkFlags{}
+	fl.Var(&f.author, "author", "Limit to commits with author matching the regular expression.")
+	fl.Var(&f.committer, "committer", "Limit to commits with committer matching the regular expression.")
+	fl.Var(&f.grep, "grep", "Limit to commits with message matching the regular expression.")
+	f.invertGrep = fl.Bool("invert-grep", false, "Limit to commits with message not matching --grep patterns.")
+	f.ignoreCase = fl.Bool("i", false, "Match the regular expressions without regard to letter case.")
+	fl.BoolVar(f.ignoreCase, "regexp-ignore-case", false, "Same as -i.")
+	f.merges = fl.Bool("merges", false, "Limit to merge commits.")
+	f.noMerges = fl.Bool("no-merges", false, "Do not show merge commits.")
+	f.firstParent = fl.Bool("first-parent", false, "Follow only the first parent of merge commits.")
+	f.ancestryPath = fl.String("ancestry-path", "", "Limit to commits that are descendants of the given commit.")
+	return f
+}
+
+// isSet returns true if any of the flags changes the walk.
+func (f *revWalkFlags) isSet() bool {
+	return len(f.author) != 0 || len(f.committer) != 0 || len(f.grep) != 0 ||
+		*f.merges || *f.noMerges || *f.firstParent || *f.ancestryPath != ""
+}
+
+// newWalk returns a walk over the range, set up according to the flags.
+func (f *revWalkFlags) newWalk(repo *Repository, rng *RevisionRange) (*RevWalk, error) {
+	walk, err := repo.NewRevWalk(rng.Include)
+	if err != nil {
+		return nil, err
+	}
+	for _, sha := range rng.Exclude {
+		if err := walk.Hide(sha); err != nil {
+			return nil, err
+		}
+	}
+
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		var res []*regexp.Regexp
+		for _, p := range patterns {
+			if *f.ignoreCase {
+				p = "(?i)" + p
+			}
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern: %w", err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	cf := &CommitFilter{InvertGrep: *f.invertGrep, Merges: *f.merges, NoMerges: *f.noMerges}
+	if cf.Author, err = compile(f.author); err != nil {
+		return nil, err
+	}
+	if cf.Committer, err = compile(f.committer); err != nil {
+		return nil, err
+	}
+	if cf.Grep, err = compile(f.grep); err != nil {
+		return nil, err
+	}
+	if !cf.IsEmpty() {
+		walk.Filter = cf
+	}
+	walk.FirstParent = *f.firstParent
+	if *f.ancestryPath != "" {
+		sha, err := repo.resolveCommit(*f.ancestryPath)
+		if err != nil {
+			return nil, err
+		}
+		walk.AncestryPath = [][]byte{sha}
+	}
+	return walk, nil
+}
+
+func cmdRevList(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("rev-list", flag.ContinueOnError)
+	walkFlags := addRevWalkFlags(fl)
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() == 0 {
+		return errors.New("usage: rev-list [<walk options>...] <revision range>...")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	rng, err := repo.ResolveRevisionRange(fl.Args())
+	if err != nil {
+		return err
+	}
+	walk, err := walkFlags.newWalk(repo, rng)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(output)
+	for {
+		c, err := walk.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%x\n", c.Sha)
+	}
+	return w.Flush()
+}
+
+func cmdRevParse(input io.Reader, output io.Writer, args []string) error {
+	const usage = "usage: rev-parse [--short] [--symbolic-full-name | --abbrev-ref] <revision>...\n" +
+		"   or: rev-parse --verify [-q] <revision>\n" +
+		"   or: rev-parse --git-dir | --show-toplevel"
+	fl := flag.NewFlagSet("rev-parse", flag.ContinueOnError)
+	verify := fl.Bool("verify", false, "Resolve exactly one revision to an object.")
+	quiet := fl.Bool("q", false, "With --verify, do not print an error if the revision is invalid, only exit with status 1.")
+	fl.BoolVar(quiet, "quiet", false, "Same as -q.")
+	short := fl.Bool("short", false, "Print abbreviated hashes.")
+	fullName := fl.Bool("symbolic-full-name", false, "Print full names of references instead of hashes.")
+	abbrevRef := fl.Bool("abbrev-ref", false, "Print short names of references instead of hashes.")
+	gitDir := fl.Bool("git-dir", false, "Print the path of the git directory.")
+	topLevel := fl.Bool("show-toplevel", false, "Print the path of the working tree.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if (*verify && fl.NArg() != 1) || (*gitDir || *topLevel) == (fl.NArg() != 0) {
+		return errors.New(usage)
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+
+	w := bufio.NewWriter(output)
+	if *gitDir {
+		fmt.Fprintln(w, repo.gitdir)
+	}
+	if *topLevel {
+		if repo.workdir == "" {
+			return errors.New("this operation must be run in a work tree")
+		}
+		fmt.Fprintln(w, repo.workdir)
+	}
+	printHash := func(prefix string, sha []byte) {
+		if *short {
+			fmt.Fprintf(w, "%s%s\n", prefix, shortHash(sha))
+		} else {
+			fmt.Fprintf(w, "%s%x\n", prefix, sha)
+		}
+	}
+	for _, rev := range fl.Args() {
+		if *verify {
+			sha, err := repo.Resolve(rev)
+			if err == nil {
+				_, err = repo.peelObject(sha, "object")
+			}
+			if err != nil {
+				if *quiet {
+					return exitCode(1)
+				}
+				return err
+			}
+			printHash("", sha)
+			continue
+		}
+		if *fullName || *abbrevRef {
+			name, err := repo.revisionRefName(rev)
+			if err != nil {
+				return err
+			}
+			if *abbrevRef {
+				name = shortRefName(name)
+			}
+			if name != "" {
+				fmt.Fprintln(w, name)
+			}
+			continue
+		}
+		if from, to, symmetric, ok := splitRevisionRange(rev); ok {
+			a, err := repo.resolveCommit(from)
+			if err != nil {
+				return err
+			}
+			b, err := repo.resolveCommit(to)
+			if err != nil {
+				return err
+			}
+			if !symmetric {
+				printHash("", b)
+				printHash("^", a)
+				continue
+			}
+			bases, err := repo.MergeBases(a, b)
+			if err != nil {
+				return err
+			}
+			printHash("", b)
+			printHash("", a)
+			for _, base := range bases {
+				printHash("^", base)
+			}
+			continue
+		}
+		exclude := strings.HasPrefix(rev, "^")
+		sha, err := repo.Resolve(strings.TrimPrefix(rev, "^"))
+		if err != nil {
+			return err
+		}
+		if exclude {
+			printHash("^", sha)
+		} else {
+			printHash("", sha)
+		}
+	}
+	return w.Flush()
+}
+
+func cmdMergeBase(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("merge-base", flag.ContinueOnError)
+	all := fl.Bool("all", false, "Print all best common ancestors.")
+	isAncestor := fl.Bool("is-ancestor", false, "Check if the first commit is an ancestor of the second one.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 2 {
+		return errors.New("usage: merge-base [--all | --is-ancestor] <commit> <commit>")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	a, err := repo.resolveCommit(fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := repo.resolveCommit(fl.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *isAncestor {
+		ok, err := repo.IsAncestor(a, b)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%s is not an ancestor of %s", fl.Arg(0), fl.Arg(1))
+		}
+		return nil
+	}
+	bases, err := repo.MergeBases(a, b)
+	if err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		return fmt.Errorf("%s and %s have no common ancestor", fl.Arg(0), fl.Arg(1))
+	}
+	if !*all {
+		bases = bases[:1]
+	}
+	w := bufio.NewWriter(output)
+	for _, sha := range bases {
+		fmt.Fprintf(w, "%x\n", sha)
+	}
+	return w.Flush()
+}
+
+func cmdMergeTree(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("merge-tree", flag.ContinueOnError)
+	// Only the mode writing the merged tree is supported, the flag is
+	// accepted for compatibility.
+	fl.Bool("write-tree", true, "Write the merged tree and print its hash.")
+	nameOnly := fl.Bool("name-only", false, "List only the names of conflicting files, without their stages.")
+	messages := fl.Bool("messages", true, "Print informational messages about the merge.")
+	noMessages := fl.Bool("no-messages", false, "Do not print informational messages about the merge.")
+	nul := fl.Bool("z", false, "Terminate entries with NUL instead of new line and do not quote paths.")
+	mergeBase := fl.String("merge-base", "", "Use the commit as the common ancestor instead of the merge base.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 2 {
+		return errors.New("usage: merge-tree [--write-tree] [--name-only] [--no-messages] [-z] [--merge-base=<commit>] <branch1> <branch2>")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	var sides [2][]byte
+	for i, rev := range fl.Args() {
+		if sides[i], err = repo.resolveCommit(rev); err != nil {
+			return err
+		}
+	}
+	opts := &MergeOptions{OursLabel: fl.Arg(0), TheirsLabel: fl.Arg(1)}
+	var res *MergeResult
+	if *mergeBase != "" {
+		trees := make([][]byte, 3)
+		for i, sha := range [][]byte{nil, sides[0], sides[1]} {
+			if i == 0 {
+				if sha, err = repo.Resolve(*mergeBase); err != nil {
+					return err
+				}
+			}
+			if trees[i], err = repo.peelObject(sha, "tree"); err != nil {
+				return err
+			}
+		}
+		res, err = repo.MergeTrees(trees[0], trees[1], trees[2], opts)
+	} else {
+		res, err = repo.MergeCommits(sides[0], sides[1], opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	quote, err := repo.pathQuoter()
+	if err != nil {
+		return err
+	}
+	term := "\n"
+	if *nul {
+		quote, term = rawPath, "\x00"
+	}
+	w := bufio.NewWriter(output)
+	fmt.Fprintf(w, "%x%s", res.Tree, term)
+	if len(res.Conflicts) == 0 {
+		return w.Flush()
+	}
+	listed := make(map[string]bool)
+	for _, s := range res.ConflictStages(opts) {
+		switch {
+		case !*nameOnly:
+			fmt.Fprintf(w, "%06d %x %d\t%s%s", s.Mode, s.Sha, s.Stage, quote(s.Path), term)
+		case !listed[s.Path]:
+			listed[s.Path] = true
+			fmt.Fprintf(w, "%s%s", quote(s.Path), term)
+		}
+	}
+	if *messages && !*noMessages {
+		fmt.Fprint(w, term)
+		for _, msg := range res.Messages(opts) {
+			if !*nul {
+				fmt.Fprintln(w, msg.Text)
+				continue
+			}
+			fmt.Fprintf(w, "%d\x00", len(msg.Paths))
+			for _, path := range msg.Paths {
+				fmt.Fprintf(w, "%s\x00", path)
+			}
+			fmt.Fprintf(w, "%s\x00%s\n\x00", msg.Type, msg.Text)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return exitCode(1)
+}
+
+func cmdMergeFile(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("merge-file", flag.ContinueOnError)
+	stdout := fl.Bool("p", false, "Write the result to the standard output instead of the current file.")
+	fl.BoolVar(stdout, "stdout", false, "Same as -p.")
+	ours := fl.Bool("ours", false, "Resolve conflicts with the current version.")
+	theirs := fl.Bool("theirs", false, "Resolve conflicts with the other version.")
+	union := fl.Bool("union", false, "Resolve conflicts with both versions.")
+	markerSize := fl.Int("marker-size", 7, "Length of conflict markers.")
+	// Conflicts are never warned about.
+	fl.Bool("q", false, "Do not warn about conflicts.")
+	fl.Bool("quiet", false, "Same as -q.")
+	var labels stringsFlag
+	fl.Var(&labels, "L", "Label of the current, base and other version in conflict markers, in this order.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	favors := 0
+	for _, set := range []bool{*ours, *theirs, *union} {
+		if set {
+			favors++
+		}
+	}
+	if fl.NArg() != 3 || len(labels) > 3 || favors > 1 {
+		return errors.New("usage: merge-file [-p | --stdout] [--ours | --theirs | --union] [--marker-size=<n>] [-L <current-name> [-L <base-name> [-L <other-name>]]] <current> <base> <other>")
+	}
+
+	var content [3][]byte
+	for i, name := range fl.Args() {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if isBinary(data) {
+			return fmt.Errorf("cannot merge binary files: %s", name)
+		}
+		content[i] = data
+	}
+	opts := &MergeOptions{OursLabel: fl.Arg(0), TheirsLabel: fl.Arg(2), MarkerSize: *markerSize}
+	if len(labels) > 0 {
+		opts.OursLabel = labels[0]
+	}
+	// The base label is used only by diff3 style markers.
+	if len(labels) > 2 {
+		opts.TheirsLabel = labels[2]
+	}
+	switch {
+	case *ours:
+		opts.Favor = MergeFavorOurs
+	case *theirs:
+		opts.Favor = MergeFavorTheirs
+	case *union:
+		opts.Favor = MergeFavorUnion
+	}
+	merged, conflicts := merge3(content[1], content[0], content[2], opts)
+	if *stdout {
+		if _, err := output.Write(merged); err != nil {
+			return err
+		}
+	} else if err := ioutil.WriteFile(fl.Arg(0), merged, 0644); err != nil {
+		return err
+	}
+	// Same as git, the exit status is the number of conflicts.
+	if conflicts > 127 {
+		conflicts = 127
+	}
+	if conflicts != 0 {
+		return exitCode(conflicts)
+	}
+	return nil
+}
+
+func cmdDifftool(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("difftool", flag.ContinueOnError)
+	tool := fl.String("t", "", "Use the diff tool of given name, instead of diff.tool.")
+	fl.StringVar(tool, "tool", "", "Same as -t.")
+	noPrompt := fl.Bool("y", false, "Do not prompt before launching the diff tool.")
+	fl.BoolVar(noPrompt, "no-prompt", false, "Same as -y.")
+	forcePrompt := fl.Bool("prompt", false, "Prompt before launching the diff tool, even if difftool.prompt is false.")
+	dirDiff := fl.Bool("d", false, "Launch the diff tool once, with two directories holding all changed files.")
+	fl.BoolVar(dirDiff, "dir-diff", false, "Same as -d.")
+	trustExitCode := fl.Bool("trust-exit-code", false, "Stop when the diff tool exits with a non-zero status, and exit with it.")
+	cached := fl.Bool("cached", false, "Compare the index with the commit, or HEAD, instead of the worktree.")
+	fl.BoolVar(cached, "staged", false, "Same as --cached.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	dt, err := repo.diffTool(*tool)
+	if err != nil {
+		return err
+	}
+	dt.TrustExitCode = dt.TrustExitCode || *trustExitCode
+	prompt, err := repo.config.Bool("difftool", "", "prompt", true)
+	if err != nil {
+		return err
+	}
+	prompt = (prompt || *forcePrompt) && !*noPrompt
+
+	// Leading arguments that are revisions select the trees to compare,
+	// the rest is the pathspec.
+	rest := fl.Args()
+	var revs []string
+	for len(rest) != 0 && rest[0] != "--" && len(revs) < 2 {
+		if from, to, symmetric, ok := splitRevisionRange(rest[0]); ok && len(revs) == 0 {
+			if symmetric {
+				x, err := repo.resolveCommit(from)
+				if err != nil {
+					return err
+				}
+				y, err := repo.resolveCommit(to)
+				if err != nil {
+					return err
+				}
+				bases, err := repo.MergeBases(x, y)
+				if err != nil {
+					return err
+				}
+				if len(bases) == 0 {
+					return fmt.Errorf("%s and %s have no common ancestor", from, to)
+				}
+				from = hex.EncodeToString(bases[0])
+			}
+			revs = []string{from, to}
+			rest = rest[1:]
+			break
+		}
+		if _, err := repo.Resolve(rest[0]); err != nil {
+			break
+		}
+		revs = append(revs, rest[0])
+		rest = rest[1:]
+	}
+	if len(revs) == 2 && *cached {
+		return errors.New("usage: difftool [-t <tool>] [-y | --prompt] [-d] [--trust-exit-code] [--cached] [<commit> [<commit>]] [[--] <path>...]")
+	}
+	ps, err := repo.parseDiffPathspec(rest)
+	if err != nil {
+		return err
+	}
+
+	var changes []*FileChange
+	worktree := false
+	switch {
+	case len(revs) == 2:
+		a, err := repo.readTreeish(revs[0])
+		if err != nil {
+			return err
+		}
+		b, err := repo.readTreeish(revs[1])
+		if err != nil {
+			return err
+		}
+		if changes, err = repo.DiffTrees(a, b, true, ps); err != nil {
+			return err
+		}
+	case *cached || len(revs) == 1:
+		rev := "HEAD"
+		if len(revs) == 1 {
+			rev = revs[0]
+		}
+		var tr *TreeObject
+		if _, err := repo.Resolve(rev); err == nil || len(revs) == 1 {
+			if tr, err = repo.readTreeish(rev); err != nil {
+				return err
+			}
+		}
+		idx, err := repo.ReadIndex()
+		if err != nil {
+			return err
+		}
+		worktree = !*cached
+		if changes, err = repo.DiffTreeIndex(tr, idx, worktree, ps); err != nil {
+			return err
+		}
+	default:
+		idx, err := repo.ReadSparseIndex()
+		if err != nil {
+			return err
+		}
+		worktree = true
+		if changes, err = repo.DiffIndexWorktree(idx, ps); err != nil {
+			return err
+		}
+	}
+	var paths []*FileChange
+	for _, c := range changes {
+		if c.Status != 'U' {
+			paths = append(paths, c)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	tmp, left, right, err := repo.diffToolFiles(paths, worktree)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	w := bufio.NewWriter(output)
+	if *dirDiff {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		status, err := dt.launch(tmp, w, "LOCAL=left", "REMOTE=right")
+		if err != nil {
+			return err
+		}
+		if err := right.copyBack(); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if status != 0 {
+			return exitCode(status)
+		}
+		return nil
+	}
+
+	lines := bufio.NewScanner(input)
+	for i, c := range paths {
+		if prompt {
+			fmt.Fprintf(w, "\nViewing (%d/%d): '%s'\nLaunch '%s' [Y/n]? ", i+1, len(paths), c.Path, dt.Name)
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if !lines.Scan() {
+				if err := lines.Err(); err != nil {
+					return err
+				}
+				return io.ErrUnexpectedEOF
+			}
+			if answer := strings.TrimSpace(lines.Text()); strings.HasPrefix(answer, "n") {
+				continue
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		// A missing side is shown as an empty file.
+		local, remote := os.DevNull, os.DevNull
+		if c.OldMode != 0 {
+			local = left.file(c.Path)
+		}
+		if c.NewMode != 0 {
+			remote = right.file(c.Path)
+		}
+		status, err := dt.launch(repo.workdir, w, "LOCAL="+local, "REMOTE="+remote, "MERGED="+c.Path, "BASE="+c.Path)
+		if err != nil {
+			return err
+		}
+		if err := right.copyBack(); err != nil {
+			return err
+		}
+		if status != 0 && dt.TrustExitCode {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			return exitCode(status)
+		}
+	}
+	return w.Flush()
+}
+
+func cmdMergetool(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("mergetool", flag.ContinueOnError)
+	tool := fl.String("t", "", "Use the merge tool of given name, instead of merge.tool.")
+	fl.StringVar(tool, "tool", "", "Same as -t.")
+	noPrompt := fl.Bool("y", false, "Do not prompt before launching the merge tool.")
+	fl.BoolVar(noPrompt, "no-prompt", false, "Same as -y.")
+	forcePrompt := fl.Bool("prompt", false, "Prompt before launching the merge tool, even if mergetool.prompt is false.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	ps, err := repo.parseCwdPathspec(fl.Args())
+	if err != nil {
+		return err
+	}
+	mt, err := repo.mergeTool(*tool)
+	if err != nil {
+		return err
+	}
+	prompt, err := repo.config.Bool("mergetool", "", "prompt", true)
+	if err != nil {
+		return err
+	}
+	prompt = (prompt || *forcePrompt) && !*noPrompt
+	keepBackup, err := repo.config.Bool("mergetool", "", "keepBackup", true)
+	if err != nil {
+		return err
+	}
+	keepTemporaries, err := repo.config.Bool("mergetool", "", "keepTemporaries", false)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := repo.LockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	idx, err := repo.ReadIndex()
+	if err != nil {
+		return err
+	}
+	paths, stages := unmergedPaths(idx, ps)
+	w := bufio.NewWriter(output)
+	if len(paths) == 0 {
+		fmt.Fprintln(w, "No files need merging")
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "Merging:\n%s\n\n", strings.Join(paths, "\n"))
+
+	lines := bufio.NewScanner(input)
+	ask := func(question string) (string, error) {
+		fmt.Fprint(w, question)
+		if err := w.Flush(); err != nil {
+			return "", err
+		}
+		if !lines.Scan() {
+			if err := lines.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		return strings.TrimSpace(lines.Text()), nil
+	}
+	confirm := func() (bool, error) {
+		fmt.Fprintf(w, "%s seems unchanged.\n", mt.Name)
+		answer, err := ask("Was the merge successful [y/n]? ")
+		return strings.HasPrefix(answer, "y"), err
+	}
+
+	var failed error
+	for _, name := range paths {
+		s := stages[name]
+		// Conflicts other than content ones, such as a file deleted on
+		// one side, cannot be resolved with a merge tool.
+		if s[2] == nil || s[3] == nil {
+			fmt.Fprintf(w, "Skipping %s: deleted on one side, resolve it manually\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "Normal merge conflict for '%s':\n  {local}: modified file\n  {remote}: modified file\n", name)
+		if prompt {
+			if _, err := ask(fmt.Sprintf("Hit return to start merge resolution tool (%s): ", mt.Name)); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		files, err := repo.writeMergeToolFiles(name, s)
+		if err != nil {
+			return err
+		}
+		merged := filepath.Join(repo.workdir, filepath.FromSlash(name))
+		if keepBackup {
+			data, err := ioutil.ReadFile(merged)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(merged+".orig", data, 0644); err != nil {
+				return err
+			}
+		}
+		ok, err := mt.run(repo.workdir, files, w, confirm)
+		if !keepTemporaries {
+			files.remove(repo.workdir)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			failed = fmt.Errorf("merge of %s failed", name)
+			break
+		}
+		if err := repo.stageResolved(idx, name, s); err != nil {
+			return err
+		}
+	}
+	// Paths resolved before a failure stay resolved.
+	if err := repo.WriteIndex(idx); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return failed
+}
+
+func cmdVerifyCommit(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("verify-commit", flag.ContinueOnError)
+	verbose := fl.Bool("v", false, "Print the content of verified commits.")
+	fl.BoolVar(verbose, "verbose", false, "Same as -v.")
+	raw := fl.Bool("raw", false, "Print the machine readable status output of gpg instead of the human readable output.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() == 0 {
+		return errors.New("usage: verify-commit [-v] [--raw] <commit>... | <revision range>...")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+
+	// Revision ranges are verified as a batch, with a line of the result
+	// for every commit.
+	isRange := false
+	for _, arg := range fl.Args() {
+		if _, _, _, ok := splitRevisionRange(arg); ok || strings.HasPrefix(arg, "^") {
+			isRange = true
+		}
+	}
+	if isRange {
+		rng, err := repo.ResolveRevisionRange(fl.Args())
+		if err != nil {
+			return err
+		}
+		verified, err := repo.VerifyCommits(rng)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(output)
+		invalid := 0
+		for _, v := range verified {
+			if !v.Valid() {
+				invalid++
+			}
+			fmt.Fprintf(w, "%x %s %s %s\n", v.Sha, v.Status, v.Key, v.Signer)
+			if *raw {
+				w.WriteString(v.Raw)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if invalid != 0 {
+			return fmt.Errorf("%d of %d commits do not have a valid signature", invalid, len(verified))
+		}
+		return nil
+	}
+
+	for _, name := range fl.Args() {
+		sha, err := repo.resolveCommit(name)
+		if err != nil {
+			return err
+		}
+		c, err := repo.readCommit(sha)
+		if err != nil {
+			return err
+		}
+		v, err := repo.VerifyCommit(c)
+		if err != nil {
+			return fmt.Errorf("verify %x signature: %w", sha, err)
+		}
+		payload, _, err := signedPayload(c)
+		if err != nil {
+			return err
+		}
+		if err := writeVerification(output, v, payload, *verbose, *raw); err != nil {
+			return err
+		}
+		if v.Status == SignatureNone {
+			return fmt.Errorf("%s: no signature found", name)
+		}
+		if !v.Valid() {
+			return fmt.Errorf("%s: signature is not valid", name)
+		}
+	}
+	return nil
+}
+
+func cmdVerifyTag(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("verify-tag", flag.ContinueOnError)
+	verbose := fl.Bool("v", false, "Print the content of verified tags.")
+	fl.BoolVar(verbose, "verbose", false, "Same as -v.")
+	raw := fl.Bool("raw", false, "Print the machine readable status output of gpg instead of the human readable output.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() == 0 {
+		return errors.New("usage: verify-tag [-v] [--raw] <tag>...")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	for _, name := range fl.Args() {
+		sha, err := repo.Resolve(name)
+		if err != nil {
+			return err
+		}
+		v, err := repo.VerifyTag(sha)
+		if err != nil {
+			return err
+		}
+		_, content, err := repo.ReadRawObject(sha)
+		if err != nil {
+			return err
+		}
+		payload, _ := tagSignedPayload(content)
+		if err := writeVerification(output, v, payload, *verbose, *raw); err != nil {
+			return err
+		}
+		if v.Status == SignatureNone {
+			return fmt.Errorf("%s: no signature found", name)
+		}
+		if !v.Valid() {
+			return fmt.Errorf("%s: signature is not valid", name)
+		}
+	}
+	return nil
+}
+
+// writeVerification writes the signed payload of the object if verbose is
+// set, followed by the output of the verification program to the standard
+// error, as git does.
+func writeVerification(output io.Writer, v *SignatureVerification, payload []byte, verbose, raw bool) error {
+	if verbose && v.Status != SignatureNone {
+		if _, err := output.Write(payload); err != nil {
+			return err
+		}
+	}
+	if raw {
+		os.Stderr.WriteString(v.Raw)
+	} else {
+		os.Stderr.WriteString(v.Output)
+	}
+	return nil
+}
+
+func cmdLsTree(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("ls-tree", flag.ContinueOnError)
+	recursive := fl.Bool("r", false, "Recurse into subtrees.")
+	nul := fl.Bool("z", false, "Terminate entries with NUL instead of new line and do not quote paths.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() < 1 {
+		return errors.New("usage: ls-tree [-r] [-z] <tree-ish> [<path>...]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	ps, err := repo.parseCwdPathspec(fl.Args()[1:])
+	if err != nil {
+		return err
+	}
+	tr, err := repo.readTreeish(fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	quote, err := repo.pathQuoter()
+	if err != nil {
+		return err
+	}
+	term := "\n"
+	if *nul {
+		quote, term = rawPath, "\x00"
+	}
+	wr := bufio.NewWriter(output)
+	if err := lsTree(wr, repo, tr, "", *recursive, ps, quote, term); err != nil {
+		return err
+	}
+	return wr.Flush()
+}
+
+func lsTree(w io.Writer, repo *Repository, tr *TreeObject, prefix string, recursive bool, ps *Pathspec, quote func(string) string, term string) error {
+	for _, leaf := range tr.Leafs {
+		path := prefix + leaf.Path
+		if recursive && leaf.Mode == modeTree {
+			obj, err := repo.ReadObject(leaf.Sha)
+			if err != nil {
+				return fmt.Errorf("read %x: %w", leaf.Sha, err)
+			}
+			sub, ok := obj.(*TreeObject)
+			if !ok {
+				return fmt.Errorf("%s: not a tree object: %T", path, obj)
+			}
+			if err := lsTree(w, repo, sub, path+"/", recursive, ps, quote, term); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ps.Match(path) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%x%s", leaf.Mode, quote(path), leaf.Sha, term)
+	}
+	return nil
+}
+
+func cmdCheckout(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("checkout", flag.ContinueOnError)
+	force := fl.Bool("force", false, "Overwrite untracked and modified files.")
+	backup := fl.Bool("backup", false, "Rename untracked and modified files that would be overwritten, adding the .orig suffix.")
+	newBranch := fl.String("b", "", "Create the branch at the start point, HEAD by default, and switch to it.")
+	detach := fl.Bool("detach", false, "Detach HEAD at the commit, even if it is a branch.")
+	recurse := fl.Bool("recurse-submodules", false, "Check out the commits recorded for populated submodules, recursively.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	const usage = "usage: checkout [--force] [--detach] [--recurse-submodules] (<branch> | <commit>)\n" +
+		"   or: checkout [--force] [--recurse-submodules] -b <new-branch> [<start-point>]\n" +
+		"   or: checkout [--force | --backup] <tree-ish> (<path> | --) [<pathspec>...]"
+	if *newBranch != "" || *detach || fl.NArg() == 1 {
+		if *backup || fl.NArg() > 1 || (*newBranch != "" && *detach) || (*newBranch == "" && fl.NArg() != 1) {
+			return errors.New(usage)
+		}
+		return checkoutHead(output, *newBranch, fl.Arg(0), *detach, *force, *recurse)
+	}
+	if fl.NArg() < 2 || *recurse {
+		return errors.New(usage)
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	ps, err := repo.parseCwdPathspec(fl.Args()[2:])
+	if err != nil {
+		return err
+	}
+	sha, err := repo.Resolve(fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	if sha, err = repo.peelObject(sha, "tree"); err != nil {
+		return fmt.Errorf("revision %q: %w", fl.Arg(0), err)
+	}
+
+	// Without a destination, files are written into the working tree.
+	dest := fl.Arg(1)
+	if dest == "--" {
+		dest = repo.workdir
+	}
+	destDir, err := filepath.Abs(dest)
+	if err != nil {
+		return fmt.Errorf("absolute path for %q: %w", dest, err)
+	}
+
+	// The journal has everything needed to run the checkout again.
+	mode := ""
+	switch {
+	case *force:
+		mode = "force"
+	case *backup:
+		mode = "backup"
+	}
+	j, err := repo.BeginJournal("checkout", append([]string{hex.EncodeToString(sha), destDir, mode}, ps.args()...)...)
+	if err != nil {
+		return err
+	}
+	if err := checkoutTree(output, repo, sha, destDir, ps, *force, *backup, j); err != nil {
+		// Nothing is left to recover if the checkout failed before
+		// changing any files, for example because of conflicts.
+		if len(j.Saved) == 0 {
+			j.Close()
+		}
+		return err
+	}
+	return j.Close()
+}
+
+// checkoutHead switches HEAD to the branch or detaches it at the commit
+// named by rev. With newBranch, the branch is created at rev, or at HEAD if
+// rev is empty, and HEAD is switched to it. With recurse, populated
+// submodules are switched to their commits in the new tree.
+func checkoutHead(output io.Writer, newBranch, rev string, detach, force, recurse bool) error {
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	oldBranch, oldHead, err := repo.headBranch()
+	if err != nil {
+		return err
+	}
+	var branch string
+	var sha []byte
+	if newBranch != "" {
+		branch = "refs/heads/" + newBranch
+		if err := ValidateRefName(branch); err != nil {
+			return err
+		}
+		if _, err := repo.resolveRef(branch); err == nil {
+			return fmt.Errorf("a branch named %q already exists", newBranch)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if rev == "" && oldHead == nil {
+			// Nothing is checked out yet, the branch is created by
+			// the first commit.
+			if err := repo.UpdateRefs(&RefUpdate{Name: "HEAD", Target: branch}); err != nil {
+				return err
+			}
+			_, err := fmt.Fprintf(output, "Switched to a new branch '%s'\n", newBranch)
+			return err
+		}
+		if rev == "" {
+			rev = "HEAD"
+		}
+	} else if !detach {
+		switch s, err := repo.resolveRef("refs/heads/" + rev); {
+		case err == nil:
+			branch, sha = "refs/heads/"+rev, s
+		case !errors.Is(err, os.ErrNotExist):
+			return err
+		}
+	}
+	if sha == nil {
+		if sha, err = repo.resolveCommit(rev); err != nil {
+			return err
+		}
+	}
+
+	var lost []*WalkedCommit
+	if oldBranch == "" && oldHead != nil && !bytes.Equal(oldHead, sha) {
+		if lost, err = repo.OrphanedCommits(oldHead, sha); err != nil {
+			return err
+		}
+	}
+	if newBranch != "" {
+		if err := repo.UpdateRefs(&RefUpdate{Name: branch, Sha: sha}); err != nil {
+			return err
+		}
+	}
+	if err := repo.SwitchHead(sha, branch, force); err != nil {
+		if newBranch != "" {
+			repo.UpdateRefs(&RefUpdate{Name: branch})
+		}
+		return err
+	}
+	if recurse {
+		if err := repo.checkoutSubmodules(sha, force); err != nil {
+			return err
+		}
+	}
+
+	wr := bufio.NewWriter(output)
+	switch {
+	case len(lost) != 0:
+		writeOrphanedCommits(wr, lost)
+	case oldBranch == "" && oldHead != nil && !bytes.Equal(oldHead, sha):
+		c, err := repo.readCommit(oldHead)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(wr, "Previous HEAD position was %s %s\n", shortHash(oldHead), commitSubject(repo.displayCommit(c)))
+	}
+	switch {
+	case branch == "":
+		c, err := repo.readCommit(sha)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(wr, "HEAD is now at %s %s\n", shortHash(sha), commitSubject(repo.displayCommit(c)))
+	case newBranch != "":
+		fmt.Fprintf(wr, "Switched to a new branch '%s'\n", newBranch)
+	case branch == oldBranch:
+		fmt.Fprintf(wr, "Already on '%s'\n", rev)
+	default:
+		fmt.Fprintf(wr, "Switched to branch '%s'\n", rev)
+	}
+	return wr.Flush()
+}
+
+// writeOrphanedCommits warns about commits that are left behind by moving
+// a detached HEAD, in the format of git.
+func writeOrphanedCommits(w io.Writer, lost []*WalkedCommit) {
+	// Same as git, only the newest few are listed.
+	const cutoff = 4
+	if len(lost) == 1 {
+		fmt.Fprint(w, "Warning: you are leaving 1 commit behind, not connected to\nany of your branches:\n\n")
+	} else {
+		fmt.Fprintf(w, "Warning: you are leaving %d commits behind, not connected to\nany of your branches:\n\n", len(lost))
+	}
+	for i, c := range lost {
+		if i == cutoff && len(lost) > cutoff+1 {
+			fmt.Fprintf(w, " ... and %d more.\n", len(lost)-cutoff)
+			break
+		}
+		fmt.Fprintf(w, "  %s %s\n", shortHash(c.Sha), commitSubject(c.Commit))
+	}
+	them := "them"
+	if len(lost) == 1 {
+		them = "it"
+	}
+	fmt.Fprintf(w, "\nIf you want to keep %s by creating a new branch, this may be a good time\nto do so with:\n\n checkout -b <new-branch-name> %s\n\n", them, shortHash(lost[0].Sha))
+}
+
+// resumeCheckout runs the checkout recorded in the journal again. Files the
+// interrupted checkout has changed can be overwritten, because their
+// previous content is in the journal.
+func resumeCheckout(output io.Writer, repo *Repository, j *Journal) error {
+	if len(j.Args) < 3 {
+		return errors.New("journal: invalid checkout arguments")
+	}
+	sha, err := hex.DecodeString(j.Args[0])
+	if err != nil {
+		return fmt.Errorf("journal: invalid tree %q", j.Args[0])
+	}
+	ps, err := ParsePathspec("", j.Args[3:])
+	if err != nil {
+		return err
+	}
+	return checkoutTree(output, repo, sha, j.Args[1], ps, j.Args[2] == "force", j.Args[2] == "backup", j)
+}
+
+// checkoutTree writes files of the tree matching the pathspec into the
+// directory, recording every change in the journal first. Files that would
+// be lost are overwritten with force, or renamed with backup.
+func checkoutTree(output io.Writer, repo *Repository, sha []byte, destDir string, ps *Pathspec, force, backup bool, j *Journal) error {
+	tr, err := repo.readTree(sha)
+	if err != nil {
+		return err
+	}
+
+	// Files of the current commit can be safely replaced in the working
+	// tree. Anywhere else, all existing files are considered untracked.
+	var base *TreeObject
+	if destDir == repo.workdir {
+		switch head, err := repo.readTreeish("HEAD"); {
+		case err == nil:
+			base = head
+		case errors.Is(err, os.ErrNotExist):
+			// Unborn branch.
+		default:
+			return err
+		}
+	}
+	obstacles, err := findCheckoutObstacles(repo, tr, base, destDir, "", ps)
+	if err != nil {
+		return err
+	}
+	var conflicts []string
+	for _, o := range obstacles {
+		if !o.Clean {
+			// A file that a resumed checkout has already changed.
+			if changed, err := j.changed(filepath.Join(destDir, filepath.FromSlash(o.Path))); err != nil {
+				return err
+			} else if changed {
+				o.Clean = true
+				continue
+			}
+			conflicts = append(conflicts, o.Path)
+		}
+	}
+	if len(conflicts) != 0 && !force && !backup {
+		return &checkoutConflictError{Paths: conflicts}
+	}
+	for _, o := range obstacles {
+		full := filepath.Join(destDir, filepath.FromSlash(o.Path))
+		switch {
+		case backup && !o.Clean:
+			if err := j.save(full + ".orig"); err != nil {
+				return err
+			}
+			if err := j.save(full); err != nil {
+				return err
+			}
+			if err := os.Rename(full, full+".orig"); err != nil {
+				return fmt.Errorf("backup %q: %w", o.Path, err)
+			}
+			fmt.Fprintf(output, "saved %s as %s.orig\n", o.Path, o.Path)
+		case o.Remove:
+			if err := j.save(full); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(full); err != nil {
+				return fmt.Errorf("remove %q: %w", o.Path, err)
+			}
+		}
+	}
+
+	_ = os.MkdirAll(destDir, newDirPerm)
+	// Use path instead of repo path to allow to checkout in any directory.
+	// This is better for testing.
+	return treeCheckout(repo, tr, destDir, "", ps, j)
+}
+
+func cmdRecover(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("recover", flag.ContinueOnError)
+	resume := fl.Bool("continue", false, "Run the interrupted operation again, to complete it.")
+	abort := fl.Bool("abort", false, "Restore all paths changed by the interrupted operation.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 || (*resume && *abort) {
+		return errors.New("usage: recover [--continue | --abort]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	j, err := repo.ReadJournal()
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(output, "No interrupted operation")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch {
+	case *abort:
+		return j.Rollback()
+	case *resume:
+		run, ok := journalResumers[j.Op]
+		if !ok {
+			return fmt.Errorf("cannot resume %s, use --abort", j.Op)
+		}
+		if err := j.Resume(); err != nil {
+			return err
+		}
+		if err := run(output, repo, j); err != nil {
+			return err
+		}
+		return j.Close()
+	}
+	wr := bufio.NewWriter(output)
+	fmt.Fprintf(wr, "Interrupted %s changed %d paths:\n", j.Op, len(j.Saved))
+	for _, s := range j.Saved {
+		fmt.Fprintf(wr, "\t%s\n", s.Path)
+	}
+	fmt.Fprintln(wr, "Use --continue to complete it, or --abort to restore the paths.")
+	return wr.Flush()
+}
+
+// journalResumers run an interrupted operation recorded in the journal
+// again.
+var journalResumers = map[string]func(output io.Writer, repo *Repository, j *Journal) error{
+	"checkout": resumeCheckout,
+}
+
+// treeCheckout writes all blobs of given tree that are matching the
+// pathspec into the path directory. Prefix is the location of the tree
+// relative to the checked out root. Every written file is saved in the
+// journal first, unless it is nil.
+func treeCheckout(repo *Repository, tr *TreeObject, path, prefix string, ps *Pathspec, j *Journal) error {
+	protect, err := repo.pathProtection()
+	if err != nil {
+		return err
+	}
+	for _, leaf := range tr.Leafs {
+		if err := protect.verify(leaf.Path, leaf.Mode); err != nil {
+			return fmt.Errorf("%s: %w", prefix+leaf.Path, err)
+		}
+		obj, err := repo.ReadObject(leaf.Sha)
+		if err != nil {
+			return fmt.Errorf("read %x: %w", leaf.Sha, err)
+		}
+		dest := filepath.Join(path, leaf.Path)
+		switch obj := obj.(type) {
+		case *TreeObject:
+			if err := treeCheckout(repo, obj, dest, prefix+leaf.Path+"/", ps, j); err != nil {
+				return err
+			}
+		case *BlobObject:
+			if !ps.Match(prefix + leaf.Path) {
+				continue
+			}
+			// Directories are created lazily so that the ones without
+			// any matching file are not created.
+			if err := os.MkdirAll(path, newDirPerm); err != nil {
+				return fmt.Errorf("mkdir %q: %w", path, err)
+			}
+			if err := j.save(dest); err != nil {
+				return err
+			}
+			switch leaf.Mode {
+			case modeSymlink:
+				// A link is not replaced when it is created.
+				if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return fmt.Errorf("remove %q: %w", dest, err)
+				}
+				if err := os.Symlink(string(obj.Data), dest); err != nil {
+					return fmt.Errorf("write %q symlink: %w", dest, err)
+				}
+			case modeExec:
+				if err := ioutil.WriteFile(dest, obj.Data, 0755); err != nil {
+					return fmt.Errorf("write %q blob: %w", dest, err)
+				}
+			default:
+				if err := ioutil.WriteFile(dest, obj.Data, 0644); err != nil {
+					return fmt.Errorf("write %q blob: %w", dest, err)
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected %T", obj)
+		}
+	}
+	return nil
+}
+
+func cmdShowBranch(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("show-branch", flag.ContinueOnError)
+	more := fl.Int("more", 0, "Show given number of commits past the common ancestor.")
+	sparse := fl.Bool("sparse", false, "Show merges reachable from only one of the branches.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+
+	names := fl.Args()
+	if len(names) == 0 {
+		refs, err := repo.ListRefs()
+		if err != nil {
+			return fmt.Errorf("list refs: %w", err)
+		}
+		for name := range refs {
+			if strings.HasPrefix(name, "refs/heads/") {
+				names = append(names, strings.TrimPrefix(name, "refs/heads/"))
+			}
+		}
+		sort.Strings(names)
+	}
+	var head string
+	if ref, err := repo.ReadRef("HEAD"); err == nil {
+		head = strings.TrimPrefix(ref.Target, "refs/heads/")
+	}
+	headSha, _ := repo.resolveRef("HEAD")
+
+	opts := ShowBranchOptions{Names: names, Head: -1, More: *more, Sparse: *sparse}
+	for i, name := range names {
+		sha, err := repo.resolveCommit(name)
+		if err != nil {
+			return err
+		}
+		opts.Tips = append(opts.Tips, sha)
+		if strings.TrimPrefix(strings.TrimPrefix(name, "refs/heads/"), "heads/") == head && bytes.Equal(sha, headSha) {
+			opts.Head = i
+		}
+	}
+	return repo.WriteShowBranch(output, opts)
+}
+
+func cmdShowRef(input io.Reader, output io.Writer, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: show-ref")
+	}
+
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+
+	refs, err := repo.refs.listRefs()
+	if err != nil {
+		return fmt.Errorf("list refs: %w", err)
+	}
+	var b bytes.Buffer
+	for _, ref := range refs {
+		if ref.Sha == nil {
+			continue
+		}
+		if _, err := fmt.Fprintf(&b, "%x %s\n", ref.Sha, ref.Name); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	if _, err := b.WriteTo(output); err != nil {
+		return fmt.Errorf("write to stdout: %w", err)
+	}
+	return nil
+}
+
+// revsFlag is a flag that can be given multiple times. Without a value, it
+// is set to HEAD.
+type revsFlag []string
+
+func (f *revsFlag) String() string { return strings.Join(*f, ", ") }
+
+func (f *revsFlag) Set(value string) error {
+	if value == "true" {
+		value = "HEAD"
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+func (f *revsFlag) IsBoolFlag() bool { return true }
+
+// reachFilterFlags registers flags selecting references by reachability,
+// shared by branch and tag listing.
+type reachFilterFlags struct {
+	contains, merged, noMerged stringsFlag
+}
+
+func addReachFilterFlags(fl *flag.FlagSet) *reachFilterFlags {
+	var f reachFilterFlags
+	fl.Var(&f.contains, "contains", "List only references that contain the commit. Can be repeated.")
+	fl.Var((*revsFlag)(&f.merged), "merged", "List only references merged into the commit, HEAD by default. Can be repeated.")
+	fl.Var((*revsFlag)(&f.noMerged), "no-merged", "List only references not merged into the commit, HEAD by default. Can be repeated.")
+	return &f
+}
+
+// filter resolves the revisions given to the flags.
+func (f *reachFilterFlags) filter(repo *Repository) (*ReachFilter, error) {
+	var rf ReachFilter
+	for _, list := range []struct {
+		revs stringsFlag
+		dest *[][]byte
+	}{
+		{f.contains, &rf.Contains},
+		{f.merged, &rf.Merged},
+		{f.noMerged, &rf.NoMerged},
+	} {
+		for _, rev := range list.revs {
+			sha, err := repo.resolveCommit(rev)
+			if err != nil {
+				return nil, err
+			}
+			*list.dest = append(*list.dest, sha)
+		}
+	}
+	return &rf, nil
+}
+
+func cmdBranch(input io.Reader, output io.Writer, args []string) error {
+	const usage = "usage: branch [--contains <commit>] [--merged[=<commit>]] [--no-merged[=<commit>]]\n" +
+		"   or: branch <name> [<start-point>]\n" +
+		"   or: branch (-d | -D) <name>...\n" +
+		"   or: branch (-m | -M) [<old-name>] <new-name>"
+	fl := flag.NewFlagSet("branch", flag.ContinueOnError)
+	reach := addReachFilterFlags(fl)
+	del := fl.Bool("d", false, "Delete branches merged into HEAD.")
+	forceDel := fl.Bool("D", false, "Delete branches, even if not merged.")
+	move := fl.Bool("m", false, "Rename a branch.")
+	forceMove := fl.Bool("M", false, "Rename a branch, even if the new name exists.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	listing := len(reach.contains) != 0 || len(reach.merged) != 0 || len(reach.noMerged) != 0
+	switch {
+	case (*del || *forceDel) && (*move || *forceMove), listing && fl.NArg() != 0:
+		return errors.New(usage)
+	case *del || *forceDel:
+		if fl.NArg() == 0 {
+			return errors.New(usage)
+		}
+		return deleteBranches(output, fl.Args(), *forceDel)
+	case *move || *forceMove:
+		if fl.NArg() == 0 || fl.NArg() > 2 {
+			return errors.New(usage)
+		}
+		return renameBranch(fl.Args(), *forceMove)
+	case fl.NArg() > 2:
+		return errors.New(usage)
+	case fl.NArg() != 0:
+		return createBranch(fl.Args())
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	filter, err := reach.filter(repo)
+	if err != nil {
+		return err
+	}
+	refs, err := repo.ListRefs()
+	if err != nil {
+		return fmt.Errorf("list refs: %w", err)
+	}
+	branches := make(map[string][]byte)
+	for name, sha := range refs {
+		if strings.HasPrefix(name, "refs/heads/") {
+			branches[strings.TrimPrefix(name, "refs/heads/")] = sha
+		}
+	}
+	names, err := repo.FilterReachable(branches, filter)
+	if err != nil {
+		return err
+	}
+	var head string
+	var detached []byte
+	if ref, err := repo.ReadRef("HEAD"); err == nil {
+		head = strings.TrimPrefix(ref.Target, "refs/heads/")
+		if ref.Target == "" {
+			detached = ref.Sha
+		}
+	}
+
+	w := bufio.NewWriter(output)
+	// Same as git, a detached HEAD is listed first, if it matches.
+	if detached != nil {
+		if ok, err := repo.matchReach(filter, detached); err != nil {
+			return err
+		} else if ok {
+			fmt.Fprintf(w, "* (HEAD detached at %s)\n", shortHash(detached))
+		}
+	}
+	for _, name := range names {
+		mark := ' '
+		if name == head {
+			mark = '*'
+		}
+		fmt.Fprintf(w, "%c %s\n", mark, name)
+	}
+	return w.Flush()
+}
+
+// createBranch creates a branch from arguments of branch: the name, and the
+// commit, HEAD if not given.
+func createBranch(args []string) error {
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	start := "HEAD"
+	if len(args) == 2 {
+		start = args[1]
+	}
+	sha, err := repo.resolveCommit(start)
+	if err != nil {
+		return err
+	}
+	return repo.CreateBranch(args[0], sha)
+}
+
+// deleteBranches deletes the branches of branch -d, stopping at the first
+// one that cannot be deleted.
+func deleteBranches(output io.Writer, names []string, force bool) error {
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	w := bufio.NewWriter(output)
+	defer w.Flush()
+	for _, name := range names {
+		sha, err := repo.DeleteBranch(name, force)
+		if err != nil {
+			if errors.Is(err, errNotMerged) {
+				err = fmt.Errorf("%w\nIf you are sure you want to delete it, run 'branch -D %s'", err, name)
+			}
+			return err
+		}
+		fmt.Fprintf(w, "Deleted branch %s (was %s).\n", name, shortHash(sha))
+	}
+	return w.Flush()
+}
+
+// renameBranch renames a branch from arguments of branch -m: the old name,
+// the current branch if not given, and the new name.
+func renameBranch(args []string, force bool) error {
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	oldName, newName := "", args[len(args)-1]
+	if len(args) == 2 {
+		oldName = args[0]
+	} else {
+		current, _, err := repo.headBranch()
+		if err != nil {
+			return err
+		}
+		if current == "" {
+			return errors.New("cannot rename the current branch while not on any")
+		}
+		oldName = strings.TrimPrefix(current, "refs/heads/")
+	}
+	return repo.RenameBranch(oldName, newName, force)
+}
+
+func cmdSymbolicRef(input io.Reader, output io.Writer, args []string) error {
+	const usage = "usage: symbolic-ref [-q] [--short] <name>\n" +
+		"   or: symbolic-ref [-m <reason>] <name> <ref>\n" +
+		"   or: symbolic-ref -d [-q] <name>"
+	fl := flag.NewFlagSet("symbolic-ref", flag.ContinueOnError)
+	quiet := fl.Bool("q", false, "Do not print an error if the reference is not symbolic, only exit with status 1.")
+	short := fl.Bool("short", false, "Print the target shortened, for example master for refs/heads/master.")
+	del := fl.Bool("d", false, "Delete the symbolic reference.")
+	reason := fl.String("m", "", "Reason of the update, recorded in the reflog.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() < 1 || fl.NArg() > 2 || (*del && fl.NArg() != 1) {
+		return errors.New(usage)
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	name := fl.Arg(0)
+	switch {
+	case *del:
+		err = repo.DeleteSymbolicRef(name)
+	case fl.NArg() == 2:
+		return repo.SetSymbolicRef(name, fl.Arg(1), *reason)
+	default:
+		var target string
+		if target, err = repo.ReadSymbolicRef(name); err == nil {
+			if *short {
+				target = shortRefName(target)
+			}
+			_, err = fmt.Fprintln(output, target)
+		}
+	}
+	if *quiet && errors.Is(err, errNotSymbolic) {
+		return exitCode(1)
+	}
+	return err
+}
+
+// linesFlag is the number of annotation lines shown by tag -n. Without a
+// value, one line is shown.
+type linesFlag int
+
+func (f *linesFlag) String() string { return strconv.Itoa(int(*f)) }
+
+func (f *linesFlag) Set(value string) error {
+	if value == "true" {
+		*f = 1
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid number of lines %q", value)
+	}
+	*f = linesFlag(n)
+	return nil
+}
+
+func (f *linesFlag) IsBoolFlag() bool { return true }
+
+func cmdTag(input io.Reader, output io.Writer, args []string) error {
+	const usage = "usage: tag <name> <object>\n" +
+		"   or: tag [-l] [-n[<num>]] [--contains <commit>] [--merged[=<commit>]] [--no-merged[=<commit>]] [--points-at <object>] [--sort=<key>] [<pattern>...]"
+	fl := flag.NewFlagSet("tag", flag.ContinueOnError)
+	list := fl.Bool("l", false, "List tags matching the patterns.")
+	fl.BoolVar(list, "list", false, "List tags matching the patterns.")
+	var lines linesFlag = -1
+	fl.Var(&lines, "n", "Show given number of lines of the annotation, or of the commit message for lightweight tags.")
+	var pointsAt stringsFlag
+	fl.Var(&pointsAt, "points-at", "List only tags of the object. Can be repeated.")
+	sortKey := fl.String("sort", "", "Sort by refname or version:refname, in reverse with a - prefix.")
+	reach := addReachFilterFlags(fl)
+	// Same as in git, the number of lines can follow -n without a
+	// separator.
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "-n") && len(arg) > 2 && arg[2] >= '0' && arg[2] <= '9' {
+			args[i] = "-n=" + arg[2:]
+		}
+	}
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	listing := *list || lines >= 0 || len(pointsAt) != 0 || *sortKey != "" ||
+		len(reach.contains) != 0 || len(reach.merged) != 0 || len(reach.noMerged) != 0
+	if !listing && fl.NArg() != 0 {
+		if fl.NArg() != 2 {
+			// Only a single format is supported. Lazy.
+			return errors.New(usage)
+		}
+		return createTag(fl.Arg(0), fl.Arg(1))
+	}
+
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	if *sortKey == "" {
+		*sortKey, _ = repo.config.Get("tag", "", "sort")
+	}
+	reverse := strings.HasPrefix(*sortKey, "-")
+	var byVersion bool
+	switch strings.TrimPrefix(*sortKey, "-") {
+	case "", "refname":
+		// Sorted by name by default.
+	case "version:refname", "v:refname":
+		byVersion = true
+	default:
+		return fmt.Errorf("unsupported sort key %q", *sortKey)
+	}
+	filter, err := reach.filter(repo)
+	if err != nil {
+		return err
+	}
+	var pointsAtShas [][]byte
+	for _, rev := range pointsAt {
+		sha, err := repo.Resolve(rev)
+		if err != nil {
+			return err
+		}
+		pointsAtShas = append(pointsAtShas, sha)
+	}
+
+	refs, err := repo.ListRefs()
+	if err != nil {
+		return fmt.Errorf("list refs: %w", err)
+	}
+	tags := make(map[string][]byte)
+	for name, sha := range refs {
+		if strings.HasPrefix(name, "refs/tags/") {
+			tags[strings.TrimPrefix(name, "refs/tags/")] = sha
+		}
+	}
+	for name := range tags {
+		if !matchTagPatterns(fl.Args(), name) {
+			delete(tags, name)
+			continue
+		}
+		if len(pointsAtShas) != 0 {
+			ok, err := tagPointsAt(repo, tags[name], pointsAtShas)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				delete(tags, name)
+			}
+		}
+	}
+	names, err := repo.FilterReachable(tags, filter)
+	if err != nil {
+		return err
+	}
+	if byVersion {
+		suffixes := repo.config.GetAll("versionsort", "", "suffix")
+		sort.SliceStable(names, func(i, j int) bool {
+			return versionCompare(names[i], names[j], suffixes) < 0
+		})
+	}
+	if reverse {
+		for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+			names[i], names[j] = names[j], names[i]
+		}
+	}
+
+	w := bufio.NewWriter(output)
+	for _, name := range names {
+		if lines <= 0 {
+			fmt.Fprintln(w, name)
+			continue
+		}
+		annotation, err := tagAnnotation(repo, tags[name], int(lines))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%-15s %s\n", name, strings.Join(annotation, "\n    "))
+	}
+	return w.Flush()
+}
+
+func createTag(name, rev string) error {
+	if err := ValidateTagName(name); err != nil {
+		return err
+	}
+
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	sha, err := repo.Resolve(rev)
+	if err != nil {
+		return err
+	}
+
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/tags/" + name, Sha: sha}); err != nil {
+		return fmt.Errorf("write tag: %w", err)
+	}
+	return nil
+}
+
+// matchTagPatterns returns true if the tag name matches any of the
+// patterns, or if there are no patterns.
+func matchTagPatterns(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if wildmatch(p, name, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagPointsAt returns true if the tag reference, or the annotated tag it
+// points to, points at any of the objects.
+func tagPointsAt(repo *Repository, sha []byte, objects [][]byte) (bool, error) {
+	targets := [][]byte{sha}
+	obj, err := repo.ReadObject(sha)
+	if err != nil {
+		return false, err
+	}
+	if tag, ok := obj.(*TagObject); ok && len(tag.Header["object"]) != 0 {
+		if target, err := hex.DecodeString(tag.Header["object"][0]); err == nil {
+			targets = append(targets, target)
+		}
+	}
+	for _, target := range targets {
+		for _, o := range objects {
+			if bytes.Equal(target, o) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// tagAnnotation returns up to n first lines of the annotated tag message
+// without the signature, or of the commit message for lightweight tags.
+func tagAnnotation(repo *Repository, sha []byte, n int) ([]string, error) {
+	obj, err := repo.ReadObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	var message string
+	switch obj := obj.(type) {
+	case *TagObject:
+		message = obj.Comment
+		if i := strings.Index(message, "-----BEGIN PGP SIGNATURE-----"); i >= 0 {
+			message = message[:i]
+		}
+	case *CommitObject:
+		message = obj.Comment
+	default:
+		// Trees and blobs have no message.
+	}
+	lines := strings.Split(strings.Trim(message, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	return lines, nil
+}
+
+func cmdFsck(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	connectivityOnly := fl.Bool("connectivity-only", false, "Check only that reachable objects exist, without reading blobs or checking their format.")
+	strict := fl.Bool("strict", false, "Treat warnings as errors and reject file modes of old trees.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	checker, err := repo.fsckChecker("", *strict)
+	if err != nil {
+		return err
+	}
+
+	var tips [][]byte
+	for _, rev := range fl.Args() {
+		sha, err := repo.Resolve(rev)
+		if err != nil {
+			return err
+		}
+		tips = append(tips, sha)
+	}
+	if len(tips) == 0 {
+		refs, err := repo.ListRefs()
+		if err != nil {
+			return fmt.Errorf("list refs: %w", err)
+		}
+		for _, sha := range refs {
+			tips = append(tips, sha)
+		}
+		// Detached HEAD is not listed with other references.
+		if head, err := ioutil.ReadFile(filepath.Join(repo.gitdir, "HEAD")); err == nil {
+			if sha, err := hex.DecodeString(string(bytes.TrimSpace(head))); err == nil {
+				tips = append(tips, sha)
+			}
+		}
+	}
+
+	var problems int
+	err = repo.WalkObjects(tips, func(o *WalkedObject) error {
+		kind := o.Kind
+		if kind == "" {
+			kind = "object"
+		}
+		if o.Missing {
+			problems++
+			_, err := fmt.Fprintf(output, "missing %s %x\n", kind, o.Sha)
+			return err
+		}
+		corrupt := o.Corrupt
+		if kind == "blob" && !*connectivityOnly {
+			if _, err := repo.ReadObject(o.Sha); errors.As(err, new(*CorruptObjectError)) {
+				corrupt = err
+			} else if err != nil {
+				problems++
+				_, err := fmt.Fprintf(output, "error in %s %x: %s\n", kind, o.Sha, err)
+				return err
+			}
+		}
+		if corrupt != nil {
+			problems++
+			return printCorruptObject(output, kind, o.Sha, corrupt)
+		}
+		if kind == "blob" || *connectivityOnly {
+			return nil
+		}
+		kind, content, err := repo.ReadRawObject(o.Sha)
+		if err != nil {
+			return err
+		}
+		for _, p := range checker.problems(kind, content) {
+			if p.Severity == fsckError {
+				problems++
+			}
+			if _, err := fmt.Fprintf(output, "%s in %s %x: %s\n", p.Severity, kind, o.Sha, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk objects: %w", err)
+	}
+	if problems != 0 {
+		return fmt.Errorf("found %d problems", problems)
+	}
+	return nil
+}
+
+// printCorruptObject reports a damaged object the way git fsck does, with a
+// hint on how to restore it.
+func printCorruptObject(output io.Writer, kind string, sha []byte, err error) error {
+	var ce *CorruptObjectError
+	if !errors.As(err, &ce) {
+		return err
+	}
+	_, err = fmt.Fprintf(output, "error: %s\nerror: %x: %s corrupt or missing: %s\nhint: remove %s and fetch the object again from a repository that has it\n", ce.Err, sha, kind, ce.Path, ce.Path)
+	return err
+}
+
+func cmdCommit(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("commit", flag.ContinueOnError)
+	var messages stringsFlag
+	fl.Var(&messages, "m", "Use the message. Can be repeated, each one is a separate paragraph.")
+	file := fl.String("F", "", "Read the message from the file, or from the standard input if it is -.")
+	allowEmpty := fl.Bool("allow-empty", false, "Create the commit even if the tree is the same as of the parent.")
+	allowEmptyMessage := fl.Bool("allow-empty-message", false, "Create the commit even if the message is empty.")
+	author := fl.String("author", "", "Set the author, in the Name <email> format.")
+	date := fl.String("date", "", "Set the author date.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 || (len(messages) != 0 && *file != "") {
+		return errors.New("usage: commit [--allow-empty] [--allow-empty-message] [--author=<author>] [--date=<date>] [-m <message>... | -F <file>]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	authorID, err := repo.commitAuthor(*author, *date)
+	if err != nil {
+		return err
+	}
+	idx, err := repo.ReadIndex()
+	if err != nil {
+		return err
+	}
+	tree, err := repo.WriteIndexTree(idx)
+	if err != nil {
+		return err
+	}
+	branch, head, err := repo.headBranch()
+	if err != nil {
+		return err
+	}
+	var parents [][]byte
+	parentTree := EmptyTreeHash
+	if head != nil {
+		c, err := repo.readCommit(head)
+		if err != nil {
+			return err
+		}
+		if len(c.Header["tree"]) != 0 {
+			parentTree = c.Header["tree"][0]
+		}
+		parents = [][]byte{head}
+	}
+	if parentTree == hex.EncodeToString(tree) && !*allowEmpty {
+		fmt.Fprintln(output, "nothing to commit")
+		return exitCode(1)
+	}
+
+	var message string
+	edited := false
+	switch {
+	case len(messages) != 0:
+		message = strings.Join(messages, "\n\n")
+	case *file == "-":
+		raw, err := ioutil.ReadAll(input)
+		if err != nil {
+			return fmt.Errorf("read message: %w", err)
+		}
+		message = string(raw)
+	case *file != "":
+		raw, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return fmt.Errorf("read message: %w", err)
+		}
+		message = string(raw)
+	default:
+		path := filepath.Join(repo.gitdir, "COMMIT_EDITMSG")
+		template := "\n# Please enter the commit message for your changes. Lines starting\n" +
+			"# with '#' will be ignored, and an empty message aborts the commit.\n"
+		if err := ioutil.WriteFile(path, []byte(template), 0644); err != nil {
+			return fmt.Errorf("write message: %w", err)
+		}
+		if err := launchEditor(repo.config, path); err != nil {
+			return err
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read message: %w", err)
+		}
+		message, edited = string(raw), true
+	}
+	// Comments are removed only from a message written in the editor,
+	// same as with the default commit.cleanup of git.
+	if message = cleanupMessage(message, edited); message == "" && !*allowEmptyMessage {
+		return errors.New("aborting commit due to empty commit message")
+	}
+
+	sha, err := repo.CreateCommit(tree, parents, message, authorID)
+	if err != nil {
+		return err
+	}
+	update := &RefUpdate{Name: branch, Sha: sha, OldSha: head, Message: "commit: " + commitSubject(&CommitObject{Comment: message})}
+	if head == nil {
+		update.Message = "commit (initial)" + strings.TrimPrefix(update.Message, "commit")
+	}
+	if branch == "" {
+		update.Name = "HEAD"
+	}
+	if err := repo.UpdateRefs(update); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(output, commitSummary(branch, head == nil, sha, message))
+	return err
+}
+
+func cmdCommitGraph(input io.Reader, output io.Writer, args []string) error {
+	const usage = "usage: commit-graph write [--reachable] [--changed-paths]"
+	if len(args) == 0 || args[0] != "write" {
+		return errors.New(usage)
+	}
+	fl := flag.NewFlagSet("commit-graph write", flag.ContinueOnError)
+	// Commits are always found by walking the references.
+	fl.Bool("reachable", true, "Write all commits reachable from references.")
+	changedPaths := fl.Bool("changed-paths", false, "Compute and write changed-path Bloom filters. Default is to keep them if the existing graph has them.")
+	if err := fl.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New(usage)
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	tips, err := referencedCommits(repo)
+	if err != nil {
+		return err
+	}
+	explicit := false
+	fl.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "changed-paths" })
+	if !explicit {
+		if g := repo.loadCommitGraph(); g != nil && g.bloomIndex != nil {
+			*changedPaths = true
+		}
+	}
+	return repo.WriteCommitGraph(tips, *changedPaths)
+}
+
+func cmdPrunePacked(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("prune-packed", flag.ContinueOnError)
+	dryRun := fl.Bool("n", false, "Only list the objects that would be removed.")
+	fl.BoolVar(dryRun, "dry-run", false, "Same as -n.")
+	// Progress is never shown.
+	fl.Bool("q", false, "Do not show progress.")
+	fl.Bool("quiet", false, "Same as -q.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: prune-packed [-n | --dry-run] [-q | --quiet]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+
+	wr := bufio.NewWriter(output)
+	var list func(string) error
+	if *dryRun {
+		list = func(path string) error {
+			_, err := fmt.Fprintf(wr, "rm -f %s\n", path)
+			return err
+		}
+	}
+	if err := repo.PrunePacked(*dryRun, list); err != nil {
+		return err
+	}
+	return wr.Flush()
+}
+
+func cmdUnlock(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	dryRun := fl.Bool("n", false, "Only list the lock files that would be removed.")
+	fl.BoolVar(dryRun, "dry-run", false, "Same as -n.")
+	force := fl.Bool("force", false, "Remove lock files that are not stale yet. Locks held by a running process are never removed.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: unlock [-n | --dry-run] [--force]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	locks, err := repo.FindLocks()
+	if err != nil {
+		return err
+	}
+
+	wr := bufio.NewWriter(output)
+	if len(locks) == 0 {
+		fmt.Fprintln(wr, "No lock files")
+	}
+	for _, l := range locks {
+		name := l.Path
+		if rel, err := filepath.Rel(repo.gitdir, l.Path); err == nil {
+			name = filepath.ToSlash(rel)
+		}
+		age := l.Age.Round(time.Second)
+		switch {
+		case len(l.Holders) != 0:
+			fmt.Fprintf(wr, "Keeping %s: %s, held by %s\n", name, l.What, l.holders())
+		case !l.Stale && !*force:
+			fmt.Fprintf(wr, "Keeping %s: %s, %s old, use --force to remove it\n", name, l.What, age)
+		case *dryRun:
+			fmt.Fprintf(wr, "Would remove %s: %s, %s old\n", name, l.What, age)
+		default:
+			if err := os.Remove(l.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			os.Remove(l.Path + lockOwnerSuffix)
+			fmt.Fprintf(wr, "Removed %s: %s, %s old\n", name, l.What, age)
+		}
+	}
+	return wr.Flush()
+}
+
+func cmdGc(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("gc", flag.ContinueOnError)
+	auto := fl.Bool("auto", false, "Pack only if there are more loose objects than gc.auto or more packs than gc.autoPackLimit, and do nothing if another gc is running.")
+	force := fl.Bool("force", false, "Run even if another gc seems to be running.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: gc [--auto] [--force]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	return repo.GC(*auto, *force)
+}
+
+func cmdPackLoose(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("pack-loose", flag.ContinueOnError)
+	batchSize := fl.Int("batch-size", -1, "Pack at most this many loose objects, or all of them if 0. By default maintenance.loose-objects.batchSize or 50000.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: pack-loose [--batch-size=<n>]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	if *batchSize < 0 {
+		size, err := repo.config.Int("maintenance", "loose-objects", "batchSize", defaultLooseObjectsBatchSize)
+		if err != nil {
+			return err
+		}
+		*batchSize = int(size)
+	}
+	pack, err := repo.PackLooseObjects(*batchSize)
+	if err != nil {
+		return err
+	}
+	if pack != "" {
+		name := strings.TrimSuffix(filepath.Base(pack), ".pack")
+		_, err = fmt.Fprintln(output, strings.TrimPrefix(name, "pack-"))
+	}
+	return err
+}
+
+func cmdRepack(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("repack", flag.ContinueOnError)
+	all := fl.Bool("a", false, "Pack all objects, including already packed ones, into a single pack.")
+	remove := fl.Bool("d", false, "Remove loose objects and, with -a, packs made redundant by the new pack.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: repack [-a] [-d]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	var pack string
+	if *all {
+		pack, err = repo.Repack(*remove)
+	} else if pack, err = repo.PackLooseObjects(0); err == nil && *remove {
+		err = repo.PrunePacked(false, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if pack != "" {
+		name := strings.TrimSuffix(filepath.Base(pack), ".pack")
+		_, err = fmt.Fprintln(output, strings.TrimPrefix(name, "pack-"))
+	}
+	return err
+}
+
+// referencedCommits returns commits that references and HEAD point to.
+// References to objects other than commits are skipped.
+func referencedCommits(repo *Repository) ([][]byte, error) {
+	refs, err := repo.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("list refs: %w", err)
+	}
+	if head, err := repo.resolveRef("HEAD"); err == nil {
+		refs["HEAD"] = head
+	}
+	var tips [][]byte
+	for _, sha := range refs {
+		if sha, err := repo.peelObject(sha, "commit"); err == nil {
+			tips = append(tips, sha)
+		}
+	}
+	return tips, nil
+}
+
+func cmdArchive(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("archive", flag.ContinueOnError)
+	format := fl.String("format", "", "Format of the archive, tar or tar.gz. By default it is guessed from the output file name, or tar.")
+	prefix := fl.String("prefix", "", "Prepend the prefix to every path in the archive.")
+	outputFile := fl.String("o", "", "Write the archive to the file instead of the standard output.")
+	fl.StringVar(outputFile, "output", "", "Same as -o.")
+	worktreeAttributes := fl.Bool("worktree-attributes", false, "Read .gitattributes files from the worktree instead of the archived tree.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 1 {
+		return errors.New("usage: archive [--format=<fmt>] [--prefix=<prefix>] [-o <file>] [--worktree-attributes] <tree-ish>")
+	}
+	if *format == "" {
+		switch name := *outputFile; {
+		case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+			*format = "tar.gz"
+		default:
+			*format = "tar"
+		}
+	}
+	if *format == "tgz" {
+		*format = "tar.gz"
+	}
+	if *format != "tar" && *format != "tar.gz" {
+		return fmt.Errorf("unknown archive format %q", *format)
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+
+	if *outputFile != "" {
+		fd, err := os.Create(*outputFile)
+		if err != nil {
+			return fmt.Errorf("create archive: %w", err)
+		}
+		defer fd.Close()
+		output = fd
+	}
+	opts := &ArchiveOptions{Prefix: *prefix, WorktreeAttributes: *worktreeAttributes}
+	if *format == "tar.gz" {
+		gz := gzip.NewWriter(output)
+		if err := repo.WriteTarArchive(gz, fl.Arg(0), opts); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+	return repo.WriteTarArchive(output, fl.Arg(0), opts)
+}
+
+func cmdAnalyze(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	limits := DefaultAnalyzeLimits
+	fl.Int64Var(&limits.MaxBlobSize, "max-blob-size", limits.MaxBlobSize, "Report blobs bigger than given number of bytes.")
+	fl.Int64Var(&limits.MaxTreeEntries, "max-tree-entries", limits.MaxTreeEntries, "Report trees with more entries.")
+	fl.Int64Var(&limits.MaxPathDepth, "max-path-depth", limits.MaxPathDepth, "Report paths with more components.")
+	fl.Int64Var(&limits.MaxMessageSize, "max-message-size", limits.MaxMessageSize, "Report commit messages bigger than given number of bytes.")
+	asJSON := fl.Bool("json", false, "Write the report as JSON.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: analyze [--json] [--max-blob-size=<bytes>] [--max-tree-entries=<n>] [--max-path-depth=<n>] [--max-message-size=<bytes>]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	tips, err := referencedCommits(repo)
+	if err != nil {
+		return err
+	}
+	report, err := repo.Analyze(tips, limits)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(output)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		w := bufio.NewWriter(output)
+		fmt.Fprintf(w, "commits: %d\n", report.Commits)
+		fmt.Fprintf(w, "trees: %d\n", report.Trees)
+		fmt.Fprintf(w, "blobs: %d\n", report.Blobs)
+		fmt.Fprintf(w, "max blob size: %d\n", report.MaxBlobSize)
+		fmt.Fprintf(w, "max tree entries: %d\n", report.MaxTreeEntries)
+		fmt.Fprintf(w, "max path depth: %d\n", report.MaxPathDepth)
+		fmt.Fprintf(w, "max message size: %d\n", report.MaxMessageSize)
+		for _, issue := range report.Issues {
+			fmt.Fprintf(w, "%s %s %d > %d", issue.Kind, issue.Sha, issue.Value, issue.Limit)
+			if issue.Path != "" {
+				fmt.Fprintf(w, " %s", issue.Path)
+			}
+			w.WriteByte('\n')
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	// Issues fail the command, so that it can be used as a CI check.
+	if len(report.Issues) != 0 {
+		return fmt.Errorf("found %d issues", len(report.Issues))
+	}
+	return nil
+}
+
+func cmdStats(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("stats", flag.ContinueOnError)
+	top := fl.Int("top", 5, "Number of biggest blobs and deepest trees to show.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: stats [--top=<n>]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	stats, err := repo.Stats(*top)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(output)
+	total := 0
+	for _, n := range stats.Objects {
+		total += n
+	}
+	fmt.Fprintf(w, "refs: %d\n", stats.Refs)
+	fmt.Fprintf(w, "objects: %d\n", total)
+	for _, kind := range []string{"commit", "tree", "blob", "tag"} {
+		fmt.Fprintf(w, "  %s: %d\n", kind, stats.Objects[kind])
+	}
+	fmt.Fprintf(w, "size: %d\n", stats.Size)
+	fmt.Fprintf(w, "loose size: %d\n", stats.LooseSize)
+	fmt.Fprintf(w, "packs: %d\n", stats.Packs)
+	fmt.Fprintf(w, "pack size: %d\n", stats.PackSize)
+	fmt.Fprintf(w, "blob entries: %d\n", stats.BlobEntries)
+	fmt.Fprintf(w, "duplicate blobs: %d\n", stats.DuplicateBlobs)
+	fmt.Fprintf(w, "deduplicated size: %d\n", stats.DedupSize)
+	if len(stats.BiggestBlobs) != 0 {
+		fmt.Fprintln(w, "biggest blobs:")
+		for _, s := range stats.BiggestBlobs {
+			fmt.Fprintf(w, "  %x %d\n", s.Sha, s.Value)
+		}
+	}
+	if len(stats.DeepestTrees) != 0 {
+		fmt.Fprintln(w, "deepest trees:")
+		for _, s := range stats.DeepestTrees {
+			fmt.Fprintf(w, "  %x %d\n", s.Sha, s.Value)
+		}
+	}
+	return w.Flush()
+}
+
+func cmdSearch(input io.Reader, output io.Writer, args []string) error {
+	const usage = "usage: search index\n   or: search [--] <term>..."
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	tips, err := referencedCommits(repo)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 && args[0] == "index" {
+		idx, err := repo.BuildSearchIndex(tips)
+		if err != nil {
+			return err
+		}
+		return repo.WriteSearchIndex(idx)
+	}
+	if args[0] == "--" {
+		args = args[1:]
+	}
+	found, err := repo.SearchCommits(tips, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(output)
+	for _, sha := range found {
+		c, err := repo.readCommit(sha)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%x %s\n", sha, commitSubject(c))
+	}
+	return w.Flush()
+}
+
+func cmdSubmodule(input io.Reader, output io.Writer, args []string) error {
+	if len(args) == 0 || args[0] != "foreach" {
+		return errors.New("usage: submodule foreach [--recursive] [--quiet] <command>")
+	}
+	fl := flag.NewFlagSet("submodule foreach", flag.ContinueOnError)
+	recursive := fl.Bool("recursive", false, "Process nested submodules.")
+	quiet := fl.Bool("quiet", false, "Do not print the name of each entered submodule.")
+	if err := fl.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fl.NArg() == 0 {
+		return errors.New("usage: submodule foreach [--recursive] [--quiet] <command>")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	command := strings.Join(fl.Args(), " ")
+	return submoduleForeach(output, repo.workdir, "", command, *recursive, *quiet)
+}
+
+// submoduleForeach runs a shell command in every populated submodule of the
+// worktree. Prefix is the path of the worktree relative to the top level
+// superproject, used for display.
+func submoduleForeach(output io.Writer, workdir, prefix, command string, recursive, quiet bool) error {
+	subs, err := ReadSubmodules(workdir)
+	if err != nil {
+		return fmt.Errorf("read submodules: %w", err)
+	}
+	for _, sub := range subs {
+		dir := filepath.Join(workdir, sub.Path)
+		gitdir, err := submoduleGitDir(dir)
+		if err != nil {
+			return fmt.Errorf("submodule %q: %w", sub.Name, err)
+		}
+		if gitdir == "" {
+			// Not populated.
+			continue
+		}
+		sha, _ := readHeadCommit(gitdir)
+		displaypath := prefix + sub.Path
+		if !quiet {
+			fmt.Fprintf(output, "Entering '%s'\n", displaypath)
+		}
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Dir = dir
+		cmd.Stdout = output
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"name="+sub.Name,
+			"sm_path="+sub.Path,
+			"path="+sub.Path,
+			"displaypath="+displaypath,
+			"sha1="+sha,
+			"toplevel="+workdir,
+		)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("run command in submodule %q: %w", displaypath, err)
+		}
+		if recursive {
+			if err := submoduleForeach(output, dir, displaypath+"/", command, recursive, quiet); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func cmdSubtree(input io.Reader, output io.Writer, args []string) error {
+	const usage = "usage: subtree split --prefix=<prefix> [-b <branch>] <commit>\n" +
+		"   or: subtree add --prefix=<prefix> [-m <message>] <commit>"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "split":
+		return subtreeSplit(output, args[1:], usage)
+	case "add":
+		return subtreeAdd(output, args[1:], usage)
+	default:
+		return errors.New(usage)
+	}
+}
+
+func subtreeSplit(output io.Writer, args []string, usage string) error {
+	fl := flag.NewFlagSet("subtree split", flag.ContinueOnError)
+	prefix := fl.String("prefix", "", "Subdirectory to split.")
+	branch := fl.String("b", "", "Create a branch pointing to the split history.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 1 || *prefix == "" {
+		return errors.New(usage)
+	}
+	if *branch != "" {
+		if err := ValidateBranchName(*branch); err != nil {
+			return err
+		}
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	sha, err := repo.resolveCommit(fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	tip, err := repo.SubtreeSplit(sha, *prefix)
+	if err != nil {
+		return fmt.Errorf("split: %w", err)
+	}
+	if tip == nil {
+		return fmt.Errorf("no history for %q prefix", *prefix)
+	}
+	if *branch != "" {
+		if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/" + *branch, Sha: tip}); err != nil {
+			return fmt.Errorf("write branch: %w", err)
+		}
+	}
+	_, err = fmt.Fprintf(output, "%x\n", tip)
+	return err
+}
+
+// subtreeAdd merges the commit into HEAD with its content under the prefix,
+// and checks out the result. The commit of another repository must be
+// fetched first.
+func subtreeAdd(output io.Writer, args []string, usage string) error {
+	fl := flag.NewFlagSet("subtree add", flag.ContinueOnError)
+	prefix := fl.String("prefix", "", "Subdirectory to add the commit to.")
+	message := fl.String("m", "", "Use the message for the merge commit.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 1 || strings.Trim(*prefix, "/") == "" {
+		return errors.New(usage)
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	sha, err := repo.resolveCommit(fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	branch, head, err := repo.headBranch()
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		return errors.New("HEAD does not point to a commit yet")
+	}
+	dir := strings.Trim(*prefix, "/")
+	if *message == "" {
+		*message = fmt.Sprintf("Add '%s/' from commit '%x'\n", dir, sha)
+	}
+	merge, err := repo.SubtreeAdd(head, sha, dir, *message)
+	if err != nil {
+		return err
+	}
+	// Files are written while HEAD still points to the previous commit,
+	// so that only the added directory changes.
+	if err := repo.SwitchHead(merge, "", false); err != nil {
+		return err
+	}
+	if branch != "" {
+		err := repo.UpdateRefs(&RefUpdate{Name: branch, Sha: merge, OldSha: head}, &RefUpdate{Name: "HEAD", Target: branch})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(output, "Added dir '%s'\n", dir)
+	return err
+}
+
+func cmdCheckRefFormat(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("check-ref-format", flag.ContinueOnError)
+	var opts RefNameOptions
+	fl.BoolVar(&opts.AllowOneLevel, "allow-onelevel", false, "Accept names without a slash.")
+	fl.BoolVar(&opts.RefspecPattern, "refspec-pattern", false, "Accept a single * wildcard.")
+	normalize := fl.Bool("normalize", false, "Normalize and print the name.")
+	branch := fl.Bool("branch", false, "Check if the name is a valid branch name.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 1 {
+		return errors.New("usage: check-ref-format [--allow-onelevel] [--refspec-pattern] [--normalize] [--branch] <refname>")
+	}
+	name := fl.Arg(0)
+	if *branch {
+		if err := ValidateBranchName(name); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintln(output, name)
+		return err
+	}
+	if *normalize {
+		name = normalizeRefName(name)
+	}
+	if err := CheckRefName(name, opts); err != nil {
+		return err
+	}
+	if *normalize {
+		_, err := fmt.Fprintln(output, name)
+		return err
+	}
+	return nil
+}
+
+// setConfig sets the variable in the configuration file of the repository,
+// or the given one. With a type, the value is stored in its canonical form.
+func setConfig(name, value, kind string, global bool, file string) error {
+	switch kind {
+	case "", "path":
+	case "bool", "int", "bool-or-int":
+		var err error
+		if value, err = formatConfigValue(&ConfigEntry{Value: value}, kind); err != nil {
+			return fmt.Errorf("invalid value for --type=%s: %w", kind, err)
+		}
+	default:
+		return fmt.Errorf("unrecognized --type argument, %s", kind)
+	}
+	path := file
+	switch {
+	case global:
+		var err error
+		if path, err = globalConfigPath(); err != nil {
+			return err
+		}
+	case file == "":
+		repo, err := FindRepository(".")
+		if err != nil {
+			return fmt.Errorf("cannot open git repository: %w", err)
+		}
+		path = filepath.Join(repo.gitdir, "config")
+	}
+	return SetConfigValue(path, name, value)
+}
+
+func cmdConfig(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("config", flag.ContinueOnError)
+	global := fl.Bool("global", false, "Use the global configuration file of the user.")
+	local := fl.Bool("local", false, "Use the configuration file of the repository.")
+	file := fl.String("file", "", "Use the given configuration file.")
+	fl.StringVar(file, "f", "", "Same as -file.")
+	list := fl.Bool("list", false, "List all variables with their values.")
+	fl.BoolVar(list, "l", false, "Same as -list.")
+	edit := fl.Bool("edit", false, "Open the configuration file in the editor.")
+	fl.BoolVar(edit, "e", false, "Same as -edit.")
+	get := fl.Bool("get", false, "Show the last value of the variable.")
+	getAll := fl.Bool("get-all", false, "Show all values of a multivar.")
+	getRegexp := fl.Bool("get-regexp", false, "Show variables with names matching the regular expression.")
+	showScope := fl.Bool("show-scope", false, "Show the scope of every variable: global, local or command.")
+	kind := fl.String("type", "", "Show values converted to the type: bool, int, bool-or-int or path.")
+	types := map[string]*bool{}
+	for _, t := range []string{"bool", "int", "bool-or-int", "path"} {
+		types[t] = fl.Bool(t, false, "Same as -type="+t+".")
+	}
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	for t, on := range types {
+		if *on {
+			*kind = t
+		}
+	}
+	const usage = "usage: config [--global | --local | -f <file>] [--show-scope] [--type=<type>] (-l | -e | [--get | --get-all] <name> [<value-regex>] | --get-regexp <name-regex> [<value-regex>] | <name> <value>)"
+	modes := 0
+	for _, on := range []bool{*list, *edit, *get, *getAll, *getRegexp} {
+		if on {
+			modes++
+		}
+	}
+	scopes := 0
+	for _, on := range []bool{*global, *local, *file != ""} {
+		if on {
+			scopes++
+		}
+	}
+	if modes == 0 && fl.NArg() == 2 {
+		if *showScope || scopes > 1 {
+			return errors.New(usage)
+		}
+		return setConfig(fl.Arg(0), fl.Arg(1), *kind, *global, *file)
+	}
+	if modes == 0 && fl.NArg() != 0 {
+		*get = true
+		modes++
+	}
+	getMode := *get || *getAll || *getRegexp
+	switch {
+	case modes != 1, scopes > 1:
+		return errors.New(usage)
+	case (*list || *edit) && fl.NArg() != 0:
+		return errors.New(usage)
+	case getMode && (fl.NArg() < 1 || fl.NArg() > 2):
+		return errors.New(usage)
+	}
+	switch *kind {
+	case "", "bool", "int", "bool-or-int", "path":
+		// Known type.
+	default:
+		return fmt.Errorf("unrecognized --type argument, %s", *kind)
+	}
+
+	var gitdir string
+	if *file == "" && !*global {
+		repo, err := FindRepository(".")
+		if err != nil && (*local || *edit) {
+			return fmt.Errorf("cannot open git repository: %w", err)
+		}
+		if err == nil {
+			gitdir = repo.gitdir
+		}
+	}
+	var files []configFile
+	switch {
+	case *file != "":
+		files = []configFile{{Scope: "command", Path: *file}}
+	case *global:
+		files = configFiles("")
+	case *local:
+		files = []configFile{{Scope: "local", Path: filepath.Join(gitdir, "config")}}
+	default:
+		files = configFiles(gitdir)
+	}
+
+	if *edit {
+		path := files[len(files)-1].Path
+		if gitdir != "" && !*local {
+			// The worktree configuration is edited only explicitly.
+			path = filepath.Join(gitdir, "config")
+		}
+		if *global {
+			var err error
+			if path, err = globalConfigPath(); err != nil {
+				return err
+			}
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				if err := ioutil.WriteFile(path, []byte(globalConfigTemplate), 0644); err != nil {
+					return err
+				}
+			}
+		}
+		config, err := loadConfig(gitdir)
+		if err != nil {
+			return fmt.Errorf("read configuration: %w", err)
+		}
+		return launchEditor(config, path)
+	}
+
+	type scopedEntry struct {
+		scope string
+		*ConfigEntry
+	}
+	var entries []scopedEntry
+	for _, f := range files {
+		config, err := ReadConfigFile(f.Path)
+		if err != nil {
+			return err
+		}
+		for _, e := range config.Entries {
+			entries = append(entries, scopedEntry{scope: f.Scope, ConfigEntry: e})
+		}
+	}
+
+	wr := bufio.NewWriter(output)
+	if *list {
+		for _, e := range entries {
+			if *showScope {
+				fmt.Fprintf(wr, "%s\t", e.scope)
+			}
+			if e.NoValue {
+				fmt.Fprintln(wr, e.Name())
+			} else {
+				fmt.Fprintf(wr, "%s=%s\n", e.Name(), e.Value)
+			}
+		}
+		return wr.Flush()
+	}
+
+	var matchName func(e *ConfigEntry) bool
+	if *getRegexp {
+		pattern := fl.Arg(0)
+		// The section and the key are case insensitive.
+		if dot := strings.IndexByte(pattern, '.'); dot >= 0 {
+			last := strings.LastIndexByte(pattern, '.')
+			pattern = strings.ToLower(pattern[:dot]) + pattern[dot:last] + strings.ToLower(pattern[last:])
+		} else {
+			pattern = strings.ToLower(pattern)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid key pattern: %s: %w", fl.Arg(0), err)
+		}
+		matchName = func(e *ConfigEntry) bool { return re.MatchString(e.Name()) }
+	} else {
+		name := fl.Arg(0)
+		dot, last := strings.IndexByte(name, '.'), strings.LastIndexByte(name, '.')
+		if dot < 0 || last == len(name)-1 {
+			return fmt.Errorf("key does not contain a section: %s", name)
+		}
+		section, key := strings.ToLower(name[:dot]), strings.ToLower(name[last+1:])
+		var subsection string
+		if dot != last {
+			subsection = name[dot+1 : last]
+		}
+		matchName = func(e *ConfigEntry) bool {
+			return e.Section == section && e.Subsection == subsection && e.Key == key
+		}
+	}
+	matchValue := func(e *ConfigEntry) bool { return true }
+	if fl.NArg() == 2 {
+		pattern, negate := fl.Arg(1), false
+		if strings.HasPrefix(pattern, "!") {
+			pattern, negate = pattern[1:], true
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %s: %w", fl.Arg(1), err)
+		}
+		matchValue = func(e *ConfigEntry) bool { return re.MatchString(e.Value) != negate }
+	}
+
+	var found []scopedEntry
+	for _, e := range entries {
+		if matchName(e.ConfigEntry) && matchValue(e.ConfigEntry) {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		return exitCode(1)
+	}
+	if *get {
+		found = found[len(found)-1:]
+	}
+	for _, e := range found {
+		if *showScope {
+			fmt.Fprintf(wr, "%s\t", e.scope)
+		}
+		if *getRegexp {
+			wr.WriteString(e.Name())
+			if *kind == "" && e.NoValue {
+				wr.WriteByte('\n')
+				continue
+			}
+			wr.WriteByte(' ')
+		}
+		value, err := formatConfigValue(e.ConfigEntry, *kind)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(wr, value)
+	}
+	return wr.Flush()
+}
+
+// globalConfigTemplate is written to the global configuration file that is
+// edited before it exists.
+const globalConfigTemplate = `# This is Git's per-user configuration file.
+[user]
+# Please adapt and uncomment the following lines:
+#	name = Your Name
+#	email = you@example.com
+`
+
+func cmdCredential(input io.Reader, output io.Writer, args []string) error {
+	if len(args) != 1 || (args[0] != "fill" && args[0] != "approve" && args[0] != "reject") {
+		return errors.New("usage: credential (fill | approve | reject)")
+	}
+	// Credentials are also used outside of repositories, with the global
+	// configuration only.
+	var config *Config
+	if repo, err := FindRepository("."); err == nil {
+		config = repo.config
+	} else if config, err = loadConfig(""); err != nil {
+		return fmt.Errorf("read configuration: %w", err)
+	}
+	c, err := ReadCredential(input)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "fill":
+		if err := c.Fill(config); err != nil {
+			return err
+		}
+		_, err := c.WriteTo(output)
+		return err
+	case "approve":
+		return c.Approve(config)
+	default:
+		return c.Reject(config)
+	}
+}
+
+// defaultRemoteRefspecs are used by clone for the origin remote.
+var defaultRemoteRefspecs = []string{
+	"+refs/heads/*:refs/remotes/origin/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+func cmdClone(input io.Reader, output io.Writer, args []string) (err error) {
+	fl := flag.NewFlagSet("clone", flag.ContinueOnError)
+	bundleURI := fl.String("bundle-uri", "", "Unbundle the bundle or bundle list at the URI before fetching the rest from the repository.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	args = fl.Args()
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: clone [--bundle-uri=<uri>] <repository> [<dir>]")
+	}
+	url := args[0]
+	path := url
+	if isSCPLikeURL(url) {
+		path = url[strings.IndexByte(url, ':')+1:]
+	} else if _, _, helper := helperURL(url); !helper && !strings.Contains(url, "://") {
+		// Remember local paths independently of the working directory.
+		abs, err := filepath.Abs(url)
+		if err != nil {
+			return fmt.Errorf("absolute path for %q: %w", url, err)
+		}
+		url, path = abs, abs
+	}
+	dir := strings.TrimSuffix(filepath.Base(strings.TrimSuffix(path, "/")), ".git")
+	if len(args) == 2 {
+		dir = args[1]
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("destination path %q already exists", dir)
+	}
+	repo, err := CreateRepository(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	t, err := repo.OpenTransport(url)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	config := fmt.Sprintf("[remote \"origin\"]\n\turl = %s\n\tfetch = %s\n", url, defaultRemoteRefspecs[0])
+	fd, err := os.OpenFile(filepath.Join(repo.gitdir, "config"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open config: %w", err)
+	}
+	_, err = fd.WriteString(config)
+	if cerr := fd.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+
+	// Bundles only save work, so failing to get them is not fatal.
+	if *bundleURI != "" {
+		if err := repo.FetchBundleURI(*bundleURI); err != nil {
+			fmt.Fprintf(output, "warning: failed to fetch bundles from '%s': %s\n", *bundleURI, err)
+		}
+	} else if bt, ok := t.(BundleURITransport); ok {
+		if enabled, err := repo.config.Bool("transfer", "", "bundleURI", false); err != nil {
+			return err
+		} else if enabled {
+			list, err := bt.BundleList()
+			if err == nil && list != nil {
+				err = repo.FetchBundleList(list)
+			}
+			if err != nil {
+				fmt.Fprintf(output, "warning: failed to fetch advertised bundles: %s\n", err)
+			}
+		}
+	}
+
+	var refspecs []*Refspec
+	for _, raw := range defaultRemoteRefspecs {
+		spec, err := ParseRefspec(raw)
+		if err != nil {
+			return err
+		}
+		refspecs = append(refspecs, spec)
+	}
+	if _, err := repo.Fetch(t, refspecs, nil); err != nil {
+		return err
+	}
+
+	remoteRefs, err := t.ListRefs()
+	if err != nil {
+		return err
+	}
+	var head *Ref
+	for _, ref := range remoteRefs {
+		if ref.Name == "HEAD" && strings.HasPrefix(ref.Target, "refs/heads/") {
+			head = ref
+		}
+	}
+	if head == nil {
+		fmt.Fprintln(output, "warning: remote HEAD refers to nonexistent ref, unable to checkout")
+		return nil
+	}
+	branch := strings.TrimPrefix(head.Target, "refs/heads/")
+	// Not all transports know the hash before fetching.
+	sha, err := repo.resolveRef("refs/remotes/origin/" + branch)
+	if err != nil {
+		return fmt.Errorf("remote HEAD: %w", err)
+	}
+	err = repo.UpdateRefs(
+		&RefUpdate{Name: head.Target, Sha: sha},
+		&RefUpdate{Name: "HEAD", Target: head.Target},
+		&RefUpdate{Name: "refs/remotes/origin/HEAD", Target: "refs/remotes/origin/" + branch},
+	)
+	if err != nil {
+		return fmt.Errorf("write references: %w", err)
+	}
+	c, err := repo.readCommit(sha)
+	if err != nil {
+		return err
+	}
+	tr, err := repo.commitTree(c)
+	if err != nil {
+		return err
+	}
+	ps, err := ParsePathspec("", nil)
+	if err != nil {
+		return err
+	}
+	return treeCheckout(repo, tr, repo.workdir, "", ps, nil)
+}
+
+func cmdFetch(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	var negotiationTips stringsFlag
+	fl.Var(&negotiationTips, "negotiation-tip", "Report only commits reachable from the revision, or from references matching the glob, as present. Can be repeated.")
+	dryRun := fl.Bool("n", false, "Show the reference updates without making them.")
+	fl.BoolVar(dryRun, "dry-run", false, "Same as -n.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	args = fl.Args()
+	name := "origin"
+	if len(args) != 0 {
+		name = args[0]
+		args = args[1:]
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	remote, err := repo.ReadRemote(name)
+	switch {
+	case err == nil:
+		// Configured remote.
+	case errors.Is(err, os.ErrNotExist):
+		// Not a configured remote, but an URL.
+		remote = &Remote{URL: name}
+	default:
+		return err
+	}
+	refspecs := remote.Fetch
+	if len(args) != 0 {
+		if refspecs, err = parseRefspecs(args, false); err != nil {
+			return err
+		}
+	}
+	if len(refspecs) == 0 {
+		return errors.New("usage: fetch [-n | --dry-run] [--negotiation-tip=<revision>]... [<repository> [<refspec>...]]")
+	}
+
+	t, err := repo.OpenTransport(remote.URL)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	if len(negotiationTips) != 0 {
+		tips, err := repo.NegotiationTips(negotiationTips)
+		if err != nil {
+			return err
+		}
+		if nt, ok := t.(NegotiatingTransport); ok {
+			nt.SetNegotiationTips(tips)
+		}
+	}
+	changes, err := repo.Fetch(t, refspecs, &FetchOptions{DryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+	if err := writeRefChanges(output, changes); err != nil {
+		return err
+	}
+	if *dryRun {
+		return nil
+	}
+	return runAutoGC(output, repo)
+}
+
+func cmdPush(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("push", flag.ContinueOnError)
+	force := fl.Bool("force", false, "Allow updates that are not fast-forward.")
+	dryRun := fl.Bool("n", false, "Show the reference updates without sending them.")
+	fl.BoolVar(dryRun, "dry-run", false, "Same as -n.")
+	var options stringsFlag
+	fl.Var(&options, "o", "Pass the option to hooks of the receiving repository. Can be repeated.")
+	fl.Var(&options, "push-option", "Same as -o.")
+	var signed signedFlag
+	fl.Var(&signed, "signed", "Sign the push with a certificate: true, false, or if-asked to sign only if the receiving repository supports it.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() < 2 {
+		return errors.New("usage: push [--force] [-n | --dry-run] [--signed[=(true|false|if-asked)]] [-o <option>]... <repository> <refspec>...")
+	}
+	refspecs, err := parseRefspecs(fl.Args()[1:], *force)
+	if err != nil {
+		return err
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	opts := &PushOptions{Options: options, Signed: signed.value, DryRun: *dryRun}
+	if options == nil {
+		// An empty value clears options configured before it.
+		for _, o := range repo.config.GetAll("push", "", "pushOption") {
+			if o == "" {
+				opts.Options = nil
+			} else {
+				opts.Options = append(opts.Options, o)
+			}
+		}
+	}
+	if !signed.set {
+		if v, ok := repo.config.Get("push", "", "gpgSign"); ok {
+			if err := signed.Set(v); err != nil {
+				return fmt.Errorf("push.gpgSign: %w", err)
+			}
+			opts.Signed = signed.value
+		}
+	}
+	url := fl.Arg(0)
+	switch remote, err := repo.ReadRemote(url); {
+	case err == nil:
+		url = remote.URL
+	case errors.Is(err, os.ErrNotExist):
+		// Not a configured remote, but an URL.
+	default:
+		return err
+	}
+
+	t, err := repo.OpenTransport(url)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	changes, err := repo.Push(t, refspecs, opts)
+	if err != nil {
+		return err
+	}
+	return writeRefChanges(output, changes)
+}
+
+// signedFlag selects whether a push is signed. It is true when given
+// without a value.
+type signedFlag struct {
+	set   bool
+	value string
+}
+
+func (f *signedFlag) String() string { return f.value }
+
+func (f *signedFlag) Set(value string) error {
+	f.set = true
+	if strings.ToLower(value) == "if-asked" {
+		f.value = PushSignedIfAsked
+		return nil
+	}
+	on, err := parseConfigBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value %q, want true, false or if-asked", value)
+	}
+	if on {
+		f.value = PushSignedAlways
+	} else {
+		f.value = PushSignedNever
+	}
+	return nil
+}
+
+func (f *signedFlag) IsBoolFlag() bool { return true }
+
+func parseRefspecs(args []string, force bool) ([]*Refspec, error) {
+	refspecs := make([]*Refspec, 0, len(args))
+	for _, raw := range args {
+		spec, err := ParseRefspec(raw)
+		if err != nil {
+			return nil, err
+		}
+		spec.Force = spec.Force || force
+		refspecs = append(refspecs, spec)
+	}
+	return refspecs, nil
+}
+
+// writeRefChanges prints a summary of updated references in the format used
+// by git fetch and git push. An error is returned if any change was
+// rejected.
+func writeRefChanges(w io.Writer, changes []*RefChange) error {
+	var rejected int
+	for _, c := range changes {
+		var flag, summary, note string
+		switch {
+		case c.Rejected != "":
+			flag, summary, note = "!", "[rejected]", " ("+c.Rejected+")"
+			rejected++
+		case c.Dst == "" || bytes.Equal(c.Old, c.New):
+			continue
+		case c.New == nil:
+			flag, summary = "-", "[deleted]"
+		case c.Old == nil:
+			flag, summary = "*", "[new ref]"
+		case c.Forced:
+			flag, summary, note = "+", shortHash(c.Old)+"..."+shortHash(c.New), " (forced update)"
+		default:
+			flag, summary = " ", shortHash(c.Old)+".."+shortHash(c.New)
+		}
+		src := c.Src
+		if src == "" {
+			src = "(delete)"
+		}
+		if _, err := fmt.Fprintf(w, " %s %-17s %s -> %s%s\n", flag, summary, src, c.Dst, note); err != nil {
+			return err
+		}
+	}
+	if rejected != 0 {
+		return fmt.Errorf("%d reference updates rejected", rejected)
+	}
+	return nil
+}
+
+func shortHash(sha []byte) string {
+	return hex.EncodeToString(sha)[:7]
+}
+
+// rawDiffFlags registers output format flags shared by the diff plumbing
+// commands.
+type rawDiffFlags struct {
+	nul        *bool
+	nameOnly   *bool
+	nameStatus *bool
+}
+
+func addRawDiffFlags(fl *flag.FlagSet) *rawDiffFlags {
+	return &rawDiffFlags{
+		nul:        fl.Bool("z", false, "Separate paths and records with NUL instead of new lines."),
+		nameOnly:   fl.Bool("name-only", false, "Show only names of changed files."),
+		nameStatus: fl.Bool("name-status", false, "Show only names and status of changed files."),
+	}
+}
+
+// writeRawDiff writes changes in the raw diff format, for example
+// ":100644 100644 <old> <new> M\tpath". Missing hashes are written as zeros.
+func writeRawDiff(w io.Writer, changes []*FileChange, f *rawDiffFlags, quote func(string) string) error {
+	sep, term := "\t", "\n"
+	if *f.nul {
+		// Paths are written as they are, there is nothing to quote them
+		// from.
+		sep, term = "\x00", "\x00"
+		quote = rawPath
+	}
+	var b bytes.Buffer
+	for _, c := range changes {
+		path := quote(c.Path)
+		switch {
+		case *f.nameOnly:
+			fmt.Fprintf(&b, "%s%s", path, term)
+		case *f.nameStatus:
+			fmt.Fprintf(&b, "%c%s%s%s", c.Status, sep, path, term)
+		default:
+			fmt.Fprintf(&b, ":%06d %06d %s %s %c%s%s%s",
+				c.OldMode, c.NewMode, rawDiffHash(c.OldSha), rawDiffHash(c.NewSha),
+				c.Status, sep, path, term)
+		}
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+func rawDiffHash(sha []byte) string {
+	if sha == nil {
+		return strings.Repeat("0", 40)
+	}
+	return hex.EncodeToString(sha)
+}
+
+// parseDiffPathspec parses path arguments that can be separated from the
+// revisions with "--".
+func (r *Repository) parseDiffPathspec(args []string) (*Pathspec, error) {
+	if len(args) != 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	return r.parseCwdPathspec(args)
+}
+
+func cmdDiffTree(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("diff-tree", flag.ContinueOnError)
+	recursive := fl.Bool("r", false, "Recurse into subtrees.")
+	root := fl.Bool("root", false, "Show a root commit as a big creation event.")
+	noCommitID := fl.Bool("no-commit-id", false, "Do not show the commit hash when comparing a commit with its parent.")
+	format := addRawDiffFlags(fl)
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() < 1 || fl.Arg(0) == "--" {
+		return errors.New("usage: diff-tree [-r] [-z] [--root] [--name-only | --name-status] (<tree-ish> [<tree-ish>] | <commit>..<commit> | <commit>...<commit>) [[--] <path>...]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+
+	rest := fl.Args()[1:]
+	var a, b *TreeObject
+	if from, to, symmetric, ok := splitRevisionRange(fl.Arg(0)); ok {
+		// With three dots, the second commit is compared with the point
+		// where it forked from the first one.
+		if symmetric {
+			x, err := repo.resolveCommit(from)
+			if err != nil {
+				return err
+			}
+			y, err := repo.resolveCommit(to)
+			if err != nil {
+				return err
+			}
+			bases, err := repo.MergeBases(x, y)
+			if err != nil {
+				return err
+			}
+			if len(bases) == 0 {
+				return fmt.Errorf("%s and %s have no common ancestor", from, to)
+			}
+			from = hex.EncodeToString(bases[0])
+		}
+		if a, err = repo.readTreeish(from); err != nil {
+			return err
+		}
+		if b, err = repo.readTreeish(to); err != nil {
+			return err
+		}
+	} else if len(rest) != 0 && rest[0] != "--" {
+		if _, err := repo.Resolve(rest[0]); err == nil {
+			if a, err = repo.readTreeish(fl.Arg(0)); err != nil {
+				return err
+			}
+			if b, err = repo.readTreeish(rest[0]); err != nil {
+				return err
+			}
+			rest = rest[1:]
+		}
+	}
+	ps, err := repo.parseDiffPathspec(rest)
+	if err != nil {
+		return err
+	}
+
+	if b == nil {
+		// A single commit is compared with its first parent.
+		sha, err := repo.Resolve(fl.Arg(0))
+		if err != nil {
+			return err
+		}
+		if sha, err = repo.peelObject(sha, "commit"); err != nil {
+			return err
+		}
+		c, err := repo.readCommit(sha)
+		if err != nil {
+			return err
+		}
+		if b, err = repo.commitTree(c); err != nil {
+			return err
+		}
+		if len(c.Header["parent"]) == 0 {
+			if !*root {
+				return nil
+			}
+		} else if a, err = repo.readTreeish(c.Header["parent"][0]); err != nil {
+			return err
+		}
+		if !*noCommitID {
+			term := "\n"
+			if *format.nul {
+				term = "\x00"
+			}
+			fmt.Fprintf(output, "%x%s", sha, term)
+		}
+	}
+
+	changes, err := repo.DiffTrees(a, b, *recursive, ps)
+	if err != nil {
+		return err
+	}
+	quote, err := repo.pathQuoter()
+	if err != nil {
+		return err
+	}
+	return writeRawDiff(output, changes, format, quote)
+}
+
+func cmdDiffIndex(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("diff-index", flag.ContinueOnError)
+	cached := fl.Bool("cached", false, "Compare the tree with the index only, ignoring the worktree.")
+	format := addRawDiffFlags(fl)
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() < 1 || fl.Arg(0) == "--" {
+		return errors.New("usage: diff-index [--cached] [-z] [--name-only | --name-status] <tree-ish> [[--] <path>...]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	ps, err := repo.parseDiffPathspec(fl.Args()[1:])
+	if err != nil {
+		return err
+	}
+	tr, err := repo.readTreeish(fl.Arg(0))
+	if err != nil {
+		return err
+	}
+	idx, err := repo.ReadIndex()
+	if err != nil {
+		return err
+	}
+	changes, err := repo.DiffTreeIndex(tr, idx, !*cached, ps)
+	if err != nil {
+		return err
+	}
+	quote, err := repo.pathQuoter()
+	if err != nil {
+		return err
+	}
+	return writeRawDiff(output, changes, format, quote)
+}
+
+func cmdDiffFiles(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("diff-files", flag.ContinueOnError)
+	format := addRawDiffFlags(fl)
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	ps, err := repo.parseDiffPathspec(fl.Args())
+	if err != nil {
+		return err
+	}
+	// Entries outside of the cone are never compared with the worktree.
+	idx, err := repo.ReadSparseIndex()
+	if err != nil {
+		return err
+	}
+	changes, err := repo.DiffIndexWorktree(idx, ps)
+	if err != nil {
+		return err
+	}
+	quote, err := repo.pathQuoter()
+	if err != nil {
+		return err
+	}
+	return writeRawDiff(output, changes, format, quote)
+}
+
+func cmdLsFiles(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("ls-files", flag.ContinueOnError)
+	stage := fl.Bool("s", false, "Show the mode, the object hash and the stage of entries.")
+	fl.BoolVar(stage, "stage", false, "Same as -s.")
+	eol := fl.Bool("eol", false, "Show line endings of files in the index and the worktree, and the text and eol attributes.")
+	nul := fl.Bool("z", false, "Terminate entries with NUL instead of new line and do not quote paths.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	ps, err := repo.parseDiffPathspec(fl.Args())
+	if err != nil {
+		return err
+	}
+	idx, err := repo.ReadIndex()
+	if err != nil {
+		return err
+	}
+	quote, err := repo.pathQuoter()
+	if err != nil {
+		return err
+	}
+	term := "\n"
+	if *nul {
+		quote, term = rawPath, "\x00"
+	}
+	var attrs *attrStack
+	if *eol {
+		if attrs, err = repo.worktreeAttributes(); err != nil {
+			return err
+		}
+	}
+
+	wr := bufio.NewWriter(output)
+	for _, e := range idx.Entries {
+		if !ps.Match(e.Path) {
+			continue
+		}
+		if *stage {
+			fmt.Fprintf(wr, "%06d %x %d\t", e.Mode, e.Sha, e.Stage)
+		}
+		if *eol {
+			var indexEOL, worktreeEOL string
+			if e.Mode == modeBlob || e.Mode == modeExec {
+				_, content, err := repo.ReadRawObject(e.Sha)
+				if err != nil {
+					return fmt.Errorf("read %s from the index: %w", e.Path, err)
+				}
+				indexEOL = eolDescription(content)
+			}
+			path := filepath.Join(repo.workdir, filepath.FromSlash(e.Path))
+			if fi, err := os.Lstat(path); err == nil && fi.Mode().IsRegular() {
+				content, err := ioutil.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				worktreeEOL = eolDescription(content)
+			}
+			entryAttrs, err := attrs.Lookup(e.Path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(wr, "i/%-5s w/%-5s attr/%-17s\t", indexEOL, worktreeEOL, eolAttrDescription(entryAttrs))
+		}
+		fmt.Fprintf(wr, "%s%s", quote(e.Path), term)
+	}
+	return wr.Flush()
+}
+
+func cmdUpdateIndex(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("update-index", flag.ContinueOnError)
+	assumeUnchanged := fl.Bool("assume-unchanged", false, "Do not compare the files with the worktree.")
+	noAssumeUnchanged := fl.Bool("no-assume-unchanged", false, "Compare the files with the worktree again.")
+	skipWorktree := fl.Bool("skip-worktree", false, "Do not read or write the files in the worktree.")
+	noSkipWorktree := fl.Bool("no-skip-worktree", false, "Read and write the files in the worktree again.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	paths := fl.Args()
+	if len(paths) != 0 && paths[0] == "--" {
+		paths = paths[1:]
+	}
+	if len(paths) == 0 || (*assumeUnchanged && *noAssumeUnchanged) || (*skipWorktree && *noSkipWorktree) {
+		return errors.New("usage: update-index [--[no-]assume-unchanged] [--[no-]skip-worktree] [--] <path>...")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	unlock, err := repo.LockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	idx, err := repo.ReadIndex()
+	if err != nil {
+		return err
+	}
+	wp, err := repo.worktreePaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		e := wp.entry(idx, filepath.ToSlash(filepath.Clean(path)))
+		if e == nil || e.Stage != 0 {
+			return fmt.Errorf("%s: not in the index", path)
+		}
+		switch {
+		case *assumeUnchanged:
+			e.AssumeValid = true
+		case *noAssumeUnchanged:
+			e.AssumeValid = false
+		}
+		switch {
+		case *skipWorktree:
+			e.SkipWorktree = true
+		case *noSkipWorktree:
+			e.SkipWorktree = false
+		}
+	}
+	return repo.WriteIndex(idx)
+}
+
+func cmdAdd(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("add", flag.ContinueOnError)
+	intentToAdd := fl.Bool("N", false, "Record only that the files will be added later.")
+	fl.BoolVar(intentToAdd, "intent-to-add", false, "Same as -N.")
+	force := fl.Bool("f", false, "Add ignored files too.")
+	fl.BoolVar(force, "force", false, "Same as -f.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	paths := fl.Args()
+	if len(paths) != 0 && paths[0] == "--" {
+		paths = paths[1:]
+	}
+	if len(paths) == 0 {
+		return errors.New("usage: add [-N] [-f] [--] <pathspec>...")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	unlock, err := repo.LockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	idx, err := repo.ReadSparseIndex()
+	if err != nil {
+		return err
+	}
+	prefix, err := repo.cwdPrefix()
+	if err != nil {
+		return err
+	}
+	if !*intentToAdd {
+		if err := repo.AddPaths(idx, prefix, paths, *force); err != nil {
+			return err
+		}
+		return repo.WriteIndex(idx)
+	}
+	fileMode, err := repo.config.Bool("core", "", "fileMode", true)
+	if err != nil {
+		return err
+	}
+	wp, err := repo.worktreePaths()
+	if err != nil {
+		return err
+	}
+	ignores, err := repo.worktreeIgnores()
+	if err != nil {
+		return err
+	}
+	// The entries point to an empty blob, which must exist.
+	emptyBlob, err := repo.WriteObject("blob", nil)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		root := filepath.Join(repo.workdir, filepath.FromSlash(prefix), filepath.Clean(path))
+		// Ignored files are skipped, unless the path names them.
+		named := false
+		err := filepath.Walk(root, func(full string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(repo.workdir, full)
+			if err != nil {
+				return err
+			}
+			rel = wp.name(filepath.ToSlash(rel))
+			if rel == ".." || strings.HasPrefix(rel, "../") {
+				return fmt.Errorf("%s is outside of the repository", path)
+			}
+			if info.IsDir() {
+				if info.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				if full == root && rel != "." && !*force {
+					if named, err = ignores.Ignored(rel + "/"); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			if idx.sparseDirOf(rel) != nil {
+				// Only paths outside of the cone need all entries.
+				if err := repo.expandIndex(idx); err != nil {
+					return err
+				}
+			}
+			if wp.entry(idx, rel) != nil {
+				// Already tracked, possibly unmerged.
+				return nil
+			}
+			if !*force {
+				if ignored, err := ignores.Ignored(rel); err != nil {
+					return err
+				} else if ignored && (named || full == root) {
+					return fmt.Errorf("%s is ignored by gitignore rules, use -f to add it", rel)
+				} else if ignored {
+					return nil
+				}
+			}
+			i, _ := idx.entry(rel)
+			e := &IndexEntry{Mode: modeBlob, Sha: emptyBlob, IntentToAdd: true, Path: rel}
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				e.Mode = modeSymlink
+			case fileMode && info.Mode()&0111 != 0:
+				e.Mode = modeExec
+			}
+			idx.Entries = append(idx.Entries, nil)
+			copy(idx.Entries[i+1:], idx.Entries[i:])
+			idx.Entries[i] = e
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("add %s: %w", path, err)
+		}
+	}
+	return repo.WriteIndex(idx)
+}
+
+// untrackedFlag is the value of the -u option of status, which is "all"
+// without a value.
+type untrackedFlag string
+
+func (f *untrackedFlag) String() string { return string(*f) }
+
+func (f *untrackedFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*f = UntrackedAll
+	case UntrackedNo, UntrackedNormal, UntrackedAll:
+		*f = untrackedFlag(value)
+	default:
+		return fmt.Errorf("invalid untracked files mode %q", value)
+	}
+	return nil
+}
+
+func (f *untrackedFlag) IsBoolFlag() bool { return true }
+
+func cmdStatus(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("status", flag.ContinueOnError)
+	short := fl.Bool("s", false, "Show the status in the short format.")
+	fl.BoolVar(short, "short", false, "Same as -s.")
+	porcelain := fl.Bool("porcelain", false, "Show the status in the short format, for scripts.")
+	nul := fl.Bool("z", false, "Terminate entries with NUL instead of new line and do not quote paths. Implies --porcelain.")
+	untracked := untrackedFlag(UntrackedNormal)
+	fl.Var(&untracked, "u", "Show untracked files: no, normal or all. All if no value is given.")
+	fl.Var(&untracked, "untracked-files", "Same as -u.")
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: status [-s] [--porcelain] [-z] [-u[<mode>]]")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	entries, err := repo.Status(string(untracked))
+	if err != nil {
+		return err
+	}
+	quote, err := repo.pathQuoter()
+	if err != nil {
+		return err
+	}
+	term := "\n"
+	if *nul {
+		quote, term = rawPath, "\x00"
+	}
+
+	wr := bufio.NewWriter(output)
+	if *short || *porcelain || *nul {
+		for _, e := range entries {
+			fmt.Fprintf(wr, "%c%c %s%s", e.Staged, e.Unstaged, quote(e.Path), term)
+		}
+		return wr.Flush()
+	}
+
+	var staged, unmerged, unstaged, untrackedPaths []string
+	for _, e := range entries {
+		switch {
+		case e.Staged == '?':
+			untrackedPaths = append(untrackedPaths, quote(e.Path))
+		case e.Unmerged():
+			unmerged = append(unmerged, fmt.Sprintf("%-17s%s", unmergedLabels[string([]byte{e.Staged, e.Unstaged})]+":", quote(e.Path)))
+		default:
+			if e.Staged != ' ' {
+				staged = append(staged, fmt.Sprintf("%-12s%s", statusLabels[e.Staged]+":", quote(e.Path)))
+			}
+			if e.Unstaged != ' ' {
+				unstaged = append(unstaged, fmt.Sprintf("%-12s%s", statusLabels[e.Unstaged]+":", quote(e.Path)))
+			}
+		}
+	}
+	branch, head, err := repo.headBranch()
+	if err != nil {
+		return err
+	}
+	if branch == "" {
+		fmt.Fprintf(wr, "HEAD detached at %s\n", shortHash(head))
+	} else {
+		fmt.Fprintf(wr, "On branch %s\n", strings.TrimPrefix(branch, "refs/heads/"))
+	}
+	if head == nil {
+		fmt.Fprint(wr, "\nNo commits yet\n\n")
+	}
+	if len(unmerged) != 0 {
+		fmt.Fprint(wr, "You have unmerged paths.\n\n")
+	}
+
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{
+		{"Changes to be committed", staged},
+		{"Unmerged paths", unmerged},
+		{"Changes not staged for commit", unstaged},
+		{"Untracked files", untrackedPaths},
+	} {
+		if len(section.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(wr, "%s:\n", section.title)
+		for _, line := range section.lines {
+			fmt.Fprintf(wr, "\t%s\n", line)
+		}
+		fmt.Fprintln(wr)
+	}
+	switch {
+	case len(staged) != 0:
+		// The changes are listed, there is nothing to add.
+	case len(unstaged) != 0 || len(unmerged) != 0:
+		fmt.Fprintln(wr, "no changes added to commit")
+	case len(untrackedPaths) != 0:
+		fmt.Fprintln(wr, "nothing added to commit but untracked files present")
+	case head == nil:
+		fmt.Fprintln(wr, "nothing to commit")
+	default:
+		fmt.Fprintln(wr, "nothing to commit, working tree clean")
+	}
+	return wr.Flush()
+}
+
+// statusLabels describe changes in the long format of status.
+var statusLabels = map[byte]string{
+	'A': "new file",
+	'D': "deleted",
+	'M': "modified",
+	'T': "typechange",
+}
+
+// unmergedLabels describe unmerged paths in the long format of status.
+var unmergedLabels = map[string]string{
+	"DD": "both deleted",
+	"AU": "added by us",
+	"UD": "deleted by them",
+	"UA": "added by them",
+	"DU": "deleted by us",
+	"AA": "both added",
+	"UU": "both modified",
 }
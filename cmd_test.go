@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCatFileBatch(t *testing.T) {
+	repo := newTestRepository(t)
+	dir := repo.workdir
+	blob, err := repo.WriteObject("blob", []byte("hello\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	b := NewTreeBuilder(repo, nil)
+	if err := b.Insert("a b.txt", modeBlob, blob); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	tree, err := b.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	treeSize := len("100644 a b.txt\x00") + 20
+	missing := strings.Repeat("0", 40)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %s", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %s", err)
+	}
+	defer os.Chdir(wd)
+
+	cases := map[string]struct {
+		args  []string
+		input string
+		want  string
+	}{
+		"batch": {
+			args:  []string{"--batch"},
+			input: fmt.Sprintf("%x\n%s\n", blob, missing),
+			want:  fmt.Sprintf("%x blob 6\nhello\n\n%s missing\n", blob, missing),
+		},
+		"batch check": {
+			args:  []string{"--batch-check"},
+			input: fmt.Sprintf("%x\n%x\n%s\n", blob, tree, missing),
+			want:  fmt.Sprintf("%x blob 6\n%x tree %d\n%s missing\n", blob, tree, treeSize, missing),
+		},
+		"batch check path with spaces": {
+			args:  []string{"--batch-check"},
+			input: fmt.Sprintf("%x:a b.txt\n", tree),
+			want:  fmt.Sprintf("%x blob 6\n", blob),
+		},
+		"batch format with rest": {
+			args:  []string{"--batch=%(objecttype) %(rest)"},
+			input: fmt.Sprintf("%x first file\n", blob),
+			want:  "blob first file\nhello\n\n",
+		},
+		"batch check buffered": {
+			args:  []string{"--batch-check=%(objectname)", "--buffer"},
+			input: fmt.Sprintf("%x\n%x\n", tree, blob),
+			want:  fmt.Sprintf("%x\n%x\n", tree, blob),
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := cmdCatFile(strings.NewReader(tc.input), &out, tc.args); err != nil {
+				t.Fatalf("cat-file: %s", err)
+			}
+			if out.String() != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, out.String())
+			}
+		})
+	}
+
+	if err := cmdCatFile(strings.NewReader(""), ioutil.Discard, []string{"--batch", "--batch-check"}); err == nil {
+		t.Fatal("want usage error for two batch modes")
+	}
+}
+
+func TestConfigSet(t *testing.T) {
+	repo := newTestRepository(t)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %s", err)
+	}
+	if err := os.Chdir(repo.workdir); err != nil {
+		t.Fatalf("chdir: %s", err)
+	}
+	defer os.Chdir(wd)
+
+	if err := cmdConfig(nil, ioutil.Discard, []string{"user.name", "Bob R"}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := cmdConfig(nil, ioutil.Discard, []string{"--type=bool", "core.bare", "no"}); err != nil {
+		t.Fatalf("set bool: %s", err)
+	}
+	for name, want := range map[string]string{"user.name": "Bob R\n", "core.bare": "false\n"} {
+		var out bytes.Buffer
+		if err := cmdConfig(nil, &out, []string{name}); err != nil {
+			t.Fatalf("get %s: %s", name, err)
+		}
+		if out.String() != want {
+			t.Fatalf("want %s %q, got %q", name, want, out.String())
+		}
+	}
+	if err := cmdConfig(nil, ioutil.Discard, []string{"--type=int", "core.compression", "high"}); err == nil {
+		t.Fatal("want invalid int error")
+	}
+}
+
+func TestPathspecFromSubdirectory(t *testing.T) {
+	repo := newTestRepository(t)
+	for _, name := range []string{"sub/n.go", "src/sub/n.go", "src/sub/m.go", "src/c.go"} {
+		path := filepath.Join(repo.workdir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %s", err)
+	}
+	if err := os.Chdir(filepath.Join(repo.workdir, "src")); err != nil {
+		t.Fatalf("chdir: %s", err)
+	}
+	defer os.Chdir(wd)
+
+	if err := cmdAdd(nil, ioutil.Discard, []string{"sub/n.go", ":/sub", ":(top)src/c.go"}); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	var out bytes.Buffer
+	if err := cmdLsFiles(nil, &out, []string{"--", "sub"}); err != nil {
+		t.Fatalf("ls-files: %s", err)
+	}
+	if want := "src/sub/n.go\n"; out.String() != want {
+		t.Fatalf("want %q, got %q", want, out.String())
+	}
+	out.Reset()
+	if err := cmdLsFiles(nil, &out, []string{":/"}); err != nil {
+		t.Fatalf("ls-files: %s", err)
+	}
+	if want := "src/c.go\nsrc/sub/n.go\nsub/n.go\n"; out.String() != want {
+		t.Fatalf("want %q, got %q", want, out.String())
+	}
+	if err := cmdAdd(nil, ioutil.Discard, []string{"../../outside"}); err == nil {
+		t.Fatal("want error for a path outside of the repository")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// WriteIndexTree writes the tree of the staged files and returns its hash.
+// It fails if the index has unmerged entries.
+func (r *Repository) WriteIndexTree(idx *Index) ([]byte, error) {
+	tb := NewTreeBuilder(r, nil)
+	for _, e := range idx.Entries {
+		if e.Stage != 0 {
+			return nil, fmt.Errorf("%s: unmerged path, resolve the conflict first", e.Path)
+		}
+		if e.IntentToAdd {
+			// Only marked to be added, there is no content yet.
+			continue
+		}
+		if err := tb.Insert(e.Path, e.Mode, e.Sha); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Path, err)
+		}
+	}
+	return tb.Write()
+}
+
+// CreateCommit writes a commit of the tree with given parents and message,
+// and returns its hash. The committer is the current user, and so is the
+// author if it is nil, unless the GIT_COMMITTER_* and GIT_AUTHOR_*
+// environment variables override them. The message is in the commit
+// encoding, which is recorded in the commit unless it is UTF-8.
+func (r *Repository) CreateCommit(tree []byte, parents [][]byte, message string, author *Ident) ([]byte, error) {
+	committer, err := r.committerIdent()
+	if err != nil {
+		return nil, err
+	}
+	if author == nil {
+		if author, err = r.authorIdent(); err != nil {
+			return nil, err
+		}
+	}
+	c := CommitObject{
+		Header: map[string][]string{
+			"tree":      {hex.EncodeToString(tree)},
+			"author":    {author.String()},
+			"committer": {committer.String()},
+		},
+		Comment: message,
+	}
+	for _, p := range parents {
+		c.Header["parent"] = append(c.Header["parent"], hex.EncodeToString(p))
+	}
+	if enc := r.commitEncoding(); canonicalEncoding(enc) != encodingUTF8 {
+		c.Header["encoding"] = []string{enc}
+	}
+	raw, err := c.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.verifyNewObject("commit", raw); err != nil {
+		return nil, err
+	}
+	return r.WriteObject("commit", raw)
+}
+
+// cleanupMessage removes comment lines, trailing spaces and leading and
+// trailing blank lines of a commit message, and collapses consecutive blank
+// lines. The result is empty or ends with a new line.
+func cleanupMessage(message string, stripComments bool) string {
+	var b strings.Builder
+	blank := false
+	sc := bufio.NewScanner(strings.NewReader(message))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if stripComments && strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "" {
+			blank = b.Len() != 0
+			continue
+		}
+		if blank {
+			b.WriteByte('\n')
+			blank = false
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// headBranch returns the branch HEAD points to, or an empty name if HEAD is
+// detached. The hash is nil if the branch does not exist yet.
+func (r *Repository) headBranch() (string, []byte, error) {
+	head, err := r.Head()
+	if err != nil {
+		return "", nil, err
+	}
+	return head.Target, head.Sha, nil
+}
+
+// commitSummary returns the line describing a new commit, in the format of
+// git: the branch, whether it is the first commit, the abbreviated hash and
+// the first line of the message.
+func commitSummary(branch string, root bool, sha []byte, message string) string {
+	var b bytes.Buffer
+	b.WriteByte('[')
+	if branch == "" {
+		b.WriteString("detached HEAD")
+	} else {
+		b.WriteString(strings.TrimPrefix(branch, "refs/heads/"))
+	}
+	if root {
+		b.WriteString(" (root-commit)")
+	}
+	subject := message
+	if i := strings.IndexByte(subject, '\n'); i >= 0 {
+		subject = subject[:i]
+	}
+	fmt.Fprintf(&b, " %s] %s", hex.EncodeToString(sha)[:7], subject)
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCleanupMessage(t *testing.T) {
+	cases := map[string]struct {
+		message       string
+		stripComments bool
+		want          string
+	}{
+		"single line":      {message: "subject", want: "subject\n"},
+		"blank lines":      {message: "\n\nsubject  \n\n\n\nbody\t\n\n", want: "subject\n\nbody\n"},
+		"comments kept":    {message: "subject\n# note\n", want: "subject\n# note\n"},
+		"comments removed": {message: "subject\n# note\n\n# more\n", stripComments: true, want: "subject\n"},
+		"only comments":    {message: "# note\n", stripComments: true, want: ""},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if got := cleanupMessage(tc.message, tc.stripComments); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCreateCommit(t *testing.T) {
+	repo := newTestRepository(t)
+	var err error
+	if repo.config, err = ParseConfig(strings.NewReader("[user]\n\tname = Test\n\temail = test@example.com\n")); err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+	blob, err := repo.WriteObject("blob", []byte("content\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	idx := &Index{Version: 2, Entries: []*IndexEntry{
+		{Path: "dir/file", Mode: modeBlob, Sha: blob},
+		{Path: "new", Mode: modeBlob, Sha: blob, IntentToAdd: true},
+	}}
+	tree, err := repo.WriteIndexTree(idx)
+	if err != nil {
+		t.Fatalf("write index tree: %s", err)
+	}
+	parent := writeTestCommit(t, repo, "parent")
+	sha, err := repo.CreateCommit(tree, [][]byte{parent}, "subject\n\nbody\n", nil)
+	if err != nil {
+		t.Fatalf("create commit: %s", err)
+	}
+
+	c, err := repo.readCommit(sha)
+	if err != nil {
+		t.Fatalf("read commit: %s", err)
+	}
+	if got := c.Header["tree"]; len(got) != 1 || got[0] != hex.EncodeToString(tree) {
+		t.Errorf("want tree %x, got %v", tree, got)
+	}
+	if got := c.Header["parent"]; len(got) != 1 || got[0] != hex.EncodeToString(parent) {
+		t.Errorf("want parent %x, got %v", parent, got)
+	}
+	for _, key := range []string{"author", "committer"} {
+		if got := c.Header[key]; len(got) != 1 || !strings.HasPrefix(got[0], "Test <test@example.com> ") {
+			t.Errorf("unexpected %s %v", key, got)
+		}
+	}
+	if c.Comment != "subject\n\nbody\n" {
+		t.Errorf("unexpected message %q", c.Comment)
+	}
+	tr, err := repo.readTree(tree)
+	if err != nil {
+		t.Fatalf("read tree: %s", err)
+	}
+	if leaf, err := repo.lookupTreePath(tr, "dir/file"); err != nil || !bytes.Equal(leaf.Sha, blob) {
+		t.Errorf("want staged file in the tree, got %v", err)
+	}
+	if _, err := repo.lookupTreePath(tr, "new"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want intent to add entry left out, got %v", err)
+	}
+
+	idx.Entries[0].Stage = 2
+	if _, err := repo.WriteIndexTree(idx); err == nil {
+		t.Fatal("want error for unmerged entries")
+	}
+}
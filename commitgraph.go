@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// Commit-graph file stores parents, root trees, commit dates and generation
+// numbers of commits, so that the history can be walked without inflating
+// commit objects. It is a chunk based file with an 8 byte header: the
+// "CGPH" signature, the file version, the hash version, the chunk count and
+// the number of base graphs.
+//
+// A generation number of a commit is always greater than the generation
+// numbers of its parents. Version 1 is the topological level, stored in
+// the commit data chunk. Version 2 is the corrected commit date, the
+// commit date increased as needed to be greater than the corrected dates
+// of parents. It is stored as an offset from the commit date in the
+// generation data chunk. Generation numbers give negative ancestry answers
+// without walking down to the root commits.
+const (
+	commitGraphSignature  = "CGPH"
+	commitGraphHeaderSize = 8
+	// Commit data is the root tree hash, two parent positions and 8 bytes
+	// with the topological level and the commit date.
+	commitGraphDataSize = sha1.Size + 16
+
+	graphParentNone = 0x70000000
+	// graphExtraEdges marks the second parent position to be an index
+	// into the extra edges chunk, for commits with more than two parents.
+	graphExtraEdges = 0x80000000
+	graphLastEdge   = 0x80000000
+
+	generationV1Max = 0x3fffffff
+	// Corrected commit date offsets that do not fit in 31 bits are stored
+	// in the generation data overflow chunk, and the offset is replaced by
+	// the index of the overflow entry with the top bit set.
+	correctedDateOffsetMax      = 1<<31 - 1
+	correctedDateOffsetOverflow = 0x80000000
+)
+
+var (
+	chunkOIDFanout          = chunkID("OIDF")
+	chunkOIDLookup          = chunkID("OIDL")
+	chunkCommitData         = chunkID("CDAT")
+	chunkGenerationData     = chunkID("GDA2")
+	chunkGenerationOverflow = chunkID("GDO2")
+	chunkExtraEdges         = chunkID("EDGE")
+)
+
+// commitGraph is a parsed commit-graph file.
+type commitGraph struct {
+	count  int
+	fanout []byte
+	oids   []byte
+	data   []byte
+	// generations and overflows are nil for graphs with only version 1
+	// generation numbers.
+	generations []byte
+	overflows   []byte
+	// bloomIndex and bloomData are the changed-path filters, nil if the
+	// graph has none.
+	bloomIndex []byte
+	bloomData  []byte
+}
+
+// parseCommitGraph parses the content of a commit-graph file, including the
+// trailing checksum. Graphs that depend on base graphs are not supported.
+func parseCommitGraph(raw []byte) (*commitGraph, error) {
+	if len(raw) < commitGraphHeaderSize+sha1.Size {
+		return nil, errors.New("commit-graph file is too small")
+	}
+	if string(raw[:4]) != commitGraphSignature {
+		return nil, fmt.Errorf("invalid commit-graph signature %q", raw[:4])
+	}
+	if raw[4] != 1 {
+		return nil, fmt.Errorf("unsupported commit-graph version %d", raw[4])
+	}
+	if raw[5] != 1 {
+		return nil, fmt.Errorf("unsupported commit-graph hash version %d", raw[5])
+	}
+	if raw[7] != 0 {
+		return nil, errors.New("commit-graph chains are not supported")
+	}
+	data := raw[:len(raw)-sha1.Size]
+	if sum := sha1.Sum(data); !bytes.Equal(sum[:], raw[len(data):]) {
+		return nil, errors.New("commit-graph checksum mismatch")
+	}
+	f, err := parseChunkFile(data, commitGraphHeaderSize, int(raw[6]))
+	if err != nil {
+		return nil, err
+	}
+
+	g := &commitGraph{}
+	if g.fanout, err = f.chunkRecords(chunkOIDFanout, 4, 256); err != nil {
+		return nil, err
+	}
+	prev := uint32(0)
+	for i := 0; i < 256; i++ {
+		n := binary.BigEndian.Uint32(g.fanout[4*i:])
+		if n < prev {
+			return nil, errors.New("commit-graph fanout is not monotonic")
+		}
+		prev = n
+	}
+	g.count = int(prev)
+	if g.oids, err = f.chunkRecords(chunkOIDLookup, sha1.Size, g.count); err != nil {
+		return nil, err
+	}
+	if g.data, err = f.chunkRecords(chunkCommitData, commitGraphDataSize, g.count); err != nil {
+		return nil, err
+	}
+	if _, ok := f.chunk(chunkGenerationData); ok {
+		if g.generations, err = f.chunkRecords(chunkGenerationData, 4, g.count); err != nil {
+			return nil, err
+		}
+		g.overflows, _ = f.chunk(chunkGenerationOverflow)
+		if len(g.overflows)%8 != 0 {
+			return nil, fmt.Errorf("chunk %s: invalid size %d", chunkName(chunkGenerationOverflow), len(g.overflows))
+		}
+	}
+	index, okIndex := f.chunk(chunkBloomIndex)
+	data, okData := f.chunk(chunkBloomData)
+	if okIndex && okData {
+		if g.bloomIndex, g.bloomData, err = parseBloomChunks(index, data, g.count); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// lookup returns the position of a commit in the graph.
+func (g *commitGraph) lookup(sha []byte) (int, bool) {
+	if len(sha) != sha1.Size {
+		return 0, false
+	}
+	lo := 0
+	if sha[0] != 0 {
+		lo = int(binary.BigEndian.Uint32(g.fanout[4*(int(sha[0])-1):]))
+	}
+	hi := int(binary.BigEndian.Uint32(g.fanout[4*int(sha[0]):]))
+	if lo > hi || hi > g.count {
+		return 0, false
+	}
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(g.oids[(lo+i)*sha1.Size:(lo+i+1)*sha1.Size], sha) >= 0
+	})
+	if i < hi && bytes.Equal(g.oids[i*sha1.Size:(i+1)*sha1.Size], sha) {
+		return i, true
+	}
+	return 0, false
+}
+
+// generation returns the generation number of the commit at given
+// position. Corrected commit dates are used when the graph has them,
+// topological levels otherwise. The two must never be compared with each
+// other.
+func (g *commitGraph) generation(pos int) (uint64, bool) {
+	cdat := g.data[pos*commitGraphDataSize+sha1.Size+8:]
+	high, low := binary.BigEndian.Uint32(cdat), binary.BigEndian.Uint32(cdat[4:])
+	if g.generations == nil {
+		return uint64(high >> 2), true
+	}
+	date := uint64(high&3)<<32 | uint64(low)
+	offset := uint64(binary.BigEndian.Uint32(g.generations[4*pos:]))
+	if offset&correctedDateOffsetOverflow != 0 {
+		i := int(offset ^ correctedDateOffsetOverflow)
+		if 8*(i+1) > len(g.overflows) {
+			return 0, false
+		}
+		offset = binary.BigEndian.Uint64(g.overflows[8*i:])
+	}
+	return date + offset, true
+}
+
+// commitGraphPath returns the path of the commit-graph file.
+func (r *Repository) commitGraphPath() string {
+	return path.Join(r.objdir, "info", "commit-graph")
+}
+
+// loadCommitGraph returns the commit-graph of the repository, or nil if
+// there is none or if it cannot be used. A broken graph is ignored, same
+// as in git, because all the information it holds can be read from the
+// commits.
+func (r *Repository) loadCommitGraph() *commitGraph {
+	if r.graphLoaded {
+		return r.graph
+	}
+	r.graphLoaded = true
+	if ok, err := r.config.Bool("core", "", "commitGraph", true); err != nil || !ok {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(r.commitGraphPath())
+	if err != nil {
+		return nil
+	}
+	g, err := parseCommitGraph(raw)
+	if err != nil {
+		return nil
+	}
+	if ok, err := r.config.Bool("commitGraph", "", "readChangedPaths", true); err != nil || !ok {
+		g.bloomIndex, g.bloomData = nil, nil
+	}
+	r.graph = g
+	return r.graph
+}
+
+// commitGeneration returns the generation number of a commit, if it is
+// stored in the commit-graph.
+func (r *Repository) commitGeneration(sha []byte) (uint64, bool) {
+	g := r.loadCommitGraph()
+	if g == nil {
+		return 0, false
+	}
+	pos, ok := g.lookup(sha)
+	if !ok {
+		return 0, false
+	}
+	return g.generation(pos)
+}
+
+// graphCommit is a commit being written to a commit-graph.
+type graphCommit struct {
+	sha     []byte
+	tree    []byte
+	parents [][]byte
+	date    uint64
+	// level is the topological level and corrected the corrected commit
+	// date, both zero until computed.
+	level     uint64
+	corrected uint64
+}
+
+// WriteCommitGraph writes the commit-graph file with all commits reachable
+// from the tips, replacing the existing one. Corrected commit dates are
+// written unless commitGraph.generationVersion is set to 1. Changed-path
+// Bloom filters are computed and written if changedPaths is set.
+func (r *Repository) WriteCommitGraph(tips [][]byte, changedPaths bool) error {
+	version, err := r.config.Int("commitGraph", "", "generationVersion", 2)
+	if err != nil {
+		return fmt.Errorf("commitGraph.generationVersion: %w", err)
+	}
+
+	commits := make(map[string]*graphCommit)
+	stack := append([][]byte(nil), tips...)
+	for len(stack) != 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := commits[string(sha)]; ok {
+			continue
+		}
+		c, err := r.readWalkedCommit(sha)
+		if err != nil {
+			return err
+		}
+		gc := &graphCommit{sha: sha, parents: c.Parents}
+		if tree := c.Commit.Header["tree"]; len(tree) != 0 {
+			gc.tree, _ = hex.DecodeString(tree[0])
+		}
+		if len(gc.tree) != sha1.Size {
+			return fmt.Errorf("commit %x: invalid tree", sha)
+		}
+		if c.Committer != nil && c.Committer.When.Unix() > 0 {
+			gc.date = uint64(c.Committer.When.Unix())
+		}
+		commits[string(sha)] = gc
+		stack = append(stack, c.Parents...)
+	}
+
+	// Parents are computed before children, without recursion so that long
+	// histories do not exhaust the stack.
+	for _, gc := range commits {
+		stack := []*graphCommit{gc}
+		for len(stack) != 0 {
+			c := stack[len(stack)-1]
+			if c.level != 0 {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			level, corrected, ready := uint64(0), c.date, true
+			for _, sha := range c.parents {
+				p := commits[string(sha)]
+				if p.level == 0 {
+					stack = append(stack, p)
+					ready = false
+					continue
+				}
+				if p.level > level {
+					level = p.level
+				}
+				if p.corrected >= corrected {
+					corrected = p.corrected + 1
+				}
+			}
+			if ready {
+				c.level = level + 1
+				if c.level > generationV1Max {
+					c.level = generationV1Max
+				}
+				c.corrected = corrected
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	sorted := make([]*graphCommit, 0, len(commits))
+	for _, c := range commits {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].sha, sorted[j].sha) < 0 })
+	position := make(map[string]uint32, len(sorted))
+	for i, c := range sorted {
+		position[string(c.sha)] = uint32(i)
+	}
+
+	var fanout, oids, data, generations, overflows, edges, bloomIndex, bloomData bytes.Buffer
+	var counts [256]uint32
+	for _, c := range sorted {
+		counts[c.sha[0]]++
+	}
+	total := uint32(0)
+	for _, n := range counts {
+		total += n
+		binary.Write(&fanout, binary.BigEndian, total)
+	}
+	for _, c := range sorted {
+		oids.Write(c.sha)
+
+		data.Write(c.tree)
+		parent1, parent2 := uint32(graphParentNone), uint32(graphParentNone)
+		if len(c.parents) > 0 {
+			parent1 = position[string(c.parents[0])]
+		}
+		switch {
+		case len(c.parents) == 2:
+			parent2 = position[string(c.parents[1])]
+		case len(c.parents) > 2:
+			parent2 = graphExtraEdges | uint32(edges.Len()/4)
+			for i, sha := range c.parents[1:] {
+				edge := position[string(sha)]
+				if i == len(c.parents)-2 {
+					edge |= graphLastEdge
+				}
+				binary.Write(&edges, binary.BigEndian, edge)
+			}
+		}
+		binary.Write(&data, binary.BigEndian, parent1)
+		binary.Write(&data, binary.BigEndian, parent2)
+		binary.Write(&data, binary.BigEndian, uint32(c.level<<2)|uint32(c.date>>32&3))
+		binary.Write(&data, binary.BigEndian, uint32(c.date))
+
+		offset := c.corrected - c.date
+		if offset > correctedDateOffsetMax {
+			binary.Write(&generations, binary.BigEndian, uint32(correctedDateOffsetOverflow|overflows.Len()/8))
+			binary.Write(&overflows, binary.BigEndian, offset)
+		} else {
+			binary.Write(&generations, binary.BigEndian, uint32(offset))
+		}
+
+		if changedPaths {
+			var parent []byte
+			if len(c.parents) != 0 {
+				parent = commits[string(c.parents[0])].tree
+			}
+			f, err := r.changedPathsFilter(c.tree, parent)
+			if err != nil {
+				return fmt.Errorf("commit %x: changed paths: %w", c.sha, err)
+			}
+			bloomData.Write(f)
+			binary.Write(&bloomIndex, binary.BigEndian, uint32(bloomData.Len()))
+		}
+	}
+
+	var w chunkWriter
+	w.add(chunkOIDFanout, fanout.Bytes())
+	w.add(chunkOIDLookup, oids.Bytes())
+	w.add(chunkCommitData, data.Bytes())
+	if version >= 2 {
+		w.add(chunkGenerationData, generations.Bytes())
+		if overflows.Len() != 0 {
+			w.add(chunkGenerationOverflow, overflows.Bytes())
+		}
+	}
+	if edges.Len() != 0 {
+		w.add(chunkExtraEdges, edges.Bytes())
+	}
+	if changedPaths {
+		header := make([]byte, bloomHeaderSize)
+		binary.BigEndian.PutUint32(header, bloomHashVersion)
+		binary.BigEndian.PutUint32(header[4:], bloomNumHashes)
+		binary.BigEndian.PutUint32(header[8:], bloomBitsPerEntry)
+		w.add(chunkBloomIndex, bloomIndex.Bytes())
+		w.add(chunkBloomData, append(header, bloomData.Bytes()...))
+	}
+
+	var b bytes.Buffer
+	b.WriteString(commitGraphSignature)
+	b.Write([]byte{1, 1, byte(len(w.ids)), 0})
+	if _, err := w.writeTo(&b, commitGraphHeaderSize); err != nil {
+		return err
+	}
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+
+	dest := r.commitGraphPath()
+	if err := os.MkdirAll(path.Dir(dest), newDirPerm); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+	lock := dest + ".lock"
+	if err := writeLockFile(r.gitdir, lock, b.Bytes(), r.fsyncEnabled(fsyncCommitGraph)); err != nil {
+		return fmt.Errorf("write commit-graph: %w", err)
+	}
+	if err := commitLock(lock, dest); err != nil {
+		return fmt.Errorf("rename commit-graph: %w", err)
+	}
+	r.graph, r.graphLoaded = nil, false
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseCommitGraphGit(t *testing.T) {
+	compressed, err := base64.StdEncoding.DecodeString(gitCommitGraph)
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("gzip: %s", err)
+	}
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("gzip: %s", err)
+	}
+	g, err := parseCommitGraph(raw)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if g.count != 2 {
+		t.Fatalf("want 2 commits, got %d", g.count)
+	}
+	// Both commits have the same date, so the corrected date of the child
+	// is one second later.
+	for i, want := range []uint64{1600000000, 1600000001} {
+		pos, ok := g.lookup(g.oids[i*20 : (i+1)*20])
+		if !ok || pos != i {
+			t.Fatalf("commit %d: lookup returned %d, %v", i, pos, ok)
+		}
+		if got, _ := g.generation(pos); got != want {
+			t.Fatalf("commit %d: want generation %d, got %d", i, want, got)
+		}
+	}
+	if _, ok := g.lookup(make([]byte, 20)); ok {
+		t.Fatal("unexpected commit found")
+	}
+
+	raw[len(raw)-1] ^= 0xff
+	if _, err := parseCommitGraph(raw); err == nil {
+		t.Fatal("want checksum error")
+	}
+}
+
+func TestWriteCommitGraph(t *testing.T) {
+	repo := newTestRepository(t)
+	var err error
+	base := writeTestCommit(t, repo, "base")
+	trunk := writeTestCommit(t, repo, "trunk", base)
+	side := writeTestCommit(t, repo, "side", base)
+	third := writeTestCommit(t, repo, "third", base)
+	octopus := writeTestCommit(t, repo, "octopus", trunk, side, third)
+	top := writeTestCommit(t, repo, "top", octopus)
+
+	cases := map[string]struct {
+		config string
+		// want is the generation of base, trunk, octopus and top.
+		want []uint64
+	}{
+		"corrected commit dates": {
+			config: "",
+			want:   []uint64{1600000000, 1600000001, 1600000002, 1600000003},
+		},
+		"topological levels": {
+			config: "[commitGraph]\ngenerationVersion = 1\n",
+			want:   []uint64{1, 2, 3, 4},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if repo.config, err = ParseConfig(strings.NewReader(tc.config)); err != nil {
+				t.Fatalf("parse config: %s", err)
+			}
+			if err := repo.WriteCommitGraph([][]byte{top}, false); err != nil {
+				t.Fatalf("write: %s", err)
+			}
+			for i, sha := range [][]byte{base, trunk, octopus, top} {
+				gen, ok := repo.commitGeneration(sha)
+				if !ok {
+					t.Fatalf("commit %x: not in the graph", sha)
+				}
+				if gen != tc.want[i] {
+					t.Fatalf("commit %x: want generation %d, got %d", sha, tc.want[i], gen)
+				}
+			}
+		})
+	}
+
+	// Commits written after the graph are walked without a generation.
+	after := writeTestCommit(t, repo, "after", side)
+	ancestry := map[string]struct {
+		a, b []byte
+		want bool
+	}{
+		"ancestor":                  {a: base, b: top, want: true},
+		"octopus parent":            {a: third, b: top, want: true},
+		"newer":                     {a: top, b: base, want: false},
+		"same generation":           {a: trunk, b: side, want: false},
+		"not in the graph":          {a: after, b: top, want: false},
+		"ancestor of a new commit":  {a: side, b: after, want: true},
+		"unrelated to a new commit": {a: trunk, b: after, want: false},
+	}
+	for testName, tc := range ancestry {
+		t.Run(testName, func(t *testing.T) {
+			got, err := repo.IsAncestor(tc.a, tc.b)
+			if err != nil {
+				t.Fatalf("is ancestor: %s", err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkIsAncestor(b *testing.B) {
+	shape := defaultFixtureShape
+	shape.Commits = 500
+	f := buildFixture(b, shape)
+	master := f.Branches["refs/heads/master"]
+	var tips [][]byte
+	for _, sha := range f.Branches {
+		tips = append(tips, sha)
+	}
+
+	bench := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if ok, err := f.Repo.IsAncestor(f.Commits[0], master); err != nil || !ok {
+				b.Fatalf("is ancestor: %v, %v", ok, err)
+			}
+		}
+	}
+	b.Run("without graph", bench)
+	if err := f.Repo.WriteCommitGraph(tips, false); err != nil {
+		b.Fatalf("write commit graph: %s", err)
+	}
+	b.Run("with graph", bench)
+}
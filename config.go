@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config is a parsed git configuration file, for example .git/config or
+// .gitmodules. Section and key names are case insensitive, subsection names
+// are case sensitive.
+type Config struct {
+	Entries []*ConfigEntry
+}
+
+// ConfigEntry is a single variable. Variables declared without a value
+// (a shorthand for true) have NoValue set.
+type ConfigEntry struct {
+	Section    string
+	Subsection string
+	Key        string
+	Value      string
+	NoValue    bool
+}
+
+// Name returns the fully qualified name of the variable, for example
+// "remote.origin.url".
+func (e *ConfigEntry) Name() string {
+	if e.Subsection == "" {
+		return e.Section + "." + e.Key
+	}
+	return e.Section + "." + e.Subsection + "." + e.Key
+}
+
+// ReadConfigFile parses configuration file at given path. A file that does
+// not exist is read as an empty configuration.
+func ReadConfigFile(path string) (*Config, error) {
+	raw, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	c, err := ParseConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// configFile is a configuration file read by loadConfig, with the scope of
+// its variables: "global", "local" or "worktree".
+type configFile struct {
+	Scope string
+	Path  string
+}
+
+// configFiles returns the files read by loadConfig, lowest precedence first.
+// Only the global files are returned if gitdir is empty.
+func configFiles(gitdir string) []configFile {
+	var files []configFile
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		files = append(files, configFile{Scope: "global", Path: filepath.Join(xdg, "git", "config")})
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, configFile{Scope: "global", Path: filepath.Join(home, ".config", "git", "config")})
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, configFile{Scope: "global", Path: filepath.Join(home, ".gitconfig")})
+	}
+	if gitdir != "" {
+		files = append(files, configFile{Scope: "local", Path: filepath.Join(gitdir, "config")})
+		// An invalid format is reported when the repository is opened.
+		if format, err := readRepositoryFormat(gitdir); err == nil && format.WorktreeConfig() {
+			files = append(files, configFile{Scope: "worktree", Path: filepath.Join(gitdir, "config.worktree")})
+		}
+	}
+	return files
+}
+
+// loadConfig reads the global configuration of the user followed by the
+// configuration of the repository, so that repository values take
+// precedence. Only the global configuration is read if gitdir is empty.
+func loadConfig(gitdir string) (*Config, error) {
+	var merged Config
+	for _, file := range configFiles(gitdir) {
+		c, err := ReadConfigFile(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		merged.Entries = append(merged.Entries, c.Entries...)
+	}
+	return &merged, nil
+}
+
+// globalConfigPath returns the global configuration file that is written to:
+// ~/.gitconfig, unless only the XDG configuration file exists.
+func globalConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(home, ".gitconfig")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" {
+		xdg = filepath.Join(home, ".config")
+	}
+	if _, err := os.Stat(filepath.Join(xdg, "git", "config")); err == nil {
+		return filepath.Join(xdg, "git", "config"), nil
+	}
+	return path, nil
+}
+
+// ParseConfig parses git configuration file format.
+func ParseConfig(r io.Reader) (*Config, error) {
+	var (
+		c          Config
+		section    string
+		subsection string
+		lineNo     int
+	)
+	rd := bufio.NewReader(r)
+	for {
+		line, err := readConfigLine(rd, &lineNo)
+		if errors.Is(err, io.EOF) {
+			return &c, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("line %d: unterminated section", lineNo)
+			}
+			section, subsection, err = parseConfigSection(line[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			line = strings.TrimSpace(line[end+1:])
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: variable outside of a section", lineNo)
+		}
+		entry := ConfigEntry{Section: section, Subsection: subsection}
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			entry.Key = strings.ToLower(strings.TrimSpace(stripConfigComment(line)))
+			entry.NoValue = true
+		} else {
+			entry.Key = strings.ToLower(strings.TrimSpace(line[:eq]))
+			value, err := parseConfigValue(line[eq+1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			entry.Value = value
+		}
+		if !validConfigKey(entry.Key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", lineNo, entry.Key)
+		}
+		c.Entries = append(c.Entries, &entry)
+	}
+}
+
+// readConfigLine reads a single logical line, joining lines that end with
+// a backslash.
+func readConfigLine(rd *bufio.Reader, lineNo *int) (string, error) {
+	var b strings.Builder
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			if b.Len() != 0 {
+				return b.String(), nil
+			}
+			return "", err
+		}
+		*lineNo++
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+			b.WriteString(line[:len(line)-1])
+			continue
+		}
+		b.WriteString(line)
+		return b.String(), nil
+	}
+}
+
+func parseConfigSection(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	sp := strings.IndexByte(s, ' ')
+	if sp == -1 {
+		// Deprecated [section.subsection] syntax.
+		if dot := strings.IndexByte(s, '.'); dot != -1 {
+			return strings.ToLower(s[:dot]), s[dot+1:], nil
+		}
+		if !validConfigKey(strings.ToLower(s)) {
+			return "", "", fmt.Errorf("invalid section %q", s)
+		}
+		return strings.ToLower(s), "", nil
+	}
+	sub := strings.TrimSpace(s[sp+1:])
+	if len(sub) < 2 || sub[0] != '"' || sub[len(sub)-1] != '"' {
+		return "", "", fmt.Errorf("invalid subsection %q", sub)
+	}
+	var b strings.Builder
+	for i := 1; i < len(sub)-1; i++ {
+		if sub[i] == '\\' && i+1 < len(sub)-1 {
+			i++
+		}
+		b.WriteByte(sub[i])
+	}
+	return strings.ToLower(s[:sp]), b.String(), nil
+}
+
+func stripConfigComment(s string) string {
+	if i := strings.IndexAny(s, "#;"); i != -1 {
+		return s[:i]
+	}
+	return s
+}
+
+// parseConfigValue unquotes the value, handles escape sequences and strips
+// trailing comments.
+func parseConfigValue(s string) (string, error) {
+	var (
+		b       strings.Builder
+		quoted  bool
+		pending strings.Builder // Whitespace that is kept only if followed by a value.
+	)
+	s = strings.TrimLeft(s, " \t")
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case !quoted && (c == ' ' || c == '\t'):
+			pending.WriteByte(c)
+			continue
+		case !quoted && (c == '#' || c == ';'):
+			return b.String(), nil
+		}
+		b.WriteString(pending.String())
+		pending.Reset()
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", errors.New("unfinished escape sequence")
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case '\\', '"':
+				b.WriteByte(s[i])
+			default:
+				return "", fmt.Errorf("invalid escape sequence \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quoted {
+		return "", errors.New("unterminated quote")
+	}
+	return b.String(), nil
+}
+
+func validConfigKey(key string) bool {
+	if key == "" || !(key[0] >= 'a' && key[0] <= 'z') {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns all entries matching given section, subsection and key.
+func (c *Config) lookup(section, subsection, key string) []*ConfigEntry {
+	if c == nil {
+		return nil
+	}
+	section = strings.ToLower(section)
+	key = strings.ToLower(key)
+	var found []*ConfigEntry
+	for _, e := range c.Entries {
+		if e.Section == section && e.Subsection == subsection && e.Key == key {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// Get returns the last value of the variable. Second returned value is false
+// if the variable is not set.
+func (c *Config) Get(section, subsection, key string) (string, bool) {
+	found := c.lookup(section, subsection, key)
+	if len(found) == 0 {
+		return "", false
+	}
+	return found[len(found)-1].Value, true
+}
+
+// GetAll returns all values of a multivar in the order of declaration.
+func (c *Config) GetAll(section, subsection, key string) []string {
+	var values []string
+	for _, e := range c.lookup(section, subsection, key) {
+		values = append(values, e.Value)
+	}
+	return values
+}
+
+// Bool returns the variable value interpreted as a boolean. Default value is
+// returned if the variable is not set.
+func (c *Config) Bool(section, subsection, key string, def bool) (bool, error) {
+	found := c.lookup(section, subsection, key)
+	if len(found) == 0 {
+		return def, nil
+	}
+	e := found[len(found)-1]
+	if e.NoValue {
+		return true, nil
+	}
+	b, err := parseConfigBool(e.Value)
+	if err != nil {
+		return def, fmt.Errorf("%s: %w", e.Name(), err)
+	}
+	return b, nil
+}
+
+func parseConfigBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0", "":
+		return false, nil
+	}
+	// Any integer is a boolean as well.
+	if n, err := parseConfigInt(s); err == nil {
+		return n != 0, nil
+	}
+	return false, fmt.Errorf("invalid boolean value %q", s)
+}
+
+// Int returns the variable value interpreted as an integer, with an optional
+// k, m or g unit suffix. Default value is returned if the variable is not
+// set.
+func (c *Config) Int(section, subsection, key string, def int64) (int64, error) {
+	value, ok := c.Get(section, subsection, key)
+	if !ok {
+		return def, nil
+	}
+	n, err := parseConfigInt(value)
+	if err != nil {
+		return def, fmt.Errorf("%s.%s: %w", section, key, err)
+	}
+	return n, nil
+}
+
+// Path returns the variable value interpreted as a path, with a leading ~/
+// or ~user/ expanded to the home directory. Second returned value is false if
+// the variable is not set.
+func (c *Config) Path(section, subsection, key string) (string, bool, error) {
+	value, ok := c.Get(section, subsection, key)
+	if !ok {
+		return "", false, nil
+	}
+	path, err := expandConfigPath(value)
+	if err != nil {
+		return "", false, fmt.Errorf("%s.%s: %w", section, key, err)
+	}
+	return path, true, nil
+}
+
+func expandConfigPath(path string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	name, rest := path[1:], ""
+	if slash := strings.IndexByte(name, '/'); slash >= 0 {
+		name, rest = name[:slash], name[slash+1:]
+	}
+	var home string
+	if name == "" {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		home = dir
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		home = u.HomeDir
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// formatConfigValue returns the value of the entry converted to the type:
+// "bool", "int", "bool-or-int" or "path". Any other type returns the value
+// as it is.
+func formatConfigValue(e *ConfigEntry, kind string) (string, error) {
+	var err error
+	value := e.Value
+	switch kind {
+	case "bool":
+		b := true
+		if !e.NoValue {
+			b, err = parseConfigBool(value)
+		}
+		value = strconv.FormatBool(b)
+	case "int":
+		var n int64
+		n, err = parseConfigInt(value)
+		value = strconv.FormatInt(n, 10)
+	case "bool-or-int":
+		if n, ierr := parseConfigInt(value); ierr == nil && !e.NoValue {
+			value = strconv.FormatInt(n, 10)
+			break
+		}
+		b := true
+		if !e.NoValue {
+			b, err = parseConfigBool(value)
+		}
+		value = strconv.FormatBool(b)
+	case "path":
+		value, err = expandConfigPath(value)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", e.Name(), err)
+	}
+	return value, nil
+}
+
+func parseConfigInt(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	var unit int64 = 1
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			unit = 1 << 10
+		case 'm', 'M':
+			unit = 1 << 20
+		case 'g', 'G':
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer value %q", s)
+	}
+	return n * unit, nil
+}
+
+// Subsections returns names of all subsections of given section, in the
+// order of first appearance.
+func (c *Config) Subsections(section string) []string {
+	if c == nil {
+		return nil
+	}
+	section = strings.ToLower(section)
+	var names []string
+	seen := make(map[string]struct{})
+	for _, e := range c.Entries {
+		if e.Section != section || e.Subsection == "" {
+			continue
+		}
+		if _, ok := seen[e.Subsection]; ok {
+			continue
+		}
+		seen[e.Subsection] = struct{}{}
+		names = append(names, e.Subsection)
+	}
+	return names
+}
+
+// SetConfigValue sets the variable of the configuration file at path, the
+// same as git config <name> <value> does. A single existing value is
+// replaced in place, and a new variable is added after the last variable
+// of its section, or at the end of the file in a new section. Variables
+// with several values are not changed.
+func SetConfigValue(path, name, value string) error {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if _, err := ParseConfig(bytes.NewReader(raw)); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	lowerSection, lowerKey := strings.ToLower(section), strings.ToLower(key)
+
+	// Variables are found the same way as ParseConfig does, by logical
+	// lines, which may span several lines of the file.
+	type match struct {
+		first, last int
+		header      string
+	}
+	var (
+		matches    []match
+		insertAt   = -1
+		inSection  bool
+		lines      = strings.SplitAfter(string(raw), "\n")
+		assignment = key + " = " + quoteConfigValue(value) + "\n"
+	)
+	for i := 0; i < len(lines); i++ {
+		first := i
+		logical := strings.TrimRight(lines[i], "\r\n")
+		for strings.HasSuffix(logical, "\\") && !strings.HasSuffix(logical, "\\\\") && i+1 < len(lines) {
+			i++
+			logical = logical[:len(logical)-1] + strings.TrimRight(lines[i], "\r\n")
+		}
+		line := strings.TrimSpace(logical)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		header := ""
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			s, sub, _ := parseConfigSection(line[1:end])
+			inSection = s == lowerSection && sub == subsection
+			if inSection {
+				insertAt = i
+			}
+			header, line = line[:end+1], strings.TrimSpace(line[end+1:])
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+		}
+		if !inSection {
+			continue
+		}
+		insertAt = i
+		k := stripConfigComment(line)
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			k = line[:eq]
+		}
+		if strings.ToLower(strings.TrimSpace(k)) == lowerKey {
+			matches = append(matches, match{first: first, last: i, header: header})
+		}
+	}
+
+	var b strings.Builder
+	switch {
+	case len(matches) > 1:
+		return fmt.Errorf("%s: cannot overwrite multiple values with a single value", name)
+	case len(matches) == 1:
+		m := matches[0]
+		b.WriteString(strings.Join(lines[:m.first], ""))
+		if m.header != "" {
+			b.WriteString(m.header + " ")
+		} else {
+			b.WriteString("\t")
+		}
+		b.WriteString(assignment)
+		b.WriteString(strings.Join(lines[m.last+1:], ""))
+	case insertAt >= 0:
+		b.WriteString(strings.Join(lines[:insertAt+1], ""))
+		if !strings.HasSuffix(lines[insertAt], "\n") {
+			b.WriteString("\n")
+		}
+		b.WriteString("\t" + assignment)
+		b.WriteString(strings.Join(lines[insertAt+1:], ""))
+	default:
+		b.Write(raw)
+		if len(raw) != 0 && raw[len(raw)-1] != '\n' {
+			b.WriteString("\n")
+		}
+		if subsection == "" {
+			fmt.Fprintf(&b, "[%s]\n", section)
+		} else {
+			sub := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(subsection)
+			fmt.Fprintf(&b, "[%s \"%s\"]\n", section, sub)
+		}
+		b.WriteString("\t" + assignment)
+	}
+	return writeConfigFile(path, []byte(b.String()))
+}
+
+// splitConfigName splits a variable name into the section, the subsection
+// and the key, as they were given.
+func splitConfigName(name string) (string, string, string, error) {
+	first, last := strings.IndexByte(name, '.'), strings.LastIndexByte(name, '.')
+	if first < 0 {
+		return "", "", "", fmt.Errorf("key does not contain a section: %s", name)
+	}
+	section, key := name[:first], name[last+1:]
+	subsection := ""
+	if first != last {
+		subsection = name[first+1 : last]
+	}
+	if !validConfigKey(strings.ToLower(section)) || !validConfigKey(strings.ToLower(key)) || strings.ContainsAny(subsection, "\n\x00") {
+		return "", "", "", fmt.Errorf("invalid key: %s", name)
+	}
+	return section, subsection, key, nil
+}
+
+// quoteConfigValue returns the value in the syntax of configuration files,
+// quoted if whitespace around it or comment characters would be lost.
+func quoteConfigValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;") {
+		return `"` + b.String() + `"`
+	}
+	return b.String()
+}
+
+// writeConfigFile replaces the configuration file with the content, through
+// a lock file that is renamed over it.
+func writeConfigFile(path string, content []byte) error {
+	lock := path + ".lock"
+	if err := writeLockFile(filepath.Dir(path), lock, content, false); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	if err := commitLock(lock, path); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatConfigValue(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skipf("no home directory: %s", err)
+	}
+	config, err := ParseConfig(strings.NewReader(`
+[test]
+	flag
+	yes = On
+	size = 2k
+	zero = 0
+	dir = ~/dir
+	abs = /tmp
+	word = maybe
+`))
+	if err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+	entry := func(key string) *ConfigEntry {
+		return config.lookup("test", "", key)[0]
+	}
+
+	cases := map[string]struct {
+		key     string
+		kind    string
+		want    string
+		invalid bool
+	}{
+		"no type":             {key: "yes", want: "On"},
+		"bool without value":  {key: "flag", kind: "bool", want: "true"},
+		"bool":                {key: "yes", kind: "bool", want: "true"},
+		"bool of integer":     {key: "size", kind: "bool", want: "true"},
+		"bool of zero":        {key: "zero", kind: "bool", want: "false"},
+		"invalid bool":        {key: "word", kind: "bool", invalid: true},
+		"int":                 {key: "size", kind: "int", want: "2048"},
+		"invalid int":         {key: "yes", kind: "int", invalid: true},
+		"bool-or-int of int":  {key: "size", kind: "bool-or-int", want: "2048"},
+		"bool-or-int of bool": {key: "yes", kind: "bool-or-int", want: "true"},
+		"bool-or-int of flag": {key: "flag", kind: "bool-or-int", want: "true"},
+		"path":                {key: "dir", kind: "path", want: filepath.Join(home, "dir")},
+		"absolute path":       {key: "abs", kind: "path", want: "/tmp"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := formatConfigValue(entry(tc.key), tc.kind)
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("want an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("format: %s", err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSetConfigValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]struct {
+		config      string
+		name, value string
+		want        string
+		wantErr     bool
+	}{
+		"new file": {
+			name:  "user.name",
+			value: "Bob",
+			want:  "[user]\n\tname = Bob\n",
+		},
+		"replace value": {
+			config: "[core]\n\tbare = false # comment\n\tfilemode = true\n",
+			name:   "core.bare",
+			value:  "true",
+			want:   "[core]\n\tbare = true\n\tfilemode = true\n",
+		},
+		"key case": {
+			config: "[Core]\n\tIgnoreCase = false\n",
+			name:   "core.ignorecase",
+			value:  "true",
+			want:   "[Core]\n\tignorecase = true\n",
+		},
+		"continued value": {
+			config: "[alias]\n\tlg = log \\\n\t--oneline\n[user]\n\tname = Bob\n",
+			name:   "alias.lg",
+			value:  "log",
+			want:   "[alias]\n\tlg = log\n[user]\n\tname = Bob\n",
+		},
+		"add to section": {
+			config: "[core]\n\tbare = false\n\n[user]\n\tname = Bob\n",
+			name:   "core.filemode",
+			value:  "true",
+			want:   "[core]\n\tbare = false\n\tfilemode = true\n\n[user]\n\tname = Bob\n",
+		},
+		"add to last section": {
+			config: "[remote \"origin\"]\n\turl = a\n[core]\n\tbare = false\n[remote \"origin\"]\n\tfetch = b",
+			name:   "remote.origin.prune",
+			value:  "true",
+			want:   "[remote \"origin\"]\n\turl = a\n[core]\n\tbare = false\n[remote \"origin\"]\n\tfetch = b\n\tprune = true\n",
+		},
+		"new subsection": {
+			config: "[remote \"origin\"]\n\turl = a\n",
+			name:   "remote.Up\"stream.url",
+			value:  " spaced # value\\",
+			want:   "[remote \"origin\"]\n\turl = a\n[remote \"Up\\\"stream\"]\n\turl = \" spaced # value\\\\\"\n",
+		},
+		"multiple values": {
+			config:  "[remote \"origin\"]\n\tfetch = a\n\tfetch = b\n",
+			name:    "remote.origin.fetch",
+			value:   "c",
+			wantErr: true,
+		},
+		"no section": {
+			name:    "name",
+			value:   "Bob",
+			wantErr: true,
+		},
+		"invalid key": {
+			name:    "user.first_name",
+			value:   "Bob",
+			wantErr: true,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(testName, " ", "-", -1))
+			if tc.config != "" {
+				if err := ioutil.WriteFile(path, []byte(tc.config), 0644); err != nil {
+					t.Fatalf("write config: %s", err)
+				}
+			}
+			err := SetConfigValue(path, tc.name, tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("set: %s", err)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read config: %s", err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("want:\n%s\ngot:\n%s", tc.want, got)
+			}
+			config, err := ReadConfigFile(path)
+			if err != nil {
+				t.Fatalf("parse written config: %s", err)
+			}
+			section, subsection, key, _ := splitConfigName(tc.name)
+			if values := config.GetAll(section, subsection, key); len(values) != 1 || values[0] != tc.value {
+				t.Fatalf("want %s = %q, got %q", tc.name, tc.value, values)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Line ending conversions, decided by the text, eol and crlf attributes
+// and the core.autocrlf and core.eol settings.
+const (
+	eolNone = iota
+	// eolText converts line endings of the content, which is text.
+	eolText
+	// eolAuto converts line endings, unless the content looks binary. When
+	// content is stored, files with CRLF line endings in the index are not
+	// converted either.
+	eolAuto
+)
+
+// eolConversion returns the line ending conversion for attributes of a path,
+// and whether LF line endings become CRLF in the worktree.
+func (r *Repository) eolConversion(attrs Attributes) (int, bool, error) {
+	autocrlf, _ := r.config.Get("core", "", "autocrlf")
+	autocrlf = strings.ToLower(autocrlf)
+	if autocrlf != "input" {
+		on, err := r.config.Bool("core", "", "autocrlf", false)
+		if err != nil {
+			return eolNone, false, err
+		}
+		autocrlf = strconv.FormatBool(on)
+	}
+	// Line endings of text without the eol attribute.
+	textCRLF := autocrlf == "true"
+	if eol, _ := r.config.Get("core", "", "eol"); autocrlf == "false" && strings.ToLower(eol) == "crlf" {
+		textCRLF = true
+	}
+
+	text, ok := attrs["text"]
+	if !ok {
+		// The crlf attribute is the deprecated form of text.
+		text = attrs["crlf"]
+	}
+	var conversion int
+	var crlf bool
+	switch text {
+	case attrUnset:
+		return eolNone, false, nil
+	case attrSet:
+		conversion, crlf = eolText, textCRLF
+	case "input":
+		conversion = eolText
+	case "auto":
+		conversion, crlf = eolAuto, textCRLF
+	default:
+		switch autocrlf {
+		case "true":
+			conversion, crlf = eolAuto, true
+		case "input":
+			conversion = eolAuto
+		}
+	}
+	switch attrs["eol"] {
+	case "lf":
+		if conversion == eolNone {
+			conversion = eolText
+		}
+		crlf = false
+	case "crlf":
+		if conversion == eolNone {
+			conversion = eolText
+		}
+		crlf = true
+	}
+	return conversion, crlf, nil
+}
+
+// eolAttrDescription describes the line ending conversion requested by the
+// attributes alone, the way ls-files --eol shows it.
+func eolAttrDescription(attrs Attributes) string {
+	text, ok := attrs["text"]
+	if !ok {
+		text = attrs["crlf"]
+	}
+	var desc string
+	switch text {
+	case attrUnset:
+		return "-text"
+	case attrSet:
+		desc = "text"
+	case "input":
+		desc = "text eol=lf"
+	case "auto":
+		desc = "text=auto"
+	}
+	switch eol := attrs["eol"]; {
+	case eol != "lf" && eol != "crlf":
+		// Not specified, or not valid.
+	case desc == "text=auto":
+		desc += " eol=" + eol
+	default:
+		desc = "text eol=" + eol
+	}
+	return desc
+}
+
+// textStats are counts of characters that tell apart text from binary
+// content, as gathered by git.
+type textStats struct {
+	nul, lonecr, lonelf, crlf int
+	printable, nonprintable   int
+}
+
+func gatherTextStats(content []byte) textStats {
+	var s textStats
+	for i, c := range content {
+		switch {
+		case c == '\r':
+			if i+1 < len(content) && content[i+1] == '\n' {
+				s.crlf++
+			} else {
+				s.lonecr++
+			}
+		case c == '\n':
+			if i == 0 || content[i-1] != '\r' {
+				s.lonelf++
+			}
+		case c == 127:
+			s.nonprintable++
+		case c < 32:
+			switch c {
+			case '\b', '\t', '\033', '\014':
+				s.printable++
+			case 0:
+				s.nul++
+				s.nonprintable++
+			default:
+				s.nonprintable++
+			}
+		default:
+			s.printable++
+		}
+	}
+	// DOS text files can end with ^Z.
+	if len(content) != 0 && content[len(content)-1] == '\032' {
+		s.nonprintable--
+	}
+	return s
+}
+
+func (s textStats) binary() bool {
+	return s.lonecr > 0 || s.nul > 0 || (s.printable>>7) < s.nonprintable
+}
+
+// eolDescription classifies line endings of the content, the way ls-files
+// --eol shows it: "-text" for binary content, "lf", "crlf", "mixed" or
+// "none" for text.
+func eolDescription(content []byte) string {
+	if len(content) == 0 {
+		return "none"
+	}
+	s := gatherTextStats(content)
+	switch {
+	case s.binary():
+		return "-text"
+	case s.lonelf > 0 && s.crlf > 0:
+		return "mixed"
+	case s.lonelf > 0:
+		return "lf"
+	case s.crlf > 0:
+		return "crlf"
+	default:
+		return "none"
+	}
+}
+
+// crlfToGit replaces CRLF line endings of the content with LF. A CR that is
+// not followed by LF is kept.
+func crlfToGit(content []byte) []byte {
+	converted := make([]byte, 0, len(content))
+	for i, c := range content {
+		if c == '\r' && i+1 < len(content) && content[i+1] == '\n' {
+			continue
+		}
+		converted = append(converted, c)
+	}
+	return converted
+}
+
+// identToGit collapses expanded "$Id: ... $" keywords of the content to
+// "$Id$".
+func identToGit(content []byte) []byte {
+	var b bytes.Buffer
+	for {
+		i := bytes.Index(content, []byte("$Id:"))
+		if i < 0 {
+			break
+		}
+		end := bytes.IndexAny(content[i+4:], "$\n")
+		if end < 0 || content[i+4+end] != '$' {
+			b.Write(content[:i+4])
+			content = content[i+4:]
+			continue
+		}
+		b.Write(content[:i])
+		b.WriteString("$Id$")
+		content = content[i+4+end+1:]
+	}
+	b.Write(content)
+	return b.Bytes()
+}
+
+// runFilter runs the clean or the smudge command of the filter driver with
+// the content on its standard input. The command is run by the shell in the
+// worktree root, with %f replaced by the quoted path. A failing filter is
+// ignored, unless the driver is marked as required.
+func (r *Repository) runFilter(driver, kind, path string, content []byte) ([]byte, error) {
+	required, err := r.config.Bool("filter", driver, "required", false)
+	if err != nil {
+		return nil, err
+	}
+	command, ok := r.config.Get("filter", driver, kind)
+	if !ok || command == "" {
+		if required {
+			return nil, fmt.Errorf("%s: %s filter '%s' is not defined", path, kind, driver)
+		}
+		return content, nil
+	}
+	command = strings.Replace(command, "%f", "'"+strings.Replace(path, "'", `'\''`, -1)+"'", -1)
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = r.workdir
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if required {
+			return nil, fmt.Errorf("%s: %s filter '%s' failed: %w", path, kind, driver, err)
+		}
+		return content, nil
+	}
+	return stdout.Bytes(), nil
+}
+
+// filterDriver returns the name of the filter driver of the attributes, or an
+// empty string if there is none.
+func filterDriver(attrs Attributes) string {
+	if driver := attrs["filter"]; driver != attrSet && driver != attrUnset {
+		return driver
+	}
+	return ""
+}
+
+// convertToGit returns the content of the worktree file at path, relative to
+// the worktree root, as it is stored in the repository. The clean filter of
+// the filter attribute is applied first, followed by line ending
+// normalization and collapsing of ident keywords.
+func (r *Repository) convertToGit(attrs Attributes, path string, content []byte) ([]byte, error) {
+	if driver := filterDriver(attrs); driver != "" {
+		var err error
+		if content, err = r.runFilter(driver, "clean", path, content); err != nil {
+			return nil, err
+		}
+	}
+
+	conversion, _, err := r.eolConversion(attrs)
+	if err != nil {
+		return nil, err
+	}
+	if conversion != eolNone && bytes.IndexByte(content, '\r') >= 0 {
+		stats := gatherTextStats(content)
+		convert := stats.crlf > 0
+		if convert && conversion == eolAuto {
+			convert = !stats.binary()
+			if convert {
+				// Files committed with CRLF line endings are kept as they
+				// are, so that enabling autocrlf does not modify them.
+				if convert, err = r.indexHasCR(path); err != nil {
+					return nil, err
+				}
+				convert = !convert
+			}
+		}
+		if convert {
+			content = crlfToGit(content)
+		}
+	}
+
+	if attrs["ident"] == attrSet {
+		content = identToGit(content)
+	}
+	return content, nil
+}
+
+// indexHasCR returns true if the blob of path in the index contains a CR.
+func (r *Repository) indexHasCR(path string) (bool, error) {
+	idx, err := r.ReadIndex()
+	if err != nil {
+		return false, err
+	}
+	i, ok := idx.entry(path)
+	if !ok {
+		return false, nil
+	}
+	kind, content, err := r.ReadRawObject(idx.Entries[i].Sha)
+	if err != nil {
+		return false, fmt.Errorf("read %s from the index: %w", path, err)
+	}
+	return kind == "blob" && bytes.IndexByte(content, '\r') >= 0, nil
+}
+
+// crlfToWorktree replaces LF line endings of the content with CRLF.
+func crlfToWorktree(content []byte) []byte {
+	converted := make([]byte, 0, len(content)+bytes.Count(content, []byte("\n")))
+	for i, c := range content {
+		if c == '\n' && (i == 0 || content[i-1] != '\r') {
+			converted = append(converted, '\r')
+		}
+		converted = append(converted, c)
+	}
+	return converted
+}
+
+// identToWorktree expands "$Id$" keywords of the content, and keywords that
+// are already expanded, to "$Id: <blob hash> $".
+func identToWorktree(content []byte, sha []byte) []byte {
+	var b bytes.Buffer
+	for {
+		i := bytes.Index(content, []byte("$Id"))
+		if i < 0 || i+3 == len(content) {
+			break
+		}
+		rest := content[i+3:]
+		switch {
+		case rest[0] == '$':
+			rest = rest[1:]
+		case rest[0] == ':':
+			end := bytes.IndexAny(rest, "$\n")
+			if end < 0 || rest[end] != '$' {
+				b.Write(content[:i+3])
+				content = rest
+				continue
+			}
+			rest = rest[end+1:]
+		default:
+			b.Write(content[:i+3])
+			content = rest
+			continue
+		}
+		b.Write(content[:i])
+		fmt.Fprintf(&b, "$Id: %x $", sha)
+		content = rest
+	}
+	b.Write(content)
+	return b.Bytes()
+}
+
+// convertToWorktree returns the content of the blob with given hash as it is
+// written to the worktree at path. Ident keywords are expanded first,
+// followed by line ending conversion and the smudge filter of the filter
+// attribute.
+func (r *Repository) convertToWorktree(attrs Attributes, path string, sha, content []byte) ([]byte, error) {
+	if attrs["ident"] == attrSet {
+		content = identToWorktree(content, sha)
+	}
+
+	conversion, crlf, err := r.eolConversion(attrs)
+	if err != nil {
+		return nil, err
+	}
+	if conversion != eolNone && crlf {
+		stats := gatherTextStats(content)
+		convert := stats.lonelf > 0
+		if convert && conversion == eolAuto {
+			// Content that already has CRs is left as it is.
+			convert = stats.lonecr == 0 && stats.crlf == 0 && !stats.binary()
+		}
+		if convert {
+			content = crlfToWorktree(content)
+		}
+	}
+
+	if driver := filterDriver(attrs); driver != "" {
+		if content, err = r.runFilter(driver, "smudge", path, content); err != nil {
+			return nil, err
+		}
+	}
+	return content, nil
+}
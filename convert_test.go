@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConvertToGit(t *testing.T) {
+	repo := newTestRepository(t)
+	var err error
+
+	cases := map[string]struct {
+		config  string
+		attrs   Attributes
+		content string
+		want    string
+	}{
+		"no conversion": {
+			attrs:   Attributes{},
+			content: "a\r\nb\r\n",
+			want:    "a\r\nb\r\n",
+		},
+		"text": {
+			attrs:   Attributes{"text": attrSet},
+			content: "a\r\nb\rc\r\n",
+			want:    "a\nb\rc\n",
+		},
+		"eol implies text": {
+			attrs:   Attributes{"eol": "crlf"},
+			content: "a\r\n",
+			want:    "a\n",
+		},
+		"text unset": {
+			config:  "[core]\nautocrlf = true\n",
+			attrs:   Attributes{"text": attrUnset},
+			content: "a\r\n",
+			want:    "a\r\n",
+		},
+		"legacy crlf input": {
+			attrs:   Attributes{"crlf": "input"},
+			content: "a\r\n",
+			want:    "a\n",
+		},
+		"auto text": {
+			attrs:   Attributes{"text": "auto"},
+			content: "a\r\n",
+			want:    "a\n",
+		},
+		"auto binary": {
+			attrs:   Attributes{"text": "auto"},
+			content: "a\r\n\x00",
+			want:    "a\r\n\x00",
+		},
+		"auto lone carriage return": {
+			attrs:   Attributes{"text": "auto"},
+			content: "a\r\nb\r",
+			want:    "a\r\nb\r",
+		},
+		"autocrlf": {
+			config:  "[core]\nautocrlf = true\n",
+			attrs:   Attributes{},
+			content: "a\r\n",
+			want:    "a\n",
+		},
+		"autocrlf input": {
+			config:  "[core]\nautocrlf = input\n",
+			attrs:   Attributes{},
+			content: "a\r\n",
+			want:    "a\n",
+		},
+		"ident": {
+			attrs:   Attributes{"ident": attrSet},
+			content: "$Id: 1234 $ $Id$ $Id: broken\n$",
+			want:    "$Id$ $Id$ $Id: broken\n$",
+		},
+		"clean filter": {
+			config:  "[filter \"upper\"]\nclean = tr a-z A-Z\n",
+			attrs:   Attributes{"filter": "upper", "text": attrSet},
+			content: "abc\r\n",
+			want:    "ABC\n",
+		},
+		"clean filter path": {
+			config:  "[filter \"name\"]\nclean = echo %f\n",
+			attrs:   Attributes{"filter": "name"},
+			content: "abc\n",
+			want:    "a b.txt\n",
+		},
+		"failing filter is ignored": {
+			config:  "[filter \"fail\"]\nclean = false\n",
+			attrs:   Attributes{"filter": "fail"},
+			content: "abc\n",
+			want:    "abc\n",
+		},
+		"undefined filter is ignored": {
+			attrs:   Attributes{"filter": "undefined"},
+			content: "abc\n",
+			want:    "abc\n",
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if repo.config, err = ParseConfig(strings.NewReader(tc.config)); err != nil {
+				t.Fatalf("parse config: %s", err)
+			}
+			got, err := repo.convertToGit(tc.attrs, "a b.txt", []byte(tc.content))
+			if err != nil {
+				t.Fatalf("convert: %s", err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	repo.config, err = ParseConfig(strings.NewReader("[filter \"fail\"]\nclean = false\nrequired\n"))
+	if err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+	if _, err := repo.convertToGit(Attributes{"filter": "fail"}, "a.txt", nil); err == nil {
+		t.Fatal("required filter failure was ignored")
+	}
+}
+
+func TestEOLDescription(t *testing.T) {
+	cases := map[string]string{
+		"":         "none",
+		"abc":      "none",
+		"a\nb\n":   "lf",
+		"a\r\nb":   "crlf",
+		"a\r\nb\n": "mixed",
+		"a\rb\n":   "-text",
+		"a\x00\n":  "-text",
+	}
+	for content, want := range cases {
+		if got := eolDescription([]byte(content)); got != want {
+			t.Errorf("%q: want %q, got %q", content, want, got)
+		}
+	}
+}
+
+func TestEOLAttrDescription(t *testing.T) {
+	cases := map[string]struct {
+		attrs Attributes
+		want  string
+	}{
+		"none":          {attrs: Attributes{}, want: ""},
+		"binary":        {attrs: Attributes{"text": attrUnset, "eol": "lf"}, want: "-text"},
+		"text":          {attrs: Attributes{"text": attrSet}, want: "text"},
+		"legacy input":  {attrs: Attributes{"crlf": "input"}, want: "text eol=lf"},
+		"eol only":      {attrs: Attributes{"eol": "crlf"}, want: "text eol=crlf"},
+		"auto":          {attrs: Attributes{"text": "auto"}, want: "text=auto"},
+		"auto with eol": {attrs: Attributes{"text": "auto", "eol": "lf"}, want: "text=auto eol=lf"},
+		"invalid eol":   {attrs: Attributes{"text": attrSet, "eol": "cr"}, want: "text"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := eolAttrDescription(tc.attrs); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Credential is a set of attributes of the git credential protocol. It is
+// exchanged with credential helpers as lines of key=value pairs, terminated
+// by an empty line or the end of input.
+type Credential struct {
+	Protocol string
+	Host     string
+	Path     string
+	Username string
+	Password string
+	// Quit is set by a helper to stop asking other helpers or the user.
+	Quit bool
+}
+
+// ReadCredential parses credential attributes from the reader. A url
+// attribute sets all other attributes that are in the URL. Attributes that
+// are not known are ignored.
+func ReadCredential(r io.Reader) (*Credential, error) {
+	var c Credential
+	if err := c.read(r); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *Credential) read(r io.Reader) error {
+	rd := bufio.NewReader(r)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return nil
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return fmt.Errorf("invalid credential line: %s", line)
+		}
+		key, value := line[:eq], line[eq+1:]
+		switch key {
+		case "protocol":
+			c.Protocol = value
+		case "host":
+			c.Host = value
+		case "path":
+			c.Path = value
+		case "username":
+			c.Username = value
+		case "password":
+			c.Password = value
+		case "url":
+			if err := c.setURL(value); err != nil {
+				return err
+			}
+		case "quit":
+			c.Quit, _ = parseConfigBool(value)
+		default:
+			// Attributes of newer versions of the protocol.
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// setURL replaces the attributes with the ones described by the URL.
+func (c *Credential) setURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return fmt.Errorf("credential url cannot be parsed: %s", raw)
+	}
+	next := Credential{Protocol: u.Scheme, Host: u.Host, Path: strings.TrimPrefix(u.Path, "/")}
+	if u.User != nil {
+		next.Username = u.User.Username()
+		next.Password, _ = u.User.Password()
+	}
+	// Decoded values must not add lines when written to helpers, for
+	// example a host line for another server (CVE-2020-5260).
+	if err := next.check(); err != nil {
+		return fmt.Errorf("credential url %s: %w", raw, err)
+	}
+	*c = next
+	return nil
+}
+
+func (c *Credential) attributes() []struct{ key, value string } {
+	return []struct{ key, value string }{
+		{"protocol", c.Protocol},
+		{"host", c.Host},
+		{"path", c.Path},
+		{"username", c.Username},
+		{"password", c.Password},
+	}
+}
+
+// check returns an error if an attribute cannot be written, because it
+// contains a new line or a NUL byte.
+func (c *Credential) check() error {
+	for _, attr := range c.attributes() {
+		if strings.ContainsAny(attr.value, "\n\x00") {
+			return fmt.Errorf("credential value for %s contains a new line or NUL", attr.key)
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the attributes that are set, in the format read by
+// ReadCredential. The terminating empty line is not written. Nothing is
+// written if any of the attributes contains a new line or a NUL byte.
+func (c *Credential) WriteTo(w io.Writer) (int64, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	var b bytes.Buffer
+	for _, attr := range c.attributes() {
+		if attr.value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", attr.key, attr.value)
+		}
+	}
+	return b.WriteTo(w)
+}
+
+// String returns the URL described by the credential, without the password.
+func (c *Credential) String() string {
+	s := c.Protocol + "://"
+	if c.Username != "" {
+		var b strings.Builder
+		for i := 0; i < len(c.Username); i++ {
+			switch ch := c.Username[i]; {
+			case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9', strings.IndexByte("-_.~", ch) >= 0:
+				b.WriteByte(ch)
+			default:
+				fmt.Fprintf(&b, "%%%02X", ch)
+			}
+		}
+		s += b.String() + "@"
+	}
+	s += c.Host
+	if c.Path != "" {
+		s += "/" + c.Path
+	}
+	return s
+}
+
+// Fill completes the username and the password of the credential. Credential
+// helpers configured with credential.helper are asked first, in order, until
+// both are known. The user is asked for whatever is still missing.
+func (c *Credential) Fill(config *Config) error {
+	helpers, err := c.configure(config)
+	if err != nil {
+		return err
+	}
+	for _, helper := range helpers {
+		if err := c.runHelper(helper, "get"); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: credential helper %s: %s\n", helper, err)
+			continue
+		}
+		if c.Quit {
+			return fmt.Errorf("credential helper '%s' told us to quit", helper)
+		}
+		if c.Username != "" && c.Password != "" {
+			return nil
+		}
+	}
+
+	if c.Username == "" {
+		if c.Username, err = credentialPrompt(config, fmt.Sprintf("Username for '%s': ", c), true); err != nil {
+			return err
+		}
+	}
+	if c.Password == "" {
+		if c.Password, err = credentialPrompt(config, fmt.Sprintf("Password for '%s': ", c), false); err != nil {
+			return err
+		}
+	}
+	if c.Username == "" && c.Password == "" {
+		return errors.New("unable to get password from user")
+	}
+	return nil
+}
+
+// Approve tells credential helpers to store the credential, which was
+// accepted. Incomplete credentials are not stored.
+func (c *Credential) Approve(config *Config) error {
+	if c.Username == "" || c.Password == "" {
+		return nil
+	}
+	return c.notifyHelpers(config, "store")
+}
+
+// Reject tells credential helpers to erase the credential, which was
+// rejected.
+func (c *Credential) Reject(config *Config) error {
+	return c.notifyHelpers(config, "erase")
+}
+
+func (c *Credential) notifyHelpers(config *Config, action string) error {
+	helpers, err := c.configure(config)
+	if err != nil {
+		return err
+	}
+	for _, helper := range helpers {
+		if err := c.runHelper(helper, action); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: credential helper %s: %s\n", helper, err)
+		}
+	}
+	return nil
+}
+
+// configure applies the credential configuration that matches the
+// credential and returns its helpers. Variables in credential.<url>
+// subsections apply to credentials of URLs that match <url>. An empty helper
+// resets the list of helpers configured so far.
+func (c *Credential) configure(config *Config) ([]string, error) {
+	// A credential for any host could be given out to a helper otherwise.
+	if c.Protocol == "" {
+		return nil, errors.New("refusing to work with credential missing protocol field")
+	}
+	if c.Host == "" && c.Protocol != "file" {
+		return nil, errors.New("refusing to work with credential missing host field")
+	}
+	var helpers []string
+	useHTTPPath := false
+	for _, e := range config.Entries {
+		if e.Section != "credential" || (e.Subsection != "" && !c.matchesURL(e.Subsection)) {
+			continue
+		}
+		switch e.Key {
+		case "helper":
+			if e.Value == "" {
+				helpers = nil
+			} else {
+				helpers = append(helpers, e.Value)
+			}
+		case "username":
+			if c.Username == "" {
+				c.Username = e.Value
+			}
+		case "usehttppath":
+			on, err := parseConfigBool(e.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", e.Name(), err)
+			}
+			useHTTPPath = on || e.NoValue
+		}
+	}
+	if !useHTTPPath && (c.Protocol == "http" || c.Protocol == "https") {
+		// Credentials of HTTP remotes are shared by all paths of a host,
+		// unless configured otherwise.
+		c.Path = ""
+	}
+	return helpers, nil
+}
+
+// matchesURL returns true if the credential is for the URL pattern. The
+// host of the pattern can contain "*" in place of any single label. A path
+// of the pattern matches its subdirectories as well.
+func (c *Credential) matchesURL(pattern string) bool {
+	u, err := url.Parse(pattern)
+	if err != nil || u.Scheme == "" {
+		return false
+	}
+	if u.Scheme != c.Protocol {
+		return false
+	}
+	if u.User != nil && u.User.Username() != c.Username {
+		return false
+	}
+	labels := strings.Split(strings.ToLower(u.Host), ".")
+	hostLabels := strings.Split(strings.ToLower(c.Host), ".")
+	if len(labels) != len(hostLabels) {
+		return false
+	}
+	for i, label := range labels {
+		if ok, _ := filepath.Match(label, hostLabels[i]); !ok {
+			return false
+		}
+	}
+	prefix := strings.Trim(u.Path, "/")
+	return prefix == "" || c.Path == prefix || strings.HasPrefix(c.Path, prefix+"/")
+}
+
+// runHelper runs the credential helper with the action and the credential on
+// its standard input. The response of a get action is read into the
+// credential.
+//
+// A helper starting with "!" is a shell command, and an absolute path is a
+// program. Other helpers are names of git credential-<name> commands.
+func (c *Credential) runHelper(helper, action string) error {
+	var command string
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		command = helper[1:]
+	case filepath.IsAbs(helper):
+		command = helper
+	default:
+		command = "git credential-" + helper
+	}
+
+	var stdin, stdout bytes.Buffer
+	if _, err := c.WriteTo(&stdin); err != nil {
+		return err
+	}
+	cmd := exec.Command("sh", "-c", command+" "+action)
+	cmd.Stdin = &stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if action != "get" {
+		return nil
+	}
+	return c.read(&stdout)
+}
+
+// credentialPrompt asks the user for a value. The askpass program of
+// GIT_ASKPASS, core.askPass or SSH_ASKPASS is run with the prompt if there
+// is one, otherwise the user is asked on the terminal. Passwords are not
+// echoed.
+func credentialPrompt(config *Config, prompt string, echo bool) (string, error) {
+	askpass := os.Getenv("GIT_ASKPASS")
+	if askpass == "" {
+		askpass, _ = config.Get("core", "", "askPass")
+	}
+	if askpass == "" {
+		askpass = os.Getenv("SSH_ASKPASS")
+	}
+	if askpass != "" {
+		var stdout bytes.Buffer
+		cmd := exec.Command(askpass, prompt)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("unable to read askpass response from '%s': %w", askpass, err)
+		}
+		return strings.TrimRight(strings.SplitN(stdout.String(), "\n", 2)[0], "\r"), nil
+	}
+
+	what := strings.TrimSuffix(prompt, ": ")
+	if env := os.Getenv("GIT_TERMINAL_PROMPT"); env != "" {
+		if on, err := parseConfigBool(env); err == nil && !on {
+			return "", fmt.Errorf("could not read %s: terminal prompts disabled", what)
+		}
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %w", what, err)
+	}
+	defer tty.Close()
+	if _, err := tty.WriteString(prompt); err != nil {
+		return "", err
+	}
+	if !echo {
+		stty := func(arg string) error {
+			cmd := exec.Command("stty", arg)
+			cmd.Stdin = tty
+			return cmd.Run()
+		}
+		if err := stty("-echo"); err != nil {
+			return "", fmt.Errorf("could not read %s: %w", what, err)
+		}
+		defer func() {
+			stty("echo")
+			tty.WriteString("\n")
+		}()
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("could not read %s: %w", what, err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
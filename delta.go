@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Delta compression settings of written packs, same as the defaults of git.
+const (
+	defaultPackWindow = 10
+	defaultPackDepth  = 50
+)
+
+// deltaBlockSize is the length of base blocks that delta copies start with.
+// Shorter matches are inserted as literal data.
+const deltaBlockSize = 16
+
+// maxDeltaCopy is the longest copy a single delta instruction can encode in
+// the format git reads.
+const maxDeltaCopy = 0x10000
+
+// deltaIndex finds where blocks of a base object occur, to compute deltas
+// of other objects against it.
+type deltaIndex struct {
+	base []byte
+	// blocks maps the content of every aligned block of the base to its
+	// offsets.
+	blocks map[string][]int
+}
+
+func newDeltaIndex(base []byte) *deltaIndex {
+	idx := &deltaIndex{base: base, blocks: make(map[string][]int, len(base)/deltaBlockSize)}
+	for i := 0; i+deltaBlockSize <= len(base); i += deltaBlockSize {
+		key := string(base[i : i+deltaBlockSize])
+		// Repetitive content would make matching slow, the first few
+		// offsets are enough.
+		if offsets := idx.blocks[key]; len(offsets) < 64 {
+			idx.blocks[key] = append(offsets, i)
+		}
+	}
+	return idx
+}
+
+// delta returns the instructions that build target from the base, in the
+// format read by patchDelta, or nil if they would be longer than maxSize.
+func (idx *deltaIndex) delta(target []byte, maxSize int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	delta := append([]byte(nil), buf[:binary.PutUvarint(buf[:], uint64(len(idx.base)))]...)
+	delta = append(delta, buf[:binary.PutUvarint(buf[:], uint64(len(target)))]...)
+
+	insert := 0 // start of literal data not written yet
+	for i := 0; i+deltaBlockSize <= len(target); {
+		offset, size := idx.longestMatch(target, i)
+		if size == 0 {
+			i++
+			continue
+		}
+		// The match may start within the literal data.
+		for i > insert && offset > 0 && idx.base[offset-1] == target[i-1] {
+			i, offset, size = i-1, offset-1, size+1
+		}
+		delta = appendDeltaInsert(delta, target[insert:i])
+		for size > 0 {
+			n := size
+			if n > maxDeltaCopy {
+				n = maxDeltaCopy
+			}
+			delta = appendDeltaCopy(delta, offset, n)
+			i, offset, size = i+n, offset+n, size-n
+		}
+		insert = i
+		if len(delta) > maxSize {
+			return nil
+		}
+	}
+	delta = appendDeltaInsert(delta, target[insert:])
+	if len(delta) > maxSize {
+		return nil
+	}
+	return delta
+}
+
+// longestMatch returns the offset and length of the longest content of the
+// base that the target has at position i, or zero length if there is none
+// of at least a block.
+func (idx *deltaIndex) longestMatch(target []byte, i int) (int, int) {
+	var bestOffset, bestSize int
+	for _, offset := range idx.blocks[string(target[i:i+deltaBlockSize])] {
+		size := deltaBlockSize
+		for offset+size < len(idx.base) && i+size < len(target) && idx.base[offset+size] == target[i+size] {
+			size++
+		}
+		if size > bestSize {
+			bestOffset, bestSize = offset, size
+		}
+	}
+	return bestOffset, bestSize
+}
+
+// appendDeltaInsert appends instructions inserting the literal data. A
+// single instruction inserts at most 127 bytes.
+func appendDeltaInsert(delta, data []byte) []byte {
+	for len(data) > 0 {
+		n := len(data)
+		if n > 0x7f {
+			n = 0x7f
+		}
+		delta = append(delta, byte(n))
+		delta = append(delta, data[:n]...)
+		data = data[n:]
+	}
+	return delta
+}
+
+// appendDeltaCopy appends an instruction copying size bytes of the base at
+// offset. Only non zero bytes of the offset and the size are stored, and
+// the size of 0x10000 is stored as zero.
+func appendDeltaCopy(delta []byte, offset, size int) []byte {
+	cmd := byte(0x80)
+	var args []byte
+	for i := uint(0); i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			cmd |= 1 << i
+			args = append(args, b)
+		}
+	}
+	if size != maxDeltaCopy {
+		for i := uint(0); i < 3; i++ {
+			if b := byte(size >> (8 * i)); b != 0 {
+				cmd |= 1 << (4 + i)
+				args = append(args, b)
+			}
+		}
+	}
+	return append(append(delta, cmd), args...)
+}
+
+// deltaOrder sorts objects so that similar ones are close to each other,
+// which is where deltas are searched for: by kind, and the larger first,
+// so that deltas remove data rather than add it.
+func (r *Repository) deltaOrder(shas [][]byte) ([][]byte, error) {
+	type info struct {
+		sha  []byte
+		kind string
+		size int
+	}
+	infos := make([]info, len(shas))
+	for i, sha := range shas {
+		kind, content, err := r.ReadRawObject(sha)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = info{sha: sha, kind: kind, size: len(content)}
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].kind != infos[j].kind {
+			return infos[i].kind < infos[j].kind
+		}
+		return infos[i].size > infos[j].size
+	})
+	sorted := make([][]byte, len(infos))
+	for i, info := range infos {
+		sorted[i] = info.sha
+	}
+	return sorted, nil
+}
+
+// deltaWindow holds the objects most recently written into a pack, that
+// the next ones can be stored as deltas against.
+type deltaWindow struct {
+	size     int
+	maxDepth int
+	entries  []*deltaEntry
+}
+
+// deltaEntry is an object written into a pack.
+type deltaEntry struct {
+	kind    string
+	content []byte
+	offset  int64
+	// depth is the length of the delta chain of the entry, zero if it is
+	// stored whole.
+	depth int
+	// index is computed when the entry is first used as a base.
+	index *deltaIndex
+}
+
+// find returns the entry of the window that gives the smallest delta of
+// the object, together with the delta. A delta is used only if it is less
+// than half of the object, same as git does.
+func (w *deltaWindow) find(kind string, content []byte) (*deltaEntry, []byte) {
+	var best *deltaEntry
+	var bestDelta []byte
+	maxSize := len(content)/2 - 20
+	for i := len(w.entries) - 1; i >= 0; i-- {
+		e := w.entries[i]
+		if e.kind != kind || e.depth >= w.maxDepth || maxSize <= 0 {
+			continue
+		}
+		// Deltas against much smaller objects are mostly literal data.
+		if len(content) > 32*len(e.content) || len(e.content) < deltaBlockSize {
+			continue
+		}
+		if e.index == nil {
+			e.index = newDeltaIndex(e.content)
+		}
+		if delta := e.index.delta(content, maxSize); delta != nil {
+			best, bestDelta = e, delta
+			maxSize = len(delta) - 1
+		}
+	}
+	return best, bestDelta
+}
+
+// add puts the entry into the window, dropping the oldest one if it is
+// full.
+func (w *deltaWindow) add(e *deltaEntry) {
+	if w.size <= 0 {
+		return
+	}
+	if len(w.entries) == w.size {
+		copy(w.entries, w.entries[1:])
+		w.entries = w.entries[:len(w.entries)-1]
+	}
+	w.entries = append(w.entries, e)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 200000)
+	rnd.Read(random)
+	base := strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 100)
+
+	cases := map[string]struct {
+		base   string
+		target string
+		// small is set if the delta must be much smaller than the target.
+		small bool
+	}{
+		"same":          {base: base, target: base, small: true},
+		"appended":      {base: base, target: base + "and a new line\n", small: true},
+		"prepended":     {base: base, target: "a new line\n" + base, small: true},
+		"changed":       {base: base, target: base[:1000] + "changed" + base[1007:], small: true},
+		"unrelated":     {base: base, target: string(random[:5000])},
+		"empty target":  {base: base, target: ""},
+		"empty base":    {base: "", target: base},
+		"long copies":   {base: string(random), target: string(random[:150000]) + "x" + string(random[150000:]), small: true},
+		"short content": {base: "abc", target: "abd"},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			delta := newDeltaIndex([]byte(tc.base)).delta([]byte(tc.target), len(tc.target)+1000)
+			if delta == nil {
+				t.Fatal("no delta")
+			}
+			got, err := patchDelta([]byte(tc.base), delta)
+			if err != nil {
+				t.Fatalf("patch: %s", err)
+			}
+			if string(got) != tc.target {
+				t.Fatalf("patched content differs from the target")
+			}
+			if tc.small && len(delta) > len(tc.target)/10 {
+				t.Fatalf("want a small delta, got %d bytes for %d", len(delta), len(tc.target))
+			}
+		})
+	}
+
+	if delta := newDeltaIndex([]byte(base)).delta(random[:5000], 100); delta != nil {
+		t.Fatalf("want no delta above the size limit, got %d bytes", len(delta))
+	}
+}
+
+func TestWritePackDeltas(t *testing.T) {
+	repo := newTestRepository(t)
+	var content bytes.Buffer
+	objects := make(map[string]string)
+	var shas [][]byte
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&content, "line %d of a file that grows with every version\n", i)
+		sha, err := repo.WriteObject("blob", content.Bytes())
+		if err != nil {
+			t.Fatalf("write object: %s", err)
+		}
+		objects[string(sha)] = content.String()
+		shas = append(shas, sha)
+	}
+	repo.config.Entries = append(repo.config.Entries, &ConfigEntry{Section: "pack", Key: "depth", Value: "3"})
+	if _, err := repo.Repack(true); err != nil {
+		t.Fatalf("repack: %s", err)
+	}
+
+	packs, _, err := repo.localPacks()
+	if err != nil {
+		t.Fatalf("local packs: %s", err)
+	}
+	if len(packs) != 1 {
+		t.Fatalf("want one pack, got %d", len(packs))
+	}
+	deltas := 0
+	for _, sha := range shas {
+		assertHasObject(t, repo, sha, true)
+		_, got, err := repo.ReadRawObject(sha)
+		if err != nil {
+			t.Fatalf("read %x: %s", sha, err)
+		}
+		if string(got) != objects[string(sha)] {
+			t.Fatalf("%x: unexpected content", sha)
+		}
+		_, base, err := repo.objectDiskInfo(sha)
+		if err != nil {
+			t.Fatalf("disk info: %s", err)
+		}
+		if base != nil {
+			deltas++
+		}
+	}
+	if deltas == 0 {
+		t.Fatal("want objects stored as deltas")
+	}
+}
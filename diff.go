@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+)
+
+// splitLines splits data into lines, keeping the line terminator. Last line
+// has no terminator if data does not end with a new line.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) != 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i == -1 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// isBinary returns true if data looks like binary content. Same as git, it
+// looks for a NUL byte in the first few kilobytes.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) != -1
+}
+
+// diffMatches computes the longest common subsequence of a and b using the
+// Myers algorithm. Returned slice has an entry for each line of a, with the
+// index of the matching line in b or -1 if the line is not matched.
+func diffMatches(a, b []string) []int {
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+
+	// Common prefix and suffix are matched directly, which keeps the
+	// expensive part of the algorithm small for typical changes.
+	var prefix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		matches[prefix] = prefix
+		prefix++
+	}
+	var suffix int
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		matches[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	ma := a[prefix : len(a)-suffix]
+	mb := b[prefix : len(b)-suffix]
+	for _, m := range myers(ma, mb) {
+		matches[prefix+m[0]] = prefix + m[1]
+	}
+	return matches
+}
+
+// myers returns pairs of matching line indexes of the shortest edit script
+// transforming a into b.
+func myers(a, b []string) [][2]int {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return nil
+	}
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace keeps, for each edit distance d, the part of v that was used
+	// to compute it, which is indexes -d-1..d+1.
+	var trace [][]int
+	var d int
+search:
+	for d = 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	var matches [][2]int
+	x, y := n, m
+	for ; d > 0; d-- {
+		tv := trace[d]
+		at := func(k int) int { return tv[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			matches = append(matches, [2]int{x, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		matches = append(matches, [2]int{x, y})
+	}
+	return matches
+}
+
+// compactMatches moves groups of changed lines where the same change can be
+// shown in several places, the way git does. Groups are moved down as far
+// as possible, unless they can be aligned with a change in the other file.
+// For example adding a function after another one then matches the closing
+// brace of the existing function, instead of the added one.
+func compactMatches(a, b []string, matches []int) []int {
+	changedA := make([]bool, len(a))
+	changedB := make([]bool, len(b))
+	for i := range changedB {
+		changedB[i] = true
+	}
+	for i, m := range matches {
+		if m < 0 {
+			changedA[i] = true
+		} else {
+			changedB[m] = false
+		}
+	}
+	compactChanges(&changeGroups{lines: a, changed: changedA}, &changeGroups{lines: b, changed: changedB})
+	compactChanges(&changeGroups{lines: b, changed: changedB}, &changeGroups{lines: a, changed: changedA})
+
+	// Unchanged lines are equal in both, so they can be paired in order.
+	compacted := make([]int, len(a))
+	j := 0
+	for i := range a {
+		compacted[i] = -1
+		if changedA[i] {
+			continue
+		}
+		for changedB[j] {
+			j++
+		}
+		compacted[i] = j
+		j++
+	}
+	return compacted
+}
+
+// changeGroups iterates over groups of changed lines. Groups are separated by
+// a single unchanged line and can be empty, so that the n-th group of both
+// compared files is at the same place.
+type changeGroups struct {
+	lines      []string
+	changed    []bool
+	start, end int
+}
+
+func (g *changeGroups) isChanged(i int) bool {
+	return i >= 0 && i < len(g.lines) && g.changed[i]
+}
+
+func (g *changeGroups) first() {
+	g.start, g.end = 0, 0
+	for g.isChanged(g.end) {
+		g.end++
+	}
+}
+
+func (g *changeGroups) next() bool {
+	if g.end == len(g.lines) {
+		return false
+	}
+	g.start = g.end + 1
+	for g.end = g.start; g.isChanged(g.end); g.end++ {
+	}
+	return true
+}
+
+func (g *changeGroups) previous() bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	for g.start = g.end; g.isChanged(g.start - 1); g.start-- {
+	}
+	return true
+}
+
+func (g *changeGroups) slideDown() bool {
+	if g.end == len(g.lines) || g.lines[g.start] != g.lines[g.end] {
+		return false
+	}
+	g.changed[g.start], g.changed[g.end] = false, true
+	g.start++
+	g.end++
+	for g.isChanged(g.end) {
+		g.end++
+	}
+	return true
+}
+
+func (g *changeGroups) slideUp() bool {
+	if g.start == 0 || g.lines[g.start-1] != g.lines[g.end-1] {
+		return false
+	}
+	g.start--
+	g.end--
+	g.changed[g.start], g.changed[g.end] = true, false
+	for g.isChanged(g.start - 1) {
+		g.start--
+	}
+	return true
+}
+
+// compactChanges slides change groups of g, keeping track of the matching
+// groups of the other file.
+func compactChanges(g, other *changeGroups) {
+	g.first()
+	other.first()
+	for {
+		if g.end != g.start {
+			var earliestEnd int
+			endMatchingOther := -1
+			for {
+				size := g.end - g.start
+				for g.slideUp() {
+					other.previous()
+				}
+				earliestEnd = g.end
+				if other.end > other.start {
+					endMatchingOther = g.end
+				}
+				for g.slideDown() {
+					other.next()
+					if other.end > other.start {
+						endMatchingOther = g.end
+					}
+				}
+				if size == g.end-g.start {
+					break
+				}
+			}
+			if g.end != earliestEnd && endMatchingOther != -1 {
+				for other.end == other.start {
+					g.slideUp()
+					other.previous()
+				}
+			}
+		}
+		if !g.next() {
+			return
+		}
+		other.next()
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// diffTool returns the tool of given name to show differences with, or the
+// one set with diff.tool or merge.tool if name is empty. Same as in git, a
+// tool without difftool.<name>.cmd uses the command of the merge tool.
+func (r *Repository) diffTool(name string) (*MergeTool, error) {
+	if name == "" {
+		name, _ = r.config.Get("diff", "", "tool")
+	}
+	if name == "" {
+		name, _ = r.config.Get("merge", "", "tool")
+	}
+	if name == "" {
+		return nil, errors.New("no diff tool is configured, set diff.tool or use --tool")
+	}
+	cmd, ok := r.config.Get("difftool", name, "cmd")
+	if !ok || cmd == "" {
+		cmd, ok = r.config.Get("mergetool", name, "cmd")
+	}
+	if !ok || cmd == "" {
+		return nil, fmt.Errorf("unknown diff tool %s, set difftool.%s.cmd", name, name)
+	}
+	trust, err := r.config.Bool("difftool", "", "trustExitCode", false)
+	if err != nil {
+		return nil, err
+	}
+	return &MergeTool{Name: name, Cmd: cmd, TrustExitCode: trust}, nil
+}
+
+// diffToolTree is a temporary directory with one side of a diff: the
+// changed files are written at their paths in the directory.
+type diffToolTree struct {
+	repo *Repository
+	dir  string
+	// written is the content of the files from the worktree, so that
+	// changes made by the tool can be told and copied back.
+	written map[string][]byte
+}
+
+// write creates the file of one side of the change at its path in the
+// directory, with the content of the object, or of the worktree file if sha
+// is nil or fromWorktree is set. Symbolic links are written as files with
+// the link target, and submodules as files with their commit, same as git
+// shows them.
+func (t *diffToolTree) write(path string, mode os.FileMode, sha []byte, fromWorktree bool) error {
+	var content []byte
+	switch {
+	case mode == modeGitlink:
+		content = []byte(fmt.Sprintf("Subproject commit %x\n", sha))
+	case fromWorktree || sha == nil:
+		full := filepath.Join(t.repo.workdir, filepath.FromSlash(path))
+		info, err := os.Lstat(full)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", path, err)
+		}
+		if content, err = readWorktreeFile(full, info); err != nil {
+			return err
+		}
+		if t.written == nil {
+			t.written = make(map[string][]byte)
+		}
+		t.written[path] = content
+	default:
+		_, raw, err := t.repo.ReadRawObject(sha)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		content = raw
+		if mode != modeSymlink {
+			attrStack, err := t.repo.worktreeAttributes()
+			if err != nil {
+				return err
+			}
+			attrs, err := attrStack.Lookup(path)
+			if err != nil {
+				return err
+			}
+			if content, err = t.repo.convertToWorktree(attrs, path, sha, raw); err != nil {
+				return err
+			}
+		}
+	}
+	dest := t.file(path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if mode == modeExec {
+		perm = 0755
+	}
+	return ioutil.WriteFile(dest, content, perm)
+}
+
+// file returns the full name of the file at path in the directory.
+func (t *diffToolTree) file(path string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(path))
+}
+
+// copyBack writes files of the worktree side that were changed by the tool
+// to the worktree, so that edits made in a directory diff are kept.
+func (t *diffToolTree) copyBack() error {
+	for path, before := range t.written {
+		after, err := ioutil.ReadFile(t.file(path))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if bytes.Equal(before, after) {
+			continue
+		}
+		full := filepath.Join(t.repo.workdir, filepath.FromSlash(path))
+		info, err := os.Lstat(full)
+		if err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("cannot copy %s back to the worktree", path)
+		}
+		if err := ioutil.WriteFile(full, after, info.Mode().Perm()); err != nil {
+			return err
+		}
+		t.written[path] = after
+	}
+	return nil
+}
+
+// diffToolFiles writes both sides of the changes into the left and right
+// directories in a new temporary directory, which the caller must remove.
+// If worktree is set, the new sides of the changes are worktree files.
+// Unmerged paths are skipped.
+func (r *Repository) diffToolFiles(changes []*FileChange, worktree bool) (tmp string, left, right *diffToolTree, err error) {
+	if tmp, err = ioutil.TempDir("", "git-difftool."); err != nil {
+		return "", nil, nil, err
+	}
+	left = &diffToolTree{repo: r, dir: filepath.Join(tmp, "left")}
+	right = &diffToolTree{repo: r, dir: filepath.Join(tmp, "right")}
+	for _, c := range changes {
+		if c.Status == 'U' {
+			continue
+		}
+		if c.OldMode != 0 {
+			if err := left.write(c.Path, c.OldMode, c.OldSha, false); err != nil {
+				os.RemoveAll(tmp)
+				return "", nil, nil, err
+			}
+		}
+		if c.NewMode != 0 {
+			if err := right.write(c.Path, c.NewMode, c.NewSha, worktree); err != nil {
+				os.RemoveAll(tmp)
+				return "", nil, nil, err
+			}
+		}
+	}
+	for _, t := range []*diffToolTree{left, right} {
+		if err := os.MkdirAll(t.dir, 0755); err != nil {
+			os.RemoveAll(tmp)
+			return "", nil, nil, err
+		}
+	}
+	return tmp, left, right, nil
+}
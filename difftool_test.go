@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffToolFiles(t *testing.T) {
+	repo := newTestRepository(t)
+	var err error
+	dir := repo.workdir
+	config := "[merge]\ntool = shared\n[mergetool \"shared\"]\ncmd = merge\n"
+	if repo.config, err = ParseConfig(strings.NewReader(config)); err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+	if dt, err := repo.diffTool(""); err != nil || dt.Name != "shared" || dt.Cmd != "merge" {
+		t.Fatalf("want the merge tool to be used, got %+v, %v", dt, err)
+	}
+
+	old, err := repo.WriteObject("blob", []byte("old\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "dir"), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "dir", "a"), []byte("new\n"), 0644); err != nil {
+		t.Fatalf("write file: %s", err)
+	}
+	changes := []*FileChange{
+		{Path: "deleted", OldMode: modeBlob, OldSha: old, Status: 'D'},
+		{Path: "dir/a", OldMode: modeBlob, NewMode: modeBlob, OldSha: old, Status: 'M'},
+		{Path: "unmerged", Status: 'U'},
+	}
+	tmp, left, right, err := repo.diffToolFiles(changes, true)
+	if err != nil {
+		t.Fatalf("diff tool files: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	files := map[string]string{
+		left.file("deleted"): "old\n",
+		left.file("dir/a"):   "old\n",
+		right.file("dir/a"):  "new\n",
+	}
+	for name, want := range files {
+		if got, err := ioutil.ReadFile(name); err != nil || string(got) != want {
+			t.Fatalf("%s: want %q, got %q, %v", name, want, got, err)
+		}
+	}
+	for _, name := range []string{right.file("deleted"), left.file("unmerged"), right.file("unmerged")} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("%s: want missing, got %v", name, err)
+		}
+	}
+
+	// Changes to worktree files are copied back.
+	if err := ioutil.WriteFile(right.file("dir/a"), []byte("edited\n"), 0644); err != nil {
+		t.Fatalf("write file: %s", err)
+	}
+	if err := right.copyBack(); err != nil {
+		t.Fatalf("copy back: %s", err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "dir", "a")); string(got) != "edited\n" {
+		t.Fatalf("want edited worktree file, got %q", got)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// editorCommand returns the editor chosen by the user, from GIT_EDITOR,
+// core.editor, VISUAL or EDITOR, in this order. vi is used if none is set.
+func editorCommand(config *Config) string {
+	if editor := os.Getenv("GIT_EDITOR"); editor != "" {
+		return editor
+	}
+	if editor, ok := config.Get("core", "", "editor"); ok && editor != "" {
+		return editor
+	}
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if editor := os.Getenv(env); editor != "" {
+			return editor
+		}
+	}
+	return "vi"
+}
+
+// launchEditor opens the file in the editor and waits until it exits. The
+// editor is a shell command, run with the path as its argument.
+func launchEditor(config *Config, path string) error {
+	editor := editorCommand(config)
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s': %w", editor, err)
+	}
+	return nil
+}
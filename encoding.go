@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// Character encodings converted without the iconv command.
+const (
+	encodingUTF8   = "UTF-8"
+	encodingLatin1 = "ISO-8859-1"
+	encodingASCII  = "US-ASCII"
+)
+
+// canonicalEncoding returns the name of the encoding the way it is spelled
+// by the conversions. Names of other encodings are returned as they are.
+func canonicalEncoding(name string) string {
+	switch strings.ToUpper(name) {
+	case "", "UTF-8", "UTF8":
+		return encodingUTF8
+	case "ISO-8859-1", "ISO8859-1", "ISO_8859-1", "LATIN1", "LATIN-1":
+		return encodingLatin1
+	case "US-ASCII", "ASCII", "ANSI_X3.4-1968":
+		return encodingASCII
+	}
+	return name
+}
+
+// reencode converts text from one character encoding to another. UTF-8,
+// ISO-8859-1 and US-ASCII are converted directly, other encodings with the
+// iconv command.
+func reencode(text, from, to string) (string, error) {
+	from, to = canonicalEncoding(from), canonicalEncoding(to)
+	if from == to {
+		return text, nil
+	}
+	switch from {
+	case encodingUTF8:
+		if !utf8.ValidString(text) {
+			return "", fmt.Errorf("convert from %s: invalid text", from)
+		}
+	case encodingLatin1:
+		runes := make([]rune, len(text))
+		for i := 0; i < len(text); i++ {
+			runes[i] = rune(text[i])
+		}
+		text = string(runes)
+	case encodingASCII:
+		if i := strings.IndexFunc(text, func(r rune) bool { return r >= utf8.RuneSelf }); i >= 0 {
+			return "", fmt.Errorf("convert from %s: invalid byte at %d", from, i)
+		}
+	default:
+		var err error
+		if text, err = iconv(text, from, encodingUTF8); err != nil {
+			return "", err
+		}
+	}
+
+	switch to {
+	case encodingUTF8:
+		return text, nil
+	case encodingLatin1, encodingASCII:
+		max := rune(0xff)
+		if to == encodingASCII {
+			max = utf8.RuneSelf - 1
+		}
+		b := make([]byte, 0, len(text))
+		for _, r := range text {
+			if r > max {
+				return "", fmt.Errorf("convert to %s: %q cannot be represented", to, r)
+			}
+			b = append(b, byte(r))
+		}
+		return string(b), nil
+	}
+	return iconv(text, encodingUTF8, to)
+}
+
+// iconv converts text with the iconv command.
+func iconv(text, from, to string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("iconv", "-f", from, "-t", to)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("convert from %s to %s: %s", from, to, msg)
+		}
+		return "", fmt.Errorf("convert from %s to %s: %w", from, to, err)
+	}
+	return stdout.String(), nil
+}
+
+// localeEncoding returns the character set of the locale, as set by
+// LC_ALL, LC_CTYPE or LANG, for example "ISO-8859-1" for de_DE.ISO-8859-1.
+// An empty string is returned if the locale does not name one.
+func localeEncoding() string {
+	var locale string
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if locale = os.Getenv(name); locale != "" {
+			break
+		}
+	}
+	i := strings.IndexByte(locale, '.')
+	if i < 0 {
+		return ""
+	}
+	charset := locale[i+1:]
+	if j := strings.IndexByte(charset, '@'); j >= 0 {
+		charset = charset[:j]
+	}
+	return charset
+}
+
+// commitEncoding returns the encoding of commit messages written by the
+// user: i18n.commitEncoding, or the encoding of the locale if it is not
+// set.
+func (r *Repository) commitEncoding() string {
+	if enc, ok := r.config.Get("i18n", "", "commitEncoding"); ok && enc != "" {
+		return enc
+	}
+	if enc := localeEncoding(); enc != "" {
+		return enc
+	}
+	return encodingUTF8
+}
+
+// logOutputEncoding returns the encoding commit messages are shown in:
+// i18n.logOutputEncoding, which defaults to i18n.commitEncoding and then to
+// UTF-8.
+func (r *Repository) logOutputEncoding() string {
+	for _, key := range []string{"logOutputEncoding", "commitEncoding"} {
+		if enc, ok := r.config.Get("i18n", "", key); ok && enc != "" {
+			return enc
+		}
+	}
+	return encodingUTF8
+}
+
+// displayCommit returns the commit with the message and the identities
+// converted from the encoding it declares to the log output encoding. If
+// the conversion fails, the commit is shown as it is stored, like git does.
+func (r *Repository) displayCommit(c *CommitObject) *CommitObject {
+	from := encodingUTF8
+	if enc := c.Header["encoding"]; len(enc) != 0 {
+		from = enc[0]
+	}
+	to := r.logOutputEncoding()
+	if canonicalEncoding(from) == canonicalEncoding(to) {
+		return c
+	}
+	out := &CommitObject{Header: make(map[string][]string, len(c.Header))}
+	for key, values := range c.Header {
+		out.Header[key] = values
+	}
+	var err error
+	if out.Comment, err = reencode(c.Comment, from, to); err != nil {
+		return c
+	}
+	for _, key := range []string{"author", "committer"} {
+		var values []string
+		for _, v := range c.Header[key] {
+			if v, err = reencode(v, from, to); err != nil {
+				return c
+			}
+			values = append(values, v)
+		}
+		out.Header[key] = values
+	}
+	// The message is no longer in the declared encoding.
+	delete(out.Header, "encoding")
+	return out
+}
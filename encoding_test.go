@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestReencode(t *testing.T) {
+	cases := map[string]struct {
+		text    string
+		from    string
+		to      string
+		want    string
+		wantErr bool
+		iconv   bool
+	}{
+		"same encoding":       {text: "caf\xe9", from: "latin1", to: "ISO-8859-1", want: "caf\xe9"},
+		"latin1 to utf-8":     {text: "caf\xe9", from: "ISO-8859-1", to: "UTF-8", want: "café"},
+		"utf-8 to latin1":     {text: "café", from: "utf8", to: "ISO-8859-1", want: "caf\xe9"},
+		"not in latin1":       {text: "日本", from: "UTF-8", to: "ISO-8859-1", wantErr: true},
+		"invalid utf-8":       {text: "caf\xe9", from: "UTF-8", to: "ISO-8859-1", wantErr: true},
+		"ascii":               {text: "plain", from: "US-ASCII", to: "UTF-8", want: "plain"},
+		"not ascii":           {text: "caf\xe9", from: "ASCII", to: "UTF-8", wantErr: true},
+		"shift_jis to utf-8":  {text: "\x93\xfa\x96\x7b", from: "Shift_JIS", to: "UTF-8", want: "日本", iconv: true},
+		"utf-8 to shift_jis":  {text: "日本", from: "UTF-8", to: "Shift_JIS", want: "\x93\xfa\x96\x7b", iconv: true},
+		"shift_jis to latin1": {text: "\x93\xfa\x96\x7b", from: "Shift_JIS", to: "ISO-8859-1", wantErr: true, iconv: true},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if tc.iconv {
+				if _, err := exec.LookPath("iconv"); err != nil {
+					t.Skip("iconv not found")
+				}
+			}
+			got, err := reencode(tc.text, tc.from, tc.to)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("reencode: %s", err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLocaleEncoding(t *testing.T) {
+	cases := map[string]struct {
+		lcAll string
+		lang  string
+		want  string
+	}{
+		"no locale":    {},
+		"posix":        {lang: "C", want: ""},
+		"charset":      {lang: "de_DE.ISO-8859-1", want: "ISO-8859-1"},
+		"modifier":     {lang: "de_DE.ISO-8859-15@euro", want: "ISO-8859-15"},
+		"lc_all first": {lcAll: "ja_JP.SJIS", lang: "en_US.UTF-8", want: "SJIS"},
+	}
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if value, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, value)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	os.Unsetenv("LC_CTYPE")
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			os.Setenv("LC_ALL", tc.lcAll)
+			os.Setenv("LANG", tc.lang)
+			if got := localeEncoding(); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDisplayCommit(t *testing.T) {
+	c := &CommitObject{
+		Header: map[string][]string{
+			"author":   {"J\xfcrg <j@example.com> 1600000000 +0000"},
+			"encoding": {"ISO-8859-1"},
+		},
+		Comment: "caf\xe9\n",
+	}
+	cases := map[string]struct {
+		config  string
+		author  string
+		comment string
+	}{
+		"utf-8 output":  {author: "Jürg <j@example.com> 1600000000 +0000", comment: "café\n"},
+		"latin1 output": {config: "[i18n]\n\tcommitEncoding = latin1\n", author: c.Header["author"][0], comment: c.Comment},
+		"not possible":  {config: "[i18n]\n\tlogOutputEncoding = US-ASCII\n", author: c.Header["author"][0], comment: c.Comment},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			config, err := ParseConfig(strings.NewReader(tc.config))
+			if err != nil {
+				t.Fatalf("parse config: %s", err)
+			}
+			got := (&Repository{config: config}).displayCommit(c)
+			if got.Header["author"][0] != tc.author || got.Comment != tc.comment {
+				t.Fatalf("unexpected author %q and message %q", got.Header["author"][0], got.Comment)
+			}
+		})
+	}
+}
+
+func TestCreateCommitEncoding(t *testing.T) {
+	repo := newTestRepository(t)
+	tree, err := NewTreeBuilder(repo, nil).Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	for _, enc := range []string{"UTF-8", "ISO-8859-1"} {
+		if repo.config, err = ParseConfig(strings.NewReader("[user]\n\tname = Test\n\temail = test@example.com\n[i18n]\n\tcommitEncoding = " + enc + "\n")); err != nil {
+			t.Fatalf("parse config: %s", err)
+		}
+		sha, err := repo.CreateCommit(tree, nil, "caf\xe9\n", nil)
+		if err != nil {
+			t.Fatalf("create commit: %s", err)
+		}
+		c, err := repo.readCommit(sha)
+		if err != nil {
+			t.Fatalf("read commit: %s", err)
+		}
+		want := []string{enc}
+		if enc == "UTF-8" {
+			want = nil
+		}
+		if got := c.Header["encoding"]; strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: want encoding %q, got %q", enc, want, got)
+		}
+	}
+}
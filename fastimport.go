@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fastImporter reads a git fast-import stream, as produced by git
+// fast-export or remote helpers with the import capability, and writes
+// objects it describes. References are only collected, so that the caller
+// can update them once the whole stream is processed.
+type fastImporter struct {
+	repo  *Repository
+	rd    *bufio.Reader
+	marks map[string][]byte
+	// refs holds new values of references modified by the stream. Nil
+	// value means the reference was reset without a new value.
+	refs  map[string][]byte
+	order []string
+
+	// line is the next unprocessed line, without the line feed.
+	line string
+	eof  bool
+}
+
+func newFastImporter(repo *Repository, r io.Reader) *fastImporter {
+	// Reuse the buffered reader, so that nothing past the end of the stream
+	// is consumed.
+	rd, ok := r.(*bufio.Reader)
+	if !ok {
+		rd = bufio.NewReader(r)
+	}
+	return &fastImporter{
+		repo:  repo,
+		rd:    rd,
+		marks: make(map[string][]byte),
+		refs:  make(map[string][]byte),
+	}
+}
+
+// Import processes commands until the "done" command or the end of the
+// stream.
+func (f *fastImporter) Import() error {
+	if err := f.next(); err != nil {
+		return err
+	}
+	for !f.eof {
+		var err error
+		cmd := f.line
+		switch {
+		case cmd == "" || strings.HasPrefix(cmd, "#"):
+			err = f.next()
+		case cmd == "done":
+			return nil
+		case cmd == "blob":
+			err = f.blob()
+		case strings.HasPrefix(cmd, "commit "):
+			err = f.commit(strings.TrimPrefix(cmd, "commit "))
+		case strings.HasPrefix(cmd, "reset "):
+			err = f.reset(strings.TrimPrefix(cmd, "reset "))
+		case strings.HasPrefix(cmd, "tag "):
+			err = f.tag(strings.TrimPrefix(cmd, "tag "))
+		case cmd == "checkpoint",
+			strings.HasPrefix(cmd, "progress "),
+			strings.HasPrefix(cmd, "feature "),
+			strings.HasPrefix(cmd, "option "):
+			err = f.next()
+		default:
+			return fmt.Errorf("unsupported fast-import command %q", cmd)
+		}
+		if err != nil {
+			return fmt.Errorf("fast-import %q: %w", cmd, err)
+		}
+	}
+	return nil
+}
+
+// next reads the next line of the stream.
+func (f *fastImporter) next() error {
+	line, err := f.rd.ReadString('\n')
+	switch {
+	case err == nil:
+		// Complete line.
+	case errors.Is(err, io.EOF) && line == "":
+		f.eof = true
+		f.line = ""
+		return nil
+	case errors.Is(err, io.EOF):
+		// Last line without a line feed.
+	default:
+		return err
+	}
+	f.line = strings.TrimSuffix(line, "\n")
+	return nil
+}
+
+// optional consumes the current line if it is the given subcommand and
+// returns its argument.
+func (f *fastImporter) optional(name string) (string, bool, error) {
+	if !strings.HasPrefix(f.line, name+" ") {
+		return "", false, nil
+	}
+	arg := strings.TrimPrefix(f.line, name+" ")
+	return arg, true, f.next()
+}
+
+// data reads the data subcommand, in the exact byte count or the delimited
+// format.
+func (f *fastImporter) data() ([]byte, error) {
+	if !strings.HasPrefix(f.line, "data ") {
+		return nil, fmt.Errorf("expected data, got %q", f.line)
+	}
+	arg := strings.TrimPrefix(f.line, "data ")
+	var content []byte
+	if strings.HasPrefix(arg, "<<") {
+		delim := arg[2:]
+		var b bytes.Buffer
+		for {
+			line, err := f.rd.ReadString('\n')
+			if err != nil {
+				return nil, fmt.Errorf("read delimited data: %w", err)
+			}
+			if strings.TrimSuffix(line, "\n") == delim {
+				break
+			}
+			b.WriteString(line)
+		}
+		content = b.Bytes()
+	} else {
+		size, err := strconv.Atoi(arg)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid data size %q", arg)
+		}
+		content = make([]byte, size)
+		if _, err := io.ReadFull(f.rd, content); err != nil {
+			return nil, fmt.Errorf("read data: %w", err)
+		}
+	}
+	if err := f.next(); err != nil {
+		return nil, err
+	}
+	// Data may be followed by an optional line feed.
+	if f.line == "" && !f.eof {
+		if err := f.next(); err != nil {
+			return nil, err
+		}
+	}
+	return content, nil
+}
+
+func (f *fastImporter) mark(sha []byte, mark string) {
+	if mark != "" {
+		f.marks[mark] = sha
+	}
+}
+
+func (f *fastImporter) setRef(name string, sha []byte) {
+	if _, ok := f.refs[name]; !ok {
+		f.order = append(f.order, name)
+	}
+	f.refs[name] = sha
+}
+
+// resolve returns the hash of a commit-ish given as a mark, a hash or a
+// reference name.
+func (f *fastImporter) resolve(ref string) ([]byte, error) {
+	if strings.HasPrefix(ref, ":") {
+		sha, ok := f.marks[ref]
+		if !ok {
+			return nil, fmt.Errorf("unknown mark %s", ref)
+		}
+		return sha, nil
+	}
+	if sha, err := hex.DecodeString(ref); err == nil && len(sha) == 20 {
+		return sha, nil
+	}
+	if sha, ok := f.refs[ref]; ok {
+		if sha == nil {
+			return nil, fmt.Errorf("reference %s: %w", ref, os.ErrNotExist)
+		}
+		return sha, nil
+	}
+	return f.repo.resolveRef(ref)
+}
+
+func (f *fastImporter) blob() error {
+	if err := f.next(); err != nil {
+		return err
+	}
+	mark, _, err := f.optional("mark")
+	if err != nil {
+		return err
+	}
+	if _, _, err := f.optional("original-oid"); err != nil {
+		return err
+	}
+	content, err := f.data()
+	if err != nil {
+		return err
+	}
+	sha, err := f.repo.WriteObject("blob", content)
+	if err != nil {
+		return err
+	}
+	f.mark(sha, mark)
+	return nil
+}
+
+func (f *fastImporter) commit(ref string) error {
+	if err := f.next(); err != nil {
+		return err
+	}
+	mark, _, err := f.optional("mark")
+	if err != nil {
+		return err
+	}
+	if _, _, err := f.optional("original-oid"); err != nil {
+		return err
+	}
+	header := make(map[string][]string)
+	for _, key := range []string{"author", "committer", "encoding"} {
+		if value, ok, err := f.optional(key); err != nil {
+			return err
+		} else if ok {
+			header[key] = []string{value}
+		}
+	}
+	if len(header["committer"]) == 0 {
+		return errors.New("missing committer")
+	}
+	if len(header["author"]) == 0 {
+		header["author"] = header["committer"]
+	}
+	message, err := f.data()
+	if err != nil {
+		return err
+	}
+
+	var parents [][]byte
+	if from, ok, err := f.optional("from"); err != nil {
+		return err
+	} else if ok {
+		sha, err := f.resolve(from)
+		if err != nil {
+			return err
+		}
+		parents = append(parents, sha)
+	} else if sha, err := f.resolve(ref); err == nil {
+		// Without from, an existing branch continues from its tip.
+		parents = append(parents, sha)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for {
+		merge, ok, err := f.optional("merge")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		sha, err := f.resolve(merge)
+		if err != nil {
+			return err
+		}
+		parents = append(parents, sha)
+	}
+
+	var base *TreeObject
+	if len(parents) != 0 {
+		c, err := f.repo.readCommit(parents[0])
+		if err != nil {
+			return err
+		}
+		if base, err = f.repo.commitTree(c); err != nil {
+			return err
+		}
+	}
+	tb := NewTreeBuilder(f.repo, base)
+	if err := f.fileChanges(tb); err != nil {
+		return err
+	}
+	tree, err := tb.Write()
+	if err != nil {
+		return err
+	}
+
+	header["tree"] = []string{hex.EncodeToString(tree)}
+	for _, p := range parents {
+		header["parent"] = append(header["parent"], hex.EncodeToString(p))
+	}
+	raw, err := (&CommitObject{Header: header, Comment: string(message)}).Serialize()
+	if err != nil {
+		return err
+	}
+	sha, err := f.repo.WriteObject("commit", raw)
+	if err != nil {
+		return err
+	}
+	f.mark(sha, mark)
+	f.setRef(ref, sha)
+	return nil
+}
+
+// fileChanges applies file commands of a commit.
+func (f *fastImporter) fileChanges(tb *TreeBuilder) error {
+	for !f.eof {
+		line := f.line
+		switch {
+		case line == "deleteall":
+			*tb = *NewTreeBuilder(f.repo, nil)
+		case strings.HasPrefix(line, "D "):
+			path, err := unquoteFastImportPath(line[2:])
+			if err != nil {
+				return err
+			}
+			if err := tb.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		case strings.HasPrefix(line, "M "):
+			if err := f.modify(tb, line[2:]); err != nil {
+				return err
+			}
+			// Inline data already advanced to the next line.
+			continue
+		default:
+			// Blank line or the next command ends the commit.
+			return nil
+		}
+		if err := f.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fastImporter) modify(tb *TreeBuilder, args string) error {
+	chunks := strings.SplitN(args, " ", 3)
+	if len(chunks) != 3 {
+		return fmt.Errorf("invalid file modify %q", args)
+	}
+	var mode os.FileMode
+	switch chunks[0] {
+	case "100644", "644":
+		mode = modeBlob
+	case "100755", "755":
+		mode = modeExec
+	case "120000":
+		mode = modeSymlink
+	case "160000":
+		mode = modeGitlink
+	case "040000":
+		mode = modeTree
+	default:
+		return fmt.Errorf("invalid file mode %q", chunks[0])
+	}
+	path, err := unquoteFastImportPath(chunks[2])
+	if err != nil {
+		return err
+	}
+	var sha []byte
+	if chunks[1] == "inline" {
+		if err := f.next(); err != nil {
+			return err
+		}
+		content, err := f.data()
+		if err != nil {
+			return err
+		}
+		if sha, err = f.repo.WriteObject("blob", content); err != nil {
+			return err
+		}
+	} else {
+		if sha, err = f.resolve(chunks[1]); err != nil {
+			return err
+		}
+		if err := f.next(); err != nil {
+			return err
+		}
+	}
+	return tb.Insert(path, mode, sha)
+}
+
+func unquoteFastImportPath(path string) (string, error) {
+	if !strings.HasPrefix(path, `"`) {
+		return path, nil
+	}
+	unquoted, err := strconv.Unquote(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted path %s: %w", path, err)
+	}
+	return unquoted, nil
+}
+
+func (f *fastImporter) reset(ref string) error {
+	if err := f.next(); err != nil {
+		return err
+	}
+	from, ok, err := f.optional("from")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		f.setRef(ref, nil)
+		return nil
+	}
+	sha, err := f.resolve(from)
+	if err != nil {
+		return err
+	}
+	f.setRef(ref, sha)
+	return nil
+}
+
+func (f *fastImporter) tag(name string) error {
+	if err := f.next(); err != nil {
+		return err
+	}
+	mark, _, err := f.optional("mark")
+	if err != nil {
+		return err
+	}
+	from, ok, err := f.optional("from")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("missing from")
+	}
+	target, err := f.resolve(from)
+	if err != nil {
+		return err
+	}
+	if _, _, err := f.optional("original-oid"); err != nil {
+		return err
+	}
+	tagger, hasTagger, err := f.optional("tagger")
+	if err != nil {
+		return err
+	}
+	message, err := f.data()
+	if err != nil {
+		return err
+	}
+	kind, _, err := f.repo.ReadRawObject(target)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "object %x\ntype %s\ntag %s\n", target, kind, name)
+	if hasTagger {
+		fmt.Fprintf(&b, "tagger %s\n", tagger)
+	}
+	b.WriteString("\n")
+	b.Write(message)
+	sha, err := f.repo.WriteObject("tag", b.Bytes())
+	if err != nil {
+		return err
+	}
+	f.mark(sha, mark)
+	f.setRef("refs/tags/"+name, sha)
+	return nil
+}
+
+// RefUpdates returns changes of references made by the stream, in the
+// order they were first modified.
+func (f *fastImporter) RefUpdates() []*RefUpdate {
+	updates := make([]*RefUpdate, 0, len(f.order))
+	for _, name := range f.order {
+		updates = append(updates, &RefUpdate{Name: name, Sha: f.refs[name]})
+	}
+	return updates
+}
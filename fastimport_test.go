@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFastImport(t *testing.T) {
+	repo := newTestRepository(t)
+
+	stream := strings.Join([]string{
+		"blob",
+		"mark :1",
+		"data 6",
+		"hello",
+		"",
+		"commit refs/heads/master",
+		"mark :2",
+		"author A <a@example.com> 1600000000 +0000",
+		"committer A <a@example.com> 1600000000 +0000",
+		"data 6",
+		"first",
+		"M 100644 :1 a.txt",
+		"M 100644 :1 \"dir/b c.txt\"",
+		"",
+		"commit refs/heads/master",
+		"committer A <a@example.com> 1600000001 +0000",
+		"data <<EOF",
+		"second",
+		"EOF",
+		"from :2",
+		"D a.txt",
+		"M 100755 inline run.sh",
+		"data 3",
+		"ls",
+		"",
+		"tag v1",
+		"from :2",
+		"tagger A <a@example.com> 1600000002 +0000",
+		"data 4",
+		"v1",
+		"",
+		"done",
+		"",
+	}, "\n")
+	fi := newFastImporter(repo, strings.NewReader(stream))
+	if err := fi.Import(); err != nil {
+		t.Fatalf("import: %s", err)
+	}
+	updates := fi.RefUpdates()
+	if len(updates) != 2 || updates[0].Name != "refs/heads/master" || updates[1].Name != "refs/tags/v1" {
+		t.Fatalf("unexpected reference updates: %+v", updates)
+	}
+
+	head, err := repo.readCommit(updates[0].Sha)
+	if err != nil {
+		t.Fatalf("read head: %s", err)
+	}
+	if head.Comment != "second\n" || len(head.Header["parent"]) != 1 {
+		t.Fatalf("unexpected head commit: %+v", head)
+	}
+	tr, err := repo.commitTree(head)
+	if err != nil {
+		t.Fatalf("read tree: %s", err)
+	}
+	if _, err := repo.lookupTreePath(tr, "a.txt"); err == nil {
+		t.Fatal("a.txt must be deleted")
+	}
+	for path, mode := range map[string]os.FileMode{"dir/b c.txt": modeBlob, "run.sh": modeExec} {
+		leaf, err := repo.lookupTreePath(tr, path)
+		if err != nil {
+			t.Fatalf("lookup %s: %s", path, err)
+		}
+		if leaf.Mode != mode {
+			t.Fatalf("%s: want %s mode, got %s", path, mode, leaf.Mode)
+		}
+	}
+
+	kind, _, err := repo.ReadRawObject(updates[1].Sha)
+	if err != nil || kind != "tag" {
+		t.Fatalf("want tag object, got %q: %v", kind, err)
+	}
+}
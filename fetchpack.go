@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Client side of the version 0 upload-pack protocol, shared by transports
+// that talk to git upload-pack over a byte stream.
+
+// readAdvertisement reads references advertised by upload-pack, together
+// with the server capabilities.
+func readAdvertisement(r io.Reader) ([]*Ref, []string, error) {
+	var (
+		refs []*Ref
+		caps []string
+	)
+	for first := true; ; first = false {
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read advertisement: %w", err)
+		}
+		if line == nil {
+			break
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if bytes.HasPrefix(line, []byte("ERR ")) {
+			return nil, nil, fmt.Errorf("remote error: %s", line[4:])
+		}
+		if first {
+			if i := bytes.IndexByte(line, 0); i >= 0 {
+				caps = strings.Fields(string(line[i+1:]))
+				line = line[:i]
+			}
+		}
+		chunks := strings.SplitN(string(line), " ", 2)
+		if len(chunks) != 2 {
+			return nil, nil, fmt.Errorf("invalid advertisement line %q", line)
+		}
+		sha, err := hex.DecodeString(chunks[0])
+		if err != nil || len(sha) != 20 {
+			return nil, nil, fmt.Errorf("invalid advertised %q hash", chunks[1])
+		}
+		name := chunks[1]
+		// Peeled tags and the placeholder of an empty repository are
+		// not references.
+		if strings.HasSuffix(name, "^{}") {
+			continue
+		}
+		refs = append(refs, &Ref{Name: name, Sha: sha})
+	}
+	for _, c := range caps {
+		if !strings.HasPrefix(c, "symref=") {
+			continue
+		}
+		symref := strings.SplitN(strings.TrimPrefix(c, "symref="), ":", 2)
+		for _, ref := range refs {
+			if len(symref) == 2 && ref.Name == symref[0] {
+				ref.Target = symref[1]
+			}
+		}
+	}
+	return refs, caps, nil
+}
+
+// haveBatchSize is the number of haves sent before waiting for the server
+// to tell whether it found a common commit.
+const haveBatchSize = 32
+
+// fetchPack asks upload-pack for wanted objects and stores the received
+// pack in the local repository. Commits reachable from negotiation tips,
+// or from local references if tips are nil, are sent as haves in the order
+// chosen by fetch.negotiationAlgorithm, so that the server can leave out
+// objects that are already present. Haves are sent in batches, until the
+// server finds a common commit.
+func fetchPack(w io.Writer, r *bufio.Reader, local *Repository, serverCaps []string, wants, tips [][]byte) error {
+	caps := []string{"agent=gogit"}
+	for _, c := range serverCaps {
+		if c == "ofs-delta" || c == "thin-pack" || c == "no-progress" {
+			caps = append(caps, c)
+		}
+	}
+	var b bytes.Buffer
+	for i, sha := range wants {
+		if i == 0 {
+			writePktLine(&b, "want %x %s\n", sha, strings.Join(caps, " "))
+		} else {
+			writePktLine(&b, "want %x\n", sha)
+		}
+	}
+	writeFlushPkt(&b)
+
+	if tips == nil {
+		refs, err := local.ListRefs()
+		if err != nil {
+			return err
+		}
+		for _, sha := range refs {
+			tips = append(tips, sha)
+		}
+	}
+	algorithm, _ := local.config.Get("fetch", "", "negotiationAlgorithm")
+	n, err := local.newNegotiator(algorithm, tips)
+	if err != nil {
+		return fmt.Errorf("negotiate: %w", err)
+	}
+
+	// Without multi_ack, the server responds with NAK to every batch of
+	// haves until it finds a common commit, which it acknowledges.
+	acked := false
+	for !acked {
+		count := 0
+		for ; count < haveBatchSize; count++ {
+			sha, err := n.next()
+			if err != nil {
+				return fmt.Errorf("negotiate: %w", err)
+			}
+			if sha == nil {
+				break
+			}
+			writePktLine(&b, "have %x\n", sha)
+		}
+		if count == 0 {
+			break
+		}
+		writeFlushPkt(&b)
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return fmt.Errorf("send haves: %w", err)
+		}
+		b.Reset()
+		if acked, err = readAcknowledgement(r); err != nil {
+			return err
+		}
+	}
+	writePktLine(&b, "done\n")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("send done: %w", err)
+	}
+	// Depending on the version, the server sends NAK or acknowledges the
+	// remaining common commits before the pack.
+	for {
+		if magic, err := r.Peek(4); err == nil && string(magic) == "PACK" {
+			break
+		}
+		if _, err := readAcknowledgement(r); err != nil {
+			return err
+		}
+	}
+
+	return receiveObjects(local, wants, "fetch", func(incoming *Repository) error {
+		return incoming.storeFetchedPack(r)
+	}, nil)
+}
+
+// readAcknowledgement reads the response to haves. True is returned if the
+// server acknowledged a common commit.
+func readAcknowledgement(r io.Reader) (bool, error) {
+	line, err := readPktLine(r)
+	if err != nil {
+		return false, fmt.Errorf("read acknowledgement: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(line, []byte("ACK ")):
+		return true, nil
+	case bytes.Equal(line, []byte("NAK\n")):
+		return false, nil
+	case bytes.HasPrefix(line, []byte("ERR ")):
+		return false, fmt.Errorf("remote error: %s", bytes.TrimSpace(line[4:]))
+	default:
+		return false, fmt.Errorf("unexpected response %q", line)
+	}
+}
+
+// Client side of the fetch command of protocol version 2.
+
+// readUploadPackAdvertisement reads the capabilities advertised by a server
+// of protocol version 2, or else the references and capabilities of version
+// 0, which servers respond with if they do not support version 2. V2 is nil
+// for version 0.
+func readUploadPackAdvertisement(r *bufio.Reader) (refs []*Ref, caps []string, v2 map[string]string, err error) {
+	const versionLine = "000eversion 2\n"
+	if line, err := r.Peek(len(versionLine)); err == nil && string(line) == versionLine {
+		v2, err = readCapabilityAdvertisement(r)
+		return nil, nil, v2, err
+	}
+	refs, caps, err = readAdvertisement(r)
+	return refs, caps, nil, err
+}
+
+// listRefsV2 lists the remote references with the prefixes, the ones with
+// any name if there are none.
+func listRefsV2(w io.Writer, r io.Reader, prefixes []string) ([]*Ref, error) {
+	if err := writeLsRefsRequest(w, prefixes); err != nil {
+		return nil, err
+	}
+	return readLsRefsResponse(r)
+}
+
+// fetchPackV2 is fetchPack over protocol version 2. Each round of
+// negotiation is a separate fetch command, which repeats the wants and the
+// commits acknowledged as common so far.
+func fetchPackV2(w io.Writer, r *bufio.Reader, local *Repository, wants, tips [][]byte) error {
+	if tips == nil {
+		refs, err := local.ListRefs()
+		if err != nil {
+			return err
+		}
+		for _, sha := range refs {
+			tips = append(tips, sha)
+		}
+	}
+	algorithm, _ := local.config.Get("fetch", "", "negotiationAlgorithm")
+	n, err := local.newNegotiator(algorithm, tips)
+	if err != nil {
+		return fmt.Errorf("negotiate: %w", err)
+	}
+	var common [][]byte
+	request := func(haves [][]byte, done bool) error {
+		var b bytes.Buffer
+		writePktLine(&b, "command=fetch\n")
+		writePktLine(&b, "agent=gogit\n")
+		writeDelimPkt(&b)
+		writePktLine(&b, "thin-pack\n")
+		writePktLine(&b, "ofs-delta\n")
+		writePktLine(&b, "no-progress\n")
+		for _, sha := range wants {
+			writePktLine(&b, "want %x\n", sha)
+		}
+		for _, sha := range common {
+			writePktLine(&b, "have %x\n", sha)
+		}
+		for _, sha := range haves {
+			writePktLine(&b, "have %x\n", sha)
+		}
+		if done {
+			writePktLine(&b, "done\n")
+		}
+		writeFlushPkt(&b)
+		if _, err := w.Write(b.Bytes()); err != nil {
+			return fmt.Errorf("send fetch request: %w", err)
+		}
+		return nil
+	}
+
+	// Same as in version 0, negotiation stops at the first common
+	// commits, unless the server is ready to send the pack sooner.
+	ready := false
+	for !ready && len(common) == 0 {
+		var haves [][]byte
+		for len(haves) < haveBatchSize {
+			sha, err := n.next()
+			if err != nil {
+				return fmt.Errorf("negotiate: %w", err)
+			}
+			if sha == nil {
+				break
+			}
+			haves = append(haves, sha)
+		}
+		if len(haves) == 0 {
+			break
+		}
+		if err := request(haves, false); err != nil {
+			return err
+		}
+		var acked [][]byte
+		if acked, ready, err = readAcknowledgments(r); err != nil {
+			return err
+		}
+		common = append(common, acked...)
+	}
+	if !ready {
+		if err := request(nil, true); err != nil {
+			return err
+		}
+	}
+	switch line, err := readPktLine(r); {
+	case err != nil:
+		return fmt.Errorf("read fetch response: %w", err)
+	case bytes.HasPrefix(line, []byte("ERR ")):
+		return fmt.Errorf("remote error: %s", bytes.TrimSpace(line[4:]))
+	case string(line) != "packfile\n":
+		return fmt.Errorf("unexpected fetch response section %q", line)
+	}
+
+	pack := &sidebandReader{r: r}
+	return receiveObjects(local, wants, "fetch", func(incoming *Repository) error {
+		if err := incoming.storeFetchedPack(pack); err != nil {
+			return err
+		}
+		// The section ends with a flush packet after the pack.
+		_, err := io.Copy(ioutil.Discard, pack)
+		return err
+	}, nil)
+}
+
+// readAcknowledgments reads the acknowledgments section of a fetch response
+// and returns the commits acknowledged as common. Ready is true if the pack
+// follows in the same response.
+func readAcknowledgments(r io.Reader) (acked [][]byte, ready bool, err error) {
+	line, err := readPktLine(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("read acknowledgments: %w", err)
+	}
+	if string(line) != "acknowledgments\n" {
+		if bytes.HasPrefix(line, []byte("ERR ")) {
+			return nil, false, fmt.Errorf("remote error: %s", bytes.TrimSpace(line[4:]))
+		}
+		return nil, false, fmt.Errorf("unexpected fetch response section %q", line)
+	}
+	for {
+		line, err := readPktLine(r)
+		switch {
+		case err == errDelimPkt:
+			// The pack follows.
+			return acked, ready, nil
+		case err != nil:
+			return nil, false, fmt.Errorf("read acknowledgments: %w", err)
+		case line == nil:
+			return acked, ready, nil
+		}
+		s := strings.TrimSuffix(string(line), "\n")
+		switch {
+		case s == "NAK":
+		case s == "ready":
+			ready = true
+		case strings.HasPrefix(s, "ACK "):
+			sha, err := hex.DecodeString(s[4:])
+			if err != nil || len(sha) != 20 {
+				return nil, false, fmt.Errorf("invalid acknowledgment %q", s)
+			}
+			acked = append(acked, sha)
+		default:
+			return nil, false, fmt.Errorf("unexpected acknowledgment %q", s)
+		}
+	}
+}
+
+// sidebandReader reads the data of a side-band-64k stream that ends with a
+// flush packet. Progress messages are dropped.
+type sidebandReader struct {
+	r    io.Reader
+	data []byte
+	eof  bool
+}
+
+func (s *sidebandReader) Read(p []byte) (int, error) {
+	for len(s.data) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		line, err := readPktLine(s.r)
+		if err != nil {
+			return 0, fmt.Errorf("read side band: %w", err)
+		}
+		if line == nil {
+			s.eof = true
+			continue
+		}
+		if len(line) == 0 {
+			return 0, errors.New("read side band: empty packet")
+		}
+		switch line[0] {
+		case 1:
+			s.data = line[1:]
+		case 2:
+			// Progress.
+		case 3:
+			return 0, fmt.Errorf("remote error: %s", bytes.TrimSpace(line[1:]))
+		default:
+			return 0, fmt.Errorf("read side band: invalid band %d", line[0])
+		}
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// filePattern is a pattern of a gitignore or gitattributes file, which
+// share the same syntax.
+type filePattern struct {
+	// dir is the directory of the file relative to the worktree root,
+	// empty for the root and for files outside the worktree.
+	dir     string
+	pattern string
+	// basename patterns have no slash and match the file name at any
+	// depth below dir.
+	basename bool
+	// dirOnly patterns end with a slash and match only directories.
+	dirOnly bool
+}
+
+// parseFilePattern parses a pattern of a file found in dir. False is
+// returned if the pattern is empty.
+func parseFilePattern(pattern, dir string) (filePattern, bool) {
+	p := filePattern{dir: dir}
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if pattern == "" {
+		return p, false
+	}
+	if strings.Contains(pattern, "/") {
+		p.pattern = strings.TrimPrefix(pattern, "/")
+	} else {
+		p.pattern = pattern
+		p.basename = true
+	}
+	return p, true
+}
+
+// match returns true if the pattern applies to the path relative to the
+// worktree root. Paths of directories end with a slash.
+func (p *filePattern) match(name string) bool {
+	if strings.HasSuffix(name, "/") {
+		name = strings.TrimSuffix(name, "/")
+	} else if p.dirOnly {
+		return false
+	}
+	if p.dir != "" {
+		if !strings.HasPrefix(name, p.dir+"/") {
+			return false
+		}
+		name = name[len(p.dir)+1:]
+	}
+	if p.basename {
+		return wildmatch(p.pattern, path.Base(name), false)
+	}
+	return wildmatch(p.pattern, name, true)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+// fixtureShape describes a generated repository. The same shape always
+// generates the same objects.
+type fixtureShape struct {
+	Seed    int64
+	Commits int
+	// Branches is the number of lines of history that commits are added
+	// to. The first branch is master.
+	Branches int
+	// MergeRate is the probability that a commit merges another branch.
+	MergeRate float64
+	// Files is the number of files changed by every commit, Paths the
+	// number of distinct paths and MaxFileSize the limit of the size of
+	// their content.
+	Files       int
+	Paths       int
+	MaxFileSize int
+	// MaxDepth is the limit of the number of directories of a path.
+	MaxDepth int
+}
+
+// defaultFixtureShape is a small history with a few branches and merges.
+var defaultFixtureShape = fixtureShape{
+	Seed:        1,
+	Commits:     50,
+	Branches:    3,
+	MergeRate:   0.2,
+	Files:       2,
+	Paths:       20,
+	MaxFileSize: 256,
+	MaxDepth:    3,
+}
+
+// fixture is a repository generated by buildFixture.
+type fixture struct {
+	Repo *Repository
+	// Commits are in the order they were created, so that every commit
+	// comes after its parents.
+	Commits [][]byte
+	// Branches are tips of the branches by the reference name.
+	Branches map[string][]byte
+}
+
+// newTestRepository creates a repository in a temporary directory, which
+// is removed when the test ends.
+func newTestRepository(tb testing.TB) *Repository {
+	tb.Helper()
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		tb.Fatalf("temp dir: %s", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	repo, err := CreateRepository(dir)
+	if err != nil {
+		tb.Fatalf("create repository: %s", err)
+	}
+	return repo
+}
+
+// buildFixture creates a repository in a temporary directory and fills it
+// with a history of the shape.
+func buildFixture(tb testing.TB, shape fixtureShape) *fixture {
+	tb.Helper()
+	f := &fixture{Repo: newTestRepository(tb), Branches: make(map[string][]byte)}
+	if err := f.generate(shape); err != nil {
+		tb.Fatalf("generate fixture: %s", err)
+	}
+	return f
+}
+
+func (f *fixture) generate(shape fixtureShape) error {
+	rnd := rand.New(rand.NewSource(shape.Seed))
+	paths := make([]string, shape.Paths)
+	for i := range paths {
+		path := ""
+		for d := rnd.Intn(shape.MaxDepth + 1); d > 0; d-- {
+			path += fmt.Sprintf("dir%d/", rnd.Intn(3))
+		}
+		paths[i] = path + fmt.Sprintf("file%d.txt", i)
+	}
+
+	type branch struct {
+		name  string
+		tip   []byte
+		files map[string][]byte
+	}
+	branches := make([]*branch, shape.Branches)
+	for i := range branches {
+		name := "refs/heads/master"
+		if i > 0 {
+			name = fmt.Sprintf("refs/heads/branch%d", i)
+		}
+		branches[i] = &branch{name: name, files: make(map[string][]byte)}
+	}
+
+	for i := 0; i < shape.Commits; i++ {
+		b := branches[rnd.Intn(len(branches))]
+		var parents [][]byte
+		if b.tip != nil {
+			parents = append(parents, b.tip)
+		} else if i > 0 {
+			// New branches start at the first commit of master.
+			b.tip = f.Commits[0]
+			parents = append(parents, b.tip)
+			for path, sha := range branches[0].files {
+				b.files[path] = sha
+			}
+		}
+		message := fmt.Sprintf("commit %d", i)
+		if other := branches[rnd.Intn(len(branches))]; rnd.Float64() < shape.MergeRate && other != b && other.tip != nil && b.tip != nil {
+			parents = append(parents, other.tip)
+			message = fmt.Sprintf("merge %s into %s", other.name, b.name)
+			for path, sha := range other.files {
+				b.files[path] = sha
+			}
+		}
+		for j := 0; j < shape.Files; j++ {
+			content := make([]byte, rnd.Intn(shape.MaxFileSize)+1)
+			rnd.Read(content)
+			sha, err := f.Repo.WriteObject("blob", content)
+			if err != nil {
+				return err
+			}
+			b.files[paths[rnd.Intn(len(paths))]] = sha
+		}
+
+		sorted := make([]string, 0, len(b.files))
+		for path := range b.files {
+			sorted = append(sorted, path)
+		}
+		sort.Strings(sorted)
+		tb := NewTreeBuilder(f.Repo, nil)
+		for _, path := range sorted {
+			if err := tb.Insert(path, modeBlob, b.files[path]); err != nil {
+				return err
+			}
+		}
+		tree, err := tb.Write()
+		if err != nil {
+			return err
+		}
+		ident := fmt.Sprintf("Test <test@example.com> %d +0000", 1600000000+i*60)
+		header := map[string][]string{
+			"tree":      {fmt.Sprintf("%x", tree)},
+			"author":    {ident},
+			"committer": {ident},
+		}
+		for _, p := range parents {
+			header["parent"] = append(header["parent"], fmt.Sprintf("%x", p))
+		}
+		raw, err := (&CommitObject{Header: header, Comment: message + "\n"}).Serialize()
+		if err != nil {
+			return err
+		}
+		sha, err := f.Repo.WriteObject("commit", raw)
+		if err != nil {
+			return err
+		}
+		f.Commits = append(f.Commits, sha)
+		b.tip = sha
+	}
+
+	var updates []*RefUpdate
+	for _, b := range branches {
+		if b.tip != nil {
+			f.Branches[b.name] = b.tip
+			updates = append(updates, &RefUpdate{Name: b.name, Sha: b.tip})
+		}
+	}
+	return f.Repo.UpdateRefs(updates...)
+}
+
+func TestBuildFixture(t *testing.T) {
+	first := buildFixture(t, defaultFixtureShape)
+	second := buildFixture(t, defaultFixtureShape)
+
+	if len(first.Commits) != defaultFixtureShape.Commits {
+		t.Fatalf("want %d commits, got %d", defaultFixtureShape.Commits, len(first.Commits))
+	}
+	if fmt.Sprintf("%x", first.Commits) != fmt.Sprintf("%x", second.Commits) {
+		t.Fatal("fixtures of the same shape differ")
+	}
+	if len(first.Branches) != defaultFixtureShape.Branches {
+		t.Errorf("want %d branches, got %d", defaultFixtureShape.Branches, len(first.Branches))
+	}
+
+	merges := 0
+	for _, sha := range first.Commits {
+		c, err := first.Repo.readCommit(sha)
+		if err != nil {
+			t.Fatalf("read commit: %s", err)
+		}
+		if len(c.Header["parent"]) > 1 {
+			merges++
+		}
+	}
+	if merges == 0 {
+		t.Error("no merge commits")
+	}
+	var tips [][]byte
+	for _, sha := range first.Branches {
+		tips = append(tips, sha)
+	}
+	if err := first.Repo.CheckConnectivity(tips); err != nil {
+		t.Fatalf("check connectivity: %s", err)
+	}
+
+	shape := defaultFixtureShape
+	shape.Seed++
+	other := buildFixture(t, shape)
+	if fmt.Sprintf("%x", first.Commits) == fmt.Sprintf("%x", other.Commits) {
+		t.Fatal("fixtures of different seeds are the same")
+	}
+}
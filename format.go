@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// repositoryFormatVersion is the highest core.repositoryformatversion that
+// is understood. Version 1 repositories can require extensions, which must
+// all be known.
+const repositoryFormatVersion = 1
+
+// Repository extensions by the lower case name, with the values that are
+// supported, or nil if any value is. Extensions that are not v1 only were
+// already honored by version 0 repositories, before extensions were
+// introduced.
+var repositoryExtensions = map[string]struct {
+	v1Only bool
+	values []string
+}{
+	"noop":           {},
+	"noop-v1":        {v1Only: true},
+	"objectformat":   {v1Only: true, values: []string{"sha1"}},
+	"refstorage":     {v1Only: true, values: []string{"files", "reftable"}},
+	"worktreeconfig": {},
+}
+
+// RepositoryFormat is the layout of the repository data, declared by the
+// core.repositoryformatversion and extensions.* settings of the repository
+// configuration.
+type RepositoryFormat struct {
+	Version int
+	// Extensions are values of the extensions section by the lower case
+	// name. Extensions without a value are set to "true".
+	Extensions map[string]string
+}
+
+// Format returns the format of the repository, which tells the extensions
+// it was opened with.
+func (r *Repository) Format() *RepositoryFormat {
+	return r.format
+}
+
+// readRepositoryFormat reads the format of the repository from the
+// configuration file of the git directory. Global configuration has no
+// effect on the format.
+func readRepositoryFormat(gitdir string) (*RepositoryFormat, error) {
+	config, err := ReadConfigFile(filepath.Join(gitdir, "config"))
+	if err != nil {
+		return nil, err
+	}
+	return parseRepositoryFormat(config)
+}
+
+// parseRepositoryFormat returns the format declared by the configuration.
+// An error is returned for a format that cannot be safely read: a version
+// that is too new, an extension that is not known or has a value that is not
+// supported, or an extension of version 1 in a version 0 repository.
+func parseRepositoryFormat(config *Config) (*RepositoryFormat, error) {
+	f := &RepositoryFormat{Extensions: make(map[string]string)}
+	if raw, ok := config.Get("core", "", "repositoryFormatVersion"); ok {
+		version, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid core.repositoryformatversion %q", raw)
+		}
+		f.Version = version
+	}
+	if f.Version > repositoryFormatVersion {
+		return nil, fmt.Errorf("expected git repo version <= %d, found %d", repositoryFormatVersion, f.Version)
+	}
+
+	var unknown, v1Only []string
+	for _, e := range config.Entries {
+		if e.Section != "extensions" || e.Subsection != "" {
+			continue
+		}
+		value := e.Value
+		if e.NoValue {
+			value = "true"
+		}
+		f.Extensions[e.Key] = value
+	}
+	for name, value := range f.Extensions {
+		ext, ok := repositoryExtensions[name]
+		switch {
+		case !ok:
+			unknown = append(unknown, name)
+		case ext.v1Only && f.Version == 0:
+			v1Only = append(v1Only, name)
+		case ext.values != nil && !containsFold(ext.values, value):
+			return nil, fmt.Errorf("unsupported extensions.%s value %q", name, value)
+		}
+	}
+	if f.Version == 0 {
+		// Version 0 repositories predate extensions, so that unknown
+		// ones are not a requirement.
+		for _, name := range unknown {
+			delete(f.Extensions, name)
+		}
+		unknown = nil
+		if len(v1Only) > 0 {
+			sort.Strings(v1Only)
+			return nil, fmt.Errorf("repo version is 0, but v1-only extension found: %s", strings.Join(v1Only, ", "))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown repository extension found: %s", strings.Join(unknown, ", "))
+	}
+	return f, nil
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Extension returns the value of the extension with given name, in any
+// letter case.
+func (f *RepositoryFormat) Extension(name string) (string, bool) {
+	value, ok := f.Extensions[strings.ToLower(name)]
+	return value, ok
+}
+
+// ObjectFormat returns the hash algorithm of object names.
+func (f *RepositoryFormat) ObjectFormat() string {
+	if format, ok := f.Extension("objectFormat"); ok {
+		return strings.ToLower(format)
+	}
+	return "sha1"
+}
+
+// RefStorage returns the backend that references are stored in.
+func (f *RepositoryFormat) RefStorage() string {
+	if storage, ok := f.Extension("refStorage"); ok {
+		return strings.ToLower(storage)
+	}
+	return "files"
+}
+
+// WorktreeConfig returns true if the config.worktree file of the git
+// directory is read in addition to the repository configuration.
+func (f *RepositoryFormat) WorktreeConfig() bool {
+	value, ok := f.Extension("worktreeConfig")
+	if !ok {
+		return false
+	}
+	on, err := parseConfigBool(value)
+	return err == nil && on
+}
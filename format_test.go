@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRepositoryFormat(t *testing.T) {
+	cases := map[string]struct {
+		config     string
+		wantErr    bool
+		want       map[string]string
+		refStorage string
+	}{
+		"default": {
+			config:     "[core]\nbare = false\n",
+			want:       map[string]string{},
+			refStorage: "files",
+		},
+		"version 0 ignores unknown extensions": {
+			config:     "[core]\nrepositoryformatversion = 0\n[extensions]\nfuture = yes\nworktreeConfig\n",
+			want:       map[string]string{"worktreeconfig": "true"},
+			refStorage: "files",
+		},
+		"version 0 with a version 1 extension": {
+			config:  "[core]\nrepositoryformatversion = 0\n[extensions]\nobjectFormat = sha1\n",
+			wantErr: true,
+		},
+		"version 1 extensions": {
+			config:     "[core]\nrepositoryformatversion = 1\n[extensions]\nobjectFormat = sha1\nrefStorage = reftable\n",
+			want:       map[string]string{"objectformat": "sha1", "refstorage": "reftable"},
+			refStorage: "reftable",
+		},
+		"version 1 unknown extension": {
+			config:  "[core]\nrepositoryformatversion = 1\n[extensions]\nfuture = yes\n",
+			wantErr: true,
+		},
+		"unsupported object format": {
+			config:  "[core]\nrepositoryformatversion = 1\n[extensions]\nobjectFormat = sha256\n",
+			wantErr: true,
+		},
+		"unsupported reference storage": {
+			config:  "[core]\nrepositoryformatversion = 1\n[extensions]\nrefStorage = sql\n",
+			wantErr: true,
+		},
+		"version too new": {
+			config:  "[core]\nrepositoryformatversion = 2\n",
+			wantErr: true,
+		},
+		"invalid version": {
+			config:  "[core]\nrepositoryformatversion = one\n",
+			wantErr: true,
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			config, err := ParseConfig(strings.NewReader(tc.config))
+			if err != nil {
+				t.Fatalf("parse config: %s", err)
+			}
+			format, err := parseRepositoryFormat(config)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %+v", format)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse format: %s", err)
+			}
+			if !reflect.DeepEqual(format.Extensions, tc.want) {
+				t.Errorf("want extensions %v, got %v", tc.want, format.Extensions)
+			}
+			if got := format.RefStorage(); got != tc.refStorage {
+				t.Errorf("want %q reference storage, got %q", tc.refStorage, got)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"syscall"
 )
 
 func isDir(path string) (bool, error) {
@@ -16,3 +17,9 @@ func isDir(path string) (bool, error) {
 		return false, fmt.Errorf("stat: %w", err)
 	}
 }
+
+// isNotDir returns true if err was caused by a path component that is not
+// a directory.
+func isNotDir(err error) bool {
+	return errors.Is(err, syscall.ENOTDIR)
+}
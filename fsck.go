@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// fsckSeverity is how a problem found in an object is treated.
+type fsckSeverity int
+
+const (
+	fsckIgnore fsckSeverity = iota
+	// fsckInfo problems are reported, but never make a check fail, not
+	// even a strict one.
+	fsckInfo
+	fsckWarn
+	fsckError
+)
+
+func (s fsckSeverity) String() string {
+	switch s {
+	case fsckInfo, fsckWarn:
+		// Like git, information is reported as a warning.
+		return "warning"
+	case fsckError:
+		return "error"
+	}
+	return "ignore"
+}
+
+// fsckMessages are the default severities of problems, by the message ids
+// git fsck uses. badEncoding is not known to git.
+var fsckMessages = map[string]fsckSeverity{
+	"badDate":                 fsckError,
+	"badDateOverflow":         fsckError,
+	"badEmail":                fsckError,
+	"badEncoding":             fsckWarn,
+	"badFilemode":             fsckInfo,
+	"badName":                 fsckError,
+	"badObjectSha1":           fsckError,
+	"badParentSha1":           fsckError,
+	"badTimezone":             fsckError,
+	"badTree":                 fsckError,
+	"badTreeSha1":             fsckError,
+	"badType":                 fsckError,
+	"duplicateEntries":        fsckError,
+	"emptyName":               fsckWarn,
+	"fullPathname":            fsckWarn,
+	"hasDot":                  fsckWarn,
+	"hasDotdot":               fsckWarn,
+	"hasDotgit":               fsckWarn,
+	"missingAuthor":           fsckError,
+	"missingCommitter":        fsckError,
+	"missingEmail":            fsckError,
+	"missingNameBeforeEmail":  fsckError,
+	"missingObject":           fsckError,
+	"missingSpaceBeforeDate":  fsckError,
+	"missingSpaceBeforeEmail": fsckError,
+	"missingTagEntry":         fsckError,
+	"missingTree":             fsckError,
+	"missingTypeEntry":        fsckError,
+	"multipleAuthors":         fsckError,
+	"nulInCommit":             fsckWarn,
+	"nulInHeader":             fsckError,
+	"nullSha1":                fsckWarn,
+	"treeNotSorted":           fsckError,
+	"unterminatedHeader":      fsckError,
+	"zeroPaddedDate":          fsckError,
+	"zeroPaddedFilemode":      fsckWarn,
+}
+
+// FsckProblem is a malformation found in an object.
+type FsckProblem struct {
+	ID       string
+	Severity fsckSeverity
+	Message  string
+}
+
+func (p *FsckProblem) String() string {
+	return p.ID + ": " + p.Message
+}
+
+// FsckError is returned for an object with problems that are errors.
+type FsckError struct {
+	Kind     string
+	Sha      []byte
+	Problems []*FsckProblem
+}
+
+func (e *FsckError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.String())
+	}
+	return fmt.Sprintf("error in %s %x: %s", e.Kind, e.Sha, strings.Join(msgs, ", "))
+}
+
+// fsckChecker checks objects with the severities configured for a command.
+type fsckChecker struct {
+	// severities are the configured severities, by lower cased id.
+	severities map[string]fsckSeverity
+	// strict makes warnings errors, unless their severity is configured,
+	// and rejects file modes git tolerates in old trees.
+	strict bool
+}
+
+// fsckChecker returns a checker configured with the fsck.<msg-id> settings,
+// or with <section>.fsck.<msg-id> ones if section is not empty, for example
+// "receive" or "fetch".
+func (r *Repository) fsckChecker(section string, strict bool) (*fsckChecker, error) {
+	ids := make(map[string]string, len(fsckMessages))
+	for id := range fsckMessages {
+		ids[strings.ToLower(id)] = id
+	}
+	configSection, subsection := "fsck", ""
+	if section != "" {
+		configSection, subsection = section, "fsck"
+	}
+	c := &fsckChecker{severities: make(map[string]fsckSeverity), strict: strict}
+	for _, e := range r.config.Entries {
+		if e.Section != configSection || e.Subsection != subsection || e.Key == "skiplist" {
+			continue
+		}
+		if _, ok := ids[e.Key]; !ok {
+			return nil, fmt.Errorf("%s: unknown message id", e.Name())
+		}
+		switch strings.ToLower(e.Value) {
+		case "error":
+			c.severities[e.Key] = fsckError
+		case "warn":
+			c.severities[e.Key] = fsckWarn
+		case "ignore":
+			c.severities[e.Key] = fsckIgnore
+		default:
+			return nil, fmt.Errorf("%s: invalid severity %q", e.Name(), e.Value)
+		}
+	}
+	return c, nil
+}
+
+// problems returns the problems found in the object, with their severity
+// set. Ignored problems are left out.
+func (c *fsckChecker) problems(kind string, content []byte) []*FsckProblem {
+	var found []*FsckProblem
+	switch kind {
+	case "tree":
+		found = fsckTree(content, c.strict)
+	case "commit":
+		found = fsckCommit(content)
+	case "tag":
+		found = fsckTag(content)
+	}
+	problems := found[:0]
+	for _, p := range found {
+		severity, ok := c.severities[strings.ToLower(p.ID)]
+		if !ok {
+			severity = fsckMessages[p.ID]
+			if c.strict && severity == fsckWarn {
+				severity = fsckError
+			}
+		}
+		if severity != fsckIgnore {
+			p.Severity = severity
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// verify returns a *FsckError if the object has problems that are errors.
+func (c *fsckChecker) verify(kind string, sha, content []byte) error {
+	var errs []*FsckProblem
+	for _, p := range c.problems(kind, content) {
+		if p.Severity == fsckError {
+			errs = append(errs, p)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &FsckError{Kind: kind, Sha: sha, Problems: errs}
+}
+
+// verifyNewObject checks an object before it is written, so that trees and
+// commits created by the repository are never malformed. Only errors fail,
+// the way they do for git fsck without --strict.
+func (r *Repository) verifyNewObject(kind string, content []byte) error {
+	c, err := r.fsckChecker("", false)
+	if err != nil {
+		return err
+	}
+	return c.verify(kind, hashObject(kind, content), content)
+}
+
+// fsckObjectsEnabled tells whether objects received by fetch or receive,
+// given as section, are checked: <section>.fsckObjects, which defaults to
+// transfer.fsckObjects.
+func (r *Repository) fsckObjectsEnabled(section string) (bool, error) {
+	def, err := r.config.Bool("transfer", "", "fsckObjects", false)
+	if err != nil {
+		return false, err
+	}
+	return r.config.Bool(section, "", "fsckObjects", def)
+}
+
+// fsckReceived strictly checks objects reachable from tips that known does
+// not have, if enabled for the section. Known can be nil to check all of
+// them.
+func (r *Repository) fsckReceived(tips [][]byte, known *Repository, section string) error {
+	if ok, err := r.fsckObjectsEnabled(section); err != nil || !ok {
+		return err
+	}
+	c, err := r.fsckChecker(section, true)
+	if err != nil {
+		return err
+	}
+	return r.WalkObjects(tips, func(o *WalkedObject) error {
+		if known != nil {
+			if ok, err := known.HasObject(o.Sha); err != nil {
+				return err
+			} else if ok {
+				return SkipObject
+			}
+		}
+		if o.Missing || o.Kind == "blob" {
+			return nil
+		}
+		kind, content, err := r.ReadRawObject(o.Sha)
+		if err != nil {
+			return err
+		}
+		return c.verify(kind, o.Sha, content)
+	})
+}
+
+// fsckTree checks the raw content of a tree. Every problem is reported
+// once, even if several entries have it.
+func fsckTree(content []byte, strict bool) []*FsckProblem {
+	var problems []*FsckProblem
+	reported := make(map[string]bool)
+	report := func(id, msg string) {
+		if !reported[id] {
+			reported[id] = true
+			problems = append(problems, &FsckProblem{ID: id, Message: msg})
+		}
+	}
+	var prev, prevSortName string
+	for rest, first := content, true; len(rest) != 0; first = false {
+		sp := bytes.IndexByte(rest, ' ')
+		nul := bytes.IndexByte(rest, 0)
+		if sp <= 0 || nul < sp || len(rest) < nul+21 {
+			report("badTree", "cannot be parsed as a tree")
+			return problems
+		}
+		rawMode, name, sha := string(rest[:sp]), string(rest[sp+1:nul]), rest[nul+1:nul+21]
+		rest = rest[nul+21:]
+		mode, err := strconv.ParseUint(rawMode, 8, 32)
+		if err != nil {
+			report("badTree", "cannot be parsed as a tree")
+			return problems
+		}
+		if rawMode[0] == '0' {
+			report("zeroPaddedFilemode", "contains zero-padded file modes")
+		}
+		switch mode {
+		case 0100644, 0100755, 0120000, 040000, 0160000:
+		case 0100664:
+			// Written by early versions of git.
+			if strict {
+				report("badFilemode", "contains bad file modes")
+			}
+		default:
+			report("badFilemode", "contains bad file modes")
+		}
+		switch {
+		case name == "":
+			report("emptyName", "contains empty pathname")
+		case strings.Contains(name, "/"):
+			report("fullPathname", "contains full pathnames")
+		case name == ".":
+			report("hasDot", "contains '.'")
+		case name == "..":
+			report("hasDotdot", "contains '..'")
+		case strings.EqualFold(name, ".git"):
+			report("hasDotgit", "contains '.git'")
+		}
+		if bytes.Equal(sha, make([]byte, 20)) {
+			report("nullSha1", "contains entries pointing to null sha1")
+		}
+		sortName := name
+		if mode == 040000 {
+			sortName += "/"
+		}
+		switch {
+		case first:
+		case name == prev:
+			report("duplicateEntries", "contains duplicate file entries")
+		case sortName <= prevSortName:
+			report("treeNotSorted", "not properly sorted")
+		}
+		prev, prevSortName = name, sortName
+	}
+	return problems
+}
+
+// fsckCommit checks the raw content of a commit. Like git, it stops at the
+// first malformed header.
+func fsckCommit(content []byte) []*FsckProblem {
+	if p := fsckHeaders(content); p != nil {
+		return []*FsckProblem{p}
+	}
+	rd := &fsckHeaderReader{rest: string(content)}
+	tree, ok := rd.next("tree")
+	if !ok {
+		return fsckProblem("missingTree", "invalid format - expected 'tree' line")
+	}
+	if !isHexHash(tree) {
+		return fsckProblem("badTreeSha1", "invalid 'tree' line format - bad sha1")
+	}
+	for {
+		parent, ok := rd.next("parent")
+		if !ok {
+			break
+		}
+		if !isHexHash(parent) {
+			return fsckProblem("badParentSha1", "invalid 'parent' line format - bad sha1")
+		}
+	}
+	author, ok := rd.next("author")
+	if !ok {
+		return fsckProblem("missingAuthor", "invalid format - expected 'author' line")
+	}
+	if p := fsckIdent(author); p != nil {
+		return []*FsckProblem{p}
+	}
+	if _, ok := rd.next("author"); ok {
+		return fsckProblem("multipleAuthors", "invalid format - multiple 'author' lines")
+	}
+	committer, ok := rd.next("committer")
+	if !ok {
+		return fsckProblem("missingCommitter", "invalid format - expected 'committer' line")
+	}
+	if p := fsckIdent(committer); p != nil {
+		return []*FsckProblem{p}
+	}
+
+	var problems []*FsckProblem
+	encoding, hasEncoding := "", false
+	for !rd.done() {
+		key, value := rd.header()
+		if key == "encoding" {
+			if hasEncoding || value == "" || strings.ContainsAny(value, " \t\n") {
+				problems = append(problems, &FsckProblem{ID: "badEncoding", Message: "invalid 'encoding' line"})
+			}
+			encoding, hasEncoding = value, true
+		}
+	}
+	message := rd.body()
+	if strings.IndexByte(message, 0) >= 0 {
+		problems = append(problems, &FsckProblem{ID: "nulInCommit", Message: "NUL byte in the commit object body"})
+	}
+	if !hasEncoding || strings.EqualFold(encoding, "utf-8") || strings.EqualFold(encoding, "utf8") {
+		if !utf8.ValidString(message) {
+			problems = append(problems, &FsckProblem{ID: "badEncoding", Message: "message is not valid UTF-8"})
+		}
+	}
+	return problems
+}
+
+// fsckTag checks the raw content of an annotated tag.
+func fsckTag(content []byte) []*FsckProblem {
+	if p := fsckHeaders(content); p != nil {
+		return []*FsckProblem{p}
+	}
+	rd := &fsckHeaderReader{rest: string(content)}
+	object, ok := rd.next("object")
+	if !ok {
+		return fsckProblem("missingObject", "invalid format - expected 'object' line")
+	}
+	if !isHexHash(object) {
+		return fsckProblem("badObjectSha1", "invalid 'object' line format - bad sha1")
+	}
+	kind, ok := rd.next("type")
+	if !ok {
+		return fsckProblem("missingTypeEntry", "invalid format - expected 'type' line")
+	}
+	switch kind {
+	case "commit", "tree", "blob", "tag":
+	default:
+		return fsckProblem("badType", "invalid 'type' value")
+	}
+	if _, ok := rd.next("tag"); !ok {
+		return fsckProblem("missingTagEntry", "invalid format - expected 'tag' line")
+	}
+	if tagger, ok := rd.next("tagger"); ok {
+		if p := fsckIdent(tagger); p != nil {
+			return []*FsckProblem{p}
+		}
+	}
+	return nil
+}
+
+func fsckProblem(id, msg string) []*FsckProblem {
+	return []*FsckProblem{{ID: id, Message: msg}}
+}
+
+// fsckHeaders checks that the headers of a commit or a tag are terminated
+// and have no NUL bytes.
+func fsckHeaders(content []byte) *FsckProblem {
+	end := bytes.Index(content, []byte("\n\n"))
+	if end < 0 {
+		end = len(content)
+		if end == 0 || content[end-1] != '\n' {
+			return &FsckProblem{ID: "unterminatedHeader", Message: "unterminated header"}
+		}
+	}
+	if i := bytes.IndexByte(content[:end], 0); i >= 0 {
+		return &FsckProblem{ID: "nulInHeader", Message: fmt.Sprintf("unterminated header: NUL at offset %d", i)}
+	}
+	return nil
+}
+
+// fsckHeaderReader reads header lines of a commit or a tag in order.
+type fsckHeaderReader struct {
+	rest string
+}
+
+// next returns the value of the next header if it has the key.
+func (rd *fsckHeaderReader) next(key string) (string, bool) {
+	if !strings.HasPrefix(rd.rest, key+" ") {
+		return "", false
+	}
+	_, value := rd.header()
+	return value, true
+}
+
+// header returns the next header, with its continuation lines.
+func (rd *fsckHeaderReader) header() (string, string) {
+	line := rd.rest
+	end := strings.IndexByte(line, '\n')
+	for end >= 0 && end+1 < len(line) && line[end+1] == ' ' {
+		next := strings.IndexByte(line[end+1:], '\n')
+		if next < 0 {
+			end = -1
+			break
+		}
+		end += 1 + next
+	}
+	if end < 0 {
+		end = len(line)
+		rd.rest = ""
+	} else {
+		rd.rest = line[end+1:]
+	}
+	line = line[:end]
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return line, ""
+}
+
+// done tells whether all headers were read.
+func (rd *fsckHeaderReader) done() bool {
+	return rd.rest == "" || rd.rest[0] == '\n'
+}
+
+// body returns the message following the headers.
+func (rd *fsckHeaderReader) body() string {
+	return strings.TrimPrefix(rd.rest, "\n")
+}
+
+// fsckIdent checks an author, committer or tagger line the way git does.
+func fsckIdent(s string) *FsckProblem {
+	bad := func(id, msg string) *FsckProblem {
+		return &FsckProblem{ID: id, Message: "invalid author/committer line - " + msg}
+	}
+	if strings.HasPrefix(s, "<") {
+		return bad("missingNameBeforeEmail", "missing name before email")
+	}
+	i := strings.IndexAny(s, "<>")
+	switch {
+	case i < 0:
+		return bad("missingEmail", "missing email")
+	case s[i] == '>':
+		return bad("badName", "bad name")
+	case s[i-1] != ' ':
+		return bad("missingSpaceBeforeEmail", "missing space before email")
+	}
+	s = s[i+1:]
+	if i = strings.IndexAny(s, "<>"); i < 0 || s[i] != '>' {
+		return bad("badEmail", "bad email")
+	}
+	s = s[i+1:]
+	if !strings.HasPrefix(s, " ") {
+		return bad("missingSpaceBeforeDate", "missing space before date")
+	}
+	s = s[1:]
+	digits := len(s) - len(strings.TrimLeft(s, "0123456789"))
+	if digits > 1 && s[0] == '0' {
+		return bad("zeroPaddedDate", "zero-padded date")
+	}
+	if digits == 0 || digits == len(s) || s[digits] != ' ' {
+		return bad("badDate", "bad date")
+	}
+	if _, err := strconv.ParseUint(s[:digits], 10, 64); err != nil {
+		return bad("badDateOverflow", "date causes integer overflow")
+	}
+	tz := s[digits+1:]
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') || strings.Trim(tz[1:], "0123456789") != "" {
+		return bad("badTimezone", "bad time zone")
+	}
+	return nil
+}
+
+// isHexHash tells whether s is a full hash in lower case hex.
+func isHexHash(s string) bool {
+	if len(s) != 40 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFsckObject(t *testing.T) {
+	sha := strings.Repeat("\x01", 20)
+	tree := "tree " + strings.Repeat("ab", 20) + "\n"
+	ident := "Test <test@example.com> 1600000000 +0000"
+	commit := tree + "author " + ident + "\ncommitter " + ident + "\n"
+	cases := map[string]struct {
+		kind    string
+		content string
+		strict  bool
+		want    []string
+	}{
+		"valid tree": {
+			kind:    "tree",
+			content: "100644 a\x00" + sha + "100644 b.c\x00" + sha + "40000 b\x00" + sha,
+		},
+		"tree sorted as directory": {
+			kind:    "tree",
+			content: "40000 b\x00" + sha + "100644 b.c\x00" + sha,
+			want:    []string{"treeNotSorted"},
+		},
+		"duplicate entries": {
+			kind:    "tree",
+			content: "100644 a\x00" + sha + "100755 a\x00" + sha,
+			want:    []string{"duplicateEntries"},
+		},
+		"truncated tree": {
+			kind:    "tree",
+			content: "100644 a\x00" + sha[:10],
+			want:    []string{"badTree"},
+		},
+		"bad names": {
+			kind:    "tree",
+			content: "40000 .\x00" + sha + "40000 .GIT\x00" + sha + "100644 a/b\x00" + sha,
+			want:    []string{"hasDot", "hasDotgit", "fullPathname"},
+		},
+		"modes": {
+			kind:    "tree",
+			content: "040000 a\x00" + sha + "100664 b\x00" + sha + "100600 c\x00" + sha,
+			want:    []string{"zeroPaddedFilemode", "badFilemode"},
+		},
+		"old mode strict": {
+			kind:    "tree",
+			content: "100664 a\x00" + sha,
+			strict:  true,
+			want:    []string{"badFilemode"},
+		},
+		"old mode": {
+			kind:    "tree",
+			content: "100664 a\x00" + sha,
+		},
+		"null sha": {
+			kind:    "tree",
+			content: "100644 a\x00" + strings.Repeat("\x00", 20),
+			want:    []string{"nullSha1"},
+		},
+		"valid commit": {
+			kind:    "commit",
+			content: commit + "\nsubject\n",
+		},
+		"commit without tree": {
+			kind:    "commit",
+			content: "author " + ident + "\ncommitter " + ident + "\n\nsubject\n",
+			want:    []string{"missingTree"},
+		},
+		"bad parent": {
+			kind:    "commit",
+			content: tree + "parent 1234\nauthor " + ident + "\ncommitter " + ident + "\n\nsubject\n",
+			want:    []string{"badParentSha1"},
+		},
+		"multiple authors": {
+			kind:    "commit",
+			content: tree + "author " + ident + "\nauthor " + ident + "\ncommitter " + ident + "\n\nsubject\n",
+			want:    []string{"multipleAuthors"},
+		},
+		"unterminated header": {
+			kind:    "commit",
+			content: strings.TrimSuffix(commit, "\n"),
+			want:    []string{"unterminatedHeader"},
+		},
+		"bad encoding header": {
+			kind:    "commit",
+			content: commit + "encoding \n\nsubject\n",
+			want:    []string{"badEncoding"},
+		},
+		"invalid utf-8": {
+			kind:    "commit",
+			content: commit + "\nsubj\xffect\n",
+			want:    []string{"badEncoding"},
+		},
+		"other encoding": {
+			kind:    "commit",
+			content: commit + "encoding ISO-8859-1\n\nsubj\xe9ct\n",
+		},
+		"signed commit": {
+			kind:    "commit",
+			content: commit + "gpgsig -----BEGIN PGP SIGNATURE-----\n \n -----END PGP SIGNATURE-----\n\nsubject\n",
+		},
+		"valid tag": {
+			kind:    "tag",
+			content: "object " + strings.Repeat("ab", 20) + "\ntype commit\ntag v1\ntagger " + ident + "\n\nmessage\n",
+		},
+		"tag of unknown type": {
+			kind:    "tag",
+			content: "object " + strings.Repeat("ab", 20) + "\ntype note\ntag v1\n\nmessage\n",
+			want:    []string{"badType"},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			c := &fsckChecker{strict: tc.strict}
+			var got []string
+			for _, p := range c.problems(tc.kind, []byte(tc.content)) {
+				got = append(got, p.ID)
+			}
+			if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFsckIdent(t *testing.T) {
+	cases := map[string]string{
+		"Test <test@example.com> 1600000000 +0000":           "",
+		"<test@example.com> 1600000000 +0000":                "missingNameBeforeEmail",
+		"Test test@example.com 1600000000 +0000":             "missingEmail",
+		"Test> <test@example.com> 1 +0000":                   "badName",
+		"Test<test@example.com> 1600000000 +0000":            "missingSpaceBeforeEmail",
+		"Test <test@example.com 1600000000 +0000":            "badEmail",
+		"Test <test@example.com>1600000000 +0000":            "missingSpaceBeforeDate",
+		"Test <test@example.com> 0160 +0000":                 "zeroPaddedDate",
+		"Test <test@example.com> 0 +0000":                    "",
+		"Test <test@example.com> now +0000":                  "badDate",
+		"Test <test@example.com> 1600000000":                 "badDate",
+		"Test <test@example.com> 99999999999999999999 +0000": "badDateOverflow",
+		"Test <test@example.com> 1600000000 0000":            "badTimezone",
+		"Test <test@example.com> 1600000000 +00:00":          "badTimezone",
+	}
+	for ident, want := range cases {
+		t.Run(ident, func(t *testing.T) {
+			var got string
+			if p := fsckIdent(ident); p != nil {
+				got = p.ID
+			}
+			if got != want {
+				t.Fatalf("want %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestFsckCheckerSeverities(t *testing.T) {
+	config, err := ParseConfig(strings.NewReader("[fsck]\n\thasDot = error\n\tnullSha1 = ignore\n[receive \"fsck\"]\n\thasDot = ignore\n"))
+	if err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+	repo := &Repository{config: config}
+	sha := strings.Repeat("\x01", 20)
+	tree := []byte("40000 .\x00" + sha + "100644 a\x00" + strings.Repeat("\x00", 20) + "100644 b.git\x00" + sha + "40000 .git\x00" + sha)
+
+	cases := map[string]struct {
+		section string
+		strict  bool
+		want    string
+	}{
+		"fsck":           {want: "hasDot:error hasDotgit:warning treeNotSorted:error"},
+		"fsck strict":    {strict: true, want: "hasDot:error hasDotgit:error treeNotSorted:error"},
+		"receive strict": {section: "receive", strict: true, want: "nullSha1:error hasDotgit:error treeNotSorted:error"},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			c, err := repo.fsckChecker(tc.section, tc.strict)
+			if err != nil {
+				t.Fatalf("checker: %s", err)
+			}
+			var got []string
+			for _, p := range c.problems("tree", tree) {
+				got = append(got, p.ID+":"+p.Severity.String())
+			}
+			if strings.Join(got, " ") != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := repo.fsckChecker("fetch", false); err != nil {
+		t.Fatalf("want no fetch settings, got %s", err)
+	}
+	config.Entries = append(config.Entries, &ConfigEntry{Section: "fsck", Key: "nosuchid", Value: "error"})
+	if _, err := repo.fsckChecker("", false); err == nil {
+		t.Fatal("want error for unknown message id")
+	}
+}
+
+func TestFetchChecksObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream, err := CreateRepository(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatalf("create upstream repository: %s", err)
+	}
+	local, err := CreateRepository(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatalf("create local repository: %s", err)
+	}
+	tree, err := NewTreeBuilder(upstream, nil).Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	// Written directly, because creating a malformed commit fails.
+	commit, err := upstream.WriteObject("commit", []byte(fmt.Sprintf("tree %x\nauthor Test <test@example.com> 01600000000 +0000\ncommitter Test <test@example.com> 1600000000 +0000\n\nsubject\n", tree)))
+	if err != nil {
+		t.Fatalf("write commit: %s", err)
+	}
+	if err := upstream.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: commit}); err != nil {
+		t.Fatalf("update upstream: %s", err)
+	}
+
+	fetch := func() error {
+		tr, err := local.OpenTransport("file://" + filepath.ToSlash(upstream.workdir))
+		if err != nil {
+			t.Fatalf("open transport: %s", err)
+		}
+		defer tr.Close()
+		spec, err := ParseRefspec("refs/heads/*:refs/remotes/origin/*")
+		if err != nil {
+			t.Fatalf("parse refspec: %s", err)
+		}
+		_, err = local.Fetch(tr, []*Refspec{spec}, nil)
+		return err
+	}
+	local.config.Entries = append(local.config.Entries, &ConfigEntry{Section: "transfer", Key: "fsckobjects", Value: "true"})
+	if err := fetch(); !errors.As(err, new(*FsckError)) {
+		t.Fatalf("want fsck error, got %v", err)
+	}
+	assertHasObject(t, local, commit, false)
+
+	local.config.Entries = append(local.config.Entries, &ConfigEntry{Section: "fetch", Subsection: "fsck", Key: "zeropaddeddate", Value: "ignore"})
+	if err := fetch(); err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	assertHasObject(t, local, commit, true)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fsyncComponent is a set of repository files that core.fsync applies to.
+type fsyncComponent uint
+
+const (
+	fsyncLooseObject fsyncComponent = 1 << iota
+	fsyncPack
+	fsyncPackMetadata
+	fsyncCommitGraph
+	fsyncIndex
+	fsyncReference
+)
+
+var fsyncComponentNames = map[string]fsyncComponent{
+	"loose-object":     fsyncLooseObject,
+	"pack":             fsyncPack,
+	"pack-metadata":    fsyncPackMetadata,
+	"commit-graph":     fsyncCommitGraph,
+	"index":            fsyncIndex,
+	"reference":        fsyncReference,
+	"objects":          fsyncLooseObject | fsyncPack,
+	"derived-metadata": fsyncPackMetadata | fsyncCommitGraph,
+	"committed":        fsyncLooseObject | fsyncPack | fsyncReference,
+	"added":            fsyncLooseObject | fsyncPack | fsyncReference | fsyncIndex,
+	"all":              ^fsyncComponent(0),
+}
+
+// Same as git, loose objects are not synced by default.
+const defaultFsyncComponents = fsyncPack | fsyncPackMetadata | fsyncCommitGraph | fsyncReference
+
+// parseFsyncComponents parses a comma separated list of core.fsync
+// components. A component prefixed with "-" is removed from the set and
+// "none" clears it.
+func parseFsyncComponents(value string) (fsyncComponent, error) {
+	components := defaultFsyncComponents
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "none" {
+			components = 0
+			continue
+		}
+		remove := strings.HasPrefix(name, "-")
+		c, ok := fsyncComponentNames[strings.TrimPrefix(name, "-")]
+		if !ok {
+			return 0, fmt.Errorf("unknown %q fsync component", name)
+		}
+		if remove {
+			components &^= c
+		} else {
+			components |= c
+		}
+	}
+	return components, nil
+}
+
+// readFsyncConfig reads core.fsync and core.fsyncMethod settings.
+func (r *Repository) readFsyncConfig() error {
+	r.fsync = defaultFsyncComponents
+	if ok, err := r.config.Bool("core", "", "fsyncObjectFiles", false); err != nil {
+		return err
+	} else if ok {
+		r.fsync |= fsyncLooseObject
+	}
+	if value, ok := r.config.Get("core", "", "fsync"); ok {
+		components, err := parseFsyncComponents(value)
+		if err != nil {
+			return fmt.Errorf("core.fsync: %w", err)
+		}
+		r.fsync = components
+	}
+	switch method, _ := r.config.Get("core", "", "fsyncMethod"); method {
+	case "", "fsync", "writeout-only":
+		// There is no portable way to only write out the page cache, so
+		// both methods do a full fsync.
+	case "batch":
+		r.fsyncBatch = true
+	default:
+		return fmt.Errorf("core.fsyncMethod: unknown %q method", method)
+	}
+	return nil
+}
+
+// fsyncEnabled returns true if files of given component must be flushed to
+// the disk.
+func (r *Repository) fsyncEnabled(c fsyncComponent) bool {
+	return r.fsync&c != 0
+}
+
+// syncLooseObject makes a loose object, that was just renamed into its
+// place, durable. In batch mode it is only scheduled and synced together
+// with all other pending objects before the next reference update.
+func (r *Repository) syncLooseObject(path string) error {
+	if !r.fsyncEnabled(fsyncLooseObject) {
+		return nil
+	}
+	if r.fsyncBatch {
+		r.pendingSync = append(r.pendingSync, path, filepath.Dir(path))
+		return nil
+	}
+	return syncPath(filepath.Dir(path))
+}
+
+// syncPending flushes all loose objects written in batch mode.
+func (r *Repository) syncPending() error {
+	synced := make(map[string]struct{}, len(r.pendingSync))
+	for _, path := range r.pendingSync {
+		if _, ok := synced[path]; ok {
+			continue
+		}
+		synced[path] = struct{}{}
+		if err := syncPath(path); err != nil {
+			return err
+		}
+	}
+	r.pendingSync = nil
+	return nil
+}
+
+// syncFile flushes an open file to the disk.
+func syncFile(fd *os.File) error {
+	if err := fd.Sync(); err != nil {
+		return fmt.Errorf("fsync %s: %w", fd.Name(), err)
+	}
+	return nil
+}
+
+// syncPath flushes a file or a directory. Syncing a directory makes
+// renames of files within it durable.
+func syncPath(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open for fsync: %w", err)
+	}
+	defer fd.Close()
+	return syncFile(fd)
+}
+
+// writeFileSync writes a new file and, if requested, flushes it to the disk
+// before it is closed.
+func writeFileSync(path string, content []byte, fsync bool) error {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(content)
+	if err == nil && fsync {
+		err = syncFile(fd)
+	}
+	if cerr := fd.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParseFsyncComponents(t *testing.T) {
+	cases := map[string]struct {
+		value   string
+		want    fsyncComponent
+		wantErr bool
+	}{
+		"empty keeps defaults": {
+			value: "",
+			want:  defaultFsyncComponents,
+		},
+		"add loose objects": {
+			value: "loose-object",
+			want:  defaultFsyncComponents | fsyncLooseObject,
+		},
+		"none resets": {
+			value: "none,reference",
+			want:  fsyncReference,
+		},
+		"remove component": {
+			value: "committed, -pack",
+			want:  defaultFsyncComponents&^fsyncPack | fsyncLooseObject,
+		},
+		"all": {
+			value: "all",
+			want:  ^fsyncComponent(0),
+		},
+		"unknown component": {
+			value:   "objects,bogus",
+			wantErr: true,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, err := parseFsyncComponents(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %b, got %b", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultGCAuto is the number of loose objects above which gc --auto
+	// packs them, unless gc.auto is set.
+	defaultGCAuto = 6700
+	// defaultGCAutoPackLimit is the number of packs above which gc --auto
+	// combines them into one, unless gc.autoPackLimit is set.
+	defaultGCAutoPackLimit = 50
+)
+
+// gc.pid in the git directory holds the process ID and the host name of the
+// running gc, so that only one gc runs at a time. A file older than
+// gcPidMaxAge was left by a gc that was killed.
+const (
+	gcPidFile   = "gc.pid"
+	gcPidMaxAge = 12 * time.Hour
+)
+
+// gcRunningError is returned when gc cannot start, because another gc is
+// running.
+type gcRunningError struct {
+	Pid  int
+	Host string
+}
+
+func (e *gcRunningError) Error() string {
+	return fmt.Sprintf("gc is already running on machine '%s' pid %d (use --force if not)", e.Host, e.Pid)
+}
+
+// lockGC creates gc.pid and returns the function that removes it. With
+// force, gc.pid of a running gc is taken over.
+func (r *Repository) lockGC(force bool) (func(), error) {
+	path := filepath.Join(r.gitdir, gcPidFile)
+	host, _ := os.Hostname()
+	for attempt := 0; attempt < 2; attempt++ {
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(fd, "%d %s", os.Getpid(), host)
+			if cerr := fd.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("write %s: %w", gcPidFile, err)
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("create %s: %w", gcPidFile, err)
+		}
+		if running := runningGC(path, host); running != nil && !force {
+			return nil, running
+		}
+		// Left by a gc that is not running anymore.
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("remove %s: %w", gcPidFile, err)
+		}
+	}
+	return nil, fmt.Errorf("cannot create %s", gcPidFile)
+}
+
+// runningGC returns the gc that holds gc.pid, or nil if it is not running.
+// A gc of another machine cannot be checked and is assumed to be running.
+func runningGC(path, host string) *gcRunningError {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > gcPidMaxAge {
+		return nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	fields := strings.SplitN(string(raw), " ", 2)
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || len(fields) != 2 {
+		return nil
+	}
+	e := &gcRunningError{Pid: pid, Host: fields[1]}
+	if e.Host != host {
+		return e
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return nil
+	}
+	if err := p.Signal(syscall.Signal(0)); err != nil && !errors.Is(err, syscall.EPERM) {
+		return nil
+	}
+	return e
+}
+
+// localPacks returns packs of the object directory, without those of
+// alternates, and separately those of them that are kept.
+func (r *Repository) localPacks() (packs, kept []*packFile, err error) {
+	if err := r.loadPacks(); err != nil {
+		return nil, nil, fmt.Errorf("load packs: %w", err)
+	}
+	for _, p := range r.packs {
+		if filepath.Dir(filepath.Dir(p.path)) != r.objdir {
+			continue
+		}
+		if p.kept() {
+			kept = append(kept, p)
+		} else {
+			packs = append(packs, p)
+		}
+	}
+	return packs, kept, nil
+}
+
+// kept returns true if the pack has a .keep file next to it. A kept pack
+// is never repacked or removed by gc, which lets large packs that rarely
+// change, or a pack that is being received, stay as they are.
+func (p *packFile) kept() bool {
+	_, err := os.Stat(strings.TrimSuffix(p.path, ".pack") + ".keep")
+	return err == nil
+}
+
+// tooManyLooseObjects estimates the number of loose objects from the number
+// of objects in a single fan-out directory, as git does, so that the check
+// is cheap enough to be run after every command.
+func (r *Repository) tooManyLooseObjects(limit int64) (bool, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(r.objdir, "17"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("read objects directory: %w", err)
+	}
+	threshold := (limit + 255) / 256
+	var n int64
+	for _, e := range entries {
+		if _, err := hex.DecodeString(e.Name()); err == nil && len(e.Name()) == 38 {
+			n++
+		}
+	}
+	return n > threshold, nil
+}
+
+// autoGCNeeds returns whether gc --auto has anything to do: loose objects
+// are packed when there are more than gc.auto of them, and all packs are
+// combined into one when there are more than gc.autoPackLimit, not counting
+// kept packs. Zero gc.auto
+// disables gc --auto, zero gc.autoPackLimit only combining packs.
+func (r *Repository) autoGCNeeds() (packLoose, repack bool, err error) {
+	limit, err := r.config.Int("gc", "", "auto", defaultGCAuto)
+	if err != nil || limit <= 0 {
+		return false, false, err
+	}
+	packLimit, err := r.config.Int("gc", "", "autoPackLimit", defaultGCAutoPackLimit)
+	if err != nil {
+		return false, false, err
+	}
+	if packLimit > 0 {
+		packs, _, err := r.localPacks()
+		if err != nil {
+			return false, false, err
+		}
+		if int64(len(packs)) > packLimit {
+			return false, true, nil
+		}
+	}
+	packLoose, err = r.tooManyLooseObjects(limit)
+	return packLoose, false, err
+}
+
+// Repack stores all objects of the object directory, loose and packed, in a
+// single new pack and returns its path. With remove, the previous packs and
+// the loose objects are removed. Unreachable objects are kept. Kept packs
+// are left as they are, and their objects are not copied into the new pack.
+func (r *Repository) Repack(remove bool) (string, error) {
+	packs, kept, err := r.localPacks()
+	if err != nil {
+		return "", err
+	}
+	seen := make(map[string]struct{})
+	for _, p := range kept {
+		for i := 0; i < p.index.count(); i++ {
+			seen[string(p.index.sha(i))] = struct{}{}
+		}
+	}
+	var shas [][]byte
+	add := func(sha []byte) {
+		if _, ok := seen[string(sha)]; !ok {
+			seen[string(sha)] = struct{}{}
+			shas = append(shas, sha)
+		}
+	}
+	for _, p := range packs {
+		for i := 0; i < p.index.count(); i++ {
+			add(p.index.sha(i))
+		}
+	}
+	err = r.looseObjects(func(sha []byte, path string) error {
+		add(sha)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	var pack string
+	if len(shas) != 0 {
+		if pack, err = r.writePack(shas); err != nil {
+			return "", err
+		}
+	}
+	if !remove {
+		return pack, nil
+	}
+	for _, p := range packs {
+		if p.path == pack {
+			// The same objects were already packed alone.
+			continue
+		}
+		base := strings.TrimSuffix(p.path, ".pack")
+		// The index goes first, so that the pack is not used anymore.
+		for _, ext := range []string{".idx", ".pack", ".rev", ".bitmap"} {
+			if err := os.Remove(base + ext); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", fmt.Errorf("remove pack: %w", err)
+			}
+		}
+	}
+	if err := r.loadPacks(); err != nil {
+		return "", fmt.Errorf("load packs: %w", err)
+	}
+	return pack, r.PrunePacked(false, nil)
+}
+
+// GC packs objects of the repository. With auto it does only what
+// autoGCNeeds reports, and nothing if another gc is running.
+func (r *Repository) GC(auto, force bool) error {
+	packLoose, repack := true, true
+	if auto {
+		var err error
+		if packLoose, repack, err = r.autoGCNeeds(); err != nil || !packLoose && !repack {
+			return err
+		}
+	}
+	unlock, err := r.lockGC(force)
+	if err != nil {
+		var running *gcRunningError
+		if auto && errors.As(err, &running) {
+			return nil
+		}
+		return err
+	}
+	defer unlock()
+	if repack {
+		_, err := r.Repack(true)
+		return err
+	}
+	if _, err := r.PackLooseObjects(0); err != nil {
+		return err
+	}
+	return r.PrunePacked(false, nil)
+}
+
+// runAutoGC runs gc --auto after a command that created many objects. By
+// default gc runs in a background process, so that the command does not
+// wait for it, unless gc.autoDetach is false.
+func runAutoGC(output io.Writer, repo *Repository) error {
+	packLoose, repack, err := repo.autoGCNeeds()
+	if err != nil || !packLoose && !repack {
+		return err
+	}
+	detach, err := repo.config.Bool("gc", "", "autoDetach", true)
+	if err != nil {
+		return err
+	}
+	if !detach {
+		fmt.Fprintln(output, "Auto packing the repository for optimum performance.")
+		return repo.GC(true, false)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("auto gc: %w", err)
+	}
+	cmd := exec.Command(exe, "gc", "--auto")
+	cmd.Dir = repo.workdir
+	if cmd.Dir == "" {
+		cmd.Dir = repo.gitdir
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("auto gc: %w", err)
+	}
+	// The gc outlives this process.
+	cmd.Process.Release()
+	fmt.Fprintln(output, "Auto packing the repository in background for optimum performance.")
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAutoGCNeeds(t *testing.T) {
+	cases := map[string]struct {
+		config        string
+		loose         int
+		packs         int
+		wantPackLoose bool
+		wantRepack    bool
+	}{
+		"nothing to do":       {loose: 3, packs: 1},
+		"many loose objects":  {config: "[gc]\n\tauto = 512\n", loose: 3, wantPackLoose: true},
+		"many packs":          {config: "[gc]\n\tautoPackLimit = 2\n", loose: 3, packs: 3, wantRepack: true},
+		"pack limit disabled": {config: "[gc]\n\tautoPackLimit = 0\n", packs: 3},
+		"disabled":            {config: "[gc]\n\tauto = 0\n\tautoPackLimit = 1\n", loose: 10, packs: 3},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			repo := newTestRepository(t)
+			var err error
+			if repo.config, err = ParseConfig(strings.NewReader(tc.config)); err != nil {
+				t.Fatalf("parse config: %s", err)
+			}
+			// Only the number of files in the fan-out directory is
+			// looked at.
+			fanout := filepath.Join(repo.objdir, "17")
+			if err := os.MkdirAll(fanout, 0755); err != nil {
+				t.Fatalf("mkdir: %s", err)
+			}
+			for i := 0; i < tc.loose; i++ {
+				if err := ioutil.WriteFile(filepath.Join(fanout, fmt.Sprintf("%038x", i)), nil, 0444); err != nil {
+					t.Fatalf("write object: %s", err)
+				}
+			}
+			for i := 0; i < tc.packs; i++ {
+				if _, err := repo.WriteObject("blob", []byte(fmt.Sprint(i))); err != nil {
+					t.Fatalf("write object: %s", err)
+				}
+				if err := os.RemoveAll(fanout); err != nil {
+					t.Fatalf("remove: %s", err)
+				}
+				if _, err := repo.PackLooseObjects(0); err != nil {
+					t.Fatalf("pack: %s", err)
+				}
+			}
+
+			packLoose, repack, err := repo.autoGCNeeds()
+			if err != nil {
+				t.Fatalf("auto gc needs: %s", err)
+			}
+			if packLoose != tc.wantPackLoose || repack != tc.wantRepack {
+				t.Fatalf("want pack loose %v repack %v, got %v %v", tc.wantPackLoose, tc.wantRepack, packLoose, repack)
+			}
+		})
+	}
+}
+
+func TestGC(t *testing.T) {
+	repo := newTestRepository(t)
+	var shas [][]byte
+	for i := 0; i < 3; i++ {
+		sha, err := repo.WriteObject("blob", []byte(fmt.Sprintf("blob %d\n", i)))
+		if err != nil {
+			t.Fatalf("write object: %s", err)
+		}
+		shas = append(shas, sha)
+		if i < 2 {
+			pack, err := repo.PackLooseObjects(0)
+			if err != nil {
+				t.Fatalf("pack: %s", err)
+			}
+			// The pack of the first object is kept.
+			if i == 0 {
+				if err := ioutil.WriteFile(strings.TrimSuffix(pack, ".pack")+".keep", nil, 0644); err != nil {
+					t.Fatalf("write keep: %s", err)
+				}
+			}
+		}
+	}
+
+	// Another gc is running.
+	pidFile := filepath.Join(repo.gitdir, gcPidFile)
+	host, _ := os.Hostname()
+	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d %s", os.Getpid(), host)), 0644); err != nil {
+		t.Fatalf("write pid file: %s", err)
+	}
+	var running *gcRunningError
+	if err := repo.GC(false, false); !errors.As(err, &running) || running.Pid != os.Getpid() {
+		t.Fatalf("want gc running error, got %v", err)
+	}
+	// The gc that wrote the file is not running anymore.
+	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d %s", 1<<30, host)), 0644); err != nil {
+		t.Fatalf("write pid file: %s", err)
+	}
+	if err := repo.GC(false, false); err != nil {
+		t.Fatalf("gc: %s", err)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Fatalf("want pid file removed, got %v", err)
+	}
+
+	packs, kept, err := repo.localPacks()
+	if err != nil {
+		t.Fatalf("local packs: %s", err)
+	}
+	if len(kept) != 1 || kept[0].index.count() != 1 {
+		t.Fatalf("want the kept pack left as it is, got %+v", kept)
+	}
+	if len(packs) != 1 || packs[0].index.count() != len(shas)-1 {
+		t.Fatalf("want a single pack of the other %d objects, got %+v", len(shas)-1, packs)
+	}
+	for _, sha := range shas {
+		assertHasObject(t, repo, sha, true)
+	}
+	err = repo.looseObjects(func(sha []byte, path string) error {
+		return fmt.Errorf("loose object %x left", sha)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -20,11 +21,81 @@ import (
 type Repository struct {
 	workdir string
 	gitdir  string
-	conf    string // TODO
+	config  *Config
+	format  *RepositoryFormat
+	refs    refStorage
+
+	// Zlib compression levels of loose objects and pack files.
+	looseCompression int
+	packCompression  int
+
+	// objdir is where new objects are written. Objects are read from
+	// objdir first and then from each of the alternates directories.
+	objdir     string
+	alternates []string
+
+	// fsync is the set of components flushed to the disk after writing.
+	// In batch mode, loose objects are collected in pendingSync and
+	// flushed before the next reference update.
+	fsync       fsyncComponent
+	fsyncBatch  bool
+	pendingSync []string
+
+	// graph is the commit-graph, loaded on first use. It is nil if the
+	// repository has none.
+	graph       *commitGraph
+	graphLoaded bool
+
+	// packs are packs of all object directories, loaded on first use and
+	// updated when an object is not found in any of them.
+	packs       []*packFile
+	packsLoaded bool
+	// windows are the mapped regions of the packs, shared with
+	// quarantines of the repository.
+	windows *packWindows
+
+	// indexLock is index.lock while it is held by LockIndex.
+	indexLock *os.File
 }
 
+// InitOptions are settings of InitRepository.
+type InitOptions struct {
+	// Bare creates a repository without a worktree, with the git directory
+	// in the given directory itself.
+	Bare bool
+	// InitialBranch is the branch HEAD points to. The init.defaultBranch
+	// setting is used if empty, or master if that is not set either.
+	InitialBranch string
+	// TemplateDir is a directory with files copied into the new git
+	// directory, for example hooks. The GIT_TEMPLATE_DIR environment
+	// variable or the init.templateDir setting is used if empty.
+	TemplateDir string
+}
+
+// CreateRepository creates a new repository with a worktree in the
+// directory, using the default options.
 func CreateRepository(dir string) (*Repository, error) {
-	switch err := os.MkdirAll(path.Join(dir, ".git"), newDirPerm); {
+	return InitRepository(dir, &InitOptions{})
+}
+
+// InitRepository creates a new repository in the directory. Files of the
+// template directory are copied before the default files are written, which
+// they take precedence over, except for the config file that the core
+// settings are appended to.
+func InitRepository(dir string, opts *InitOptions) (*Repository, error) {
+	if opts.InitialBranch != "" {
+		if err := ValidateBranchName(opts.InitialBranch); err != nil {
+			return nil, fmt.Errorf("invalid initial branch name: %w", err)
+		}
+	}
+	gitdir := path.Join(dir, ".git")
+	if opts.Bare {
+		gitdir = dir
+		if ok, err := isDir(path.Join(dir, "objects")); err == nil && ok {
+			return nil, fmt.Errorf("already a git repository: %s", dir)
+		}
+	}
+	switch err := os.MkdirAll(gitdir, newDirPerm); {
 	case errors.Is(err, os.ErrExist):
 		return nil, fmt.Errorf("already a git repository: %w", err)
 	case err == nil:
@@ -33,17 +104,14 @@ func CreateRepository(dir string) (*Repository, error) {
 		return nil, fmt.Errorf("mkdir .git: %w", err)
 	}
 
-	repo, err := OpenRepository(dir)
+	workdir := dir
+	if opts.Bare {
+		workdir = ""
+	}
+	repo, err := openGitDir(gitdir, workdir)
 	if err != nil {
 		return nil, fmt.Errorf("new repository: %w", err)
 	}
-	if ok, err := isDir(repo.workdir); err != nil {
-		return nil, fmt.Errorf("workdir is dir %q: %w", repo.workdir, err)
-	} else if !ok {
-		if err := os.MkdirAll(repo.workdir, newDirPerm); err != nil {
-			return nil, fmt.Errorf("mkdir workdir: %w", err)
-		}
-	}
 	if _, err := repo.DirPath(true, "branches"); err != nil {
 		return nil, fmt.Errorf("mkdir branches: %w", err)
 	}
@@ -56,22 +124,119 @@ func CreateRepository(dir string) (*Repository, error) {
 	if _, err := repo.DirPath(true, "refs", "heads"); err != nil {
 		return nil, fmt.Errorf("mkdir refs/heads: %w", err)
 	}
-	if err := repo.WriteFile(true, []byte(defaultDescription), "description"); err != nil {
-		return nil, fmt.Errorf("write description file: %w", err)
+
+	templateDir := opts.TemplateDir
+	if templateDir == "" {
+		templateDir = os.Getenv("GIT_TEMPLATE_DIR")
+	}
+	if templateDir == "" {
+		if templateDir, _, err = repo.config.Path("init", "", "templateDir"); err != nil {
+			return nil, err
+		}
+	}
+	var templateConfig []byte
+	if templateDir != "" {
+		if err := copyTemplate(templateDir, repo.gitdir); err != nil {
+			return nil, fmt.Errorf("copy template: %w", err)
+		}
+		templateConfig, err = ioutil.ReadFile(path.Join(repo.gitdir, "config"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read template config: %w", err)
+		}
+	}
+
+	branch := opts.InitialBranch
+	if branch == "" {
+		branch, _ = repo.config.Get("init", "", "defaultBranch")
+	}
+	if branch == "" {
+		branch = defaultBranch
+	}
+	if err := ValidateBranchName(branch); err != nil {
+		return nil, fmt.Errorf("init.defaultBranch: %w", err)
+	}
+
+	if _, err := os.Stat(path.Join(repo.gitdir, "description")); errors.Is(err, os.ErrNotExist) {
+		if err := repo.WriteFile(true, []byte(defaultDescription), "description"); err != nil {
+			return nil, fmt.Errorf("write description file: %w", err)
+		}
 	}
-	if err := repo.WriteFile(true, []byte(defaultHEAD), "HEAD"); err != nil {
+	if err := repo.WriteFile(true, []byte("ref: refs/heads/"+branch+"\n"), "HEAD"); err != nil {
 		return nil, fmt.Errorf("write HEAD file: %w", err)
 	}
-	if err := repo.WriteFile(true, []byte(defaultConfig), "config"); err != nil {
+	config := string(templateConfig)
+	if config != "" && !strings.HasSuffix(config, "\n") {
+		config += "\n"
+	}
+	config += fmt.Sprintf(defaultConfig, opts.Bare)
+	if err := repo.WriteFile(true, []byte(config), "config"); err != nil {
 		return nil, fmt.Errorf("write config file: %w", err)
 	}
+	// Settings that depend on the file system are probed once, when the
+	// repository is created.
+	probed := config
+	if probeIgnoreCase(repo.gitdir) {
+		probed += "ignorecase = true\n"
+	}
+	if probePrecompose(repo.gitdir) {
+		probed += "precomposeunicode = true\n"
+	}
+	if probed != config {
+		if err := repo.WriteFile(false, []byte(probed), "config"); err != nil {
+			return nil, fmt.Errorf("write config file: %w", err)
+		}
+	}
 	return repo, nil
 }
 
+// copyTemplate copies files of the template directory into the git
+// directory, keeping their permissions. Files that exist are not
+// overwritten. A template directory that does not exist is ignored.
+func copyTemplate(templateDir, gitdir string) error {
+	return filepath.Walk(templateDir, func(src string, info os.FileInfo, err error) error {
+		if err != nil {
+			if src == templateDir && errors.Is(err, os.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(templateDir, src)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(gitdir, rel)
+		switch {
+		case rel == ".":
+			return nil
+		case info.IsDir():
+			if err := os.Mkdir(dest, newDirPerm); err != nil && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+			return nil
+		}
+		if _, err := os.Lstat(dest); err == nil {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dest)
+		}
+		content, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dest, content, info.Mode().Perm())
+	})
+}
+
 const (
+	defaultBranch      = "master"
 	defaultDescription = "Unnamed repository.\n"
-	defaultHEAD        = "ref: refs/heads/master\n"
-	defaultConfig      = "[core]\nrepositoryformatversion = 0\nfilemode = false\nbare = false\n"
+	// defaultConfig is formatted with the value of core.bare.
+	defaultConfig = "[core]\nrepositoryformatversion = 0\nfilemode = false\nbare = %t\n"
 )
 
 func FindRepository(repo string) (*Repository, error) {
@@ -83,15 +248,51 @@ func FindRepository(repo string) (*Repository, error) {
 		if ok, err := isDir(path.Join(repo, ".git")); err == nil && ok {
 			return OpenRepository(repo)
 		}
-		if repo == "." {
+		if isBareRepository(repo) {
+			return OpenRepository(repo)
+		}
+		parent := filepath.Dir(repo)
+		if parent == repo {
 			return nil, fmt.Errorf("no .git directory: %w", os.ErrNotExist)
 		}
-		repo = filepath.Dir(repo)
+		repo = parent
 	}
 }
 
+// isBareRepository returns true if the directory is a git directory without
+// a worktree: it has a HEAD file and an objects directory, and core.bare is
+// not false.
+func isBareRepository(dir string) bool {
+	if info, err := os.Stat(path.Join(dir, "HEAD")); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if ok, err := isDir(path.Join(dir, "objects")); err != nil || !ok {
+		return false
+	}
+	config, err := ReadConfigFile(path.Join(dir, "config"))
+	if err != nil {
+		return false
+	}
+	bare, err := config.Bool("core", "", "bare", true)
+	return err == nil && bare
+}
+
+// OpenRepository opens the repository with a worktree in the directory, or
+// the bare repository that is the directory. The worktree of a bare
+// repository is empty.
 func OpenRepository(dir string) (*Repository, error) {
-	gitdir := path.Join(dir, ".git")
+	gitdir, workdir := path.Join(dir, ".git"), dir
+	if ok, _ := isDir(gitdir); !ok && isBareRepository(dir) {
+		gitdir, workdir = dir, ""
+	}
+	return openGitDir(gitdir, workdir)
+}
+
+func openGitDir(gitdir, workdir string) (*Repository, error) {
+	dir := workdir
+	if dir == "" {
+		dir = gitdir
+	}
 
 	if ok, err := isDir(dir); err != nil {
 		return nil, fmt.Errorf("is dir: %w", err)
@@ -99,15 +300,112 @@ func OpenRepository(dir string) (*Repository, error) {
 		return nil, fmt.Errorf("not a git directory: %q", dir)
 	}
 
-	// TODO read configuration
+	format, err := readRepositoryFormat(gitdir)
+	if err != nil {
+		return nil, fmt.Errorf("repository format: %w", err)
+	}
+	config, err := loadConfig(gitdir)
+	if err != nil {
+		return nil, fmt.Errorf("read configuration: %w", err)
+	}
 
 	r := &Repository{
-		workdir: dir,
+		workdir: workdir,
 		gitdir:  gitdir,
+		config:  config,
+		format:  format,
+		objdir:  path.Join(gitdir, "objects"),
+	}
+	if err := r.readCompression(); err != nil {
+		return nil, err
+	}
+	if err := r.readPackWindowConfig(); err != nil {
+		return nil, err
+	}
+	if err := r.readFsyncConfig(); err != nil {
+		return nil, err
+	}
+	fsyncRefs := r.fsyncEnabled(fsyncReference)
+	if format.RefStorage() == "reftable" {
+		r.refs = &reftableStorage{dir: path.Join(gitdir, "reftable"), fsync: fsyncRefs}
+	} else {
+		r.refs = &filesRefStorage{gitdir: gitdir, fsync: fsyncRefs}
+	}
+	if env := os.Getenv("GIT_OBJECT_DIRECTORY"); env != "" {
+		r.objdir = env
+	}
+	alternates, err := readAlternates(r.objdir)
+	if err != nil {
+		return nil, fmt.Errorf("alternates: %w", err)
+	}
+	r.alternates = alternates
+	if env := os.Getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES"); env != "" {
+		r.alternates = append(r.alternates, filepath.SplitList(env)...)
 	}
 	return r, nil
 }
 
+// readCompression reads zlib compression levels. core.compression is the
+// default for both loose objects and packs, unless a more specific setting
+// is present. Same as git, loose objects are by default compressed for
+// speed.
+func (r *Repository) readCompression() error {
+	level := func(section, key string, def int) (int, error) {
+		value, ok := r.config.Get(section, "", key)
+		if !ok {
+			return def, nil
+		}
+		n, err := parseConfigInt(value)
+		if err != nil {
+			return 0, fmt.Errorf("%s.%s: %w", section, key, err)
+		}
+		if n < -1 || n > 9 {
+			return 0, fmt.Errorf("%s.%s: bad zlib compression level %d", section, key, n)
+		}
+		return int(n), nil
+	}
+	looseDefault, packDefault := zlib.BestSpeed, zlib.DefaultCompression
+	if _, ok := r.config.Get("core", "", "compression"); ok {
+		core, err := level("core", "compression", 0)
+		if err != nil {
+			return err
+		}
+		looseDefault, packDefault = core, core
+	}
+	var err error
+	if r.looseCompression, err = level("core", "looseCompression", looseDefault); err != nil {
+		return err
+	}
+	if r.packCompression, err = level("pack", "compression", packDefault); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readAlternates returns object directories listed in the
+// info/alternates file of given object directory. Relative paths are
+// resolved against the object directory.
+func readAlternates(objdir string) ([]string, error) {
+	raw, err := ioutil.ReadFile(path.Join(objdir, "info", "alternates"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	var dirs []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(objdir, line)
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs, nil
+}
+
 // DirPath returns a directory path that is relative to this repository. If
 // mkdir flag is set, directory is created if does not yet exist.
 func (r *Repository) DirPath(mkdir bool, pathChunks ...string) (string, error) {
@@ -128,13 +426,14 @@ func (r *Repository) DirPath(mkdir bool, pathChunks ...string) (string, error) {
 }
 
 func (r *Repository) WriteFile(mkdir bool, content []byte, pathChunks ...string) error {
-	if len(pathChunks) > 1 {
-		_, err := r.DirPath(mkdir, pathChunks[:len(pathChunks)-2]...)
-		if err != nil {
+	full := path.Join(r.gitdir, path.Join(pathChunks...))
+	// Chunks may contain slashes, for example a reference name, so the
+	// parent directory is computed from the full path.
+	if dir := path.Dir(full); dir != r.gitdir {
+		if _, err := r.DirPath(mkdir, dir[len(r.gitdir)+1:]); err != nil {
 			return fmt.Errorf("ensure directory: %w", err)
 		}
 	}
-	full := path.Join(r.gitdir, path.Join(pathChunks...))
 	if err := ioutil.WriteFile(full, content, 0644); err != nil {
 		return fmt.Errorf("write contnt: %w", err)
 	}
@@ -142,60 +441,134 @@ func (r *Repository) WriteFile(mkdir bool, content []byte, pathChunks ...string)
 }
 
 func (r *Repository) ReadObject(sha []byte) (Object, error) {
+	kind, content, err := r.ReadRawObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	newObj, ok := objects[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown object kind: %q", kind)
+	}
+	obj := newObj()
+	if err := obj.Deserialize(content); err != nil {
+		return nil, fmt.Errorf("deserialize %s object: %w", kind, err)
+	}
+	return obj, nil
+}
+
+// ReadRawObject returns the type and the content of an object, without
+// parsing it. Every object directory is searched for a loose copy of the
+// object that is not corrupt, followed by packs. A *CorruptObjectError is
+// returned if there are only damaged copies, while an error wrapping
+// os.ErrNotExist is returned if there are none.
+func (r *Repository) ReadRawObject(sha []byte) (string, []byte, error) {
 	if len(sha) != 20 {
-		return nil, fmt.Errorf("invalid hash length: %d", len(sha))
+		return "", nil, fmt.Errorf("invalid hash length: %d", len(sha))
 	}
 	s := hex.EncodeToString(sha)
-	full := path.Join(r.gitdir, "objects", s[:2], s[2:])
-	fd, err := os.Open(full)
-	if err != nil {
-		return nil, fmt.Errorf("read object: %w", err)
+	var corrupt error
+	for _, dir := range append([]string{r.objdir}, r.alternates...) {
+		full := path.Join(dir, s[:2], s[2:])
+		kind, content, err := readLooseObject(full, sha)
+		switch {
+		case err == nil:
+			return kind, content, nil
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		case errors.As(err, new(*CorruptObjectError)):
+			if corrupt == nil {
+				corrupt = err
+			}
+		default:
+			return "", nil, fmt.Errorf("read object: %w", err)
+		}
 	}
-	defer fd.Close()
-
-	zrd, err := zlib.NewReader(fd)
-	if err != nil {
-		return nil, fmt.Errorf("zlib object reader: %w", err)
+	kind, content, err := r.readPackedObject(sha)
+	switch {
+	case err == nil:
+		return kind, content, nil
+	case errors.Is(err, os.ErrNotExist) && corrupt != nil:
+		return "", nil, corrupt
+	case errors.Is(err, os.ErrNotExist) && s == EmptyTreeHash:
+		return "tree", nil, nil
+	case errors.Is(err, os.ErrNotExist) && s == EmptyBlobHash:
+		return "blob", nil, nil
+	case errors.Is(err, os.ErrNotExist):
+		return "", nil, fmt.Errorf("read object: object %s: %w", s, os.ErrNotExist)
+	default:
+		return "", nil, fmt.Errorf("read object: %w", err)
 	}
-	defer zrd.Close()
-
-	rd := bufio.NewReader(zrd)
+}
 
-	kind, err := rd.ReadString(' ')
+// readCommit reads an object that must be a commit.
+func (r *Repository) readCommit(sha []byte) (*CommitObject, error) {
+	obj, err := r.ReadObject(sha)
 	if err != nil {
-		return nil, fmt.Errorf("read object kind: %w", err)
+		return nil, err
 	}
-	kind = kind[:len(kind)-1]
-	newObj, ok := objects[kind]
+	c, ok := obj.(*CommitObject)
 	if !ok {
-		return nil, fmt.Errorf("unknown object kind: %q", kind)
+		return nil, fmt.Errorf("%x is not a commit object: %T", sha, obj)
 	}
+	return c, nil
+}
 
-	ssize, err := rd.ReadString(0)
+// readTree reads an object that must be a tree.
+func (r *Repository) readTree(sha []byte) (*TreeObject, error) {
+	obj, err := r.ReadObject(sha)
 	if err != nil {
-		return nil, fmt.Errorf("read object size: %w", err)
+		return nil, err
 	}
-	size, err := strconv.Atoi(ssize[:len(ssize)-1])
-	if err != nil {
-		return nil, fmt.Errorf("invalid object size: %w", err)
+	tr, ok := obj.(*TreeObject)
+	if !ok {
+		return nil, fmt.Errorf("%x is not a tree object: %T", sha, obj)
 	}
+	return tr, nil
+}
 
-	content, err := ioutil.ReadAll(rd)
-	if err != nil {
-		return nil, fmt.Errorf("read object content: %w", err)
-	}
-	if size != len(content) {
-		return nil, fmt.Errorf("bad object length %d != %d", len(content), size)
+// lookupTreePath returns the leaf at given slash separated path, starting at
+// the tree tr. Returned error wraps os.ErrNotExist if there is no such path.
+func (r *Repository) lookupTreePath(tr *TreeObject, treePath string) (*TreeLeaf, error) {
+	chunks := strings.Split(strings.Trim(treePath, "/"), "/")
+	for i, name := range chunks {
+		var found *TreeLeaf
+		for _, leaf := range tr.Leafs {
+			if leaf.Path == name {
+				found = leaf
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("path %q: %w", treePath, os.ErrNotExist)
+		}
+		if i == len(chunks)-1 {
+			return found, nil
+		}
+		if found.Mode != modeTree {
+			return nil, fmt.Errorf("path %q: %w", treePath, os.ErrNotExist)
+		}
+		sub, err := r.readTree(found.Sha)
+		if err != nil {
+			return nil, err
+		}
+		tr = sub
 	}
+	return nil, fmt.Errorf("path %q: %w", treePath, os.ErrNotExist)
+}
 
-	obj := newObj()
-	if err := obj.Deserialize(content); err != nil {
-		return nil, fmt.Errorf("deserialize %s object: %w", kind, err)
+// commitTree returns the root tree of a commit.
+func (r *Repository) commitTree(c *CommitObject) (*TreeObject, error) {
+	if len(c.Header["tree"]) == 0 {
+		return nil, errors.New("commit without tree")
 	}
-	return obj, nil
+	sha, err := hex.DecodeString(c.Header["tree"][0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid tree hash value: %w", err)
+	}
+	return r.readTree(sha)
 }
 
-func (r *Repository) WriteObject(kind string, content []byte) (sha []byte, werr error) {
+func (r *Repository) WriteObject(kind string, content []byte) ([]byte, error) {
 	var b bytes.Buffer
 	if _, err := fmt.Fprintf(&b, "%s %d\x00", kind, len(content)); err != nil {
 		return nil, fmt.Errorf("build header: %w", err)
@@ -206,30 +579,115 @@ func (r *Repository) WriteObject(kind string, content []byte) (sha []byte, werr
 	raw := b.Bytes()
 
 	sum := sha1.Sum(raw)
-	sha = sum[:]
+	sha := sum[:]
+	if ok, err := r.HasObject(sha); err != nil {
+		return sha, err
+	} else if ok {
+		// Objects are immutable, there is no need to write it again.
+		return sha, nil
+	}
+	err := r.writeLooseObject(sha, func(fd *os.File) error {
+		wr, err := zlib.NewWriterLevel(fd, r.looseCompression)
+		if err != nil {
+			return fmt.Errorf("zlib object writer: %w", err)
+		}
+		if _, err := wr.Write(raw); err != nil {
+			return fmt.Errorf("zlib object write: %w", err)
+		}
+		if err := wr.Close(); err != nil {
+			return fmt.Errorf("close zlib object writer: %w", err)
+		}
+		return nil
+	})
+	return sha, err
+}
+
+// hashObject returns the hash an object with given content would be stored
+// under.
+func hashObject(kind string, content []byte) []byte {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", kind, len(content))
+	h.Write(content)
+	return h.Sum(nil)
+}
+
+// writeLooseObject stores the compressed content of an object produced by
+// write. Content is written to a temporary file first, so that a crash
+// never leaves a truncated object behind.
+func (r *Repository) writeLooseObject(sha []byte, write func(*os.File) error) (werr error) {
 	s := hex.EncodeToString(sha)
-	if _, err := r.DirPath(true, "objects", s[:2]); err != nil {
-		return sha, fmt.Errorf("ensure object dir: %w", err)
+	dir := path.Join(r.objdir, s[:2])
+	if err := os.MkdirAll(dir, newDirPerm); err != nil {
+		return fmt.Errorf("ensure object dir: %w", err)
 	}
-	full := path.Join(r.gitdir, "objects", s[:2], s[2:])
-
-	fd, err := os.OpenFile(full, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	fd, err := ioutil.TempFile(dir, "tmp_obj_")
 	if err != nil {
-		return sha, fmt.Errorf("open object file: %w", err)
+		return fmt.Errorf("create object file: %w", err)
 	}
 	defer func() {
-		if err := fd.Close(); err != nil {
-			werr = fmt.Errorf("close object file: %w", err)
+		if werr != nil {
+			fd.Close()
+			os.Remove(fd.Name())
 		}
 	}()
-	wr := zlib.NewWriter(fd)
-	if _, err := wr.Write(raw); err != nil {
-		return sha, fmt.Errorf("zlib object write: %w", err)
+	if err := write(fd); err != nil {
+		return err
 	}
-	if err := wr.Close(); err != nil {
-		return sha, fmt.Errorf("close zlib object writer: %w", err)
+	if r.fsyncEnabled(fsyncLooseObject) && !r.fsyncBatch {
+		if err := syncFile(fd); err != nil {
+			return err
+		}
+	}
+	if err := fd.Close(); err != nil {
+		return fmt.Errorf("close object file: %w", err)
+	}
+	if err := os.Chmod(fd.Name(), 0444); err != nil {
+		return fmt.Errorf("chmod object file: %w", err)
+	}
+	full := path.Join(dir, s[2:])
+	if err := os.Rename(fd.Name(), full); err != nil {
+		return fmt.Errorf("rename object file: %w", err)
+	}
+	return r.syncLooseObject(full)
+}
+
+// objectPath returns the location of the loose object file with given hash.
+// All object directories are searched.
+func (r *Repository) objectPath(sha []byte) (string, error) {
+	s := hex.EncodeToString(sha)
+	for _, dir := range append([]string{r.objdir}, r.alternates...) {
+		full := path.Join(dir, s[:2], s[2:])
+		switch _, err := os.Stat(full); {
+		case err == nil:
+			return full, nil
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		default:
+			return "", fmt.Errorf("stat object: %w", err)
+		}
+	}
+	return "", fmt.Errorf("object %s: %w", s, os.ErrNotExist)
+}
+
+// HasObject returns true if an object with given hash exists in the
+// repository.
+func (r *Repository) HasObject(sha []byte) (bool, error) {
+	if len(sha) != 20 {
+		return false, fmt.Errorf("invalid hash length: %d", len(sha))
+	}
+	if _, err := r.objectPath(sha); err == nil {
+		return true, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	switch _, _, err := r.findPacked(sha); {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	default:
+		return false, err
 	}
-	return sha, werr
 }
 
 func (r *Repository) ResolveRef(ref string) ([]byte, error) {
@@ -252,7 +710,7 @@ var objects = map[string]func() Object{
 	"commit": func() Object { return &CommitObject{} },
 	"blob":   func() Object { return &BlobObject{} },
 	"tree":   func() Object { return &TreeObject{} },
-	"tag":    func() Object { panic("todo: tag") },
+	"tag":    func() Object { return &TagObject{} },
 }
 
 type Object interface {
@@ -294,7 +752,11 @@ readHeader:
 				buf = append(buf, c)
 			}
 		case c == '\n':
-			if next, err := rd.Peek(1); err == nil && next[0] == '\n' {
+			if next, err := rd.Peek(1); err == nil && next[0] == ' ' && len(key) != 0 {
+				// Continuation of a multi line value.
+				_, _ = rd.ReadByte()
+				buf = append(buf, c)
+			} else if err == nil && next[0] == '\n' {
 				// End of header.
 				_, _ = rd.ReadByte()
 				header[key] = append(header[key], string(buf))
@@ -319,7 +781,70 @@ readHeader:
 }
 
 func (o *CommitObject) Serialize() ([]byte, error) {
-	panic("todo")
+	var b bytes.Buffer
+	if err := serializeHeader(&b, o.Header, commitHeaderOrder); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	b.WriteString(o.Comment)
+	return b.Bytes(), nil
+}
+
+// commitHeaderOrder is the order in which git writes well known commit
+// header keys. Any other key is written after those, sorted by name.
+var commitHeaderOrder = []string{"tree", "parent", "author", "committer", "encoding"}
+
+// serializeHeader writes header keys in given order first, followed by all
+// remaining keys sorted alphabetically. Multi line values are written using
+// continuation lines that start with a space.
+func serializeHeader(w *bytes.Buffer, header map[string][]string, order []string) error {
+	keys := append([]string(nil), order...)
+	var rest []string
+	for key := range header {
+		known := false
+		for _, k := range order {
+			if k == key {
+				known = true
+				break
+			}
+		}
+		if !known {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	keys = append(keys, rest...)
+
+	for _, key := range keys {
+		if key == "" || strings.ContainsAny(key, " \n") {
+			return fmt.Errorf("invalid header key %q", key)
+		}
+		for _, value := range header[key] {
+			fmt.Fprintf(w, "%s %s\n", key, strings.ReplaceAll(value, "\n", "\n "))
+		}
+	}
+	return nil
+}
+
+// TagObject is an annotated tag. Its format is the same as the commit's,
+// with the object, type, tag and tagger header keys.
+type TagObject struct {
+	Header  map[string][]string
+	Comment string
+}
+
+func (o *TagObject) Deserialize(raw []byte) error {
+	var c CommitObject
+	if err := c.Deserialize(raw); err != nil {
+		return err
+	}
+	o.Header = c.Header
+	o.Comment = c.Comment
+	return nil
+}
+
+func (o *TagObject) Serialize() ([]byte, error) {
+	return nil, errors.New("not implemented")
 }
 
 type TreeObject struct {
@@ -332,6 +857,24 @@ type TreeLeaf struct {
 	Sha  []byte
 }
 
+// Tree leaf modes. Mode is stored as the decimal number that has the same
+// digits as the octal value written in the tree object.
+const (
+	modeTree    os.FileMode = 40000
+	modeBlob    os.FileMode = 100644
+	modeExec    os.FileMode = 100755
+	modeSymlink os.FileMode = 120000
+	modeGitlink os.FileMode = 160000
+)
+
+// Hashes of the empty tree and the empty blob. Like git, the repository
+// reads both even if they are not stored, so that anything can be compared
+// with an empty tree, for example the first commit.
+const (
+	EmptyTreeHash = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+	EmptyBlobHash = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+)
+
 func (o *TreeObject) Deserialize(raw []byte) error {
 	rd := bufio.NewReader(bytes.NewReader(raw))
 	for {
@@ -357,7 +900,7 @@ func (o *TreeObject) Deserialize(raw []byte) error {
 		leaf.Path = path[:len(path)-1]
 
 		sha := make([]byte, 20)
-		if _, err := rd.Read(sha); err != nil {
+		if _, err := io.ReadFull(rd, sha); err != nil {
 			return fmt.Errorf("read sha: %w", err)
 		}
 		leaf.Sha = sha
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -42,6 +48,23 @@ A commit message`,
 				Comment: "A commit message",
 			},
 		},
+		"multi line value": {
+			raw: `tree c7aebf0cbe2b1a70501c7b7e1e28faceaba77541
+gpgsig -----BEGIN PGP SIGNATURE-----
+ 
+ iQEzBAABCAAdFiEE
+ -----END PGP SIGNATURE-----
+
+A commit message`,
+
+			wantObj: CommitObject{
+				Header: map[string][]string{
+					"tree":   []string{"c7aebf0cbe2b1a70501c7b7e1e28faceaba77541"},
+					"gpgsig": []string{"-----BEGIN PGP SIGNATURE-----\n\niQEzBAABCAAdFiEE\n-----END PGP SIGNATURE-----"},
+				},
+				Comment: "A commit message",
+			},
+		},
 	}
 
 	for testName, tc := range cases {
@@ -61,3 +84,223 @@ A commit message`,
 		})
 	}
 }
+
+func TestCommitObjectSerialize(t *testing.T) {
+	raw := `tree c7aebf0cbe2b1a70501c7b7e1e28faceaba77541
+parent c2367d038bac610d36342cb5e3a88b5b0ca16616
+parent 8a0e7ef1ad8b3a4a0b1f6e0d3d62a6a3e4596e4b
+author Bob R <bobr@example.com> 1580755918 +0100
+committer Bob R <bobr@example.com> 1580755918 +0100
+gpgsig -----BEGIN PGP SIGNATURE-----
+ 
+ iQEzBAABCAAdFiEE
+ -----END PGP SIGNATURE-----
+
+A commit message
+`
+	var c CommitObject
+	if err := c.Deserialize([]byte(raw)); err != nil {
+		t.Fatalf("deserialize: %s", err)
+	}
+	got, err := c.Serialize()
+	if err != nil {
+		t.Fatalf("serialize: %s", err)
+	}
+	if string(got) != raw {
+		t.Logf("want %q", raw)
+		t.Fatalf("got  %q", got)
+	}
+
+	c.Header["bad key"] = []string{"value"}
+	if _, err := c.Serialize(); err == nil {
+		t.Fatal("want invalid header key error")
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	cases := map[string]struct {
+		config    string
+		wantLoose int
+		wantPack  int
+		wantErr   bool
+	}{
+		"default": {
+			wantLoose: zlib.BestSpeed,
+			wantPack:  zlib.DefaultCompression,
+		},
+		"core": {
+			config:    "[core]\ncompression = 9\n",
+			wantLoose: 9,
+			wantPack:  9,
+		},
+		"specific over core": {
+			config:    "[core]\ncompression = 9\nlooseCompression = 0\n[pack]\ncompression = 4\n",
+			wantLoose: 0,
+			wantPack:  4,
+		},
+		"out of range": {
+			config:  "[core]\nlooseCompression = 10\n",
+			wantErr: true,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gogit-test-")
+			if err != nil {
+				t.Fatalf("temp dir: %s", err)
+			}
+			defer os.RemoveAll(dir)
+			if _, err := CreateRepository(dir); err != nil {
+				t.Fatalf("create repository: %s", err)
+			}
+			config := filepath.Join(dir, ".git", "config")
+			fd, err := os.OpenFile(config, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatalf("open config: %s", err)
+			}
+			_, err = fd.WriteString(tc.config)
+			fd.Close()
+			if err != nil {
+				t.Fatalf("write config: %s", err)
+			}
+
+			repo, err := OpenRepository(dir)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("open repository: %s", err)
+			}
+			if repo.looseCompression != tc.wantLoose || repo.packCompression != tc.wantPack {
+				t.Fatalf("want levels %d and %d, got %d and %d", tc.wantLoose, tc.wantPack, repo.looseCompression, repo.packCompression)
+			}
+
+			// Level 0 stores the object as it is.
+			content := bytes.Repeat([]byte("hello world\n"), 10)
+			sha, err := repo.WriteObject("blob", content)
+			if err != nil {
+				t.Fatalf("write object: %s", err)
+			}
+			s := hex.EncodeToString(sha)
+			raw, err := ioutil.ReadFile(filepath.Join(dir, ".git", "objects", s[:2], s[2:]))
+			if err != nil {
+				t.Fatalf("read object: %s", err)
+			}
+			if stored := bytes.Contains(raw, content); stored != (tc.wantLoose == 0) {
+				t.Fatalf("want object stored uncompressed %v, got %v", tc.wantLoose == 0, stored)
+			}
+		})
+	}
+}
+
+func TestInitRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	template := filepath.Join(dir, "template")
+	if err := os.MkdirAll(filepath.Join(template, "hooks"), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(template, "hooks", "post-commit"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("write hook: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(template, "description"), []byte("From template.\n"), 0644); err != nil {
+		t.Fatalf("write description: %s", err)
+	}
+
+	repo, err := InitRepository(filepath.Join(dir, "bare.git"), &InitOptions{
+		Bare:          true,
+		InitialBranch: "main",
+		TemplateDir:   template,
+	})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if repo.workdir != "" || repo.gitdir != filepath.Join(dir, "bare.git") {
+		t.Fatalf("want a bare repository, got worktree %q and git directory %q", repo.workdir, repo.gitdir)
+	}
+	head, err := ioutil.ReadFile(filepath.Join(repo.gitdir, "HEAD"))
+	if err != nil {
+		t.Fatalf("read HEAD: %s", err)
+	}
+	if string(head) != "ref: refs/heads/main\n" {
+		t.Fatalf("unexpected HEAD %q", head)
+	}
+	if info, err := os.Stat(filepath.Join(repo.gitdir, "hooks", "post-commit")); err != nil || info.Mode().Perm() != 0755 {
+		t.Fatalf("hook was not copied: %v", err)
+	}
+	if desc, err := ioutil.ReadFile(filepath.Join(repo.gitdir, "description")); err != nil || string(desc) != "From template.\n" {
+		t.Fatalf("want the template description, got %q (%v)", desc, err)
+	}
+
+	opened, err := OpenRepository(repo.gitdir)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if opened.workdir != "" {
+		t.Fatalf("bare repository opened with worktree %q", opened.workdir)
+	}
+	if bare, err := opened.config.Bool("core", "", "bare", false); err != nil || !bare {
+		t.Fatalf("want core.bare, got %v (%v)", bare, err)
+	}
+
+	if _, err := InitRepository(filepath.Join(dir, "invalid"), &InitOptions{InitialBranch: "a..b"}); err == nil {
+		t.Fatal("invalid initial branch accepted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "invalid")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("repository with invalid branch was created: %v", err)
+	}
+}
+
+func TestReadEmptyObjects(t *testing.T) {
+	repo := newTestRepository(t)
+	for kind, s := range map[string]string{"tree": EmptyTreeHash, "blob": EmptyBlobHash} {
+		sha, _ := hex.DecodeString(s)
+		if !bytes.Equal(hashObject(kind, nil), sha) {
+			t.Errorf("%s: want the hash of the empty object, got %s", kind, s)
+		}
+		assertHasObject(t, repo, sha, false)
+		got, content, err := repo.ReadRawObject(sha)
+		if err != nil {
+			t.Fatalf("%s: read: %s", kind, err)
+		}
+		if got != kind || len(content) != 0 {
+			t.Errorf("%s: unexpected %s object of %d bytes", kind, got, len(content))
+		}
+	}
+
+	// The first commit is compared with the empty tree.
+	blob, err := repo.WriteObject("blob", []byte("content\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	tb := NewTreeBuilder(repo, nil)
+	if err := tb.Insert("file", modeBlob, blob); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	tree, err := tb.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	a, err := repo.readTreeish(EmptyTreeHash)
+	if err != nil {
+		t.Fatalf("read empty tree: %s", err)
+	}
+	b, err := repo.readTree(tree)
+	if err != nil {
+		t.Fatalf("read tree: %s", err)
+	}
+	changes, err := repo.DiffTrees(a, b, true, nil)
+	if err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	if len(changes) != 1 || changes[0].Path != "file" || changes[0].Status != 'A' {
+		t.Fatalf("want file added, got %v", changes)
+	}
+}
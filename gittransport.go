@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultGitPort = "9418"
+
+// gitTransport is the client of the anonymous git protocol, served by git
+// daemon. It can only fetch.
+type gitTransport struct {
+	*streamTransport
+	url *url.URL
+}
+
+func openGitTransport(local *Repository, rawurl string) (*gitTransport, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	version, err := local.wireProtocolVersion()
+	if err != nil {
+		return nil, err
+	}
+	var extra []string
+	if version == 2 {
+		extra = append(extra, "version=2")
+	}
+	conn, err := dialGitDaemon(u, extra...)
+	if err != nil {
+		return nil, err
+	}
+	st, err := newStreamTransport(local, "git://", conn, conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &gitTransport{streamTransport: st, url: u}, nil
+}
+
+// dialGitDaemon connects to git daemon and requests upload-pack of the
+// repository. Extra parameters, for example "version=2", are passed to the
+// server.
+func dialGitDaemon(u *url.URL, extra ...string) (net.Conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultGitPort)
+	}
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	// The request names the service, the repository and the virtual host,
+	// each terminated with a NUL byte. Extra parameters follow another NUL
+	// byte.
+	request := fmt.Sprintf("git-upload-pack %s\x00host=%s\x00", u.Path, u.Host)
+	if len(extra) != 0 {
+		request += "\x00" + strings.Join(extra, "\x00") + "\x00"
+	}
+	if err := writePktLine(conn, "%s", request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	return conn, nil
+}
+
+// ObjectSizes asks for sizes of the objects with the object-info command of
+// protocol version 2, over a separate connection.
+func (t *gitTransport) ObjectSizes(shas [][]byte) ([]int64, error) {
+	conn, err := dialGitDaemon(t.url, "version=2")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	caps, err := readCapabilityAdvertisement(rd)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := caps["object-info"]; !ok {
+		return nil, errors.New("object-info is not supported by the remote repository")
+	}
+	if err := writeObjectInfoRequest(conn, shas); err != nil {
+		return nil, err
+	}
+	return readObjectInfoResponse(rd, shas)
+}
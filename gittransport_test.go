@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// serveGitDaemon accepts a single connection on a loopback port and runs
+// the script of a git daemon with it. It returns the address of the server
+// and a function that waits for the script to finish.
+func serveGitDaemon(t *testing.T, script func(rd *bufio.Reader, w io.Writer) error) (string, func() error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		done <- script(bufio.NewReader(conn), conn)
+	}()
+	return ln.Addr().String(), func() error { return <-done }
+}
+
+// readPktLines reads packet lines until a flush packet or the stop line,
+// which is returned with the lines.
+func readPktLines(rd io.Reader, stop string) ([]string, error) {
+	var lines []string
+	for {
+		line, err := readPktLine(rd)
+		if err != nil {
+			return lines, err
+		}
+		if line == nil {
+			return lines, nil
+		}
+		lines = append(lines, string(line))
+		if string(line) == stop {
+			return lines, nil
+		}
+	}
+}
+
+func TestGitTransportFetch(t *testing.T) {
+	upstream := newTestRepository(t)
+	base := writeTestCommit(t, upstream, "base")
+	head := writeTestCommit(t, upstream, "head", base)
+	// The pack has only the objects that are not reachable from the
+	// common commit.
+	known := make(map[string]bool)
+	var objects [][]byte
+	for _, tip := range [][]byte{base, head} {
+		err := upstream.WalkObjects([][]byte{tip}, func(o *WalkedObject) error {
+			if !known[string(o.Sha)] {
+				known[string(o.Sha)] = true
+				if bytes.Equal(tip, head) {
+					objects = append(objects, o.Sha)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("walk objects: %s", err)
+		}
+	}
+
+	// The local history has more commits than fit in a batch of haves
+	// before the common one.
+	local := newTestRepository(t)
+	tip := writeTestCommit(t, local, "base")
+	for i := 0; i < haveBatchSize+4; i++ {
+		tip = writeTestCommit(t, local, fmt.Sprintf("local %d", i), tip)
+	}
+	if err := local.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: tip}); err != nil {
+		t.Fatalf("update ref: %s", err)
+	}
+
+	var request string
+	var wants []string
+	var batches [][]string
+	addr, wait := serveGitDaemon(t, func(rd *bufio.Reader, w io.Writer) error {
+		line, err := readPktLine(rd)
+		if err != nil {
+			return err
+		}
+		request = string(line)
+		writePktLine(w, "%x HEAD\x00multi_ack ofs-delta symref=HEAD:refs/heads/main agent=git/test\n", head)
+		writePktLine(w, "%x refs/heads/main\n", head)
+		writeFlushPkt(w)
+		if wants, err = readPktLines(rd, "done\n"); err != nil {
+			return err
+		}
+		for {
+			haves, err := readPktLines(rd, "done\n")
+			if err != nil {
+				return err
+			}
+			if len(haves) != 0 && haves[len(haves)-1] == "done\n" {
+				break
+			}
+			batches = append(batches, haves)
+			if strings.Contains(strings.Join(haves, ""), fmt.Sprintf("have %x\n", base)) {
+				writePktLine(w, "ACK %x\n", base)
+			} else {
+				writePktLine(w, "NAK\n")
+			}
+		}
+		writePktLine(w, "ACK %x\n", base)
+		_, _, err = upstream.writePackData(w, objects)
+		return err
+	})
+
+	tr, err := openGitTransport(local, "git://"+addr+"/repo.git")
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	refs, err := tr.ListRefs()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(refs) != 2 || refs[0].Name != "HEAD" || refs[0].Target != "refs/heads/main" || !bytes.Equal(refs[1].Sha, head) {
+		t.Fatalf("unexpected references %+v", refs)
+	}
+	if err := tr.Fetch(refs[1:]); err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	if err := wait(); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	if want := "git-upload-pack /repo.git\x00host=" + addr + "\x00\x00version=2\x00"; request != want {
+		t.Fatalf("want request %q, got %q", want, request)
+	}
+	if want := fmt.Sprintf("want %x agent=gogit ofs-delta\n", head); len(wants) != 1 || wants[0] != want {
+		t.Fatalf("want %q, got %q", want, wants)
+	}
+	// The first batch is not acknowledged, the second has the common
+	// commit.
+	if len(batches) != 2 || len(batches[0]) != haveBatchSize || batches[1][len(batches[1])-1] != fmt.Sprintf("have %x\n", base) {
+		t.Fatalf("unexpected batches of haves %q", batches)
+	}
+	for _, sha := range objects {
+		if ok, err := local.HasObject(sha); err != nil || !ok {
+			t.Fatalf("want fetched object %x, got %v, %v", sha, ok, err)
+		}
+	}
+}
+
+func TestGitTransportError(t *testing.T) {
+	local := newTestRepository(t)
+	addr, wait := serveGitDaemon(t, func(rd *bufio.Reader, w io.Writer) error {
+		if _, err := readPktLine(rd); err != nil {
+			return err
+		}
+		return writePktLine(w, "ERR access denied or repository not exported: /repo.git\n")
+	})
+	_, err := openGitTransport(local, "git://"+addr+"/repo.git")
+	if err == nil || !strings.Contains(err.Error(), "remote error: access denied") {
+		t.Fatalf("want remote error, got %v", err)
+	}
+	if err := wait(); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+}
+
+func TestReadAdvertisement(t *testing.T) {
+	const sha = "0123456789012345678901234567890123456789"
+	var b bytes.Buffer
+	writePktLine(&b, "%s HEAD\x00multi_ack symref=HEAD:refs/heads/main\n", sha)
+	writePktLine(&b, "%s refs/heads/main\n", sha)
+	writePktLine(&b, "%s refs/tags/v1\n", sha)
+	writePktLine(&b, "%s refs/tags/v1^{}\n", sha)
+	writeFlushPkt(&b)
+	refs, caps, err := readAdvertisement(&b)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	var names []string
+	for _, ref := range refs {
+		names = append(names, ref.Name+">"+ref.Target)
+	}
+	if got := strings.Join(names, " "); got != "HEAD>refs/heads/main refs/heads/main> refs/tags/v1>" {
+		t.Fatalf("unexpected references %s", got)
+	}
+	if strings.Join(caps, " ") != "multi_ack symref=HEAD:refs/heads/main" {
+		t.Fatalf("unexpected capabilities %q", caps)
+	}
+
+	// An empty repository advertises only the capabilities.
+	b.Reset()
+	writePktLine(&b, "%s capabilities^{}\x00ofs-delta\n", strings.Repeat("0", 40))
+	writeFlushPkt(&b)
+	if refs, caps, err = readAdvertisement(&b); err != nil || len(refs) != 0 || len(caps) != 1 {
+		t.Fatalf("want only capabilities, got %+v %q %v", refs, caps, err)
+	}
+}
+
+func TestReadAcknowledgement(t *testing.T) {
+	const sha = "0123456789012345678901234567890123456789"
+	cases := map[string]struct {
+		line    string
+		want    bool
+		wantErr bool
+	}{
+		"nak":                {line: "NAK\n"},
+		"ack":                {line: "ACK " + sha + "\n", want: true},
+		"multi_ack continue": {line: "ACK " + sha + " continue\n", want: true},
+		"multi_ack common":   {line: "ACK " + sha + " common\n", want: true},
+		"error":              {line: "ERR upload-pack: not our ref\n", wantErr: true},
+		"unexpected":         {line: "shallow " + sha + "\n", wantErr: true},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var b bytes.Buffer
+			writePktLine(&b, "%s", tc.line)
+			acked, err := readAcknowledgement(&b)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read: %s", err)
+			}
+			if acked != tc.want {
+				t.Fatalf("want %v, got %v", tc.want, acked)
+			}
+		})
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/husio/gogit
 
-go 1.13
+go 1.14
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+)
+
+// logGraph draws the ASCII history graph of git log --graph next to the
+// commits, the same way git does. Every branch line is a column of two
+// characters. Commits must be given children first, and each commit is
+// drawn on a row of its own, preceded by rows making room for octopus
+// merges and followed by rows connecting it to its parents.
+type logGraph struct {
+	// commit is the commit being drawn and parents are its parents that
+	// are shown.
+	commit  string
+	parents []string
+	// width is the number of characters the commit rows take.
+	width        int
+	expansionRow int
+	state        graphState
+	prevState    graphState
+	// commitIndex is the column of the commit, and prevCommitIndex the
+	// one of the commit drawn before.
+	commitIndex     int
+	prevCommitIndex int
+	// mergeLayout is 0 if the first parent of a merge goes to a column
+	// on its left, and 1 otherwise.
+	mergeLayout    int
+	edgesAdded     int
+	prevEdgesAdded int
+	// columns are the commits expected on each branch line before the
+	// commit row, and newColumns after it.
+	columns    []string
+	newColumns []string
+	// mapping tells for each character of the current row which column of
+	// newColumns the branch line drawn there goes to, or -1.
+	mapping     []int
+	oldMapping  []int
+	mappingSize int
+}
+
+type graphState int
+
+const (
+	statePadding graphState = iota
+	stateSkip
+	statePreCommit
+	stateCommit
+	statePostMerge
+	stateCollapsing
+)
+
+// update starts drawing the next commit with the parents that are shown.
+func (g *logGraph) update(sha []byte, parents [][]byte) {
+	g.commit = string(sha)
+	g.parents = g.parents[:0]
+	for _, p := range parents {
+		g.parents = append(g.parents, string(p))
+	}
+	g.prevCommitIndex = g.commitIndex
+	g.updateColumns()
+	g.expansionRow = 0
+	switch {
+	case g.state != statePadding:
+		g.state = stateSkip
+	case g.needsPreCommitLine():
+		g.state = statePreCommit
+	default:
+		g.state = stateCommit
+	}
+}
+
+func (g *logGraph) setState(s graphState) {
+	g.prevState = g.state
+	g.state = s
+}
+
+func (g *logGraph) updateColumns() {
+	g.columns, g.newColumns = g.newColumns, g.columns[:0]
+	maxColumns := len(g.columns) + len(g.parents)
+	g.mappingSize = 2 * maxColumns
+	if len(g.mapping) < g.mappingSize {
+		// The old mapping is still needed by the commit row.
+		old := make([]int, g.mappingSize)
+		copy(old, g.oldMapping)
+		for i := len(g.oldMapping); i < len(old); i++ {
+			old[i] = -1
+		}
+		g.mapping, g.oldMapping = make([]int, g.mappingSize), old
+	}
+	for i := 0; i < g.mappingSize; i++ {
+		g.mapping[i] = -1
+	}
+	g.width = 0
+	g.prevEdgesAdded = g.edgesAdded
+	g.edgesAdded = 0
+
+	// The commit gets a column of its own if no commit drawn so far is
+	// its child.
+	seen := false
+	for i := 0; i <= len(g.columns); i++ {
+		col := g.commit
+		if i < len(g.columns) {
+			col = g.columns[i]
+		} else if seen {
+			break
+		}
+		if col != g.commit {
+			g.insertColumn(col, -1)
+			continue
+		}
+		seen = true
+		g.commitIndex = i
+		g.mergeLayout = -1
+		for _, p := range g.parents {
+			g.insertColumn(p, i)
+		}
+		// The commit takes up a column even without parents.
+		if len(g.parents) == 0 {
+			g.width += 2
+		}
+	}
+	for g.mappingSize > 1 && g.mapping[g.mappingSize-1] < 0 {
+		g.mappingSize--
+	}
+}
+
+// insertColumn adds a column for the commit unless it already has one. Idx
+// is the column of the commit being drawn if it is its parent.
+func (g *logGraph) insertColumn(commit string, idx int) {
+	i := g.findNewColumn(commit)
+	if i < 0 {
+		i = len(g.newColumns)
+		g.newColumns = append(g.newColumns, commit)
+	}
+
+	var mappingIdx int
+	switch {
+	case len(g.parents) > 1 && idx > -1 && g.mergeLayout == -1:
+		// The layout of a merge depends on whether its first parent
+		// is in a column on its left.
+		dist := idx - i
+		shift := 1
+		if dist > 1 {
+			shift = 2*dist - 3
+		}
+		g.mergeLayout = 1
+		if dist > 0 {
+			g.mergeLayout = 0
+		}
+		g.edgesAdded = len(g.parents) + g.mergeLayout - 2
+		mappingIdx = g.width + (g.mergeLayout-1)*shift
+		g.width += 2 * g.mergeLayout
+	case g.edgesAdded > 0 && i == g.mapping[g.width-2]:
+		// The parent is in the last existing column, so it is joined
+		// right away instead of with an added edge.
+		mappingIdx = g.width - 2
+		g.edgesAdded = -1
+	default:
+		mappingIdx = g.width
+		g.width += 2
+	}
+	g.mapping[mappingIdx] = i
+}
+
+func (g *logGraph) findNewColumn(commit string) int {
+	for i, c := range g.newColumns {
+		if c == commit {
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *logGraph) numDashedParents() int {
+	return len(g.parents) + g.mergeLayout - 3
+}
+
+func (g *logGraph) needsPreCommitLine() bool {
+	return len(g.parents) >= 3 && g.commitIndex < len(g.columns)-1 &&
+		g.expansionRow < 2*g.numDashedParents()
+}
+
+// isMappingCorrect tells whether every branch line is in its column, or
+// will be after a '/'.
+func (g *logGraph) isMappingCorrect() bool {
+	for i := 0; i < g.mappingSize; i++ {
+		if target := g.mapping[i]; target >= 0 && target != i/2 {
+			return false
+		}
+	}
+	return true
+}
+
+// finished tells whether all rows of the commit are drawn.
+func (g *logGraph) finished() bool {
+	return g.state == statePadding
+}
+
+// nextLine returns the next row of the graph, and whether it is the row of
+// the commit itself.
+func (g *logGraph) nextLine() (string, bool) {
+	var b strings.Builder
+	commitLine := false
+	switch g.state {
+	case statePadding:
+		for range g.newColumns {
+			b.WriteString("| ")
+		}
+	case stateSkip:
+		b.WriteString("...")
+		if g.needsPreCommitLine() {
+			g.setState(statePreCommit)
+		} else {
+			g.setState(stateCommit)
+		}
+	case statePreCommit:
+		g.writePreCommitLine(&b)
+	case stateCommit:
+		g.writeCommitLine(&b)
+		commitLine = true
+	case statePostMerge:
+		g.writePostMergeLine(&b)
+	case stateCollapsing:
+		g.writeCollapsingLine(&b)
+	}
+	g.pad(&b)
+	return b.String(), commitLine
+}
+
+// paddingLine returns a row leaving the branch lines unchanged, to go next
+// to lines that belong to no commit.
+func (g *logGraph) paddingLine() string {
+	if g.state != stateCommit {
+		line, _ := g.nextLine()
+		return line
+	}
+	var b strings.Builder
+	for _, col := range g.columns {
+		b.WriteByte('|')
+		if col == g.commit && len(g.parents) > 2 {
+			b.WriteString(strings.Repeat(" ", (len(g.parents)-2)*2))
+		} else {
+			b.WriteByte(' ')
+		}
+	}
+	g.pad(&b)
+	g.prevState = statePadding
+	return b.String()
+}
+
+// pad makes all rows of a commit the same width.
+func (g *logGraph) pad(b *strings.Builder) {
+	if n := g.width - b.Len(); n > 0 {
+		b.WriteString(strings.Repeat(" ", n))
+	}
+}
+
+func (g *logGraph) writePreCommitLine(b *strings.Builder) {
+	seen := false
+	for i, col := range g.columns {
+		switch {
+		case col == g.commit:
+			seen = true
+			b.WriteByte('|')
+			b.WriteString(strings.Repeat(" ", g.expansionRow))
+		case seen && g.expansionRow == 0:
+			// Lines after a merge drawn just before go on as '\'.
+			if g.prevState == statePostMerge && g.prevCommitIndex < i {
+				b.WriteByte('\\')
+			} else {
+				b.WriteByte('|')
+			}
+		case seen:
+			b.WriteByte('\\')
+		default:
+			b.WriteByte('|')
+		}
+		b.WriteByte(' ')
+	}
+	g.expansionRow++
+	if !g.needsPreCommitLine() {
+		g.setState(stateCommit)
+	}
+}
+
+func (g *logGraph) writeCommitLine(b *strings.Builder) {
+	seen := false
+	for i := 0; i <= len(g.columns); i++ {
+		col := g.commit
+		if i < len(g.columns) {
+			col = g.columns[i]
+		} else if seen {
+			break
+		}
+		switch {
+		case col == g.commit:
+			seen = true
+			b.WriteByte('*')
+			if len(g.parents) > 2 {
+				// The dashes of an octopus merge.
+				dashed := g.numDashedParents()
+				for j := 0; j < dashed; j++ {
+					b.WriteByte('-')
+					if j == dashed-1 {
+						b.WriteByte('.')
+					} else {
+						b.WriteByte('-')
+					}
+				}
+			}
+		case seen && g.edgesAdded > 1:
+			b.WriteByte('\\')
+		case seen && g.edgesAdded == 1:
+			if g.prevState == statePostMerge && g.prevEdgesAdded > 0 && g.prevCommitIndex < i {
+				b.WriteByte('\\')
+			} else {
+				b.WriteByte('|')
+			}
+		case g.prevState == stateCollapsing && g.oldMapping[2*i+1] == i && g.mapping[2*i] < i:
+			b.WriteByte('/')
+		default:
+			b.WriteByte('|')
+		}
+		b.WriteByte(' ')
+	}
+	switch {
+	case len(g.parents) > 1:
+		g.setState(statePostMerge)
+	case g.isMappingCorrect():
+		g.setState(statePadding)
+	default:
+		g.setState(stateCollapsing)
+	}
+}
+
+var graphMergeChars = [...]byte{'/', '|', '\\'}
+
+func (g *logGraph) writePostMergeLine(b *strings.Builder) {
+	// Past the column of the first parent, the edge going to it from the
+	// merge is drawn horizontally.
+	seen, pastParent := false, false
+	for i := 0; i <= len(g.columns); i++ {
+		col := g.commit
+		if i < len(g.columns) {
+			col = g.columns[i]
+		} else if seen {
+			break
+		}
+		switch {
+		case col == g.commit:
+			seen = true
+			idx := g.mergeLayout
+			for j := range g.parents {
+				b.WriteByte(graphMergeChars[idx])
+				if idx == 2 {
+					if g.edgesAdded > 0 || j < len(g.parents)-1 {
+						b.WriteByte(' ')
+					}
+				} else {
+					idx++
+				}
+			}
+			if g.edgesAdded == 0 {
+				b.WriteByte(' ')
+			}
+		case seen:
+			if g.edgesAdded > 0 {
+				b.WriteByte('\\')
+			} else {
+				b.WriteByte('|')
+			}
+			b.WriteByte(' ')
+		default:
+			b.WriteByte('|')
+			if g.mergeLayout != 0 || i != g.commitIndex-1 {
+				if pastParent {
+					b.WriteByte('_')
+				} else {
+					b.WriteByte(' ')
+				}
+			}
+		}
+		if len(g.parents) != 0 && col == g.parents[0] {
+			pastParent = true
+		}
+	}
+	if g.isMappingCorrect() {
+		g.setState(statePadding)
+	} else {
+		g.setState(stateCollapsing)
+	}
+}
+
+// writeCollapsingLine moves branch lines to the left, towards their
+// columns. Lines only ever move to the left, and only one of them moves
+// horizontally across others in a row.
+func (g *logGraph) writeCollapsingLine(b *strings.Builder) {
+	g.mapping, g.oldMapping = g.oldMapping, g.mapping
+	for i := 0; i < g.mappingSize; i++ {
+		g.mapping[i] = -1
+	}
+	horizontalEdge, horizontalTarget := -1, -1
+	for i := 0; i < g.mappingSize; i++ {
+		target := g.oldMapping[i]
+		switch {
+		case target < 0:
+		case target*2 == i:
+			// Already in its column.
+			g.mapping[i] = target
+		case g.mapping[i-1] < 0:
+			// Nothing on the left, move there.
+			g.mapping[i-1] = target
+			if horizontalEdge == -1 {
+				horizontalEdge, horizontalTarget = i, target
+				for j := target*2 + 3; j < i-2; j += 2 {
+					g.mapping[j] = target
+				}
+			}
+		case g.mapping[i-1] == target:
+			// Joins the line on the left going to the same column.
+		default:
+			// Crosses over the line on the left, which is not the
+			// target.
+			g.mapping[i-2] = target
+			if horizontalEdge == -1 {
+				horizontalEdge, horizontalTarget = i-1, target
+				for j := target*2 + 3; j < i-2; j += 2 {
+					g.mapping[j] = target
+				}
+			}
+		}
+	}
+	copy(g.oldMapping, g.mapping[:g.mappingSize])
+	if g.mapping[g.mappingSize-1] < 0 {
+		g.mappingSize--
+	}
+
+	usedHorizontal := false
+	for i := 0; i < g.mappingSize; i++ {
+		target := g.mapping[i]
+		switch {
+		case target < 0:
+			b.WriteByte(' ')
+		case target*2 == i:
+			b.WriteByte('|')
+		case target == horizontalTarget && i != horizontalEdge-1:
+			// Only the first segment of the horizontal line goes on
+			// into the next row.
+			if i != target*2+3 {
+				g.mapping[i] = -1
+			}
+			usedHorizontal = true
+			b.WriteByte('_')
+		default:
+			if usedHorizontal && i < horizontalEdge {
+				g.mapping[i] = -1
+			}
+			b.WriteByte('/')
+		}
+	}
+	if g.isMappingCorrect() {
+		g.setState(statePadding)
+	}
+}
+
+// writeCommit writes the rows of the graph up to the row of the commit,
+// which is left for the first line of the commit to continue.
+func (g *logGraph) writeCommit(w *bufio.Writer) {
+	if g.finished() {
+		w.WriteString(g.paddingLine())
+		return
+	}
+	for !g.finished() {
+		line, commitLine := g.nextLine()
+		w.WriteString(line)
+		if commitLine {
+			return
+		}
+		w.WriteByte('\n')
+	}
+}
+
+// writeMessage writes the lines following the commit row, each but the
+// first preceded by the next row of the graph, and then the remaining rows
+// of the commit.
+func (g *logGraph) writeMessage(w *bufio.Writer, msg string) {
+	for p := msg; ; {
+		i := strings.IndexByte(p, '\n')
+		if i < 0 {
+			w.WriteString(p)
+			break
+		}
+		w.WriteString(p[:i+1])
+		if p = p[i+1:]; p == "" {
+			break
+		}
+		line, _ := g.nextLine()
+		w.WriteString(line)
+	}
+	if g.finished() {
+		return
+	}
+	terminated := strings.HasSuffix(msg, "\n")
+	if !terminated {
+		w.WriteByte('\n')
+	}
+	for {
+		line, _ := g.nextLine()
+		w.WriteString(line)
+		if g.finished() {
+			break
+		}
+		w.WriteByte('\n')
+	}
+	if terminated {
+		w.WriteByte('\n')
+	}
+}
+
+// sortForGraph orders the commits so that every commit comes after its
+// children, and returns the parents of each commit that are among them.
+// Commits are taken from a stack, so that a line of history is shown until
+// it merges instead of interleaved with others, and the last parent of a
+// merge is followed first, the same way as git log --graph does.
+func sortForGraph(commits []*WalkedCommit, firstParent bool) ([]*WalkedCommit, map[string][][]byte) {
+	bySha := make(map[string]*WalkedCommit, len(commits))
+	for _, c := range commits {
+		bySha[string(c.Sha)] = c
+	}
+	parents := make(map[string][][]byte, len(commits))
+	children := make(map[string]int, len(commits))
+	for _, c := range commits {
+		ps := c.Parents
+		if firstParent && len(ps) > 1 {
+			ps = ps[:1]
+		}
+		var shown [][]byte
+		for _, p := range ps {
+			if _, ok := bySha[string(p)]; ok {
+				shown = append(shown, p)
+				children[string(p)]++
+			}
+		}
+		parents[string(c.Sha)] = shown
+	}
+
+	var stack []*WalkedCommit
+	for i := len(commits) - 1; i >= 0; i-- {
+		if children[string(commits[i].Sha)] == 0 {
+			stack = append(stack, commits[i])
+		}
+	}
+	sorted := make([]*WalkedCommit, 0, len(commits))
+	for len(stack) != 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		sorted = append(sorted, c)
+		for _, p := range parents[string(c.Sha)] {
+			if children[string(p)]--; children[string(p)] == 0 {
+				stack = append(stack, bySha[string(p)])
+			}
+		}
+	}
+	return sorted, parents
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLogGraph(t *testing.T) {
+	cases := map[string]struct {
+		// commits are given newest first, each followed by its
+		// parents.
+		commits [][]string
+		want    []string
+	}{
+		"linear": {
+			commits: [][]string{{"C", "B"}, {"B", "A"}, {"A"}},
+			want: []string{
+				"* C",
+				"* B",
+				"* A",
+			},
+		},
+		"merge": {
+			commits: [][]string{{"D", "B", "C"}, {"C", "A"}, {"B", "A"}, {"A"}},
+			want: []string{
+				"*   D",
+				"|\\  ",
+				"| * C",
+				"* | B",
+				"|/  ",
+				"* A",
+			},
+		},
+		"octopus": {
+			commits: [][]string{
+				{"H", "F", "G"}, {"G", "C"}, {"F", "E"},
+				{"E", "B", "C", "D"}, {"D", "A"}, {"C", "A"}, {"B", "A"}, {"A"},
+			},
+			want: []string{
+				"*   H",
+				"|\\  ",
+				"| * G",
+				"* | F",
+				"| |     ",
+				"|  \\    ",
+				"*-. \\   E",
+				"|\\ \\ \\  ",
+				"| | |/  ",
+				"| |/|   ",
+				"| | * D",
+				"| * | C",
+				"| |/  ",
+				"* / B",
+				"|/  ",
+				"* A",
+			},
+		},
+		"unrelated": {
+			commits: [][]string{{"B"}, {"A"}},
+			want: []string{
+				"* B",
+				"* A",
+			},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var commits []*WalkedCommit
+			for _, c := range tc.commits {
+				wc := &WalkedCommit{Sha: []byte(c[0])}
+				for _, p := range c[1:] {
+					wc.Parents = append(wc.Parents, []byte(p))
+				}
+				commits = append(commits, wc)
+			}
+			sorted, parents := sortForGraph(commits, false)
+
+			var b bytes.Buffer
+			w := bufio.NewWriter(&b)
+			g := &logGraph{}
+			for _, c := range sorted {
+				g.update(c.Sha, parents[string(c.Sha)])
+				g.writeCommit(w)
+				g.writeMessage(w, string(c.Sha))
+				w.WriteByte('\n')
+			}
+			w.Flush()
+			if want := strings.Join(tc.want, "\n") + "\n"; b.String() != want {
+				t.Fatalf("want:\n%s\ngot:\n%s", want, b.String())
+			}
+		})
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	cases := map[string]struct {
+		format  string
+		want    logFormat
+		wantErr bool
+	}{
+		"medium":       {format: "medium", want: logFormat{name: "medium"}},
+		"oneline":      {format: "oneline", want: logFormat{name: "oneline", terminated: true}},
+		"format":       {format: "format:%h", want: logFormat{name: "format", user: "%h"}},
+		"tformat":      {format: "tformat:%h", want: logFormat{name: "format", user: "%h", terminated: true}},
+		"placeholders": {format: "%h %s", want: logFormat{name: "format", user: "%h %s", terminated: true}},
+		"unknown":      {format: "fuller", wantErr: true},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, err := parseLogFormat(tc.format)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// helperTransport talks to an external git-remote-<name> program using the
+// remote helper protocol described in gitremote-helpers(7). The helper runs
+// with GIT_DIR set to the local repository, so that it can read objects to
+// push and write fetched objects directly.
+type helperTransport struct {
+	local    *Repository
+	cmd      *exec.Cmd
+	in       io.WriteCloser
+	out      *bufio.Reader
+	caps     map[string]bool
+	refspecs []*Refspec
+}
+
+// helperURL splits an URL of the <transport>::<address> form. False is
+// returned if the URL does not use this form.
+func helperURL(url string) (string, string, bool) {
+	i := strings.Index(url, "::")
+	if i <= 0 || strings.ContainsAny(url[:i], "/:") {
+		return "", "", false
+	}
+	return url[:i], url[i+2:], true
+}
+
+func openHelperTransport(local *Repository, name, url string) (*helperTransport, error) {
+	program := "git-remote-" + name
+	if _, err := exec.LookPath(program); err != nil {
+		return nil, fmt.Errorf("unsupported %q transport: %w", name, err)
+	}
+	cmd := exec.Command(program, url, url)
+	cmd.Env = append(os.Environ(), "GIT_DIR="+local.gitdir)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdin pipe: %w", err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", program, err)
+	}
+	t := &helperTransport{
+		local: local,
+		cmd:   cmd,
+		in:    in,
+		out:   bufio.NewReader(out),
+		caps:  make(map[string]bool),
+	}
+	if err := t.readCapabilities(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *helperTransport) send(lines ...string) error {
+	if _, err := io.WriteString(t.in, strings.Join(lines, "\n")+"\n"); err != nil {
+		if errors.Is(err, syscall.EPIPE) {
+			return errors.New("helper exited unexpectedly")
+		}
+		return fmt.Errorf("write to helper: %w", err)
+	}
+	return nil
+}
+
+func (t *helperTransport) readLine() (string, error) {
+	line, err := t.out.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", errors.New("helper exited unexpectedly")
+		}
+		return "", fmt.Errorf("read from helper: %w", err)
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// readBlock reads response lines until a blank line.
+func (t *helperTransport) readBlock() ([]string, error) {
+	var lines []string
+	for {
+		line, err := t.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return lines, nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func (t *helperTransport) readCapabilities() error {
+	if err := t.send("capabilities"); err != nil {
+		return err
+	}
+	lines, err := t.readBlock()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		// Asterisk marks capabilities that must be understood.
+		mandatory := strings.HasPrefix(line, "*")
+		line = strings.TrimPrefix(line, "*")
+		switch {
+		case strings.HasPrefix(line, "refspec "):
+			spec, err := ParseRefspec(strings.TrimPrefix(line, "refspec "))
+			if err != nil {
+				return fmt.Errorf("helper refspec: %w", err)
+			}
+			t.refspecs = append(t.refspecs, spec)
+		case line == "fetch", line == "import", line == "push", line == "option":
+			t.caps[line] = true
+		default:
+			if mandatory {
+				return fmt.Errorf("helper requires unsupported %q capability", line)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *helperTransport) ListRefs() ([]*Ref, error) {
+	command := "list"
+	if t.caps["push"] && !t.caps["fetch"] && !t.caps["import"] {
+		command = "list for-push"
+	}
+	if err := t.send(command); err != nil {
+		return nil, err
+	}
+	lines, err := t.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	var refs []*Ref
+	byName := make(map[string]*Ref)
+	for _, line := range lines {
+		chunks := strings.Fields(line)
+		if len(chunks) < 2 {
+			if strings.HasPrefix(line, ":") {
+				// Keywords, like ":object-format sha1".
+				continue
+			}
+			return nil, fmt.Errorf("invalid helper list line %q", line)
+		}
+		ref := &Ref{Name: chunks[1]}
+		switch value := chunks[0]; {
+		case value == "?":
+			// Hash is known only after importing.
+		case strings.HasPrefix(value, "@"):
+			ref.Target = value[1:]
+		case strings.HasPrefix(value, ":"):
+			continue
+		default:
+			if ref.Sha, err = hex.DecodeString(value); err != nil || len(ref.Sha) != 20 {
+				return nil, fmt.Errorf("invalid helper list line %q", line)
+			}
+		}
+		refs = append(refs, ref)
+		byName[ref.Name] = ref
+	}
+	for _, ref := range refs {
+		if target, ok := byName[ref.Target]; ok && ref.Sha == nil {
+			ref.Sha = target.Sha
+		}
+	}
+	return refs, nil
+}
+
+func (t *helperTransport) Fetch(refs []*Ref) error {
+	switch {
+	case t.caps["fetch"]:
+		return t.fetch(refs)
+	case t.caps["import"]:
+		return t.importRefs(refs)
+	default:
+		return errors.New("helper does not support fetching")
+	}
+}
+
+// fetch asks the helper to write objects into the repository itself.
+// Lock files the helper reports keep its packs from being removed until
+// the objects are checked.
+func (t *helperTransport) fetch(refs []*Ref) error {
+	var lines []string
+	var tips [][]byte
+	for _, ref := range refs {
+		if ref.Sha == nil {
+			return fmt.Errorf("helper did not list the %s hash", ref.Name)
+		}
+		lines = append(lines, fmt.Sprintf("fetch %x %s", ref.Sha, ref.Name))
+		tips = append(tips, ref.Sha)
+	}
+	packs, err := t.packFiles()
+	if err != nil {
+		return err
+	}
+	if err := t.send(append(lines, "")...); err != nil {
+		return err
+	}
+	status, err := t.readBlock()
+	if err != nil {
+		return err
+	}
+	for _, line := range status {
+		if lock := strings.TrimPrefix(line, "lock "); lock != line {
+			defer os.Remove(lock)
+		}
+	}
+	if err := t.indexPacks(packs); err != nil {
+		return err
+	}
+	if err := t.local.CheckConnectivity(tips); err != nil {
+		return err
+	}
+	if err := t.local.checkTreeNames(tips, nil); err != nil {
+		return err
+	}
+	return t.local.fsckReceived(tips, nil, "fetch")
+}
+
+func (t *helperTransport) packFiles() (map[string]struct{}, error) {
+	names, err := filepath.Glob(filepath.Join(t.local.objdir, "pack", "*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	packs := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		packs[name] = struct{}{}
+	}
+	return packs, nil
+}
+
+// indexPacks indexes the pack files written by the helper without an
+// index, as packs are read only once they have one. Packs the helper
+// indexed itself are used as they are.
+func (t *helperTransport) indexPacks(existing map[string]struct{}) error {
+	current, err := t.packFiles()
+	if err != nil {
+		return err
+	}
+	for name := range current {
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		idxPath := strings.TrimSuffix(name, ".pack") + ".idx"
+		if _, err := os.Stat(idxPath); err == nil {
+			continue
+		}
+		fd, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("open pack: %w", err)
+		}
+		indexed, err := t.local.IndexPack(fd)
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("index %s: %w", filepath.Base(name), err)
+		}
+		// The indexed copy is named after its checksum.
+		if indexed != name {
+			if err := os.Remove(name); err != nil {
+				return fmt.Errorf("remove indexed pack: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// importRefs reads a fast-import stream produced by the helper. Imported
+// references are written to the private namespace declared by the helper
+// refspecs, and hashes of fetched references are taken from there.
+func (t *helperTransport) importRefs(refs []*Ref) error {
+	lines := make([]string, 0, len(refs)+1)
+	for _, ref := range refs {
+		lines = append(lines, "import "+ref.Name)
+	}
+	if err := t.send(append(lines, "")...); err != nil {
+		return err
+	}
+	fi := newFastImporter(t.local, t.out)
+	if err := fi.Import(); err != nil {
+		return err
+	}
+	if updates := fi.RefUpdates(); len(updates) != 0 {
+		if err := t.local.UpdateRefs(updates...); err != nil {
+			return fmt.Errorf("update imported references: %w", err)
+		}
+	}
+	for _, ref := range refs {
+		name := ref.Name
+		for _, spec := range t.refspecs {
+			if dst, ok := spec.Map(ref.Name); ok {
+				name = dst
+				break
+			}
+		}
+		sha, err := t.local.resolveRef(name)
+		if err != nil {
+			return fmt.Errorf("helper did not import %s: %w", ref.Name, err)
+		}
+		ref.Sha = sha
+	}
+	return nil
+}
+
+func (t *helperTransport) Push(changes []*RefChange, opts *PushOptions) error {
+	if !t.caps["push"] {
+		return errors.New("helper does not support pushing")
+	}
+	if opts != nil {
+		if err := t.setPushOptions(opts); err != nil {
+			return err
+		}
+	}
+	lines := make([]string, 0, len(changes)+1)
+	byDst := make(map[string]*RefChange, len(changes))
+	for _, c := range changes {
+		src := c.Src
+		if src == "" && c.New != nil {
+			src = hex.EncodeToString(c.New)
+		}
+		force := ""
+		if c.Forced {
+			force = "+"
+		}
+		lines = append(lines, fmt.Sprintf("push %s%s:%s", force, src, c.Dst))
+		byDst[c.Dst] = c
+	}
+	if err := t.send(append(lines, "")...); err != nil {
+		return err
+	}
+	status, err := t.readBlock()
+	if err != nil {
+		return err
+	}
+	for _, line := range status {
+		chunks := strings.SplitN(line, " ", 3)
+		if len(chunks) < 2 {
+			return fmt.Errorf("invalid helper push status %q", line)
+		}
+		c, ok := byDst[chunks[1]]
+		if !ok {
+			continue
+		}
+		if chunks[0] == "error" {
+			c.Rejected = "failed"
+			if len(chunks) == 3 {
+				c.Rejected = chunks[2]
+			}
+		}
+	}
+	return nil
+}
+
+// setPushOptions passes push options and the request for a signed push to
+// the helper.
+func (t *helperTransport) setPushOptions(opts *PushOptions) error {
+	for _, o := range opts.Options {
+		if ok, err := t.setOption("push-option", o); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("the receiving end does not support push options")
+		}
+	}
+	if opts.Signed != PushSignedNever {
+		if ok, err := t.setOption("pushcert", opts.Signed); err != nil {
+			return err
+		} else if !ok && opts.Signed != PushSignedIfAsked {
+			return errors.New("the receiving end does not support --signed push")
+		}
+	}
+	return nil
+}
+
+// setOption sets an option of the helper. False is returned if the helper
+// does not support the option.
+func (t *helperTransport) setOption(name, value string) (bool, error) {
+	if !t.caps["option"] {
+		return false, nil
+	}
+	if err := t.send(fmt.Sprintf("option %s %s", name, value)); err != nil {
+		return false, err
+	}
+	line, err := t.readLine()
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case line == "ok":
+		return true, nil
+	case line == "unsupported":
+		return false, nil
+	case strings.HasPrefix(line, "error "):
+		return false, fmt.Errorf("helper option %s: %s", name, strings.TrimPrefix(line, "error "))
+	default:
+		return false, fmt.Errorf("unexpected helper response %q", line)
+	}
+}
+
+func (t *helperTransport) Close() error {
+	// Closing the input tells the helper to exit.
+	t.in.Close()
+	if err := t.cmd.Wait(); err != nil {
+		return fmt.Errorf("helper: %w", err)
+	}
+	return nil
+}
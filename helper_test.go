@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testHelperScript is a git-remote-test helper that lists a single branch,
+// fetches by copying a prepared pack without an index and a lock file, and
+// logs pushes, refusing refs/heads/locked.
+const testHelperScript = `#!/bin/sh
+pack="$GIT_DIR/objects/pack/pack-received"
+while read -r cmd arg; do
+	case "$cmd" in
+	capabilities)
+		printf 'fetch\npush\noption\n\n' ;;
+	option)
+		echo unsupported ;;
+	list)
+		cat @DIR@/refs
+		echo ;;
+	fetch)
+		# A batch of fetch commands ends with a blank line.
+		while read -r line && [ -n "$line" ]; do :; done
+		mkdir -p "${pack%/*}"
+		cp @DIR@/upstream.pack "$pack.pack"
+		touch "$pack.keep"
+		printf 'lock %s\n\n' "$pack.keep" ;;
+	push)
+		dsts="${arg#*:}"
+		echo "push $arg" >> @DIR@/log
+		while read -r line && [ -n "$line" ]; do
+			echo "$line" >> @DIR@/log
+			dsts="$dsts ${line#*:}"
+		done
+		for dst in $dsts; do
+			if [ "$dst" = refs/heads/locked ]; then
+				echo "error $dst protected"
+			else
+				echo "ok $dst"
+			fi
+		done
+		echo ;;
+	*)
+		exit 0 ;;
+	esac
+done
+`
+
+// installTestHelper writes the script as the git-remote-test program into
+// the directory and puts it on PATH. The returned function restores PATH.
+func installTestHelper(t *testing.T, dir, script string) func() {
+	t.Helper()
+	script = strings.Replace(script, "@DIR@", dir, -1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "git-remote-test"), []byte(script), 0755); err != nil {
+		t.Fatalf("write helper: %s", err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+func TestHelperTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer installTestHelper(t, dir, testHelperScript)()
+
+	upstream := newTestRepository(t)
+	head := writeTestCommit(t, upstream, "head")
+	var shas [][]byte
+	err = upstream.WalkObjects([][]byte{head}, func(o *WalkedObject) error {
+		shas = append(shas, o.Sha)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk objects: %s", err)
+	}
+	fd, err := os.Create(filepath.Join(dir, "upstream.pack"))
+	if err != nil {
+		t.Fatalf("create pack: %s", err)
+	}
+	_, _, err = upstream.writePackData(fd, shas)
+	fd.Close()
+	if err != nil {
+		t.Fatalf("write pack: %s", err)
+	}
+	refs := fmt.Sprintf("%x refs/heads/main\n@refs/heads/main HEAD\n", head)
+	if err := ioutil.WriteFile(filepath.Join(dir, "refs"), []byte(refs), 0644); err != nil {
+		t.Fatalf("write refs: %s", err)
+	}
+
+	local := newTestRepository(t)
+	tr, err := local.OpenTransport("test::example")
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	listed, err := tr.ListRefs()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(listed) != 2 || listed[0].Name != "refs/heads/main" || listed[1].Name != "HEAD" || listed[1].Target != "refs/heads/main" {
+		t.Fatalf("unexpected references %+v", listed)
+	}
+	if !bytes.Equal(listed[1].Sha, head) {
+		t.Fatalf("want HEAD at %x, got %x", head, listed[1].Sha)
+	}
+	if err := tr.Fetch(listed[:1]); err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	for _, sha := range shas {
+		if ok, err := local.HasObject(sha); err != nil || !ok {
+			t.Fatalf("want fetched object %x, got %v, %v", sha, ok, err)
+		}
+	}
+	// The received pack is indexed in place of the copy without an index,
+	// and the lock is removed.
+	packDir := filepath.Join(local.objdir, "pack")
+	for _, name := range []string{"pack-received.pack", "pack-received.keep"} {
+		if _, err := os.Stat(filepath.Join(packDir, name)); !os.IsNotExist(err) {
+			t.Fatalf("want %s removed, got %v", name, err)
+		}
+	}
+	if idx, _ := filepath.Glob(filepath.Join(packDir, "pack-*.idx")); len(idx) != 1 {
+		t.Fatalf("want a single indexed pack, got %q", idx)
+	}
+	if loose, _ := filepath.Glob(filepath.Join(local.objdir, "??", "*")); len(loose) != 0 {
+		t.Fatalf("want no loose objects, got %q", loose)
+	}
+
+	changes := []*RefChange{
+		{Src: "refs/heads/main", Dst: "refs/heads/main", New: head},
+		{Dst: "refs/heads/locked", New: head, Forced: true},
+	}
+	if err := tr.Push(changes, nil); err != nil {
+		t.Fatalf("push: %s", err)
+	}
+	if changes[0].Rejected != "" || changes[1].Rejected != "protected" {
+		t.Fatalf("want only the locked branch rejected, got %q and %q", changes[0].Rejected, changes[1].Rejected)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatalf("read log: %s", err)
+	}
+	if want := fmt.Sprintf("push refs/heads/main:refs/heads/main\npush +%x:refs/heads/locked\n", head); string(log) != want {
+		t.Fatalf("want pushes %q, got %q", want, log)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+}
+
+func TestHelperTransportExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// The helper exits once it has told its capabilities.
+	defer installTestHelper(t, dir, "#!/bin/sh\nread -r line\nprintf 'fetch\\n\\n'\nexit 3\n")()
+
+	local := newTestRepository(t)
+	tr, err := local.OpenTransport("test::example")
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	if _, err := tr.ListRefs(); err == nil || !strings.Contains(err.Error(), "exited unexpectedly") {
+		t.Fatalf("want unexpected exit error, got %v", err)
+	}
+	if err := tr.Close(); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("want exit status error, got %v", err)
+	}
+}
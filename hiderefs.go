@@ -0,0 +1,46 @@
+package main
+
+import "strings"
+
+// hiddenRefs are patterns of references that a repository does not
+// advertise to other repositories, read from transfer.hideRefs and the
+// hideRefs setting of a service section, for example uploadpack or
+// receive.
+type hiddenRefs []string
+
+// hiddenRefs returns patterns of transfer.hideRefs and <section>.hideRefs,
+// in the order they are configured.
+func (r *Repository) hiddenRefs(section string) hiddenRefs {
+	var patterns hiddenRefs
+	for _, e := range r.config.Entries {
+		if e.Subsection != "" || e.Key != "hiderefs" || (e.Section != "transfer" && e.Section != section) {
+			continue
+		}
+		patterns = append(patterns, e.Value)
+	}
+	return patterns
+}
+
+// hidden returns true if the reference is hidden. A pattern matches a
+// reference of the same name and all references below it, so that
+// "refs/changes" hides "refs/changes/01/1/1". A pattern starting with "!"
+// makes matching references visible again, and the last matching pattern
+// wins. A "^" prefix, which matches names before namespaces are stripped,
+// is the same as no prefix, as namespaces are not supported.
+func (h hiddenRefs) hidden(name string) bool {
+	for i := len(h) - 1; i >= 0; i-- {
+		pattern := h[i]
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "/")
+		if pattern == "" {
+			continue
+		}
+		if name == pattern || strings.HasPrefix(name, pattern+"/") {
+			return !negated
+		}
+	}
+	return false
+}
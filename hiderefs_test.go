@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestHiddenRefs(t *testing.T) {
+	patterns := hiddenRefs{"refs/changes/", "refs/keep-around", "refs/heads/internal", "!refs/heads/internal/public", "^refs/pull"}
+	cases := map[string]bool{
+		"refs/changes/01/1/1":          true,
+		"refs/changes":                 true,
+		"refs/changesets":              false,
+		"refs/keep-around/abc":         true,
+		"refs/heads/internal":          true,
+		"refs/heads/internal/wip":      true,
+		"refs/heads/internal/public":   false,
+		"refs/heads/internal/public/x": false,
+		"refs/heads/master":            false,
+		"refs/pull/1/head":             true,
+		"HEAD":                         false,
+	}
+	for name, want := range cases {
+		if got := patterns.hidden(name); got != want {
+			t.Errorf("%s: want hidden %v, got %v", name, want, got)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// hookPath returns the executable of the hook with given name, in the
+// core.hooksPath directory or in the hooks directory of the repository.
+// False is returned if there is no such hook, or if it is not executable.
+func (r *Repository) hookPath(name string) (string, bool) {
+	dir, ok, err := r.config.Path("core", "", "hooksPath")
+	switch {
+	case err != nil:
+		return "", false
+	case !ok:
+		dir = filepath.Join(r.gitdir, "hooks")
+	case !filepath.IsAbs(dir):
+		// Relative to where hooks run.
+		dir = filepath.Join(r.hookDir(), dir)
+	}
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+		return "", false
+	}
+	return path, true
+}
+
+// hookDir is the directory hooks run in: the worktree root, or the git
+// directory of a bare repository.
+func (r *Repository) hookDir() string {
+	if r.workdir != "" {
+		return r.workdir
+	}
+	return r.gitdir
+}
+
+// runHook runs the hook with the input on its standard input and the
+// environment variables added. Output of the hook is written to the
+// standard error. False is returned if the hook does not exist, and an
+// *exec.ExitError if it failed.
+func (r *Repository) runHook(name string, input []byte, env []string, args ...string) (bool, error) {
+	path, ok := r.hookPath(name)
+	if !ok {
+		return false, nil
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Dir = r.hookDir()
+	cmd.Env = append(append(os.Environ(), "GIT_DIR="+r.gitdir), env...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return true, err
+		}
+		return true, fmt.Errorf("run %s hook: %w", name, err)
+	}
+	return true, nil
+}
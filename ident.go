@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ident is the author or the committer of a commit, or the tagger of a tag.
+type Ident struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// parseIdent parses a header value in the "Name <email> 1580755918 +0100"
+// format. Time zone of When is the one of the offset.
+func parseIdent(s string) (*Ident, error) {
+	open := strings.IndexByte(s, '<')
+	end := strings.LastIndexByte(s, '>')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("invalid identity %q", s)
+	}
+	id := &Ident{
+		Name:  strings.TrimSpace(s[:open]),
+		Email: s[open+1 : end],
+	}
+	chunks := strings.Fields(s[end+1:])
+	if len(chunks) != 2 {
+		return nil, fmt.Errorf("invalid identity %q: missing date", s)
+	}
+	sec, err := strconv.ParseInt(chunks[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity %q date: %w", s, err)
+	}
+	tz := chunks[1]
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') {
+		return nil, fmt.Errorf("invalid identity %q time zone", s)
+	}
+	hours, err := strconv.Atoi(tz[1:3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity %q time zone: %w", s, err)
+	}
+	minutes, err := strconv.Atoi(tz[3:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity %q time zone: %w", s, err)
+	}
+	offset := hours*3600 + minutes*60
+	if tz[0] == '-' {
+		offset = -offset
+	}
+	id.When = time.Unix(sec, 0).In(time.FixedZone("", offset))
+	return id, nil
+}
+
+// String returns the identity in the same format it is stored.
+func (id *Ident) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", id.Name, id.Email, id.When.Unix(), id.When.Format("-0700"))
+}
+
+// identDateLayouts are the date formats accepted besides the internal
+// "1580755918 +0100" one, same as the most common ones of git: RFC 2822 and
+// ISO 8601. Dates without a time zone are in the local one.
+var identDateLayouts = []string{
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC3339,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05-0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// parseIdentDate parses the date of GIT_AUTHOR_DATE, GIT_COMMITTER_DATE or
+// commit --date. A Unix timestamp can be prefixed with @ and followed by the
+// time zone offset.
+func parseIdentDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	chunks := strings.Fields(strings.TrimPrefix(s, "@"))
+	if len(chunks) == 1 || len(chunks) == 2 {
+		if sec, err := strconv.ParseInt(chunks[0], 10, 64); err == nil {
+			if len(chunks) == 1 {
+				return time.Unix(sec, 0).UTC(), nil
+			}
+			id, err := parseIdent("<> " + strings.Join(chunks, " "))
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid date %q", s)
+			}
+			return id.When, nil
+		}
+	}
+	for _, layout := range identDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+// envIdent returns the identity given by the environment variables with
+// the prefix, like GIT_AUTHOR_NAME, GIT_AUTHOR_EMAIL and GIT_AUTHOR_DATE for
+// "author", or else by the role.name and role.email settings or the
+// user.name and user.email ones. The time is the current one, unless the
+// date variable is set.
+func (r *Repository) envIdent(role string) (*Ident, error) {
+	prefix := "GIT_" + strings.ToUpper(role)
+	id := Ident{Name: os.Getenv(prefix + "_NAME"), Email: os.Getenv(prefix + "_EMAIL"), When: time.Now()}
+	for _, section := range []string{role, "user"} {
+		if id.Name == "" {
+			id.Name, _ = r.config.Get(section, "", "name")
+		}
+		if id.Email == "" {
+			id.Email, _ = r.config.Get(section, "", "email")
+		}
+	}
+	if id.Name == "" || id.Email == "" {
+		return nil, fmt.Errorf("%s identity unknown: set user.name and user.email", role)
+	}
+	if date := os.Getenv(prefix + "_DATE"); date != "" {
+		when, err := parseIdentDate(date)
+		if err != nil {
+			return nil, fmt.Errorf("%s_DATE: %w", prefix, err)
+		}
+		id.When = when
+	}
+	return &id, nil
+}
+
+// committerIdent returns the identity of the user committing, by default at
+// the current time.
+func (r *Repository) committerIdent() (*Ident, error) {
+	return r.envIdent("committer")
+}
+
+// authorIdent returns the identity of the author of new commits, by default
+// the user at the current time.
+func (r *Repository) authorIdent() (*Ident, error) {
+	return r.envIdent("author")
+}
+
+// commitAuthor returns the author of a new commit, overridden by the values
+// of commit --author, in the "Name <email>" format, and --date, if they are
+// not empty.
+func (r *Repository) commitAuthor(author, date string) (*Ident, error) {
+	var id *Ident
+	if author == "" {
+		var err error
+		if id, err = r.authorIdent(); err != nil {
+			return nil, err
+		}
+	} else {
+		open, end := strings.IndexByte(author, '<'), strings.LastIndexByte(author, '>')
+		if open < 0 || end < open || strings.TrimSpace(author[end+1:]) != "" {
+			return nil, fmt.Errorf("invalid author %q: must be Name <email>", author)
+		}
+		id = &Ident{Name: strings.TrimSpace(author[:open]), Email: author[open+1 : end], When: time.Now()}
+		if env := os.Getenv("GIT_AUTHOR_DATE"); env != "" && date == "" {
+			date = env
+		}
+	}
+	if date != "" {
+		when, err := parseIdentDate(date)
+		if err != nil {
+			return nil, err
+		}
+		id.When = when
+	}
+	return id, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseIdentDate(t *testing.T) {
+	cases := map[string]struct {
+		date    string
+		want    string // Unix time and offset, as in commits
+		wantErr bool
+	}{
+		"raw":          {date: "1600000000 +0200", want: "1600000000 +0200"},
+		"timestamp":    {date: "@1600000000", want: "1600000000 +0000"},
+		"timestamp tz": {date: "@1600000000 -0130", want: "1600000000 -0130"},
+		"rfc 2822":     {date: "Sun, 13 Sep 2020 14:26:40 +0200", want: "1600000000 +0200"},
+		"iso 8601":     {date: "2020-09-13T12:26:40Z", want: "1600000000 +0000"},
+		"iso offset":   {date: "2020-09-13 14:26:40 +0200", want: "1600000000 +0200"},
+		"garbage":      {date: "yesterday", wantErr: true},
+		"bad zone":     {date: "1600000000 CEST", wantErr: true},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, err := parseIdentDate(tc.date)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			id := &Ident{Name: "A", Email: "a@example.com", When: got}
+			if s := strings.TrimPrefix(id.String(), "A <a@example.com> "); s != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, s)
+			}
+		})
+	}
+}
+
+func TestCommitAuthor(t *testing.T) {
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_AUTHOR_DATE"} {
+		if value, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, value)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+	config, err := ParseConfig(strings.NewReader("[user]\n\tname = User\n\temail = user@example.com\n[author]\n\temail = author@example.com\n"))
+	if err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+	repo := &Repository{config: config}
+
+	cases := map[string]struct {
+		env     map[string]string
+		author  string
+		date    string
+		want    string
+		wantErr bool
+	}{
+		"config": {
+			date: "1600000000 +0000",
+			want: "User <author@example.com> 1600000000 +0000",
+		},
+		"environment": {
+			env:  map[string]string{"GIT_AUTHOR_NAME": "Env", "GIT_AUTHOR_DATE": "1500000000 +0100"},
+			want: "Env <author@example.com> 1500000000 +0100",
+		},
+		"flags": {
+			env:    map[string]string{"GIT_AUTHOR_NAME": "Env", "GIT_AUTHOR_DATE": "1500000000 +0100"},
+			author: "Flag Name <flag@example.com>",
+			date:   "@1600000000",
+			want:   "Flag Name <flag@example.com> 1600000000 +0000",
+		},
+		"flag with environment date": {
+			env:    map[string]string{"GIT_AUTHOR_DATE": "1500000000 +0100"},
+			author: "Flag <flag@example.com>",
+			want:   "Flag <flag@example.com> 1500000000 +0100",
+		},
+		"invalid author": {author: "Flag", wantErr: true},
+		"invalid date":   {env: map[string]string{"GIT_AUTHOR_DATE": "never"}, wantErr: true},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			for name, value := range tc.env {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+			id, err := repo.commitAuthor(tc.author, tc.date)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %s", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("commit author: %s", err)
+			}
+			if got := id.String(); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is a single pattern of a gitignore file.
+type ignoreRule struct {
+	filePattern
+	// negate patterns start with "!" and include again what was excluded
+	// by earlier patterns.
+	negate bool
+}
+
+// parseIgnore parses the content of a gitignore file found in dir.
+func parseIgnore(content []byte, dir string) []*ignoreRule {
+	var rules []*ignoreRule
+	lines := bufio.NewScanner(bytes.NewReader(content))
+	for lines.Scan() {
+		pattern := strings.TrimSuffix(lines.Text(), "\r")
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		// Trailing spaces are ignored, unless escaped with a backslash.
+		for strings.HasSuffix(pattern, " ") && !strings.HasSuffix(pattern, "\\ ") {
+			pattern = pattern[:len(pattern)-1]
+		}
+		negate := false
+		if strings.HasPrefix(pattern, "!") {
+			negate = true
+			pattern = pattern[1:]
+		} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+			pattern = pattern[1:]
+		}
+		p, ok := parseFilePattern(pattern, dir)
+		if !ok {
+			continue
+		}
+		rules = append(rules, &ignoreRule{filePattern: p, negate: negate})
+	}
+	return rules
+}
+
+// ignoreStack is the list of gitignore rules that apply to a worktree,
+// ordered from the lowest to the highest priority.
+type ignoreStack struct {
+	// global rules are of core.excludesFile, and info rules are of
+	// $GIT_DIR/info/exclude.
+	global []*ignoreRule
+	info   []*ignoreRule
+	// dirs are rules of .gitignore files by the directory, loaded on first
+	// use.
+	dirs map[string][]*ignoreRule
+	// read returns the content of the .gitignore file in the directory, or
+	// nil if there is none.
+	read func(dir string) ([]byte, error)
+}
+
+// worktreeIgnores returns the gitignore rules of the worktree, reading
+// .gitignore files from the disk, together with the core.excludesFile and
+// $GIT_DIR/info/exclude files.
+func (r *Repository) worktreeIgnores() (*ignoreStack, error) {
+	s := &ignoreStack{
+		dirs: make(map[string][]*ignoreRule),
+		read: func(dir string) ([]byte, error) {
+			content, err := ioutil.ReadFile(filepath.Join(r.workdir, filepath.FromSlash(dir), ".gitignore"))
+			if errors.Is(err, os.ErrNotExist) || isNotDir(err) {
+				return nil, nil
+			}
+			return content, err
+		},
+	}
+	file, ok, err := r.config.Path("core", "", "excludesFile")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		content, err := ioutil.ReadFile(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("read excludes: %w", err)
+		}
+		s.global = parseIgnore(content, "")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(r.gitdir, "info", "exclude"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read excludes: %w", err)
+	}
+	s.info = parseIgnore(content, "")
+	return s, nil
+}
+
+func (s *ignoreStack) dirRules(dir string) ([]*ignoreRule, error) {
+	if rules, ok := s.dirs[dir]; ok {
+		return rules, nil
+	}
+	content, err := s.read(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path.Join(dir, ".gitignore"), err)
+	}
+	rules := parseIgnore(content, dir)
+	s.dirs[dir] = rules
+	return rules, nil
+}
+
+// Ignored tells whether the path relative to the worktree root is ignored.
+// The path of a directory must end with a slash. Rules of deeper .gitignore
+// files take precedence, and within a file later lines take precedence over
+// earlier ones. A path in an ignored directory is always ignored, because
+// git does not look into ignored directories.
+func (s *ignoreStack) Ignored(name string) (bool, error) {
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] != '/' {
+			continue
+		}
+		if ignored, err := s.ignored(name[:i+1]); err != nil || ignored {
+			return ignored, err
+		}
+	}
+	return s.ignored(name)
+}
+
+// ignored tells whether rules exclude the path itself.
+func (s *ignoreStack) ignored(name string) (bool, error) {
+	levels := [][]*ignoreRule{s.global, s.info}
+	dirs := []string{""}
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	for _, dir := range dirs {
+		rules, err := s.dirRules(dir)
+		if err != nil {
+			return false, err
+		}
+		levels = append(levels, rules)
+	}
+
+	ignored := false
+	for _, rules := range levels {
+		for _, rule := range rules {
+			if rule.match(name) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestIgnored(t *testing.T) {
+	files := map[string]string{
+		"": "# comment\n" +
+			"*.log\n" +
+			"!keep.log\n" +
+			"/top\n" +
+			"build/\n" +
+			"docs/*.tmp\n" +
+			"trailing   \n" +
+			"\\!bang\n",
+		"sub": "*.txt\n" +
+			"!a.log\n",
+		"vendor": "!*.log\n",
+	}
+	stack := &ignoreStack{
+		dirs: make(map[string][]*ignoreRule),
+		read: func(dir string) ([]byte, error) {
+			return []byte(files[dir]), nil
+		},
+		info: parseIgnore([]byte("*.o\n"), ""),
+	}
+
+	cases := map[string]bool{
+		"a.log":           true,
+		"x/y/a.log":       true,
+		"keep.log":        false,
+		"x/keep.log":      false,
+		"top":             true,
+		"x/top":           false,
+		"build/":          true,
+		"build":           false,
+		"x/build/":        true,
+		"x/build/a.c":     true,
+		"docs/a.tmp":      true,
+		"docs/x/a.tmp":    false,
+		"trailing":        true,
+		"!bang":           true,
+		"a.o":             true,
+		"a.c":             false,
+		"sub/a.txt":       true,
+		"a.txt":           false,
+		"sub/a.log":       false,
+		"sub/b.log":       true,
+		"vendor/x.log":    false,
+		"build/keep.log":  true,
+		"sub/x/build/a.c": true,
+	}
+	for name, want := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := stack.Ignored(name)
+			if err != nil {
+				t.Fatalf("ignored: %s", err)
+			}
+			if got != want {
+				t.Fatalf("want %v, got %v", want, got)
+			}
+		})
+	}
+}
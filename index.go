@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Index is the content of the .git/index file, the staging area. Entries
+// are sorted by path and stage.
+type Index struct {
+	Version uint32
+	Entries []*IndexEntry
+
+	// ModTime is the modification time of the index file, used to detect
+	// files changed too shortly after they were staged to be told apart by
+	// their stat data.
+	ModTime time.Time
+}
+
+// IndexEntry is a single staged file.
+type IndexEntry struct {
+	Ctime time.Time
+	Mtime time.Time
+	Dev   uint32
+	Ino   uint32
+	// Mode is stored the same way as in tree leafs.
+	Mode os.FileMode
+	Uid  uint32
+	Gid  uint32
+	Size uint32
+	Sha  []byte
+	// Stage is non zero for unmerged entries.
+	Stage int
+	// AssumeValid entries, marked with update-index --assume-unchanged,
+	// and SkipWorktree entries are not compared with the worktree.
+	AssumeValid  bool
+	SkipWorktree bool
+	// IntentToAdd entries, recorded with add -N, only mark a path to be
+	// added later. They have the hash of an empty blob and no stat data.
+	IntentToAdd bool
+	Path        string
+}
+
+// Index entry flags.
+const (
+	indexFlagAssumeValid = 0x8000
+	indexFlagExtended    = 0x4000
+	indexFlagStageMask   = 0x3000
+	indexFlagStageShift  = 12
+	indexFlagNameMask    = 0x0fff
+
+	// Extended flags, only in version 3 and later.
+	indexFlagSkipWorktree = 0x4000
+	indexFlagIntentToAdd  = 0x2000
+)
+
+// ReadIndex reads the index of the repository. A repository without an
+// index file has an empty index. Sparse directory entries are expanded, so
+// that every file has its own entry.
+func (r *Repository) ReadIndex() (*Index, error) {
+	return r.readIndex(true)
+}
+
+func (r *Repository) readIndex(full bool) (*Index, error) {
+	path := filepath.Join(r.gitdir, "index")
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Index{Version: 2}, nil
+		}
+		return nil, fmt.Errorf("read index: %w", err)
+	}
+	idx, err := parseIndex(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse index: %w", err)
+	}
+	if info, err := os.Stat(path); err == nil {
+		idx.ModTime = info.ModTime()
+	}
+	if full {
+		if err := r.expandIndex(idx); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+func parseIndex(raw []byte) (*Index, error) {
+	if len(raw) < 12+sha1.Size {
+		return nil, errors.New("index file too short")
+	}
+	content, trailer := raw[:len(raw)-sha1.Size], raw[len(raw)-sha1.Size:]
+	if sum := sha1.Sum(content); !bytes.Equal(sum[:], trailer) {
+		return nil, errors.New("index checksum mismatch")
+	}
+	if !bytes.Equal(content[:4], []byte("DIRC")) {
+		return nil, errors.New("not an index file")
+	}
+	idx := &Index{Version: binary.BigEndian.Uint32(content[4:8])}
+	if idx.Version != 2 && idx.Version != 3 {
+		return nil, fmt.Errorf("unsupported index version %d", idx.Version)
+	}
+	count := binary.BigEndian.Uint32(content[8:12])
+
+	body := bytes.NewReader(content[12:])
+	rd := bufio.NewReader(body)
+	for i := uint32(0); i < count; i++ {
+		e, err := readIndexEntry(rd)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		idx.Entries = append(idx.Entries, e)
+	}
+	// Optional extensions, with names starting with an upper case letter,
+	// only cache data and can be ignored. Others change the meaning of the
+	// entries.
+	for rest := content[len(content)-body.Len()-rd.Buffered():]; len(rest) != 0; {
+		if len(rest) < 8 {
+			return nil, errors.New("truncated extension header")
+		}
+		name := rest[:4]
+		size := binary.BigEndian.Uint32(rest[4:8])
+		if uint64(size) > uint64(len(rest)-8) {
+			return nil, fmt.Errorf("extension %q: truncated", name)
+		}
+		sparse := string(name) == indexExtSparseDirs
+		if (name[0] < 'A' || name[0] > 'Z') && !sparse {
+			return nil, fmt.Errorf("unsupported index extension %q", name)
+		}
+		rest = rest[8+size:]
+	}
+	return idx, nil
+}
+
+func readIndexEntry(rd *bufio.Reader) (*IndexEntry, error) {
+	var header struct {
+		CtimeSec, CtimeNsec uint32
+		MtimeSec, MtimeNsec uint32
+		Dev, Ino, Mode      uint32
+		Uid, Gid, Size      uint32
+		Sha                 [20]byte
+		Flags               uint16
+	}
+	if err := binary.Read(rd, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("read entry: %w", err)
+	}
+	size := 62
+	var skipWorktree, intentToAdd bool
+	if header.Flags&indexFlagExtended != 0 {
+		var extended uint16
+		if err := binary.Read(rd, binary.BigEndian, &extended); err != nil {
+			return nil, fmt.Errorf("read extended flags: %w", err)
+		}
+		size += 2
+		skipWorktree = extended&indexFlagSkipWorktree != 0
+		intentToAdd = extended&indexFlagIntentToAdd != 0
+	}
+	path, err := rd.ReadString(0)
+	if err != nil {
+		return nil, fmt.Errorf("read path: %w", err)
+	}
+	size += len(path)
+	// Entries are padded with one to eight NUL bytes, including the path
+	// terminator, to a multiple of eight bytes.
+	if pad := (8 - size%8) % 8; pad != 0 {
+		if _, err := io.CopyN(ioutil.Discard, rd, int64(pad)); err != nil {
+			return nil, fmt.Errorf("read padding: %w", err)
+		}
+	}
+	mode, err := strconv.Atoi(strconv.FormatUint(uint64(header.Mode), 8))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode: %w", err)
+	}
+	return &IndexEntry{
+		Ctime:        time.Unix(int64(header.CtimeSec), int64(header.CtimeNsec)),
+		Mtime:        time.Unix(int64(header.MtimeSec), int64(header.MtimeNsec)),
+		Dev:          header.Dev,
+		Ino:          header.Ino,
+		Mode:         os.FileMode(mode),
+		Uid:          header.Uid,
+		Gid:          header.Gid,
+		Size:         header.Size,
+		Sha:          append([]byte(nil), header.Sha[:]...),
+		Stage:        int(header.Flags&indexFlagStageMask) >> indexFlagStageShift,
+		AssumeValid:  header.Flags&indexFlagAssumeValid != 0,
+		SkipWorktree: skipWorktree,
+		IntentToAdd:  intentToAdd,
+		Path:         path[:len(path)-1],
+	}, nil
+}
+
+// LockIndex takes index.lock before the index is read, so that no other
+// process writes the index between reading and writing it back. The next
+// WriteIndex writes through the lock and releases it. The returned function
+// releases the lock if the index was not written, and does nothing if the
+// lock was held already.
+func (r *Repository) LockIndex() (func(), error) {
+	if r.indexLock != nil {
+		return func() {}, nil
+	}
+	lock := filepath.Join(r.gitdir, "index.lock")
+	fd, err := createLock(r.gitdir, lock)
+	if err != nil {
+		return nil, fmt.Errorf("lock index: %w", err)
+	}
+	r.indexLock = fd
+	return func() {
+		if r.indexLock == fd {
+			r.indexLock = nil
+			fd.Close()
+			releaseLock(lock)
+		}
+	}, nil
+}
+
+// WriteIndex replaces the index file of the repository. Extensions of the
+// index that was read are not preserved. If index.sparse is set in cone
+// mode, directories outside of the cone are written as sparse directory
+// entries, otherwise sparse directory entries are expanded. Entries of idx
+// are not collapsed.
+func (r *Repository) WriteIndex(idx *Index) error {
+	if err := r.smudgeRacyEntries(idx); err != nil {
+		return err
+	}
+	cone, err := r.useSparseIndex()
+	if err != nil {
+		return err
+	}
+	out := *idx
+	if cone != nil {
+		if out.Entries, err = r.collapseIndex(idx.Entries, cone); err != nil {
+			return err
+		}
+	} else if err := r.expandIndex(&out); err != nil {
+		return err
+	}
+	raw, err := out.Serialize()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.gitdir, "index")
+	lock := path + ".lock"
+	if err := r.writeIndexLock(lock, raw); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	if err := commitLock(lock, path); err != nil {
+		return fmt.Errorf("update index: %w", err)
+	}
+	if info, err := os.Stat(path); err == nil {
+		idx.ModTime = info.ModTime()
+	}
+	return nil
+}
+
+// writeIndexLock writes the index to the lock held by LockIndex, or takes
+// the lock if it is not held.
+func (r *Repository) writeIndexLock(lock string, raw []byte) error {
+	fd := r.indexLock
+	if fd == nil {
+		return writeLockFile(r.gitdir, lock, raw, r.fsyncEnabled(fsyncIndex))
+	}
+	r.indexLock = nil
+	_, err := fd.Write(raw)
+	if err == nil && r.fsyncEnabled(fsyncIndex) {
+		err = syncFile(fd)
+	}
+	if cerr := fd.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		releaseLock(lock)
+	}
+	return err
+}
+
+// smudgeRacyEntries clears the size of entries that were modified after
+// they were staged, but too shortly for their stat data to tell. Once the
+// index is written again, their modification time would no longer be
+// compared with the old index file time, and the change would be missed.
+func (r *Repository) smudgeRacyEntries(idx *Index) error {
+	for _, e := range idx.Entries {
+		if e.Stage != 0 || e.IntentToAdd || e.isSparseDir() || e.Mtime.Before(idx.ModTime) {
+			continue
+		}
+		leaf, err := r.worktreeLeaf(e, idx)
+		if err != nil {
+			return err
+		}
+		if leaf == nil || leaf.Sha == nil {
+			e.Size = 0
+		}
+	}
+	return nil
+}
+
+// Serialize returns the content of the index file. Version 3 is used only
+// if any entry has extended flags.
+func (idx *Index) Serialize() ([]byte, error) {
+	version := uint32(2)
+	sparse := false
+	for _, e := range idx.Entries {
+		if e.SkipWorktree || e.IntentToAdd {
+			version = 3
+		}
+		sparse = sparse || e.isSparseDir()
+	}
+	var b bytes.Buffer
+	b.WriteString("DIRC")
+	binary.Write(&b, binary.BigEndian, version)
+	binary.Write(&b, binary.BigEndian, uint32(len(idx.Entries)))
+	for _, e := range idx.Entries {
+		if err := writeIndexEntry(&b, e); err != nil {
+			return nil, fmt.Errorf("entry %s: %w", e.Path, err)
+		}
+	}
+	if sparse {
+		b.WriteString(indexExtSparseDirs)
+		binary.Write(&b, binary.BigEndian, uint32(0))
+	}
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+	return b.Bytes(), nil
+}
+
+func writeIndexEntry(b *bytes.Buffer, e *IndexEntry) error {
+	if len(e.Sha) != sha1.Size {
+		return fmt.Errorf("invalid hash length %d", len(e.Sha))
+	}
+	if e.Stage < 0 || e.Stage > 3 {
+		return fmt.Errorf("invalid stage %d", e.Stage)
+	}
+	mode, err := strconv.ParseUint(strconv.FormatUint(uint64(e.Mode), 10), 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode: %w", err)
+	}
+	fields := []uint32{
+		uint32(e.Ctime.Unix()), uint32(e.Ctime.Nanosecond()),
+		uint32(e.Mtime.Unix()), uint32(e.Mtime.Nanosecond()),
+		e.Dev, e.Ino, uint32(mode), e.Uid, e.Gid, e.Size,
+	}
+	if e.Ctime.IsZero() {
+		fields[0], fields[1] = 0, 0
+	}
+	if e.Mtime.IsZero() {
+		fields[2], fields[3] = 0, 0
+	}
+	binary.Write(b, binary.BigEndian, fields)
+	b.Write(e.Sha)
+
+	flags := uint16(e.Stage) << indexFlagStageShift
+	if len(e.Path) < indexFlagNameMask {
+		flags |= uint16(len(e.Path))
+	} else {
+		flags |= indexFlagNameMask
+	}
+	if e.AssumeValid {
+		flags |= indexFlagAssumeValid
+	}
+	var extended uint16
+	if e.SkipWorktree {
+		extended |= indexFlagSkipWorktree
+	}
+	if e.IntentToAdd {
+		extended |= indexFlagIntentToAdd
+	}
+	size := 62
+	if extended != 0 {
+		flags |= indexFlagExtended
+	}
+	binary.Write(b, binary.BigEndian, flags)
+	if extended != 0 {
+		binary.Write(b, binary.BigEndian, extended)
+		size += 2
+	}
+	b.WriteString(e.Path)
+	size += len(e.Path)
+	// At least one NUL byte terminates the path.
+	b.Write(make([]byte, 8-size%8))
+	return nil
+}
+
+// entry returns the index of the stage zero entry with given path, or the
+// position at which it would be inserted and false.
+func (idx *Index) entry(path string) (int, bool) {
+	i := sort.Search(len(idx.Entries), func(i int) bool {
+		return idx.Entries[i].Path >= path
+	})
+	return i, i < len(idx.Entries) && idx.Entries[i].Path == path && idx.Entries[i].Stage == 0
+}
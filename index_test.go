@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestParseIndex(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("DIRC")
+	binary.Write(&b, binary.BigEndian, uint32(2))
+	binary.Write(&b, binary.BigEndian, uint32(2))
+	for i, path := range []string{"a.txt", "dir/unmerged"} {
+		fields := []uint32{1600000000, 0, 1600000001, 5, 1, 2, 0100755, 1000, 1000, 42}
+		binary.Write(&b, binary.BigEndian, fields)
+		b.Write(bytes.Repeat([]byte{byte(i + 1)}, 20))
+		flags := uint16(len(path))
+		if i == 1 {
+			flags |= 2 << indexFlagStageShift
+		}
+		binary.Write(&b, binary.BigEndian, flags)
+		b.WriteString(path)
+		b.Write(make([]byte, 8-(62+len(path))%8))
+	}
+	// Unknown extensions are ignored.
+	b.WriteString("TREE")
+	binary.Write(&b, binary.BigEndian, uint32(3))
+	b.WriteString("xyz")
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+
+	idx, err := parseIndex(b.Bytes())
+	if err != nil {
+		t.Fatalf("parse index: %s", err)
+	}
+	if len(idx.Entries) != 2 {
+		t.Fatalf("want 2 entries, got %d", len(idx.Entries))
+	}
+	e := idx.Entries[0]
+	if e.Path != "a.txt" || e.Mode != modeExec || e.Size != 42 || e.Stage != 0 || e.Mtime.Unix() != 1600000001 {
+		t.Fatalf("unexpected first entry: %+v", e)
+	}
+	if e := idx.Entries[1]; e.Path != "dir/unmerged" || e.Stage != 2 || e.Sha[0] != 2 {
+		t.Fatalf("unexpected second entry: %+v", e)
+	}
+
+	raw := b.Bytes()
+	raw[len(raw)-1] ^= 0xff
+	if _, err := parseIndex(raw); err == nil {
+		t.Fatal("want checksum error")
+	}
+}
+
+func TestIndexSerialize(t *testing.T) {
+	mtime := time.Unix(1600000001, 5)
+	idx := &Index{Entries: []*IndexEntry{
+		{Mtime: mtime, Mode: modeExec, Size: 42, Sha: bytes.Repeat([]byte{1}, 20), AssumeValid: true, Path: "a.txt"},
+		{Mtime: mtime, Mode: modeBlob, Sha: bytes.Repeat([]byte{2}, 20), SkipWorktree: true, Path: "b.txt"},
+		{Mode: modeBlob, Sha: hashObject("blob", nil), IntentToAdd: true, Path: "dir/new.txt"},
+		{Mode: modeSymlink, Sha: bytes.Repeat([]byte{3}, 20), Stage: 3, Path: "dir/unmerged"},
+	}}
+	raw, err := idx.Serialize()
+	if err != nil {
+		t.Fatalf("serialize: %s", err)
+	}
+	got, err := parseIndex(raw)
+	if err != nil {
+		t.Fatalf("parse index: %s", err)
+	}
+	if got.Version != 3 {
+		t.Fatalf("want version 3 for extended flags, got %d", got.Version)
+	}
+	if len(got.Entries) != len(idx.Entries) {
+		t.Fatalf("want %d entries, got %d", len(idx.Entries), len(got.Entries))
+	}
+	for i, want := range idx.Entries {
+		e := got.Entries[i]
+		if e.Path != want.Path || e.Mode != want.Mode || e.Size != want.Size || e.Stage != want.Stage ||
+			!bytes.Equal(e.Sha, want.Sha) || !e.Mtime.Equal(want.Mtime) && !want.Mtime.IsZero() ||
+			e.AssumeValid != want.AssumeValid || e.SkipWorktree != want.SkipWorktree || e.IntentToAdd != want.IntentToAdd {
+			t.Errorf("entry %d: want %+v, got %+v", i, want, e)
+		}
+	}
+
+	idx.Entries = idx.Entries[:1]
+	if raw, err = idx.Serialize(); err != nil {
+		t.Fatalf("serialize: %s", err)
+	}
+	if got, err = parseIndex(raw); err != nil {
+		t.Fatalf("parse index: %s", err)
+	} else if got.Version != 2 {
+		t.Fatalf("want version 2, got %d", got.Version)
+	}
+}
+
+func TestParseIndexRequiredExtension(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("DIRC")
+	binary.Write(&b, binary.BigEndian, uint32(2))
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	// Split index entries are stored in another file.
+	b.WriteString("link")
+	binary.Write(&b, binary.BigEndian, uint32(20))
+	b.Write(make([]byte, 20))
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+
+	if _, err := parseIndex(b.Bytes()); err == nil {
+		t.Fatal("want unsupported extension error")
+	}
+}
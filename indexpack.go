@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// defaultUnpackLimit is the number of objects from which a received pack is
+// kept instead of unpacked, unless fetch.unpackLimit or
+// transfer.unpackLimit is set.
+const defaultUnpackLimit = 100
+
+// storeFetchedPack stores a pack stream received by fetch. Small packs are
+// unpacked into loose objects, and larger ones are kept as they are.
+func (r *Repository) storeFetchedPack(rd io.Reader) error {
+	br := bufio.NewReader(rd)
+	header, err := br.Peek(12)
+	if err != nil {
+		return fmt.Errorf("read pack header: %w", err)
+	}
+	limit, err := r.config.Int("transfer", "", "unpackLimit", defaultUnpackLimit)
+	if err != nil {
+		return err
+	}
+	if limit, err = r.config.Int("fetch", "", "unpackLimit", limit); err != nil {
+		return err
+	}
+	if int64(binary.BigEndian.Uint32(header[8:12])) < limit {
+		_, err = r.UnpackObjects(br)
+		return err
+	}
+	_, err = r.IndexPack(br)
+	return err
+}
+
+// indexedEntry is an entry of a pack being indexed.
+type indexedEntry struct {
+	offset int64
+	crc    uint32
+	// sha is nil until the object of a delta is resolved.
+	sha []byte
+	// base is the entry an offset delta is against, and baseSha the
+	// object a reference delta is against.
+	base    *indexedEntry
+	baseSha []byte
+}
+
+// IndexPack stores a pack stream in the object directory together with a
+// new index, and returns the path of the pack. The stream is written to the
+// disk as it is read, while the pack checksum and the CRC32 checksums of
+// the entries are computed, so that only a single object is held in memory
+// at a time. A thin pack is completed with the delta bases it leaves out,
+// which are copied from the local objects.
+func (r *Repository) IndexPack(rd io.Reader) (string, error) {
+	dir := filepath.Join(r.objdir, "pack")
+	if err := os.MkdirAll(dir, newDirPerm); err != nil {
+		return "", fmt.Errorf("ensure pack dir: %w", err)
+	}
+	packTmp, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return "", fmt.Errorf("create pack: %w", err)
+	}
+	defer os.Remove(packTmp.Name())
+	defer packTmp.Close()
+
+	bw := bufio.NewWriter(packTmp)
+	p := &packReader{rd: bufio.NewReader(rd), hash: sha1.New(), out: bw}
+	var header [12]byte
+	if _, err := io.ReadFull(p, header[:]); err != nil {
+		return "", fmt.Errorf("read pack header: %w", err)
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return "", errors.New("not a pack stream")
+	}
+	if v := binary.BigEndian.Uint32(header[4:8]); v != 2 && v != 3 {
+		return "", fmt.Errorf("unsupported pack version %d", v)
+	}
+	count := int(binary.BigEndian.Uint32(header[8:12]))
+
+	entries := make([]*indexedEntry, 0, count)
+	byOffset := make(map[int64]*indexedEntry, count)
+	for i := 0; i < count; i++ {
+		e := &indexedEntry{offset: p.offset}
+		p.crc = crc32.NewIEEE()
+		typ, size, err := p.readEntryHeader()
+		if err != nil {
+			return "", fmt.Errorf("entry at %d: %w", e.offset, err)
+		}
+		switch typ {
+		case packOfsDelta:
+			distance, err := p.readDeltaOffset()
+			if err != nil {
+				return "", fmt.Errorf("entry at %d: %w", e.offset, err)
+			}
+			if e.base = byOffset[e.offset-distance]; e.base == nil {
+				return "", fmt.Errorf("entry at %d: no delta base at %d", e.offset, e.offset-distance)
+			}
+		case packRefDelta:
+			e.baseSha = make([]byte, sha1.Size)
+			if _, err := io.ReadFull(p, e.baseSha); err != nil {
+				return "", fmt.Errorf("entry at %d: %w", e.offset, err)
+			}
+		}
+		// Deltas are only checked to inflate correctly here, and are
+		// resolved once the whole pack is on the disk.
+		data, err := p.readInflated(size)
+		if err != nil {
+			return "", fmt.Errorf("entry at %d: %w", e.offset, err)
+		}
+		if kind, ok := packKinds[typ]; ok {
+			e.sha = hashObject(kind, data)
+		} else if typ != packOfsDelta && typ != packRefDelta {
+			return "", fmt.Errorf("entry at %d: unknown type %d", e.offset, typ)
+		}
+		e.crc = p.crc.Sum32()
+		entries = append(entries, e)
+		byOffset[e.offset] = e
+	}
+	p.crc = nil
+
+	sum := p.hash.Sum(nil)
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(p.rd, trailer); err != nil {
+		return "", fmt.Errorf("read pack checksum: %w", err)
+	}
+	if !bytes.Equal(sum, trailer) {
+		return "", fmt.Errorf("pack checksum mismatch: %x != %x", trailer, sum)
+	}
+	if _, err := bw.Write(trailer); err != nil {
+		return "", fmt.Errorf("write pack: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return "", fmt.Errorf("write pack: %w", err)
+	}
+
+	pack := &packFile{path: packTmp.Name(), offsets: make(map[string]int64, count)}
+	for _, e := range entries {
+		if e.sha != nil {
+			pack.offsets[string(e.sha)] = e.offset
+		}
+	}
+	thin, err := r.resolvePackDeltas(pack, packTmp, entries)
+	if err != nil {
+		return "", err
+	}
+	objects := make([]*packedObject, 0, len(entries)+len(thin))
+	for _, e := range entries {
+		objects = append(objects, &packedObject{sha: e.sha, offset: e.offset, crc: e.crc})
+	}
+	if len(thin) != 0 {
+		end := p.offset
+		appended, completed, err := r.completeThinPack(packTmp, end, count, thin)
+		if err != nil {
+			return "", err
+		}
+		objects = append(objects, appended...)
+		sum = completed
+	}
+	return r.installPack(packTmp, objects, sum)
+}
+
+// defaultDeltaBaseCacheLimit is the total size of delta bases kept in
+// memory while deltas of a pack are resolved, unless
+// core.deltaBaseCacheLimit is set, the same as in git.
+const defaultDeltaBaseCacheLimit = 96 << 20
+
+// resolvePackDeltas computes hashes of the delta entries of a pack being
+// indexed. Same as git index-pack, deltas are resolved from their bases
+// down, so that each delta is patched once from the content of its base,
+// which is cached while its deltas are resolved. Bases of reference deltas
+// are first looked up in the pack. The ones found only among the local
+// objects are returned, as a thin pack must be completed with them.
+func (r *Repository) resolvePackDeltas(pack *packFile, fd *os.File, entries []*indexedEntry) ([][]byte, error) {
+	limit, err := r.config.Int("core", "", "deltaBaseCacheLimit", defaultDeltaBaseCacheLimit)
+	if err != nil {
+		return nil, err
+	}
+	d := &deltaResolver{
+		repo:     r,
+		pack:     pack,
+		fd:       fd,
+		children: make(map[*indexedEntry][]*indexedEntry),
+		byBase:   make(map[string][]*indexedEntry),
+		cache:    &deltaBaseCache{limit: limit, bases: make(map[*indexedEntry]*cachedBase)},
+	}
+	var roots []*indexedEntry
+	for _, e := range entries {
+		switch {
+		case e.base != nil:
+			d.children[e.base] = append(d.children[e.base], e)
+		case e.baseSha != nil:
+			d.byBase[string(e.baseSha)] = append(d.byBase[string(e.baseSha)], e)
+		default:
+			roots = append(roots, e)
+		}
+	}
+	for _, e := range roots {
+		if err := d.resolve(e, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only bases that are not in the pack are taken from the local
+	// objects.
+	var thin [][]byte
+	for _, e := range entries {
+		if _, ok := d.byBase[string(e.baseSha)]; e.baseSha == nil || !ok {
+			continue
+		}
+		ok, err := r.HasObject(e.baseSha)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		kind, content, err := r.ReadRawObject(e.baseSha)
+		if err != nil {
+			return nil, fmt.Errorf("delta base %x: %w", e.baseSha, err)
+		}
+		thin = append(thin, e.baseSha)
+		base := &indexedEntry{offset: -1, sha: e.baseSha}
+		if err := d.resolve(base, &cachedBase{kind: kind, content: content}); err != nil {
+			return nil, err
+		}
+	}
+	unresolved := 0
+	for _, e := range entries {
+		if e.sha == nil {
+			unresolved++
+		}
+	}
+	if unresolved != 0 {
+		return nil, fmt.Errorf("%d deltas with missing base", unresolved)
+	}
+
+	// A base believed to be external could be resolved later on from the
+	// pack itself.
+	var missing [][]byte
+	for _, sha := range thin {
+		if _, ok := pack.offsets[string(sha)]; !ok {
+			missing = append(missing, sha)
+		}
+	}
+	return missing, nil
+}
+
+// deltaResolver resolves the deltas of a pack being indexed.
+type deltaResolver struct {
+	repo *Repository
+	pack *packFile
+	fd   *os.File
+	// children are the offset deltas of each entry, and byBase the
+	// reference deltas of each base, removed once they are resolved.
+	children map[*indexedEntry][]*indexedEntry
+	byBase   map[string][]*indexedEntry
+	cache    *deltaBaseCache
+}
+
+// resolve resolves the deltas against the resolved entry, and recursively
+// those against them. The content of the entry is read when there are
+// deltas, unless given.
+func (d *deltaResolver) resolve(e *indexedEntry, content *cachedBase) error {
+	deltas := append(d.children[e], d.byBase[string(e.sha)]...)
+	delete(d.byBase, string(e.sha))
+	if len(deltas) == 0 {
+		return nil
+	}
+	if content != nil {
+		d.cache.add(e, content)
+	}
+	defer d.cache.remove(e)
+	for _, delta := range deltas {
+		base, err := d.base(e)
+		if err != nil {
+			return err
+		}
+		instructions, err := d.repo.readPackDelta(d.pack, d.fd, delta.offset)
+		if err != nil {
+			return err
+		}
+		target, err := patchDelta(base.content, instructions)
+		if err != nil {
+			return fmt.Errorf("entry at %d: %w", delta.offset, err)
+		}
+		delta.sha = hashObject(base.kind, target)
+		d.pack.offsets[string(delta.sha)] = delta.offset
+		if err := d.resolve(delta, &cachedBase{kind: base.kind, content: target}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// base returns the content of a resolved entry, from the cache or read
+// again if it was evicted.
+func (d *deltaResolver) base(e *indexedEntry) (*cachedBase, error) {
+	if b, ok := d.cache.get(e); ok {
+		return b, nil
+	}
+	var b cachedBase
+	var err error
+	if e.offset < 0 {
+		b.kind, b.content, err = d.repo.ReadRawObject(e.sha)
+	} else {
+		b.kind, b.content, err = d.repo.readPackEntry(d.pack, d.fd, e.offset, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.cache.add(e, &b)
+	return &b, nil
+}
+
+// readPackDelta returns the instructions of the delta entry at offset,
+// without resolving it.
+func (r *Repository) readPackDelta(p *packFile, fd *os.File, offset int64) ([]byte, error) {
+	section, release := r.packSection(p, fd, offset)
+	defer release()
+	pr := &packReader{rd: bufio.NewReader(section), offset: offset}
+	typ, size, err := pr.readEntryHeader()
+	if err != nil {
+		return nil, fmt.Errorf("entry at %d: %w", offset, err)
+	}
+	switch typ {
+	case packOfsDelta:
+		_, err = pr.readDeltaOffset()
+	case packRefDelta:
+		_, err = io.ReadFull(pr, make([]byte, sha1.Size))
+	default:
+		err = fmt.Errorf("type %d is not a delta", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("entry at %d: %w", offset, err)
+	}
+	data, err := pr.readInflated(size)
+	if err != nil {
+		return nil, fmt.Errorf("entry at %d: %w", offset, err)
+	}
+	return data, nil
+}
+
+// deltaBaseCache holds the content of entries whose deltas are being
+// resolved, which are the bases of the current delta chain, up to a total
+// size. Least recently used bases are evicted to make room.
+type deltaBaseCache struct {
+	limit int64
+	size  int64
+	tick  uint64
+	bases map[*indexedEntry]*cachedBase
+}
+
+type cachedBase struct {
+	kind     string
+	content  []byte
+	lastUsed uint64
+}
+
+func (c *deltaBaseCache) get(e *indexedEntry) (*cachedBase, bool) {
+	b, ok := c.bases[e]
+	if ok {
+		c.tick++
+		b.lastUsed = c.tick
+	}
+	return b, ok
+}
+
+// add caches the content, evicting others if the cache is full. Content
+// larger than the limit is not cached.
+func (c *deltaBaseCache) add(e *indexedEntry, b *cachedBase) {
+	size := int64(len(b.content))
+	if size > c.limit {
+		return
+	}
+	for c.size+size > c.limit {
+		var lru *indexedEntry
+		for other, ob := range c.bases {
+			if lru == nil || ob.lastUsed < c.bases[lru].lastUsed {
+				lru = other
+			}
+		}
+		c.remove(lru)
+	}
+	c.tick++
+	b.lastUsed = c.tick
+	c.bases[e] = b
+	c.size += size
+}
+
+func (c *deltaBaseCache) remove(e *indexedEntry) {
+	if b, ok := c.bases[e]; ok {
+		c.size -= int64(len(b.content))
+		delete(c.bases, e)
+	}
+}
+
+// completeThinPack appends the local objects to a pack of count entries
+// that ends at end, followed by the checksum, and updates the number of
+// entries in the header. Appended entries and the new pack checksum are
+// returned.
+func (r *Repository) completeThinPack(fd *os.File, end int64, count int, bases [][]byte) ([]*packedObject, []byte, error) {
+	if _, err := fd.Seek(end, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("seek pack: %w", err)
+	}
+	kinds := make(map[string]byte, len(packKinds))
+	for typ, kind := range packKinds {
+		kinds[kind] = typ
+	}
+	bw := bufio.NewWriter(fd)
+	pw := &packWriter{w: bw, offset: end}
+	var objects []*packedObject
+	for _, sha := range bases {
+		kind, content, err := r.ReadRawObject(sha)
+		if err != nil {
+			return nil, nil, fmt.Errorf("delta base %x: %w", sha, err)
+		}
+		obj := &packedObject{sha: sha, offset: pw.offset}
+		pw.crc = crc32.NewIEEE()
+		if err := pw.writeEntry(kinds[kind], content, r.packCompression); err != nil {
+			return nil, nil, fmt.Errorf("write %x: %w", sha, err)
+		}
+		obj.crc = pw.crc.Sum32()
+		objects = append(objects, obj)
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, nil, fmt.Errorf("write pack: %w", err)
+	}
+
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(count+len(bases)))
+	if _, err := fd.WriteAt(n[:], 8); err != nil {
+		return nil, nil, fmt.Errorf("write pack header: %w", err)
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(fd, 0, pw.offset)); err != nil {
+		return nil, nil, fmt.Errorf("read pack: %w", err)
+	}
+	sum := h.Sum(nil)
+	if _, err := fd.WriteAt(sum, pw.offset); err != nil {
+		return nil, nil, fmt.Errorf("write pack checksum: %w", err)
+	}
+	return objects, sum, nil
+}
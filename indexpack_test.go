@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIndexPack(t *testing.T) {
+	repo := newTestRepository(t)
+	base := []byte("hello world\n")
+	// Copy "hello " from the base and insert "gopher\n", or "there!\n".
+	delta := []byte{12, 13, 0x90, 6, 7}
+	delta = append(delta, []byte("gopher\n")...)
+	other := []byte{12, 13, 0x90, 6, 7}
+	other = append(other, []byte("there!\n")...)
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(3))
+	writeTestPackEntry(t, &pack, packBlob, nil, base)
+	// Offset delta with the base at the first entry, 12 bytes back.
+	writeTestPackEntry(t, &pack, packOfsDelta, []byte{byte(pack.Len() - 12)}, delta)
+	writeTestPackEntry(t, &pack, packRefDelta, hashObject("blob", base), other)
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+
+	path, err := repo.IndexPack(&pack)
+	if err != nil {
+		t.Fatalf("index pack: %s", err)
+	}
+	idx, err := readPackIndex(strings.TrimSuffix(path, ".pack") + ".idx")
+	if err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	if idx.count() != 3 {
+		t.Fatalf("want 3 objects indexed, got %d", idx.count())
+	}
+	if !bytes.Equal(idx.packSum, sum[:]) {
+		t.Fatalf("want pack checksum %x, got %x", sum, idx.packSum)
+	}
+	for _, want := range []string{"hello world\n", "hello gopher\n", "hello there!\n"} {
+		kind, content, err := repo.ReadRawObject(hashObject("blob", []byte(want)))
+		if err != nil {
+			t.Fatalf("read %q: %s", want, err)
+		}
+		if kind != "blob" || string(content) != want {
+			t.Fatalf("want blob %q, got %s %q", want, kind, content)
+		}
+	}
+}
+
+func TestIndexPackDeltaChains(t *testing.T) {
+	src := newTestRepository(t)
+	// Each blob adds a line to the previous one, so that the pack has
+	// long delta chains.
+	var shas, contents [][]byte
+	var content []byte
+	for i := 0; i < 30; i++ {
+		content = append(content, fmt.Sprintf("line %d of a growing file\n", i)...)
+		sha, err := src.WriteObject("blob", content)
+		if err != nil {
+			t.Fatalf("write blob: %s", err)
+		}
+		shas, contents = append(shas, sha), append(contents, append([]byte(nil), content...))
+	}
+	path, err := src.writePack(shas)
+	if err != nil {
+		t.Fatalf("write pack: %s", err)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read pack: %s", err)
+	}
+
+	// Without room for any base, bases are read again from the pack.
+	for _, limit := range []string{"", "1"} {
+		t.Run("limit "+limit, func(t *testing.T) {
+			repo := newTestRepository(t)
+			if limit != "" {
+				repo.config.Entries = append(repo.config.Entries, &ConfigEntry{Section: "core", Key: "deltabasecachelimit", Value: limit})
+			}
+			if _, err := repo.IndexPack(bytes.NewReader(raw)); err != nil {
+				t.Fatalf("index pack: %s", err)
+			}
+			deltas := 0
+			for i, sha := range shas {
+				kind, content, err := repo.ReadRawObject(sha)
+				if err != nil {
+					t.Fatalf("read %x: %s", sha, err)
+				}
+				if kind != "blob" || !bytes.Equal(content, contents[i]) {
+					t.Fatalf("%x: content differs", sha)
+				}
+				if _, base, err := repo.objectDiskInfo(sha); err == nil && base != nil {
+					deltas++
+				}
+			}
+			if deltas == 0 {
+				t.Fatal("want objects stored as deltas")
+			}
+		})
+	}
+}
+
+func TestIndexThinPack(t *testing.T) {
+	repo := newTestRepository(t)
+	base, err := repo.WriteObject("blob", []byte("hello world\n"))
+	if err != nil {
+		t.Fatalf("write base: %s", err)
+	}
+
+	delta := []byte{12, 13, 0x90, 6, 7}
+	delta = append(delta, []byte("gopher\n")...)
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(1))
+	writeTestPackEntry(t, &pack, packRefDelta, base, delta)
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+
+	q, err := repo.NewQuarantine()
+	if err != nil {
+		t.Fatalf("quarantine: %s", err)
+	}
+	path, err := q.Repository().IndexPack(&pack)
+	if err != nil {
+		t.Fatalf("index pack: %s", err)
+	}
+	if err := q.Migrate(); err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	path = filepath.Join(repo.objdir, "pack", filepath.Base(path))
+	loose, err := repo.objectPath(base)
+	if err != nil {
+		t.Fatalf("find base: %s", err)
+	}
+	if err := os.Remove(loose); err != nil {
+		t.Fatalf("remove base: %s", err)
+	}
+
+	// The pack is complete without the loose base.
+	idx, err := readPackIndex(strings.TrimSuffix(path, ".pack") + ".idx")
+	if err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	if idx.count() != 2 {
+		t.Fatalf("want the base appended to the pack, got %d objects", idx.count())
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read pack: %s", err)
+	}
+	if n := binary.BigEndian.Uint32(raw[8:12]); n != 2 {
+		t.Fatalf("want 2 entries in the pack header, got %d", n)
+	}
+	if sum := sha1.Sum(raw[:len(raw)-sha1.Size]); !bytes.Equal(sum[:], raw[len(raw)-sha1.Size:]) || !bytes.Equal(sum[:], idx.packSum) {
+		t.Fatal("pack checksum mismatch")
+	}
+	sha, _ := hex.DecodeString("cb2ad40a24dc67c699f262b980adf4fe46aca576")
+	if _, content, err := repo.ReadRawObject(sha); err != nil || string(content) != "hello gopher\n" {
+		t.Fatalf("read patched object: %q, %v", content, err)
+	}
+	if _, content, err := repo.ReadRawObject(base); err != nil || string(content) != "hello world\n" {
+		t.Fatalf("read appended base: %q, %v", content, err)
+	}
+}
+
+func TestIndexPackChecksumMismatch(t *testing.T) {
+	repo := newTestRepository(t)
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(1))
+	writeTestPackEntry(t, &pack, packBlob, nil, []byte("hello world\n"))
+	pack.Write(make([]byte, sha1.Size))
+
+	if _, err := repo.IndexPack(&pack); err == nil {
+		t.Fatal("want checksum error")
+	}
+	names, err := ioutil.ReadDir(filepath.Join(repo.objdir, "pack"))
+	if err != nil {
+		t.Fatalf("read pack dir: %s", err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("want no files left, got %d", len(names))
+	}
+}
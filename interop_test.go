@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Interoperability tests exchange repositories with git, when it is
+// installed, and compare the state of both sides.
+
+// requireGit skips the test if git is not installed.
+func requireGit(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+}
+
+// runGit runs git in the directory, isolated from the configuration of the
+// user, and returns its standard output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"HOME="+dir,
+		"GIT_AUTHOR_NAME=Test",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_AUTHOR_DATE=1600000000 +0000",
+		"GIT_COMMITTER_NAME=Test",
+		"GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_COMMITTER_DATE=1600000000 +0000",
+	)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return stdout.String()
+}
+
+// newGitRepository creates a repository with git, with a history of
+// branches, a merge, an annotated tag and files of all modes.
+func newGitRepository(t *testing.T, dir string) {
+	t.Helper()
+	runGit(t, dir, "init", "-q", "-b", "main", ".")
+	write := func(name, content string, mode os.FileMode) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	write("README", "readme\n", 0644)
+	write("src/main.go", "package main\n", 0644)
+	write("bin/run.sh", "#!/bin/sh\n", 0755)
+	if err := os.Symlink("src/main.go", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("symlink: %s", err)
+	}
+	runGit(t, dir, "add", "-A")
+	runGit(t, dir, "commit", "-q", "-m", "initial")
+	runGit(t, dir, "tag", "-a", "-m", "first release", "v1.0")
+
+	runGit(t, dir, "checkout", "-q", "-b", "feature")
+	write("src/feature.go", "package main\n\nfunc feature() {}\n", 0644)
+	runGit(t, dir, "add", "-A")
+	runGit(t, dir, "commit", "-q", "-m", "add feature")
+
+	runGit(t, dir, "checkout", "-q", "main")
+	write("README", "readme\nmore\n", 0644)
+	runGit(t, dir, "commit", "-q", "-a", "-m", "update readme")
+	runGit(t, dir, "merge", "-q", "--no-ff", "-m", "merge feature", "feature")
+	runGit(t, dir, "tag", "light")
+}
+
+// gitObjects returns the type and the content of all objects of the git
+// repository, by their hex encoded hash.
+func gitObjects(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	out := runGit(t, dir, "cat-file", "--batch-all-objects", "--batch")
+	objects := make(map[string]string)
+	rd := bufio.NewReader(strings.NewReader(out))
+	for {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF {
+			return objects
+		}
+		if err != nil {
+			t.Fatalf("read batch output: %s", err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("invalid batch output line %q", line)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			t.Fatalf("invalid batch output line %q", line)
+		}
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(rd, content); err != nil {
+			t.Fatalf("read %s content: %s", fields[0], err)
+		}
+		objects[fields[0]] = fields[1] + " " + string(content[:size])
+	}
+}
+
+// gitRefs returns all references of the git repository with the objects
+// they point to.
+func gitRefs(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	refs := make(map[string]string)
+	for _, line := range strings.Split(runGit(t, dir, "for-each-ref", "--format=%(objectname) %(refname)"), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs
+}
+
+// assertSameObjects checks that every object of the git repository can be
+// read from the repository with the same type and content.
+func assertSameObjects(t *testing.T, repo *Repository, gitDir string) {
+	t.Helper()
+	for name, want := range gitObjects(t, gitDir) {
+		sha, _ := hex.DecodeString(name)
+		kind, content, err := repo.ReadRawObject(sha)
+		if err != nil {
+			t.Errorf("read %s: %s", name, err)
+			continue
+		}
+		if got := kind + " " + string(content); got != want {
+			t.Errorf("object %s differs\nwant %q\ngot  %q", name, want, got)
+		}
+	}
+}
+
+// assertSameRefs checks that references of the repository and the git
+// repository point to the same objects. Names are mapped with rename before
+// looking them up in the git repository, and references for which rename
+// returns an empty string are skipped.
+func assertSameRefs(t *testing.T, repo *Repository, gitDir string, rename func(string) string) {
+	t.Helper()
+	refs, err := repo.ListRefs()
+	if err != nil {
+		t.Fatalf("list refs: %s", err)
+	}
+	got := make(map[string]string)
+	for name, sha := range refs {
+		if name = rename(name); name != "" {
+			got[name] = hex.EncodeToString(sha)
+		}
+	}
+	want := make(map[string]string)
+	for name, sha := range gitRefs(t, gitDir) {
+		if _, ok := got[name]; ok || rename(name) == name {
+			want[name] = sha
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("references differ\nwant %v\ngot  %v", want, got)
+	}
+}
+
+func sameRefName(name string) string {
+	return name
+}
+
+func TestInteropCloneFromGit(t *testing.T) {
+	requireGit(t)
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.Mkdir(upstream, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	newGitRepository(t, upstream)
+
+	clone := filepath.Join(dir, "clone")
+	if err := cmdClone(nil, ioutil.Discard, []string{upstream, clone}); err != nil {
+		t.Fatalf("clone: %s", err)
+	}
+	repo, err := OpenRepository(clone)
+	if err != nil {
+		t.Fatalf("open clone: %s", err)
+	}
+	assertSameObjects(t, repo, upstream)
+	assertSameRefs(t, repo, upstream, func(name string) string {
+		if strings.HasPrefix(name, "refs/remotes/origin/") && name != "refs/remotes/origin/HEAD" {
+			return "refs/heads/" + strings.TrimPrefix(name, "refs/remotes/origin/")
+		}
+		if strings.HasPrefix(name, "refs/tags/") {
+			return name
+		}
+		return ""
+	})
+
+	// The clone must be a valid repository for git, with the work tree
+	// checked out. The work tree is compared with an index read from HEAD,
+	// so that only the content of files matters.
+	runGit(t, clone, "fsck", "--strict", "--no-dangling")
+	runGit(t, clone, "read-tree", "HEAD")
+	if status := runGit(t, clone, "status", "--porcelain"); status != "" {
+		t.Errorf("checked out work tree differs from HEAD:\n%s", status)
+	}
+}
+
+func TestInteropGitCloneFromUs(t *testing.T) {
+	requireGit(t)
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	repo, err := CreateRepository(filepath.Join(dir, "ours"))
+	if err != nil {
+		t.Fatalf("create repository: %s", err)
+	}
+	first := writeTestCommit(t, repo, "first")
+	second := writeTestCommit(t, repo, "second", first)
+	other := writeTestCommit(t, repo, "other", first)
+	merge := writeTestCommit(t, repo, "merge", second, other)
+	err = repo.UpdateRefs(
+		&RefUpdate{Name: "refs/heads/master", Sha: merge},
+		&RefUpdate{Name: "refs/heads/other", Sha: other},
+	)
+	if err != nil {
+		t.Fatalf("update refs: %s", err)
+	}
+
+	// Without --no-local git would copy the object directory instead of
+	// reading the objects.
+	runGit(t, dir, "clone", "-q", "--no-local", "--bare", repo.workdir, "theirs")
+	theirs := filepath.Join(dir, "theirs")
+	runGit(t, theirs, "fsck", "--strict", "--no-dangling")
+	assertSameObjects(t, repo, theirs)
+	assertSameRefs(t, repo, theirs, sameRefName)
+}
+
+func TestInteropPushToGit(t *testing.T) {
+	requireGit(t)
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	repo, err := CreateRepository(filepath.Join(dir, "ours"))
+	if err != nil {
+		t.Fatalf("create repository: %s", err)
+	}
+	first := writeTestCommit(t, repo, "first")
+	second := writeTestCommit(t, repo, "second", first)
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: second}); err != nil {
+		t.Fatalf("update refs: %s", err)
+	}
+
+	theirs := filepath.Join(dir, "theirs")
+	if err := os.Mkdir(theirs, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	runGit(t, theirs, "init", "-q", "-b", "main", ".")
+	tr, err := repo.OpenTransport(theirs)
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	defer tr.Close()
+	spec, err := ParseRefspec("refs/heads/master:refs/heads/pushed")
+	if err != nil {
+		t.Fatalf("parse refspec: %s", err)
+	}
+	if _, err := repo.Push(tr, []*Refspec{spec}, nil); err != nil {
+		t.Fatalf("push: %s", err)
+	}
+
+	runGit(t, theirs, "fsck", "--strict", "--no-dangling")
+	if got := strings.TrimSpace(runGit(t, theirs, "rev-parse", "refs/heads/pushed")); got != hex.EncodeToString(second) {
+		t.Fatalf("want pushed branch at %x, got %s", second, got)
+	}
+	assertSameObjects(t, repo, theirs)
+}
+
+func TestInteropGitPushToUs(t *testing.T) {
+	requireGit(t)
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.Mkdir(upstream, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	newGitRepository(t, upstream)
+	repo, err := CreateRepository(filepath.Join(dir, "ours"))
+	if err != nil {
+		t.Fatalf("create repository: %s", err)
+	}
+
+	// Objects of small pushes are stored as loose objects.
+	runGit(t, upstream, "push", "-q", repo.workdir, "refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*")
+	repo, err = OpenRepository(repo.workdir)
+	if err != nil {
+		t.Fatalf("open repository: %s", err)
+	}
+	assertSameObjects(t, repo, upstream)
+	assertSameRefs(t, repo, upstream, sameRefName)
+	refs, err := repo.ListRefs()
+	if err != nil {
+		t.Fatalf("list refs: %s", err)
+	}
+	var tips [][]byte
+	for _, sha := range refs {
+		tips = append(tips, sha)
+	}
+	if err := repo.CheckConnectivity(tips); err != nil {
+		t.Fatalf("check connectivity: %s", err)
+	}
+	runGit(t, repo.workdir, "fsck", "--strict", "--no-dangling")
+}
+
+func TestInteropLargeOffsetIndex(t *testing.T) {
+	requireGit(t)
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	newGitRepository(t, dir)
+	runGit(t, dir, "repack", "-adq")
+
+	// Git stores offsets past the given limit in the large offset table,
+	// the same as offsets of entries past 2 GiB.
+	packs, err := filepath.Glob(filepath.Join(dir, ".git", "objects", "pack", "*.pack"))
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("want a single pack, got %q, %v", packs, err)
+	}
+	idxPath := strings.TrimSuffix(packs[0], ".pack") + ".idx"
+	if err := os.Remove(idxPath); err != nil {
+		t.Fatalf("remove index: %s", err)
+	}
+	runGit(t, dir, "index-pack", "--index-version=2,0x20", "-o", idxPath, packs[0])
+	idx, err := readPackIndex(idxPath)
+	if err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	if len(idx.large) == 0 {
+		t.Fatal("want large offsets in the index")
+	}
+
+	repo, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatalf("open repository: %s", err)
+	}
+	assertSameObjects(t, repo, dir)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An operation that changes many files, such as a checkout, keeps a
+// journal in the git directory while it runs. Before a path is replaced or
+// removed, its previous content is stored as a blob and recorded in the
+// journal, so that an operation that was killed midway can be rolled back.
+// The journal also records the operation and its arguments, so that it can
+// be resumed instead. The journal is removed when the operation completes,
+// and no other operation can start while it exists.
+//
+// The journal is a text file with an "op <name>" line, followed by
+// "arg <value>" lines and "save <mode> <hash> <path>" lines, where the mode
+// is zero and the hash is "-" for a path that did not exist.
+const journalFile = "journal"
+
+// Journal records an operation in progress.
+type Journal struct {
+	Op   string
+	Args []string
+	// Saved are the previous states of changed paths, in the order they
+	// were changed.
+	Saved []*JournalSave
+
+	repo *Repository
+	fd   *os.File
+}
+
+// JournalSave is the state of a path before it was changed. Mode is zero if
+// the path did not exist, and a directory has no hash.
+type JournalSave struct {
+	Path string
+	Mode os.FileMode
+	Sha  []byte
+}
+
+// interruptedError is returned when an operation cannot start, because
+// another one was interrupted.
+type interruptedError struct {
+	Op string
+}
+
+func (e *interruptedError) Error() string {
+	return fmt.Sprintf("an interrupted %s left the repository in a partial state, run recover --continue or recover --abort", e.Op)
+}
+
+// BeginJournal starts recording the operation. It fails if the journal of
+// an interrupted operation exists.
+func (r *Repository) BeginJournal(op string, args ...string) (*Journal, error) {
+	switch j, err := r.ReadJournal(); {
+	case err == nil:
+		return nil, &interruptedError{Op: j.Op}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	fd, err := os.OpenFile(filepath.Join(r.gitdir, journalFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, &interruptedError{Op: op}
+		}
+		return nil, fmt.Errorf("create journal: %w", err)
+	}
+	j := &Journal{Op: op, Args: args, repo: r, fd: fd}
+	var b strings.Builder
+	fmt.Fprintf(&b, "op %s\n", op)
+	for _, arg := range args {
+		fmt.Fprintf(&b, "arg %s\n", arg)
+	}
+	if err := j.append(b.String()); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return nil, err
+	}
+	return j, nil
+}
+
+// ReadJournal returns the journal of an interrupted operation. Error wraps
+// os.ErrNotExist if there is none.
+func (r *Repository) ReadJournal() (*Journal, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(r.gitdir, journalFile))
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+	j := &Journal{repo: r}
+	sc := bufio.NewScanner(bytes.NewReader(raw))
+	for sc.Scan() {
+		line := sc.Text()
+		kind, value := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			kind, value = line[:i], line[i+1:]
+		}
+		switch kind {
+		case "op":
+			j.Op = value
+		case "arg":
+			j.Args = append(j.Args, value)
+		case "save":
+			fields := strings.SplitN(value, " ", 3)
+			if len(fields) != 3 {
+				// A line cut short when the operation was killed.
+				continue
+			}
+			mode, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("journal: invalid mode %q", fields[0])
+			}
+			s := &JournalSave{Mode: os.FileMode(mode), Path: fields[2]}
+			if fields[1] != "-" {
+				if s.Sha, err = hex.DecodeString(fields[1]); err != nil {
+					return nil, fmt.Errorf("journal: invalid hash %q", fields[1])
+				}
+			}
+			j.Saved = append(j.Saved, s)
+		default:
+			return nil, fmt.Errorf("journal: unexpected line %q", line)
+		}
+	}
+	if j.Op == "" {
+		return nil, errors.New("journal: missing operation")
+	}
+	return j, nil
+}
+
+// Resume opens the journal of an interrupted operation for recording the
+// changes of the resumed operation.
+func (j *Journal) Resume() error {
+	fd, err := os.OpenFile(filepath.Join(j.repo.gitdir, journalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	j.fd = fd
+	return nil
+}
+
+// append writes and flushes a record, so that it is not lost if the
+// process is killed right after the change it precedes.
+func (j *Journal) append(record string) error {
+	if _, err := j.fd.WriteString(record); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	return syncFile(j.fd)
+}
+
+// save records the current state of the path, which is about to be
+// changed. A directory is saved together with all its files. Nil journal
+// records nothing.
+func (j *Journal) save(path string) error {
+	if j == nil {
+		return nil
+	}
+	s := &JournalSave{Path: path}
+	info, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) || isNotDir(err):
+		// Created by the operation.
+	case err != nil:
+		return fmt.Errorf("stat %s: %w", path, err)
+	case info.IsDir():
+		s.Mode = modeTree
+	default:
+		content, err := readWorktreeFile(path, info)
+		if err != nil {
+			return err
+		}
+		s.Mode = modeBlob
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			s.Mode = modeSymlink
+		case info.Mode()&0111 != 0:
+			s.Mode = modeExec
+		}
+		if s.Sha, err = j.repo.WriteObject("blob", content); err != nil {
+			return fmt.Errorf("save %s: %w", path, err)
+		}
+	}
+	sha := "-"
+	if s.Sha != nil {
+		sha = hex.EncodeToString(s.Sha)
+	}
+	if err := j.append(fmt.Sprintf("save %d %s %s\n", s.Mode, sha, path)); err != nil {
+		return err
+	}
+	j.Saved = append(j.Saved, s)
+
+	if s.Mode != modeTree {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("read dir %s: %w", path, err)
+	}
+	for _, e := range entries {
+		if err := j.save(filepath.Join(path, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changed returns true if the path was saved and its content is not the
+// saved one anymore, which means the operation has changed it.
+func (j *Journal) changed(path string) (bool, error) {
+	if j == nil {
+		return false, nil
+	}
+	for _, s := range j.Saved {
+		if s.Path != path {
+			continue
+		}
+		info, err := os.Lstat(path)
+		switch {
+		case s.Mode == 0:
+			return err == nil, nil
+		case err != nil:
+			return true, nil
+		case s.Mode == modeTree || info.IsDir():
+			return (s.Mode == modeTree) != info.IsDir(), nil
+		}
+		content, err := readWorktreeFile(path, info)
+		if err != nil {
+			return false, err
+		}
+		return !bytes.Equal(hashObject("blob", content), s.Sha), nil
+	}
+	return false, nil
+}
+
+// Close completes the operation and removes the journal.
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	if j.fd != nil {
+		j.fd.Close()
+	}
+	if err := os.Remove(filepath.Join(j.repo.gitdir, journalFile)); err != nil {
+		return fmt.Errorf("remove journal: %w", err)
+	}
+	return nil
+}
+
+// Rollback restores all saved paths to their state from before the
+// operation, in reverse order, and removes the journal.
+func (j *Journal) Rollback() error {
+	for i := len(j.Saved) - 1; i >= 0; i-- {
+		s := j.Saved[i]
+		if s.Mode == modeTree {
+			// Files of the directory were saved after it, and so are
+			// already restored.
+			if ok, err := isDir(s.Path); err != nil {
+				return err
+			} else if !ok {
+				os.Remove(s.Path)
+				if err := os.MkdirAll(s.Path, newDirPerm); err != nil {
+					return fmt.Errorf("restore %s: %w", s.Path, err)
+				}
+			}
+			continue
+		}
+		if err := os.RemoveAll(s.Path); err != nil && !isNotDir(err) {
+			return fmt.Errorf("restore %s: %w", s.Path, err)
+		}
+		if s.Mode == 0 {
+			continue
+		}
+		_, content, err := j.repo.ReadRawObject(s.Sha)
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", s.Path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(s.Path), newDirPerm); err != nil {
+			return fmt.Errorf("restore %s: %w", s.Path, err)
+		}
+		switch s.Mode {
+		case modeSymlink:
+			err = os.Symlink(string(content), s.Path)
+		case modeExec:
+			err = ioutil.WriteFile(s.Path, content, 0755)
+		default:
+			err = ioutil.WriteFile(s.Path, content, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", s.Path, err)
+		}
+	}
+	return j.Close()
+}
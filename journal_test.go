@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	cases := map[string]struct {
+		abort bool
+		want  map[string]string
+	}{
+		"abort": {
+			abort: true,
+			want:  map[string]string{"a": "old\n", "dir": "old dir\n"},
+		},
+		"continue": {
+			want: map[string]string{"a": "new a\n", "dir/b": "new b\n"},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			repo := newTestRepository(t)
+			dir := repo.workdir
+			tb := NewTreeBuilder(repo, nil)
+			for name, content := range map[string]string{"a": "new a\n", "dir/b": "new b\n"} {
+				blob, err := repo.WriteObject("blob", []byte(content))
+				if err != nil {
+					t.Fatalf("write blob: %s", err)
+				}
+				if err := tb.Insert(name, modeBlob, blob); err != nil {
+					t.Fatalf("insert: %s", err)
+				}
+			}
+			tree, err := tb.Write()
+			if err != nil {
+				t.Fatalf("write tree: %s", err)
+			}
+			for name, content := range map[string]string{"a": "old\n", "dir": "old dir\n"} {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatalf("write file: %s", err)
+				}
+			}
+
+			// The checkout is killed while writing the first file.
+			j, err := repo.BeginJournal("checkout", hex.EncodeToString(tree), dir, "backup")
+			if err != nil {
+				t.Fatalf("begin journal: %s", err)
+			}
+			for _, name := range []string{"a.orig", "a"} {
+				if err := j.save(filepath.Join(dir, name)); err != nil {
+					t.Fatalf("save: %s", err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("ne"), 0644); err != nil {
+				t.Fatalf("write file: %s", err)
+			}
+			j.fd.Close()
+
+			var interrupted *interruptedError
+			if _, err := repo.BeginJournal("checkout"); !errors.As(err, &interrupted) {
+				t.Fatalf("want interrupted error, got %v", err)
+			}
+			j, err = repo.ReadJournal()
+			if err != nil {
+				t.Fatalf("read journal: %s", err)
+			}
+			if j.Op != "checkout" || len(j.Args) != 3 || len(j.Saved) != 2 || j.Saved[1].Mode != modeBlob || j.Saved[0].Mode != 0 {
+				t.Fatalf("unexpected journal %+v", j)
+			}
+
+			if tc.abort {
+				if err := j.Rollback(); err != nil {
+					t.Fatalf("rollback: %s", err)
+				}
+			} else {
+				if err := j.Resume(); err != nil {
+					t.Fatalf("resume: %s", err)
+				}
+				// The partially written file is not backed up, the file
+				// in place of the directory is.
+				if err := resumeCheckout(ioutil.Discard, repo, j); err != nil {
+					t.Fatalf("resume checkout: %s", err)
+				}
+				if err := j.Close(); err != nil {
+					t.Fatalf("close: %s", err)
+				}
+				tc.want["dir.orig"] = "old dir\n"
+			}
+			for name, want := range tc.want {
+				if got, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+					t.Fatalf("%s: want %q, got %q, %v", name, want, got, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, "a.orig")); !os.IsNotExist(err) {
+				t.Fatalf("want no backup of a, got %v", err)
+			}
+			if _, err := repo.ReadJournal(); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("want journal removed, got %v", err)
+			}
+		})
+	}
+}
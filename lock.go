@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Files are updated by writing a lock file next to them, which is renamed
+// into place. A lock file that exists means that another process is
+// updating the file, or that a process crashed while doing so and left the
+// lock file behind.
+//
+// The process taking a lock writes its pid, host and operation to an owner
+// file next to the lock file, because lock files are closed before they are
+// renamed into place, so an open file does not tell that the lock is held.
+// A lock is stale once its owner is not running anymore. Locks without an
+// owner file, written by other programs, are stale if they are older than
+// staleLockAge and no process has them open. Processes are only known where
+// /proc lists their open files.
+const staleLockAge = 10 * time.Minute
+
+// lockOwnerSuffix is appended to the path of a lock file to get the path of
+// its owner file.
+const lockOwnerSuffix = ".owner"
+
+// lockOperation is what this process does, recorded in the owner files of
+// its locks. main sets it to the command that is run.
+var lockOperation = filepath.Base(os.Args[0])
+
+// lockOwner is the process that took a lock.
+type lockOwner struct {
+	Pid       int
+	Host      string
+	Operation string
+}
+
+func (o *lockOwner) String() string {
+	s := "process " + strconv.Itoa(o.Pid)
+	if host, _ := os.Hostname(); o.Host != host {
+		s += " on " + o.Host
+	}
+	if o.Operation != "" {
+		s += " (" + o.Operation + ")"
+	}
+	return s
+}
+
+// running returns whether the owner still runs. Processes of other hosts
+// cannot be looked at and are assumed to run, same as for gc.pid.
+func (o *lockOwner) running() bool {
+	if host, _ := os.Hostname(); o.Host != host {
+		return true
+	}
+	p, err := os.FindProcess(o.Pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// readLockOwner returns the owner of a lock, or nil if the lock has no owner
+// file.
+func readLockOwner(lock string) *lockOwner {
+	raw, err := ioutil.ReadFile(lock + lockOwnerSuffix)
+	if err != nil {
+		return nil
+	}
+	fields := strings.SplitN(strings.TrimSuffix(string(raw), "\n"), " ", 3)
+	if len(fields) < 2 {
+		return nil
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil || pid <= 0 {
+		return nil
+	}
+	o := &lockOwner{Pid: pid, Host: fields[1]}
+	if len(fields) == 3 {
+		o.Operation = fields[2]
+	}
+	return o
+}
+
+// createLock creates the lock file of a file in the git directory and writes
+// its owner file. The lock must be released with commitLock or releaseLock.
+func createLock(gitdir, lock string) (*os.File, error) {
+	fd, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, lockFileError(gitdir, lock, err)
+	}
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%d %s %s\n", os.Getpid(), host, lockOperation)
+	if err := ioutil.WriteFile(lock+lockOwnerSuffix, []byte(owner), 0644); err != nil {
+		fd.Close()
+		os.Remove(lock)
+		return nil, fmt.Errorf("write lock owner: %w", err)
+	}
+	return fd, nil
+}
+
+// writeLockFile creates the lock file with the content, and if requested
+// flushes it to the disk before it is closed.
+func writeLockFile(gitdir, lock string, content []byte, fsync bool) error {
+	fd, err := createLock(gitdir, lock)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(content)
+	if err == nil && fsync {
+		err = syncFile(fd)
+	}
+	if cerr := fd.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		releaseLock(lock)
+	}
+	return err
+}
+
+// commitLock renames the closed lock file into place. The owner file is
+// removed first, while the lock is still held, so that the owner file of
+// the next process taking the lock is not removed. The lock is released if
+// it cannot be renamed.
+func commitLock(lock, dest string) error {
+	os.Remove(lock + lockOwnerSuffix)
+	if err := os.Rename(lock, dest); err != nil {
+		os.Remove(lock)
+		return err
+	}
+	return nil
+}
+
+// releaseLock removes the lock file without updating the locked file.
+func releaseLock(lock string) {
+	os.Remove(lock + lockOwnerSuffix)
+	os.Remove(lock)
+}
+
+// lockError is returned when a file cannot be locked, because its lock file
+// exists.
+type lockError struct {
+	Path string
+	// What describes the locked file.
+	What    string
+	Age     time.Duration
+	Holders []int
+	// Owner is the process that took the lock, if it wrote an owner file.
+	Owner *lockOwner
+	Stale bool
+}
+
+func (e *lockError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cannot lock %s: %s exists", e.What, e.Path)
+	switch {
+	case len(e.Holders) != 0:
+		fmt.Fprintf(&b, ", held by %s", e.holders())
+	case e.Stale && e.Owner != nil:
+		fmt.Fprintf(&b, "\n%s took the lock and is not running anymore; remove it with unlock", e.Owner)
+	case e.Stale:
+		fmt.Fprintf(&b, "\nthe lock is %s old and no process holds it, a process probably crashed; remove it with unlock", e.Age.Round(time.Second))
+	default:
+		b.WriteString("\nanother process seems to be running in this repository; if not, remove the lock with unlock --force")
+	}
+	return b.String()
+}
+
+// holders describes the processes holding the lock.
+func (e *lockError) holders() string {
+	if e.Owner != nil {
+		return e.Owner.String()
+	}
+	return "process " + joinPids(e.Holders)
+}
+
+// Unwrap makes the error match os.ErrExist, same as the error of creating
+// the lock file.
+func (e *lockError) Unwrap() error {
+	return os.ErrExist
+}
+
+// lockFileError describes the error of creating a lock file of a file in the
+// git directory. Errors other than an existing lock file are returned as
+// they are.
+func lockFileError(gitdir, lock string, err error) error {
+	if !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	if info, serr := inspectLock(gitdir, lock); serr == nil {
+		return info
+	}
+	return err
+}
+
+// inspectLock describes an existing lock file.
+func inspectLock(gitdir, lock string) (*lockError, error) {
+	info, err := os.Lstat(lock)
+	if err != nil {
+		return nil, err
+	}
+	e := &lockError{Path: lock, What: lockedFile(gitdir, lock), Age: time.Since(info.ModTime())}
+	if e.Age < 0 {
+		e.Age = 0
+	}
+	if e.Owner = readLockOwner(lock); e.Owner != nil {
+		if e.Owner.running() {
+			e.Holders = []int{e.Owner.Pid}
+		} else {
+			e.Stale = true
+		}
+		return e, nil
+	}
+	e.Holders = lockHolders(lock)
+	e.Stale = len(e.Holders) == 0 && e.Age >= staleLockAge
+	return e, nil
+}
+
+// lockedFile returns a description of the file a lock file is for.
+func lockedFile(gitdir, lock string) string {
+	name := strings.TrimSuffix(lock, ".lock")
+	if rel, err := filepath.Rel(gitdir, name); err == nil && !strings.HasPrefix(rel, "..") {
+		name = filepath.ToSlash(rel)
+	}
+	switch {
+	case name == "index":
+		return "the index"
+	case name == "packed-refs":
+		return "packed references"
+	case name == "objects/info/commit-graph":
+		return "the commit-graph"
+	case name == "reftable/tables.list":
+		return "reftable references"
+	case name == "HEAD" || strings.HasPrefix(name, "refs/"):
+		return "reference " + name
+	}
+	return name
+}
+
+// lockHolders returns the processes that have the file open. Nil is
+// returned if open files of processes cannot be listed.
+func lockHolders(path string) []int {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	self := os.Getpid()
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		fds, err := ioutil.ReadDir(filepath.Join("/proc", p.Name(), "fd"))
+		if err != nil {
+			// Processes of other users cannot be looked at.
+			continue
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join("/proc", p.Name(), "fd", fd.Name())); err == nil && target == abs {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
+
+func joinPids(pids []int) string {
+	s := make([]string, len(pids))
+	for i, pid := range pids {
+		s[i] = strconv.Itoa(pid)
+	}
+	return strings.Join(s, ", ")
+}
+
+// FindLocks returns all lock files in the git directory, sorted by path.
+// Pack files and loose objects are not looked at, because they are never
+// locked.
+func (r *Repository) FindLocks() ([]*lockError, error) {
+	var locks []*lockError
+	err := filepath.Walk(r.gitdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if rel, _ := filepath.Rel(r.gitdir, path); rel == "objects" {
+				// Only objects/info has lock files.
+				return r.findLocksIn(filepath.Join(path, "info"), &locks)
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".lock") {
+			l, err := inspectLock(r.gitdir, path)
+			if err != nil {
+				return nil
+			}
+			locks = append(locks, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Path < locks[j].Path })
+	return locks, nil
+}
+
+// findLocksIn adds lock files directly in the directory and skips the
+// directory that contains it in the walk.
+func (r *Repository) findLocksIn(dir string, locks *[]*lockError) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".lock") {
+			if l, err := inspectLock(r.gitdir, filepath.Join(dir, e.Name())); err == nil {
+				*locks = append(*locks, l)
+			}
+		}
+	}
+	return filepath.SkipDir
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFindLocks(t *testing.T) {
+	repo := newTestRepository(t)
+
+	old := time.Now().Add(-time.Hour)
+	cases := map[string]struct {
+		modTime time.Time
+		what    string
+		stale   bool
+	}{
+		"index.lock":                     {modTime: time.Now(), what: "the index"},
+		"refs/heads/main.lock":           {modTime: old, what: "reference refs/heads/main", stale: true},
+		"objects/info/commit-graph.lock": {modTime: old, what: "the commit-graph", stale: true},
+	}
+	for name, tc := range cases {
+		path := filepath.Join(repo.gitdir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("write lock: %s", err)
+		}
+		if err := os.Chtimes(path, tc.modTime, tc.modTime); err != nil {
+			t.Fatalf("chtimes: %s", err)
+		}
+	}
+	// Not a lock of the repository.
+	if err := ioutil.WriteFile(filepath.Join(repo.gitdir, "objects", "loose.lock"), nil, 0644); err != nil {
+		t.Fatalf("write file: %s", err)
+	}
+
+	locks, err := repo.FindLocks()
+	if err != nil {
+		t.Fatalf("find locks: %s", err)
+	}
+	if len(locks) != len(cases) {
+		t.Fatalf("want %d locks, got %+v", len(cases), locks)
+	}
+	for _, l := range locks {
+		rel, _ := filepath.Rel(repo.gitdir, l.Path)
+		tc, ok := cases[filepath.ToSlash(rel)]
+		if !ok {
+			t.Fatalf("unexpected lock %s", l.Path)
+		}
+		if l.What != tc.what || l.Stale != tc.stale {
+			t.Errorf("%s: want %q stale %v, got %q stale %v", rel, tc.what, tc.stale, l.What, l.Stale)
+		}
+	}
+
+	// Writing a locked file reports the lock.
+	err = repo.WriteIndex(&Index{})
+	var lockErr *lockError
+	if !errors.As(err, &lockErr) || lockErr.What != "the index" || lockErr.Stale {
+		t.Fatalf("want lock error of the index, got %v", err)
+	}
+	if !errors.Is(err, os.ErrExist) {
+		t.Fatalf("want lock error to match os.ErrExist")
+	}
+}
+
+func TestLockOwner(t *testing.T) {
+	repo := newTestRepository(t)
+	lock := filepath.Join(repo.gitdir, "packed-refs.lock")
+
+	// A lock of a running process is not stale however old it is, also
+	// once the lock file is closed.
+	fd, err := createLock(repo.gitdir, lock)
+	if err != nil {
+		t.Fatalf("create lock: %s", err)
+	}
+	fd.Close()
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	l, err := inspectLock(repo.gitdir, lock)
+	if err != nil {
+		t.Fatalf("inspect lock: %s", err)
+	}
+	if l.Stale || len(l.Holders) != 1 || l.Holders[0] != os.Getpid() || l.Owner == nil || l.Owner.Operation != lockOperation {
+		t.Fatalf("want lock held by this process, got %+v", l)
+	}
+	if err := commitLock(lock, filepath.Join(repo.gitdir, "packed-refs")); err != nil {
+		t.Fatalf("commit lock: %s", err)
+	}
+	if _, err := os.Stat(lock + lockOwnerSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want owner file removed, got %v", err)
+	}
+
+	// The lock of a process that exited is stale at once.
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	cases := map[string]struct {
+		owner string
+		stale bool
+	}{
+		"exited":     {owner: fmt.Sprintf("%d %s fetch\n", exited.Process.Pid, hostname(t)), stale: true},
+		"other host": {owner: fmt.Sprintf("%d not-%s fetch\n", exited.Process.Pid, hostname(t))},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if err := ioutil.WriteFile(lock, nil, 0644); err != nil {
+				t.Fatalf("write lock: %s", err)
+			}
+			if err := ioutil.WriteFile(lock+lockOwnerSuffix, []byte(tc.owner), 0644); err != nil {
+				t.Fatalf("write owner: %s", err)
+			}
+			defer releaseLock(lock)
+			l, err := inspectLock(repo.gitdir, lock)
+			if err != nil {
+				t.Fatalf("inspect lock: %s", err)
+			}
+			if l.Stale != tc.stale || l.Owner == nil || l.Owner.Pid != exited.Process.Pid || l.Owner.Operation != "fetch" {
+				t.Fatalf("want stale %v lock of pid %d, got %+v", tc.stale, exited.Process.Pid, l)
+			}
+			if !tc.stale && len(l.Holders) != 1 {
+				t.Fatalf("want the lock held, got %+v", l)
+			}
+		})
+	}
+}
+
+func TestLockIndex(t *testing.T) {
+	repo := newTestRepository(t)
+	other, err := OpenRepository(repo.workdir)
+	if err != nil {
+		t.Fatalf("open repository: %s", err)
+	}
+
+	unlock, err := repo.LockIndex()
+	if err != nil {
+		t.Fatalf("lock index: %s", err)
+	}
+	defer unlock()
+	idx, err := repo.ReadIndex()
+	if err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	// Another writer cannot update the index between reading and writing.
+	var lockErr *lockError
+	if err := other.WriteIndex(&Index{}); !errors.As(err, &lockErr) || len(lockErr.Holders) == 0 {
+		t.Fatalf("want index held by this process, got %v", err)
+	}
+	if err := repo.WriteIndex(idx); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+	for _, path := range []string{"index.lock", "index.lock" + lockOwnerSuffix} {
+		if _, err := os.Stat(filepath.Join(repo.gitdir, path)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("want %s removed, got %v", path, err)
+		}
+	}
+	// The index is not locked anymore.
+	if err := other.WriteIndex(idx); err != nil {
+		t.Fatalf("write index again: %s", err)
+	}
+}
+
+func hostname(t *testing.T) string {
+	t.Helper()
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no host name: %s", err)
+	}
+	return host
+}
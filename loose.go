@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// CorruptObjectError is returned when a stored object exists, but it cannot
+// be read or its content does not match its hash.
+type CorruptObjectError struct {
+	Sha []byte
+	// Path is the file the damaged copy of the object is stored in.
+	Path string
+	Err  error
+}
+
+func (e *CorruptObjectError) Error() string {
+	storage := "loose"
+	if filepath.Ext(e.Path) == ".pack" {
+		storage = "packed"
+	}
+	return fmt.Sprintf("%s object %x (stored in %s) is corrupt: %s", storage, e.Sha, e.Path, e.Err)
+}
+
+func (e *CorruptObjectError) Unwrap() error {
+	return e.Err
+}
+
+// readLooseObject reads the loose object file at path, which must contain
+// the object with given hash. An error wrapping os.ErrNotExist is returned
+// if there is no such file, and a *CorruptObjectError if the file is
+// truncated, is not a valid zlib stream or has content of another object.
+func readLooseObject(path string, sha []byte) (string, []byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fd.Close()
+
+	corrupt := func(format string, args ...interface{}) error {
+		return &CorruptObjectError{Sha: sha, Path: path, Err: fmt.Errorf(format, args...)}
+	}
+
+	zrd, err := zlib.NewReader(fd)
+	if err != nil {
+		return "", nil, corrupt("inflate: %w", err)
+	}
+	defer zrd.Close()
+	rd := bufio.NewReader(zrd)
+
+	kind, err := rd.ReadString(' ')
+	if err != nil {
+		return "", nil, corrupt("unable to unpack header: %w", err)
+	}
+	kind = kind[:len(kind)-1]
+	if _, ok := objects[kind]; !ok {
+		return "", nil, corrupt("unknown object kind %q", kind)
+	}
+
+	ssize, err := rd.ReadString(0)
+	if err != nil {
+		return "", nil, corrupt("unable to unpack header: %w", err)
+	}
+	size, err := strconv.Atoi(ssize[:len(ssize)-1])
+	if err != nil || size < 0 {
+		return "", nil, corrupt("invalid object size %q", ssize[:len(ssize)-1])
+	}
+
+	content, err := ioutil.ReadAll(rd)
+	if err != nil {
+		// A truncated file ends the stream before the zlib checksum.
+		var invalid flate.CorruptInputError
+		if err == io.ErrUnexpectedEOF || err == zlib.ErrChecksum || errors.As(err, &invalid) {
+			return "", nil, corrupt("inflate: %w", err)
+		}
+		return "", nil, fmt.Errorf("read object content: %w", err)
+	}
+	if size != len(content) {
+		return "", nil, corrupt("bad object length %d != %d", len(content), size)
+	}
+	if got := hashObject(kind, content); !bytes.Equal(got, sha) {
+		return "", nil, corrupt("hash mismatch, content is of %x", got)
+	}
+	return kind, content, nil
+}
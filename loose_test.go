@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadCorruptObject(t *testing.T) {
+	repo := newTestRepository(t)
+	sha, err := repo.WriteObject("blob", []byte("hello\n"))
+	if err != nil {
+		t.Fatalf("write object: %s", err)
+	}
+	other, err := repo.WriteObject("blob", []byte("other\n"))
+	if err != nil {
+		t.Fatalf("write object: %s", err)
+	}
+	path, err := repo.objectPath(sha)
+	if err != nil {
+		t.Fatalf("object path: %s", err)
+	}
+	otherPath, err := repo.objectPath(other)
+	if err != nil {
+		t.Fatalf("object path: %s", err)
+	}
+	good, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read object file: %s", err)
+	}
+	swapped, err := ioutil.ReadFile(otherPath)
+	if err != nil {
+		t.Fatalf("read object file: %s", err)
+	}
+
+	cases := map[string][]byte{
+		"truncated":      good[:len(good)-6],
+		"invalid header": []byte("xx"),
+		"empty":          nil,
+		"hash mismatch":  swapped,
+	}
+	for testName, content := range cases {
+		t.Run(testName, func(t *testing.T) {
+			os.Remove(path)
+			if err := ioutil.WriteFile(path, content, 0644); err != nil {
+				t.Fatalf("write object file: %s", err)
+			}
+			_, _, err := repo.ReadRawObject(sha)
+			var ce *CorruptObjectError
+			if !errors.As(err, &ce) {
+				t.Fatalf("want a corrupt object error, got %v", err)
+			}
+			if ce.Path != path {
+				t.Fatalf("want corrupt copy %q, got %q", path, ce.Path)
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				t.Fatal("corrupt object reported as missing")
+			}
+		})
+	}
+
+	// A valid copy in an alternate object directory is used instead.
+	altDir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(altDir)
+	alt, err := CreateRepository(altDir)
+	if err != nil {
+		t.Fatalf("create repository: %s", err)
+	}
+	if _, err := alt.WriteObject("blob", []byte("hello\n")); err != nil {
+		t.Fatalf("write object: %s", err)
+	}
+	repo.alternates = append(repo.alternates, alt.objdir)
+	kind, content, err := repo.ReadRawObject(sha)
+	if err != nil {
+		t.Fatalf("read object with an alternate copy: %s", err)
+	}
+	if kind != "blob" || string(content) != "hello\n" {
+		t.Fatalf("unexpected object %s %q", kind, content)
+	}
+
+	if err := os.Remove(otherPath); err != nil {
+		t.Fatalf("remove object: %s", err)
+	}
+	if _, _, err := repo.ReadRawObject(other); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want missing object, got %v", err)
+	}
+}
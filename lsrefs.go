@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Client and server of the ls-refs command of protocol version 2, which
+// lists only references with requested prefixes instead of advertising all
+// of them.
+
+// RefPrefixTransport is implemented by transports that can list only some of
+// the remote references.
+type RefPrefixTransport interface {
+	// SetRefPrefixes limits references returned by ListRefs to the ones
+	// with a name starting with one of the prefixes. HEAD is always
+	// listed. It must be called before ListRefs.
+	SetRefPrefixes(prefixes []string)
+}
+
+// refPrefixes returns the prefixes of remote references that fetching with
+// the refspecs needs, the same way git computes them. Objects requested by
+// their hash need no reference.
+func refPrefixes(refspecs []*Refspec) []string {
+	var prefixes []string
+	seen := make(map[string]bool)
+	for _, spec := range refspecs {
+		prefix := spec.Src
+		if spec.IsPattern() {
+			prefix = prefix[:strings.IndexByte(prefix, '*')]
+		} else if _, err := hex.DecodeString(prefix); err == nil && len(prefix) == 40 {
+			continue
+		}
+		if prefix != "" && !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// hasRefPrefix tells whether the reference name starts with one of the
+// prefixes. Any name matches if there are no prefixes.
+func hasRefPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLsRefsRequest writes an ls-refs command asking for references with
+// the prefixes, or for all of them if there are none, and for the targets
+// of symbolic references.
+func writeLsRefsRequest(w io.Writer, prefixes []string) error {
+	var b bytes.Buffer
+	writePktLine(&b, "command=ls-refs\n")
+	writePktLine(&b, "agent=gogit\n")
+	writeDelimPkt(&b)
+	writePktLine(&b, "symrefs\n")
+	if len(prefixes) != 0 {
+		writePktLine(&b, "ref-prefix HEAD\n")
+	}
+	for _, prefix := range prefixes {
+		writePktLine(&b, "ref-prefix %s\n", prefix)
+	}
+	writeFlushPkt(&b)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("send ls-refs request: %w", err)
+	}
+	return nil
+}
+
+// readLsRefsResponse reads the references listed by ls-refs. An unborn HEAD
+// is not a reference and is left out.
+func readLsRefsResponse(r io.Reader) ([]*Ref, error) {
+	var refs []*Ref
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, fmt.Errorf("read ls-refs response: %w", err)
+		}
+		if line == nil {
+			return refs, nil
+		}
+		if bytes.HasPrefix(line, []byte("ERR ")) {
+			return nil, fmt.Errorf("remote error: %s", bytes.TrimSpace(line[4:]))
+		}
+		chunks := strings.Split(strings.TrimSuffix(string(line), "\n"), " ")
+		if len(chunks) < 2 {
+			return nil, fmt.Errorf("invalid ls-refs line %q", line)
+		}
+		if chunks[0] == "unborn" {
+			continue
+		}
+		sha, err := hex.DecodeString(chunks[0])
+		if err != nil || len(sha) != 20 {
+			return nil, fmt.Errorf("invalid ls-refs %q hash", chunks[1])
+		}
+		ref := &Ref{Name: chunks[1], Sha: sha}
+		for _, attr := range chunks[2:] {
+			if strings.HasPrefix(attr, "symref-target:") {
+				ref.Target = strings.TrimPrefix(attr, "symref-target:")
+			}
+		}
+		refs = append(refs, ref)
+	}
+}
+
+// serveLsRefs answers arguments of an ls-refs command with the references
+// upload-pack advertises.
+func (r *Repository) serveLsRefs(rd io.Reader, w io.Writer) error {
+	var (
+		symrefs, peel bool
+		prefixes      []string
+	)
+	for {
+		line, err := readPktLine(rd)
+		if err != nil {
+			return fmt.Errorf("read ls-refs arguments: %w", err)
+		}
+		if line == nil {
+			break
+		}
+		arg := strings.TrimSuffix(string(line), "\n")
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case arg == "unborn":
+			// Unborn HEAD is never advertised.
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		default:
+			return fmt.Errorf("ls-refs: unexpected line: '%s'", arg)
+		}
+	}
+	refs, err := r.uploadPackRefs()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, ref := range refs {
+		if !hasRefPrefix(ref.Name, prefixes) {
+			continue
+		}
+		line := fmt.Sprintf("%x %s", ref.Sha, ref.Name)
+		if symrefs && ref.Target != "" {
+			line += " symref-target:" + ref.Target
+		}
+		if peel && strings.HasPrefix(ref.Name, "refs/tags/") {
+			if kind, _, err := r.ReadRawObject(ref.Sha); err == nil && kind == "tag" {
+				if peeled, err := r.peelObject(ref.Sha, "commit"); err == nil {
+					line += fmt.Sprintf(" peeled:%x", peeled)
+				}
+			}
+		}
+		writePktLine(bw, "%s\n", line)
+	}
+	writeFlushPkt(bw)
+	return bw.Flush()
+}
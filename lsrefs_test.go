@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRefPrefixes(t *testing.T) {
+	cases := map[string]struct {
+		refspecs []string
+		want     []string
+	}{
+		"patterns": {
+			refspecs: []string{"+refs/heads/*:refs/remotes/origin/*", "refs/tags/*:refs/tags/*"},
+			want:     []string{"refs/heads/", "refs/tags/"},
+		},
+		"single branch": {
+			refspecs: []string{"refs/heads/main:refs/remotes/origin/main"},
+			want:     []string{"refs/heads/main"},
+		},
+		"duplicates": {
+			refspecs: []string{"refs/heads/*:refs/remotes/a/*", "refs/heads/*:refs/remotes/b/*"},
+			want:     []string{"refs/heads/"},
+		},
+		"hash": {
+			refspecs: []string{"0123456789abcdef0123456789abcdef01234567:refs/heads/x"},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			specs, err := parseRefspecs(tc.refspecs, false)
+			if err != nil {
+				t.Fatalf("parse refspecs: %s", err)
+			}
+			if got := refPrefixes(specs); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestServeLsRefs(t *testing.T) {
+	repo := newTestRepository(t)
+	commit := writeTestCommit(t, repo, "first")
+	for _, name := range []string{"refs/heads/master", "refs/heads/topic", "refs/tags/v1", "refs/notes/commits"} {
+		if err := repo.UpdateRefs(&RefUpdate{Name: name, Sha: commit}); err != nil {
+			t.Fatalf("update %s: %s", name, err)
+		}
+	}
+
+	cases := map[string]struct {
+		prefixes []string
+		want     []string
+	}{
+		"all":      {want: []string{"HEAD -> refs/heads/master", "refs/heads/master", "refs/heads/topic", "refs/notes/commits", "refs/tags/v1"}},
+		"branches": {prefixes: []string{"refs/heads/"}, want: []string{"HEAD -> refs/heads/master", "refs/heads/master", "refs/heads/topic"}},
+		"single":   {prefixes: []string{"refs/heads/topic", "refs/tags/"}, want: []string{"HEAD -> refs/heads/master", "refs/heads/topic", "refs/tags/v1"}},
+		"none":     {prefixes: []string{"refs/pull/"}, want: []string{"HEAD -> refs/heads/master"}},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var request, response bytes.Buffer
+			if err := writeLsRefsRequest(&request, tc.prefixes); err != nil {
+				t.Fatalf("write request: %s", err)
+			}
+			if err := repo.serveV2Command(&request, &response); err != nil {
+				t.Fatalf("serve: %s", err)
+			}
+			refs, err := readLsRefsResponse(&response)
+			if err != nil {
+				t.Fatalf("read response: %s", err)
+			}
+			var got []string
+			for _, ref := range refs {
+				if !bytes.Equal(ref.Sha, commit) {
+					t.Errorf("%s: want %x, got %x", ref.Name, commit, ref.Sha)
+				}
+				name := ref.Name
+				if ref.Target != "" {
+					name += " -> " + ref.Target
+				}
+				got = append(got, name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want:\n%s\ngot:\n%s", strings.Join(tc.want, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -17,30 +18,84 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Run '%s <command> -help' to learn more about each command.\n", os.Args[0])
 		os.Exit(2)
 	}
-	run, ok := commands[os.Args[1]]
+	// Skip first two arguments. Second argument is the command name, or an
+	// alias of one.
+	config := commandConfig()
+	run, args, ok := lookupCommand(config, os.Args[1], os.Args[2:])
 	if !ok {
-		fmt.Fprintf(os.Stderr, "Unknown command %q\n", os.Args[1])
-		fmt.Fprintf(os.Stderr, "\nAvailable commands are:\n\t%s\n", strings.Join(availableCmds(), "\n\t"))
-		os.Exit(2)
+		if run, args, ok = correctCommand(config, os.Args[1], os.Args[2:], os.Stdin, os.Stderr); !ok {
+			os.Exit(2)
+		}
 	}
-
-	// Skip first two arguments. Second argument is the command name that
-	// we just consumed.
-	if err := run(os.Stdin, os.Stdout, os.Args[2:]); err != nil {
+	lockOperation += " " + os.Args[1]
+	if err := run(os.Stdin, os.Stdout, args); err != nil {
+		var code exitCode
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// exitCode is returned by commands that fail without printing an error, for
+// example when a looked up value does not exist.
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit status %d", int(c))
+}
+
 var commands = map[string]func(input io.Reader, output io.Writer, args []string) error{
-	"cat-file":    cmdCatFile,
-	"checkout":    cmdCheckout,
-	"hash-object": cmdHashObject,
-	"init":        cmdInit,
-	"log":         cmdLog,
-	"ls-tree":     cmdLsTree,
-	"show-ref":    cmdShowRef,
-	"tag":         cmdTag,
+	"add":              cmdAdd,
+	"analyze":          cmdAnalyze,
+	"archive":          cmdArchive,
+	"branch":           cmdBranch,
+	"cat-file":         cmdCatFile,
+	"check-ref-format": cmdCheckRefFormat,
+	"checkout":         cmdCheckout,
+	"clone":            cmdClone,
+	"commit":           cmdCommit,
+	"commit-graph":     cmdCommitGraph,
+	"config":           cmdConfig,
+	"credential":       cmdCredential,
+	"diff-files":       cmdDiffFiles,
+	"diff-index":       cmdDiffIndex,
+	"diff-tree":        cmdDiffTree,
+	"difftool":         cmdDifftool,
+	"fetch":            cmdFetch,
+	"fsck":             cmdFsck,
+	"gc":               cmdGc,
+	"hash-object":      cmdHashObject,
+	"init":             cmdInit,
+	"log":              cmdLog,
+	"ls-files":         cmdLsFiles,
+	"ls-tree":          cmdLsTree,
+	"merge-base":       cmdMergeBase,
+	"merge-file":       cmdMergeFile,
+	"merge-tree":       cmdMergeTree,
+	"mergetool":        cmdMergetool,
+	"pack-loose":       cmdPackLoose,
+	"prune-packed":     cmdPrunePacked,
+	"push":             cmdPush,
+	"recover":          cmdRecover,
+	"repack":           cmdRepack,
+	"rev-list":         cmdRevList,
+	"rev-parse":        cmdRevParse,
+	"search":           cmdSearch,
+	"show-branch":      cmdShowBranch,
+	"show-ref":         cmdShowRef,
+	"stats":            cmdStats,
+	"status":           cmdStatus,
+	"submodule":        cmdSubmodule,
+	"subtree":          cmdSubtree,
+	"symbolic-ref":     cmdSymbolicRef,
+	"tag":              cmdTag,
+	"ui":               cmdUI,
+	"unlock":           cmdUnlock,
+	"update-index":     cmdUpdateIndex,
+	"verify-commit":    cmdVerifyCommit,
+	"verify-tag":       cmdVerifyTag,
 }
 
 func availableCmds() []string {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// defaultLooseObjectsBatchSize is the number of loose objects packed at most
+// by PackLooseObjects, unless maintenance.loose-objects.batchSize is set.
+const defaultLooseObjectsBatchSize = 50000
+
+// looseObjects calls fn with the hash and the path of every loose object of
+// the object directory. Objects of alternates are not listed.
+func (r *Repository) looseObjects(fn func(sha []byte, path string) error) error {
+	for i := 0; i < 256; i++ {
+		dir := filepath.Join(r.objdir, fmt.Sprintf("%02x", i))
+		entries, err := ioutil.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read objects directory: %w", err)
+		}
+		for _, e := range entries {
+			sha, err := hex.DecodeString(dir[len(dir)-2:] + e.Name())
+			if err != nil || len(sha) != 20 {
+				// Not an object file, for example an object being
+				// written.
+				continue
+			}
+			if err := fn(sha, filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PrunePacked removes loose objects of the object directory that are
+// already stored in a pack of any object directory. Paths of removed files
+// are passed to fn, if it is not nil. Nothing is removed with dryRun.
+func (r *Repository) PrunePacked(dryRun bool, fn func(path string) error) error {
+	if err := r.loadPacks(); err != nil {
+		return fmt.Errorf("load packs: %w", err)
+	}
+	err := r.looseObjects(func(sha []byte, path string) error {
+		packed := false
+		for _, p := range r.packs {
+			if _, ok := p.index.find(sha); ok {
+				packed = true
+				break
+			}
+		}
+		if !packed {
+			return nil
+		}
+		if fn != nil {
+			if err := fn(path); err != nil {
+				return err
+			}
+		}
+		if dryRun {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove packed object: %w", err)
+		}
+		// Fails unless the directory became empty.
+		os.Remove(filepath.Dir(path))
+		return nil
+	})
+	return err
+}
+
+// PackLooseObjects stores up to batchSize loose objects in a new pack, or
+// all of them if batchSize is not positive, and returns the path of the
+// pack. Loose objects that are already packed are removed first. Objects
+// that were packed are not removed, so that processes reading them are not
+// disturbed, but they are removed by the next run. An empty path is
+// returned if there are no objects to pack.
+func (r *Repository) PackLooseObjects(batchSize int) (string, error) {
+	if err := r.PrunePacked(false, nil); err != nil {
+		return "", err
+	}
+	var shas [][]byte
+	errBatchFull := errors.New("batch is full")
+	err := r.looseObjects(func(sha []byte, path string) error {
+		if batchSize > 0 && len(shas) == batchSize {
+			return errBatchFull
+		}
+		shas = append(shas, sha)
+		return nil
+	})
+	if err != nil && err != errBatchFull {
+		return "", err
+	}
+	if len(shas) == 0 {
+		return "", nil
+	}
+	return r.writePack(shas)
+}
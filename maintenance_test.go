@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPackLooseObjects(t *testing.T) {
+	repo := newTestRepository(t)
+
+	var shas [][]byte
+	for i := 0; i < 10; i++ {
+		sha, err := repo.WriteObject("blob", []byte(fmt.Sprintf("blob %d\n", i)))
+		if err != nil {
+			t.Fatalf("write object: %s", err)
+		}
+		shas = append(shas, sha)
+	}
+	countLoose := func() int {
+		n := 0
+		if err := repo.looseObjects(func([]byte, string) error { n++; return nil }); err != nil {
+			t.Fatalf("list loose objects: %s", err)
+		}
+		return n
+	}
+
+	first, err := repo.PackLooseObjects(4)
+	if err != nil {
+		t.Fatalf("pack loose objects: %s", err)
+	}
+	if first == "" {
+		t.Fatal("no pack written")
+	}
+	// Packed objects are removed only by the next run.
+	if n := countLoose(); n != 10 {
+		t.Fatalf("want 10 loose objects, got %d", n)
+	}
+	if _, err := repo.PackLooseObjects(0); err != nil {
+		t.Fatalf("pack loose objects: %s", err)
+	}
+	if n := countLoose(); n != 6 {
+		t.Fatalf("want 6 loose objects, got %d", n)
+	}
+	if err := repo.PrunePacked(false, nil); err != nil {
+		t.Fatalf("prune packed: %s", err)
+	}
+	if n := countLoose(); n != 0 {
+		t.Fatalf("want no loose objects, got %d", n)
+	}
+	if pack, err := repo.PackLooseObjects(0); err != nil || pack != "" {
+		t.Fatalf("want nothing to pack, got %q (%v)", pack, err)
+	}
+
+	for i, sha := range shas {
+		ok, err := repo.HasObject(sha)
+		if err != nil || !ok {
+			t.Fatalf("packed object %x not found: %v", sha, err)
+		}
+		kind, content, err := repo.ReadRawObject(sha)
+		if err != nil {
+			t.Fatalf("read packed object: %s", err)
+		}
+		if want := fmt.Sprintf("blob %d\n", i); kind != "blob" || string(content) != want {
+			t.Fatalf("want blob %q, got %s %q", want, kind, content)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MergeOptions configures a three-way merge. Zero value is valid.
+type MergeOptions struct {
+	// Labels used in conflict markers. Default to "ours" and "theirs".
+	OursLabel   string
+	TheirsLabel string
+	// Favor, if set, resolves conflicting hunks with the lines of one of
+	// the sides, or of both, instead of writing conflict markers.
+	Favor MergeFavor
+	// MarkerSize is the length of conflict markers, 7 by default.
+	MarkerSize int
+}
+
+// MergeFavor tells how conflicting hunks are resolved.
+type MergeFavor int
+
+const (
+	MergeFavorNone MergeFavor = iota
+	MergeFavorOurs
+	MergeFavorTheirs
+	// MergeFavorUnion keeps the lines of both sides, ours first.
+	MergeFavorUnion
+)
+
+func (o *MergeOptions) withDefaults() MergeOptions {
+	var opts MergeOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.OursLabel == "" {
+		opts.OursLabel = "ours"
+	}
+	if opts.TheirsLabel == "" {
+		opts.TheirsLabel = "theirs"
+	}
+	if opts.MarkerSize <= 0 {
+		opts.MarkerSize = 7
+	}
+	return opts
+}
+
+// MergeConflict describes a path that could not be merged cleanly. Leafs
+// that do not exist on a given side are nil.
+type MergeConflict struct {
+	Path   string
+	Kind   string // content, add/add, modify/delete, file/directory, mode, binary or submodule
+	Base   *TreeLeaf
+	Ours   *TreeLeaf
+	Theirs *TreeLeaf
+}
+
+// MergeResult is the outcome of a tree merge.
+type MergeResult struct {
+	// Tree is the hash of the merged tree. Conflicting files are present
+	// in the tree with conflict markers.
+	Tree      []byte
+	Conflicts []*MergeConflict
+}
+
+// MergeTrees performs a three-way merge of ours and theirs trees, using base
+// as the common ancestor. Base can be nil if there is no common ancestor.
+// Merged blobs and trees are written to the object store, but neither the
+// index nor the worktree is touched.
+func (r *Repository) MergeTrees(base, ours, theirs []byte, opts *MergeOptions) (*MergeResult, error) {
+	m := treeMerger{repo: r, opts: opts.withDefaults()}
+	var trees [3]*TreeObject
+	for i, sha := range [][]byte{base, ours, theirs} {
+		if sha == nil {
+			trees[i] = &TreeObject{}
+			continue
+		}
+		tr, err := r.readTree(sha)
+		if err != nil {
+			return nil, fmt.Errorf("read tree %x: %w", sha, err)
+		}
+		trees[i] = tr
+	}
+	sha, err := m.mergeTrees("", trees[0], trees[1], trees[2])
+	if err != nil {
+		return nil, err
+	}
+	if sha == nil {
+		// Everything was removed.
+		if sha, err = r.WriteObject("tree", nil); err != nil {
+			return nil, fmt.Errorf("write empty tree: %w", err)
+		}
+	}
+	return &MergeResult{Tree: sha, Conflicts: m.conflicts}, nil
+}
+
+// MergeCommits merges the trees of two commits, using their merge base as
+// the common ancestor. Same as in git, several merge bases are merged
+// together first, and the result, conflict markers included, is used as
+// the ancestor.
+func (r *Repository) MergeCommits(ours, theirs []byte, opts *MergeOptions) (*MergeResult, error) {
+	base, err := r.mergeBaseTree([][]byte{ours}, [][]byte{theirs})
+	if err != nil {
+		return nil, err
+	}
+	oursTree, err := r.peelObject(ours, "tree")
+	if err != nil {
+		return nil, err
+	}
+	theirsTree, err := r.peelObject(theirs, "tree")
+	if err != nil {
+		return nil, err
+	}
+	return r.MergeTrees(base, oursTree, theirsTree, opts)
+}
+
+// mergeBaseTree returns the tree of the merge base of two commits having
+// the sets of commits as parents, or nil if they have no common ancestor.
+//
+// Several merge bases are merged one by one into a virtual commit, the same
+// as git does. The virtual commit is only needed to find the ancestor of
+// the next merge, which is the merge base of its parents, the bases merged
+// so far, and the next one, so that it is never written.
+func (r *Repository) mergeBaseTree(a, b [][]byte) ([]byte, error) {
+	bases, err := r.mergeBasesOf(a, b)
+	if err != nil || len(bases) == 0 {
+		return nil, err
+	}
+	tree, err := r.peelObject(bases[0], "tree")
+	if err != nil {
+		return nil, err
+	}
+	opts := &MergeOptions{OursLabel: "Temporary merge branch 1", TheirsLabel: "Temporary merge branch 2"}
+	for i, next := range bases[1:] {
+		ancestor, err := r.mergeBaseTree(bases[:i+1], [][]byte{next})
+		if err != nil {
+			return nil, err
+		}
+		nextTree, err := r.peelObject(next, "tree")
+		if err != nil {
+			return nil, err
+		}
+		res, err := r.MergeTrees(ancestor, tree, nextTree, opts)
+		if err != nil {
+			return nil, fmt.Errorf("merge bases: %w", err)
+		}
+		tree = res.Tree
+	}
+	return tree, nil
+}
+
+type treeMerger struct {
+	repo      *Repository
+	opts      MergeOptions
+	conflicts []*MergeConflict
+}
+
+func sameLeaf(a, b *TreeLeaf) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Mode == b.Mode && bytes.Equal(a.Sha, b.Sha)
+}
+
+func leafsByName(tr *TreeObject) map[string]*TreeLeaf {
+	leafs := make(map[string]*TreeLeaf)
+	if tr != nil {
+		for _, l := range tr.Leafs {
+			leafs[l.Path] = l
+		}
+	}
+	return leafs
+}
+
+// mergeTrees returns the hash of the merged tree or nil if the result is
+// empty.
+func (m *treeMerger) mergeTrees(prefix string, base, ours, theirs *TreeObject) ([]byte, error) {
+	b, o, t := leafsByName(base), leafsByName(ours), leafsByName(theirs)
+	names := make(map[string]struct{})
+	for _, side := range []map[string]*TreeLeaf{b, o, t} {
+		for name := range side {
+			names[name] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var result TreeObject
+	for _, name := range sorted {
+		leafs, err := m.mergeEntry(prefix+name, b[name], o[name], t[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", prefix+name, err)
+		}
+		result.Leafs = append(result.Leafs, leafs...)
+	}
+	if len(result.Leafs) == 0 {
+		return nil, nil
+	}
+	sortTreeLeafs(result.Leafs)
+	raw, err := result.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("serialize tree: %w", err)
+	}
+	return m.repo.WriteObject("tree", raw)
+}
+
+func (m *treeMerger) conflict(kind, path string, base, ours, theirs *TreeLeaf) {
+	m.conflicts = append(m.conflicts, &MergeConflict{
+		Path:   path,
+		Kind:   kind,
+		Base:   base,
+		Ours:   ours,
+		Theirs: theirs,
+	})
+}
+
+// mergeEntry merges a single tree entry and returns leafs that should be
+// present in the result tree under the entry name.
+func (m *treeMerger) mergeEntry(path string, base, ours, theirs *TreeLeaf) ([]*TreeLeaf, error) {
+	name := path[strings.LastIndexByte(path, '/')+1:]
+	keep := func(l *TreeLeaf) []*TreeLeaf {
+		if l == nil {
+			return nil
+		}
+		return []*TreeLeaf{{Mode: l.Mode, Path: name, Sha: l.Sha}}
+	}
+
+	switch {
+	case sameLeaf(ours, theirs):
+		return keep(ours), nil
+	case sameLeaf(base, ours):
+		return keep(theirs), nil
+	case sameLeaf(base, theirs):
+		return keep(ours), nil
+	}
+
+	isTree := func(l *TreeLeaf) bool { return l != nil && l.Mode == modeTree }
+
+	// Both sides changed the entry in a different way.
+	switch {
+	case (isTree(ours) || ours == nil) && (isTree(theirs) || theirs == nil) && (isTree(base) || base == nil):
+		// Directory removed on one side is merged as an empty
+		// directory, so that only files modified on the other side
+		// are conflicting.
+		var trees [3]*TreeObject
+		for i, l := range []*TreeLeaf{base, ours, theirs} {
+			if l == nil {
+				continue
+			}
+			tr, err := m.repo.readTree(l.Sha)
+			if err != nil {
+				return nil, err
+			}
+			trees[i] = tr
+		}
+		sha, err := m.mergeTrees(path+"/", trees[0], trees[1], trees[2])
+		if err != nil || sha == nil {
+			return nil, err
+		}
+		return []*TreeLeaf{{Mode: modeTree, Path: name, Sha: sha}}, nil
+	case ours == nil || theirs == nil:
+		m.conflict("modify/delete", path, base, ours, theirs)
+		if ours != nil {
+			return keep(ours), nil
+		}
+		return keep(theirs), nil
+	case ours.Mode == modeTree || theirs.Mode == modeTree:
+		// Directory stays in place, the file is moved aside.
+		dir, file, label := ours, theirs, m.opts.TheirsLabel
+		if theirs.Mode == modeTree {
+			dir, file, label = theirs, ours, m.opts.OursLabel
+		}
+		dirSha := dir.Sha
+		if isTree(base) {
+			// The side of the file removed the directory, which
+			// conflicts with files modified on the other side.
+			var trees [3]*TreeObject
+			for i, l := range []*TreeLeaf{base, ours, theirs} {
+				if l == file {
+					continue
+				}
+				tr, err := m.repo.readTree(l.Sha)
+				if err != nil {
+					return nil, err
+				}
+				trees[i] = tr
+			}
+			sha, err := m.mergeTrees(path+"/", trees[0], trees[1], trees[2])
+			if err != nil {
+				return nil, err
+			}
+			if sha == nil {
+				return keep(file), nil
+			}
+			dirSha = sha
+		}
+		m.conflict("file/directory", path, base, ours, theirs)
+		return []*TreeLeaf{
+			{Mode: dir.Mode, Path: name, Sha: dirSha},
+			{Mode: file.Mode, Path: name + "~" + label, Sha: file.Sha},
+		}, nil
+	case ours.Mode == modeGitlink || theirs.Mode == modeGitlink:
+		m.conflict("submodule", path, base, ours, theirs)
+		return keep(ours), nil
+	case ours.Mode == modeSymlink || theirs.Mode == modeSymlink:
+		if !bytes.Equal(ours.Sha, theirs.Sha) {
+			m.conflict("content", path, base, ours, theirs)
+			return keep(ours), nil
+		}
+	}
+
+	mode := ours.Mode
+	if ours.Mode != theirs.Mode {
+		switch {
+		case base != nil && base.Mode == ours.Mode:
+			mode = theirs.Mode
+		case base != nil && base.Mode == theirs.Mode:
+			mode = ours.Mode
+		default:
+			m.conflict("mode", path, base, ours, theirs)
+		}
+	}
+	if bytes.Equal(ours.Sha, theirs.Sha) {
+		return []*TreeLeaf{{Mode: mode, Path: name, Sha: ours.Sha}}, nil
+	}
+
+	var content [3][]byte
+	for i, l := range []*TreeLeaf{base, ours, theirs} {
+		if l == nil || l.Mode == modeTree {
+			continue
+		}
+		data, err := m.readBlob(l.Sha)
+		if err != nil {
+			return nil, err
+		}
+		content[i] = data
+	}
+	if isBinary(content[0]) || isBinary(content[1]) || isBinary(content[2]) {
+		m.conflict("binary", path, base, ours, theirs)
+		return []*TreeLeaf{{Mode: mode, Path: name, Sha: ours.Sha}}, nil
+	}
+	merged, conflicts := merge3(content[0], content[1], content[2], &m.opts)
+	if conflicts != 0 {
+		kind := "content"
+		if base == nil {
+			kind = "add/add"
+		}
+		m.conflict(kind, path, base, ours, theirs)
+	}
+	sha, err := m.repo.WriteObject("blob", merged)
+	if err != nil {
+		return nil, fmt.Errorf("write merged blob: %w", err)
+	}
+	return []*TreeLeaf{{Mode: mode, Path: name, Sha: sha}}, nil
+}
+
+func (m *treeMerger) readBlob(sha []byte) ([]byte, error) {
+	obj, err := m.repo.ReadObject(sha)
+	if err != nil {
+		return nil, fmt.Errorf("read blob %s: %w", hex.EncodeToString(sha), err)
+	}
+	blob, ok := obj.(*BlobObject)
+	if !ok {
+		return nil, fmt.Errorf("%x is not a blob object: %T", sha, obj)
+	}
+	return blob.Data, nil
+}
+
+// merge3 performs a line based three-way merge and returns the merged
+// content together with the number of conflicting hunks. Conflicts are
+// written using the conventional conflict markers. Same as in git,
+// conflicts separated by at most three unchanged lines are shown as a
+// single one.
+func merge3(base, ours, theirs []byte, opts *MergeOptions) ([]byte, int) {
+	o := opts.withDefaults()
+	b, x, y := splitLines(base), splitLines(ours), splitLines(theirs)
+	mx, my := diffMatches(b, x), diffMatches(b, y)
+
+	// Merged lines are kept as the ours side of chunks that are not
+	// conflicts.
+	type chunk struct {
+		ours, theirs []string
+		conflict     bool
+	}
+	var (
+		chunks  []*chunk
+		i, j, k int
+	)
+	for {
+		// Copy lines that are the same in all three versions.
+		start := i
+		for i < len(b) && mx[i] == j && my[i] == k {
+			i, j, k = i+1, j+1, k+1
+		}
+		if i != start {
+			chunks = append(chunks, &chunk{ours: b[start:i]})
+		}
+		// Find the end of the unstable chunk, which is the next base line
+		// matched by both sides.
+		ni := i
+		for ni < len(b) && (mx[ni] == -1 || my[ni] == -1) {
+			ni++
+		}
+		nj, nk := len(x), len(y)
+		if ni < len(b) {
+			nj, nk = mx[ni], my[ni]
+		}
+		if ni == i && nj == j && nk == k {
+			break
+		}
+		cb, cx, cy := b[i:ni], x[j:nj], y[k:nk]
+		switch {
+		case equalLines(cx, cb):
+			chunks = append(chunks, &chunk{ours: cy})
+		case equalLines(cy, cb), equalLines(cx, cy):
+			chunks = append(chunks, &chunk{ours: cx})
+		default:
+			n := len(chunks)
+			if n >= 2 && chunks[n-2].conflict && len(chunks[n-1].ours) <= 3 {
+				prev, gap := chunks[n-2], chunks[n-1].ours
+				prev.ours = append(append(prev.ours, gap...), cx...)
+				prev.theirs = append(append(prev.theirs, gap...), cy...)
+				chunks = chunks[:n-1]
+			} else {
+				chunks = append(chunks, &chunk{
+					ours:     append([]string(nil), cx...),
+					theirs:   append([]string(nil), cy...),
+					conflict: true,
+				})
+			}
+		}
+		i, j, k = ni, nj, nk
+	}
+
+	var (
+		out       bytes.Buffer
+		conflicts int
+	)
+	writeLines := func(lines []string) {
+		for _, l := range lines {
+			out.WriteString(l)
+		}
+	}
+	terminate := func() {
+		if out.Len() != 0 && out.Bytes()[out.Len()-1] != '\n' {
+			out.WriteByte('\n')
+		}
+	}
+	for _, c := range chunks {
+		switch {
+		case !c.conflict, o.Favor == MergeFavorOurs:
+			writeLines(c.ours)
+		case o.Favor == MergeFavorTheirs:
+			writeLines(c.theirs)
+		case o.Favor == MergeFavorUnion:
+			writeLines(c.ours)
+			if len(c.theirs) != 0 {
+				terminate()
+			}
+			writeLines(c.theirs)
+		default:
+			conflicts++
+			marker := func(c byte, label string) {
+				terminate()
+				out.WriteString(strings.Repeat(string(c), o.MarkerSize))
+				if label != "" {
+					out.WriteString(" " + label)
+				}
+				out.WriteByte('\n')
+			}
+			marker('<', o.OursLabel)
+			writeLines(c.ours)
+			marker('=', "")
+			writeLines(c.theirs)
+			marker('>', o.TheirsLabel)
+		}
+	}
+	return out.Bytes(), conflicts
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
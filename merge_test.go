@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	cases := map[string]struct {
+		base, ours, theirs string
+		opts               *MergeOptions
+		want               string
+		wantConflicts      int
+	}{
+		"no changes": {
+			base:   "a\nb\nc\n",
+			ours:   "a\nb\nc\n",
+			theirs: "a\nb\nc\n",
+			want:   "a\nb\nc\n",
+		},
+		"changes on one side": {
+			base:   "a\nb\nc\n",
+			ours:   "a\nB\nc\n",
+			theirs: "a\nb\nc\n",
+			want:   "a\nB\nc\n",
+		},
+		"non overlapping changes": {
+			base:   "a\nb\nc\nd\ne\n",
+			ours:   "A\nb\nc\nd\ne\n",
+			theirs: "a\nb\nc\nd\nE\n",
+			want:   "A\nb\nc\nd\nE\n",
+		},
+		"same change on both sides": {
+			base:   "a\nb\nc\n",
+			ours:   "a\nX\nc\n",
+			theirs: "a\nX\nc\n",
+			want:   "a\nX\nc\n",
+		},
+		"insertions at different places": {
+			base:   "a\nb\nc\n",
+			ours:   "a\nx\nb\nc\n",
+			theirs: "a\nb\nc\ny\n",
+			want:   "a\nx\nb\nc\ny\n",
+		},
+		"conflict": {
+			base:          "a\nb\nc\n",
+			ours:          "a\nX\nc\n",
+			theirs:        "a\nY\nc\n",
+			want:          "a\n<<<<<<< ours\nX\n=======\nY\n>>>>>>> theirs\nc\n",
+			wantConflicts: 1,
+		},
+		"conflict without trailing new line": {
+			base:          "a",
+			ours:          "b",
+			theirs:        "c",
+			want:          "<<<<<<< ours\nb\n=======\nc\n>>>>>>> theirs\n",
+			wantConflicts: 1,
+		},
+		"add/add without base": {
+			base:          "",
+			ours:          "a\n",
+			theirs:        "b\n",
+			want:          "<<<<<<< ours\na\n=======\nb\n>>>>>>> theirs\n",
+			wantConflicts: 1,
+		},
+		"close conflicts are joined": {
+			base:          "a\nb\nc\nd\n",
+			ours:          "a\nB1\nc\nD1\n",
+			theirs:        "a\nB2\nc\nD2\n",
+			want:          "a\n<<<<<<< ours\nB1\nc\nD1\n=======\nB2\nc\nD2\n>>>>>>> theirs\n",
+			wantConflicts: 1,
+		},
+		"distant conflicts": {
+			base:          "a\nb\nc\nd\ne\nf\ng\n",
+			ours:          "a\nX\nc\nd\ne\nf\nF\n",
+			theirs:        "a\nY\nc\nd\ne\nf\nG\n",
+			want:          "a\n<<<<<<< ours\nX\n=======\nY\n>>>>>>> theirs\nc\nd\ne\nf\n<<<<<<< ours\nF\n=======\nG\n>>>>>>> theirs\n",
+			wantConflicts: 2,
+		},
+		"marker size": {
+			base:          "a\n",
+			ours:          "b\n",
+			theirs:        "c\n",
+			opts:          &MergeOptions{OursLabel: "x", TheirsLabel: "y", MarkerSize: 3},
+			want:          "<<< x\nb\n===\nc\n>>> y\n",
+			wantConflicts: 1,
+		},
+		"favor ours": {
+			base:   "a\nb\nc\n",
+			ours:   "a\nX\nc\n",
+			theirs: "a\nY\nc\n",
+			opts:   &MergeOptions{Favor: MergeFavorOurs},
+			want:   "a\nX\nc\n",
+		},
+		"favor theirs": {
+			base:   "a\nb\nc\n",
+			ours:   "a\nX\nc\n",
+			theirs: "a\nY\nc\n",
+			opts:   &MergeOptions{Favor: MergeFavorTheirs},
+			want:   "a\nY\nc\n",
+		},
+		"union without trailing new line": {
+			base:   "a",
+			ours:   "b",
+			theirs: "c",
+			opts:   &MergeOptions{Favor: MergeFavorUnion},
+			want:   "b\nc",
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, conflicts := merge3([]byte(tc.base), []byte(tc.ours), []byte(tc.theirs), tc.opts)
+			if conflicts != tc.wantConflicts {
+				t.Errorf("want %d conflicts, got %d", tc.wantConflicts, conflicts)
+			}
+			if string(got) != tc.want {
+				t.Logf("want %q", tc.want)
+				t.Fatalf("got  %q", got)
+			}
+		})
+	}
+}
+
+func TestMergeBaseTreeVirtual(t *testing.T) {
+	repo := newTestRepository(t)
+
+	// Commit messages are the content of file.txt. The merges have three
+	// merge bases, x, y and z, where y and z have a closer common ancestor
+	// than the root. Merging z with the first base only, and the root as
+	// the ancestor, conflicts on the last line.
+	root := writeTestCommit(t, repo, "a\nb\nc\nd\ne")
+	x := writeTestCommit(t, repo, "X\nb\nc\nd\ne", root)
+	p := writeTestCommit(t, repo, "a\nb\nc\nd\nP", root)
+	y := writeTestCommit(t, repo, "a\nb\nY\nd\nP", p)
+	z := writeTestCommit(t, repo, "a\nb\nc\nd\nZ", p)
+	ours := writeTestCommit(t, repo, "ours", x, y, z)
+	theirs := writeTestCommit(t, repo, "theirs", z, y, x)
+
+	tree, err := repo.mergeBaseTree([][]byte{ours}, [][]byte{theirs})
+	if err != nil {
+		t.Fatalf("merge base tree: %s", err)
+	}
+	tr, err := repo.readTree(tree)
+	if err != nil {
+		t.Fatalf("read tree: %s", err)
+	}
+	leaf, err := repo.lookupTreePath(tr, "file.txt")
+	if err != nil {
+		t.Fatalf("lookup: %s", err)
+	}
+	_, content, err := repo.ReadRawObject(leaf.Sha)
+	if err != nil {
+		t.Fatalf("read blob: %s", err)
+	}
+	if want := "X\nb\nY\nd\nZ"; string(content) != want {
+		t.Fatalf("want virtual merge base %q, got %q", want, content)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MergeTool is an external program that resolves conflicts, configured as
+// mergetool.<name>.cmd. The command is run by the shell, with the BASE,
+// LOCAL, REMOTE and MERGED variables set to paths of the files.
+type MergeTool struct {
+	Name string
+	Cmd  string
+	// TrustExitCode tells that the exit status of the command tells if the
+	// conflicts were resolved. Otherwise the merged file must be changed.
+	TrustExitCode bool
+}
+
+// mergeTool returns the merge tool of given name, or the one set with
+// merge.tool if name is empty.
+func (r *Repository) mergeTool(name string) (*MergeTool, error) {
+	if name == "" {
+		name, _ = r.config.Get("merge", "", "tool")
+	}
+	if name == "" {
+		return nil, errors.New("no merge tool is configured, set merge.tool or use --tool")
+	}
+	cmd, ok := r.config.Get("mergetool", name, "cmd")
+	if !ok || cmd == "" {
+		return nil, fmt.Errorf("unknown merge tool %s, set mergetool.%s.cmd", name, name)
+	}
+	trust, err := r.config.Bool("mergetool", name, "trustExitCode", false)
+	if err != nil {
+		return nil, err
+	}
+	return &MergeTool{Name: name, Cmd: cmd, TrustExitCode: trust}, nil
+}
+
+// unmergedPaths returns the unmerged entries of the index by path, indexed
+// by their stage, in the order of the index.
+func unmergedPaths(idx *Index, ps *Pathspec) ([]string, map[string]*[4]*IndexEntry) {
+	var paths []string
+	stages := make(map[string]*[4]*IndexEntry)
+	for _, e := range idx.Entries {
+		if e.Stage == 0 || !ps.Match(e.Path) {
+			continue
+		}
+		s, ok := stages[e.Path]
+		if !ok {
+			s = &[4]*IndexEntry{}
+			stages[e.Path] = s
+			paths = append(paths, e.Path)
+		}
+		s[e.Stage] = e
+	}
+	return paths, stages
+}
+
+// mergeToolFiles are the files the merge tool is run with. Paths are
+// relative to the worktree.
+type mergeToolFiles struct {
+	Base, Local, Remote, Merged string
+}
+
+// writeMergeToolFiles writes the base, local and remote versions of an
+// unmerged path next to it, named after the path with the version and the
+// process id added before the extension, same as in git. Missing versions
+// are written as empty files.
+func (r *Repository) writeMergeToolFiles(name string, stages *[4]*IndexEntry) (*mergeToolFiles, error) {
+	attrStack, err := r.worktreeAttributes()
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := attrStack.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	ext := path.Ext(name)
+	if strings.HasPrefix(path.Base(name), ".") && ext == path.Base(name) {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	files := &mergeToolFiles{Merged: name}
+	for i, dest := range []*string{&files.Base, &files.Local, &files.Remote} {
+		*dest = fmt.Sprintf("%s_%s_%d%s", stem, []string{"BASE", "LOCAL", "REMOTE"}[i], os.Getpid(), ext)
+		var content []byte
+		if e := stages[i+1]; e != nil {
+			_, raw, err := r.ReadRawObject(e.Sha)
+			if err != nil {
+				return nil, fmt.Errorf("read %s stage %d: %w", name, i+1, err)
+			}
+			if content, err = r.convertToWorktree(attrs, name, e.Sha, raw); err != nil {
+				return nil, err
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(r.workdir, filepath.FromSlash(*dest)), content, 0644); err != nil {
+			return nil, fmt.Errorf("write %s: %w", *dest, err)
+		}
+	}
+	return files, nil
+}
+
+// remove deletes the base, local and remote files.
+func (f *mergeToolFiles) remove(workdir string) {
+	for _, name := range []string{f.Base, f.Local, f.Remote} {
+		os.Remove(filepath.Join(workdir, filepath.FromSlash(name)))
+	}
+}
+
+// run launches the tool in the worktree and returns true if the merged
+// file is resolved. Unless the exit status is trusted, the tool must change
+// the merged file, or confirm must tell that the unchanged file is
+// resolved.
+func (t *MergeTool) run(workdir string, files *mergeToolFiles, output io.Writer, confirm func() (bool, error)) (bool, error) {
+	merged := filepath.Join(workdir, filepath.FromSlash(files.Merged))
+	before, err := ioutil.ReadFile(merged)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	status, err := t.launch(workdir, output,
+		"BASE="+files.Base,
+		"LOCAL="+files.Local,
+		"REMOTE="+files.Remote,
+		"MERGED="+files.Merged,
+	)
+	if err != nil {
+		return false, err
+	}
+	if t.TrustExitCode {
+		return status == 0, nil
+	}
+	after, err := ioutil.ReadFile(merged)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if !bytes.Equal(before, after) {
+		return true, nil
+	}
+	return confirm()
+}
+
+// launch runs the command of the tool in the directory with the variables
+// added to the environment, and returns its exit status.
+func (t *MergeTool) launch(dir string, output io.Writer, env ...string) (int, error) {
+	cmd := exec.Command("sh", "-c", t.Cmd)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = output
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("run %s: %w", t.Name, err)
+	}
+	return 0, nil
+}
+
+// stageResolved replaces the unmerged entries of the path with the content
+// of the worktree file. The mode of our version is kept.
+func (r *Repository) stageResolved(idx *Index, name string, stages *[4]*IndexEntry) error {
+	full := filepath.Join(r.workdir, filepath.FromSlash(name))
+	info, err := os.Lstat(full)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", name, err)
+	}
+	content, err := readWorktreeFile(full, info)
+	if err != nil {
+		return err
+	}
+	attrStack, err := r.worktreeAttributes()
+	if err != nil {
+		return err
+	}
+	attrs, err := attrStack.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if content, err = r.convertToGit(attrs, name, content); err != nil {
+		return err
+	}
+	sha, err := r.WriteObject("blob", content)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	mode := modeBlob
+	for _, i := range []int{2, 3, 1} {
+		if stages[i] != nil {
+			mode = stages[i].Mode
+			break
+		}
+	}
+	e := &IndexEntry{Mtime: info.ModTime(), Mode: mode, Size: uint32(info.Size()), Sha: sha, Path: name}
+	setStatData(e, info)
+
+	entries := idx.Entries[:0]
+	inserted := false
+	for _, x := range idx.Entries {
+		if x.Path == name {
+			if !inserted {
+				entries = append(entries, e)
+				inserted = true
+			}
+			continue
+		}
+		entries = append(entries, x)
+	}
+	idx.Entries = entries
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeTool(t *testing.T) {
+	cases := map[string]struct {
+		cmd     string
+		trust   bool
+		confirm bool
+		wantOK  bool
+		// want is the content of the merged file after the tool run.
+		want string
+	}{
+		"changed": {
+			cmd:    "cat $REMOTE > $MERGED",
+			wantOK: true,
+			want:   "theirs\n",
+		},
+		"all files": {
+			cmd:    "cat $BASE $LOCAL $REMOTE > $MERGED",
+			wantOK: true,
+			want:   "base\nours\ntheirs\n",
+		},
+		"unchanged": {
+			cmd:    "true",
+			wantOK: false,
+			want:   "conflict\n",
+		},
+		"unchanged confirmed": {
+			cmd:     "true",
+			confirm: true,
+			wantOK:  true,
+			want:    "conflict\n",
+		},
+		"trusted failure": {
+			cmd:    "cat $LOCAL > $MERGED && false",
+			trust:  true,
+			wantOK: false,
+			want:   "ours\n",
+		},
+		"trusted success": {
+			cmd:    "exit 0",
+			trust:  true,
+			wantOK: true,
+			want:   "conflict\n",
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			repo := newTestRepository(t)
+			var err error
+			dir := repo.workdir
+			config := "[merge]\ntool = test\n[mergetool \"test\"]\ncmd = " + tc.cmd + "\n"
+			if tc.trust {
+				config += "trustExitCode = true\n"
+			}
+			if repo.config, err = ParseConfig(strings.NewReader(config)); err != nil {
+				t.Fatalf("parse config: %s", err)
+			}
+
+			idx := &Index{}
+			for stage, content := range []string{"base\n", "ours\n", "theirs\n"} {
+				sha, err := repo.WriteObject("blob", []byte(content))
+				if err != nil {
+					t.Fatalf("write blob: %s", err)
+				}
+				idx.Entries = append(idx.Entries, &IndexEntry{Mode: modeBlob, Sha: sha, Stage: stage + 1, Path: "dir/a.txt"})
+			}
+			idx.Entries = append(idx.Entries, &IndexEntry{Mode: modeBlob, Sha: idx.Entries[0].Sha, Path: "z"})
+			merged := filepath.Join(dir, "dir", "a.txt")
+			if err := os.MkdirAll(filepath.Dir(merged), 0755); err != nil {
+				t.Fatalf("mkdir: %s", err)
+			}
+			if err := ioutil.WriteFile(merged, []byte("conflict\n"), 0644); err != nil {
+				t.Fatalf("write merged: %s", err)
+			}
+
+			mt, err := repo.mergeTool("")
+			if err != nil {
+				t.Fatalf("merge tool: %s", err)
+			}
+			paths, stages := unmergedPaths(idx, &Pathspec{})
+			if len(paths) != 1 || paths[0] != "dir/a.txt" {
+				t.Fatalf("want dir/a.txt unmerged, got %q", paths)
+			}
+			files, err := repo.writeMergeToolFiles(paths[0], stages[paths[0]])
+			if err != nil {
+				t.Fatalf("write files: %s", err)
+			}
+			if !strings.HasPrefix(files.Local, "dir/a_LOCAL_") || !strings.HasSuffix(files.Local, ".txt") {
+				t.Fatalf("unexpected local file name %s", files.Local)
+			}
+			var out bytes.Buffer
+			ok, err := mt.run(dir, files, &out, func() (bool, error) { return tc.confirm, nil })
+			if err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			if ok != tc.wantOK {
+				t.Fatalf("want ok %v, got %v", tc.wantOK, ok)
+			}
+			if got, _ := ioutil.ReadFile(merged); string(got) != tc.want {
+				t.Fatalf("want merged %q, got %q", tc.want, got)
+			}
+			files.remove(dir)
+			if _, err := os.Stat(filepath.Join(dir, files.Base)); !os.IsNotExist(err) {
+				t.Fatalf("want base file removed, got %v", err)
+			}
+			if !ok {
+				return
+			}
+
+			if err := repo.stageResolved(idx, paths[0], stages[paths[0]]); err != nil {
+				t.Fatalf("stage: %s", err)
+			}
+			if len(idx.Entries) != 2 || idx.Entries[0].Path != "dir/a.txt" || idx.Entries[0].Stage != 0 || idx.Entries[1].Path != "z" {
+				t.Fatalf("unexpected entries after staging %+v", idx.Entries)
+			}
+			assertHasObject(t, repo, idx.Entries[0].Sha, true)
+			if want := hashObject("blob", []byte(tc.want)); !bytes.Equal(idx.Entries[0].Sha, want) {
+				t.Fatalf("want staged %x, got %x", want, idx.Entries[0].Sha)
+			}
+		})
+	}
+}
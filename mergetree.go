@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// MergeStage is a version of a conflicting path, as written to the index
+// by a merge: stage 1 is the base, 2 is ours and 3 is theirs.
+type MergeStage struct {
+	Path  string
+	Mode  os.FileMode
+	Sha   []byte
+	Stage int
+}
+
+// MergeMessage is an informational message about the merge of the paths,
+// like the ones git merge prints.
+type MergeMessage struct {
+	Paths []string
+	// Type is a stable short description of the message, for example
+	// "CONFLICT (contents)" or "Auto-merging".
+	Type string
+	Text string
+}
+
+// ConflictStages returns the versions of the conflicting paths, sorted by
+// path and stage. The file of a file/directory conflict is reported under
+// the name it was moved to.
+func (res *MergeResult) ConflictStages(opts *MergeOptions) []*MergeStage {
+	o := opts.withDefaults()
+	seen := make(map[string]bool)
+	var stages []*MergeStage
+	for _, c := range res.Conflicts {
+		leafs := []*TreeLeaf{c.Base, c.Ours, c.Theirs}
+		path := c.Path
+		if c.Kind == "file/directory" {
+			if c.Ours.Mode == modeTree {
+				leafs, path = []*TreeLeaf{nil, nil, c.Theirs}, c.Path+"~"+o.TheirsLabel
+			} else {
+				leafs, path = []*TreeLeaf{nil, c.Ours, nil}, c.Path+"~"+o.OursLabel
+			}
+		}
+		// A path can have several conflicts, like of the mode and of the
+		// content.
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		for i, l := range leafs {
+			if l != nil && l.Mode != modeTree {
+				stages = append(stages, &MergeStage{Path: path, Mode: l.Mode, Sha: l.Sha, Stage: i + 1})
+			}
+		}
+	}
+	sort.SliceStable(stages, func(i, j int) bool {
+		return stages[i].Path < stages[j].Path
+	})
+	return stages
+}
+
+// Messages returns what git merge would print about the conflicts.
+func (res *MergeResult) Messages(opts *MergeOptions) []*MergeMessage {
+	o := opts.withDefaults()
+	contentConflict := make(map[string]bool)
+	for _, c := range res.Conflicts {
+		if c.Kind == "content" || c.Kind == "add/add" {
+			contentConflict[c.Path] = true
+		}
+	}
+	var msgs []*MergeMessage
+	add := func(typ string, text string, paths ...string) {
+		msgs = append(msgs, &MergeMessage{Paths: paths, Type: typ, Text: text})
+	}
+	for _, c := range res.Conflicts {
+		switch c.Kind {
+		case "content", "add/add":
+			add("Auto-merging", "Auto-merging "+c.Path, c.Path)
+			add("CONFLICT (contents)", fmt.Sprintf("CONFLICT (%s): Merge conflict in %s", c.Kind, c.Path), c.Path)
+		case "binary":
+			add("CONFLICT (binary)", fmt.Sprintf("warning: Cannot merge binary files: %s (%s vs. %s)", c.Path, o.OursLabel, o.TheirsLabel), c.Path)
+			add("Auto-merging", "Auto-merging "+c.Path, c.Path)
+			add("CONFLICT (contents)", "CONFLICT (content): Merge conflict in "+c.Path, c.Path)
+		case "modify/delete":
+			deleted, modified := o.OursLabel, o.TheirsLabel
+			if c.Ours != nil {
+				deleted, modified = modified, deleted
+			}
+			add("CONFLICT (modify/delete)", fmt.Sprintf("CONFLICT (modify/delete): %s deleted in %s and modified in %s.  Version %s of %s left in tree.",
+				c.Path, deleted, modified, modified, c.Path), c.Path)
+		case "file/directory":
+			label := o.TheirsLabel
+			if c.Theirs.Mode == modeTree {
+				label = o.OursLabel
+			}
+			moved := c.Path + "~" + label
+			add("CONFLICT (file/directory)", fmt.Sprintf("CONFLICT (file/directory): directory in the way of %s from %s; moving it to %s instead.",
+				c.Path, label, moved), moved, c.Path)
+		case "submodule":
+			add("CONFLICT (submodule)", "CONFLICT (submodule): Merge conflict in "+c.Path, c.Path)
+		case "mode":
+			// Reported together with the content, if it conflicts as
+			// well.
+			if !contentConflict[c.Path] {
+				add("CONFLICT (distinct modes)", "CONFLICT (mode): Merge conflict in "+c.Path, c.Path)
+			}
+		}
+	}
+	return msgs
+}
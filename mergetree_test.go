@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeTreeConflicts(t *testing.T) {
+	repo := newTestRepository(t)
+	writeTree := func(files map[string]string) []byte {
+		t.Helper()
+		tb := NewTreeBuilder(repo, nil)
+		for name, content := range files {
+			blob, err := repo.WriteObject("blob", []byte(content))
+			if err != nil {
+				t.Fatalf("write blob: %s", err)
+			}
+			if err := tb.Insert(name, modeBlob, blob); err != nil {
+				t.Fatalf("insert %s: %s", name, err)
+			}
+		}
+		sha, err := tb.Write()
+		if err != nil {
+			t.Fatalf("write tree: %s", err)
+		}
+		return sha
+	}
+
+	cases := map[string]struct {
+		base, ours, theirs map[string]string
+		wantPaths          []string
+		wantMessages       []string
+	}{
+		"clean": {
+			base:   map[string]string{"a": "1\n", "b": "1\n"},
+			ours:   map[string]string{"a": "2\n", "b": "1\n"},
+			theirs: map[string]string{"a": "1\n", "b": "2\n"},
+		},
+		"content": {
+			base:      map[string]string{"a": "1\n"},
+			ours:      map[string]string{"a": "2\n"},
+			theirs:    map[string]string{"a": "3\n"},
+			wantPaths: []string{"a 1", "a 2", "a 3"},
+			wantMessages: []string{
+				"Auto-merging: Auto-merging a",
+				"CONFLICT (contents): CONFLICT (content): Merge conflict in a",
+			},
+		},
+		"modify/delete": {
+			base:         map[string]string{"a": "1\n", "b": "1\n"},
+			ours:         map[string]string{"b": "1\n"},
+			theirs:       map[string]string{"a": "2\n", "b": "1\n"},
+			wantPaths:    []string{"a 1", "a 3"},
+			wantMessages: []string{"CONFLICT (modify/delete): CONFLICT (modify/delete): a deleted in ours and modified in theirs.  Version theirs of a left in tree."},
+		},
+		"file/directory": {
+			base:      map[string]string{"d/x": "1\n"},
+			ours:      map[string]string{"d/x": "2\n"},
+			theirs:    map[string]string{"d": "file\n"},
+			wantPaths: []string{"d/x 1", "d/x 2", "d~theirs 3"},
+			wantMessages: []string{
+				"CONFLICT (modify/delete): CONFLICT (modify/delete): d/x deleted in theirs and modified in ours.  Version ours of d/x left in tree.",
+				"CONFLICT (file/directory): CONFLICT (file/directory): directory in the way of d from theirs; moving it to d~theirs instead.",
+			},
+		},
+		"directory replaced by file": {
+			base:   map[string]string{"d/x": "1\n"},
+			ours:   map[string]string{"d": "file\n"},
+			theirs: map[string]string{"d/x": "1\n", "e": "1\n"},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			res, err := repo.MergeTrees(writeTree(tc.base), writeTree(tc.ours), writeTree(tc.theirs), nil)
+			if err != nil {
+				t.Fatalf("merge trees: %s", err)
+			}
+			var paths, messages []string
+			for _, s := range res.ConflictStages(nil) {
+				paths = append(paths, fmt.Sprintf("%s %d", s.Path, s.Stage))
+			}
+			for _, msg := range res.Messages(nil) {
+				messages = append(messages, msg.Type+": "+msg.Text)
+			}
+			if !reflect.DeepEqual(paths, tc.wantPaths) {
+				t.Errorf("want conflicts %q, got %q", tc.wantPaths, paths)
+			}
+			if !reflect.DeepEqual(messages, tc.wantMessages) {
+				t.Errorf("want messages:\n%s\ngot:\n%s", strings.Join(tc.wantMessages, "\n"), strings.Join(messages, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Files are read with system calls where memory mapping is not supported.
+const mmapSupported = false
+
+func mmap(fd *os.File, offset int64, length int) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported")
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+// mmap maps the region of the file into memory for reading.
+func mmap(fd *os.File, offset int64, length int) ([]byte, error) {
+	return syscall.Mmap(int(fd.Fd()), offset, length, syscall.PROT_READ, syscall.MAP_PRIVATE)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
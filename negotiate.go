@@ -0,0 +1,179 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Values of fetch.negotiationAlgorithm. Any other value selects the
+// consecutive algorithm.
+const (
+	negotiationConsecutive = "consecutive"
+	negotiationSkipping    = "skipping"
+	negotiationNoop        = "noop"
+)
+
+// negotiator chooses local commits that are sent as haves while fetching,
+// so that the server can leave out objects that are already present.
+type negotiator interface {
+	// next returns the next commit to send, or nil if there are no more.
+	next() ([]byte, error)
+}
+
+// newNegotiator returns a negotiator of the algorithm, walking history of
+// the tips. Tips that are not commits, or that are missing, are ignored.
+func (r *Repository) newNegotiator(algorithm string, tips [][]byte) (negotiator, error) {
+	if algorithm == negotiationNoop {
+		return noopNegotiator{}, nil
+	}
+	var commits [][]byte
+	for _, sha := range tips {
+		if c, err := r.peelObject(sha, "commit"); err == nil {
+			commits = append(commits, c)
+		}
+	}
+	if algorithm == negotiationSkipping {
+		n := &skippingNegotiator{repo: r, entries: make(map[string]*skipEntry)}
+		for _, sha := range commits {
+			if _, err := n.push(sha); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	}
+	w, err := r.NewRevWalk(commits)
+	if err != nil {
+		return nil, err
+	}
+	return consecutiveNegotiator{w}, nil
+}
+
+// noopNegotiator sends no haves.
+type noopNegotiator struct{}
+
+func (noopNegotiator) next() ([]byte, error) { return nil, nil }
+
+// consecutiveNegotiator sends every commit, newest first.
+type consecutiveNegotiator struct {
+	walk *RevWalk
+}
+
+func (n consecutiveNegotiator) next() ([]byte, error) {
+	c, err := n.walk.Next()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.Sha, nil
+}
+
+// skippingNegotiator walks commits newest first, same as the consecutive
+// negotiator, but skips an increasing number of commits after every sent
+// one, so that the number of haves grows with the logarithm of the history
+// length. Tips and roots are always sent.
+type skippingNegotiator struct {
+	repo    *Repository
+	queue   commitQueue
+	entries map[string]*skipEntry
+}
+
+type skipEntry struct {
+	// ttl is the number of commits to skip before sending the next one,
+	// and originalTTL the distance between the last two sent commits.
+	ttl, originalTTL int
+	popped           bool
+}
+
+func (n *skippingNegotiator) push(sha []byte) (*skipEntry, error) {
+	if e, ok := n.entries[string(sha)]; ok {
+		return e, nil
+	}
+	c, err := n.repo.readWalkedCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	e := &skipEntry{}
+	n.entries[string(sha)] = e
+	heap.Push(&n.queue, &queuedCommit{commit: c, order: len(n.entries)})
+	return e, nil
+}
+
+func (n *skippingNegotiator) next() ([]byte, error) {
+	for n.queue.Len() != 0 {
+		c := heap.Pop(&n.queue).(*queuedCommit).commit
+		e := n.entries[string(c.Sha)]
+		e.popped = true
+
+		parentPushed := false
+		for _, parent := range c.Parents {
+			p, err := n.push(parent)
+			if err != nil {
+				return nil, err
+			}
+			if p.popped {
+				// Already visited because of clock skew.
+				continue
+			}
+			parentPushed = true
+			originalTTL, ttl := e.originalTTL, e.ttl-1
+			if e.ttl == 0 {
+				originalTTL = e.originalTTL*3/2 + 1
+				ttl = originalTTL
+			}
+			if p.originalTTL < originalTTL {
+				p.originalTTL, p.ttl = originalTTL, ttl
+			}
+		}
+		if e.ttl == 0 || !parentPushed {
+			return c.Sha, nil
+		}
+	}
+	return nil, nil
+}
+
+// NegotiatingTransport is implemented by transports that tell the remote
+// repository which objects the local repository has.
+type NegotiatingTransport interface {
+	// SetNegotiationTips limits the commits that are sent as present to
+	// the given commits and their history. By default history of all
+	// local references is used.
+	SetNegotiationTips(tips [][]byte)
+}
+
+// NegotiationTips resolves the --negotiation-tip arguments of fetch, which
+// are revisions or glob patterns of reference names. Patterns are relative
+// to refs/ unless they start with it.
+func (r *Repository) NegotiationTips(revs []string) ([][]byte, error) {
+	var refs map[string][]byte
+	// Not nil even if no reference matches, which means no tips.
+	tips := make([][]byte, 0, len(revs))
+	for _, rev := range revs {
+		if !strings.ContainsAny(rev, "*?[") {
+			sha, err := r.Resolve(rev)
+			if err != nil {
+				return nil, err
+			}
+			tips = append(tips, sha)
+			continue
+		}
+		if refs == nil {
+			var err error
+			if refs, err = r.ListRefs(); err != nil {
+				return nil, err
+			}
+		}
+		if !strings.HasPrefix(rev, "refs/") {
+			rev = "refs/" + rev
+		}
+		for name, sha := range refs {
+			if wildmatch(rev, name, false) {
+				tips = append(tips, sha)
+			}
+		}
+	}
+	return tips, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestNegotiator(t *testing.T) {
+	repo := newTestRepository(t)
+	names := make(map[string]string)
+	var tip []byte
+	for i := 1; i <= 20; i++ {
+		var parents [][]byte
+		if tip != nil {
+			parents = append(parents, tip)
+		}
+		tip = writeTestCommit(t, repo, strconv.Itoa(i), parents...)
+		names[string(tip)] = strconv.Itoa(i)
+	}
+
+	cases := map[string]struct {
+		algorithm string
+		want      []string
+	}{
+		"default": {
+			algorithm: "",
+			want:      []string{"20", "19", "18", "17", "16", "15", "14", "13", "12", "11", "10", "9", "8", "7", "6", "5", "4", "3", "2", "1"},
+		},
+		"skipping": {
+			algorithm: negotiationSkipping,
+			want:      []string{"20", "18", "15", "10", "2", "1"},
+		},
+		"noop": {
+			algorithm: negotiationNoop,
+			want:      nil,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			n, err := repo.newNegotiator(tc.algorithm, [][]byte{tip})
+			if err != nil {
+				t.Fatalf("new negotiator: %s", err)
+			}
+			var got []string
+			for {
+				sha, err := n.next()
+				if err != nil {
+					t.Fatalf("next: %s", err)
+				}
+				if sha == nil {
+					break
+				}
+				got = append(got, names[string(sha)])
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want haves %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
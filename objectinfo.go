@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Client and server of the object-info command of protocol version 2,
+// which tells sizes of objects without sending them.
+
+// ObjectInfoTransport is implemented by transports that can ask the remote
+// repository about objects without fetching them.
+type ObjectInfoTransport interface {
+	// ObjectSizes returns sizes of the objects, in the same order. Size of
+	// an object that the remote repository does not have is -1.
+	ObjectSizes(shas [][]byte) ([]int64, error)
+}
+
+// readCapabilityAdvertisement reads the capabilities a server of protocol
+// version 2 advertises, as a map of names to optional values.
+func readCapabilityAdvertisement(r io.Reader) (map[string]string, error) {
+	line, err := readPktLine(r)
+	if err != nil {
+		return nil, fmt.Errorf("read capabilities: %w", err)
+	}
+	if string(bytes.TrimSuffix(line, []byte("\n"))) != "version 2" {
+		if bytes.HasPrefix(line, []byte("ERR ")) {
+			return nil, fmt.Errorf("remote error: %s", bytes.TrimSpace(line[4:]))
+		}
+		return nil, errors.New("server does not support protocol version 2")
+	}
+	caps := make(map[string]string)
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, fmt.Errorf("read capabilities: %w", err)
+		}
+		if line == nil {
+			return caps, nil
+		}
+		chunks := strings.SplitN(strings.TrimSuffix(string(line), "\n"), "=", 2)
+		if len(chunks) == 1 {
+			chunks = append(chunks, "")
+		}
+		caps[chunks[0]] = chunks[1]
+	}
+}
+
+// writeObjectInfoRequest writes an object-info command asking for sizes of
+// the objects.
+func writeObjectInfoRequest(w io.Writer, shas [][]byte) error {
+	var b bytes.Buffer
+	writePktLine(&b, "command=object-info\n")
+	writePktLine(&b, "agent=gogit\n")
+	writeDelimPkt(&b)
+	writePktLine(&b, "size\n")
+	for _, sha := range shas {
+		writePktLine(&b, "oid %x\n", sha)
+	}
+	writeFlushPkt(&b)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("send object-info request: %w", err)
+	}
+	return nil
+}
+
+// readObjectInfoResponse reads sizes of the requested objects.
+func readObjectInfoResponse(r io.Reader, shas [][]byte) ([]int64, error) {
+	line, err := readPktLine(r)
+	if err != nil {
+		return nil, fmt.Errorf("read object-info response: %w", err)
+	}
+	if attrs := strings.Fields(string(line)); len(attrs) != 1 || attrs[0] != "size" {
+		return nil, fmt.Errorf("unexpected object-info attributes %q", line)
+	}
+	sizes := make([]int64, 0, len(shas))
+	for {
+		line, err := readPktLine(r)
+		if err != nil {
+			return nil, fmt.Errorf("read object-info response: %w", err)
+		}
+		if line == nil {
+			break
+		}
+		chunks := strings.SplitN(strings.TrimSuffix(string(line), "\n"), " ", 2)
+		if len(chunks) != 2 || len(sizes) == len(shas) || chunks[0] != hex.EncodeToString(shas[len(sizes)]) {
+			return nil, fmt.Errorf("unexpected object-info line %q", line)
+		}
+		size := int64(-1)
+		if chunks[1] != "" {
+			if size, err = strconv.ParseInt(chunks[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid object-info size %q", chunks[1])
+			}
+		}
+		sizes = append(sizes, size)
+	}
+	if len(sizes) != len(shas) {
+		return nil, fmt.Errorf("object-info response has %d objects, want %d", len(sizes), len(shas))
+	}
+	return sizes, nil
+}
+
+// serveV2Command reads a command of protocol version 2 and writes the
+// response. Only the object-info and ls-refs commands are supported.
+func (r *Repository) serveV2Command(rd io.Reader, w io.Writer) error {
+	var command string
+	for {
+		line, err := readPktLine(rd)
+		if err == errDelimPkt || (err == nil && line == nil) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read command: %w", err)
+		}
+		// Capabilities of the client are ignored.
+		if s := strings.TrimSuffix(string(line), "\n"); strings.HasPrefix(s, "command=") {
+			command = strings.TrimPrefix(s, "command=")
+		}
+	}
+	switch command {
+	case "object-info":
+		return r.serveObjectInfo(rd, w)
+	case "ls-refs":
+		return r.serveLsRefs(rd, w)
+	default:
+		return fmt.Errorf("invalid command '%s'", command)
+	}
+}
+
+// serveObjectInfo answers arguments of an object-info command. A missing
+// object is reported without a size.
+func (r *Repository) serveObjectInfo(rd io.Reader, w io.Writer) error {
+	var (
+		size bool
+		shas [][]byte
+	)
+	for {
+		line, err := readPktLine(rd)
+		if err != nil {
+			return fmt.Errorf("read object-info arguments: %w", err)
+		}
+		if line == nil {
+			break
+		}
+		arg := strings.TrimSuffix(string(line), "\n")
+		switch {
+		case arg == "size":
+			size = true
+		case strings.HasPrefix(arg, "oid "):
+			sha, err := hex.DecodeString(arg[4:])
+			if err != nil || len(sha) != 20 {
+				return fmt.Errorf("object-info: invalid oid %q", arg[4:])
+			}
+			shas = append(shas, sha)
+		default:
+			return fmt.Errorf("object-info: unexpected line: '%s'", arg)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	if size {
+		writePktLine(bw, "size")
+	}
+	for _, sha := range shas {
+		info := hex.EncodeToString(sha)
+		if size {
+			if _, content, err := r.ReadRawObject(sha); err == nil {
+				info += " " + strconv.Itoa(len(content))
+			} else {
+				info += " "
+			}
+		}
+		writePktLine(bw, "%s", info)
+	}
+	writeFlushPkt(bw)
+	return bw.Flush()
+}
+
+// ObjectSizes asks the remote repository for sizes of the objects the same
+// way it is asked over protocol version 2. The remote repository must
+// enable transfer.advertiseObjectInfo.
+func (t *localTransport) ObjectSizes(shas [][]byte) ([]int64, error) {
+	if ok, err := t.remote.config.Bool("transfer", "", "advertiseObjectInfo", false); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.New("object-info is not supported by the remote repository")
+	}
+	var request, response bytes.Buffer
+	if err := writeObjectInfoRequest(&request, shas); err != nil {
+		return nil, err
+	}
+	if err := t.remote.serveV2Command(&request, &response); err != nil {
+		return nil, err
+	}
+	return readObjectInfoResponse(&response, shas)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocalTransportObjectSizes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream, err := CreateRepository(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatalf("create upstream repository: %s", err)
+	}
+	local, err := CreateRepository(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatalf("create local repository: %s", err)
+	}
+	blob, err := upstream.WriteObject("blob", []byte("hello\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	missing := make([]byte, 20)
+
+	tr, err := local.OpenTransport(upstream.workdir)
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	oi, ok := tr.(ObjectInfoTransport)
+	if !ok {
+		t.Fatal("local transport does not implement object-info")
+	}
+	if _, err := oi.ObjectSizes([][]byte{blob}); err == nil {
+		t.Fatal("object-info served without transfer.advertiseObjectInfo")
+	}
+
+	fd, err := os.OpenFile(filepath.Join(upstream.gitdir, "config"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open config: %s", err)
+	}
+	fd.WriteString("[transfer]\nadvertiseObjectInfo = true\n")
+	fd.Close()
+	if tr, err = local.OpenTransport(upstream.workdir); err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	sizes, err := tr.(ObjectInfoTransport).ObjectSizes([][]byte{blob, missing})
+	if err != nil {
+		t.Fatalf("object sizes: %s", err)
+	}
+	if want := []int64{6, -1}; !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("want sizes %v, got %v", want, sizes)
+	}
+	assertHasObject(t, local, blob, false)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Object type codes used in pack files.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var packKinds = map[byte]string{
+	packCommit: "commit",
+	packTree:   "tree",
+	packBlob:   "blob",
+	packTag:    "tag",
+}
+
+// packReader consumes a pack stream, tracking the offset and the checksum
+// of the data read so far. It implements io.ByteReader, so that zlib
+// streams of pack entries are never read past their end. The checksum is
+// not computed if hash is nil. If crc is not nil, it is updated with the
+// same data, and so is out, which receives a copy of the stream.
+type packReader struct {
+	rd     *bufio.Reader
+	offset int64
+	hash   hash.Hash
+	crc    hash.Hash32
+	out    io.Writer
+	buf    [1]byte
+}
+
+func (p *packReader) ReadByte() (byte, error) {
+	b, err := p.rd.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p.buf[0] = b
+	if err := p.consumed(p.buf[:]); err != nil {
+		return 0, err
+	}
+	return b, nil
+}
+
+func (p *packReader) Read(b []byte) (int, error) {
+	n, err := p.rd.Read(b)
+	if werr := p.consumed(b[:n]); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// consumed accounts for data read from the stream.
+func (p *packReader) consumed(b []byte) error {
+	p.offset += int64(len(b))
+	if p.hash != nil {
+		p.hash.Write(b)
+	}
+	if p.crc != nil {
+		p.crc.Write(b)
+	}
+	if p.out != nil {
+		if _, err := p.out.Write(b); err != nil {
+			return fmt.Errorf("write pack: %w", err)
+		}
+	}
+	return nil
+}
+
+// readEntryHeader reads the type and the inflated size of a pack entry.
+func (p *packReader) readEntryHeader() (byte, int64, error) {
+	b, err := p.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	typ := (b >> 4) & 7
+	size := int64(b & 0x0f)
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		if shift > 56 {
+			return 0, 0, errors.New("entry size overflow")
+		}
+		if b, err = p.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int64(b&0x7f) << shift
+	}
+	return typ, size, nil
+}
+
+// readDeltaOffset reads the distance to the base of an offset delta.
+func (p *packReader) readDeltaOffset() (int64, error) {
+	b, err := p.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(b & 0x7f)
+	for b&0x80 != 0 {
+		if b, err = p.ReadByte(); err != nil {
+			return 0, err
+		}
+		offset = ((offset + 1) << 7) | int64(b&0x7f)
+	}
+	return offset, nil
+}
+
+// readInflated reads a zlib stream, that must inflate to exactly size
+// bytes.
+func (p *packReader) readInflated(size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(p)
+	if err != nil {
+		return nil, fmt.Errorf("zlib reader: %w", err)
+	}
+	defer zr.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, fmt.Errorf("inflate: %w", err)
+	}
+	// Read the rest of the stream to consume the checksum.
+	if n, err := io.Copy(ioutil.Discard, zr); err != nil {
+		return nil, fmt.Errorf("inflate: %w", err)
+	} else if n != 0 {
+		return nil, fmt.Errorf("entry longer than %d bytes", size)
+	}
+	return data, nil
+}
+
+// UnpackObjects reads a pack stream and stores every object it contains as
+// a loose object. Delta bases must be within the pack or already present in
+// the repository, so thin packs, which leave out bases the receiver has,
+// are completed from the local objects. The number of unpacked objects is
+// returned.
+func (r *Repository) UnpackObjects(rd io.Reader) (int, error) {
+	p := &packReader{rd: bufio.NewReader(rd), hash: sha1.New()}
+	var header [12]byte
+	if _, err := io.ReadFull(p, header[:]); err != nil {
+		return 0, fmt.Errorf("read pack header: %w", err)
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return 0, errors.New("not a pack stream")
+	}
+	if v := binary.BigEndian.Uint32(header[4:8]); v != 2 && v != 3 {
+		return 0, fmt.Errorf("unsupported pack version %d", v)
+	}
+	count := int(binary.BigEndian.Uint32(header[8:12]))
+
+	// Hashes of already stored entries by their offset, for resolving
+	// offset deltas.
+	stored := make(map[int64][]byte, count)
+	type refDelta struct {
+		offset int64
+		base   []byte
+		data   []byte
+	}
+	// Reference deltas with a base that is not yet known.
+	var pending []refDelta
+
+	for i := 0; i < count; i++ {
+		offset := p.offset
+		typ, size, err := p.readEntryHeader()
+		if err != nil {
+			return 0, fmt.Errorf("entry at %d: %w", offset, err)
+		}
+		var base []byte
+		switch typ {
+		case packOfsDelta:
+			distance, err := p.readDeltaOffset()
+			if err != nil {
+				return 0, fmt.Errorf("entry at %d: %w", offset, err)
+			}
+			sha, ok := stored[offset-distance]
+			if !ok {
+				return 0, fmt.Errorf("entry at %d: no delta base at %d", offset, offset-distance)
+			}
+			base = sha
+		case packRefDelta:
+			base = make([]byte, 20)
+			if _, err := io.ReadFull(p, base); err != nil {
+				return 0, fmt.Errorf("entry at %d: %w", offset, err)
+			}
+		}
+		data, err := p.readInflated(size)
+		if err != nil {
+			return 0, fmt.Errorf("entry at %d: %w", offset, err)
+		}
+
+		if kind, ok := packKinds[typ]; ok {
+			sha, err := r.WriteObject(kind, data)
+			if err != nil {
+				return 0, err
+			}
+			stored[offset] = sha
+			continue
+		}
+		if base == nil {
+			return 0, fmt.Errorf("entry at %d: unknown type %d", offset, typ)
+		}
+		switch sha, err := r.applyDelta(base, data); {
+		case err == nil:
+			stored[offset] = sha
+		case errors.Is(err, os.ErrNotExist) && typ == packRefDelta:
+			pending = append(pending, refDelta{offset: offset, base: base, data: data})
+		default:
+			return 0, fmt.Errorf("entry at %d: %w", offset, err)
+		}
+	}
+
+	sum := p.hash.Sum(nil)
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(p.rd, trailer); err != nil {
+		return 0, fmt.Errorf("read pack checksum: %w", err)
+	}
+	if !bytes.Equal(sum, trailer) {
+		return 0, fmt.Errorf("pack checksum mismatch: %x != %x", trailer, sum)
+	}
+
+	// Bases of reference deltas may come later in the pack.
+	for len(pending) != 0 {
+		var unresolved []refDelta
+		for _, d := range pending {
+			switch _, err := r.applyDelta(d.base, d.data); {
+			case err == nil:
+				// Resolved.
+			case errors.Is(err, os.ErrNotExist):
+				unresolved = append(unresolved, d)
+			default:
+				return 0, fmt.Errorf("entry at %d: %w", d.offset, err)
+			}
+		}
+		if len(unresolved) == len(pending) {
+			return 0, fmt.Errorf("%d deltas with missing base, first %x", len(pending), pending[0].base)
+		}
+		pending = unresolved
+	}
+	return count, nil
+}
+
+// applyDelta stores an object reconstructed from a delta against an
+// existing base object.
+func (r *Repository) applyDelta(base, delta []byte) ([]byte, error) {
+	kind, content, err := r.ReadRawObject(base)
+	if err != nil {
+		return nil, fmt.Errorf("delta base: %w", err)
+	}
+	target, err := patchDelta(content, delta)
+	if err != nil {
+		return nil, fmt.Errorf("delta against %x: %w", base, err)
+	}
+	return r.WriteObject(kind, target)
+}
+
+// patchDelta builds an object from its base and delta instructions.
+func patchDelta(base, delta []byte) ([]byte, error) {
+	rd := bytes.NewReader(delta)
+	baseSize, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, fmt.Errorf("read base size: %w", err)
+	}
+	if baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("base size mismatch: %d != %d", baseSize, len(base))
+	}
+	targetSize, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, fmt.Errorf("read target size: %w", err)
+	}
+	// Do not trust the declared size for the allocation.
+	target := make([]byte, 0, minUint64(targetSize, 1<<20))
+	for rd.Len() != 0 {
+		cmd, _ := rd.ReadByte()
+		switch {
+		case cmd&0x80 != 0:
+			// Copy from the base. Bits of cmd tell which bytes of the
+			// offset and the size follow.
+			var offset, size uint64
+			for i := uint(0); i < 7; i++ {
+				if cmd&(1<<i) == 0 {
+					continue
+				}
+				b, err := rd.ReadByte()
+				if err != nil {
+					return nil, errors.New("truncated copy instruction")
+				}
+				if i < 4 {
+					offset |= uint64(b) << (8 * i)
+				} else {
+					size |= uint64(b) << (8 * (i - 4))
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, errors.New("copy out of base bounds")
+			}
+			target = append(target, base[offset:offset+size]...)
+		case cmd != 0:
+			// Insert literal data.
+			start := len(target)
+			target = append(target, make([]byte, cmd)...)
+			if n, _ := rd.Read(target[start:]); n != int(cmd) {
+				return nil, errors.New("truncated insert instruction")
+			}
+		default:
+			return nil, errors.New("invalid delta instruction")
+		}
+	}
+	if uint64(len(target)) != targetSize {
+		return nil, fmt.Errorf("target size mismatch: %d != %d", len(target), targetSize)
+	}
+	return target, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestUnpackObjects(t *testing.T) {
+	repo := newTestRepository(t)
+
+	base := []byte("hello world\n")
+	// Copy "hello " from the base and insert "gopher\n".
+	delta := []byte{byte(len(base)), 13, 0x90, 6, 7}
+	delta = append(delta, []byte("gopher\n")...)
+
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	writeTestPackEntry(t, &pack, packBlob, nil, base)
+	// Offset delta with the base at the first entry, 12 bytes back.
+	writeTestPackEntry(t, &pack, packOfsDelta, []byte{byte(pack.Len() - 12)}, delta)
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+
+	n, err := repo.UnpackObjects(&pack)
+	if err != nil {
+		t.Fatalf("unpack: %s", err)
+	}
+	if n != 2 {
+		t.Fatalf("want 2 objects, got %d", n)
+	}
+	// echo 'hello gopher' | git hash-object --stdin
+	sha, _ := hex.DecodeString("cb2ad40a24dc67c699f262b980adf4fe46aca576")
+	kind, content, err := repo.ReadRawObject(sha)
+	if err != nil {
+		t.Fatalf("read patched object: %s", err)
+	}
+	if kind != "blob" || string(content) != "hello gopher\n" {
+		t.Fatalf("unexpected %s object: %q", kind, content)
+	}
+}
+
+func TestUnpackThinPack(t *testing.T) {
+	repo := newTestRepository(t)
+	base, err := repo.WriteObject("blob", []byte("hello world\n"))
+	if err != nil {
+		t.Fatalf("write base: %s", err)
+	}
+
+	// A reference delta against the base, which is left out of the pack.
+	delta := []byte{12, 13, 0x90, 6, 7}
+	delta = append(delta, []byte("gopher\n")...)
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(1))
+	writeTestPackEntry(t, &pack, packRefDelta, base, delta)
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+
+	// Received objects are written to a quarantine first, the same as
+	// when fetching.
+	q, err := repo.NewQuarantine()
+	if err != nil {
+		t.Fatalf("quarantine: %s", err)
+	}
+	if _, err := q.Repository().UnpackObjects(&pack); err != nil {
+		t.Fatalf("unpack: %s", err)
+	}
+	if err := q.Migrate(); err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	sha, _ := hex.DecodeString("cb2ad40a24dc67c699f262b980adf4fe46aca576")
+	kind, content, err := repo.ReadRawObject(sha)
+	if err != nil {
+		t.Fatalf("read patched object: %s", err)
+	}
+	if kind != "blob" || string(content) != "hello gopher\n" {
+		t.Fatalf("unexpected %s object: %q", kind, content)
+	}
+}
+
+func TestUnpackObjectsChecksumMismatch(t *testing.T) {
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(0))
+	pack.Write(make([]byte, sha1.Size))
+
+	if _, err := (&Repository{}).UnpackObjects(&pack); err == nil {
+		t.Fatal("want checksum error")
+	}
+}
+
+func writeTestPackEntry(t *testing.T, w *bytes.Buffer, typ byte, extra, data []byte) {
+	t.Helper()
+	size := len(data)
+	b := typ<<4 | byte(size&0x0f)
+	size >>= 4
+	for size != 0 {
+		w.WriteByte(b | 0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	w.WriteByte(b)
+	w.Write(extra)
+	zw := zlib.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("compress: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("compress: %s", err)
+	}
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// maxDeltaDepth limits the length of a chain of deltas that is resolved
+// when reading a packed object, so that a malformed pack cannot recurse
+// forever.
+const maxDeltaDepth = 10000
+
+// packIndex is a version 2 pack index, which maps hashes of objects stored
+// in a pack to the offsets of their entries.
+type packIndex struct {
+	fanout [256]uint32
+	// shas are sorted object hashes, 20 bytes each. offsets are 4 byte
+	// offsets of their entries, or indexes into large 8 byte offsets if the
+	// most significant bit is set.
+	shas    []byte
+	offsets []byte
+	large   []byte
+	// packSum is the checksum of the pack the index is for.
+	packSum []byte
+	// raw is the content of the index file, which slices above point to.
+	raw []byte
+}
+
+var packIndexMagic = []byte{0xff, 't', 'O', 'c'}
+
+// readPackIndex reads the pack index, which is mapped into memory if
+// possible.
+func readPackIndex(path string) (*packIndex, error) {
+	raw, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := parsePackIndex(raw)
+	if err != nil {
+		unmapFile(raw)
+		return nil, err
+	}
+	return idx, nil
+}
+
+func parsePackIndex(raw []byte) (*packIndex, error) {
+	if len(raw) < 8+256*4+2*sha1.Size || !bytes.Equal(raw[:4], packIndexMagic) {
+		return nil, errors.New("not a version 2 pack index")
+	}
+	if v := binary.BigEndian.Uint32(raw[4:8]); v != 2 {
+		return nil, fmt.Errorf("unsupported pack index version %d", v)
+	}
+	if sum := sha1.Sum(raw[:len(raw)-sha1.Size]); !bytes.Equal(sum[:], raw[len(raw)-sha1.Size:]) {
+		return nil, errors.New("pack index checksum mismatch")
+	}
+
+	idx := &packIndex{raw: raw}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(raw[8+i*4:])
+		if i > 0 && idx.fanout[i] < idx.fanout[i-1] {
+			return nil, errors.New("pack index fanout is not sorted")
+		}
+	}
+	n := int(idx.fanout[255])
+	rest := raw[8+256*4 : len(raw)-2*sha1.Size]
+	if len(rest) < n*(sha1.Size+4+4) {
+		return nil, fmt.Errorf("pack index is too short for %d objects", n)
+	}
+	idx.shas = rest[:n*sha1.Size]
+	rest = rest[n*sha1.Size:]
+	// CRC32 checksums of the entries are not used.
+	rest = rest[n*4:]
+	idx.offsets = rest[:n*4]
+	// Offsets of entries past 2 GiB follow in a table of 8 byte
+	// offsets. The first entry is always at a small offset, so there are
+	// fewer large ones than objects.
+	idx.large = rest[n*4:]
+	if len(idx.large)%8 != 0 || (len(idx.large) != 0 && len(idx.large) > (n-1)*8) {
+		return nil, errors.New("invalid pack index large offset table")
+	}
+	idx.packSum = raw[len(raw)-2*sha1.Size : len(raw)-sha1.Size]
+	return idx, nil
+}
+
+// close unmaps the index file. The index is empty afterwards.
+func (idx *packIndex) close() {
+	unmapFile(idx.raw)
+	*idx = packIndex{}
+}
+
+// count returns the number of objects in the pack.
+func (idx *packIndex) count() int {
+	return int(idx.fanout[255])
+}
+
+// find returns the position of the object in the index.
+func (idx *packIndex) find(sha []byte) (int, bool) {
+	lo := 0
+	if sha[0] > 0 {
+		lo = int(idx.fanout[sha[0]-1])
+	}
+	hi := int(idx.fanout[sha[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(idx.sha(lo+i), sha) >= 0
+	})
+	return i, i < hi && bytes.Equal(idx.sha(i), sha)
+}
+
+func (idx *packIndex) sha(i int) []byte {
+	return idx.shas[i*sha1.Size : (i+1)*sha1.Size]
+}
+
+func (idx *packIndex) offset(i int) (int64, error) {
+	off := binary.BigEndian.Uint32(idx.offsets[i*4:])
+	if off&0x80000000 == 0 {
+		return int64(off), nil
+	}
+	j := int(off & 0x7fffffff)
+	if (j+1)*8 > len(idx.large) {
+		return 0, fmt.Errorf("large offset %d is out of the index bounds", j)
+	}
+	large := binary.BigEndian.Uint64(idx.large[j*8:])
+	if large > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid large offset %d", large)
+	}
+	return int64(large), nil
+}
+
+// packFile is a pack stored in an object directory, together with its
+// index.
+type packFile struct {
+	path  string
+	index *packIndex
+	// offsets are entry offsets by object hash, used instead of the index
+	// while the pack is being indexed.
+	offsets map[string]int64
+	// ends are entry offsets in increasing order followed by the offset of
+	// the trailer, for computing sizes of entries. Loaded on first use.
+	ends []int64
+	// size is the size of the pack file, known once a window is mapped.
+	size int64
+	// forgotten is set once the pack is not used anymore, so that its
+	// windows and index are unmapped when they are released.
+	forgotten bool
+}
+
+// findOffset returns the offset of the entry of the object, and false if
+// the pack does not contain it.
+func (p *packFile) findOffset(sha []byte) (int64, bool, error) {
+	if p.offsets != nil {
+		offset, ok := p.offsets[string(sha)]
+		return offset, ok, nil
+	}
+	i, ok := p.index.find(sha)
+	if !ok {
+		return 0, false, nil
+	}
+	offset, err := p.index.offset(i)
+	return offset, true, err
+}
+
+// loadPacks updates the list of known packs with packs of all object
+// directories. Packs without an index are still being written and are
+// skipped.
+func (r *Repository) loadPacks() error {
+	known := make(map[string]*packFile, len(r.packs))
+	for _, p := range r.packs {
+		known[p.path] = p
+	}
+	defer func() {
+		// Packs removed since they were loaded are not read anymore.
+		for _, p := range known {
+			r.windows.forget(p)
+		}
+	}()
+	var packs []*packFile
+	for _, dir := range append([]string{r.objdir}, r.alternates...) {
+		names, err := filepath.Glob(filepath.Join(dir, "pack", "*.pack"))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if p, ok := known[name]; ok {
+				packs = append(packs, p)
+				delete(known, name)
+				continue
+			}
+			idxPath := name[:len(name)-len(".pack")] + ".idx"
+			idx, err := readPackIndex(idxPath)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", idxPath, err)
+			}
+			packs = append(packs, &packFile{path: name, index: idx})
+		}
+	}
+	r.packs = packs
+	r.packsLoaded = true
+	return nil
+}
+
+// findPacked returns the pack that contains the object, and the offset of
+// its entry. Packs are searched again if the object is not found, as new
+// ones could have been written since they were loaded.
+func (r *Repository) findPacked(sha []byte) (*packFile, int64, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 || !r.packsLoaded {
+			if err := r.loadPacks(); err != nil {
+				return nil, 0, err
+			}
+		}
+		for _, p := range r.packs {
+			if i, ok := p.index.find(sha); ok {
+				offset, err := p.index.offset(i)
+				return p, offset, err
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("object %x: %w", sha, os.ErrNotExist)
+}
+
+// readPackedObject returns the type and the content of an object stored in
+// any of the packs.
+func (r *Repository) readPackedObject(sha []byte) (string, []byte, error) {
+	p, offset, err := r.findPacked(sha)
+	if err != nil {
+		return "", nil, err
+	}
+	fd, err := openPack(p)
+	if err != nil {
+		return "", nil, err
+	}
+	if fd != nil {
+		defer fd.Close()
+	}
+	kind, content, err := r.readPackEntry(p, fd, offset, 0)
+	if err != nil {
+		return "", nil, &CorruptObjectError{Sha: sha, Path: p.path, Err: err}
+	}
+	return kind, content, nil
+}
+
+// readPackEntry reads the object of the pack entry at offset, resolving
+// deltas against their bases. The pack is read from fd if it is set, and
+// through mapped windows otherwise.
+func (r *Repository) readPackEntry(p *packFile, fd *os.File, offset int64, depth int) (string, []byte, error) {
+	if depth > maxDeltaDepth {
+		return "", nil, fmt.Errorf("delta chain longer than %d", maxDeltaDepth)
+	}
+	section, release := r.packSection(p, fd, offset)
+	defer release()
+	pr := &packReader{rd: bufio.NewReader(section), offset: offset}
+	typ, size, err := pr.readEntryHeader()
+	if err != nil {
+		return "", nil, fmt.Errorf("entry at %d: %w", offset, err)
+	}
+	var baseKind string
+	var base []byte
+	switch typ {
+	case packOfsDelta:
+		distance, err := pr.readDeltaOffset()
+		if err != nil {
+			return "", nil, fmt.Errorf("entry at %d: %w", offset, err)
+		}
+		if distance <= 0 || distance > offset {
+			return "", nil, fmt.Errorf("entry at %d: invalid delta base offset", offset)
+		}
+		if baseKind, base, err = r.readPackEntry(p, fd, offset-distance, depth+1); err != nil {
+			return "", nil, err
+		}
+	case packRefDelta:
+		sha := make([]byte, sha1.Size)
+		if _, err := io.ReadFull(pr, sha); err != nil {
+			return "", nil, fmt.Errorf("entry at %d: %w", offset, err)
+		}
+		if baseOffset, ok, ferr := p.findOffset(sha); ferr != nil {
+			err = ferr
+		} else if ok {
+			baseKind, base, err = r.readPackEntry(p, fd, baseOffset, depth+1)
+		} else {
+			baseKind, base, err = r.ReadRawObject(sha)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("delta base %x: %w", sha, err)
+		}
+	}
+	data, err := pr.readInflated(size)
+	if err != nil {
+		return "", nil, fmt.Errorf("entry at %d: %w", offset, err)
+	}
+	if kind, ok := packKinds[typ]; ok {
+		return kind, data, nil
+	}
+	if typ != packOfsDelta && typ != packRefDelta {
+		return "", nil, fmt.Errorf("entry at %d: unknown type %d", offset, typ)
+	}
+	target, err := patchDelta(base, data)
+	if err != nil {
+		return "", nil, fmt.Errorf("entry at %d: %w", offset, err)
+	}
+	return baseKind, target, nil
+}
+
+// packEntryInfo returns the size of the pack entry at offset, and the hash
+// of its delta base if it is a delta.
+func (r *Repository) packEntryInfo(p *packFile, offset int64) (int64, []byte, error) {
+	if p.ends == nil {
+		info, err := os.Stat(p.path)
+		if err != nil {
+			return 0, nil, err
+		}
+		ends := make([]int64, 0, p.index.count()+1)
+		for i := 0; i < p.index.count(); i++ {
+			off, err := p.index.offset(i)
+			if err != nil {
+				return 0, nil, err
+			}
+			ends = append(ends, off)
+		}
+		sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+		p.ends = append(ends, info.Size()-sha1.Size)
+	}
+	i := sort.Search(len(p.ends), func(i int) bool { return p.ends[i] > offset })
+	if i == len(p.ends) {
+		return 0, nil, fmt.Errorf("no entry at %d", offset)
+	}
+	size := p.ends[i] - offset
+
+	fd, err := openPack(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	if fd != nil {
+		defer fd.Close()
+	}
+	section, release := r.packSection(p, fd, offset)
+	defer release()
+	pr := &packReader{rd: bufio.NewReader(io.LimitReader(section, size)), offset: offset}
+	typ, _, err := pr.readEntryHeader()
+	if err != nil {
+		return 0, nil, err
+	}
+	switch typ {
+	case packOfsDelta:
+		distance, err := pr.readDeltaOffset()
+		if err != nil {
+			return 0, nil, err
+		}
+		for i := 0; i < p.index.count(); i++ {
+			if off, err := p.index.offset(i); err == nil && off == offset-distance {
+				return size, p.index.sha(i), nil
+			}
+		}
+		return 0, nil, fmt.Errorf("no delta base at %d", offset-distance)
+	case packRefDelta:
+		base := make([]byte, sha1.Size)
+		if _, err := io.ReadFull(pr, base); err != nil {
+			return 0, nil, err
+		}
+		return size, base, nil
+	}
+	return size, nil, nil
+}
+
+// objectDiskInfo returns the number of bytes the object takes in the
+// repository, and the hash of its delta base if it is stored as a delta.
+func (r *Repository) objectDiskInfo(sha []byte) (int64, []byte, error) {
+	path, err := r.objectPath(sha)
+	if err == nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, nil, err
+		}
+		return info.Size(), nil, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, nil, err
+	}
+	p, offset, err := r.findPacked(sha)
+	if err != nil {
+		return 0, nil, err
+	}
+	return r.packEntryInfo(p, offset)
+}
+
+// packedObject is an object written into a pack by writePack.
+type packedObject struct {
+	sha    []byte
+	offset int64
+	crc    uint32
+}
+
+// writePack writes the objects into a new pack of the object directory,
+// together with its index, and returns the path of the pack.
+func (r *Repository) writePack(shas [][]byte) (string, error) {
+	dir := filepath.Join(r.objdir, "pack")
+	if err := os.MkdirAll(dir, newDirPerm); err != nil {
+		return "", fmt.Errorf("ensure pack dir: %w", err)
+	}
+	packTmp, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return "", fmt.Errorf("create pack: %w", err)
+	}
+	defer os.Remove(packTmp.Name())
+	defer packTmp.Close()
+
+	objects, sum, err := r.writePackData(packTmp, shas)
+	if err != nil {
+		return "", err
+	}
+	return r.installPack(packTmp, objects, sum)
+}
+
+// installPack writes the index of a pack written to a temporary file of the
+// pack directory, and moves both to their final names.
+func (r *Repository) installPack(packTmp *os.File, objects []*packedObject, sum []byte) (string, error) {
+	dir := filepath.Dir(packTmp.Name())
+	if r.fsyncEnabled(fsyncPack) {
+		if err := syncFile(packTmp); err != nil {
+			return "", err
+		}
+	}
+	if err := packTmp.Close(); err != nil {
+		return "", fmt.Errorf("close pack: %w", err)
+	}
+
+	idxTmp, err := ioutil.TempFile(dir, "tmp_idx_")
+	if err != nil {
+		return "", fmt.Errorf("create pack index: %w", err)
+	}
+	defer os.Remove(idxTmp.Name())
+	defer idxTmp.Close()
+	if err := writePackIndex(idxTmp, objects, sum); err != nil {
+		return "", err
+	}
+	if r.fsyncEnabled(fsyncPackMetadata) {
+		if err := syncFile(idxTmp); err != nil {
+			return "", err
+		}
+	}
+	if err := idxTmp.Close(); err != nil {
+		return "", fmt.Errorf("close pack index: %w", err)
+	}
+
+	base := filepath.Join(dir, "pack-"+hex.EncodeToString(sum))
+	for _, f := range []struct{ tmp, ext string }{{packTmp.Name(), ".pack"}, {idxTmp.Name(), ".idx"}} {
+		if err := os.Chmod(f.tmp, 0444); err != nil {
+			return "", fmt.Errorf("chmod pack: %w", err)
+		}
+		// The index is renamed last, so that the pack is never used
+		// before it is complete.
+		if err := os.Rename(f.tmp, base+f.ext); err != nil {
+			return "", fmt.Errorf("rename pack: %w", err)
+		}
+	}
+	if r.fsyncEnabled(fsyncPack | fsyncPackMetadata) {
+		if err := syncPath(dir); err != nil {
+			return "", err
+		}
+	}
+	return base + ".pack", nil
+}
+
+// writePackData writes the pack stream of the objects and returns its
+// entries and checksum. Objects are stored as offset deltas against similar
+// objects written before them, when that is smaller, searching the
+// pack.window most recent objects of the same kind, with delta chains no
+// longer than pack.depth.
+func (r *Repository) writePackData(w io.Writer, shas [][]byte) ([]*packedObject, []byte, error) {
+	windowSize, err := r.config.Int("pack", "", "window", defaultPackWindow)
+	if err != nil {
+		return nil, nil, err
+	}
+	depth, err := r.config.Int("pack", "", "depth", defaultPackDepth)
+	if err != nil {
+		return nil, nil, err
+	}
+	if depth > maxDeltaDepth {
+		depth = maxDeltaDepth
+	}
+	if shas, err = r.deltaOrder(shas); err != nil {
+		return nil, nil, err
+	}
+
+	h := sha1.New()
+	pw := &packWriter{w: io.MultiWriter(w, h)}
+	var header [12]byte
+	copy(header[:], "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(shas)))
+	if _, err := pw.Write(header[:]); err != nil {
+		return nil, nil, err
+	}
+
+	kinds := make(map[string]byte, len(packKinds))
+	for typ, kind := range packKinds {
+		kinds[kind] = typ
+	}
+	window := &deltaWindow{size: int(windowSize), maxDepth: int(depth)}
+	objects := make([]*packedObject, 0, len(shas))
+	for _, sha := range shas {
+		kind, content, err := r.ReadRawObject(sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		obj := &packedObject{sha: sha, offset: pw.offset}
+		entry := &deltaEntry{kind: kind, content: content, offset: pw.offset}
+		pw.crc = crc32.NewIEEE()
+		if base, delta := window.find(kind, content); base != nil {
+			entry.depth = base.depth + 1
+			err = pw.writeOfsDelta(obj.offset-base.offset, delta, r.packCompression)
+		} else {
+			err = pw.writeEntry(kinds[kind], content, r.packCompression)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("write %x: %w", sha, err)
+		}
+		obj.crc = pw.crc.Sum32()
+		objects = append(objects, obj)
+		window.add(entry)
+	}
+	sum := h.Sum(nil)
+	if _, err := w.Write(sum); err != nil {
+		return nil, nil, err
+	}
+	return objects, sum, nil
+}
+
+// packWriter writes a pack stream, tracking the offset and the CRC32
+// checksum of the entry being written.
+type packWriter struct {
+	w      io.Writer
+	offset int64
+	crc    hash.Hash32
+}
+
+func (p *packWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	if p.crc != nil {
+		p.crc.Write(b[:n])
+	}
+	return n, err
+}
+
+// writeEntry writes a whole object entry with the content compressed at
+// given zlib level.
+func (p *packWriter) writeEntry(typ byte, content []byte, level int) error {
+	if _, err := p.Write(packEntryHeader(typ, len(content))); err != nil {
+		return err
+	}
+	return p.writeCompressed(content, level)
+}
+
+// writeOfsDelta writes an entry with the delta against the base entry at
+// given distance before it.
+func (p *packWriter) writeOfsDelta(distance int64, delta []byte, level int) error {
+	header := packEntryHeader(packOfsDelta, len(delta))
+	// The distance is stored most significant bits first, with one
+	// subtracted from all but the last group, as readDeltaOffset expects.
+	var ofs [10]byte
+	pos := len(ofs) - 1
+	ofs[pos] = byte(distance & 0x7f)
+	for distance >>= 7; distance != 0; distance >>= 7 {
+		distance--
+		pos--
+		ofs[pos] = 0x80 | byte(distance&0x7f)
+	}
+	if _, err := p.Write(append(header, ofs[pos:]...)); err != nil {
+		return err
+	}
+	return p.writeCompressed(delta, level)
+}
+
+// packEntryHeader returns the header with the type and the inflated size
+// of an entry.
+func packEntryHeader(typ byte, size int) []byte {
+	header := []byte{typ<<4 | byte(size&0x0f)}
+	for size >>= 4; size != 0; size >>= 7 {
+		header[len(header)-1] |= 0x80
+		header = append(header, byte(size&0x7f))
+	}
+	return header
+}
+
+func (p *packWriter) writeCompressed(content []byte, level int) error {
+	zw, err := zlib.NewWriterLevel(p, level)
+	if err != nil {
+		return fmt.Errorf("zlib writer: %w", err)
+	}
+	if _, err := zw.Write(content); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writePackIndex writes a version 2 index of the pack entries. Offsets that
+// do not fit in 31 bits are written to the table of large offsets.
+func writePackIndex(w io.Writer, objects []*packedObject, packSum []byte) error {
+	sorted := make([]*packedObject, len(objects))
+	copy(sorted, objects)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].sha, sorted[j].sha) < 0 })
+
+	h := sha1.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	bw.Write(packIndexMagic)
+	binary.Write(bw, binary.BigEndian, uint32(2))
+	var fanout [256]uint32
+	for _, obj := range sorted {
+		fanout[obj.sha[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(bw, binary.BigEndian, fanout)
+	for _, obj := range sorted {
+		bw.Write(obj.sha)
+	}
+	for _, obj := range sorted {
+		binary.Write(bw, binary.BigEndian, obj.crc)
+	}
+	var large []uint64
+	for _, obj := range sorted {
+		if obj.offset < 0x80000000 {
+			binary.Write(bw, binary.BigEndian, uint32(obj.offset))
+			continue
+		}
+		binary.Write(bw, binary.BigEndian, uint32(len(large))|0x80000000)
+		large = append(large, uint64(obj.offset))
+	}
+	binary.Write(bw, binary.BigEndian, large)
+	bw.Write(packSum)
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("write pack index: %w", err)
+	}
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackIndexLargeOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	offsets := []int64{12, 0x7fffffff, 0x80000000, 1 << 32, 1<<40 + 7}
+	var objects []*packedObject
+	for i, offset := range offsets {
+		objects = append(objects, &packedObject{sha: hashObject("blob", []byte{byte(i)}), offset: offset, crc: uint32(i)})
+	}
+	var b bytes.Buffer
+	if err := writePackIndex(&b, objects, make([]byte, sha1.Size)); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+	path := filepath.Join(dir, "pack.idx")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatalf("write file: %s", err)
+	}
+	idx, err := readPackIndex(path)
+	if err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	if len(idx.large) != 3*8 {
+		t.Fatalf("want 3 large offsets, got %d bytes", len(idx.large))
+	}
+	for _, obj := range objects {
+		i, ok := idx.find(obj.sha)
+		if !ok {
+			t.Fatalf("%x not found", obj.sha)
+		}
+		if offset, err := idx.offset(i); err != nil || offset != obj.offset {
+			t.Fatalf("want offset %d, got %d, %v", obj.offset, offset, err)
+		}
+	}
+
+	// An index referring to a missing large offset is an error.
+	raw := b.Bytes()
+	n := len(objects)
+	offsetTable := raw[8+256*4+n*(sha1.Size+4):]
+	for i := 0; i < n; i++ {
+		if off := binary.BigEndian.Uint32(offsetTable[i*4:]); off&0x80000000 != 0 {
+			binary.BigEndian.PutUint32(offsetTable[i*4:], 0x80000000|7)
+			break
+		}
+	}
+	sum := sha1.Sum(raw[:len(raw)-sha1.Size])
+	copy(raw[len(raw)-sha1.Size:], sum[:])
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("write file: %s", err)
+	}
+	if idx, err = readPackIndex(path); err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := idx.offset(i); err != nil {
+			return
+		}
+	}
+	t.Fatal("want out of bounds large offset error")
+}
+
+func TestReadLargeOffsetPack(t *testing.T) {
+	repo := newTestRepository(t)
+	base := []byte("hello world\n")
+	// Copy "hello " from the base and insert "gopher\n".
+	delta := []byte{12, 13, 0x90, 6, 7}
+	delta = append(delta, []byte("gopher\n")...)
+	writeTestSparsePack(t, repo, []testSparseEntry{
+		{offset: 12, data: []byte("small\n")},
+		{offset: 0x80000000 + 100, data: base},
+		{offset: 0x80000000 + 200, data: delta, base: 0x80000000 + 100},
+	})
+
+	for _, want := range []string{"small\n", "hello world\n", "hello gopher\n"} {
+		kind, content, err := repo.ReadRawObject(hashObject("blob", []byte(want)))
+		if err != nil {
+			t.Fatalf("read %q: %s", want, err)
+		}
+		if kind != "blob" || string(content) != want {
+			t.Fatalf("want blob %q, got %s %q", want, kind, content)
+		}
+	}
+}
+
+// testSparseEntry is a blob, or an offset delta if base is set, written by
+// writeTestSparsePack at the offset.
+type testSparseEntry struct {
+	offset int64
+	data   []byte
+	base   int64
+}
+
+// writeTestSparsePack writes a pack with entries at the given offsets, in
+// increasing order, and its index. Gaps between the entries are holes of a
+// sparse file, so that packs with entries past 2 GiB take little space.
+// The pack checksum is not computed.
+func writeTestSparsePack(t *testing.T, repo *Repository, entries []testSparseEntry) {
+	t.Helper()
+	dir := filepath.Join(repo.objdir, "pack")
+	if err := os.MkdirAll(dir, newDirPerm); err != nil {
+		t.Fatalf("pack dir: %s", err)
+	}
+	fd, err := os.Create(filepath.Join(dir, "pack-sparse.pack"))
+	if err != nil {
+		t.Fatalf("create pack: %s", err)
+	}
+	defer fd.Close()
+	var header bytes.Buffer
+	header.WriteString("PACK")
+	binary.Write(&header, binary.BigEndian, uint32(2))
+	binary.Write(&header, binary.BigEndian, uint32(len(entries)))
+	if _, err := fd.WriteAt(header.Bytes(), 0); err != nil {
+		t.Fatalf("write pack: %s", err)
+	}
+
+	var objects []*packedObject
+	contents := make(map[int64][]byte)
+	var end int64
+	for _, e := range entries {
+		var b bytes.Buffer
+		pw := &packWriter{w: &b, offset: e.offset}
+		content := e.data
+		if e.base != 0 {
+			if err := pw.writeOfsDelta(e.offset-e.base, e.data, zlib.DefaultCompression); err != nil {
+				t.Fatalf("write entry: %s", err)
+			}
+			if content, err = patchDelta(contents[e.base], e.data); err != nil {
+				t.Fatalf("patch delta: %s", err)
+			}
+		} else if err := pw.writeEntry(packBlob, e.data, zlib.DefaultCompression); err != nil {
+			t.Fatalf("write entry: %s", err)
+		}
+		contents[e.offset] = content
+		if _, err := fd.WriteAt(b.Bytes(), e.offset); err != nil {
+			t.Fatalf("write pack: %s", err)
+		}
+		end = pw.offset
+		objects = append(objects, &packedObject{sha: hashObject("blob", content), offset: e.offset})
+	}
+	sum := make([]byte, sha1.Size)
+	if _, err := fd.WriteAt(sum, end); err != nil {
+		t.Fatalf("write pack: %s", err)
+	}
+
+	var idx bytes.Buffer
+	if err := writePackIndex(&idx, objects, sum); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pack-sparse.idx"), idx.Bytes(), 0444); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Packs are read through windows, regions of pack files mapped into
+// memory, so that reading an object takes no system calls once its window
+// is mapped. Windows are aligned to half of their size, so that entries
+// close to the end of one are usually found whole in the next. The total
+// size of mapped windows is bounded, and the least recently used ones are
+// unmapped to make room for new ones. Where memory mapping is not
+// available, packs are read with system calls instead.
+
+// Default window size and limit of mapped windows, the same as git uses,
+// which are respectively overridden by core.packedGitWindowSize and
+// core.packedGitLimit.
+var (
+	defaultPackWindowSize int64 = 32 << 20
+	defaultPackedLimit    int64 = 256 << 20
+)
+
+func init() {
+	if strconv.IntSize == 64 {
+		defaultPackWindowSize = 1 << 30
+		defaultPackedLimit = 32 << 40
+	}
+}
+
+// packWindows are the mapped windows of all packs of a repository.
+type packWindows struct {
+	mu         sync.Mutex
+	windowSize int64
+	limit      int64
+	// mapped is the total size of the windows, and tick counts window
+	// uses, to find the least recently used one.
+	mapped  int64
+	tick    uint64
+	windows []*packWindow
+}
+
+// packWindow is a mapped region of a pack starting at offset.
+type packWindow struct {
+	pack     *packFile
+	offset   int64
+	data     []byte
+	lastUsed uint64
+	// inUse counts readers of the window, which must not be unmapped
+	// until they are done.
+	inUse int
+}
+
+// readPackWindowConfig reads the window size and the limit of mapped
+// windows. Same as git, the window size is rounded down to a multiple of
+// two memory pages.
+func (r *Repository) readPackWindowConfig() error {
+	size, err := r.config.Int("core", "", "packedGitWindowSize", defaultPackWindowSize)
+	if err != nil {
+		return err
+	}
+	limit, err := r.config.Int("core", "", "packedGitLimit", defaultPackedLimit)
+	if err != nil {
+		return err
+	}
+	pages := int64(2 * os.Getpagesize())
+	if size = size / pages * pages; size < pages {
+		size = pages
+	}
+	r.windows = &packWindows{windowSize: size, limit: limit}
+	return nil
+}
+
+// packSection returns a reader of the pack from the offset on, and a
+// function releasing it. The pack is read from the file if fd is set, and
+// through windows otherwise.
+func (r *Repository) packSection(p *packFile, fd *os.File, offset int64) (io.Reader, func()) {
+	if fd != nil {
+		return io.NewSectionReader(fd, offset, 1<<62), func() {}
+	}
+	wr := &packWindowReader{windows: r.windows, pack: p, offset: offset}
+	return wr, wr.release
+}
+
+// openPack returns the file to read the pack from, or nil if it is read
+// through windows. The file must be closed by the caller.
+func openPack(p *packFile) (*os.File, error) {
+	if mmapSupported {
+		return nil, nil
+	}
+	fd, err := os.Open(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("open pack: %w", err)
+	}
+	return fd, nil
+}
+
+// use returns the window containing the offset, mapping it if needed. The
+// window must be released once it is not used anymore.
+func (w *packWindows) use(p *packFile, offset int64) (*packWindow, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.tick++
+	for _, win := range w.windows {
+		if win.pack == p && offset >= win.offset && offset < win.offset+int64(len(win.data)) {
+			win.inUse++
+			win.lastUsed = w.tick
+			return win, nil
+		}
+	}
+
+	if p.size == 0 {
+		info, err := os.Stat(p.path)
+		if err != nil {
+			return nil, fmt.Errorf("stat pack: %w", err)
+		}
+		p.size = info.Size()
+	}
+	if offset >= p.size {
+		return nil, io.EOF
+	}
+	align := w.windowSize / 2
+	start := offset / align * align
+	length := w.windowSize
+	if start+length > p.size {
+		length = p.size - start
+	}
+	for w.mapped+length > w.limit && w.unmapOne() {
+	}
+	fd, err := os.Open(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("open pack: %w", err)
+	}
+	defer fd.Close()
+	data, err := mmap(fd, start, int(length))
+	if err != nil {
+		return nil, fmt.Errorf("map pack: %w", err)
+	}
+	win := &packWindow{pack: p, offset: start, data: data, lastUsed: w.tick, inUse: 1}
+	w.windows = append(w.windows, win)
+	w.mapped += length
+	return win, nil
+}
+
+func (w *packWindows) release(win *packWindow) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	win.inUse--
+	if win.inUse == 0 && win.pack.forgotten {
+		w.unmapPack(win.pack)
+	}
+}
+
+// unmapOne unmaps the least recently used window that is not in use, and
+// returns false if there is none.
+func (w *packWindows) unmapOne() bool {
+	lru := -1
+	for i, win := range w.windows {
+		if win.inUse == 0 && (lru < 0 || win.lastUsed < w.windows[lru].lastUsed) {
+			lru = i
+		}
+	}
+	if lru < 0 {
+		return false
+	}
+	w.unmap(lru)
+	return true
+}
+
+func (w *packWindows) unmap(i int) {
+	win := w.windows[i]
+	munmap(win.data)
+	w.mapped -= int64(len(win.data))
+	w.windows = append(w.windows[:i], w.windows[i+1:]...)
+}
+
+// forget unmaps the windows and the index of a pack that is not used
+// anymore. Windows still in use are unmapped once they are released, and
+// the index once none of them is in use, because readers of the windows
+// look up delta bases in it.
+func (w *packWindows) forget(p *packFile) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p.forgotten = true
+	w.unmapPack(p)
+}
+
+// unmapPack unmaps the windows of a forgotten pack that are not in use, and
+// its index if none is.
+func (w *packWindows) unmapPack(p *packFile) {
+	inUse := false
+	for i := 0; i < len(w.windows); i++ {
+		if win := w.windows[i]; win.pack == p {
+			if win.inUse != 0 {
+				inUse = true
+				continue
+			}
+			w.unmap(i)
+			i--
+		}
+	}
+	if !inUse && p.index != nil {
+		p.index.close()
+	}
+}
+
+// packWindowReader reads a pack through its windows, moving to the next
+// window when the end of one is reached.
+type packWindowReader struct {
+	windows *packWindows
+	pack    *packFile
+	offset  int64
+	win     *packWindow
+}
+
+func (wr *packWindowReader) Read(b []byte) (int, error) {
+	if wr.win == nil || wr.offset >= wr.win.offset+int64(len(wr.win.data)) {
+		wr.release()
+		win, err := wr.windows.use(wr.pack, wr.offset)
+		if err != nil {
+			return 0, err
+		}
+		wr.win = win
+	}
+	n := copy(b, wr.win.data[wr.offset-wr.win.offset:])
+	wr.offset += int64(n)
+	return n, nil
+}
+
+func (wr *packWindowReader) release() {
+	if wr.win != nil {
+		wr.windows.release(wr.win)
+		wr.win = nil
+	}
+}
+
+// mapFile returns the content of a whole file, mapped into memory if
+// possible. The content must be released with unmapFile.
+func mapFile(path string) ([]byte, error) {
+	if !mmapSupported {
+		return ioutil.ReadFile(path)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+	return mmap(fd, 0, int(info.Size()))
+}
+
+// unmapFile releases the content returned by mapFile.
+func unmapFile(b []byte) {
+	if mmapSupported && len(b) != 0 {
+		munmap(b)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestPackWindows(t *testing.T) {
+	repo := newTestRepository(t)
+
+	// Similar blobs of random data, stored as deltas, and larger than
+	// the windows.
+	rnd := rand.New(rand.NewSource(1))
+	base := make([]byte, 3*os.Getpagesize())
+	rnd.Read(base)
+	var shas, contents [][]byte
+	for i := 0; i < 20; i++ {
+		content := append([]byte(fmt.Sprintf("version %d\n", i)), base...)
+		content = append(content, bytes.Repeat([]byte{byte(i)}, i*100)...)
+		sha, err := repo.WriteObject("blob", content)
+		if err != nil {
+			t.Fatalf("write blob: %s", err)
+		}
+		shas, contents = append(shas, sha), append(contents, content)
+	}
+	if _, err := repo.writePack(shas); err != nil {
+		t.Fatalf("write pack: %s", err)
+	}
+	for _, sha := range shas {
+		path, err := repo.objectPath(sha)
+		if err != nil {
+			t.Fatalf("find loose object: %s", err)
+		}
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("remove loose object: %s", err)
+		}
+	}
+
+	pages := int64(2 * os.Getpagesize())
+	repo.windows = &packWindows{windowSize: pages, limit: 2 * pages}
+	for i, sha := range shas {
+		kind, content, err := repo.ReadRawObject(sha)
+		if err != nil {
+			t.Fatalf("read %x: %s", sha, err)
+		}
+		if kind != "blob" || !bytes.Equal(content, contents[i]) {
+			t.Fatalf("%x: content differs", sha)
+		}
+		for _, win := range repo.windows.windows {
+			if win.inUse != 0 {
+				t.Fatalf("window at %d is still in use", win.offset)
+			}
+		}
+		if repo.windows.mapped > repo.windows.limit {
+			t.Fatalf("want at most %d bytes mapped, got %d", repo.windows.limit, repo.windows.mapped)
+		}
+	}
+	if len(repo.windows.windows) == 0 {
+		t.Fatal("want the pack read through windows")
+	}
+
+	// Windows and indexes of packs that are removed are unmapped, once
+	// the windows are not in use anymore.
+	p := repo.packs[0]
+	win, err := repo.windows.use(p, 0)
+	if err != nil {
+		t.Fatalf("use window: %s", err)
+	}
+	for _, p := range repo.packs {
+		os.Remove(p.path)
+	}
+	if err := repo.loadPacks(); err != nil {
+		t.Fatalf("load packs: %s", err)
+	}
+	if len(repo.windows.windows) != 1 || p.index.count() != len(shas) {
+		t.Fatalf("want the window in use and the index left, got %d windows and %d objects", len(repo.windows.windows), p.index.count())
+	}
+	repo.windows.release(win)
+	if len(repo.windows.windows) != 0 || repo.windows.mapped != 0 {
+		t.Fatalf("want no windows left, got %d", len(repo.windows.windows))
+	}
+	if p.index.count() != 0 || p.index.raw != nil {
+		t.Fatal("want the index unmapped")
+	}
+}
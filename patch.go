@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// patchContext is the number of unchanged lines shown around changes.
+const patchContext = 3
+
+// diffLine is a single line of a unified or combined diff. Marks has a
+// column for each preimage: '-' if the line was removed from it, '+' if the
+// line was added compared to it, and ' ' if it is unchanged.
+type diffLine struct {
+	text  string
+	marks []byte
+	// old holds the line index within each preimage, or -1 if the line is
+	// not there. Same for new and the postimage.
+	old []int
+	new int
+}
+
+func (l *diffLine) changed() bool {
+	return bytes.IndexFunc(l.marks, func(r rune) bool { return r != ' ' }) >= 0
+}
+
+// diffLineSequence compares each preimage with the postimage and returns
+// all lines of the postimage, interleaved with the lines removed from the
+// preimages. Removed lines come before the lines added in their place.
+func diffLineSequence(pre [][]string, post []string) []*diffLine {
+	n := len(pre)
+	inv := make([][]int, n)
+	lost := make([][][]int, n)
+	for i := range pre {
+		inv[i] = make([]int, len(post))
+		for j := range inv[i] {
+			inv[i][j] = -1
+		}
+		lost[i] = make([][]int, len(post)+1)
+		last := -1
+		for k, m := range compactMatches(pre[i], post, diffMatches(pre[i], post)) {
+			if m >= 0 {
+				inv[i][m] = k
+				last = m
+			} else {
+				lost[i][last+1] = append(lost[i][last+1], k)
+			}
+		}
+	}
+
+	newLine := func(text string) *diffLine {
+		l := &diffLine{text: text, marks: bytes.Repeat([]byte{' '}, n), old: make([]int, n), new: -1}
+		for i := range l.old {
+			l.old[i] = -1
+		}
+		return l
+	}
+	var lines []*diffLine
+	for j := 0; j <= len(post); j++ {
+		start := len(lines)
+		for i := range pre {
+		removed:
+			for _, k := range lost[i][j] {
+				// The same line removed from several preimages is shown
+				// only once.
+				for _, l := range lines[start:] {
+					if l.marks[i] == ' ' && l.text == pre[i][k] {
+						l.marks[i] = '-'
+						l.old[i] = k
+						continue removed
+					}
+				}
+				l := newLine(pre[i][k])
+				l.marks[i] = '-'
+				l.old[i] = k
+				lines = append(lines, l)
+			}
+		}
+		if j == len(post) {
+			break
+		}
+		l := newLine(post[j])
+		l.new = j
+		for i := range pre {
+			l.old[i] = inv[i][j]
+			if inv[i][j] < 0 {
+				l.marks[i] = '+'
+			}
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// diffHunk is a range of diff lines, [start, end).
+type diffHunk struct {
+	start, end int
+}
+
+// diffHunks groups changed lines together with their context. If dense is
+// set, changes where the postimage matches one of the preimages are not
+// shown, same as git does for combined diffs with --cc.
+func diffHunks(lines []*diffLine, dense bool) []diffHunk {
+	shown := make([]bool, len(lines))
+	for i, l := range lines {
+		shown[i] = l.changed()
+	}
+	if dense {
+		pruneDenseChanges(lines, shown)
+	}
+
+	var hunks []diffHunk
+	for i := 0; i < len(lines); i++ {
+		if !shown[i] {
+			continue
+		}
+		start := i - patchContext
+		if start < 0 {
+			start = 0
+		}
+		end := i + 1
+		for j := end; j < len(lines) && j <= end+2*patchContext; j++ {
+			if shown[j] {
+				end = j + 1
+			}
+		}
+		i = end - 1
+		end += patchContext
+		if end > len(lines) {
+			end = len(lines)
+		}
+		hunks = append(hunks, diffHunk{start: start, end: end})
+	}
+	return hunks
+}
+
+// pruneDenseChanges hides groups of nearby changes that all differ from the
+// same subset of preimages, because the postimage took that part from one
+// of them without modification.
+func pruneDenseChanges(lines []*diffLine, shown []bool) {
+	all := strings.Repeat("x", len(lines[0].marks))
+	parentSet := func(l *diffLine) string {
+		set := []byte(all)
+		for i, m := range l.marks {
+			if m == ' ' {
+				set[i] = ' '
+			}
+		}
+		return string(set)
+	}
+	for i := 0; i < len(lines); i++ {
+		if !shown[i] {
+			continue
+		}
+		start, end := i, i+1
+		for j := end; j < len(lines) && j < end+patchContext; j++ {
+			if shown[j] {
+				end = j + 1
+			}
+		}
+		i = end - 1
+
+		same := parentSet(lines[start])
+		for j := start; j < end && same != ""; j++ {
+			if shown[j] && parentSet(lines[j]) != same {
+				same = ""
+			}
+		}
+		if same != "" && same != all {
+			for j := start; j < end; j++ {
+				shown[j] = false
+			}
+		}
+	}
+}
+
+// writeHunk writes the hunk header and lines. Funcname is appended to the
+// header of two way diffs.
+func writeHunk(w io.Writer, lines []*diffLine, h diffHunk, funcname string) error {
+	n := len(lines[0].marks)
+	at := strings.Repeat("@", n+1)
+	var b bytes.Buffer
+	b.WriteString(at)
+	for i := 0; i < n; i++ {
+		col := func(l *diffLine) int { return l.old[i] }
+		b.WriteString(" -" + hunkRange(lines, h, col))
+	}
+	b.WriteString(" +" + hunkRange(lines, h, func(l *diffLine) int { return l.new }))
+	b.WriteString(" " + at)
+	if funcname != "" {
+		b.WriteString(" " + funcname)
+	}
+	b.WriteByte('\n')
+	for _, l := range lines[h.start:h.end] {
+		b.Write(l.marks)
+		b.WriteString(l.text)
+		if !strings.HasSuffix(l.text, "\n") {
+			b.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// hunkRange formats the "start,count" range of a hunk within a single
+// image. Count is omitted if it is one. An empty range starts at the line
+// preceding the hunk.
+func hunkRange(lines []*diffLine, h diffHunk, index func(*diffLine) int) string {
+	first, count := -1, 0
+	for _, l := range lines[h.start:h.end] {
+		if i := index(l); i >= 0 {
+			if first < 0 {
+				first = i
+			}
+			count++
+		}
+	}
+	if count == 0 {
+		first = 0
+		for i := h.start - 1; i >= 0; i-- {
+			if j := index(lines[i]); j >= 0 {
+				first = j + 1
+				break
+			}
+		}
+		return fmt.Sprintf("%d,0", first)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", first+1)
+	}
+	return fmt.Sprintf("%d,%d", first+1, count)
+}
+
+// hunkFuncname finds the line preceding the hunk in the preimage that looks
+// like a function definition, using the default git rule: a line starting
+// with a letter, an underscore or a dollar sign.
+func hunkFuncname(pre []string, lines []*diffLine, h diffHunk) string {
+	start := len(pre)
+	for _, l := range lines[h.start:h.end] {
+		if l.old[0] >= 0 {
+			start = l.old[0]
+			break
+		}
+	}
+	for i := start - 1; i >= 0; i-- {
+		line := strings.TrimRight(pre[i], " \t\r\n")
+		if line == "" {
+			continue
+		}
+		if c := line[0]; c == '_' || c == '$' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if len(line) > 80 {
+				line = strings.TrimRight(line[:80], " \t")
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// leafContent returns the content of a tree entry, as compared by diffs.
+// Missing entries are empty and submodules are described by their commit.
+func (r *Repository) leafContent(mode os.FileMode, sha []byte) ([]byte, error) {
+	switch {
+	case sha == nil:
+		return nil, nil
+	case mode == modeGitlink:
+		return []byte(fmt.Sprintf("Subproject commit %x\n", sha)), nil
+	}
+	_, content, err := r.ReadRawObject(sha)
+	if err != nil {
+		return nil, fmt.Errorf("read %x: %w", sha, err)
+	}
+	return content, nil
+}
+
+// WritePatch writes changes in the git unified diff format.
+func (r *Repository) WritePatch(w io.Writer, changes []*FileChange) error {
+	for _, c := range changes {
+		if c.Status == 'T' {
+			// Type change is shown as a deletion and an addition.
+			del := &FileChange{Path: c.Path, OldMode: c.OldMode, OldSha: c.OldSha, Status: 'D'}
+			add := &FileChange{Path: c.Path, NewMode: c.NewMode, NewSha: c.NewSha, Status: 'A'}
+			if err := r.writeFilePatch(w, del); err != nil {
+				return err
+			}
+			if err := r.writeFilePatch(w, add); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.writeFilePatch(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) writeFilePatch(w io.Writer, c *FileChange) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "diff --git a/%s b/%s\n", c.Path, c.Path)
+	switch {
+	case c.Status == 'A':
+		fmt.Fprintf(&b, "new file mode %06d\n", c.NewMode)
+	case c.Status == 'D':
+		fmt.Fprintf(&b, "deleted file mode %06d\n", c.OldMode)
+	case c.OldMode != c.NewMode:
+		fmt.Fprintf(&b, "old mode %06d\nnew mode %06d\n", c.OldMode, c.NewMode)
+	}
+	if bytes.Equal(c.OldSha, c.NewSha) {
+		// Only the mode changed.
+		_, err := b.WriteTo(w)
+		return err
+	}
+	fmt.Fprintf(&b, "index %s..%s", patchHash(c.OldSha), patchHash(c.NewSha))
+	if c.OldMode == c.NewMode {
+		fmt.Fprintf(&b, " %06d", c.OldMode)
+	}
+	b.WriteByte('\n')
+
+	oldName, newName := "a/"+c.Path, "b/"+c.Path
+	if c.OldSha == nil {
+		oldName = "/dev/null"
+	}
+	if c.NewSha == nil {
+		newName = "/dev/null"
+	}
+	old, err := r.leafContent(c.OldMode, c.OldSha)
+	if err != nil {
+		return err
+	}
+	cur, err := r.leafContent(c.NewMode, c.NewSha)
+	if err != nil {
+		return err
+	}
+	if isBinary(old) || isBinary(cur) {
+		fmt.Fprintf(&b, "Binary files %s and %s differ\n", oldName, newName)
+		_, err := b.WriteTo(w)
+		return err
+	}
+	pre := splitLines(old)
+	lines := diffLineSequence([][]string{pre}, splitLines(cur))
+	hunks := diffHunks(lines, false)
+	if len(hunks) != 0 {
+		fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	}
+	if _, err := b.WriteTo(w); err != nil {
+		return err
+	}
+	for _, h := range hunks {
+		if err := writeHunk(w, lines, h, hunkFuncname(pre, lines, h)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchHash returns the abbreviated hash written in the patch index line.
+func patchHash(sha []byte) string {
+	if sha == nil {
+		return strings.Repeat("0", 7)
+	}
+	return shortHash(sha)
+}
+
+// WriteCombinedPatch writes the git combined diff of a merge result with
+// its parents. Only files that differ from every parent are shown. With
+// dense set, hunks where the result matches one of the parents are omitted
+// as well, and files left without hunks are not shown.
+func (r *Repository) WriteCombinedPatch(w io.Writer, parents []*TreeObject, result *TreeObject, dense bool, ps *Pathspec) error {
+	var perParent []map[string]*FileChange
+	for _, p := range parents {
+		changes, err := r.DiffTrees(p, result, true, ps)
+		if err != nil {
+			return err
+		}
+		byPath := make(map[string]*FileChange, len(changes))
+		for _, c := range changes {
+			byPath[c.Path] = c
+		}
+		perParent = append(perParent, byPath)
+	}
+	if len(perParent) == 0 {
+		return nil
+	}
+
+	changes, err := r.DiffTrees(parents[0], result, true, ps)
+	if err != nil {
+		return err
+	}
+next:
+	for _, c := range changes {
+		pair := make([]*FileChange, len(perParent))
+		for i, byPath := range perParent {
+			if pair[i] = byPath[c.Path]; pair[i] == nil {
+				continue next
+			}
+		}
+		if err := r.writeCombinedFilePatch(w, c.Path, pair, dense); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) writeCombinedFilePatch(w io.Writer, path string, pair []*FileChange, dense bool) error {
+	var pre [][]string
+	var hashes []string
+	var binary bool
+	for _, c := range pair {
+		old, err := r.leafContent(c.OldMode, c.OldSha)
+		if err != nil {
+			return err
+		}
+		binary = binary || isBinary(old)
+		pre = append(pre, splitLines(old))
+		hashes = append(hashes, patchHash(c.OldSha))
+	}
+	last := pair[len(pair)-1]
+	cur, err := r.leafContent(last.NewMode, last.NewSha)
+	if err != nil {
+		return err
+	}
+	binary = binary || isBinary(cur)
+
+	var modes []string
+	var modeChanged bool
+	for _, c := range pair {
+		modes = append(modes, fmt.Sprintf("%06d", c.OldMode))
+		modeChanged = modeChanged || c.OldMode != last.NewMode
+	}
+
+	var lines []*diffLine
+	var hunks []diffHunk
+	if !binary {
+		lines = diffLineSequence(pre, splitLines(cur))
+		if hunks = diffHunks(lines, dense); len(hunks) == 0 && dense && !modeChanged {
+			return nil
+		}
+	}
+
+	var b bytes.Buffer
+	if dense {
+		fmt.Fprintf(&b, "diff --cc %s\n", path)
+	} else {
+		fmt.Fprintf(&b, "diff --combined %s\n", path)
+	}
+	fmt.Fprintf(&b, "index %s..%s\n", strings.Join(hashes, ","), patchHash(last.NewSha))
+	if modeChanged {
+		fmt.Fprintf(&b, "mode %s..%06d\n", strings.Join(modes, ","), last.NewMode)
+	}
+	if binary {
+		fmt.Fprintf(&b, "Binary files differ\n")
+	} else {
+		newName := "b/" + path
+		if last.NewSha == nil {
+			newName = "/dev/null"
+		}
+		fmt.Fprintf(&b, "--- a/%s\n+++ %s\n", path, newName)
+	}
+	if _, err := b.WriteTo(w); err != nil {
+		return err
+	}
+	for _, h := range hunks {
+		if err := writeHunk(w, lines, h, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
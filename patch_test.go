@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePatch(t *testing.T) {
+	repo := newTestRepository(t)
+	blob := func(content string) []byte {
+		t.Helper()
+		sha, err := repo.WriteObject("blob", []byte(content))
+		if err != nil {
+			t.Fatalf("write blob: %s", err)
+		}
+		return sha
+	}
+	numbers := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+
+	cases := map[string]struct {
+		change *FileChange
+		want   string
+	}{
+		"modified": {
+			change: &FileChange{Path: "n", OldMode: modeBlob, NewMode: modeBlob, Status: 'M',
+				OldSha: blob(numbers), NewSha: blob(strings.Replace(numbers, "2\n", "two\n", 1) + "13\n")},
+			want: "diff --git a/n b/n\n" +
+				"index 08fe19c..5cec9f9 100644\n" +
+				"--- a/n\n" +
+				"+++ b/n\n" +
+				"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+13\n",
+		},
+		"added without newline": {
+			change: &FileChange{Path: "x", NewMode: modeBlob, Status: 'A', NewSha: blob("a")},
+			want: "diff --git a/x b/x\n" +
+				"new file mode 100644\n" +
+				"index 0000000..2e65efe\n" +
+				"--- /dev/null\n" +
+				"+++ b/x\n" +
+				"@@ -0,0 +1 @@\n+a\n\\ No newline at end of file\n",
+		},
+		"mode change": {
+			change: &FileChange{Path: "x", OldMode: modeBlob, NewMode: modeExec, Status: 'M',
+				OldSha: blob("a"), NewSha: blob("a")},
+			want: "diff --git a/x b/x\nold mode 100644\nnew mode 100755\n",
+		},
+		"binary": {
+			change: &FileChange{Path: "b", OldMode: modeBlob, Status: 'D', OldSha: blob("\x00")},
+			want: "diff --git a/b b/b\n" +
+				"deleted file mode 100644\n" +
+				"index f76dd23..0000000\n" +
+				"Binary files a/b and /dev/null differ\n",
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := repo.WritePatch(&b, []*FileChange{tc.change}); err != nil {
+				t.Fatalf("write patch: %s", err)
+			}
+			if got := b.String(); got != tc.want {
+				t.Fatalf("unexpected patch:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompactMatches(t *testing.T) {
+	a := splitLines([]byte("func a() {\n}\n"))
+	b := splitLines([]byte("func a() {\n}\n\nfunc b() {\n}\n"))
+	lines := diffLineSequence([][]string{a}, b)
+	var got strings.Builder
+	for _, l := range lines {
+		got.Write(l.marks)
+		got.WriteString(l.text)
+	}
+	want := " func a() {\n }\n+\n+func b() {\n+}\n"
+	if got.String() != want {
+		t.Fatalf("unexpected diff:\n%s", got.String())
+	}
+}
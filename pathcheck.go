@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// pathProtection rejects tree entry names that are harmless on the local
+// file system, but that Windows or macOS would treat as .git, following the
+// core.protectNTFS and core.protectHFS settings. A repository checked out
+// from such a tree could be taken over by its content.
+type pathProtection struct {
+	ntfs bool
+	hfs  bool
+}
+
+func (r *Repository) pathProtection() (*pathProtection, error) {
+	ntfs, err := r.config.Bool("core", "", "protectNTFS", true)
+	if err != nil {
+		return nil, err
+	}
+	hfs, err := r.config.Bool("core", "", "protectHFS", runtime.GOOS == "darwin")
+	if err != nil {
+		return nil, err
+	}
+	return &pathProtection{ntfs: ntfs, hfs: hfs}, nil
+}
+
+// verify returns an error if the name of a tree entry with given mode is not
+// safe to check out. Names that are empty, ".", ".." or any variant of
+// .git in letter case are rejected regardless of the settings. Symbolic
+// links cannot be named .gitmodules either, as git would follow them when
+// reading submodule configuration.
+func (p *pathProtection) verify(name string, mode os.FileMode) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("invalid path %q", name)
+	case strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("invalid path %q: contains a slash or a NUL byte", name)
+	case strings.EqualFold(name, ".git"):
+		return fmt.Errorf("invalid path %q", name)
+	case mode == modeSymlink && strings.EqualFold(name, ".gitmodules"):
+		return fmt.Errorf("invalid path %q: symbolic link", name)
+	}
+	symlink := mode == modeSymlink
+	if p.hfs && (isHFSDotName(name, "git") || (symlink && isHFSDotName(name, "gitmodules"))) {
+		return fmt.Errorf("invalid path %q: same as .git on HFS+", name)
+	}
+	if p.ntfs {
+		if strings.IndexByte(name, '\\') >= 0 {
+			return fmt.Errorf("invalid path %q: contains a backslash", name)
+		}
+		if isNTFSDotGit(name) || (symlink && isNTFSDotName(name, "gitmodules", "gi7eba")) {
+			return fmt.Errorf("invalid path %q: same as .git on NTFS", name)
+		}
+	}
+	return nil
+}
+
+// isHFSDotName returns true if HFS+ would consider the name to be a dot
+// followed by the ASCII needle. HFS+ folds letter case and ignores some
+// Unicode code points.
+func isHFSDotName(name, needle string) bool {
+	next := func() rune {
+		for name != "" {
+			c, size := utf8.DecodeRuneInString(name)
+			name = name[size:]
+			if c == utf8.RuneError && size == 1 {
+				// Names are compared only up to invalid UTF-8.
+				return 0
+			}
+			switch {
+			case c >= 0x200c && c <= 0x200f, c >= 0x202a && c <= 0x202e, c >= 0x206a && c <= 0x206f, c == 0xfeff:
+				continue
+			}
+			return c
+		}
+		return 0
+	}
+	if next() != '.' {
+		return false
+	}
+	for i := 0; i < len(needle); i++ {
+		c := next()
+		if c >= utf8.RuneSelf || unicode.ToLower(c) != rune(needle[i]) {
+			return false
+		}
+	}
+	return next() == 0
+}
+
+// isNTFSDotGit returns true if NTFS would consider the name to be .git,
+// which includes its 8.3 short name git~1, trailing dots and spaces and
+// alternate data streams.
+func isNTFSDotGit(name string) bool {
+	var rest string
+	switch {
+	case len(name) >= 5 && strings.EqualFold(name[:5], "git~1"):
+		rest = name[5:]
+	case len(name) >= 4 && strings.EqualFold(name[:4], ".git"):
+		rest = name[4:]
+	default:
+		return false
+	}
+	return ntfsIgnoredSuffix(rest)
+}
+
+// isNTFSDotName returns true if NTFS would consider the name to be a dot
+// followed by the needle, or one of its 8.3 short names. Names longer than
+// six characters have short names that start with the first six characters
+// of the name, or with the short prefix derived from the hash of the name.
+func isNTFSDotName(name, needle, shortPrefix string) bool {
+	if len(name) > len(needle) && name[0] == '.' && strings.EqualFold(name[1:len(needle)+1], needle) {
+		return ntfsIgnoredSuffix(name[len(needle)+1:])
+	}
+	if len(name) >= 8 && strings.EqualFold(name[:6], needle[:6]) && name[6] == '~' && name[7] >= '1' && name[7] <= '4' {
+		return ntfsIgnoredSuffix(name[8:])
+	}
+
+	sawTilde := false
+	i := 0
+	for ; i < 8; i++ {
+		if i >= len(name) {
+			return false
+		}
+		c := name[i]
+		switch {
+		case sawTilde:
+			if c < '0' || c > '9' {
+				return false
+			}
+		case c == '~':
+			i++
+			if i >= len(name) || name[i] < '1' || name[i] > '9' {
+				return false
+			}
+			sawTilde = true
+		case i >= 6, c >= utf8.RuneSelf:
+			return false
+		case byte(unicode.ToLower(rune(c))) != shortPrefix[i]:
+			return false
+		}
+	}
+	return ntfsIgnoredSuffix(name[i:])
+}
+
+// ntfsIgnoredSuffix returns true if NTFS ignores the rest of a name, which is
+// either empty, made of dots and spaces, or an alternate data stream.
+func ntfsIgnoredSuffix(rest string) bool {
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case ':':
+			return true
+		case '.', ' ':
+			// Ignored.
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// checkTreeNames verifies names of entries of all trees reachable from tips,
+// so that received history cannot be checked out into a path that is not
+// safe. Objects that are in the known repository are not verified again.
+func (r *Repository) checkTreeNames(tips [][]byte, known *Repository) error {
+	protect, err := r.pathProtection()
+	if err != nil {
+		return err
+	}
+	return r.WalkObjects(tips, func(o *WalkedObject) error {
+		if known != nil {
+			if ok, err := known.HasObject(o.Sha); err != nil {
+				return err
+			} else if ok {
+				return SkipObject
+			}
+		}
+		tr, ok := o.Object.(*TreeObject)
+		if !ok {
+			return nil
+		}
+		for _, leaf := range tr.Leafs {
+			if err := protect.verify(leaf.Path, leaf.Mode); err != nil {
+				return fmt.Errorf("tree %x: %w", o.Sha, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathProtectionVerify(t *testing.T) {
+	cases := map[string]struct {
+		protect pathProtection
+		name    string
+		mode    os.FileMode
+		invalid bool
+	}{
+		"regular":                {name: "file.txt", mode: modeBlob},
+		"dot git":                {name: ".git", mode: modeTree, invalid: true},
+		"dot git upper case":     {name: ".GIT", mode: modeTree, invalid: true},
+		"dot dot":                {name: "..", mode: modeTree, invalid: true},
+		"slash":                  {name: "a/b", mode: modeBlob, invalid: true},
+		"gitmodules":             {name: ".gitmodules", mode: modeBlob},
+		"gitmodules symlink":     {name: ".gitmodules", mode: modeSymlink, invalid: true},
+		"short name unprotected": {name: "git~1", mode: modeTree},
+		"short name":             {protect: pathProtection{ntfs: true}, name: "GIT~1", mode: modeTree, invalid: true},
+		"trailing dots":          {protect: pathProtection{ntfs: true}, name: ".git. .", mode: modeTree, invalid: true},
+		"data stream":            {protect: pathProtection{ntfs: true}, name: ".git::$INDEX_ALLOCATION", mode: modeTree, invalid: true},
+		"longer name":            {protect: pathProtection{ntfs: true}, name: ".gitignore", mode: modeBlob},
+		"backslash":              {protect: pathProtection{ntfs: true}, name: "a\\b", mode: modeBlob, invalid: true},
+		"ntfs gitmodules":        {protect: pathProtection{ntfs: true}, name: "GITMOD~1", mode: modeSymlink, invalid: true},
+		"ntfs hashed gitmodules": {protect: pathProtection{ntfs: true}, name: "gi7eba~9", mode: modeSymlink, invalid: true},
+		"ntfs gitmodules file":   {protect: pathProtection{ntfs: true}, name: "GITMOD~1", mode: modeBlob},
+		"ignorable code points":  {protect: pathProtection{hfs: true}, name: ".g\u200cit", mode: modeTree, invalid: true},
+		"ignorable unprotected":  {name: ".g\u200cit", mode: modeTree},
+		"hfs gitmodules":         {protect: pathProtection{hfs: true}, name: ".GITMODULES\ufeff", mode: modeSymlink, invalid: true},
+		"hfs different name":     {protect: pathProtection{hfs: true}, name: ".g\u200cits", mode: modeTree},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.protect.verify(tc.name, tc.mode)
+			if tc.invalid && err == nil {
+				t.Fatal("want an error")
+			}
+			if !tc.invalid && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestFetchRejectsUnsafeTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream, err := CreateRepository(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatalf("create upstream repository: %s", err)
+	}
+	local, err := CreateRepository(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatalf("create local repository: %s", err)
+	}
+	blob, err := upstream.WriteObject("blob", []byte("[core]\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	tb := NewTreeBuilder(upstream, nil)
+	if err := tb.Insert("GIT~1/config", modeBlob, blob); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	tree, err := tb.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	if err := upstream.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: tree}); err != nil {
+		t.Fatalf("update upstream: %s", err)
+	}
+
+	tr, err := local.OpenTransport("file://" + filepath.ToSlash(upstream.workdir))
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	spec, err := ParseRefspec("refs/heads/*:refs/remotes/origin/*")
+	if err != nil {
+		t.Fatalf("parse refspec: %s", err)
+	}
+	if _, err := local.Fetch(tr, []*Refspec{spec}, nil); err == nil {
+		t.Fatal("fetch of an unsafe tree succeeded")
+	}
+	if _, err := local.ReadRef("refs/remotes/origin/master"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want no reference, got %v", err)
+	}
+	assertHasObject(t, local, tree, false)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Pathspec is a list of path patterns as accepted by commands that operate
+// on a subset of a tree or worktree. Patterns are relative to the directory
+// the command runs in, and matched paths to the repository root. Both use
+// forward slashes.
+//
+// Each pattern may be prefixed with magic signatures, either in the long
+// form ":(icase,glob)pattern" or the short form ":!pattern". Supported
+// magic words are icase, glob, literal, exclude and top, which makes the
+// pattern relative to the root, as does the short form ":/pattern".
+//
+// An empty pathspec matches every path.
+type Pathspec struct {
+	items []pathspecItem
+}
+
+type pathspecItem struct {
+	pattern string
+	icase   bool
+	glob    bool
+	literal bool
+	exclude bool
+	top     bool
+}
+
+// ParsePathspec parses given path arguments. Prefix is the slash terminated
+// directory they are relative to, which is empty for the repository root.
+// Returned pathspec is never nil.
+func ParsePathspec(prefix string, args []string) (*Pathspec, error) {
+	var ps Pathspec
+	for _, arg := range args {
+		item, err := parsePathspecItem(prefix, arg)
+		if err != nil {
+			return nil, fmt.Errorf("pathspec %q: %w", arg, err)
+		}
+		ps.items = append(ps.items, item)
+	}
+	return &ps, nil
+}
+
+func parsePathspecItem(prefix, arg string) (pathspecItem, error) {
+	var item pathspecItem
+	switch {
+	case strings.HasPrefix(arg, ":("):
+		end := strings.IndexByte(arg, ')')
+		if end == -1 {
+			return item, fmt.Errorf("missing ')' at the end of pathspec magic")
+		}
+		for _, magic := range strings.Split(arg[2:end], ",") {
+			switch magic {
+			case "icase":
+				item.icase = true
+			case "glob":
+				item.glob = true
+			case "literal":
+				item.literal = true
+			case "exclude":
+				item.exclude = true
+			case "top":
+				item.top = true
+			case "":
+			default:
+				return item, fmt.Errorf("unsupported magic %q", magic)
+			}
+		}
+		arg = arg[end+1:]
+	case strings.HasPrefix(arg, ":"):
+		arg = arg[1:]
+	shortMagic:
+		for len(arg) > 0 {
+			switch arg[0] {
+			case '!', '^':
+				item.exclude = true
+			case '/':
+				item.top = true
+			case ':':
+				arg = arg[1:]
+				break shortMagic
+			default:
+				break shortMagic
+			}
+			arg = arg[1:]
+		}
+	}
+	if item.glob && item.literal {
+		return item, fmt.Errorf("glob and literal magic are incompatible")
+	}
+	item.pattern = strings.TrimPrefix(arg, "./")
+	if prefix != "" && !item.top {
+		pattern := path.Clean(prefix + item.pattern)
+		if pattern == ".." || strings.HasPrefix(pattern, "../") {
+			return item, fmt.Errorf("outside of the repository")
+		}
+		if strings.HasSuffix(item.pattern, "/") {
+			// A trailing slash selects only directories.
+			pattern += "/"
+		}
+		item.pattern = pattern
+	}
+	if item.icase {
+		item.pattern = strings.ToLower(item.pattern)
+	}
+	return item, nil
+}
+
+// args returns arguments that parse to the pathspec regardless of the
+// directory they are relative to.
+func (ps *Pathspec) args() []string {
+	var args []string
+	for _, item := range ps.items {
+		magic := []string{"top"}
+		for _, m := range []struct {
+			word string
+			set  bool
+		}{{"icase", item.icase}, {"glob", item.glob}, {"literal", item.literal}, {"exclude", item.exclude}} {
+			if m.set {
+				magic = append(magic, m.word)
+			}
+		}
+		args = append(args, ":("+strings.Join(magic, ",")+")"+item.pattern)
+	}
+	return args
+}
+
+// cwdPrefix returns the slash terminated path of the current directory
+// relative to the worktree root, which pathspecs given on the command line
+// are relative to. It is empty at the root and outside of the worktree.
+func (r *Repository) cwdPrefix() (string, error) {
+	if r.workdir == "" {
+		return "", nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("getwd: %w", err)
+	}
+	rel, err := filepath.Rel(r.workdir, cwd)
+	if err != nil {
+		return "", nil
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", nil
+	}
+	return rel + "/", nil
+}
+
+// parseCwdPathspec parses pathspec arguments given on the command line,
+// which are relative to the current directory.
+func (r *Repository) parseCwdPathspec(args []string) (*Pathspec, error) {
+	prefix, err := r.cwdPrefix()
+	if err != nil {
+		return nil, err
+	}
+	return ParsePathspec(prefix, args)
+}
+
+// IsEmpty returns true if pathspec contains no patterns and therefore
+// matches everything.
+func (ps *Pathspec) IsEmpty() bool {
+	return ps == nil || len(ps.items) == 0
+}
+
+// Match returns true if given path is selected by the pathspec. A path is
+// selected if it matches at least one of the positive patterns (or there
+// are none) and does not match any of the exclude patterns.
+func (ps *Pathspec) Match(path string) bool {
+	if ps.IsEmpty() {
+		return true
+	}
+	var (
+		included    bool
+		hasPositive bool
+	)
+	for _, item := range ps.items {
+		if item.exclude {
+			if item.match(path) {
+				return false
+			}
+			continue
+		}
+		hasPositive = true
+		if !included && item.match(path) {
+			included = true
+		}
+	}
+	return included || !hasPositive
+}
+
+func (it *pathspecItem) match(path string) bool {
+	if it.icase {
+		path = strings.ToLower(path)
+	}
+	pattern := strings.TrimSuffix(it.pattern, "/")
+	if pattern == "" || pattern == "." {
+		return true
+	}
+	// Directory prefix matches regardless of the magic used. A glob
+	// pattern matching a directory does not select the paths below it.
+	if path == pattern || strings.HasPrefix(path, pattern+"/") {
+		return true
+	}
+	if it.literal {
+		return false
+	}
+	if it.glob {
+		return wildmatch(pattern, path, true)
+	}
+	return wildmatch(pattern, path, false)
+}
+
+// wildmatch implements fnmatch-like matching with *, ? and [...] classes.
+// When pathname is set, wildcards do not match the slash, except for "**",
+// which matches any number of directories.
+func wildmatch(pattern, name string, pathname bool) bool {
+	for len(pattern) > 0 {
+		switch c := pattern[0]; c {
+		case '*':
+			if pathname && strings.HasPrefix(pattern, "**") {
+				rest := strings.TrimLeft(pattern, "*")
+				if strings.HasPrefix(rest, "/") {
+					// "**/" matches zero or more leading directories.
+					if wildmatch(rest[1:], name, pathname) {
+						return true
+					}
+				}
+				for i := 0; i <= len(name); i++ {
+					if wildmatch(rest, name[i:], pathname) {
+						return true
+					}
+				}
+				return false
+			}
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if wildmatch(rest, name[i:], pathname) {
+					return true
+				}
+				if i < len(name) && pathname && name[i] == '/' {
+					return false
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 || (pathname && name[0] == '/') {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		case '[':
+			if len(name) == 0 || (pathname && name[0] == '/') {
+				return false
+			}
+			ok, width := matchClass(pattern, name[0])
+			if width == 0 {
+				// Unterminated class is matched literally.
+				if name[0] != '[' {
+					return false
+				}
+				width = 1
+			} else if !ok {
+				return false
+			}
+			pattern, name = pattern[width:], name[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return len(name) == 0
+}
+
+// matchClass matches a single character against the bracket expression at
+// the beginning of the pattern. It returns the length of the expression or
+// zero if the expression is not terminated.
+func matchClass(pattern string, c byte) (bool, int) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+	matched := false
+	for first := true; i < len(pattern); first = false {
+		if pattern[i] == ']' && !first {
+			return matched != negate, i + 1
+		}
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, 0
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPathspecMatch(t *testing.T) {
+	cases := map[string]struct {
+		prefix string
+		spec   []string
+		path   string
+		want   bool
+	}{
+		"empty": {
+			spec: nil,
+			path: "any/path",
+			want: true,
+		},
+		"exact": {
+			spec: []string{"README.md"},
+			path: "README.md",
+			want: true,
+		},
+		"directory prefix": {
+			spec: []string{"src"},
+			path: "src/main.go",
+			want: true,
+		},
+		"directory prefix with trailing slash": {
+			spec: []string{"src/"},
+			path: "src/main.go",
+			want: true,
+		},
+		"not a directory prefix": {
+			spec: []string{"src"},
+			path: "srcx/main.go",
+			want: false,
+		},
+		"wildcard crosses directories": {
+			spec: []string{"*.go"},
+			path: "src/main.go",
+			want: true,
+		},
+		"glob wildcard does not cross directories": {
+			spec: []string{":(glob)*.go"},
+			path: "src/main.go",
+			want: false,
+		},
+		"glob double star": {
+			spec: []string{":(glob)**/*.go"},
+			path: "src/pkg/main.go",
+			want: true,
+		},
+		"glob double star zero directories": {
+			spec: []string{":(glob)**/main.go"},
+			path: "main.go",
+			want: true,
+		},
+		"glob wildcard does not select directories": {
+			spec: []string{":(glob)src/*"},
+			path: "src/sub/c.go",
+			want: false,
+		},
+		"glob wildcard": {
+			spec: []string{":(glob)src/*"},
+			path: "src/c.go",
+			want: true,
+		},
+		"literal": {
+			spec: []string{":(literal)*.go"},
+			path: "main.go",
+			want: false,
+		},
+		"literal exact": {
+			spec: []string{":(literal)*.go"},
+			path: "*.go",
+			want: true,
+		},
+		"icase": {
+			spec: []string{":(icase)readme.MD"},
+			path: "README.md",
+			want: true,
+		},
+		"character class": {
+			spec: []string{"file[0-9].txt"},
+			path: "file7.txt",
+			want: true,
+		},
+		"negated character class": {
+			spec: []string{"file[!0-9].txt"},
+			path: "file7.txt",
+			want: false,
+		},
+		"exclude only": {
+			spec: []string{":!vendor"},
+			path: "main.go",
+			want: true,
+		},
+		"exclude short magic": {
+			spec: []string{"src", ":!src/vendor"},
+			path: "src/vendor/lib.go",
+			want: false,
+		},
+		"exclude long magic": {
+			spec: []string{":(exclude)*.md"},
+			path: "docs/intro.md",
+			want: false,
+		},
+		"exclude caret": {
+			spec: []string{":^*.md"},
+			path: "docs/intro.md",
+			want: false,
+		},
+		"no positive match": {
+			spec: []string{"docs", ":!*.md"},
+			path: "main.go",
+			want: false,
+		},
+		"prefix": {
+			prefix: "src/",
+			spec:   []string{"sub"},
+			path:   "src/sub/n.go",
+			want:   true,
+		},
+		"prefix not matching the root": {
+			prefix: "src/",
+			spec:   []string{"sub"},
+			path:   "sub/n.go",
+			want:   false,
+		},
+		"prefix current directory": {
+			prefix: "src/",
+			spec:   []string{"."},
+			path:   "main.go",
+			want:   false,
+		},
+		"prefix parent directory": {
+			prefix: "src/sub/",
+			spec:   []string{"../c.go"},
+			path:   "src/c.go",
+			want:   true,
+		},
+		"prefix wildcard": {
+			prefix: "src/",
+			spec:   []string{"*.go"},
+			path:   "src/sub/n.go",
+			want:   true,
+		},
+		"prefix exclude": {
+			prefix: "src/",
+			spec:   []string{":!sub"},
+			path:   "sub/n.go",
+			want:   true,
+		},
+		"top long magic": {
+			prefix: "src/",
+			spec:   []string{":(top)sub"},
+			path:   "sub/n.go",
+			want:   true,
+		},
+		"top short magic": {
+			prefix: "src/",
+			spec:   []string{":/README.md"},
+			path:   "README.md",
+			want:   true,
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			ps, err := ParsePathspec(tc.prefix, tc.spec)
+			if err != nil {
+				t.Fatalf("parse: %+v", err)
+			}
+			if got := ps.Match(tc.path); got != tc.want {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+			// The arguments recorded to resume from any directory.
+			top, err := ParsePathspec("other/", ps.args())
+			if err != nil {
+				t.Fatalf("parse %q: %+v", ps.args(), err)
+			}
+			if got := top.Match(tc.path); got != tc.want {
+				t.Fatalf("%q: want %v, got %v", ps.args(), tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParsePathspecErrors(t *testing.T) {
+	cases := map[string]string{
+		"unterminated magic": ":(glob",
+		"unknown magic":      ":(foo)bar",
+		"glob and literal":   ":(glob,literal)bar",
+		"outside":            "../../bar",
+	}
+	for testName, arg := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if _, err := ParsePathspec("src/", []string{arg}); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
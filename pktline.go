@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// pkt-line framing used by the git wire protocol. Each line is prefixed
+// with its length, including the four bytes of the prefix, written as hex.
+// A flush packet "0000" has no payload and ends a section of the message.
+// Protocol version 2 also separates sections with a delimiter packet "0001".
+
+const maxPktLineData = 65516
+
+// writePktLine writes a single formatted pkt-line.
+func writePktLine(w io.Writer, format string, args ...interface{}) error {
+	line := fmt.Sprintf(format, args...)
+	if len(line) > maxPktLineData {
+		return fmt.Errorf("pkt-line too long: %d", len(line))
+	}
+	_, err := fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+	return err
+}
+
+// errDelimPkt is returned by readPktLine for a delimiter packet.
+var errDelimPkt = errors.New("unexpected delimiter packet")
+
+// writeDelimPkt writes a delimiter packet.
+func writeDelimPkt(w io.Writer) error {
+	_, err := io.WriteString(w, "0001")
+	return err
+}
+
+// writeFlushPkt writes a flush packet.
+func writeFlushPkt(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// readPktLine reads a single pkt-line. Nil payload is returned for a flush
+// packet, and errDelimPkt for a delimiter packet.
+func readPktLine(r io.Reader) ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read pkt-line length: %w", err)
+	}
+	size, err := strconv.ParseUint(string(prefix[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", prefix[:])
+	}
+	switch {
+	case size == 0:
+		return nil, nil
+	case size == 1:
+		return nil, errDelimPkt
+	case size < 4:
+		return nil, fmt.Errorf("invalid pkt-line length %d", size)
+	}
+	line := make([]byte, size-4)
+	if _, err := io.ReadFull(r, line); err != nil {
+		return nil, fmt.Errorf("read pkt-line: %w", err)
+	}
+	return line, nil
+}
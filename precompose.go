@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Hangul syllables are composed algorithmically from a leading consonant, a
+// vowel and an optional trailing consonant.
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// precomposeUnicode returns the name in the NFC form, with decomposed
+// characters composed. File systems of macOS return names in a decomposed
+// form, while repositories store names as they were typed, which usually is
+// precomposed. Names that are not valid UTF-8 are returned as they are.
+func precomposeUnicode(name string) string {
+	ascii := true
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii || !utf8.ValidString(name) {
+		return name
+	}
+
+	composed := make([]rune, 0, len(name))
+	starter := -1
+	// Combining class of the last character that was not composed with the
+	// starter.
+	var lastClass uint8
+	for _, c := range name {
+		class := combiningClass(c)
+		if starter >= 0 && (starter == len(composed)-1 || (lastClass != 0 && lastClass < class)) {
+			if pair, ok := composePair(composed[starter], c); ok {
+				composed[starter] = pair
+				continue
+			}
+		}
+		if class == 0 {
+			starter = len(composed)
+		}
+		lastClass = class
+		composed = append(composed, c)
+	}
+	return string(composed)
+}
+
+func composePair(a, b rune) (rune, bool) {
+	switch {
+	case a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount:
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+b-hangulVBase)*hangulTCount, true
+	case a >= hangulSBase && a < hangulSBase+hangulSCount && (a-hangulSBase)%hangulTCount == 0 && b > hangulTBase && b < hangulTBase+hangulTCount:
+		return a + b - hangulTBase, true
+	}
+	c, ok := compositions[[2]rune{a, b}]
+	return c, ok
+}
+
+func combiningClass(c rune) uint8 {
+	i := sort.Search(len(combiningClasses), func(i int) bool {
+		return combiningClasses[i].hi >= c
+	})
+	if i < len(combiningClasses) && combiningClasses[i].lo <= c {
+		return combiningClasses[i].class
+	}
+	return 0
+}
+
+// worktreePaths compares paths read from the worktree, or given by the user,
+// with paths of the index, following the core.precomposeUnicode and
+// core.ignoreCase settings.
+type worktreePaths struct {
+	precompose bool
+	ignoreCase bool
+}
+
+func (r *Repository) worktreePaths() (*worktreePaths, error) {
+	precompose, err := r.config.Bool("core", "", "precomposeUnicode", false)
+	if err != nil {
+		return nil, err
+	}
+	ignoreCase, err := r.config.Bool("core", "", "ignoreCase", false)
+	if err != nil {
+		return nil, err
+	}
+	return &worktreePaths{precompose: precompose, ignoreCase: ignoreCase}, nil
+}
+
+// name returns the path as it is stored in the index.
+func (p *worktreePaths) name(path string) string {
+	if p.precompose {
+		return precomposeUnicode(path)
+	}
+	return path
+}
+
+// entry returns the index entry of the path, at any stage. With ignoreCase,
+// an entry of the path that differs only in letter case is returned.
+func (p *worktreePaths) entry(idx *Index, path string) *IndexEntry {
+	path = p.name(path)
+	i, _ := idx.entry(path)
+	if i < len(idx.Entries) && idx.Entries[i].Path == path {
+		return idx.Entries[i]
+	}
+	if p.ignoreCase {
+		for _, e := range idx.Entries {
+			if strings.EqualFold(e.Path, path) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// probeIgnoreCase returns true if the file system of the directory does not
+// tell apart names that differ only in letter case. The directory must
+// contain the config file.
+func probeIgnoreCase(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "CoNfIg"))
+	return err == nil
+}
+
+// probePrecompose returns true if a file created in the directory with a
+// precomposed name can be found by its decomposed name.
+func probePrecompose(dir string) bool {
+	path := filepath.Join(dir, "\u00c4")
+	fd, err := os.Create(path)
+	if err != nil {
+		return false
+	}
+	fd.Close()
+	defer os.Remove(path)
+	_, err = os.Stat(filepath.Join(dir, "A\u0308"))
+	return err == nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPrecomposeUnicode(t *testing.T) {
+	cases := map[string]struct {
+		name string
+		want string
+	}{
+		"ascii":         {name: "dir/file.txt", want: "dir/file.txt"},
+		"decomposed":    {name: "A\u0308pfel/cafe\u0301", want: "\u00c4pfel/caf\u00e9"},
+		"precomposed":   {name: "\u00c4pfel", want: "\u00c4pfel"},
+		"two marks":     {name: "e\u0323\u0302", want: "\u1ec7"},
+		"not blocked":   {name: "a\u0316\u0301", want: "\u00e1\u0316"},
+		"blocked":       {name: "a\u0301\u0301", want: "\u00e1\u0301"},
+		"hangul":        {name: "\u1112\u1161\u11ab", want: "\ud55c"},
+		"invalid utf8":  {name: "a\xffe\u0301", want: "a\xffe\u0301"},
+		"mark at start": {name: "\u0301a", want: "\u0301a"},
+		"excluded":      {name: "\u0915\u093c", want: "\u0915\u093c"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := precomposeUnicode(tc.name); got != tc.want {
+				t.Fatalf("want %+q, got %+q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWorktreePathsEntry(t *testing.T) {
+	idx := &Index{Entries: []*IndexEntry{
+		{Path: "Makefile"},
+		{Path: "caf\u00e9.txt"},
+		{Path: "conflict", Stage: 2},
+	}}
+	cases := map[string]struct {
+		paths worktreePaths
+		path  string
+		want  string
+	}{
+		"exact":               {path: "Makefile", want: "Makefile"},
+		"case differs":        {path: "makefile"},
+		"ignore case":         {paths: worktreePaths{ignoreCase: true}, path: "MAKEFILE", want: "Makefile"},
+		"decomposed":          {path: "cafe\u0301.txt"},
+		"precompose":          {paths: worktreePaths{precompose: true}, path: "cafe\u0301.txt", want: "caf\u00e9.txt"},
+		"precompose and case": {paths: worktreePaths{precompose: true, ignoreCase: true}, path: "CAFE\u0301.txt", want: "caf\u00e9.txt"},
+		"unmerged":            {path: "conflict", want: "conflict"},
+		"missing":             {paths: worktreePaths{ignoreCase: true}, path: "missing"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var got string
+			if e := tc.paths.entry(idx, tc.path); e != nil {
+				got = e.Path
+			}
+			if got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Date formats of the pretty format placeholders.
+const (
+	rfc2822DateFormat   = "Mon, 2 Jan 2006 15:04:05 -0700"
+	isoDateFormat       = "2006-01-02 15:04:05 -0700"
+	strictISODateFormat = "2006-01-02T15:04:05-07:00"
+	shortDateFormat     = "2006-01-02"
+)
+
+// formatCommit expands the placeholders of a git log --format string for
+// the commit. Supported are the hashes (%H, %h, %T, %t, %P, %p), author and
+// committer identities and dates (%an, %ae, %al, %ad, %aD, %ai, %aI, %as,
+// %at and the same for %c), the message (%s, %b, %B) and the literals (%n,
+// %%, %xNN). Placeholders that are not known are copied as they are.
+func formatCommit(format string, sha []byte, c *CommitObject) string {
+	header := func(name string) string {
+		if values := c.Header[name]; len(values) != 0 {
+			return values[0]
+		}
+		return ""
+	}
+	subject, body := splitCommitMessage(c.Comment)
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		placeholder := format[i+1:]
+		n := 1
+		switch placeholder[0] {
+		case 'H':
+			b.WriteString(hex.EncodeToString(sha))
+		case 'h':
+			b.WriteString(shortHash(sha))
+		case 'T':
+			b.WriteString(header("tree"))
+		case 't':
+			if tree := header("tree"); len(tree) >= 7 {
+				b.WriteString(tree[:7])
+			}
+		case 'P', 'p':
+			for j, parent := range c.Header["parent"] {
+				if j > 0 {
+					b.WriteByte(' ')
+				}
+				if placeholder[0] == 'p' && len(parent) >= 7 {
+					parent = parent[:7]
+				}
+				b.WriteString(parent)
+			}
+		case 'a', 'c':
+			name := "author"
+			if placeholder[0] == 'c' {
+				name = "committer"
+			}
+			if len(placeholder) < 2 {
+				n = 0
+				break
+			}
+			n = 2
+			id, err := parseIdent(header(name))
+			if err != nil {
+				// Git writes nothing for a malformed identity.
+				if strings.IndexByte("nNeElLdDiIst", placeholder[1]) < 0 {
+					n = 0
+				}
+				break
+			}
+			switch placeholder[1] {
+			case 'n', 'N':
+				b.WriteString(id.Name)
+			case 'e', 'E':
+				b.WriteString(id.Email)
+			case 'l', 'L':
+				local := id.Email
+				if at := strings.IndexByte(local, '@'); at >= 0 {
+					local = local[:at]
+				}
+				b.WriteString(local)
+			case 'd':
+				b.WriteString(id.When.Format(logDateFormat))
+			case 'D':
+				b.WriteString(id.When.Format(rfc2822DateFormat))
+			case 'i':
+				b.WriteString(id.When.Format(isoDateFormat))
+			case 'I':
+				b.WriteString(id.When.Format(strictISODateFormat))
+			case 's':
+				b.WriteString(id.When.Format(shortDateFormat))
+			case 't':
+				b.WriteString(strconv.FormatInt(id.When.Unix(), 10))
+			default:
+				n = 0
+			}
+		case 's':
+			b.WriteString(subject)
+		case 'b':
+			b.WriteString(body)
+		case 'B':
+			b.WriteString(c.Comment)
+		case 'n':
+			b.WriteByte('\n')
+		case '%':
+			b.WriteByte('%')
+		case 'x':
+			if len(placeholder) < 3 {
+				n = 0
+				break
+			}
+			v, err := strconv.ParseUint(placeholder[1:3], 16, 8)
+			if err != nil {
+				n = 0
+				break
+			}
+			b.WriteByte(byte(v))
+			n = 3
+		default:
+			n = 0
+		}
+		if n == 0 {
+			b.WriteByte('%')
+			continue
+		}
+		i += n
+	}
+	return b.String()
+}
+
+// splitCommitMessage returns the subject of the message, the first
+// paragraph with lines joined by spaces, and the body that follows it.
+func splitCommitMessage(message string) (subject, body string) {
+	lines := strings.SplitAfter(message, "\n")
+	i := 0
+	// Leading empty lines are not part of the subject.
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	var parts []string
+	for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+		parts = append(parts, strings.TrimSpace(lines[i]))
+	}
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	return strings.Join(parts, " "), strings.Join(lines[i:], "")
+}
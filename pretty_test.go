@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestFormatCommit(t *testing.T) {
+	sha, _ := hex.DecodeString("0d4450fec727e89faa9f81cdd1ba15f236e8ce73")
+	c := &CommitObject{
+		Header: map[string][]string{
+			"tree":      {"79d15d3a1876d88007012a3bbde65ecc6124d336"},
+			"parent":    {"1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"},
+			"author":    {"A U Thor <author@example.com> 1600000000 +0200"},
+			"committer": {"C O Mitter <committer@example.com> 1600000100 -0130"},
+		},
+		Comment: "Subject line\ncontinued\n\n\nBody text.\n",
+	}
+
+	cases := map[string]struct {
+		format string
+		want   string
+	}{
+		"hashes": {
+			format: "%H %h %T %t",
+			want:   "0d4450fec727e89faa9f81cdd1ba15f236e8ce73 0d4450f 79d15d3a1876d88007012a3bbde65ecc6124d336 79d15d3",
+		},
+		"parents": {
+			format: "%P|%p",
+			want:   "1111111111111111111111111111111111111111 2222222222222222222222222222222222222222|1111111 2222222",
+		},
+		"author": {
+			format: "%an <%ae> %al",
+			want:   "A U Thor <author@example.com> author",
+		},
+		"author dates": {
+			format: "%ad|%aD|%ai|%aI|%as|%at",
+			want:   "Sun Sep 13 14:26:40 2020 +0200|Sun, 13 Sep 2020 14:26:40 +0200|2020-09-13 14:26:40 +0200|2020-09-13T14:26:40+02:00|2020-09-13|1600000000",
+		},
+		"committer": {
+			format: "%cn %ce %cd",
+			want:   "C O Mitter committer@example.com Sun Sep 13 10:58:20 2020 -0130",
+		},
+		"message": {
+			format: "[%s][%b]",
+			want:   "[Subject line continued][Body text.\n]",
+		},
+		"raw message": {
+			format: "%B",
+			want:   "Subject line\ncontinued\n\n\nBody text.\n",
+		},
+		"literals": {
+			format: "%n%%%x41",
+			want:   "\n%A",
+		},
+		"unknown placeholders": {
+			format: "%q %a %aq %xZZ %",
+			want:   "%q %a %aq %xZZ %",
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if got := formatCommit(tc.format, sha, c); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
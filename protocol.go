@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Transports that can be used are restricted, so that a URL that comes from
+// an untrusted source, for example .gitmodules of a cloned repository,
+// cannot make a command run programs or read local files.
+//
+// If GIT_ALLOW_PROTOCOL is set, it is a colon separated list of the only
+// allowed transports. Otherwise protocol.<name>.allow or protocol.allow is
+// one of:
+//
+//	always  the transport can be used
+//	never   the transport cannot be used
+//	user    the transport can be used unless GIT_PROTOCOL_FROM_USER is false,
+//	        which is set by commands that use URLs they did not get from
+//	        the user
+//
+// Without configuration, transports known to be safe can always be used,
+// ext that runs any command never, and all the others, including local
+// paths, are of the user policy.
+var defaultProtocolPolicies = map[string]string{
+	"git":   "always",
+	"http":  "always",
+	"https": "always",
+	"ssh":   "always",
+	"ext":   "never",
+}
+
+// transportName returns the name of the transport that serves the URL, as
+// used by protocol.<name>.allow.
+func transportName(url string) string {
+	if helper, _, ok := helperURL(url); ok {
+		return helper
+	}
+	if i := strings.Index(url, "://"); i >= 0 {
+		return url[:i]
+	}
+	if isSCPLikeURL(url) {
+		return "ssh"
+	}
+	return "file"
+}
+
+// checkProtocol returns an error if the transport is not allowed.
+func (r *Repository) checkProtocol(name string) error {
+	if list, ok := os.LookupEnv("GIT_ALLOW_PROTOCOL"); ok {
+		for _, allowed := range strings.Split(list, ":") {
+			if allowed == name {
+				return nil
+			}
+		}
+		return fmt.Errorf("transport '%s' not allowed", name)
+	}
+	policy, ok := r.config.Get("protocol", name, "allow")
+	if !ok {
+		policy, ok = r.config.Get("protocol", "", "allow")
+	}
+	if !ok {
+		if policy, ok = defaultProtocolPolicies[name]; !ok {
+			policy = "user"
+		}
+	}
+	switch policy {
+	case "always":
+		return nil
+	case "never":
+	case "user":
+		fromUser := true
+		if v := os.Getenv("GIT_PROTOCOL_FROM_USER"); v != "" {
+			var err error
+			if fromUser, err = parseConfigBool(v); err != nil {
+				return fmt.Errorf("GIT_PROTOCOL_FROM_USER: %w", err)
+			}
+		}
+		if fromUser {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown value for protocol.allow: %s", policy)
+	}
+	return fmt.Errorf("transport '%s' not allowed", name)
+}
+
+// wireProtocolVersion returns the version of the upload-pack protocol set by
+// protocol.version, 2 by default, the same as in git. Servers that do not
+// support version 2 respond in version 0, so it only has to be lowered for
+// servers that misbehave.
+func (r *Repository) wireProtocolVersion() (int, error) {
+	v, err := r.config.Int("protocol", "", "version", 2)
+	if err != nil {
+		return 0, err
+	}
+	switch v {
+	case 0, 1:
+		// Version 1 only adds a version line to version 0.
+		return 0, nil
+	case 2:
+		return 2, nil
+	default:
+		return 0, fmt.Errorf("unknown value for protocol.version: %d", v)
+	}
+}
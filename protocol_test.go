@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckProtocol(t *testing.T) {
+	cases := map[string]struct {
+		config    string
+		allowList string
+		fromUser  string
+		url       string
+		want      bool
+	}{
+		"default safe":         {url: "ssh://example.com/repo", want: true},
+		"default never":        {url: "ext::sh -c touch% /tmp/pwned", want: false},
+		"default user":         {url: "/srv/repo", want: true},
+		"default not the user": {url: "/srv/repo", fromUser: "0", want: false},
+		"user for safe":        {url: "git://example.com/repo", fromUser: "0", want: true},
+		"protocol never":       {config: "[protocol]\n\tallow = never\n", url: "git@example.com:repo", want: false},
+		"transport overrides": {
+			config: "[protocol]\n\tallow = never\n[protocol \"file\"]\n\tallow = always\n",
+			url:    "file:///srv/repo", fromUser: "0", want: true,
+		},
+		"allow list":             {allowList: "https:ssh", url: "example.com:repo", want: true},
+		"not in allow list":      {allowList: "https:ssh", url: "git://example.com/repo", want: false},
+		"allow list over config": {config: "[protocol \"file\"]\n\tallow = never\n", allowList: "file", url: "/srv/repo", want: true},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			repo := &Repository{}
+			var err error
+			if repo.config, err = ParseConfig(strings.NewReader(tc.config)); err != nil {
+				t.Fatalf("parse config: %s", err)
+			}
+			for name, value := range map[string]string{"GIT_ALLOW_PROTOCOL": tc.allowList, "GIT_PROTOCOL_FROM_USER": tc.fromUser} {
+				if value == "" {
+					os.Unsetenv(name)
+				} else {
+					os.Setenv(name, value)
+					defer os.Unsetenv(name)
+				}
+			}
+			err = repo.checkProtocol(transportName(tc.url))
+			if got := err == nil; got != tc.want {
+				t.Fatalf("want allowed %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of PushOptions.Signed.
+const (
+	PushSignedNever   = ""
+	PushSignedAlways  = "true"
+	PushSignedIfAsked = "if-asked"
+)
+
+// PushOptions control how references are pushed.
+type PushOptions struct {
+	// Options are passed to the hooks of the receiving repository, which
+	// must accept them with receive.advertisePushOptions.
+	Options []string
+	// Signed requests a push certificate, signed with the key of the
+	// pusher, that records the updated references. With
+	// PushSignedIfAsked the push is not signed when the receiving
+	// repository does not support certificates.
+	Signed string
+	// DryRun reports the changes that would be sent without sending
+	// them.
+	DryRun bool
+}
+
+// pushCertNonce returns the nonce the receiving repository at path expects
+// in a push certificate created at given time. The seed is the value of the
+// receive.certNonceSeed setting.
+func pushCertNonce(seed, path string, stamp int64) string {
+	mac := hmac.New(sha1.New, []byte(seed))
+	fmt.Fprintf(mac, "%s:%d", path, stamp)
+	return fmt.Sprintf("%d-%s", stamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// PushCert is a push certificate, the signed statement of a pusher about
+// references it updates.
+type PushCert struct {
+	Pusher  string
+	Pushee  string
+	Nonce   string
+	Options []string
+	Changes []*RefChange
+}
+
+// Serialize returns the certificate without the signature.
+func (c *PushCert) Serialize() []byte {
+	var b bytes.Buffer
+	b.WriteString("certificate version 0.1\n")
+	fmt.Fprintf(&b, "pusher %s\n", c.Pusher)
+	if c.Pushee != "" {
+		fmt.Fprintf(&b, "pushee %s\n", c.Pushee)
+	}
+	fmt.Fprintf(&b, "nonce %s\n", c.Nonce)
+	for _, o := range c.Options {
+		fmt.Fprintf(&b, "push-option %s\n", o)
+	}
+	b.WriteString("\n")
+	for _, ch := range c.Changes {
+		fmt.Fprintf(&b, "%s %s %s\n", rawDiffHash(ch.Old), rawDiffHash(ch.New), ch.Dst)
+	}
+	return b.Bytes()
+}
+
+// parsePushCert parses a certificate without the signature.
+func parsePushCert(raw []byte) (*PushCert, error) {
+	var c PushCert
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+	if len(lines) == 0 || lines[0] != "certificate version 0.1" {
+		return nil, errors.New("unsupported push certificate version")
+	}
+	i := 1
+	for ; i < len(lines) && lines[i] != ""; i++ {
+		chunks := strings.SplitN(lines[i], " ", 2)
+		if len(chunks) != 2 {
+			return nil, fmt.Errorf("invalid push certificate line %q", lines[i])
+		}
+		switch chunks[0] {
+		case "pusher":
+			c.Pusher = chunks[1]
+		case "pushee":
+			c.Pushee = chunks[1]
+		case "nonce":
+			c.Nonce = chunks[1]
+		case "push-option":
+			c.Options = append(c.Options, chunks[1])
+		}
+	}
+	for i++; i < len(lines); i++ {
+		chunks := strings.SplitN(lines[i], " ", 3)
+		if len(chunks) != 3 {
+			return nil, fmt.Errorf("invalid push certificate command %q", lines[i])
+		}
+		old, err1 := hex.DecodeString(chunks[0])
+		sha, err2 := hex.DecodeString(chunks[1])
+		if err1 != nil || err2 != nil || len(old) != 20 || len(sha) != 20 {
+			return nil, fmt.Errorf("invalid push certificate command %q", lines[i])
+		}
+		c.Changes = append(c.Changes, &RefChange{Dst: chunks[2], Old: nilIfZero(old), New: nilIfZero(sha)})
+	}
+	return &c, nil
+}
+
+func nilIfZero(sha []byte) []byte {
+	if bytes.Equal(sha, make([]byte, len(sha))) {
+		return nil
+	}
+	return sha
+}
+
+// signPushCert creates a signed certificate of changes for the receiving
+// repository at url, with the nonce it asked for.
+func (r *Repository) signPushCert(url, nonce string, opts *PushOptions, changes []*RefChange) ([]byte, error) {
+	pusher, err := r.committerIdent()
+	if err != nil {
+		return nil, err
+	}
+	cert := &PushCert{
+		Pusher:  pusher.String(),
+		Pushee:  url,
+		Nonce:   nonce,
+		Options: opts.Options,
+		Changes: changes,
+	}
+	payload := cert.Serialize()
+	signature, err := r.signPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	return append(payload, signature...), nil
+}
+
+// receivePushCert verifies a signed certificate sent along with updates,
+// stores it as a blob and returns the environment variables describing it
+// to hooks. The nonce is the one the repository asked for.
+func (r *Repository) receivePushCert(raw []byte, nonce string, updates []*RefUpdate) ([]string, error) {
+	payload, signature := tagSignedPayload(raw)
+	cert, err := parsePushCert(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(cert.Changes) != len(updates) {
+		return nil, errors.New("inconsistent push certificate")
+	}
+	for i, c := range cert.Changes {
+		u := updates[i]
+		if c.Dst != u.Name || !bytes.Equal(c.Old, u.OldSha) || !bytes.Equal(c.New, u.Sha) {
+			return nil, errors.New("inconsistent push certificate")
+		}
+	}
+	sha, err := r.WriteObject("blob", raw)
+	if err != nil {
+		return nil, fmt.Errorf("write push certificate: %w", err)
+	}
+	v := &SignatureVerification{Status: SignatureNone}
+	if signature != nil {
+		if v, err = r.verifySignature(payload, signature); err != nil {
+			return nil, err
+		}
+	}
+	nonceStatus := "OK"
+	switch {
+	case cert.Nonce == "":
+		nonceStatus = "MISSING"
+	case cert.Nonce != nonce:
+		nonceStatus = "BAD"
+	}
+	return []string{
+		"GIT_PUSH_CERT=" + hex.EncodeToString(sha),
+		"GIT_PUSH_CERT_SIGNER=" + v.Signer,
+		"GIT_PUSH_CERT_KEY=" + v.Key,
+		"GIT_PUSH_CERT_STATUS=" + v.Status,
+		"GIT_PUSH_CERT_NONCE=" + cert.Nonce,
+		"GIT_PUSH_CERT_NONCE_STATUS=" + nonceStatus,
+	}, nil
+}
+
+// pushOptionsEnv returns the environment variables passing push options to
+// hooks.
+func pushOptionsEnv(options []string) []string {
+	env := []string{"GIT_PUSH_OPTION_COUNT=" + strconv.Itoa(len(options))}
+	for i, o := range options {
+		env = append(env, fmt.Sprintf("GIT_PUSH_OPTION_%d=%s", i, o))
+	}
+	return env
+}
+
+// certNonce returns the nonce a push certificate for the repository must
+// have now, or false if receive.certNonceSeed is not set and the repository
+// does not accept certificates.
+func (r *Repository) certNonce() (string, bool) {
+	seed, ok := r.config.Get("receive", "", "certNonceSeed")
+	if !ok || seed == "" {
+		return "", false
+	}
+	return pushCertNonce(seed, r.gitdir, time.Now().Unix()), true
+}
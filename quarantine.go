@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Quarantine is a temporary object directory for received objects. Objects
+// written through the quarantine repository are not visible to the main
+// repository until migrated, so that a rejected push or a broken transfer
+// never leaves its objects behind.
+type Quarantine struct {
+	repo   *Repository
+	parent *Repository
+	dir    string
+}
+
+// NewQuarantine creates a new incoming object directory inside of the
+// repository object directory.
+func (r *Repository) NewQuarantine() (*Quarantine, error) {
+	if err := os.MkdirAll(r.objdir, newDirPerm); err != nil {
+		return nil, fmt.Errorf("ensure object dir: %w", err)
+	}
+	dir, err := ioutil.TempDir(r.objdir, "incoming-")
+	if err != nil {
+		return nil, fmt.Errorf("create quarantine dir: %w", err)
+	}
+	repo := *r
+	repo.objdir = dir
+	repo.alternates = append([]string{r.objdir}, r.alternates...)
+	// Objects are synced when they are migrated into the repository.
+	repo.fsync &^= fsyncLooseObject
+	repo.pendingSync = nil
+	return &Quarantine{repo: &repo, parent: r, dir: dir}, nil
+}
+
+// Repository returns a view of the repository that writes objects into the
+// quarantine directory and reads them from both the quarantine and the main
+// object directories.
+func (q *Quarantine) Repository() *Repository {
+	return q.repo
+}
+
+// Env returns environment variables that make a child process, for example a
+// hook, see the quarantined objects.
+func (q *Quarantine) Env() []string {
+	return []string{
+		"GIT_OBJECT_DIRECTORY=" + q.dir,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES=" + strings.Join(q.repo.alternates, string(filepath.ListSeparator)),
+		"GIT_QUARANTINE_PATH=" + q.dir,
+	}
+}
+
+// Migrate moves all quarantined objects into the main object directory and
+// removes the quarantine. Objects that already exist in the main directory
+// are not overwritten.
+func (q *Quarantine) Migrate() error {
+	err := filepath.Walk(q.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(q.dir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(q.parent.objdir, rel)
+		switch _, err := os.Stat(dest); {
+		case err == nil:
+			return nil
+		case errors.Is(err, os.ErrNotExist):
+			// Not yet present.
+		default:
+			return fmt.Errorf("stat %q: %w", dest, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), newDirPerm); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+		if err := os.Rename(path, dest); err != nil {
+			return fmt.Errorf("move %q: %w", rel, err)
+		}
+		if q.parent.fsyncEnabled(fsyncLooseObject) && !q.parent.fsyncBatch {
+			if err := syncPath(dest); err != nil {
+				return err
+			}
+		}
+		return q.parent.syncLooseObject(dest)
+	})
+	if err != nil {
+		return fmt.Errorf("migrate quarantine: %w", err)
+	}
+	return q.Discard()
+}
+
+// Discard removes the quarantine together with all objects it contains.
+func (q *Quarantine) Discard() error {
+	if err := os.RemoveAll(q.dir); err != nil {
+		return fmt.Errorf("remove quarantine: %w", err)
+	}
+	return nil
+}
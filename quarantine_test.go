@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	repo := newTestRepository(t)
+	existing, err := repo.WriteObject("blob", []byte("existing"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+
+	q, err := repo.NewQuarantine()
+	if err != nil {
+		t.Fatalf("new quarantine: %s", err)
+	}
+	incoming, err := q.Repository().WriteObject("blob", []byte("incoming"))
+	if err != nil {
+		t.Fatalf("write quarantined blob: %s", err)
+	}
+
+	assertHasObject(t, q.Repository(), existing, true)
+	assertHasObject(t, q.Repository(), incoming, true)
+	assertHasObject(t, repo, incoming, false)
+
+	if err := q.Migrate(); err != nil {
+		t.Fatalf("migrate: %s", err)
+	}
+	assertHasObject(t, repo, incoming, true)
+	assertHasObject(t, repo, existing, true)
+}
+
+func assertHasObject(t *testing.T, repo *Repository, sha []byte, want bool) {
+	t.Helper()
+	got, err := repo.HasObject(sha)
+	if err != nil {
+		t.Fatalf("has object: %s", err)
+	}
+	if got != want {
+		t.Fatalf("object %x: want present=%v, got %v", sha, want, got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// quotePath quotes a path for output the way git does: a path with control
+// characters, a double quote or a backslash is written in double quotes,
+// with C escape sequences for them. With quoteNonASCII, which is
+// core.quotePath, bytes above 0x7f are written as octal escapes as well.
+// Other paths are returned as they are.
+func quotePath(name string, quoteNonASCII bool) string {
+	needsQuote := func(c byte) bool {
+		return c < 0x20 || c == '"' || c == '\\' || c == 0x7f || (quoteNonASCII && c >= 0x80)
+	}
+	i := 0
+	for i < len(name) && !needsQuote(name[i]) {
+		i++
+	}
+	if i == len(name) {
+		return name
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	b.WriteString(name[:i])
+	for ; i < len(name); i++ {
+		c := name[i]
+		if !needsQuote(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('\\')
+		switch c {
+		case '\a':
+			b.WriteByte('a')
+		case '\b':
+			b.WriteByte('b')
+		case '\t':
+			b.WriteByte('t')
+		case '\n':
+			b.WriteByte('n')
+		case '\v':
+			b.WriteByte('v')
+		case '\f':
+			b.WriteByte('f')
+		case '\r':
+			b.WriteByte('r')
+		case '"', '\\':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%03o", c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// pathQuoter returns the function that quotes paths written by commands,
+// following core.quotePath, which is true by default.
+func (r *Repository) pathQuoter() (func(string) string, error) {
+	quoteNonASCII, err := r.config.Bool("core", "", "quotePath", true)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) string {
+		return quotePath(name, quoteNonASCII)
+	}, nil
+}
+
+// rawPath returns the path as it is, for output that separates paths with
+// NUL and so does not need to quote them.
+func rawPath(name string) string {
+	return name
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestQuotePath(t *testing.T) {
+	cases := map[string]struct {
+		name          string
+		quoteNonASCII bool
+		want          string
+	}{
+		"plain":              {name: "dir/file.txt", quoteNonASCII: true, want: "dir/file.txt"},
+		"space":              {name: "a b", quoteNonASCII: true, want: "a b"},
+		"control characters": {name: "a\tb\nc\x01", want: `"a\tb\nc\001"`},
+		"quote and escape":   {name: `a"b\c`, want: `"a\"b\\c"`},
+		"delete":             {name: "a\x7f", want: `"a\177"`},
+		"non-ASCII quoted":   {name: "zaż", quoteNonASCII: true, want: `"za\305\274"`},
+		"non-ASCII raw":      {name: "zaż", want: "zaż"},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if got := quotePath(tc.name, tc.quoteNonASCII); got != tc.want {
+				t.Fatalf("want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Updates of references are appended to their logs in the logs directory,
+// in the format of git, which lets <ref>@{<n>} find earlier values. Same as
+// git, branches, remote-tracking branches, notes and HEAD are logged in
+// repositories with a worktree, and other references only if their log
+// exists. core.logAllRefUpdates set to always logs all references, and set
+// to false only those with a log. Reftable repositories keep no logs,
+// because their log blocks are not supported.
+
+// reflogUpdate is a logged update, with the values the reference resolved
+// to before and after it.
+type reflogUpdate struct {
+	name     string
+	old, new []byte
+	message  string
+}
+
+// reflogState is what references resolved to before they were updated.
+type reflogState struct {
+	values map[string][]byte
+	// headTarget is the branch HEAD pointed to.
+	headTarget string
+}
+
+// readReflogState returns the values the updated references and HEAD
+// resolve to, read before they are updated. Nil is returned if references
+// are not logged.
+func (r *Repository) readReflogState(updates []*RefUpdate) (*reflogState, error) {
+	if _, ok := r.refs.(*filesRefStorage); !ok {
+		return nil, nil
+	}
+	head, err := r.refs.readRef("HEAD")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	s := &reflogState{values: make(map[string][]byte)}
+	if head != nil {
+		s.headTarget = head.Target
+	}
+	for _, u := range append([]*RefUpdate{{Name: "HEAD"}}, updates...) {
+		sha, err := r.resolveRef(u.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		s.values[u.Name] = sha
+	}
+	return s, nil
+}
+
+// writeReflogs appends the updates to the logs of the references, and to
+// the log of HEAD if they update the branch it points to. Logs of deleted
+// references are removed.
+func (r *Repository) writeReflogs(updates []*RefUpdate, before *reflogState) error {
+	if before == nil {
+		return nil
+	}
+	mode := "always"
+	if v, _ := r.config.Get("core", "", "logAllRefUpdates"); v != "always" {
+		logged, err := r.config.Bool("core", "", "logAllRefUpdates", r.workdir != "")
+		if err != nil {
+			return err
+		}
+		mode = strconv.FormatBool(logged)
+	}
+	id, err := r.committerIdent()
+	if err != nil {
+		// Same as git, a missing identity does not fail the update.
+		id = &Ident{When: time.Now()}
+	}
+	var logs []reflogUpdate
+	for _, u := range updates {
+		if u.Target == "" && u.Sha == nil {
+			if err := os.Remove(r.reflogPath(u.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("delete reflog: %w", err)
+			}
+			continue
+		}
+		sha, err := r.resolveRef(u.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		logs = append(logs, reflogUpdate{name: u.Name, old: before.values[u.Name], new: sha, message: u.Message})
+		if u.Name != "HEAD" && u.Name == before.headTarget {
+			logs = append(logs, reflogUpdate{name: "HEAD", old: before.values["HEAD"], new: sha, message: u.Message})
+		}
+	}
+	for _, l := range logs {
+		if bytes.Equal(l.old, l.new) && l.name != "HEAD" {
+			continue
+		}
+		if !r.logsRef(l.name, mode) {
+			continue
+		}
+		if err := r.appendReflog(l, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logsRef returns whether updates of the reference are logged with given
+// core.logAllRefUpdates.
+func (r *Repository) logsRef(name, mode string) bool {
+	switch mode {
+	case "always":
+		return true
+	case "true":
+		for _, prefix := range []string{"refs/heads/", "refs/remotes/", "refs/notes/"} {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+		if name == "HEAD" {
+			return true
+		}
+	}
+	_, err := os.Stat(r.reflogPath(name))
+	return err == nil
+}
+
+func (r *Repository) appendReflog(l reflogUpdate, id *Ident) error {
+	path := r.reflogPath(l.name)
+	if err := os.MkdirAll(filepath.Dir(path), newDirPerm); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+	oldSha, newSha := l.old, l.new
+	if oldSha == nil {
+		oldSha = make([]byte, 20)
+	}
+	if newSha == nil {
+		newSha = make([]byte, 20)
+	}
+	line := fmt.Sprintf("%x %x %s", oldSha, newSha, id)
+	// The message is a single line, same as git makes it.
+	if message := strings.Join(strings.Fields(l.message), " "); message != "" {
+		line += "\t" + message
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open reflog: %w", err)
+	}
+	_, err = fd.WriteString(line + "\n")
+	if cerr := fd.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write reflog of %s: %w", l.name, err)
+	}
+	return nil
+}
+
+func (r *Repository) reflogPath(name string) string {
+	return filepath.Join(r.gitdir, "logs", filepath.FromSlash(name))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReflog(t *testing.T) {
+	repo := newTestRepository(t)
+	repo.config.Entries = append(repo.config.Entries,
+		&ConfigEntry{Section: "user", Key: "name", Value: "Test"},
+		&ConfigEntry{Section: "user", Key: "email", Value: "test@example.com"})
+	first := writeTestCommit(t, repo, "first")
+	second := writeTestCommit(t, repo, "second", first)
+
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: first, Message: "commit (initial): first"}); err != nil {
+		t.Fatalf("update master: %s", err)
+	}
+	if err := repo.UpdateRefs(
+		&RefUpdate{Name: "refs/heads/master", Sha: second, Message: "commit: second\n\nbody"},
+		&RefUpdate{Name: "refs/tags/v1", Sha: first},
+	); err != nil {
+		t.Fatalf("update master: %s", err)
+	}
+
+	// HEAD points to master, so that its log has the same entries.
+	raw, err := ioutil.ReadFile(filepath.Join(repo.gitdir, "logs", "refs", "heads", "master"))
+	if err != nil {
+		t.Fatalf("read reflog: %s", err)
+	}
+	want := fmt.Sprintf("%x %x Test <test@example.com> ", make([]byte, 20), first)
+	if !bytes.HasPrefix(raw, []byte(want)) || !bytes.HasSuffix(raw, []byte("\tcommit: second body\n")) || bytes.Count(raw, []byte("\n")) != 2 {
+		t.Fatalf("want 2 entries starting with %q, got:\n%s", want, raw)
+	}
+	for rev, want := range map[string][]byte{"master@{0}": second, "master@{1}": first, "HEAD@{1}": first, "@{1}": first} {
+		got, err := repo.Resolve(rev)
+		if err != nil {
+			t.Fatalf("resolve %s: %s", rev, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: want %x, got %x", rev, want, got)
+		}
+	}
+	// Tags are not logged.
+	if _, err := os.Stat(filepath.Join(repo.gitdir, "logs", "refs", "tags", "v1")); !os.IsNotExist(err) {
+		t.Fatalf("want no reflog of a tag, got %v", err)
+	}
+
+	// With core.logAllRefUpdates set to false, existing logs are kept up
+	// to date and no new logs are created.
+	repo.config.Entries = append(repo.config.Entries, &ConfigEntry{Section: "core", Key: "logallrefupdates", Value: "false"})
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: first}, &RefUpdate{Name: "refs/heads/other", Sha: first}); err != nil {
+		t.Fatalf("update refs: %s", err)
+	}
+	if got, err := repo.Resolve("master@{1}"); err != nil || !bytes.Equal(got, second) {
+		t.Fatalf("want master@{1} at %x, got %x, %v", second, got, err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.gitdir, "logs", "refs", "heads", "other")); !os.IsNotExist(err) {
+		t.Fatalf("want no reflog of other, got %v", err)
+	}
+
+	// The log of a deleted reference is removed.
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master"}); err != nil {
+		t.Fatalf("delete master: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.gitdir, "logs", "refs", "heads", "master")); !os.IsNotExist(err) {
+		t.Fatalf("want reflog removed, got %v", err)
+	}
+}
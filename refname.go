@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RefNameOptions relax the rules checked by CheckRefName.
+type RefNameOptions struct {
+	// AllowOneLevel accepts names without a slash, like "HEAD".
+	AllowOneLevel bool
+	// RefspecPattern accepts a single "*" wildcard.
+	RefspecPattern bool
+}
+
+// ValidateRefName returns an error if name is not a valid full reference
+// name, for example "refs/heads/master".
+func ValidateRefName(name string) error {
+	return CheckRefName(name, RefNameOptions{})
+}
+
+// CheckRefName implements the rules of git check-ref-format.
+func CheckRefName(name string, opts RefNameOptions) error {
+	if name == "" {
+		return errors.New("empty reference name")
+	}
+	if name == "@" {
+		return errors.New("reference name cannot be a single @")
+	}
+	if strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return fmt.Errorf("reference name %q cannot begin or end with a slash", name)
+	}
+	if strings.HasSuffix(name, ".") {
+		return fmt.Errorf("reference name %q cannot end with a dot", name)
+	}
+	if !opts.AllowOneLevel && !strings.Contains(name, "/") {
+		return fmt.Errorf("reference name %q must contain at least one slash", name)
+	}
+	for _, bad := range []string{"..", "@{", "//"} {
+		if strings.Contains(name, bad) {
+			return fmt.Errorf("reference name %q cannot contain %q", name, bad)
+		}
+	}
+	var wildcards int
+	for _, c := range name {
+		switch {
+		case c < 0x20 || c == 0x7f:
+			return fmt.Errorf("reference name %q cannot contain control characters", name)
+		case c == '*':
+			wildcards++
+			if !opts.RefspecPattern || wildcards > 1 {
+				return fmt.Errorf("reference name %q cannot contain %q", name, c)
+			}
+		case strings.ContainsRune(" ~^:?[\\", c):
+			return fmt.Errorf("reference name %q cannot contain %q", name, c)
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") {
+			return fmt.Errorf("reference name %q component cannot begin with a dot", name)
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return fmt.Errorf("reference name %q component cannot end with .lock", name)
+		}
+	}
+	return nil
+}
+
+// normalizeRefName removes a leading slash and collapses consecutive
+// slashes, as check-ref-format --normalize does.
+func normalizeRefName(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	for strings.Contains(name, "//") {
+		name = strings.ReplaceAll(name, "//", "/")
+	}
+	return name
+}
+
+// ValidateBranchName returns an error if a short branch name, for example
+// "feature/x", cannot be used to create a branch.
+func ValidateBranchName(name string) error {
+	if strings.HasPrefix(name, "-") || name == "HEAD" {
+		return fmt.Errorf("invalid branch name %q", name)
+	}
+	return ValidateRefName("refs/heads/" + name)
+}
+
+// ValidateTagName returns an error if a short tag name cannot be used to
+// create a tag.
+func ValidateTagName(name string) error {
+	if strings.HasPrefix(name, "-") {
+		return fmt.Errorf("invalid tag name %q", name)
+	}
+	return ValidateRefName("refs/tags/" + name)
+}
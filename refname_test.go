@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckRefName(t *testing.T) {
+	cases := map[string]struct {
+		name    string
+		opts    RefNameOptions
+		wantErr bool
+	}{
+		"branch":                   {name: "refs/heads/master"},
+		"nested branch":            {name: "refs/heads/feature/x-1"},
+		"one level":                {name: "HEAD", wantErr: true},
+		"one level allowed":        {name: "HEAD", opts: RefNameOptions{AllowOneLevel: true}},
+		"double dot":               {name: "refs/heads/a..b", wantErr: true},
+		"reflog syntax":            {name: "refs/heads/a@{1}", wantErr: true},
+		"single at":                {name: "@", opts: RefNameOptions{AllowOneLevel: true}, wantErr: true},
+		"lock suffix":              {name: "refs/heads/x.lock", wantErr: true},
+		"lock suffix in component": {name: "refs/heads.lock/x", wantErr: true},
+		"leading dot":              {name: "refs/heads/.hidden", wantErr: true},
+		"trailing dot":             {name: "refs/heads/x.", wantErr: true},
+		"trailing slash":           {name: "refs/heads/x/", wantErr: true},
+		"double slash":             {name: "refs//heads/x", wantErr: true},
+		"control character":        {name: "refs/heads/a\x01b", wantErr: true},
+		"space":                    {name: "refs/heads/a b", wantErr: true},
+		"colon":                    {name: "refs/heads/a:b", wantErr: true},
+		"backslash":                {name: "refs/heads/a\\b", wantErr: true},
+		"wildcard":                 {name: "refs/heads/*", wantErr: true},
+		"wildcard in pattern":      {name: "refs/heads/*", opts: RefNameOptions{RefspecPattern: true}},
+		"two wildcards in pattern": {name: "refs/*/*", opts: RefNameOptions{RefspecPattern: true}, wantErr: true},
+		"unicode":                  {name: "refs/heads/zażółć"},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			err := CheckRefName(tc.name, tc.opts)
+			if tc.wantErr && err == nil {
+				t.Fatal("want error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
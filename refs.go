@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Ref is a named reference. Symbolic references have Target set to the name
+// of the reference they point to instead of Sha.
+type Ref struct {
+	Name   string
+	Sha    []byte
+	Target string
+}
+
+// RefUpdate is a single change within a reference transaction. Update with
+// neither Sha nor Target set deletes the reference.
+type RefUpdate struct {
+	Name   string
+	Sha    []byte
+	Target string
+
+	// OldSha, if set, must be the current value of the reference for the
+	// transaction to be applied.
+	OldSha []byte
+
+	// Message is the reason of the update, recorded in the reflog.
+	Message string
+}
+
+// refStorage is implemented by reference backends.
+type refStorage interface {
+	// readRef returns a single reference, without following symbolic
+	// references. Error wraps os.ErrNotExist if it does not exist.
+	readRef(name string) (*Ref, error)
+	listRefs() ([]*Ref, error)
+	// updateRefs applies all updates or none of them.
+	updateRefs(updates []*RefUpdate) error
+}
+
+// ReadRef returns the reference with given full name, without following
+// symbolic references.
+func (r *Repository) ReadRef(name string) (*Ref, error) {
+	return r.refs.readRef(name)
+}
+
+// resolveRef returns the hash a reference points to, following symbolic
+// references.
+func (r *Repository) resolveRef(name string) ([]byte, error) {
+	for depth := 0; depth < 5; depth++ {
+		ref, err := r.refs.readRef(name)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Target == "" {
+			return ref.Sha, nil
+		}
+		name = ref.Target
+	}
+	return nil, fmt.Errorf("reference %s: too many levels of symbolic references", name)
+}
+
+// shortRefName returns the reference name without the refs/heads/,
+// refs/tags/, refs/remotes/ or refs/ prefix.
+func shortRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/", "refs/"} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return name
+}
+
+// Head returns HEAD with Target set to the branch it points to, empty if
+// HEAD is detached, and Sha to the commit it resolves to, nil if the branch
+// has no commits yet.
+func (r *Repository) Head() (*Ref, error) {
+	head, err := r.refs.readRef("HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("read HEAD: %w", err)
+	}
+	if head.Target == "" {
+		return head, nil
+	}
+	sha, err := r.resolveRef(head.Target)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return &Ref{Name: "HEAD", Target: head.Target, Sha: sha}, nil
+}
+
+// errNotSymbolic is returned when a symbolic reference is expected.
+var errNotSymbolic = errors.New("not a symbolic ref")
+
+// ReadSymbolicRef returns the name of the reference the symbolic reference
+// points to. Chains of symbolic references are followed to the last one,
+// which does not have to exist.
+func (r *Repository) ReadSymbolicRef(name string) (string, error) {
+	ref, err := r.refs.readRef(name)
+	if err != nil {
+		return "", err
+	}
+	if ref.Target == "" {
+		return "", fmt.Errorf("ref %s is %w", name, errNotSymbolic)
+	}
+	for depth := 0; depth < 5; depth++ {
+		next, err := r.refs.readRef(ref.Target)
+		if errors.Is(err, os.ErrNotExist) {
+			return ref.Target, nil
+		} else if err != nil {
+			return "", err
+		}
+		if next.Target == "" {
+			return ref.Target, nil
+		}
+		ref = next
+	}
+	return "", fmt.Errorf("reference %s: too many levels of symbolic references", name)
+}
+
+// SetSymbolicRef points the reference to the target, which must be under
+// refs/, the same as git requires. The reason is recorded in the reflog.
+func (r *Repository) SetSymbolicRef(name, target, reason string) error {
+	if name != "HEAD" {
+		if err := ValidateRefName(name); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(target, "refs/") {
+		return fmt.Errorf("refusing to point %s outside of refs/", name)
+	}
+	if err := ValidateRefName(target); err != nil {
+		return err
+	}
+	return r.UpdateRefs(&RefUpdate{Name: name, Target: target, Message: reason})
+}
+
+// DeleteSymbolicRef removes the symbolic reference, but not the reference
+// it points to. HEAD cannot be deleted.
+func (r *Repository) DeleteSymbolicRef(name string) error {
+	if name == "HEAD" {
+		return errors.New("deleting 'HEAD' is not allowed")
+	}
+	ref, err := r.refs.readRef(name)
+	if err != nil {
+		return err
+	}
+	if ref.Target == "" {
+		return fmt.Errorf("cannot delete %s: %w", name, errNotSymbolic)
+	}
+	return r.UpdateRefs(&RefUpdate{Name: name})
+}
+
+// ListRefs returns all references stored in the repository mapped to the
+// hash they point to. Symbolic references are not included, because their
+// targets are listed on their own.
+func (r *Repository) ListRefs() (map[string][]byte, error) {
+	all, err := r.refs.listRefs()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string][]byte, len(all))
+	for _, ref := range all {
+		if ref.Sha != nil {
+			refs[ref.Name] = ref.Sha
+		}
+	}
+	return refs, nil
+}
+
+// refDecorations returns the short names of references by the commit they
+// point to, the way git log --decorate shows them: HEAD first, then other
+// references in the reverse order of their names. Tags are prefixed with
+// "tag: " and annotated ones are peeled to the commit.
+func (r *Repository) refDecorations() (map[string][]string, error) {
+	refs, err := r.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("list refs: %w", err)
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	decorations := make(map[string][]string)
+	head, err := r.ReadRef("HEAD")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if head != nil && head.Target == "" && head.Sha != nil {
+		decorations[string(head.Sha)] = []string{"HEAD"}
+	}
+	for _, name := range names {
+		sha := refs[name]
+		if peeled, err := r.peelObject(sha, "commit"); err == nil {
+			sha = peeled
+		}
+		short := name
+		switch {
+		case strings.HasPrefix(name, "refs/heads/"):
+			short = strings.TrimPrefix(name, "refs/heads/")
+		case strings.HasPrefix(name, "refs/tags/"):
+			short = "tag: " + strings.TrimPrefix(name, "refs/tags/")
+		case strings.HasPrefix(name, "refs/remotes/"):
+			short = strings.TrimPrefix(name, "refs/remotes/")
+		}
+		if head != nil && name == head.Target {
+			decorations[string(sha)] = append([]string{"HEAD -> " + short}, decorations[string(sha)]...)
+			continue
+		}
+		decorations[string(sha)] = append(decorations[string(sha)], short)
+	}
+	return decorations, nil
+}
+
+// UpdateRefs atomically applies all given reference updates.
+func (r *Repository) UpdateRefs(updates ...*RefUpdate) error {
+	for _, u := range updates {
+		if u.Name != "HEAD" {
+			if err := ValidateRefName(u.Name); err != nil {
+				return err
+			}
+			if !strings.HasPrefix(u.Name, "refs/") {
+				return fmt.Errorf("reference %q outside of refs/", u.Name)
+			}
+		}
+		if u.Sha != nil && len(u.Sha) != 20 {
+			return fmt.Errorf("%s: invalid hash length: %d", u.Name, len(u.Sha))
+		}
+	}
+	// Objects must be durable before any reference points to them.
+	if err := r.syncPending(); err != nil {
+		return err
+	}
+	before, err := r.readReflogState(updates)
+	if err != nil {
+		return err
+	}
+	if err := r.refs.updateRefs(updates); err != nil {
+		return err
+	}
+	return r.writeReflogs(updates, before)
+}
+
+// checkOldSha verifies the expected value of a reference before it is
+// updated.
+func checkOldSha(u *RefUpdate, current *Ref) error {
+	if u.OldSha == nil {
+		return nil
+	}
+	if current == nil || !bytes.Equal(current.Sha, u.OldSha) {
+		return fmt.Errorf("%s: reference changed concurrently", u.Name)
+	}
+	return nil
+}
+
+// filesRefStorage is the traditional backend, keeping each reference in its
+// own file, with optional packed-refs file.
+type filesRefStorage struct {
+	gitdir string
+	// fsync flushes reference files and their directories after writing.
+	fsync bool
+}
+
+func (s *filesRefStorage) packedRefs() (map[string][]byte, error) {
+	refs := make(map[string][]byte)
+	switch raw, err := ioutil.ReadFile(filepath.Join(s.gitdir, "packed-refs")); {
+	case err == nil:
+		if err := parsePackedRefs(raw, refs); err != nil {
+			return nil, fmt.Errorf("packed-refs: %w", err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// No packed refs.
+	default:
+		return nil, fmt.Errorf("read packed-refs: %w", err)
+	}
+	return refs, nil
+}
+
+func parseLooseRef(name string, content []byte) (*Ref, error) {
+	content = bytes.TrimSpace(content)
+	if bytes.HasPrefix(content, []byte("ref:")) {
+		target := strings.TrimSpace(string(content[len("ref:"):]))
+		return &Ref{Name: name, Target: target}, nil
+	}
+	sha, err := hex.DecodeString(string(content))
+	if err != nil || len(sha) != 20 {
+		return nil, fmt.Errorf("invalid %q reference", name)
+	}
+	return &Ref{Name: name, Sha: sha}, nil
+}
+
+func (s *filesRefStorage) readRef(name string) (*Ref, error) {
+	switch content, err := ioutil.ReadFile(filepath.Join(s.gitdir, filepath.FromSlash(name))); {
+	case err == nil:
+		return parseLooseRef(name, content)
+	case errors.Is(err, os.ErrNotExist):
+		// Check packed references.
+	default:
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	packed, err := s.packedRefs()
+	if err != nil {
+		return nil, err
+	}
+	if sha, ok := packed[name]; ok {
+		return &Ref{Name: name, Sha: sha}, nil
+	}
+	return nil, fmt.Errorf("reference %s: %w", name, os.ErrNotExist)
+}
+
+func (s *filesRefStorage) listRefs() ([]*Ref, error) {
+	packed, err := s.packedRefs()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*Ref, len(packed))
+	for name, sha := range packed {
+		byName[name] = &Ref{Name: name, Sha: sha}
+	}
+
+	// Loose references take precedence over packed ones.
+	err = filepath.Walk(filepath.Join(s.gitdir, "refs"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".lock") || strings.HasSuffix(path, ".lock"+lockOwnerSuffix) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read %q: %w", path, err)
+		}
+		name := filepath.ToSlash(path[len(s.gitdir)+1:])
+		ref, err := parseLooseRef(name, content)
+		if err != nil {
+			return err
+		}
+		byName[name] = ref
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("walk refs: %w", err)
+	}
+	return sortedRefs(byName), nil
+}
+
+func sortedRefs(byName map[string]*Ref) []*Ref {
+	refs := make([]*Ref, 0, len(byName))
+	for _, ref := range byName {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return refs
+}
+
+func (s *filesRefStorage) updateRefs(updates []*RefUpdate) (err error) {
+	// Lock all references first, so that either all or none of them are
+	// modified.
+	var locks []string
+	defer func() {
+		for _, l := range locks {
+			if l != "" {
+				releaseLock(l)
+			}
+		}
+	}()
+	var deletePacked []string
+	for _, u := range updates {
+		path := filepath.Join(s.gitdir, filepath.FromSlash(u.Name))
+		if err := os.MkdirAll(filepath.Dir(path), newDirPerm); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+		lock := path + ".lock"
+		fd, err := createLock(s.gitdir, lock)
+		if err != nil {
+			return err
+		}
+		locks = append(locks, lock)
+
+		current, err := s.readRef(u.Name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fd.Close()
+			return err
+		}
+		if err := checkOldSha(u, current); err != nil {
+			fd.Close()
+			return err
+		}
+		var content string
+		switch {
+		case u.Target != "":
+			content = "ref: " + u.Target + "\n"
+		case u.Sha != nil:
+			content = hex.EncodeToString(u.Sha) + "\n"
+		default:
+			deletePacked = append(deletePacked, u.Name)
+		}
+		_, werr := fd.WriteString(content)
+		if werr == nil && s.fsync {
+			werr = syncFile(fd)
+		}
+		if err := fd.Close(); err != nil && werr == nil {
+			werr = err
+		}
+		if werr != nil {
+			return fmt.Errorf("write %s: %w", u.Name, werr)
+		}
+	}
+
+	if len(deletePacked) != 0 {
+		if err := s.removePacked(deletePacked); err != nil {
+			return err
+		}
+	}
+	for i, u := range updates {
+		path := filepath.Join(s.gitdir, filepath.FromSlash(u.Name))
+		if u.Target == "" && u.Sha == nil {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("delete %s: %w", u.Name, err)
+			}
+			continue
+		}
+		err := commitLock(locks[i], path)
+		locks[i] = ""
+		if err != nil {
+			return fmt.Errorf("update %s: %w", u.Name, err)
+		}
+	}
+	if s.fsync {
+		synced := make(map[string]bool)
+		for _, u := range updates {
+			dir := filepath.Dir(filepath.Join(s.gitdir, filepath.FromSlash(u.Name)))
+			if synced[dir] {
+				continue
+			}
+			synced[dir] = true
+			if err := syncPath(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removePacked rewrites the packed-refs file without given references.
+func (s *filesRefStorage) removePacked(names []string) error {
+	path := filepath.Join(s.gitdir, "packed-refs")
+	raw, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read packed-refs: %w", err)
+	}
+	remove := make(map[string]bool, len(names))
+	for _, n := range names {
+		remove[n] = true
+	}
+	var (
+		b       bytes.Buffer
+		skipped bool
+		changed bool
+	)
+	for _, line := range strings.SplitAfter(string(raw), "\n") {
+		if strings.HasPrefix(line, "^") && skipped {
+			// Peeled value of a removed tag.
+			continue
+		}
+		skipped = false
+		if chunks := strings.SplitN(strings.TrimSpace(line), " ", 2); len(chunks) == 2 && remove[chunks[1]] {
+			skipped = true
+			changed = true
+			continue
+		}
+		b.WriteString(line)
+	}
+	if !changed {
+		return nil
+	}
+	lock := path + ".lock"
+	if err := writeLockFile(s.gitdir, lock, b.Bytes(), s.fsync); err != nil {
+		return fmt.Errorf("write packed-refs: %w", err)
+	}
+	if err := commitLock(lock, path); err != nil {
+		return fmt.Errorf("update packed-refs: %w", err)
+	}
+	if s.fsync {
+		return syncPath(s.gitdir)
+	}
+	return nil
+}
+
+func parsePackedRefs(raw []byte, refs map[string][]byte) error {
+	sc := bufio.NewScanner(bytes.NewReader(raw))
+	for sc.Scan() {
+		line := sc.Text()
+		// Skip comments, empty lines and peeled tag values.
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		chunks := strings.SplitN(line, " ", 2)
+		if len(chunks) != 2 {
+			return fmt.Errorf("invalid line %q", line)
+		}
+		sha, err := hex.DecodeString(chunks[0])
+		if err != nil {
+			return fmt.Errorf("invalid %q hash: %w", chunks[1], err)
+		}
+		refs[chunks[1]] = sha
+	}
+	return sc.Err()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestHeadAndSymbolicRefs(t *testing.T) {
+	repo := newTestRepository(t)
+	assertHead := func(target string, sha []byte) {
+		t.Helper()
+		head, err := repo.Head()
+		if err != nil {
+			t.Fatalf("head: %s", err)
+		}
+		if head.Name != "HEAD" || head.Target != target || !bytes.Equal(head.Sha, sha) {
+			t.Fatalf("want HEAD at %q %x, got %q %x", target, sha, head.Target, head.Sha)
+		}
+	}
+
+	// A new repository has an unborn branch.
+	assertHead("refs/heads/master", nil)
+	commit := writeTestCommit(t, repo, "first")
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: commit}); err != nil {
+		t.Fatalf("update master: %s", err)
+	}
+	assertHead("refs/heads/master", commit)
+
+	if err := repo.SetSymbolicRef("refs/heads/alias", "refs/heads/master", ""); err != nil {
+		t.Fatalf("set alias: %s", err)
+	}
+	if err := repo.SetSymbolicRef("HEAD", "refs/heads/alias", ""); err != nil {
+		t.Fatalf("set HEAD: %s", err)
+	}
+	if target, err := repo.ReadSymbolicRef("HEAD"); err != nil || target != "refs/heads/master" {
+		t.Fatalf("want HEAD to end at refs/heads/master, got %q, %v", target, err)
+	}
+	assertHead("refs/heads/alias", commit)
+	if _, err := repo.ReadSymbolicRef("refs/heads/master"); !errors.Is(err, errNotSymbolic) {
+		t.Fatalf("want not symbolic error, got %v", err)
+	}
+	if err := repo.SetSymbolicRef("HEAD", "master", ""); err == nil {
+		t.Fatal("pointed HEAD outside of refs/")
+	}
+
+	if err := repo.DeleteSymbolicRef("HEAD"); err == nil {
+		t.Fatal("deleted HEAD")
+	}
+	if err := repo.DeleteSymbolicRef("refs/heads/master"); !errors.Is(err, errNotSymbolic) {
+		t.Fatalf("want not symbolic error, got %v", err)
+	}
+	if err := repo.SetSymbolicRef("HEAD", "refs/heads/master", ""); err != nil {
+		t.Fatalf("set HEAD: %s", err)
+	}
+	if err := repo.DeleteSymbolicRef("refs/heads/alias"); err != nil {
+		t.Fatalf("delete alias: %s", err)
+	}
+	if _, err := repo.ReadRef("refs/heads/alias"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want alias deleted, got %v", err)
+	}
+	assertHead("refs/heads/master", commit)
+
+	// Detached HEAD.
+	if err := repo.UpdateRefs(&RefUpdate{Name: "HEAD", Sha: commit}); err != nil {
+		t.Fatalf("detach HEAD: %s", err)
+	}
+	assertHead("", commit)
+	if _, err := repo.ReadSymbolicRef("HEAD"); !errors.Is(err, errNotSymbolic) {
+		t.Fatalf("want not symbolic error, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Refspec maps references of one repository to references of another, for
+// example "+refs/heads/*:refs/remotes/origin/*".
+type Refspec struct {
+	// Force allows updates that are not fast-forward.
+	Force bool
+	Src   string
+	// Dst is empty if the source is only fetched, or if it is deleted
+	// when pushing.
+	Dst string
+}
+
+// ParseRefspec parses a refspec in the <+><src>:<dst> form. Both sides must
+// contain a "*" wildcard or neither of them.
+func ParseRefspec(s string) (*Refspec, error) {
+	var spec Refspec
+	if strings.HasPrefix(s, "+") {
+		spec.Force = true
+		s = s[1:]
+	}
+	spec.Src = s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		spec.Src, spec.Dst = s[:i], s[i+1:]
+	}
+	if spec.Src == "" && spec.Dst == "" {
+		return nil, fmt.Errorf("invalid %q refspec", s)
+	}
+	if strings.Contains(spec.Src, "*") != strings.Contains(spec.Dst, "*") && spec.Dst != "" {
+		return nil, fmt.Errorf("refspec %q: wildcard must be used on both sides", s)
+	}
+	opts := RefNameOptions{AllowOneLevel: true, RefspecPattern: true}
+	for _, name := range []string{spec.Src, spec.Dst} {
+		if name == "" {
+			continue
+		}
+		if err := CheckRefName(name, opts); err != nil {
+			return nil, fmt.Errorf("refspec %q: %w", s, err)
+		}
+	}
+	return &spec, nil
+}
+
+// IsPattern returns true if the refspec uses a wildcard.
+func (s *Refspec) IsPattern() bool {
+	return strings.Contains(s.Src, "*")
+}
+
+// Map returns the destination for given source reference name. False is
+// returned if the name does not match the source side of the refspec.
+func (s *Refspec) Map(name string) (string, bool) {
+	if !s.IsPattern() {
+		if name != s.Src {
+			return "", false
+		}
+		return s.Dst, true
+	}
+	i := strings.IndexByte(s.Src, '*')
+	prefix, suffix := s.Src[:i], s.Src[i+1:]
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	if s.Dst == "" {
+		return "", true
+	}
+	matched := name[len(prefix) : len(name)-len(suffix)]
+	return strings.Replace(s.Dst, "*", matched, 1), true
+}
+
+func (s *Refspec) String() string {
+	var b strings.Builder
+	if s.Force {
+		b.WriteByte('+')
+	}
+	b.WriteString(s.Src)
+	if s.Dst != "" {
+		b.WriteByte(':')
+		b.WriteString(s.Dst)
+	}
+	return b.String()
+}
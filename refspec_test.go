@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestRefspecMap(t *testing.T) {
+	cases := map[string]struct {
+		refspec string
+		name    string
+		wantDst string
+		wantOk  bool
+	}{
+		"exact match": {
+			refspec: "refs/heads/master:refs/remotes/origin/master",
+			name:    "refs/heads/master",
+			wantDst: "refs/remotes/origin/master",
+			wantOk:  true,
+		},
+		"exact mismatch": {
+			refspec: "refs/heads/master:refs/remotes/origin/master",
+			name:    "refs/heads/main",
+		},
+		"wildcard": {
+			refspec: "+refs/heads/*:refs/remotes/origin/*",
+			name:    "refs/heads/feature/x",
+			wantDst: "refs/remotes/origin/feature/x",
+			wantOk:  true,
+		},
+		"wildcard with suffix": {
+			refspec: "refs/heads/*-wip:refs/wip/*",
+			name:    "refs/heads/parser-wip",
+			wantDst: "refs/wip/parser",
+			wantOk:  true,
+		},
+		"wildcard mismatch": {
+			refspec: "refs/heads/*:refs/remotes/origin/*",
+			name:    "refs/tags/v1",
+		},
+		"source only": {
+			refspec: "refs/tags/*",
+			name:    "refs/tags/v1",
+			wantOk:  true,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			spec, err := ParseRefspec(tc.refspec)
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			dst, ok := spec.Map(tc.name)
+			if ok != tc.wantOk || dst != tc.wantDst {
+				t.Fatalf("want %q, %v, got %q, %v", tc.wantDst, tc.wantOk, dst, ok)
+			}
+		})
+	}
+}
+
+func TestParseRefspecInvalid(t *testing.T) {
+	for _, raw := range []string{"", ":", "refs/heads/*:refs/x", "refs/heads/a b:refs/x"} {
+		if _, err := ParseRefspec(raw); err == nil {
+			t.Errorf("%q: want error", raw)
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// reftableStorage keeps references in a stack of reftable files, as
+// described in git's Documentation/technical/reftable.txt. Tables are
+// listed in reftable/tables.list from the oldest to the newest and newer
+// tables take precedence. Only ref blocks are written and read. Log, object
+// and index blocks are out of scope, so that no reflogs are kept in
+// reftable repositories.
+//
+// Tables are never modified once written, so parsed tables are cached by
+// name and the merged state by the content of tables.list.
+type reftableStorage struct {
+	dir string
+	// fsync flushes new tables and tables.list after writing.
+	fsync bool
+
+	mu       sync.Mutex
+	tables   map[string]*reftable
+	list     string
+	cached   map[string]*reftableRecord
+	maxIndex uint64
+}
+
+const (
+	reftableHeaderSize   = 24
+	reftableFooterSize   = 68
+	reftableBlockSize    = 4096
+	reftableRestartEvery = 16
+)
+
+// Reftable record value types.
+const (
+	reftableDeletion = 0
+	reftableVal1     = 1
+	reftableVal2     = 2
+	reftableSymref   = 3
+)
+
+type reftableRecord struct {
+	name        string
+	updateIndex uint64
+	valueType   byte
+	sha         []byte
+	peeled      []byte
+	target      string
+}
+
+func (rec *reftableRecord) ref() *Ref {
+	if rec.valueType == reftableSymref {
+		return &Ref{Name: rec.name, Target: rec.target}
+	}
+	return &Ref{Name: rec.name, Sha: rec.sha}
+}
+
+type reftable struct {
+	minUpdateIndex uint64
+	maxUpdateIndex uint64
+	records        []*reftableRecord
+	// unsupported is set if the table has blocks other than ref blocks,
+	// which are not read.
+	unsupported bool
+}
+
+// readTablesList returns the content of tables.list and the table names
+// listed in it.
+func (s *reftableStorage) readTablesList() (string, []string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(s.dir, "tables.list"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil, nil
+	} else if err != nil {
+		return "", nil, fmt.Errorf("read tables.list: %w", err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(raw), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	return string(raw), names, nil
+}
+
+// state returns the current value of all references, including deletion
+// records, and the highest update index used. Returned state must not be
+// modified.
+func (s *reftableStorage) state() (map[string]*reftableRecord, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Tables removed by a compaction that happened after tables.list was
+	// read are found in the new list.
+	for attempt := 0; ; attempt++ {
+		list, names, err := s.readTablesList()
+		if err != nil {
+			return nil, 0, err
+		}
+		if s.cached != nil && list == s.list {
+			return s.cached, s.maxIndex, nil
+		}
+		tables, err := s.loadTables(names)
+		if errors.Is(err, os.ErrNotExist) && attempt < 3 {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		var maxIndex uint64
+		state := make(map[string]*reftableRecord)
+		for _, t := range tables {
+			if t.maxUpdateIndex > maxIndex {
+				maxIndex = t.maxUpdateIndex
+			}
+			for _, rec := range t.records {
+				state[rec.name] = rec
+			}
+		}
+		s.list, s.cached, s.maxIndex = list, state, maxIndex
+		return state, maxIndex, nil
+	}
+}
+
+// loadTables returns the parsed tables, reading only those that are not
+// cached yet. Tables that are not listed anymore are dropped from the cache.
+func (s *reftableStorage) loadTables(names []string) ([]*reftable, error) {
+	loaded := make(map[string]*reftable, len(names))
+	tables := make([]*reftable, 0, len(names))
+	for _, name := range names {
+		t, ok := s.tables[name]
+		if !ok {
+			raw, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+			if err != nil {
+				return nil, fmt.Errorf("read table: %w", err)
+			}
+			if t, err = parseReftable(raw); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", name, err)
+			}
+		}
+		loaded[name] = t
+		tables = append(tables, t)
+	}
+	s.tables = loaded
+	return tables, nil
+}
+
+func (s *reftableStorage) readRef(name string) (*Ref, error) {
+	state, _, err := s.state()
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := state[name]
+	if !ok || rec.valueType == reftableDeletion {
+		return nil, fmt.Errorf("reference %s: %w", name, os.ErrNotExist)
+	}
+	return rec.ref(), nil
+}
+
+func (s *reftableStorage) listRefs() ([]*Ref, error) {
+	state, _, err := s.state()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*Ref, len(state))
+	for name, rec := range state {
+		if rec.valueType != reftableDeletion && name != "HEAD" {
+			byName[name] = rec.ref()
+		}
+	}
+	return sortedRefs(byName), nil
+}
+
+func (s *reftableStorage) updateRefs(updates []*RefUpdate) error {
+	if err := os.MkdirAll(s.dir, newDirPerm); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+	listPath := filepath.Join(s.dir, "tables.list")
+	lock, err := createLock(filepath.Dir(s.dir), listPath+".lock")
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			releaseLock(listPath + ".lock")
+		}
+	}()
+	defer lock.Close()
+
+	state, maxIndex, err := s.state()
+	if err != nil {
+		return err
+	}
+	index := maxIndex + 1
+	t := reftable{minUpdateIndex: index, maxUpdateIndex: index}
+	for _, u := range updates {
+		var current *Ref
+		if rec, ok := state[u.Name]; ok && rec.valueType != reftableDeletion {
+			current = rec.ref()
+		}
+		if err := checkOldSha(u, current); err != nil {
+			return err
+		}
+		rec := reftableRecord{name: u.Name, updateIndex: index}
+		switch {
+		case u.Target != "":
+			rec.valueType = reftableSymref
+			rec.target = u.Target
+		case u.Sha != nil:
+			rec.valueType = reftableVal1
+			rec.sha = u.Sha
+		default:
+			rec.valueType = reftableDeletion
+		}
+		t.records = append(t.records, &rec)
+	}
+
+	name, err := s.writeTable(&t)
+	if err != nil {
+		return err
+	}
+	_, names, err := s.readTablesList()
+	if err != nil {
+		return err
+	}
+	names = append(names, name)
+	// Compaction must not fail the update, which is written already.
+	compacted, removed := s.compact(names)
+
+	if _, err := lock.WriteString(strings.Join(compacted, "\n") + "\n"); err != nil {
+		return fmt.Errorf("write tables.list: %w", err)
+	}
+	if s.fsync {
+		if err := syncFile(lock); err != nil {
+			return err
+		}
+	}
+	if err := lock.Close(); err != nil {
+		return fmt.Errorf("close tables.list: %w", err)
+	}
+	committed = true
+	if err := commitLock(listPath+".lock", listPath); err != nil {
+		return fmt.Errorf("update tables.list: %w", err)
+	}
+	for _, name := range removed {
+		os.Remove(filepath.Join(s.dir, name))
+	}
+	if s.fsync {
+		return syncPath(s.dir)
+	}
+	return nil
+}
+
+// writeTable writes a new table file and returns its name.
+func (s *reftableStorage) writeTable(t *reftable) (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("random: %w", err)
+	}
+	name := fmt.Sprintf("0x%012x-0x%012x-%x.ref", t.minUpdateIndex, t.maxUpdateIndex, random)
+	if err := writeFileSync(filepath.Join(s.dir, name), t.encode(), s.fsync); err != nil {
+		return "", fmt.Errorf("write table: %w", err)
+	}
+	return name, nil
+}
+
+// compact merges the newest tables of the stack into one, so that every
+// table has at least twice as many records as all newer tables together,
+// the same geometric sequence as git uses for auto-compaction. It returns
+// the new stack and the names of tables to remove once it is in use, or
+// the stack unchanged if nothing is compacted. Tables with blocks that are
+// not read are never compacted, so that their content is not lost.
+//
+// Must be called with tables.list locked.
+func (s *reftableStorage) compact(names []string) ([]string, []string) {
+	s.mu.Lock()
+	tables, err := s.loadTables(names)
+	s.mu.Unlock()
+	if err != nil {
+		return names, nil
+	}
+	start := len(tables) - 1
+	total := len(tables[start].records)
+	for start > 0 && !tables[start-1].unsupported && len(tables[start-1].records) < 2*total {
+		start--
+		total += len(tables[start].records)
+	}
+	if start == len(tables)-1 || tables[start].unsupported {
+		return names, nil
+	}
+
+	merged := make(map[string]*reftableRecord)
+	for _, t := range tables[start:] {
+		for _, rec := range t.records {
+			merged[rec.name] = rec
+		}
+	}
+	t := reftable{
+		minUpdateIndex: tables[start].minUpdateIndex,
+		maxUpdateIndex: tables[len(tables)-1].maxUpdateIndex,
+	}
+	for _, rec := range merged {
+		// Deletions only hide references of older tables.
+		if rec.valueType == reftableDeletion && start == 0 {
+			continue
+		}
+		t.records = append(t.records, rec)
+	}
+	name, err := s.writeTable(&t)
+	if err != nil {
+		return names, nil
+	}
+	return append(names[:start:start], name), names[start:]
+}
+
+func (t *reftable) header() []byte {
+	h := make([]byte, reftableHeaderSize)
+	copy(h, "REFT")
+	h[4] = 1
+	putUint24(h[5:], reftableBlockSize)
+	binary.BigEndian.PutUint64(h[8:], t.minUpdateIndex)
+	binary.BigEndian.PutUint64(h[16:], t.maxUpdateIndex)
+	return h
+}
+
+// encode writes the table with ref blocks only. Records are sorted by name
+// and prefix compressed, with a restart point every few records.
+func (t *reftable) encode() []byte {
+	sort.Slice(t.records, func(i, j int) bool { return t.records[i].name < t.records[j].name })
+
+	var (
+		out      bytes.Buffer
+		block    []byte
+		restarts []int
+		prev     string
+		lead     int
+	)
+	beginBlock := func() {
+		block = block[:0]
+		// The first block includes the file header and its length and
+		// restart offsets are counted from the beginning of the file.
+		if out.Len() == 0 {
+			block = append(block, t.header()...)
+		}
+		lead = len(block)
+		block = append(block, 'r', 0, 0, 0)
+		restarts = restarts[:0]
+		prev = ""
+	}
+	finishBlock := func(pad bool) {
+		for _, r := range restarts {
+			var b [3]byte
+			putUint24(b[:], uint32(r))
+			block = append(block, b[:]...)
+		}
+		var n [2]byte
+		binary.BigEndian.PutUint16(n[:], uint16(len(restarts)))
+		block = append(block, n[:]...)
+		putUint24(block[lead+1:], uint32(len(block)))
+		out.Write(block)
+		if pad && len(block) < reftableBlockSize {
+			out.Write(make([]byte, reftableBlockSize-len(block)))
+		}
+	}
+
+	beginBlock()
+	for i, rec := range t.records {
+		restart := len(restarts) == 0 || i%reftableRestartEvery == 0
+		encoded := rec.encode(prev, restart, t.minUpdateIndex)
+		if len(block)+len(encoded)+3*(len(restarts)+1)+2 > reftableBlockSize && len(restarts) != 0 {
+			finishBlock(true)
+			beginBlock()
+			restart = true
+			encoded = rec.encode(prev, restart, t.minUpdateIndex)
+		}
+		if restart {
+			restarts = append(restarts, len(block))
+		}
+		block = append(block, encoded...)
+		prev = rec.name
+	}
+	finishBlock(false)
+
+	footer := make([]byte, 0, reftableFooterSize)
+	footer = append(footer, t.header()...)
+	// Index, object and log positions. None of them is written.
+	footer = append(footer, make([]byte, 5*8)...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(footer))
+	footer = append(footer, crc[:]...)
+	out.Write(footer)
+	return out.Bytes()
+}
+
+func (rec *reftableRecord) encode(prev string, restart bool, minUpdateIndex uint64) []byte {
+	var prefix int
+	if !restart {
+		for prefix < len(prev) && prefix < len(rec.name) && prev[prefix] == rec.name[prefix] {
+			prefix++
+		}
+	}
+	suffix := rec.name[prefix:]
+	var b bytes.Buffer
+	putReftableVarint(&b, uint64(prefix))
+	putReftableVarint(&b, uint64(len(suffix))<<3|uint64(rec.valueType))
+	b.WriteString(suffix)
+	putReftableVarint(&b, rec.updateIndex-minUpdateIndex)
+	switch rec.valueType {
+	case reftableVal1:
+		b.Write(rec.sha)
+	case reftableVal2:
+		b.Write(rec.sha)
+		b.Write(rec.peeled)
+	case reftableSymref:
+		putReftableVarint(&b, uint64(len(rec.target)))
+		b.WriteString(rec.target)
+	}
+	return b.Bytes()
+}
+
+// parseReftable reads all ref records of a table. Reading stops at the
+// first block that is not a ref block.
+func parseReftable(data []byte) (*reftable, error) {
+	if len(data) < reftableHeaderSize+reftableFooterSize {
+		return nil, errors.New("table too short")
+	}
+	if string(data[:4]) != "REFT" {
+		return nil, errors.New("invalid magic")
+	}
+	if data[4] != 1 {
+		return nil, fmt.Errorf("unsupported version %d", data[4])
+	}
+	footer := data[len(data)-reftableFooterSize:]
+	if !bytes.Equal(footer[:reftableHeaderSize], data[:reftableHeaderSize]) {
+		return nil, errors.New("footer does not match header")
+	}
+	if crc := binary.BigEndian.Uint32(footer[reftableFooterSize-4:]); crc != crc32.ChecksumIEEE(footer[:reftableFooterSize-4]) {
+		return nil, errors.New("footer checksum mismatch")
+	}
+	t := reftable{
+		minUpdateIndex: binary.BigEndian.Uint64(data[8:]),
+		maxUpdateIndex: binary.BigEndian.Uint64(data[16:]),
+	}
+
+	end := len(data) - reftableFooterSize
+	pos, headerLen := 0, reftableHeaderSize
+	for pos+headerLen < end && data[pos+headerLen] == 'r' {
+		if pos+headerLen+4 > end {
+			return nil, errors.New("truncated block header")
+		}
+		blockLen := int(uint24(data[pos+headerLen+1:]))
+		blockEnd := pos + blockLen
+		if blockLen < headerLen+6 || blockEnd > end {
+			return nil, fmt.Errorf("invalid block length %d", blockLen)
+		}
+		restartCount := int(binary.BigEndian.Uint16(data[blockEnd-2:]))
+		recordsEnd := blockEnd - 2 - 3*restartCount
+		if recordsEnd < pos+headerLen+4 {
+			return nil, errors.New("invalid restart count")
+		}
+		if err := t.parseRecords(data[pos+headerLen+4 : recordsEnd]); err != nil {
+			return nil, err
+		}
+		// Blocks may be padded with zeros.
+		pos, headerLen = blockEnd, 0
+		for pos < end && data[pos] == 0 {
+			pos++
+		}
+	}
+	t.unsupported = pos+headerLen < end
+	return &t, nil
+}
+
+func (t *reftable) parseRecords(data []byte) error {
+	var prev string
+	for len(data) != 0 {
+		prefix, n, err := readReftableVarint(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		suffixType, n, err := readReftableVarint(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		suffixLen := int(suffixType >> 3)
+		if int(prefix) > len(prev) || suffixLen > len(data) {
+			return errors.New("invalid record name")
+		}
+		rec := reftableRecord{
+			name:      prev[:prefix] + string(data[:suffixLen]),
+			valueType: byte(suffixType & 0x7),
+		}
+		data = data[suffixLen:]
+		delta, n, err := readReftableVarint(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		rec.updateIndex = t.minUpdateIndex + delta
+
+		switch rec.valueType {
+		case reftableDeletion:
+		case reftableVal1, reftableVal2:
+			size := 20
+			if rec.valueType == reftableVal2 {
+				size = 40
+			}
+			if len(data) < size {
+				return errors.New("truncated record value")
+			}
+			rec.sha = append([]byte(nil), data[:20]...)
+			if rec.valueType == reftableVal2 {
+				rec.peeled = append([]byte(nil), data[20:40]...)
+			}
+			data = data[size:]
+		case reftableSymref:
+			l, n, err := readReftableVarint(data)
+			if err != nil {
+				return err
+			}
+			data = data[n:]
+			if int(l) > len(data) {
+				return errors.New("truncated symref target")
+			}
+			rec.target = string(data[:l])
+			data = data[l:]
+		default:
+			return fmt.Errorf("unknown value type %d", rec.valueType)
+		}
+		t.records = append(t.records, &rec)
+		prev = rec.name
+	}
+	return nil
+}
+
+// putReftableVarint writes a number using the variable length encoding
+// that is also used by the offset deltas of pack files.
+func putReftableVarint(b *bytes.Buffer, v uint64) {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v != 0; v >>= 7 {
+		v--
+		i--
+		buf[i] = 0x80 | byte(v&0x7f)
+	}
+	b.Write(buf[i:])
+}
+
+func readReftableVarint(data []byte) (uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errors.New("truncated varint")
+	}
+	c := data[0]
+	v := uint64(c & 0x7f)
+	n := 1
+	for c&0x80 != 0 {
+		if n >= len(data) || n > 9 {
+			return 0, 0, errors.New("truncated varint")
+		}
+		c = data[n]
+		n++
+		v = ((v + 1) << 7) | uint64(c&0x7f)
+	}
+	return v, n, nil
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReftableStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &reftableStorage{dir: dir}
+	sha := func(n int) []byte { return bytes.Repeat([]byte{byte(n)}, 20) }
+
+	// Enough references to span multiple blocks.
+	var updates []*RefUpdate
+	for i := 0; i < 500; i++ {
+		updates = append(updates, &RefUpdate{Name: fmt.Sprintf("refs/heads/branch-%03d", i), Sha: sha(i)})
+	}
+	updates = append(updates, &RefUpdate{Name: "HEAD", Target: "refs/heads/branch-000"})
+	if err := s.updateRefs(updates); err != nil {
+		t.Fatalf("first update: %s", err)
+	}
+	if err := s.updateRefs([]*RefUpdate{
+		{Name: "refs/heads/branch-001"},
+		{Name: "refs/heads/branch-002", Sha: sha(99), OldSha: sha(2)},
+	}); err != nil {
+		t.Fatalf("second update: %s", err)
+	}
+	if err := s.updateRefs([]*RefUpdate{
+		{Name: "refs/heads/branch-003", Sha: sha(99), OldSha: sha(42)},
+	}); err == nil {
+		t.Fatal("want stale old value error")
+	}
+
+	refs, err := s.listRefs()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(refs) != 499 {
+		t.Fatalf("want 499 references, got %d", len(refs))
+	}
+	if ref, err := s.readRef("refs/heads/branch-002"); err != nil || !bytes.Equal(ref.Sha, sha(99)) {
+		t.Fatalf("unexpected branch-002: %+v, %v", ref, err)
+	}
+	if ref, err := s.readRef("refs/heads/branch-499"); err != nil || !bytes.Equal(ref.Sha, sha(499)) {
+		t.Fatalf("unexpected branch-499: %+v, %v", ref, err)
+	}
+	if _, err := s.readRef("refs/heads/branch-001"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("deleted reference is present")
+	}
+	if ref, err := s.readRef("HEAD"); err != nil || ref.Target != "refs/heads/branch-000" {
+		t.Fatalf("unexpected HEAD: %+v, %v", ref, err)
+	}
+}
+
+func TestReftableCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &reftableStorage{dir: dir}
+	sha := func(n int) []byte { return bytes.Repeat([]byte{byte(n)}, 20) }
+	for i := 0; i < 100; i++ {
+		update := &RefUpdate{Name: fmt.Sprintf("refs/heads/branch-%03d", i%10), Sha: sha(i)}
+		if i == 99 {
+			update.Sha = nil
+		}
+		if err := s.updateRefs([]*RefUpdate{update}); err != nil {
+			t.Fatalf("update %d: %s", i, err)
+		}
+	}
+	_, names, err := s.readTablesList()
+	if err != nil {
+		t.Fatalf("read tables.list: %s", err)
+	}
+	if len(names) > 8 {
+		t.Fatalf("want the stack compacted, got %d tables", len(names))
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %s", err)
+	}
+	if len(files) != len(names)+1 {
+		t.Fatalf("want compacted tables removed, got %d files for %d tables", len(files), len(names))
+	}
+
+	// Another storage reads the compacted stack, and its updates are seen
+	// by the first one, which cached the previous state.
+	other := &reftableStorage{dir: dir}
+	for _, s := range []*reftableStorage{s, other} {
+		refs, err := s.listRefs()
+		if err != nil {
+			t.Fatalf("list: %s", err)
+		}
+		if len(refs) != 9 {
+			t.Fatalf("want 9 references, got %d", len(refs))
+		}
+		if ref, err := s.readRef("refs/heads/branch-000"); err != nil || !bytes.Equal(ref.Sha, sha(90)) {
+			t.Fatalf("unexpected branch-000: %+v, %v", ref, err)
+		}
+		if _, err := s.readRef("refs/heads/branch-009"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatal("deleted reference is present")
+		}
+	}
+	if err := other.updateRefs([]*RefUpdate{{Name: "refs/heads/branch-000", Sha: sha(200), OldSha: sha(90)}}); err != nil {
+		t.Fatalf("update: %s", err)
+	}
+	if ref, err := s.readRef("refs/heads/branch-000"); err != nil || !bytes.Equal(ref.Sha, sha(200)) {
+		t.Fatalf("unexpected branch-000: %+v, %v", ref, err)
+	}
+}
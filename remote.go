@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RefChange describes a reference update made by fetch or push.
+type RefChange struct {
+	Src string
+	Dst string
+	// Old is nil if the reference is created and New is nil if it is
+	// deleted.
+	Old []byte
+	New []byte
+	// Forced is set for updates that are not fast-forward.
+	Forced bool
+	// Rejected is the reason why the change was not applied.
+	Rejected string
+}
+
+// Remote is a configured remote repository.
+type Remote struct {
+	Name  string
+	URL   string
+	Fetch []*Refspec
+}
+
+// ReadRemote returns the remote.<name> configuration. Error wraps
+// os.ErrNotExist if no such remote is configured.
+func (r *Repository) ReadRemote(name string) (*Remote, error) {
+	url, ok := r.config.Get("remote", name, "url")
+	if !ok {
+		return nil, fmt.Errorf("remote %q: %w", name, os.ErrNotExist)
+	}
+	remote := Remote{Name: name, URL: url}
+	for _, raw := range r.config.GetAll("remote", name, "fetch") {
+		spec, err := ParseRefspec(raw)
+		if err != nil {
+			return nil, fmt.Errorf("remote %q: %w", name, err)
+		}
+		remote.Fetch = append(remote.Fetch, spec)
+	}
+	return &remote, nil
+}
+
+// FetchOptions control how references are fetched.
+type FetchOptions struct {
+	// DryRun reports the changes without updating any local reference.
+	// Objects are still downloaded, same as in git, because they are
+	// needed to tell if the changes are fast-forward.
+	DryRun bool
+}
+
+// Fetch downloads references matching refspecs, together with all objects
+// they need, and updates local references they are mapped to. Rejected
+// changes are not applied. Options can be nil.
+func (r *Repository) Fetch(t Transport, refspecs []*Refspec, opts *FetchOptions) ([]*RefChange, error) {
+	if pt, ok := t.(RefPrefixTransport); ok {
+		pt.SetRefPrefixes(refPrefixes(refspecs))
+	}
+	remoteRefs, err := t.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("list remote references: %w", err)
+	}
+	var (
+		changes []*RefChange
+		forced  []bool
+		sources []*Ref
+		wanted  []*Ref
+	)
+	for _, ref := range remoteRefs {
+		if ref.Sha == nil && ref.Target != "" {
+			continue
+		}
+		for _, spec := range refspecs {
+			dst, ok := spec.Map(ref.Name)
+			if !ok {
+				continue
+			}
+			changes = append(changes, &RefChange{Src: ref.Name, Dst: dst})
+			forced = append(forced, spec.Force)
+			sources = append(sources, ref)
+			if ref.Sha == nil {
+				wanted = append(wanted, ref)
+			} else if ok, err := r.HasObject(ref.Sha); err != nil {
+				return nil, err
+			} else if !ok {
+				wanted = append(wanted, ref)
+			}
+			break
+		}
+	}
+	// Objects can be requested by their full hash, for example the exact
+	// commit to build, if the remote repository allows it.
+	for _, spec := range refspecs {
+		if len(spec.Src) != 40 || spec.IsPattern() {
+			continue
+		}
+		sha, err := hex.DecodeString(spec.Src)
+		if err != nil {
+			continue
+		}
+		ref := &Ref{Name: spec.Src, Sha: sha}
+		changes = append(changes, &RefChange{Src: spec.Src, Dst: spec.Dst})
+		forced = append(forced, spec.Force)
+		sources = append(sources, ref)
+		if ok, err := r.HasObject(sha); err != nil {
+			return nil, err
+		} else if !ok {
+			wanted = append(wanted, ref)
+		}
+	}
+	if len(wanted) != 0 {
+		if err := t.Fetch(wanted); err != nil {
+			return nil, fmt.Errorf("fetch objects: %w", err)
+		}
+	}
+	for i, c := range changes {
+		if sources[i].Sha == nil {
+			return nil, fmt.Errorf("remote did not send %s", c.Src)
+		}
+		c.New = sources[i].Sha
+	}
+
+	var updates []*RefUpdate
+	for i, c := range changes {
+		if c.Dst == "" {
+			continue
+		}
+		switch current, err := r.refs.readRef(c.Dst); {
+		case err == nil:
+			c.Old = current.Sha
+		case errors.Is(err, os.ErrNotExist):
+			// New reference.
+		default:
+			return nil, err
+		}
+		if bytes.Equal(c.Old, c.New) {
+			continue
+		}
+		if err := r.checkRefChange(c, forced[i]); err != nil {
+			return nil, err
+		}
+		if c.Rejected == "" {
+			updates = append(updates, &RefUpdate{Name: c.Dst, Sha: c.New, OldSha: c.Old})
+		}
+	}
+	if len(updates) != 0 && (opts == nil || !opts.DryRun) {
+		if err := r.UpdateRefs(updates...); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// Push sends local references matching refspecs to the remote repository.
+// A refspec with an empty source deletes the destination reference.
+// Rejected changes are not sent.
+func (r *Repository) Push(t Transport, refspecs []*Refspec, opts *PushOptions) ([]*RefChange, error) {
+	remoteRefs, err := t.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("list remote references: %w", err)
+	}
+	remote := make(map[string][]byte, len(remoteRefs))
+	for _, ref := range remoteRefs {
+		remote[ref.Name] = ref.Sha
+	}
+
+	var changes []*RefChange
+	var forced []bool
+	for _, spec := range refspecs {
+		specChanges, err := r.pushChanges(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range specChanges {
+			c.Old = remote[c.Dst]
+			changes = append(changes, c)
+			forced = append(forced, spec.Force)
+		}
+	}
+
+	var accepted []*RefChange
+	for i, c := range changes {
+		switch {
+		case c.New == nil && c.Old == nil:
+			c.Rejected = "remote ref does not exist"
+			continue
+		case c.New == nil:
+			accepted = append(accepted, c)
+			continue
+		case bytes.Equal(c.Old, c.New):
+			continue
+		}
+		if c.Old != nil {
+			// History cannot be compared without the remote commit.
+			if ok, err := r.HasObject(c.Old); err != nil {
+				return nil, err
+			} else if !ok {
+				if forced[i] {
+					c.Forced = true
+					accepted = append(accepted, c)
+				} else {
+					c.Rejected = "fetch first"
+				}
+				continue
+			}
+		}
+		if err := r.checkRefChange(c, forced[i]); err != nil {
+			return nil, err
+		}
+		if c.Rejected == "" {
+			accepted = append(accepted, c)
+		}
+	}
+	if len(accepted) != 0 && (opts == nil || !opts.DryRun) {
+		if err := t.Push(accepted, opts); err != nil {
+			return nil, fmt.Errorf("push: %w", err)
+		}
+	}
+	return changes, nil
+}
+
+// pushChanges expands a push refspec into changes of remote references.
+func (r *Repository) pushChanges(spec *Refspec) ([]*RefChange, error) {
+	if spec.Src == "" {
+		dst, err := qualifyPushDst(spec.Dst, spec.Dst)
+		if err != nil {
+			return nil, err
+		}
+		return []*RefChange{{Dst: dst}}, nil
+	}
+	if spec.IsPattern() {
+		refs, err := r.refs.listRefs()
+		if err != nil {
+			return nil, err
+		}
+		var changes []*RefChange
+		for _, ref := range refs {
+			if dst, ok := spec.Map(ref.Name); ok && ref.Sha != nil {
+				changes = append(changes, &RefChange{Src: ref.Name, Dst: dst, New: ref.Sha})
+			}
+		}
+		return changes, nil
+	}
+
+	src, sha, err := r.expandLocalRef(spec.Src)
+	if err != nil {
+		return nil, err
+	}
+	dst := spec.Dst
+	if dst == "" {
+		dst = src
+	}
+	if dst, err = qualifyPushDst(dst, src); err != nil {
+		return nil, err
+	}
+	return []*RefChange{{Src: src, Dst: dst, New: sha}}, nil
+}
+
+// expandLocalRef finds a local reference by its full or short name. A hash
+// is accepted as well.
+func (r *Repository) expandLocalRef(name string) (string, []byte, error) {
+	for _, full := range []string{name, "refs/" + name, "refs/tags/" + name, "refs/heads/" + name} {
+		switch sha, err := r.resolveRef(full); {
+		case err == nil:
+			return full, sha, nil
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		default:
+			return "", nil, err
+		}
+	}
+	if sha, err := hex.DecodeString(name); err == nil && len(sha) == 20 {
+		return name, sha, nil
+	}
+	return "", nil, fmt.Errorf("src refspec %s does not match any", name)
+}
+
+// qualifyPushDst returns the full destination reference name. Short names
+// are put into the same namespace as the source reference.
+func qualifyPushDst(dst, src string) (string, error) {
+	if strings.HasPrefix(dst, "refs/") {
+		return dst, nil
+	}
+	switch {
+	case strings.HasPrefix(src, "refs/tags/"):
+		return "refs/tags/" + dst, nil
+	case strings.HasPrefix(src, "refs/heads/"), !strings.HasPrefix(src, "refs/"):
+		return "refs/heads/" + dst, nil
+	default:
+		return "", fmt.Errorf("destination %q is not a full reference name", dst)
+	}
+}
+
+// checkRefChange rejects a change that would lose history, unless forced.
+func (r *Repository) checkRefChange(c *RefChange, force bool) error {
+	if c.Old == nil {
+		return nil
+	}
+	if strings.HasPrefix(c.Dst, "refs/tags/") {
+		if force {
+			c.Forced = true
+		} else {
+			c.Rejected = "would clobber existing tag"
+		}
+		return nil
+	}
+	ok, err := r.IsAncestor(c.Old, c.New)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.Dst, err)
+	}
+	switch {
+	case ok:
+		// Fast-forward.
+	case force:
+		c.Forced = true
+	default:
+		c.Rejected = "non-fast-forward"
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Resolve returns the hash of the object named by a revision, as described
+// in gitrevisions(7). Supported are full and abbreviated hashes, reference
+// names with the usual short forms, the @{<n>} reflog entries, the ~<n>,
+// ^<n>, ^{} and ^{<type>} suffixes, and the <rev>:<path> form naming a blob
+// or a tree within a commit.
+func (r *Repository) Resolve(rev string) ([]byte, error) {
+	if i := strings.IndexByte(rev, ':'); i >= 0 {
+		if i == 0 {
+			return nil, fmt.Errorf("revision %q: paths in the index are not supported", rev)
+		}
+		tree, err := r.resolveRevision(rev[:i])
+		if err != nil {
+			return nil, err
+		}
+		if tree, err = r.peelObject(tree, "tree"); err != nil {
+			return nil, fmt.Errorf("revision %q: %w", rev, err)
+		}
+		treePath := strings.Trim(rev[i+1:], "/")
+		if treePath == "" {
+			return tree, nil
+		}
+		tr, err := r.readTree(tree)
+		if err != nil {
+			return nil, err
+		}
+		leaf, err := r.lookupTreePath(tr, treePath)
+		if err != nil {
+			return nil, fmt.Errorf("revision %q: %w", rev, err)
+		}
+		return leaf.Sha, nil
+	}
+	return r.resolveRevision(rev)
+}
+
+// RevisionRange is a set of commits selected by revision arguments, as
+// described in the "Specifying ranges" section of gitrevisions(7). Selected
+// are commits reachable from any of the included commits, but not from any
+// of the excluded ones.
+type RevisionRange struct {
+	Include [][]byte
+	Exclude [][]byte
+}
+
+// ResolveRevisionRange resolves revision arguments. Besides a single
+// revision, each argument can be ^<rev> to exclude commits reachable from
+// it, <rev1>..<rev2> to select commits reachable from rev2 but not from
+// rev1, or <rev1>...<rev2> for commits reachable from either but not from
+// both. A missing side of the dotted notation defaults to HEAD.
+func (r *Repository) ResolveRevisionRange(args []string) (*RevisionRange, error) {
+	rng := &RevisionRange{}
+	for _, arg := range args {
+		if from, to, symmetric, ok := splitRevisionRange(arg); ok {
+			a, err := r.resolveCommit(from)
+			if err != nil {
+				return nil, err
+			}
+			b, err := r.resolveCommit(to)
+			if err != nil {
+				return nil, err
+			}
+			if !symmetric {
+				rng.Include = append(rng.Include, b)
+				rng.Exclude = append(rng.Exclude, a)
+				continue
+			}
+			bases, err := r.MergeBases(a, b)
+			if err != nil {
+				return nil, err
+			}
+			rng.Include = append(rng.Include, a, b)
+			rng.Exclude = append(rng.Exclude, bases...)
+			continue
+		}
+		exclude := strings.HasPrefix(arg, "^")
+		sha, err := r.resolveCommit(strings.TrimPrefix(arg, "^"))
+		if err != nil {
+			return nil, err
+		}
+		if exclude {
+			rng.Exclude = append(rng.Exclude, sha)
+		} else {
+			rng.Include = append(rng.Include, sha)
+		}
+	}
+	return rng, nil
+}
+
+// splitRevisionRange splits the <rev1>..<rev2> and <rev1>...<rev2> forms.
+// Reference names cannot contain two dots, so the forms are not ambiguous.
+func splitRevisionRange(rev string) (from, to string, symmetric, ok bool) {
+	if i := strings.Index(rev, "..."); i >= 0 {
+		from, to = rev[:i], rev[i+3:]
+		symmetric = true
+	} else if i := strings.Index(rev, ".."); i >= 0 {
+		from, to = rev[:i], rev[i+2:]
+	} else {
+		return "", "", false, false
+	}
+	if from == "" {
+		from = "HEAD"
+	}
+	if to == "" {
+		to = "HEAD"
+	}
+	return from, to, symmetric, true
+}
+
+// resolveCommit resolves a revision naming a commit. Tags are peeled.
+func (r *Repository) resolveCommit(rev string) ([]byte, error) {
+	sha, err := r.Resolve(rev)
+	if err != nil {
+		return nil, err
+	}
+	if sha, err = r.peelObject(sha, "commit"); err != nil {
+		return nil, fmt.Errorf("revision %q: %w", rev, err)
+	}
+	return sha, nil
+}
+
+// readTreeish reads the tree named by a revision. Commits and tags are
+// peeled to their trees.
+func (r *Repository) readTreeish(rev string) (*TreeObject, error) {
+	sha, err := r.Resolve(rev)
+	if err != nil {
+		return nil, err
+	}
+	if sha, err = r.peelObject(sha, "tree"); err != nil {
+		return nil, fmt.Errorf("revision %q: %w", rev, err)
+	}
+	return r.readTree(sha)
+}
+
+// resolveRevision resolves a revision without the path part.
+func (r *Repository) resolveRevision(rev string) ([]byte, error) {
+	end := strings.IndexAny(rev, "~^")
+	if end < 0 {
+		end = len(rev)
+	}
+	sha, err := r.resolveRevisionName(rev[:end])
+	if err != nil {
+		return nil, err
+	}
+	for rest := rev[end:]; rest != ""; {
+		op := rest[0]
+		rest = rest[1:]
+
+		if op == '^' && strings.HasPrefix(rest, "{") {
+			j := strings.IndexByte(rest, '}')
+			if j < 0 {
+				return nil, fmt.Errorf("revision %q: unterminated ^{", rev)
+			}
+			kind := rest[1:j]
+			rest = rest[j+1:]
+			if sha, err = r.peelObject(sha, kind); err != nil {
+				return nil, fmt.Errorf("revision %q: %w", rev, err)
+			}
+			continue
+		}
+
+		digits := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+		n := 1
+		if digits != 0 {
+			if n, err = strconv.Atoi(rest[:digits]); err != nil {
+				return nil, fmt.Errorf("revision %q: %w", rev, err)
+			}
+			rest = rest[digits:]
+		}
+		switch op {
+		case '~':
+			for i := 0; i < n; i++ {
+				if sha, err = r.nthParent(sha, 1); err != nil {
+					return nil, fmt.Errorf("revision %q: %w", rev, err)
+				}
+			}
+		case '^':
+			if n == 0 {
+				// ^0 only makes sure that the object is a commit.
+				if sha, err = r.peelObject(sha, "commit"); err != nil {
+					return nil, fmt.Errorf("revision %q: %w", rev, err)
+				}
+				continue
+			}
+			if sha, err = r.nthParent(sha, n); err != nil {
+				return nil, fmt.Errorf("revision %q: %w", rev, err)
+			}
+		}
+	}
+	return sha, nil
+}
+
+// resolveRevisionName returns the hash named by a hash, by a reference or
+// by an entry of a reference log. Short reference names are looked up in
+// the same order as git does, and take precedence over abbreviated hashes.
+func (r *Repository) resolveRevisionName(name string) ([]byte, error) {
+	if i := strings.Index(name, "@{"); i >= 0 && strings.HasSuffix(name, "}") {
+		return r.resolveReflogEntry(name[:i], name[i+2:len(name)-1])
+	}
+	if name == "" || name == "@" {
+		name = "HEAD"
+	}
+	if len(name) == 40 {
+		if sha, err := hex.DecodeString(name); err == nil {
+			return sha, nil
+		}
+	}
+	if err := CheckRefName(name, RefNameOptions{AllowOneLevel: true}); err != nil {
+		return nil, fmt.Errorf("invalid revision %q: %w", name, err)
+	}
+	switch _, sha, err := r.expandRefName(name); {
+	case err == nil:
+		return sha, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	if ok, err := r.isHashPrefix(name); err != nil {
+		return nil, err
+	} else if ok {
+		return r.expandHash(name)
+	}
+	return nil, fmt.Errorf("unknown revision %q: %w", name, os.ErrNotExist)
+}
+
+// expandRefName returns the full name of the reference a short name refers
+// to, and the hash it resolves to.
+func (r *Repository) expandRefName(name string) (string, []byte, error) {
+	candidates := []string{
+		name,
+		"refs/" + name,
+		"refs/tags/" + name,
+		"refs/heads/" + name,
+		"refs/remotes/" + name,
+		"refs/remotes/" + name + "/HEAD",
+	}
+	for _, full := range candidates {
+		switch sha, err := r.resolveRef(full); {
+		case err == nil:
+			return full, sha, nil
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		default:
+			return "", nil, err
+		}
+	}
+	return "", nil, fmt.Errorf("unknown revision %q: %w", name, os.ErrNotExist)
+}
+
+// revisionRefName returns the full name of the reference a revision names,
+// or an empty string if it names an object some other way. HEAD is
+// replaced with the current branch, unless HEAD is detached.
+func (r *Repository) revisionRefName(rev string) (string, error) {
+	if rev == "HEAD" || rev == "@" {
+		head, err := r.Head()
+		if err != nil {
+			return "", err
+		}
+		if head.Target == "" {
+			return "HEAD", nil
+		}
+		return head.Target, nil
+	}
+	if strings.ContainsAny(rev, "~^:") || strings.Contains(rev, "@{") ||
+		CheckRefName(rev, RefNameOptions{AllowOneLevel: true}) != nil {
+		if _, err := r.Resolve(rev); err != nil {
+			return "", err
+		}
+		return "", nil
+	}
+	switch name, _, err := r.expandRefName(rev); {
+	case err == nil:
+		return name, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return "", err
+	}
+	if _, err := r.Resolve(rev); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// resolveReflogEntry returns the value a reference had n updates ago,
+// according to its log. An empty name refers to the current branch.
+func (r *Repository) resolveReflogEntry(name, n string) ([]byte, error) {
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("revision %s@{%s}: only reflog entries by number are supported", name, n)
+	}
+	full := "HEAD"
+	if name == "" {
+		head, err := r.Head()
+		if err != nil {
+			return nil, err
+		}
+		if head.Target == "" {
+			return nil, errors.New("HEAD does not point to a branch")
+		}
+		full = head.Target
+	} else if name != "HEAD" && name != "@" {
+		if full, _, err = r.expandRefName(name); err != nil {
+			return nil, err
+		}
+	}
+	if count == 0 {
+		return r.resolveRef(full)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(r.gitdir, "logs", filepath.FromSlash(full)))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unknown revision %s@{%s}: %w", name, n, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("read reflog: %w", err)
+	}
+	// Each line is the old and the new hash followed by the identity and
+	// the message of the update.
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+	value := func(line string, field int) []byte {
+		chunks := strings.SplitN(line, " ", 3)
+		if len(chunks) < 3 {
+			return nil
+		}
+		sha, err := hex.DecodeString(chunks[field])
+		if err != nil || len(sha) != 20 || bytes.Equal(sha, make([]byte, 20)) {
+			return nil
+		}
+		return sha
+	}
+	var sha []byte
+	if count < len(lines) {
+		sha = value(lines[len(lines)-1-count], 1)
+	} else if count == len(lines) {
+		sha = value(lines[0], 0)
+	}
+	if sha == nil {
+		if name == "" {
+			name = strings.TrimPrefix(full, "refs/heads/")
+		}
+		return nil, fmt.Errorf("log for '%s' only has %d entries", name, len(lines))
+	}
+	return sha, nil
+}
+
+// nthParent returns the n-th parent of a commit, counting from one. Tags
+// are peeled first.
+func (r *Repository) nthParent(sha []byte, n int) ([]byte, error) {
+	sha, err := r.peelObject(sha, "commit")
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.readCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	parents := c.Header["parent"]
+	if n > len(parents) {
+		return nil, fmt.Errorf("commit %x has no parent %d", sha, n)
+	}
+	parent, err := hex.DecodeString(parents[n-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid parent hash value: %w", err)
+	}
+	return parent, nil
+}
+
+// peelObject follows tags, and commits to their trees, until an object of
+// given kind is found. An empty kind peels tags only and the "object" kind
+// accepts any object.
+func (r *Repository) peelObject(sha []byte, kind string) ([]byte, error) {
+	for {
+		obj, err := r.ReadObject(sha)
+		if err != nil {
+			return nil, err
+		}
+		var current, next string
+		switch obj := obj.(type) {
+		case *TagObject:
+			current = "tag"
+			if len(obj.Header["object"]) != 0 {
+				next = obj.Header["object"][0]
+			}
+		case *CommitObject:
+			current = "commit"
+			if kind == "tree" && len(obj.Header["tree"]) != 0 {
+				next = obj.Header["tree"][0]
+			}
+		case *TreeObject:
+			current = "tree"
+		case *BlobObject:
+			current = "blob"
+		}
+		if current == kind || kind == "object" || (kind == "" && current != "tag") {
+			return sha, nil
+		}
+		if next == "" {
+			return nil, fmt.Errorf("%x is a %s, not a %s", sha, current, kind)
+		}
+		if sha, err = hex.DecodeString(next); err != nil {
+			return nil, fmt.Errorf("invalid %s hash value: %w", current, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	repo := newTestRepository(t)
+	first := writeTestCommit(t, repo, "first")
+	second := writeTestCommit(t, repo, "second", first)
+	third := writeTestCommit(t, repo, "third", second, first)
+	if err := repo.UpdateRefs(
+		&RefUpdate{Name: "refs/heads/master", Sha: third},
+		&RefUpdate{Name: "refs/tags/v1", Sha: first},
+	); err != nil {
+		t.Fatalf("update refs: %s", err)
+	}
+	c, err := repo.readCommit(second)
+	if err != nil {
+		t.Fatalf("read commit: %s", err)
+	}
+	tree, err := hex.DecodeString(c.Header["tree"][0])
+	if err != nil {
+		t.Fatalf("decode tree hash: %s", err)
+	}
+	blob, err := repo.WriteObject("blob", []byte("second"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	reflog := fmt.Sprintf("%x %x A <a@example.com> 1600000000 +0000\tcommit (initial): first\n", make([]byte, 20), first) +
+		fmt.Sprintf("%x %x A <a@example.com> 1600000000 +0000\tcommit: second\n", first, second) +
+		fmt.Sprintf("%x %x A <a@example.com> 1600000000 +0000\tmerge\n", second, third)
+	if err := os.MkdirAll(filepath.Join(repo.gitdir, "logs", "refs", "heads"), 0755); err != nil {
+		t.Fatalf("create logs directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo.gitdir, "logs", "refs", "heads", "master"), []byte(reflog), 0644); err != nil {
+		t.Fatalf("write reflog: %s", err)
+	}
+
+	cases := map[string]struct {
+		rev  string
+		want []byte
+	}{
+		"full hash":     {rev: hex.EncodeToString(second), want: second},
+		"short hash":    {rev: hex.EncodeToString(second)[:12], want: second},
+		"short upper":   {rev: strings.ToUpper(hex.EncodeToString(second)[:12]), want: second},
+		"head":          {rev: "HEAD", want: third},
+		"at sign":       {rev: "@", want: third},
+		"short branch":  {rev: "master", want: third},
+		"short tag":     {rev: "v1", want: first},
+		"first parent":  {rev: "HEAD^", want: second},
+		"second parent": {rev: "HEAD^2", want: first},
+		"ancestor":      {rev: "master~2", want: first},
+		"chained":       {rev: "HEAD~1^", want: first},
+		"zero parent":   {rev: "HEAD^0", want: third},
+		"peel tree":     {rev: "HEAD~^{tree}", want: tree},
+		"path blob":     {rev: "HEAD~1:file.txt", want: blob},
+		"path root":     {rev: "HEAD~1:", want: tree},
+		"reflog newest": {rev: "master@{0}", want: third},
+		"reflog":        {rev: "master@{1}", want: second},
+		"reflog branch": {rev: "@{2}", want: first},
+		"reflog parent": {rev: "master@{1}~1", want: first},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, err := repo.Resolve(tc.rev)
+			if err != nil {
+				t.Fatalf("resolve %q: %s", tc.rev, err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Fatalf("want %x, got %x", tc.want, got)
+			}
+		})
+	}
+
+	for _, rev := range []string{"missing", "HEAD~3", "HEAD^3", "HEAD:missing.txt", "HEAD:file.txt/x", "v1^{blob}", "a..b", "abc", "master@{3}", "HEAD@{1}", "master@{yesterday}"} {
+		if _, err := repo.Resolve(rev); err == nil {
+			t.Errorf("%q: want error", rev)
+		}
+	}
+}
+
+func TestResolveRevisionRange(t *testing.T) {
+	repo := newTestRepository(t)
+	base := writeTestCommit(t, repo, "base")
+	trunk := writeTestCommit(t, repo, "trunk", base)
+	side := writeTestCommit(t, repo, "side", base)
+	if err := repo.UpdateRefs(
+		&RefUpdate{Name: "refs/heads/master", Sha: trunk},
+		&RefUpdate{Name: "refs/heads/side", Sha: side},
+	); err != nil {
+		t.Fatalf("update refs: %s", err)
+	}
+
+	cases := map[string]struct {
+		args []string
+		want RevisionRange
+	}{
+		"single": {
+			args: []string{"side"},
+			want: RevisionRange{Include: [][]byte{side}},
+		},
+		"exclude": {
+			args: []string{"side", "^master"},
+			want: RevisionRange{Include: [][]byte{side}, Exclude: [][]byte{trunk}},
+		},
+		"two dots": {
+			args: []string{"master..side"},
+			want: RevisionRange{Include: [][]byte{side}, Exclude: [][]byte{trunk}},
+		},
+		"two dots default head": {
+			args: []string{"side.."},
+			want: RevisionRange{Include: [][]byte{trunk}, Exclude: [][]byte{side}},
+		},
+		"three dots": {
+			args: []string{"master...side"},
+			want: RevisionRange{Include: [][]byte{trunk, side}, Exclude: [][]byte{base}},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, err := repo.ResolveRevisionRange(tc.args)
+			if err != nil {
+				t.Fatalf("resolve %q: %s", tc.args, err)
+			}
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Fatalf("want %x, got %x", tc.want, *got)
+			}
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// WalkedCommit is a commit returned by RevWalk.
+type WalkedCommit struct {
+	Sha     []byte
+	Commit  *CommitObject
+	Parents [][]byte
+	// Committer is nil if the commit has no valid committer header.
+	Committer *Ident
+}
+
+// RevWalk iterates over commits reachable from the tips, newest first by
+// commit date, same as git log does by default. Commits are read only when
+// needed, so that the walk can be stopped early.
+type RevWalk struct {
+	// Filter, if set, limits returned commits. Commits that do not match
+	// are still walked through.
+	Filter *CommitFilter
+	// FirstParent follows only the first parent of merge commits.
+	FirstParent bool
+	// AncestryPath, if set, limits the walk to commits that are
+	// descendants of any of the given commits. Those commits are not
+	// returned themselves. It requires walking the whole history before
+	// the first commit is returned.
+	AncestryPath [][]byte
+	// Paths, if set, limits returned commits to those that change paths
+	// selected by the pathspec, compared to their parents. A commit that
+	// does not change them compared to one of its parents is walked only
+	// through that parent, same as the default history simplification of
+	// git log.
+	Paths *Pathspec
+
+	repo  *Repository
+	queue commitQueue
+	seen  map[string]struct{}
+	// hidden are commits reachable from the hidden tips.
+	hidden map[string]struct{}
+	// limited is set once all commits to return are queued.
+	limited bool
+	// bloomKeys are the changed-path filter keys of Paths, computed on
+	// first use. They are nil if filters cannot be used.
+	bloomKeys  [][]bloomKey
+	bloomReady bool
+}
+
+// NewRevWalk returns a walk starting at given commits.
+func (r *Repository) NewRevWalk(tips [][]byte) (*RevWalk, error) {
+	w := &RevWalk{
+		repo:   r,
+		seen:   make(map[string]struct{}),
+		hidden: make(map[string]struct{}),
+	}
+	for _, sha := range tips {
+		if err := w.push(sha); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Hide excludes a commit and all of its ancestors from the walk, as the
+// ^<rev> notation does. It must be called before the walk is started.
+func (w *RevWalk) Hide(sha []byte) error {
+	w.hidden[string(sha)] = struct{}{}
+	return w.push(sha)
+}
+
+func (w *RevWalk) push(sha []byte) error {
+	if _, ok := w.seen[string(sha)]; ok {
+		return nil
+	}
+	w.seen[string(sha)] = struct{}{}
+	walked, err := w.repo.readWalkedCommit(sha)
+	if err != nil {
+		return err
+	}
+	heap.Push(&w.queue, &queuedCommit{commit: walked, order: len(w.seen)})
+	return nil
+}
+
+func (r *Repository) readWalkedCommit(sha []byte) (*WalkedCommit, error) {
+	c, err := r.readCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	walked := &WalkedCommit{Sha: sha, Commit: c}
+	for _, parent := range c.Header["parent"] {
+		p, err := hex.DecodeString(parent)
+		if err != nil {
+			return nil, fmt.Errorf("commit %x: invalid parent: %w", sha, err)
+		}
+		walked.Parents = append(walked.Parents, p)
+	}
+	if committer := c.Header["committer"]; len(committer) != 0 {
+		walked.Committer, _ = parseIdent(committer[0])
+	}
+	return walked, nil
+}
+
+// Next returns the next commit of the walk. Error io.EOF is returned once
+// all commits were visited.
+func (w *RevWalk) Next() (*WalkedCommit, error) {
+	if w.AncestryPath != nil && !w.limited {
+		if err := w.limitAncestryPath(); err != nil {
+			return nil, err
+		}
+	}
+	for !w.done() {
+		q, err := w.step()
+		if err != nil {
+			return nil, err
+		}
+		if q == nil || q.treesame {
+			continue
+		}
+		if w.Filter == nil || w.Filter.Match(q.commit.Commit) {
+			return q.commit, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// done returns true if no more commits can be returned. Once only hidden
+// commits are queued, no commit reachable from them can be returned.
+func (w *RevWalk) done() bool {
+	if len(w.hidden) == 0 {
+		return w.queue.Len() == 0
+	}
+	for _, q := range w.queue {
+		if _, ok := w.hidden[string(q.commit.Sha)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// step takes the next commit from the queue and queues its parents. Nil is
+// returned if the commit is hidden.
+func (w *RevWalk) step() (*queuedCommit, error) {
+	q := heap.Pop(&w.queue).(*queuedCommit)
+	if w.limited {
+		return q, nil
+	}
+	_, hidden := w.hidden[string(q.commit.Sha)]
+	parents := w.walkedParents(q.commit)
+	if !hidden && !w.Paths.IsEmpty() {
+		var err error
+		if parents, q.treesame, err = w.simplify(q.commit, parents); err != nil {
+			return nil, err
+		}
+	}
+	for _, parent := range parents {
+		if hidden {
+			w.hidden[string(parent)] = struct{}{}
+		}
+		if err := w.push(parent); err != nil {
+			return nil, err
+		}
+	}
+	if hidden {
+		return nil, nil
+	}
+	return q, nil
+}
+
+func (w *RevWalk) walkedParents(c *WalkedCommit) [][]byte {
+	if w.FirstParent && len(c.Parents) > 1 {
+		return c.Parents[:1]
+	}
+	return c.Parents
+}
+
+// simplify returns the parents to walk through and whether the commit
+// should be left out, because it does not change Paths compared to one of
+// its parents.
+func (w *RevWalk) simplify(c *WalkedCommit, parents [][]byte) ([][]byte, bool, error) {
+	if len(parents) == 0 {
+		same, err := w.treesame(c, nil)
+		return nil, same, err
+	}
+	for _, parent := range parents {
+		same, err := w.treesame(c, parent)
+		if err != nil {
+			return nil, false, err
+		}
+		if same {
+			return [][]byte{parent}, true, nil
+		}
+	}
+	return parents, false, nil
+}
+
+// treesame returns true if the commit and the parent have the same content
+// of Paths. A nil parent is the empty tree. Comparing against the first
+// parent does not read the trees if the commit-graph has a changed-path
+// filter that rules out all paths.
+func (w *RevWalk) treesame(c *WalkedCommit, parent []byte) (bool, error) {
+	if parent == nil || (len(c.Parents) != 0 && bytes.Equal(parent, c.Parents[0])) {
+		if !w.bloomReady {
+			w.bloomKeys, w.bloomReady = bloomPathspecKeys(w.Paths), true
+		}
+		if maybe, ok := w.repo.maybeChangedPaths(c.Sha, w.bloomKeys); ok && !maybe {
+			return true, nil
+		}
+	}
+	tree, err := w.repo.commitTree(c.Commit)
+	if err != nil {
+		return false, fmt.Errorf("commit %x: %w", c.Sha, err)
+	}
+	var old *TreeObject
+	if parent != nil {
+		if old, err = w.repo.readTreeish(hex.EncodeToString(parent)); err != nil {
+			return false, err
+		}
+	}
+	changes, err := w.repo.DiffTrees(old, tree, true, w.Paths)
+	if err != nil {
+		return false, err
+	}
+	return len(changes) == 0, nil
+}
+
+// limitAncestryPath walks all commits down to the ancestry path bottoms and
+// queues again only those that descend from them.
+func (w *RevWalk) limitAncestryPath() error {
+	bottoms := make(map[string]struct{}, len(w.AncestryPath))
+	for _, sha := range w.AncestryPath {
+		bottoms[string(sha)] = struct{}{}
+		// Ancestors of a bottom commit cannot descend from it.
+		if err := w.Hide(sha); err != nil {
+			return err
+		}
+	}
+	var all []*queuedCommit
+	for !w.done() {
+		q, err := w.step()
+		if err != nil {
+			return err
+		}
+		if q != nil {
+			all = append(all, q)
+		}
+	}
+
+	// Commits are walked newest first, so going backward mostly visits
+	// parents before their children. Repeat until no commit is added, in
+	// case commit dates are out of order.
+	onPath := make(map[string]struct{})
+	for changed := true; changed; {
+		changed = false
+		for i := len(all) - 1; i >= 0; i-- {
+			c := all[i].commit
+			if _, ok := onPath[string(c.Sha)]; ok {
+				continue
+			}
+			// All parents count, even if only the first one is walked.
+			for _, parent := range c.Parents {
+				_, bottom := bottoms[string(parent)]
+				_, descendant := onPath[string(parent)]
+				if bottom || descendant {
+					onPath[string(c.Sha)] = struct{}{}
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	w.queue = w.queue[:0]
+	for _, q := range all {
+		if _, ok := onPath[string(q.commit.Sha)]; ok {
+			heap.Push(&w.queue, q)
+		}
+	}
+	w.limited = true
+	return nil
+}
+
+// MergeBases returns the best common ancestors of two commits. There can be
+// more than one if neither of them is an ancestor of the other, for example
+// after criss-cross merges.
+func (r *Repository) MergeBases(a, b []byte) ([][]byte, error) {
+	return r.mergeBasesOf([][]byte{a}, [][]byte{b})
+}
+
+// mergeBasesOf returns the best common ancestors of two sets of commits,
+// which are the merge bases of two commits having the sets as parents.
+func (r *Repository) mergeBasesOf(as, bs [][]byte) ([][]byte, error) {
+	const (
+		fromA = 1 << iota
+		fromB
+		stale
+	)
+	flags := make(map[string]int)
+	var queue commitQueue
+	push := func(sha []byte, f int) error {
+		if flags[string(sha)]&f == f {
+			return nil
+		}
+		flags[string(sha)] |= f
+		c, err := r.readWalkedCommit(sha)
+		if err != nil {
+			return err
+		}
+		heap.Push(&queue, &queuedCommit{commit: c, order: len(flags)})
+		return nil
+	}
+	for _, a := range as {
+		if err := push(a, fromA); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range bs {
+		if err := push(b, fromB); err != nil {
+			return nil, err
+		}
+	}
+
+	// Paint commits with the tips they are reachable from, until only
+	// commits below already found common ancestors are left.
+	var candidates [][]byte
+	for {
+		active := false
+		for _, q := range queue {
+			if flags[string(q.commit.Sha)]&stale == 0 {
+				active = true
+				break
+			}
+		}
+		if !active {
+			break
+		}
+		c := heap.Pop(&queue).(*queuedCommit).commit
+		f := flags[string(c.Sha)]
+		if f&(fromA|fromB) == fromA|fromB {
+			if f&stale == 0 {
+				candidates = append(candidates, c.Sha)
+			}
+			f |= stale
+			flags[string(c.Sha)] = f
+		}
+		for _, parent := range c.Parents {
+			if err := push(parent, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A candidate can be an ancestor of another one when commit dates
+	// are out of order.
+	var bases [][]byte
+	for i, c := range candidates {
+		redundant := false
+		for j, other := range candidates {
+			if i == j {
+				continue
+			}
+			ok, err := r.IsAncestor(c, other)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			bases = append(bases, c)
+		}
+	}
+	return bases, nil
+}
+
+// ReachFilter selects references by the reachability of the commits they
+// point to. Lists that are empty select every reference.
+type ReachFilter struct {
+	// Contains selects tips that any of the commits is reachable from.
+	Contains [][]byte
+	// Merged selects tips reachable from any of the commits, and NoMerged
+	// tips reachable from none of them.
+	Merged   [][]byte
+	NoMerged [][]byte
+}
+
+// IsEmpty returns true if the filter selects every reference.
+func (f *ReachFilter) IsEmpty() bool {
+	return len(f.Contains) == 0 && len(f.Merged) == 0 && len(f.NoMerged) == 0
+}
+
+// FilterReachable returns the sorted names of references selected by the
+// filter. Annotated tags are peeled, and references to objects other than
+// commits are not selected unless the filter is empty.
+func (r *Repository) FilterReachable(refs map[string][]byte, f *ReachFilter) ([]string, error) {
+	var names []string
+	for name, sha := range refs {
+		if !f.IsEmpty() {
+			tip, err := r.peelObject(sha, "commit")
+			if err != nil {
+				continue
+			}
+			if ok, err := r.matchReach(f, tip); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *Repository) matchReach(f *ReachFilter, tip []byte) (bool, error) {
+	if len(f.Contains) != 0 {
+		contains := false
+		for _, sha := range f.Contains {
+			ok, err := r.IsAncestor(sha, tip)
+			if err != nil {
+				return false, err
+			}
+			if contains = ok; contains {
+				break
+			}
+		}
+		if !contains {
+			return false, nil
+		}
+	}
+	if len(f.Merged) != 0 {
+		merged, err := r.reachableFromAny(tip, f.Merged)
+		if err != nil || !merged {
+			return false, err
+		}
+	}
+	merged, err := r.reachableFromAny(tip, f.NoMerged)
+	return !merged, err
+}
+
+// reachableFromAny returns true if the commit is reachable from any of the
+// tips.
+func (r *Repository) reachableFromAny(sha []byte, tips [][]byte) (bool, error) {
+	for _, tip := range tips {
+		if ok, err := r.IsAncestor(sha, tip); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// CommitFilter selects commits by their author, committer, message and
+// number of parents. Within each list, a commit must match any of the
+// patterns. Lists that are empty match every commit.
+type CommitFilter struct {
+	// Merges selects only commits with more than one parent, and NoMerges
+	// only commits with at most one.
+	Merges   bool
+	NoMerges bool
+
+	// Author and Committer patterns are matched against the "Name <email>"
+	// part of the identity.
+	Author    []*regexp.Regexp
+	Committer []*regexp.Regexp
+	Grep      []*regexp.Regexp
+	// InvertGrep selects commits with a message that matches none of the
+	// Grep patterns.
+	InvertGrep bool
+}
+
+// IsEmpty returns true if the filter matches every commit.
+func (f *CommitFilter) IsEmpty() bool {
+	return len(f.Author) == 0 && len(f.Committer) == 0 && len(f.Grep) == 0 && !f.Merges && !f.NoMerges
+}
+
+// Match returns true if the commit is selected by the filter.
+func (f *CommitFilter) Match(c *CommitObject) bool {
+	if merge := len(c.Header["parent"]) > 1; (f.Merges && !merge) || (f.NoMerges && merge) {
+		return false
+	}
+	if !matchIdent(f.Author, c.Header["author"]) || !matchIdent(f.Committer, c.Header["committer"]) {
+		return false
+	}
+	if len(f.Grep) == 0 {
+		return true
+	}
+	return matchAny(f.Grep, c.Comment) != f.InvertGrep
+}
+
+func matchIdent(patterns []*regexp.Regexp, header []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	if len(header) == 0 {
+		return false
+	}
+	// The date is not matched, same as in git.
+	ident := header[0]
+	if end := strings.LastIndexByte(ident, '>'); end >= 0 {
+		ident = ident[:end+1]
+	}
+	return matchAny(patterns, ident)
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+type queuedCommit struct {
+	commit *WalkedCommit
+	// order breaks ties between commits with the same date.
+	order int
+	// treesame is set by RevWalk for commits left out by the history
+	// simplification.
+	treesame bool
+}
+
+// commitQueue implements heap.Interface, with the newest commit first.
+type commitQueue []*queuedCommit
+
+func (q commitQueue) Len() int { return len(q) }
+
+func (q commitQueue) Less(i, j int) bool {
+	a, b := q[i].commit.Committer, q[j].commit.Committer
+	switch {
+	case a == nil || b == nil:
+		// Commits without a date go last.
+		if (a == nil) != (b == nil) {
+			return b == nil
+		}
+	case !a.When.Equal(b.When):
+		return a.When.After(b.When)
+	}
+	return q[i].order < q[j].order
+}
+
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*queuedCommit)) }
+
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestRevWalk(t *testing.T) {
+	repo := newTestRepository(t)
+	// All commits have the same date, so they are walked in the order in
+	// which they were found.
+	base := writeTestCommit(t, repo, "base")
+	trunk := writeTestCommit(t, repo, "trunk", base)
+	side := writeTestCommit(t, repo, "side", base)
+	merge := writeTestCommit(t, repo, "merge", trunk, side)
+	top := writeTestCommit(t, repo, "top", merge)
+
+	cases := map[string]struct {
+		filter       *CommitFilter
+		hide         [][]byte
+		firstParent  bool
+		ancestryPath [][]byte
+		want         []string
+	}{
+		"all": {
+			want: []string{"top", "merge", "trunk", "side", "base"},
+		},
+		"first parent": {
+			firstParent: true,
+			want:        []string{"top", "merge", "trunk", "base"},
+		},
+		"merges": {
+			filter: &CommitFilter{Merges: true},
+			want:   []string{"merge"},
+		},
+		"no merges": {
+			filter: &CommitFilter{NoMerges: true},
+			want:   []string{"top", "trunk", "side", "base"},
+		},
+		"hidden": {
+			hide: [][]byte{trunk},
+			want: []string{"top", "merge", "side"},
+		},
+		"hidden first parent": {
+			hide:        [][]byte{side},
+			firstParent: true,
+			want:        []string{"top", "merge", "trunk"},
+		},
+		"ancestry path": {
+			ancestryPath: [][]byte{side},
+			want:         []string{"top", "merge"},
+		},
+		"ancestry path from root": {
+			ancestryPath: [][]byte{base},
+			want:         []string{"top", "merge", "trunk", "side"},
+		},
+		"ancestry path through second parent": {
+			firstParent:  true,
+			ancestryPath: [][]byte{side},
+			want:         []string{"top", "merge"},
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			walk, err := repo.NewRevWalk([][]byte{top})
+			if err != nil {
+				t.Fatalf("new walk: %s", err)
+			}
+			for _, sha := range tc.hide {
+				if err := walk.Hide(sha); err != nil {
+					t.Fatalf("hide: %s", err)
+				}
+			}
+			walk.Filter = tc.filter
+			walk.FirstParent = tc.firstParent
+			walk.AncestryPath = tc.ancestryPath
+
+			var got []string
+			for {
+				c, err := walk.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("next: %s", err)
+				}
+				got = append(got, c.Commit.Comment[:len(c.Commit.Comment)-1])
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMergeBases(t *testing.T) {
+	repo := newTestRepository(t)
+	base := writeTestCommit(t, repo, "base")
+	trunk := writeTestCommit(t, repo, "trunk", base)
+	side := writeTestCommit(t, repo, "side", base)
+	merge := writeTestCommit(t, repo, "merge", trunk, side)
+	// Criss-cross merges have two best common ancestors.
+	crossA := writeTestCommit(t, repo, "cross a", trunk, side)
+	crossB := writeTestCommit(t, repo, "cross b", side, trunk)
+
+	cases := map[string]struct {
+		a, b []byte
+		want [][]byte
+	}{
+		"fork point": {a: trunk, b: side, want: [][]byte{base}},
+		"ancestor":   {a: merge, b: side, want: [][]byte{side}},
+		"same":       {a: merge, b: merge, want: [][]byte{merge}},
+		"criss-cross": {
+			a:    crossA,
+			b:    crossB,
+			want: [][]byte{trunk, side},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, err := repo.MergeBases(tc.a, tc.b)
+			if err != nil {
+				t.Fatalf("merge bases: %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %x, got %x", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFilterReachable(t *testing.T) {
+	repo := newTestRepository(t)
+	base := writeTestCommit(t, repo, "base")
+	trunk := writeTestCommit(t, repo, "trunk", base)
+	side := writeTestCommit(t, repo, "side", base)
+	merge := writeTestCommit(t, repo, "merge", trunk, side)
+	topic := writeTestCommit(t, repo, "topic", trunk)
+	commit, err := repo.readCommit(base)
+	if err != nil {
+		t.Fatalf("read commit: %s", err)
+	}
+	tree, err := hex.DecodeString(commit.Header["tree"][0])
+	if err != nil {
+		t.Fatalf("tree: %s", err)
+	}
+	refs := map[string][]byte{
+		"master": merge,
+		"side":   side,
+		"topic":  topic,
+		"old":    base,
+		"tree":   tree,
+	}
+
+	cases := map[string]struct {
+		filter ReachFilter
+		want   []string
+	}{
+		"empty": {
+			want: []string{"master", "old", "side", "topic", "tree"},
+		},
+		"contains": {
+			filter: ReachFilter{Contains: [][]byte{trunk}},
+			want:   []string{"master", "topic"},
+		},
+		"contains any": {
+			filter: ReachFilter{Contains: [][]byte{side, topic}},
+			want:   []string{"master", "side", "topic"},
+		},
+		"merged": {
+			filter: ReachFilter{Merged: [][]byte{merge}},
+			want:   []string{"master", "old", "side"},
+		},
+		"no merged": {
+			filter: ReachFilter{NoMerged: [][]byte{merge}},
+			want:   []string{"topic"},
+		},
+		"merged and not merged": {
+			filter: ReachFilter{Merged: [][]byte{merge}, NoMerged: [][]byte{side}},
+			want:   []string{"master"},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, err := repo.FilterReachable(refs, &tc.filter)
+			if err != nil {
+				t.Fatalf("filter: %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCommitFilterMatch(t *testing.T) {
+	commit := &CommitObject{
+		Header: map[string][]string{
+			"author":    []string{"Bob R <bobr@example.com> 1580755918 +0100"},
+			"committer": []string{"Alice M <alice@example.com> 1580755918 +0100"},
+		},
+		Comment: "Fix the parser\n\nIt crashed on empty input.\n",
+	}
+	re := func(patterns ...string) []*regexp.Regexp {
+		var res []*regexp.Regexp
+		for _, p := range patterns {
+			res = append(res, regexp.MustCompile(p))
+		}
+		return res
+	}
+
+	cases := map[string]struct {
+		filter CommitFilter
+		want   bool
+	}{
+		"empty": {
+			filter: CommitFilter{},
+			want:   true,
+		},
+		"author name": {
+			filter: CommitFilter{Author: re("^Bob")},
+			want:   true,
+		},
+		"author email": {
+			filter: CommitFilter{Author: re(`bobr@example\.com>$`)},
+			want:   true,
+		},
+		"author date is not matched": {
+			filter: CommitFilter{Author: re("1580755918")},
+			want:   false,
+		},
+		"any author pattern": {
+			filter: CommitFilter{Author: re("Carol", "Bob")},
+			want:   true,
+		},
+		"committer": {
+			filter: CommitFilter{Committer: re("Bob")},
+			want:   false,
+		},
+		"grep body": {
+			filter: CommitFilter{Grep: re("empty input")},
+			want:   true,
+		},
+		"invert grep": {
+			filter: CommitFilter{Grep: re("empty input"), InvertGrep: true},
+			want:   false,
+		},
+		"invert grep without match": {
+			filter: CommitFilter{Grep: re("typo"), InvertGrep: true},
+			want:   true,
+		},
+		"all kinds must match": {
+			filter: CommitFilter{Author: re("Bob"), Grep: re("typo")},
+			want:   false,
+		},
+		"no merges": {
+			filter: CommitFilter{NoMerges: true},
+			want:   true,
+		},
+		"merges": {
+			filter: CommitFilter{Merges: true},
+			want:   false,
+		},
+		"invert grep does not invert author": {
+			filter: CommitFilter{Author: re("Carol"), Grep: re("typo"), InvertGrep: true},
+			want:   false,
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			if got := tc.filter.Match(commit); got != tc.want {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkRevWalk(b *testing.B) {
+	shape := defaultFixtureShape
+	shape.Commits = 500
+	f := buildFixture(b, shape)
+	tips := [][]byte{f.Branches["refs/heads/master"]}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		walk, err := f.Repo.NewRevWalk(tips)
+		if err != nil {
+			b.Fatalf("new walk: %s", err)
+		}
+		for {
+			if _, err := walk.Next(); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				b.Fatalf("walk: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Search index is an inverted index of terms found in commit messages and
+// author identities, stored in .git/search-index. The file starts with the
+// "GSIX" signature and a 4 byte version, followed by:
+//
+//   - the number of tips and their hashes; commits reachable from the tips
+//     are indexed,
+//   - the number of commits and their hashes, newest first,
+//   - the number of terms and, for every term in sorted order, the length
+//     prefixed term and the list of positions of commits containing it.
+//
+// Lengths and positions are written as unsigned varints. Positions are
+// increasing and each is stored as the difference from the previous one.
+// The file ends with the SHA-1 checksum of its content.
+const (
+	searchIndexSignature = "GSIX"
+	searchIndexVersion   = 1
+)
+
+// SearchIndex maps terms to commits that contain them.
+type SearchIndex struct {
+	Tips    [][]byte
+	Commits [][]byte
+	terms   map[string][]uint32
+}
+
+// searchTerms splits text into lower case words made of letters and
+// digits.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+}
+
+// commitSearchTerms returns terms of the commit message and of the author
+// name and email.
+func commitSearchTerms(c *CommitObject) []string {
+	text := c.Comment
+	if author := c.Header["author"]; len(author) != 0 {
+		ident := author[0]
+		if end := strings.LastIndexByte(ident, '>'); end >= 0 {
+			ident = ident[:end+1]
+		}
+		text += "\n" + ident
+	}
+	return searchTerms(text)
+}
+
+// BuildSearchIndex indexes all commits reachable from the tips.
+func (r *Repository) BuildSearchIndex(tips [][]byte) (*SearchIndex, error) {
+	walk, err := r.NewRevWalk(tips)
+	if err != nil {
+		return nil, err
+	}
+	idx := &SearchIndex{Tips: tips, terms: make(map[string][]uint32)}
+	for {
+		c, err := walk.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		pos := uint32(len(idx.Commits))
+		idx.Commits = append(idx.Commits, c.Sha)
+		for _, term := range commitSearchTerms(c.Commit) {
+			postings := idx.terms[term]
+			if len(postings) == 0 || postings[len(postings)-1] != pos {
+				idx.terms[term] = append(postings, pos)
+			}
+		}
+	}
+	return idx, nil
+}
+
+// Search returns commits that contain all terms of the query, newest first.
+func (idx *SearchIndex) Search(query string) [][]byte {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	// Intersect starting from the rarest term, so that the candidate list
+	// is as short as possible.
+	sort.Slice(terms, func(i, j int) bool { return len(idx.terms[terms[i]]) < len(idx.terms[terms[j]]) })
+	candidates := idx.terms[terms[0]]
+	for _, term := range terms[1:] {
+		postings := idx.terms[term]
+		var common []uint32
+		for i, j := 0, 0; i < len(candidates) && j < len(postings); {
+			switch {
+			case candidates[i] < postings[j]:
+				i++
+			case candidates[i] > postings[j]:
+				j++
+			default:
+				common = append(common, candidates[i])
+				i++
+				j++
+			}
+		}
+		candidates = common
+	}
+	found := make([][]byte, 0, len(candidates))
+	for _, pos := range candidates {
+		found = append(found, idx.Commits[pos])
+	}
+	return found
+}
+
+// Serialize returns the index in the search index file format.
+func (idx *SearchIndex) Serialize() []byte {
+	var b bytes.Buffer
+	var buf [binary.MaxVarintLen64]byte
+	uvarint := func(n uint64) {
+		b.Write(buf[:binary.PutUvarint(buf[:], n)])
+	}
+	b.WriteString(searchIndexSignature)
+	binary.Write(&b, binary.BigEndian, uint32(searchIndexVersion))
+	for _, list := range [][][]byte{idx.Tips, idx.Commits} {
+		uvarint(uint64(len(list)))
+		for _, sha := range list {
+			b.Write(sha)
+		}
+	}
+	terms := make([]string, 0, len(idx.terms))
+	for term := range idx.terms {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	uvarint(uint64(len(terms)))
+	for _, term := range terms {
+		uvarint(uint64(len(term)))
+		b.WriteString(term)
+		postings := idx.terms[term]
+		uvarint(uint64(len(postings)))
+		prev := uint32(0)
+		for _, pos := range postings {
+			uvarint(uint64(pos - prev))
+			prev = pos
+		}
+	}
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+	return b.Bytes()
+}
+
+// parseSearchIndex parses the content of a search index file.
+func parseSearchIndex(raw []byte) (*SearchIndex, error) {
+	if len(raw) < 8+sha1.Size {
+		return nil, errors.New("search index is too small")
+	}
+	data := raw[:len(raw)-sha1.Size]
+	if sum := sha1.Sum(data); !bytes.Equal(sum[:], raw[len(data):]) {
+		return nil, errors.New("search index checksum mismatch")
+	}
+	if string(data[:4]) != searchIndexSignature {
+		return nil, fmt.Errorf("invalid search index signature %q", data[:4])
+	}
+	if v := binary.BigEndian.Uint32(data[4:8]); v != searchIndexVersion {
+		return nil, fmt.Errorf("unsupported search index version %d", v)
+	}
+	rd := bufio.NewReader(bytes.NewReader(data[8:]))
+	readCount := func(max uint64) (int, error) {
+		n, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return 0, fmt.Errorf("search index is truncated: %w", err)
+		}
+		if n > max {
+			return 0, fmt.Errorf("search index: invalid length %d", n)
+		}
+		return int(n), nil
+	}
+	readHashes := func() ([][]byte, error) {
+		n, err := readCount(uint64(len(data) / sha1.Size))
+		if err != nil {
+			return nil, err
+		}
+		hashes := make([][]byte, n)
+		for i := range hashes {
+			hashes[i] = make([]byte, sha1.Size)
+			if _, err := io.ReadFull(rd, hashes[i]); err != nil {
+				return nil, fmt.Errorf("search index is truncated: %w", err)
+			}
+		}
+		return hashes, nil
+	}
+
+	idx := &SearchIndex{terms: make(map[string][]uint32)}
+	var err error
+	if idx.Tips, err = readHashes(); err != nil {
+		return nil, err
+	}
+	if idx.Commits, err = readHashes(); err != nil {
+		return nil, err
+	}
+	count, err := readCount(uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		n, err := readCount(uint64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		term := make([]byte, n)
+		if _, err := io.ReadFull(rd, term); err != nil {
+			return nil, fmt.Errorf("search index is truncated: %w", err)
+		}
+		n, err = readCount(uint64(len(idx.Commits)))
+		if err != nil {
+			return nil, err
+		}
+		postings := make([]uint32, n)
+		pos := uint64(0)
+		for j := range postings {
+			delta, err := binary.ReadUvarint(rd)
+			if err != nil {
+				return nil, fmt.Errorf("search index is truncated: %w", err)
+			}
+			if pos += delta; pos >= uint64(len(idx.Commits)) || (j > 0 && delta == 0) {
+				return nil, fmt.Errorf("search index: term %q: invalid commit position", term)
+			}
+			postings[j] = uint32(pos)
+		}
+		idx.terms[string(term)] = postings
+	}
+	if _, err := rd.ReadByte(); err != io.EOF {
+		return nil, errors.New("search index: unexpected data after the terms")
+	}
+	return idx, nil
+}
+
+func (r *Repository) searchIndexPath() string {
+	return path.Join(r.gitdir, "search-index")
+}
+
+// WriteSearchIndex replaces the search index file of the repository.
+func (r *Repository) WriteSearchIndex(idx *SearchIndex) error {
+	dest := r.searchIndexPath()
+	lock := dest + ".lock"
+	if err := writeLockFile(r.gitdir, lock, idx.Serialize(), false); err != nil {
+		return fmt.Errorf("write search index: %w", err)
+	}
+	if err := commitLock(lock, dest); err != nil {
+		return fmt.Errorf("rename search index: %w", err)
+	}
+	return nil
+}
+
+// ReadSearchIndex reads the search index file of the repository. Error
+// os.ErrNotExist is returned if the index was never built.
+func (r *Repository) ReadSearchIndex() (*SearchIndex, error) {
+	raw, err := ioutil.ReadFile(r.searchIndexPath())
+	if err != nil {
+		return nil, err
+	}
+	return parseSearchIndex(raw)
+}
+
+// SearchCommits returns commits that contain all terms of the query, newest
+// first. Commits reachable from the tips that are not in the search index,
+// because they were added since it was built, are searched by reading them.
+// Indexed commits are returned until the index is built again, even if they
+// are no longer reachable.
+func (r *Repository) SearchCommits(tips [][]byte, query string) ([][]byte, error) {
+	idx, err := r.ReadSearchIndex()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	walk, err := r.NewRevWalk(tips)
+	if err != nil {
+		return nil, err
+	}
+	if idx != nil {
+		for _, sha := range idx.Tips {
+			// A tip could have been removed since the index was built.
+			if err := walk.Hide(sha); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+	}
+	want := searchTerms(query)
+	var found [][]byte
+	for {
+		c, err := walk.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		terms := make(map[string]struct{})
+		for _, term := range commitSearchTerms(c.Commit) {
+			terms[term] = struct{}{}
+		}
+		match := len(want) != 0
+		for _, term := range want {
+			if _, ok := terms[term]; !ok {
+				match = false
+				break
+			}
+		}
+		if match {
+			found = append(found, c.Sha)
+		}
+	}
+	if idx != nil {
+		found = append(found, idx.Search(query)...)
+	}
+	return found, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchCommits(t *testing.T) {
+	repo := newTestRepository(t)
+	base := writeTestCommit(t, repo, "Add the parser")
+	fix := writeTestCommit(t, repo, "Fix the parser crash", base)
+	docs := writeTestCommit(t, repo, "Document the crash", fix)
+
+	idx, err := repo.BuildSearchIndex([][]byte{docs})
+	if err != nil {
+		t.Fatalf("build: %s", err)
+	}
+	if err := repo.WriteSearchIndex(idx); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	read, err := repo.ReadSearchIndex()
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if !reflect.DeepEqual(read, idx) {
+		t.Fatal("read index differs from the written one")
+	}
+	// Commits added after the index was built are searched too.
+	later := writeTestCommit(t, repo, "Rewrite the parser", docs)
+
+	cases := map[string]struct {
+		query string
+		want  [][]byte
+	}{
+		"single term":          {query: "parser", want: [][]byte{later, fix, base}},
+		"all terms":            {query: "parser crash", want: [][]byte{fix}},
+		"case and punctuation": {query: "CRASH!", want: [][]byte{docs, fix}},
+		"author":               {query: "test@example.com", want: [][]byte{later, docs, fix, base}},
+		"no match":             {query: "parser typo", want: nil},
+		"empty":                {query: "", want: nil},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got, err := repo.SearchCommits([][]byte{later}, tc.query)
+			if err != nil {
+				t.Fatalf("search: %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %x, got %x", tc.want, got)
+			}
+		})
+	}
+
+	raw := idx.Serialize()
+	raw[10] ^= 0xff
+	if _, err := parseSearchIndex(raw); err == nil {
+		t.Fatal("want checksum error")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ShowBranchOptions configures WriteShowBranch.
+type ShowBranchOptions struct {
+	// Names are displayed for the tips, in the same order.
+	Names []string
+	Tips  [][]byte
+	// Head is the index of the checked out branch, or -1.
+	Head int
+	// More is the number of commits shown past the common ancestor.
+	More int
+	// Sparse shows merge commits reachable from only one of the tips,
+	// which are omitted by default.
+	Sparse bool
+}
+
+// showBranchCommit is the state of a commit during the show-branch walk.
+type showBranchCommit struct {
+	*WalkedCommit
+	// flags has a bit set for every tip the commit is reachable from.
+	flags         uint64
+	uninteresting bool
+	seen          bool
+}
+
+// commitName names a commit relative to a tip, as in "master~2" or "side^2".
+type commitName struct {
+	head       string
+	generation int
+}
+
+func (cn *commitName) String() string {
+	switch cn.generation {
+	case 0:
+		return cn.head
+	case 1:
+		return cn.head + "^"
+	default:
+		return fmt.Sprintf("%s~%d", cn.head, cn.generation)
+	}
+}
+
+// WriteShowBranch writes the table of commits reachable from the tips, in
+// the format of git show-branch. Commits are listed newest first, with a
+// column for every tip marking commits reachable from it, down to the first
+// commit reachable from all the tips.
+func (r *Repository) WriteShowBranch(output io.Writer, opts ShowBranchOptions) error {
+	n := len(opts.Tips)
+	if n == 0 {
+		return errors.New("no revisions to show")
+	}
+	if n > 64 {
+		return fmt.Errorf("cannot handle more than 64 revisions")
+	}
+	all := uint64(1)<<uint(n) - 1
+	if n == 64 {
+		all = ^uint64(0)
+	}
+
+	commits := make(map[string]*showBranchCommit)
+	load := func(sha []byte) (*showBranchCommit, error) {
+		if c, ok := commits[string(sha)]; ok {
+			return c, nil
+		}
+		walked, err := r.readWalkedCommit(sha)
+		if err != nil {
+			return nil, err
+		}
+		c := &showBranchCommit{WalkedCommit: walked}
+		commits[string(sha)] = c
+		return c, nil
+	}
+
+	var queue commitQueue
+	var seen []*showBranchCommit
+	order := 0
+	push := func(c *showBranchCommit) {
+		order++
+		heap.Push(&queue, &queuedCommit{commit: c.WalkedCommit, order: order})
+	}
+	markSeen := func(c *showBranchCommit) bool {
+		if c.seen {
+			return false
+		}
+		c.seen = true
+		seen = append(seen, c)
+		return true
+	}
+	// Tips are queued last to first, which decides the order of commits
+	// with the same date.
+	for i := n - 1; i >= 0; i-- {
+		c, err := load(opts.Tips[i])
+		if err != nil {
+			return err
+		}
+		c.flags |= 1 << uint(i)
+		push(c)
+	}
+
+	// Walk commits until all queued ones are reachable from every tip, and
+	// so are not interesting anymore.
+	extra := opts.More
+	for queue.Len() != 0 {
+		interesting := false
+		for _, q := range queue {
+			if !commits[string(q.commit.Sha)].uninteresting {
+				interesting = true
+				break
+			}
+		}
+		c := commits[string(heap.Pop(&queue).(*queuedCommit).commit.Sha)]
+		if !interesting && extra <= 0 {
+			break
+		}
+		markSeen(c)
+		flags, uninteresting := c.flags, c.uninteresting
+		if flags&all == all {
+			uninteresting = true
+		}
+		for _, sha := range c.Parents {
+			p, err := load(sha)
+			if err != nil {
+				return err
+			}
+			if p.flags&flags == flags && (p.uninteresting || !uninteresting) {
+				continue
+			}
+			if markSeen(p) && !interesting {
+				extra--
+			}
+			p.flags |= flags
+			p.uninteresting = p.uninteresting || uninteresting
+			push(p)
+		}
+	}
+	// Commits reachable from a common ancestor that were seen before it
+	// are not interesting either.
+	for changed := true; changed; {
+		changed = false
+		for _, c := range seen {
+			if c.flags&all != all && !c.uninteresting {
+				continue
+			}
+			for _, sha := range c.Parents {
+				if p, ok := commits[string(sha)]; ok && !p.uninteresting {
+					p.uninteresting = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	seen = sortShowBranchCommits(seen, commits)
+	names := nameShowBranchCommits(seen, commits, opts)
+
+	w := bufio.NewWriter(output)
+	if n > 1 {
+		for i, sha := range opts.Tips {
+			mark := '!'
+			if i == opts.Head {
+				mark = '*'
+			}
+			fmt.Fprintf(w, "%s%c [%s] %s\n", strings.Repeat(" ", i), mark, opts.Names[i], commitSubject(commits[string(sha)].Commit))
+		}
+		fmt.Fprintln(w, strings.Repeat("-", n))
+	}
+	extra = opts.More
+	shownMergePoint := false
+	for _, c := range seen {
+		shownMergePoint = shownMergePoint || c.flags&all == all
+		if n > 1 {
+			isMerge := len(c.Parents) > 1
+			if isMerge && !opts.Sparse && omitInDense(c, opts.Tips, n) {
+				continue
+			}
+			for i := 0; i < n; i++ {
+				switch {
+				case c.flags&(1<<uint(i)) == 0:
+					w.WriteByte(' ')
+				case isMerge:
+					w.WriteByte('-')
+				case i == opts.Head:
+					w.WriteByte('*')
+				default:
+					w.WriteByte('+')
+				}
+			}
+			w.WriteByte(' ')
+		}
+		name := shortHash(c.Sha)
+		if cn, ok := names[string(c.Sha)]; ok {
+			name = cn.String()
+		}
+		fmt.Fprintf(w, "[%s] %s\n", name, commitSubject(c.Commit))
+		if shownMergePoint {
+			if extra--; extra < 0 {
+				break
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// sortShowBranchCommits sorts commits in the topological order. Parents
+// are shown after all of their children, and as close as possible to the
+// last of them, so that branches are not interleaved.
+func sortShowBranchCommits(seen []*showBranchCommit, commits map[string]*showBranchCommit) []*showBranchCommit {
+	children := make(map[string]int, len(seen))
+	for _, c := range seen {
+		for _, sha := range c.Parents {
+			if p, ok := commits[string(sha)]; ok && p.seen {
+				children[string(sha)]++
+			}
+		}
+	}
+	var stack []*showBranchCommit
+	for i := len(seen) - 1; i >= 0; i-- {
+		if children[string(seen[i].Sha)] == 0 {
+			stack = append(stack, seen[i])
+		}
+	}
+	sorted := make([]*showBranchCommit, 0, len(seen))
+	for len(stack) != 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		sorted = append(sorted, c)
+		for _, sha := range c.Parents {
+			p, ok := commits[string(sha)]
+			if !ok || !p.seen {
+				continue
+			}
+			if children[string(sha)]--; children[string(sha)] == 0 {
+				stack = append(stack, p)
+			}
+		}
+	}
+	return sorted
+}
+
+// omitInDense returns true for merge commits that are reachable from only
+// one of the tips and are not a tip themselves.
+func omitInDense(c *showBranchCommit, tips [][]byte, n int) bool {
+	for _, sha := range tips {
+		if string(sha) == string(c.Sha) {
+			return false
+		}
+	}
+	count := 0
+	for i := 0; i < n; i++ {
+		if c.flags&(1<<uint(i)) != 0 {
+			count++
+		}
+	}
+	return count == 1
+}
+
+// nameShowBranchCommits names seen commits relative to the tips. First
+// parent chains are named before the other parents, so that the names are
+// as short as possible.
+func nameShowBranchCommits(seen []*showBranchCommit, commits map[string]*showBranchCommit, opts ShowBranchOptions) map[string]*commitName {
+	names := make(map[string]*commitName)
+	for _, c := range seen {
+		if _, ok := names[string(c.Sha)]; ok {
+			continue
+		}
+		for i, sha := range opts.Tips {
+			if string(sha) == string(c.Sha) {
+				names[string(c.Sha)] = &commitName{head: opts.Names[i]}
+				break
+			}
+		}
+	}
+
+	nameFirstParentChain := func(c *showBranchCommit) int {
+		count := 0
+		for c != nil && len(c.Parents) != 0 {
+			cn, ok := names[string(c.Sha)]
+			if !ok {
+				break
+			}
+			parent := c.Parents[0]
+			if _, ok := names[string(parent)]; ok {
+				break
+			}
+			names[string(parent)] = &commitName{head: cn.head, generation: cn.generation + 1}
+			count++
+			c = commits[string(parent)]
+		}
+		return count
+	}
+	for named := true; named; {
+		named = false
+		for _, c := range seen {
+			if nameFirstParentChain(c) != 0 {
+				named = true
+			}
+		}
+	}
+
+	for named := true; named; {
+		named = false
+		for _, c := range seen {
+			cn, ok := names[string(c.Sha)]
+			if !ok {
+				continue
+			}
+			for nth, parent := range c.Parents {
+				if _, ok := names[string(parent)]; ok {
+					continue
+				}
+				head := cn.String()
+				if nth == 0 {
+					head += "^"
+				} else {
+					head += fmt.Sprintf("^%d", nth+1)
+				}
+				names[string(parent)] = &commitName{head: head}
+				named = true
+				nameFirstParentChain(commits[string(parent)])
+			}
+		}
+	}
+	return names
+}
+
+// commitSubject returns the first paragraph of the commit message, joined
+// into a single line.
+func commitSubject(c *CommitObject) string {
+	paragraph := strings.TrimLeft(c.Comment, "\n")
+	if i := strings.Index(paragraph, "\n\n"); i >= 0 {
+		paragraph = paragraph[:i]
+	}
+	lines := strings.Split(strings.TrimRight(paragraph, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, " ")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteShowBranch(t *testing.T) {
+	repo := newTestRepository(t)
+	base := writeTestCommit(t, repo, "base")
+	side := writeTestCommit(t, repo, "side", base)
+	trunk := writeTestCommit(t, repo, "trunk", base)
+	more := writeTestCommit(t, repo, "more", trunk)
+	merge := writeTestCommit(t, repo, "merge", more, side)
+	top := writeTestCommit(t, repo, "top", merge)
+
+	cases := map[string]struct {
+		opts ShowBranchOptions
+		want string
+	}{
+		"merged branch": {
+			opts: ShowBranchOptions{
+				Names: []string{"master", "side"},
+				Tips:  [][]byte{top, side},
+				Head:  0,
+			},
+			want: "" +
+				"* [master] top\n" +
+				" ! [side] side\n" +
+				"--\n" +
+				"*  [master] top\n" +
+				"*+ [side] side\n",
+		},
+		"sparse": {
+			opts: ShowBranchOptions{
+				Names:  []string{"master", "side"},
+				Tips:   [][]byte{top, side},
+				Head:   0,
+				Sparse: true,
+			},
+			want: "" +
+				"* [master] top\n" +
+				" ! [side] side\n" +
+				"--\n" +
+				"*  [master] top\n" +
+				"-  [master^] merge\n" +
+				"*+ [side] side\n",
+		},
+		"more": {
+			opts: ShowBranchOptions{
+				Names: []string{"side", "master"},
+				Tips:  [][]byte{side, top},
+				Head:  1,
+				More:  1,
+			},
+			want: "" +
+				"! [side] side\n" +
+				" * [master] top\n" +
+				"--\n" +
+				" * [master] top\n" +
+				"+* [side] side\n" +
+				" * [master~2] more\n",
+		},
+		"diverged": {
+			opts: ShowBranchOptions{
+				Names: []string{"master~2", "side"},
+				Tips:  [][]byte{more, side},
+				Head:  -1,
+			},
+			want: "" +
+				"! [master~2] more\n" +
+				" ! [side] side\n" +
+				"--\n" +
+				" + [side] side\n" +
+				"+  [master~2] more\n" +
+				"+  [master~2^] trunk\n" +
+				"++ [side^] base\n",
+		},
+		"single": {
+			opts: ShowBranchOptions{
+				Names: []string{"side"},
+				Tips:  [][]byte{side},
+				Head:  -1,
+			},
+			want: "[side] side\n",
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := repo.WriteShowBranch(&b, tc.opts); err != nil {
+				t.Fatalf("show branch: %s", err)
+			}
+			if got := b.String(); got != tc.want {
+				t.Fatalf("want\n%s\ngot\n%s", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Signature verification status codes, same as git's %G? format.
+const (
+	SignatureGood         = "G"
+	SignatureBad          = "B"
+	SignatureUntrusted    = "U"
+	SignatureExpired      = "X"
+	SignatureExpiredKey   = "Y"
+	SignatureRevokedKey   = "R"
+	SignatureCannotVerify = "E"
+	SignatureNone         = "N"
+)
+
+// SignatureVerification is the result of verifying a signed object.
+type SignatureVerification struct {
+	Status string
+	Signer string
+	Key    string
+	// Output is the human readable output of the verification program,
+	// and Raw is its machine readable status output.
+	Output string
+	Raw    string
+}
+
+// Valid returns true if the signature is good. Untrusted signatures are
+// considered valid, same as git does with the default minimum trust level.
+func (v *SignatureVerification) Valid() bool {
+	return v.Status == SignatureGood || v.Status == SignatureUntrusted
+}
+
+// signedPayload splits a commit into the signature and the content that
+// was signed. Nil signature is returned for unsigned commits.
+func signedPayload(c *CommitObject) (payload []byte, signature []byte, err error) {
+	sigs := c.Header["gpgsig"]
+	if len(sigs) == 0 {
+		return nil, nil, nil
+	}
+	header := make(map[string][]string, len(c.Header))
+	for k, v := range c.Header {
+		if k != "gpgsig" && k != "gpgsig-sha256" {
+			header[k] = v
+		}
+	}
+	payload, err = (&CommitObject{Header: header, Comment: c.Comment}).Serialize()
+	if err != nil {
+		return nil, nil, fmt.Errorf("serialize payload: %w", err)
+	}
+	return payload, []byte(sigs[0] + "\n"), nil
+}
+
+// VerifyCommit checks the signature of a commit using the program
+// configured with gpg.program. Unsigned commit has the SignatureNone status.
+func (r *Repository) VerifyCommit(c *CommitObject) (*SignatureVerification, error) {
+	payload, signature, err := signedPayload(c)
+	if err != nil {
+		return nil, err
+	}
+	if signature == nil {
+		return &SignatureVerification{Status: SignatureNone}, nil
+	}
+	return r.verifySignature(payload, signature)
+}
+
+// tagSignatureMarkers start the signature appended to a tag message.
+var tagSignatureMarkers = []string{
+	"-----BEGIN PGP SIGNATURE-----",
+	"-----BEGIN PGP MESSAGE-----",
+}
+
+// tagSignedPayload splits a raw tag object into the content that was signed
+// and the signature that follows it. Nil signature is returned for unsigned
+// tags.
+func tagSignedPayload(raw []byte) (payload []byte, signature []byte) {
+	for start := 0; start < len(raw); {
+		end := bytes.IndexByte(raw[start:], '\n')
+		if end < 0 {
+			end = len(raw)
+		} else {
+			end += start + 1
+		}
+		line := string(raw[start:end])
+		for _, marker := range tagSignatureMarkers {
+			if strings.HasPrefix(line, marker) {
+				return raw[:start], raw[start:]
+			}
+		}
+		start = end
+	}
+	return raw, nil
+}
+
+// VerifyTag checks the signature of the tag object with given hash. Unsigned
+// tag has the SignatureNone status.
+func (r *Repository) VerifyTag(sha []byte) (*SignatureVerification, error) {
+	kind, raw, err := r.ReadRawObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	if kind != "tag" {
+		return nil, fmt.Errorf("%x is not a tag object: %s", sha, kind)
+	}
+	payload, signature := tagSignedPayload(raw)
+	if signature == nil {
+		return &SignatureVerification{Status: SignatureNone}, nil
+	}
+	return r.verifySignature(payload, signature)
+}
+
+// CommitVerification is the signature verification of a commit of a range.
+type CommitVerification struct {
+	Sha []byte
+	*SignatureVerification
+}
+
+// VerifyCommits checks signatures of all commits of the range, newest first.
+// Verification does not stop at the first commit without a valid signature,
+// so that all of them can be reported.
+func (r *Repository) VerifyCommits(rng *RevisionRange) ([]*CommitVerification, error) {
+	walk, err := r.NewRevWalk(rng.Include)
+	if err != nil {
+		return nil, err
+	}
+	for _, sha := range rng.Exclude {
+		if err := walk.Hide(sha); err != nil {
+			return nil, err
+		}
+	}
+	var verified []*CommitVerification
+	for {
+		c, err := walk.Next()
+		if errors.Is(err, io.EOF) {
+			return verified, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		v, err := r.VerifyCommit(c.Commit)
+		if err != nil {
+			return nil, fmt.Errorf("verify %x signature: %w", c.Sha, err)
+		}
+		verified = append(verified, &CommitVerification{Sha: c.Sha, SignatureVerification: v})
+	}
+}
+
+func (r *Repository) verifySignature(payload, signature []byte) (*SignatureVerification, error) {
+	program, ok := r.config.Get("gpg", "", "program")
+	if !ok {
+		program = "gpg"
+	}
+
+	sigfile, err := ioutil.TempFile("", "gogit-signature-")
+	if err != nil {
+		return nil, fmt.Errorf("create signature file: %w", err)
+	}
+	defer os.Remove(sigfile.Name())
+	if _, err := sigfile.Write(signature); err != nil {
+		sigfile.Close()
+		return nil, fmt.Errorf("write signature file: %w", err)
+	}
+	if err := sigfile.Close(); err != nil {
+		return nil, fmt.Errorf("close signature file: %w", err)
+	}
+
+	var status, output bytes.Buffer
+	cmd := exec.Command(program, "--keyid-format=long", "--status-fd=1", "--verify", sigfile.Name(), "-")
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &status
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		// Non zero exit code is expected for bad signatures, which is
+		// reported through the status output.
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("run %s: %w", program, err)
+		}
+	}
+	v := parseGPGStatus(status.Bytes())
+	v.Output = output.String()
+	v.Raw = status.String()
+	return v, nil
+}
+
+// parseGPGStatus interprets the machine readable output of gpg --status-fd.
+func parseGPGStatus(raw []byte) *SignatureVerification {
+	v := SignatureVerification{Status: SignatureCannotVerify}
+	trusted := false
+	sc := bufio.NewScanner(bytes.NewReader(raw))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		args := fields[2:]
+		switch fields[1] {
+		case "GOODSIG":
+			v.Status = SignatureGood
+		case "BADSIG":
+			v.Status = SignatureBad
+		case "EXPSIG":
+			v.Status = SignatureExpired
+		case "EXPKEYSIG":
+			v.Status = SignatureExpiredKey
+		case "REVKEYSIG":
+			v.Status = SignatureRevokedKey
+		case "ERRSIG":
+			v.Status = SignatureCannotVerify
+			if len(args) != 0 {
+				v.Key = args[0]
+			}
+			continue
+		case "VALIDSIG":
+			if len(args) != 0 {
+				v.Key = args[0]
+			}
+			continue
+		case "TRUST_FULLY", "TRUST_ULTIMATE":
+			trusted = true
+			continue
+		default:
+			continue
+		}
+		// Status lines with key id and the user id.
+		if len(args) != 0 && v.Key == "" {
+			v.Key = args[0]
+		}
+		if len(args) > 1 {
+			v.Signer = strings.Join(args[1:], " ")
+		}
+	}
+	if v.Status == SignatureGood && !trusted {
+		v.Status = SignatureUntrusted
+	}
+	return &v
+}
+
+// signPayload returns a detached signature of the payload, made by the
+// program configured with gpg.program. The key of user.signingKey is used,
+// or the key of the committer identity if it is not set.
+func (r *Repository) signPayload(payload []byte) ([]byte, error) {
+	program, ok := r.config.Get("gpg", "", "program")
+	if !ok {
+		program = "gpg"
+	}
+	key, _ := r.config.Get("user", "", "signingKey")
+	if key == "" {
+		id, err := r.committerIdent()
+		if err != nil {
+			return nil, err
+		}
+		key = fmt.Sprintf("%s <%s>", id.Name, id.Email)
+	}
+
+	var signature, status bytes.Buffer
+	cmd := exec.Command(program, "--status-fd=2", "-bsau", key)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &signature
+	cmd.Stderr = &status
+	err := cmd.Run()
+	if err != nil || !bytes.Contains(status.Bytes(), []byte("[GNUPG:] SIG_CREATED ")) {
+		return nil, fmt.Errorf("%s failed to sign the data: %s", program, strings.TrimSpace(status.String()))
+	}
+	return signature.Bytes(), nil
+}
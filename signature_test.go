@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagSignedPayload(t *testing.T) {
+	cases := map[string]struct {
+		raw       string
+		payload   string
+		signature string
+	}{
+		"unsigned": {
+			raw:     "object 1\ntype commit\ntag v1\n\nmessage\n",
+			payload: "object 1\ntype commit\ntag v1\n\nmessage\n",
+		},
+		"signed": {
+			raw:       "object 1\ntype commit\ntag v1\n\nmessage\n-----BEGIN PGP SIGNATURE-----\n\nabc\n-----END PGP SIGNATURE-----\n",
+			payload:   "object 1\ntype commit\ntag v1\n\nmessage\n",
+			signature: "-----BEGIN PGP SIGNATURE-----\n\nabc\n-----END PGP SIGNATURE-----\n",
+		},
+		"marker inside a line": {
+			raw:     "object 1\n\nsee -----BEGIN PGP SIGNATURE-----\n",
+			payload: "object 1\n\nsee -----BEGIN PGP SIGNATURE-----\n",
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			payload, signature := tagSignedPayload([]byte(tc.raw))
+			if string(payload) != tc.payload {
+				t.Errorf("want payload %q, got %q", tc.payload, payload)
+			}
+			if string(signature) != tc.signature {
+				t.Errorf("want signature %q, got %q", tc.signature, signature)
+			}
+		})
+	}
+}
+
+func TestVerifyCommits(t *testing.T) {
+	repo := newTestRepository(t)
+	var err error
+	dir := repo.workdir
+
+	// The fake gpg accepts signatures that contain "good".
+	program := filepath.Join(dir, "gpg")
+	script := "#!/bin/sh\n" +
+		"if grep -q good \"$4\"; then\n" +
+		"  echo '[GNUPG:] GOODSIG 1234 Test <test@example.com>'\n" +
+		"  echo '[GNUPG:] TRUST_ULTIMATE'\n" +
+		"else\n" +
+		"  echo '[GNUPG:] BADSIG 1234 Test <test@example.com>'\n" +
+		"  exit 1\n" +
+		"fi\n"
+	if err := ioutil.WriteFile(program, []byte(script), 0755); err != nil {
+		t.Fatalf("write gpg: %s", err)
+	}
+	if repo.config, err = ParseConfig(strings.NewReader("[gpg]\nprogram = " + program + "\n")); err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+
+	tree, err := NewTreeBuilder(repo, nil).Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	var commits [][]byte
+	for i, sig := range []string{"", "good", "forged", "good"} {
+		header := map[string][]string{
+			"tree":      {fmt.Sprintf("%x", tree)},
+			"author":    {fmt.Sprintf("Test <test@example.com> %d +0000", 1600000000+i)},
+			"committer": {fmt.Sprintf("Test <test@example.com> %d +0000", 1600000000+i)},
+		}
+		if len(commits) != 0 {
+			header["parent"] = []string{fmt.Sprintf("%x", commits[len(commits)-1])}
+		}
+		if sig != "" {
+			header["gpgsig"] = []string{"-----BEGIN PGP SIGNATURE-----\n" + sig + "\n-----END PGP SIGNATURE-----"}
+		}
+		raw, err := (&CommitObject{Header: header, Comment: "commit\n"}).Serialize()
+		if err != nil {
+			t.Fatalf("serialize commit: %s", err)
+		}
+		sha, err := repo.WriteObject("commit", raw)
+		if err != nil {
+			t.Fatalf("write commit: %s", err)
+		}
+		commits = append(commits, sha)
+	}
+
+	verified, err := repo.VerifyCommits(&RevisionRange{Include: commits[3:], Exclude: commits[:1]})
+	if err != nil {
+		t.Fatalf("verify commits: %s", err)
+	}
+	var got []string
+	for _, v := range verified {
+		got = append(got, fmt.Sprintf("%x %s %s %s", v.Sha, v.Status, v.Key, v.Signer))
+	}
+	want := []string{
+		fmt.Sprintf("%x G 1234 Test <test@example.com>", commits[3]),
+		fmt.Sprintf("%x B 1234 Test <test@example.com>", commits[2]),
+		fmt.Sprintf("%x G 1234 Test <test@example.com>", commits[1]),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	if !strings.Contains(verified[0].Raw, "[GNUPG:] GOODSIG") {
+		t.Errorf("missing raw status output: %q", verified[0].Raw)
+	}
+}
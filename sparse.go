@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A sparse index replaces all entries of a directory that is outside of
+// the sparse-checkout cone with a single sparse directory entry: a skip
+// worktree entry with the tree mode, the hash of the tree and the path of
+// the directory with a trailing slash. Such an index has the required
+// "sdir" extension, so that older versions of git refuse to read it.
+//
+// It is written only in cone mode, when core.sparseCheckout,
+// core.sparseCheckoutCone and index.sparse are all set.
+const indexExtSparseDirs = "sdir"
+
+// sparseCone is a sparse-checkout definition in cone mode. Files directly
+// in the root directory are always included.
+type sparseCone struct {
+	// recursive directories are included with all their content, and
+	// parents only with the files directly in them. All leading
+	// directories of the recursive ones are parents.
+	recursive map[string]struct{}
+	parents   map[string]struct{}
+}
+
+// loadSparseCone returns the cone mode definition from the
+// info/sparse-checkout file, or nil if cone mode is not enabled. A file
+// with patterns that cannot be used in cone mode disables it, same as in
+// git.
+func (r *Repository) loadSparseCone() (*sparseCone, error) {
+	for _, name := range []string{"sparseCheckout", "sparseCheckoutCone"} {
+		if ok, err := r.config.Bool("core", "", name, false); err != nil || !ok {
+			return nil, err
+		}
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(r.gitdir, "info", "sparse-checkout"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read sparse-checkout: %w", err)
+	}
+	cone, ok := parseSparseCone(raw)
+	if !ok {
+		return nil, nil
+	}
+	return cone, nil
+}
+
+// parseSparseCone parses cone mode patterns, which are pairs of "/dir/" and
+// "!/dir/*/" for parent directories, and "/dir/" alone for recursive ones.
+// The patterns must start with "/*" and "!/*/".
+func parseSparseCone(raw []byte) (*sparseCone, bool) {
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(raw))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < 2 || lines[0] != "/*" || lines[1] != "!/*/" {
+		return nil, false
+	}
+	c := &sparseCone{recursive: make(map[string]struct{}), parents: make(map[string]struct{})}
+	var last string
+	for _, line := range lines[2:] {
+		switch {
+		case strings.HasPrefix(line, "!/") && strings.HasSuffix(line, "/*/"):
+			dir := line[2 : len(line)-3]
+			if dir != last {
+				return nil, false
+			}
+			delete(c.recursive, dir)
+			c.parents[dir] = struct{}{}
+		case strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") && len(line) > 2 && !strings.ContainsAny(line, "*?[\\"):
+			last = line[1 : len(line)-1]
+			c.recursive[last] = struct{}{}
+		default:
+			return nil, false
+		}
+	}
+	for dir := range c.recursive {
+		for dir = path.Dir(dir); dir != "."; dir = path.Dir(dir) {
+			c.parents[dir] = struct{}{}
+		}
+	}
+	return c, true
+}
+
+// includesDir returns true if any file in the directory can be included.
+func (c *sparseCone) includesDir(dir string) bool {
+	if _, ok := c.parents[dir]; ok {
+		return true
+	}
+	return c.recursiveDir(dir)
+}
+
+// recursiveDir returns true if the directory or any of its leading
+// directories is included recursively.
+func (c *sparseCone) recursiveDir(dir string) bool {
+	for ; dir != "."; dir = path.Dir(dir) {
+		if _, ok := c.recursive[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// outsideDir returns the top most directory out of the directory and its
+// leading directories that is outside of the cone, or an empty string if
+// there is none.
+func (c *sparseCone) outsideDir(dir string) string {
+	if dir == "." || c.includesDir(dir) {
+		return ""
+	}
+	chunks := strings.Split(dir, "/")
+	for i := 1; i < len(chunks); i++ {
+		if top := strings.Join(chunks[:i], "/"); !c.includesDir(top) {
+			return top
+		}
+	}
+	return dir
+}
+
+// isSparseDir returns true if the entry is a sparse directory entry.
+func (e *IndexEntry) isSparseDir() bool {
+	return e.Mode == modeTree
+}
+
+// useSparseIndex returns the cone the index should be collapsed to when it
+// is written, or nil if the index should be full.
+func (r *Repository) useSparseIndex() (*sparseCone, error) {
+	if ok, err := r.config.Bool("index", "", "sparse", false); err != nil || !ok {
+		return nil, err
+	}
+	return r.loadSparseCone()
+}
+
+// collapseIndex returns entries of the index with directories outside of the
+// cone replaced by sparse directory entries. A directory is collapsed only if
+// all of its entries are merged skip worktree entries, so that nothing that
+// needs to be looked at is hidden. Sparse directory entries that are in the
+// cone are expanded.
+func (r *Repository) collapseIndex(entries []*IndexEntry, cone *sparseCone) ([]*IndexEntry, error) {
+	var collapsed []*IndexEntry
+	for i := 0; i < len(entries); {
+		e := entries[i]
+		var dir string
+		if e.isSparseDir() {
+			if dir = cone.outsideDir(strings.TrimSuffix(e.Path, "/")); dir == "" {
+				files, err := r.sparseDirFiles(e)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(append(append([]*IndexEntry(nil), entries[:i]...), files...), entries[i+1:]...)
+				continue
+			}
+		} else {
+			dir = cone.outsideDir(path.Dir(e.Path))
+		}
+		if dir == "" {
+			collapsed = append(collapsed, e)
+			i++
+			continue
+		}
+		prefix := dir + "/"
+		end := i
+		clean := true
+		for end < len(entries) && strings.HasPrefix(entries[end].Path, prefix) {
+			x := entries[end]
+			if x.Stage != 0 || !x.SkipWorktree || x.IntentToAdd {
+				clean = false
+			}
+			end++
+		}
+		if !clean || (end == i+1 && e.Path == prefix) {
+			// Already collapsed, or cannot be.
+			collapsed = append(collapsed, entries[i:end]...)
+			i = end
+			continue
+		}
+		tb := NewTreeBuilder(r, nil)
+		for _, x := range entries[i:end] {
+			name := strings.TrimSuffix(x.Path[len(prefix):], "/")
+			if err := tb.Insert(name, x.Mode, x.Sha); err != nil {
+				return nil, fmt.Errorf("collapse %s: %w", dir, err)
+			}
+		}
+		tree, err := tb.Write()
+		if err != nil {
+			return nil, fmt.Errorf("collapse %s: %w", dir, err)
+		}
+		collapsed = append(collapsed, &IndexEntry{Mode: modeTree, Sha: tree, SkipWorktree: true, Path: prefix})
+		i = end
+	}
+	return collapsed, nil
+}
+
+// expandIndex replaces sparse directory entries with skip worktree entries
+// of all files of their trees.
+func (r *Repository) expandIndex(idx *Index) error {
+	sparse := false
+	for _, e := range idx.Entries {
+		if sparse = e.isSparseDir(); sparse {
+			break
+		}
+	}
+	if !sparse {
+		return nil
+	}
+	entries := make([]*IndexEntry, 0, len(idx.Entries))
+	for _, e := range idx.Entries {
+		if !e.isSparseDir() {
+			entries = append(entries, e)
+			continue
+		}
+		files, err := r.sparseDirFiles(e)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, files...)
+	}
+	idx.Entries = entries
+	return nil
+}
+
+// sparseDirFiles returns sorted skip worktree entries of all files in the
+// tree of a sparse directory entry.
+func (r *Repository) sparseDirFiles(e *IndexEntry) ([]*IndexEntry, error) {
+	tr, err := r.readTree(e.Sha)
+	if err != nil {
+		return nil, fmt.Errorf("expand %s: %w", e.Path, err)
+	}
+	leafs := make(map[string]*TreeLeaf)
+	if err := r.flattenTree(tr, e.Path, leafs); err != nil {
+		return nil, fmt.Errorf("expand %s: %w", e.Path, err)
+	}
+	names := make([]string, 0, len(leafs))
+	for name := range leafs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*IndexEntry, len(names))
+	for i, name := range names {
+		leaf := leafs[name]
+		files[i] = &IndexEntry{Mode: leaf.Mode, Sha: leaf.Sha, SkipWorktree: true, Path: name}
+	}
+	return files, nil
+}
+
+// ReadSparseIndex reads the index without expanding sparse directory
+// entries, for commands that only look at the entries in the cone.
+func (r *Repository) ReadSparseIndex() (*Index, error) {
+	return r.readIndex(false)
+}
+
+// sparseDirOf returns the sparse directory entry the path is in, or nil.
+func (idx *Index) sparseDirOf(name string) *IndexEntry {
+	// A sparse directory entry sorts right before the paths in it.
+	i := sort.Search(len(idx.Entries), func(i int) bool {
+		return idx.Entries[i].Path > name
+	})
+	if i == 0 {
+		return nil
+	}
+	e := idx.Entries[i-1]
+	if e.isSparseDir() && strings.HasPrefix(name, e.Path) {
+		return e
+	}
+	return nil
+}
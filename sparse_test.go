@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSparseCone(t *testing.T) {
+	cases := map[string]struct {
+		patterns string
+		ok       bool
+		// in and out are files that must be included and excluded.
+		in, out []string
+	}{
+		"root only": {
+			patterns: "/*\n!/*/\n",
+			ok:       true,
+			in:       []string{"a"},
+			out:      []string{"dir/a"},
+		},
+		"recursive": {
+			patterns: "/*\n!/*/\n/dir/\n",
+			ok:       true,
+			in:       []string{"a", "dir/a", "dir/sub/a"},
+			out:      []string{"other/a", "dirx/a"},
+		},
+		"nested": {
+			patterns: "# comment\n/*\n!/*/\n/dir/\n!/dir/*/\n/dir/sub/\n",
+			ok:       true,
+			in:       []string{"dir/a", "dir/sub/a", "dir/sub/deep/a"},
+			out:      []string{"dir/other/a"},
+		},
+		"not cone patterns": {
+			patterns: "/*\n!/*/\n*.txt\n",
+			ok:       false,
+		},
+		"missing root patterns": {
+			patterns: "/dir/\n",
+			ok:       false,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			c, ok := parseSparseCone([]byte(tc.patterns))
+			if ok != tc.ok {
+				t.Fatalf("want ok %v, got %v", tc.ok, ok)
+			}
+			for _, name := range tc.in {
+				if dir := c.outsideDir(path.Dir(name)); dir != "" {
+					t.Errorf("%s: want in the cone, got outside %s", name, dir)
+				}
+			}
+			for _, name := range tc.out {
+				if dir := c.outsideDir(path.Dir(name)); dir == "" {
+					t.Errorf("%s: want outside of the cone", name)
+				}
+			}
+		})
+	}
+}
+
+func TestSparseIndex(t *testing.T) {
+	repo := newTestRepository(t)
+	var err error
+	if err := os.MkdirAll(filepath.Join(repo.gitdir, "info"), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repo.gitdir, "info", "sparse-checkout"), []byte("/*\n!/*/\n/in/\n"), 0644); err != nil {
+		t.Fatalf("write sparse-checkout: %s", err)
+	}
+	config := "[core]\nsparseCheckout = true\nsparseCheckoutCone = true\n[index]\nsparse = true\n"
+	if repo.config, err = ParseConfig(strings.NewReader(config)); err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+
+	var entries []*IndexEntry
+	for _, name := range []string{"a", "in/b", "out/c", "out/sub/d", "tracked/e", "tracked/f"} {
+		sha, err := repo.WriteObject("blob", []byte(name))
+		if err != nil {
+			t.Fatalf("write blob: %s", err)
+		}
+		skip := strings.HasPrefix(name, "out/") || name == "tracked/e"
+		entries = append(entries, &IndexEntry{Mode: modeBlob, Sha: sha, SkipWorktree: skip, Path: name})
+	}
+	tb := NewTreeBuilder(repo, nil)
+	for _, e := range entries[2:4] {
+		if err := tb.Insert(strings.TrimPrefix(e.Path, "out/"), e.Mode, e.Sha); err != nil {
+			t.Fatalf("insert: %s", err)
+		}
+	}
+	outTree, err := tb.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+
+	if err := repo.WriteIndex(&Index{Entries: entries}); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+	sparse, err := repo.ReadSparseIndex()
+	if err != nil {
+		t.Fatalf("read sparse index: %s", err)
+	}
+	var paths []string
+	for _, e := range sparse.Entries {
+		paths = append(paths, e.Path)
+	}
+	// A directory with a file that is not skipped is not collapsed.
+	if want := []string{"a", "in/b", "out/", "tracked/e", "tracked/f"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("want sparse entries %q, got %q", want, paths)
+	}
+	if e := sparse.Entries[2]; !e.isSparseDir() || !e.SkipWorktree || !bytes.Equal(e.Sha, outTree) {
+		t.Fatalf("unexpected sparse directory entry %+v", e)
+	}
+	if e := sparse.sparseDirOf("out/sub/d"); e != sparse.Entries[2] {
+		t.Fatalf("want out/sub/d in a sparse directory, got %+v", e)
+	}
+	if e := sparse.sparseDirOf("tracked/e"); e != nil {
+		t.Fatalf("want tracked/e outside of sparse directories, got %+v", e)
+	}
+
+	full, err := repo.ReadIndex()
+	if err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	if len(full.Entries) != len(entries) {
+		t.Fatalf("want %d entries, got %d", len(entries), len(full.Entries))
+	}
+	for i, e := range full.Entries {
+		if e.Path != entries[i].Path || !bytes.Equal(e.Sha, entries[i].Sha) || e.SkipWorktree != entries[i].SkipWorktree {
+			t.Fatalf("entry %d: want %+v, got %+v", i, entries[i], e)
+		}
+	}
+
+	// Without index.sparse, the sparse index is expanded when written.
+	if repo.config, err = ParseConfig(strings.NewReader("")); err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+	if err := repo.WriteIndex(sparse); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+	if idx, err := repo.ReadSparseIndex(); err != nil {
+		t.Fatalf("read sparse index: %s", err)
+	} else if len(idx.Entries) != len(entries) {
+		t.Fatalf("want %d entries, got %d", len(entries), len(idx.Entries))
+	}
+}
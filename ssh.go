@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// sshAddress is the remote end of an ssh URL.
+type sshAddress struct {
+	User string
+	Host string
+	Port string
+	Path string
+}
+
+// parseSSHURL parses ssh://[user@]host[:port]/path and the scp-like
+// [user@]host:path form.
+func parseSSHURL(rawurl string) (*sshAddress, error) {
+	if !strings.Contains(rawurl, "://") {
+		i := strings.IndexByte(rawurl, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid ssh address %q", rawurl)
+		}
+		a := &sshAddress{Host: rawurl[:i], Path: rawurl[i+1:]}
+		if j := strings.LastIndexByte(a.Host, '@'); j >= 0 {
+			a.User, a.Host = a.Host[:j], a.Host[j+1:]
+		}
+		a.Host = strings.Trim(a.Host, "[]")
+		if a.Host == "" || a.Path == "" {
+			return nil, fmt.Errorf("invalid ssh address %q", rawurl)
+		}
+		return a, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parse url: %w", err)
+	}
+	if u.Hostname() == "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid ssh url %q", rawurl)
+	}
+	a := &sshAddress{Host: u.Hostname(), Port: u.Port(), Path: u.Path}
+	if u.User != nil {
+		a.User = u.User.Username()
+	}
+	// ssh://host/~user/repo is relative to the home directory, same as
+	// host:~user/repo.
+	if strings.HasPrefix(a.Path, "/~") {
+		a.Path = a.Path[1:]
+	}
+	return a, nil
+}
+
+// isSCPLikeURL returns true for the [user@]host:path form, which has a colon
+// before the first slash and is neither a URL nor of the
+// <transport>::<address> form. A local path of that form has to be written
+// as ./host:path instead.
+func isSCPLikeURL(url string) bool {
+	colon := strings.IndexByte(url, ':')
+	if colon <= 0 || strings.Contains(url, "://") {
+		return false
+	}
+	if _, _, ok := helperURL(url); ok {
+		return false
+	}
+	slash := strings.IndexByte(url, '/')
+	return slash < 0 || colon < slash
+}
+
+// sshCommand returns the shell command that runs ssh. GIT_SSH_COMMAND takes
+// precedence over core.sshCommand. GIT_SSH is the path of the program, not a
+// shell command, and is used only when neither is set.
+func (r *Repository) sshCommand() string {
+	if cmd := os.Getenv("GIT_SSH_COMMAND"); cmd != "" {
+		return cmd
+	}
+	if cmd, ok := r.config.Get("core", "", "sshCommand"); ok && cmd != "" {
+		return cmd
+	}
+	if prog := os.Getenv("GIT_SSH"); prog != "" {
+		return shellQuote(prog)
+	}
+	return "ssh"
+}
+
+// sshArgs returns the arguments passed to the ssh command to run the remote
+// command. The identity file, port and user of the remote configured with
+// given URL override those of the URL, so that remotes on the same host can
+// use different keys:
+//
+//	[remote "work"]
+//		url = git@example.com:team/repo.git
+//		sshIdentity = ~/.ssh/id_work
+//		sshPort = 2222
+//		sshUser = deploy
+func (r *Repository) sshArgs(rawurl string, a *sshAddress, command string) ([]string, error) {
+	user, port := a.User, a.Port
+	var identity string
+	if name, ok := r.remoteForURL(rawurl); ok {
+		if v, ok := r.config.Get("remote", name, "sshUser"); ok {
+			user = v
+		}
+		if v, ok := r.config.Get("remote", name, "sshPort"); ok {
+			if _, err := strconv.ParseUint(v, 10, 16); err != nil {
+				return nil, fmt.Errorf("remote %q: invalid sshPort %q", name, v)
+			}
+			port = v
+		}
+		path, ok, err := r.config.Path("remote", name, "sshIdentity")
+		if err != nil {
+			return nil, fmt.Errorf("remote %q: %w", name, err)
+		}
+		if ok {
+			identity = path
+		}
+	}
+	var args []string
+	if identity != "" {
+		// Only the configured key is offered, not the keys of the agent,
+		// which the server could accept for another account.
+		args = append(args, "-i", identity, "-o", "IdentitiesOnly=yes")
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if err := checkSSHArg("host", a.Host); err != nil {
+		return nil, err
+	}
+	host := a.Host
+	if user != "" {
+		if err := checkSSHArg("user", user); err != nil {
+			return nil, err
+		}
+		host = user + "@" + host
+	}
+	// The destination ends the options, so that ssh cannot take it for one
+	// even if the checks above miss a case.
+	return append(args, "--", host, command), nil
+}
+
+// checkSSHArg rejects a user or host that ssh would take for an option, as
+// "-oProxyCommand=..." which runs a command, or that has control
+// characters, which could end the line of a configuration.
+func checkSSHArg(what, v string) error {
+	if strings.HasPrefix(v, "-") {
+		return fmt.Errorf("invalid ssh %s %q: cannot start with a dash", what, v)
+	}
+	for _, c := range v {
+		if c < ' ' || c == 0x7f {
+			return fmt.Errorf("invalid ssh %s %q: cannot contain control characters", what, v)
+		}
+	}
+	return nil
+}
+
+// remoteForURL returns the name of the remote configured with the URL.
+func (r *Repository) remoteForURL(rawurl string) (string, bool) {
+	for _, name := range r.config.Subsections("remote") {
+		if url, ok := r.config.Get("remote", name, "url"); ok && url == rawurl {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// shellQuote quotes s for the shell, in single quotes.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// openSSHTransport runs git-upload-pack on the remote host over ssh and
+// speaks the same protocol with it as with git daemon.
+func openSSHTransport(local *Repository, rawurl string) (*streamTransport, error) {
+	a, err := parseSSHURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	args, err := local.sshArgs(rawurl, a, "git-upload-pack "+shellQuote(a.Path))
+	if err != nil {
+		return nil, err
+	}
+	version, err := local.wireProtocolVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version == 2 {
+		// The version is requested with the environment of the
+		// remote command, which sshd accepts only if it is sent.
+		args = append([]string{"-o", "SendEnv=GIT_PROTOCOL"}, args...)
+	}
+	ssh := local.sshCommand()
+	cmd := exec.Command("sh", append([]string{"-c", ssh + ` "$@"`, ssh}, args...)...)
+	if version == 2 {
+		cmd.Env = append(os.Environ(), "GIT_PROTOCOL=version=2")
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("run ssh: %w", err)
+	}
+	return newStreamTransport(local, "ssh", stdin, stdout, func() error {
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("ssh: %w", err)
+		}
+		return nil
+	})
+}
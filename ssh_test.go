@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSSHURL(t *testing.T) {
+	cases := map[string]struct {
+		url     string
+		want    sshAddress
+		wantErr bool
+	}{
+		"scp-like": {
+			url:  "git@example.com:team/repo.git",
+			want: sshAddress{User: "git", Host: "example.com", Path: "team/repo.git"},
+		},
+		"scp-like without user": {
+			url:  "example.com:/srv/repo.git",
+			want: sshAddress{Host: "example.com", Path: "/srv/repo.git"},
+		},
+		"url with port": {
+			url:  "ssh://git@example.com:2222/srv/repo.git",
+			want: sshAddress{User: "git", Host: "example.com", Port: "2222", Path: "/srv/repo.git"},
+		},
+		"url relative to home": {
+			url:  "ssh://example.com/~alice/repo.git",
+			want: sshAddress{Host: "example.com", Path: "~alice/repo.git"},
+		},
+		"missing path": {
+			url:     "ssh://example.com",
+			wantErr: true,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			a, err := parseSSHURL(tc.url)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %+v", a)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			if *a != tc.want {
+				t.Fatalf("want %+v, got %+v", tc.want, *a)
+			}
+		})
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	const config = `
+[core]
+	sshCommand = ssh -F /dev/null
+[remote "work"]
+	url = git@example.com:team/repo.git
+	sshIdentity = /keys/id_work
+	sshPort = 2222
+	sshUser = deploy
+[remote "personal"]
+	url = git@example.com:me/repo.git
+[remote "evil"]
+	url = git@example.com:evil/repo.git
+	sshUser = -oProxyCommand=touch pwned
+`
+	repo := &Repository{}
+	var err error
+	if repo.config, err = ParseConfig(strings.NewReader(config)); err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+	cases := map[string]struct {
+		url  string
+		want string
+	}{
+		"configured remote": {
+			url:  "git@example.com:team/repo.git",
+			want: "-i /keys/id_work -o IdentitiesOnly=yes -p 2222 -- deploy@example.com cmd",
+		},
+		"remote without options": {
+			url:  "git@example.com:me/repo.git",
+			want: "-- git@example.com cmd",
+		},
+		"not a remote": {
+			url:  "ssh://other.example.com:22/repo.git",
+			want: "-p 22 -- other.example.com cmd",
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			a, err := parseSSHURL(tc.url)
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			args, err := repo.sshArgs(tc.url, a, "cmd")
+			if err != nil {
+				t.Fatalf("ssh args: %s", err)
+			}
+			if got := strings.Join(args, " "); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	// Users and hosts that ssh would take for options, or with control
+	// characters, are rejected.
+	for _, url := range []string{
+		"ssh://-oProxyCommand=touch%20pwned@example.com/repo",
+		"ssh://git@-oProxyCommand=touch%20pwned/repo",
+		"-oProxyCommand=touch pwned@example.com:repo",
+		"git@-oProxyCommand=touch pwned:repo",
+		"ssh://git%0Aname@example.com/repo",
+		"git\x00@example.com:repo",
+		"git@example.com:evil/repo.git",
+	} {
+		a, err := parseSSHURL(url)
+		if err != nil {
+			continue
+		}
+		if args, err := repo.sshArgs(url, a, "cmd"); err == nil {
+			t.Errorf("%q: want invalid user or host error, got %q", url, args)
+		}
+	}
+
+	os.Setenv("GIT_SSH", "/usr/bin/my ssh")
+	defer os.Unsetenv("GIT_SSH")
+	if got := repo.sshCommand(); got != "ssh -F /dev/null" {
+		t.Fatalf("want core.sshCommand, got %q", got)
+	}
+	os.Setenv("GIT_SSH_COMMAND", "ssh -v")
+	defer os.Unsetenv("GIT_SSH_COMMAND")
+	if got := repo.sshCommand(); got != "ssh -v" {
+		t.Fatalf("want GIT_SSH_COMMAND, got %q", got)
+	}
+	if got := (&Repository{config: &Config{}}).sshCommand(); got != "ssh -v" {
+		t.Fatalf("want GIT_SSH_COMMAND, got %q", got)
+	}
+	os.Unsetenv("GIT_SSH_COMMAND")
+	if got := (&Repository{config: &Config{}}).sshCommand(); got != `'/usr/bin/my ssh'` {
+		t.Fatalf("want GIT_SSH, got %q", got)
+	}
+}
+
+func TestInteropCloneOverSSH(t *testing.T) {
+	requireGit(t)
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.Mkdir(upstream, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	newGitRepository(t, upstream)
+
+	// The ssh command runs the remote command locally and logs the
+	// requested protocol and its arguments.
+	ssh := filepath.Join(dir, "ssh")
+	script := "#!/bin/sh\necho \"$GIT_PROTOCOL\" \"$@\" >> " + filepath.Join(dir, "log") + "\nfor last; do :; done\nexec sh -c \"git ${last#git-}\"\n"
+	if err := ioutil.WriteFile(ssh, []byte(script), 0755); err != nil {
+		t.Fatalf("write ssh: %s", err)
+	}
+	os.Setenv("GIT_SSH_COMMAND", ssh+" -x")
+	defer os.Unsetenv("GIT_SSH_COMMAND")
+
+	clone := filepath.Join(dir, "clone")
+	url := "git@example.com:" + upstream
+	if err := cmdClone(nil, ioutil.Discard, []string{url, clone}); err != nil {
+		t.Fatalf("clone: %s", err)
+	}
+	repo, err := OpenRepository(clone)
+	if err != nil {
+		t.Fatalf("open clone: %s", err)
+	}
+	assertSameObjects(t, repo, upstream)
+
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatalf("read log: %s", err)
+	}
+	if want := "version=2 -x -o SendEnv=GIT_PROTOCOL -- git@example.com git-upload-pack '" + upstream + "'\n"; string(log) != want {
+		t.Fatalf("want ssh run with %q, got %q", want, log)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// worktreeEntry writes the content of the worktree file as a blob,
+// converted by the attributes the same way it is when staged, and returns
+// the index entry for it. The mode of the previous entry is kept, unless
+// core.fileMode is set and the executable bit is trusted.
+func (r *Repository) worktreeEntry(attrs *attrStack, name string, info os.FileInfo, prev *IndexEntry) (*IndexEntry, error) {
+	full := filepath.Join(r.workdir, filepath.FromSlash(name))
+	content, err := readWorktreeFile(full, info)
+	if err != nil {
+		return nil, err
+	}
+	e := &IndexEntry{Mtime: info.ModTime(), Size: uint32(info.Size()), Mode: modeBlob, Path: name}
+	setStatData(e, info)
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		e.Mode = modeSymlink
+	default:
+		fileMode, err := r.config.Bool("core", "", "fileMode", true)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case fileMode && info.Mode()&0111 != 0:
+			e.Mode = modeExec
+		case !fileMode && prev != nil && prev.Mode == modeExec:
+			e.Mode = modeExec
+		}
+		fileAttrs, err := attrs.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if content, err = r.convertToGit(fileAttrs, name, content); err != nil {
+			return nil, err
+		}
+	}
+	if e.Sha, err = r.WriteObject("blob", content); err != nil {
+		return nil, fmt.Errorf("write %s: %w", name, err)
+	}
+	return e, nil
+}
+
+// stageFile records the worktree file in the index, replacing all entries
+// of the path, including unmerged ones. A file that does not exist anymore
+// is removed from the index.
+func (r *Repository) stageFile(idx *Index, attrs *attrStack, name string) error {
+	info, err := os.Lstat(filepath.Join(r.workdir, filepath.FromSlash(name)))
+	switch {
+	case errors.Is(err, os.ErrNotExist) || isNotDir(err):
+		setIndexEntry(idx, name, nil)
+		return nil
+	case err != nil:
+		return fmt.Errorf("stat %s: %w", name, err)
+	case info.IsDir():
+		return fmt.Errorf("%s is a directory", name)
+	}
+	var prev *IndexEntry
+	if i, ok := idx.entry(name); ok {
+		prev = idx.Entries[i]
+	}
+	e, err := r.worktreeEntry(attrs, name, info, prev)
+	if err != nil {
+		return err
+	}
+	setIndexEntry(idx, name, e)
+	return nil
+}
+
+// unstageFile resets the index entry of the path to the tree, which is what
+// git reset does for a single path. The entry is removed if the tree does
+// not have the path. Tree can be nil.
+func (r *Repository) unstageFile(idx *Index, tr *TreeObject, name string) error {
+	if tr == nil {
+		setIndexEntry(idx, name, nil)
+		return nil
+	}
+	leaf, err := r.lookupTreePath(tr, name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		setIndexEntry(idx, name, nil)
+		return nil
+	case err != nil:
+		return err
+	case leaf.Mode == modeTree:
+		return fmt.Errorf("%s is a directory", name)
+	}
+	setIndexEntry(idx, name, &IndexEntry{Mode: leaf.Mode, Sha: leaf.Sha, Path: name})
+	return nil
+}
+
+// AddPaths stages worktree files matching the patterns, pathspecs relative
+// to the prefix directory of the worktree, as in ParsePathspec.
+// Directories are added recursively. New and
+// modified files are written as blobs and recorded with their mode and stat
+// data, and tracked files that were removed are removed from the index. It
+// fails if a pattern matches neither a file nor a tracked path.
+//
+// Unless force is set, untracked files ignored by gitignore rules are not
+// added, and naming one fails.
+func (r *Repository) AddPaths(idx *Index, prefix string, patterns []string, force bool) error {
+	ps, err := ParsePathspec(prefix, patterns)
+	if err != nil {
+		return err
+	}
+	single := make([]*Pathspec, len(patterns))
+	for i, pattern := range patterns {
+		if single[i], err = ParsePathspec(prefix, []string{pattern}); err != nil {
+			return err
+		}
+	}
+	if err := r.expandIndex(idx); err != nil {
+		return err
+	}
+	wp, err := r.worktreePaths()
+	if err != nil {
+		return err
+	}
+	attrs, err := r.worktreeAttributes()
+	if err != nil {
+		return err
+	}
+	ignores, err := r.worktreeIgnores()
+	if err != nil {
+		return err
+	}
+
+	var names, ignored []string
+	found := make(map[string]os.FileInfo)
+	err = r.walkWorktree(func(name string, info os.FileInfo) error {
+		name = wp.name(name)
+		e := wp.entry(idx, name)
+		if e != nil {
+			// With core.ignoreCase the tracked name is kept.
+			name = e.Path
+		}
+		if !ps.Match(name) {
+			return nil
+		}
+		if e == nil && !force {
+			if skip, err := ignores.Ignored(name); err != nil {
+				return err
+			} else if skip {
+				if named, err := namesIgnored(ignores, single, name); err != nil {
+					return err
+				} else if named {
+					ignored = append(ignored, name)
+				}
+				return nil
+			}
+		}
+		names = append(names, name)
+		found[name] = info
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(ignored) != 0 {
+		return fmt.Errorf("paths are ignored by gitignore rules, use -f to add them: %s", strings.Join(ignored, ", "))
+	}
+	for _, e := range idx.Entries {
+		if _, ok := found[e.Path]; ok || e.Mode == modeGitlink || e.SkipWorktree || !ps.Match(e.Path) {
+			continue
+		}
+		if len(names) == 0 || names[len(names)-1] != e.Path {
+			// Removed from the worktree.
+			names = append(names, e.Path)
+		}
+	}
+
+	matched := make([]bool, len(patterns))
+	for _, name := range names {
+		for i, ps := range single {
+			matched[i] = matched[i] || ps.Match(name)
+		}
+	}
+	for i, ok := range matched {
+		if !ok {
+			return fmt.Errorf("pathspec %q did not match any files", patterns[i])
+		}
+	}
+
+	for _, name := range names {
+		if info, ok := found[name]; ok {
+			if fresh, err := r.entryUpToDate(idx, name, info); err != nil {
+				return err
+			} else if fresh {
+				continue
+			}
+		}
+		if err := r.stageFile(idx, attrs, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namesIgnored tells whether one of the patterns names the ignored path,
+// either itself or an ignored directory of it. Ignored paths that are only
+// matched by wildcards or found in directories that are not ignored are
+// skipped silently.
+func namesIgnored(ignores *ignoreStack, single []*Pathspec, name string) (bool, error) {
+	for _, ps := range single {
+		item := ps.items[0]
+		pattern := strings.TrimSuffix(item.pattern, "/")
+		switch {
+		case item.exclude || pattern == "" || pattern == ".":
+		case name == pattern:
+			return true, nil
+		case strings.HasPrefix(name, pattern+"/"):
+			if ignored, err := ignores.Ignored(pattern + "/"); err != nil || ignored {
+				return ignored, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// entryUpToDate tells whether the index entry of the path was staged from
+// the worktree file as it is now, judging by its mode and stat data.
+func (r *Repository) entryUpToDate(idx *Index, name string, info os.FileInfo) (bool, error) {
+	i, ok := idx.entry(name)
+	if !ok {
+		return false, nil
+	}
+	e := idx.Entries[i]
+	if e.Stage != 0 || e.IntentToAdd || uint32(info.Size()) != e.Size || !info.ModTime().Equal(e.Mtime) || !info.ModTime().Before(idx.ModTime) {
+		return false, nil
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return e.Mode == modeSymlink, nil
+	case e.Mode != modeBlob && e.Mode != modeExec:
+		return false, nil
+	}
+	fileMode, err := r.config.Bool("core", "", "fileMode", true)
+	if err != nil || !fileMode {
+		return err == nil, err
+	}
+	return (info.Mode()&0111 != 0) == (e.Mode == modeExec), nil
+}
+
+// walkWorktree calls fn with the slash separated path of every file and
+// symbolic link of the worktree. Nested repositories are not entered.
+func (r *Repository) walkWorktree(fn func(name string, info os.FileInfo) error) error {
+	return filepath.Walk(r.workdir, func(full string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if full != r.workdir {
+				if _, err := os.Lstat(filepath.Join(full, ".git")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(r.workdir, full)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+// setIndexEntry replaces all entries of the path with the entry, or removes
+// them if it is nil.
+func setIndexEntry(idx *Index, name string, e *IndexEntry) {
+	entries := make([]*IndexEntry, 0, len(idx.Entries)+1)
+	inserted := e == nil
+	for _, x := range idx.Entries {
+		if !inserted && x.Path >= name {
+			entries = append(entries, e)
+			inserted = true
+		}
+		if x.Path != name {
+			entries = append(entries, x)
+		}
+	}
+	if !inserted {
+		entries = append(entries, e)
+	}
+	idx.Entries = entries
+}
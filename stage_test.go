@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStageFile(t *testing.T) {
+	repo := newTestRepository(t)
+	dir := repo.workdir
+	old, err := repo.WriteObject("blob", []byte("old\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	idx := &Index{Version: 2, Entries: []*IndexEntry{
+		{Path: "a", Mode: modeBlob, Sha: old},
+		{Path: "b", Mode: modeBlob, Sha: old, Stage: 1},
+		{Path: "b", Mode: modeBlob, Sha: old, Stage: 2},
+		{Path: "gone", Mode: modeBlob, Sha: old},
+	}}
+	for name, content := range map[string]string{"b": "new\n", "c": "new\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	attrs, err := repo.worktreeAttributes()
+	if err != nil {
+		t.Fatalf("attributes: %s", err)
+	}
+	for _, name := range []string{"b", "c", "gone"} {
+		if err := repo.stageFile(idx, attrs, name); err != nil {
+			t.Fatalf("stage %s: %s", name, err)
+		}
+	}
+	blob := hashObject("blob", []byte("new\n"))
+	assertIndexEntries(t, idx, []*IndexEntry{
+		{Path: "a", Sha: old},
+		{Path: "b", Sha: blob},
+		{Path: "c", Sha: blob},
+	})
+	assertHasObject(t, repo, blob, true)
+
+	tb := NewTreeBuilder(repo, nil)
+	if err := tb.Insert("b", modeBlob, old); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	sha, err := tb.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	tr, err := repo.readTree(sha)
+	if err != nil {
+		t.Fatalf("read tree: %s", err)
+	}
+	for _, name := range []string{"b", "c"} {
+		if err := repo.unstageFile(idx, tr, name); err != nil {
+			t.Fatalf("unstage %s: %s", name, err)
+		}
+	}
+	assertIndexEntries(t, idx, []*IndexEntry{
+		{Path: "a", Sha: old},
+		{Path: "b", Sha: old},
+	})
+}
+
+func assertIndexEntries(t *testing.T, idx *Index, want []*IndexEntry) {
+	t.Helper()
+	if len(idx.Entries) != len(want) {
+		t.Fatalf("want %d entries, got %d", len(want), len(idx.Entries))
+	}
+	for i, e := range idx.Entries {
+		if e.Path != want[i].Path || e.Stage != 0 || !bytes.Equal(e.Sha, want[i].Sha) {
+			t.Errorf("entry %d: want %s %x, got %s %x stage %d", i, want[i].Path, want[i].Sha, e.Path, e.Sha, e.Stage)
+		}
+	}
+}
+
+func TestAddPaths(t *testing.T) {
+	repo := newTestRepository(t)
+	dir := repo.workdir
+	files := map[string]string{
+		"a.go":          "a\n",
+		"doc/b.txt":     "b\n",
+		"src/c.go":      "c\n",
+		"src/d/e.go":    "e\n",
+		"nested/.git/x": "x\n",
+	}
+	for name, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+
+	cases := []struct {
+		patterns []string
+		remove   string
+		want     []string
+	}{
+		{patterns: []string{"*.go"}, want: []string{"a.go", "src/c.go", "src/d/e.go"}},
+		{patterns: []string{"."}, want: []string{"a.go", "doc/b.txt", "src/c.go", "src/d/e.go"}},
+		{patterns: []string{"src/"}, remove: "src/d/e.go", want: []string{"a.go", "doc/b.txt", "src/c.go"}},
+	}
+	idx := &Index{Version: 2}
+	for _, tc := range cases {
+		if tc.remove != "" {
+			if err := os.Remove(filepath.Join(dir, filepath.FromSlash(tc.remove))); err != nil {
+				t.Fatalf("remove: %s", err)
+			}
+		}
+		if err := repo.AddPaths(idx, "", tc.patterns, false); err != nil {
+			t.Fatalf("add %q: %s", tc.patterns, err)
+		}
+		var got []string
+		for _, e := range idx.Entries {
+			got = append(got, e.Path)
+			if want := hashObject("blob", []byte(files[e.Path])); !bytes.Equal(e.Sha, want) {
+				t.Errorf("%s: want %x, got %x", e.Path, want, e.Sha)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Fatalf("add %q: want %q, got %q", tc.patterns, tc.want, got)
+		}
+	}
+
+	if err := repo.AddPaths(idx, "", []string{"a.go", "missing"}, false); err == nil {
+		t.Fatal("want error for a pattern that matches nothing")
+	}
+}
+
+func TestAddPathsIgnored(t *testing.T) {
+	repo := newTestRepository(t)
+	files := map[string]string{
+		".gitignore":   "*.log\nbuild/\n",
+		"a.go":         "a\n",
+		"debug.log":    "log\n",
+		"src/c.go":     "c\n",
+		"src/x.log":    "log\n",
+		"build/out.go": "out\n",
+	}
+	for name, content := range files {
+		full := filepath.Join(repo.workdir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	paths := func(idx *Index) string {
+		var names []string
+		for _, e := range idx.Entries {
+			names = append(names, e.Path)
+		}
+		return strings.Join(names, " ")
+	}
+
+	idx := &Index{Version: 2}
+	if err := repo.AddPaths(idx, "", []string{".", "src"}, false); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if want := ".gitignore a.go src/c.go"; paths(idx) != want {
+		t.Fatalf("want %q, got %q", want, paths(idx))
+	}
+	for _, pattern := range []string{"debug.log", "build", "build/out.go"} {
+		if err := repo.AddPaths(idx, "", []string{pattern}, false); err == nil {
+			t.Fatalf("add %s: want error for an ignored path", pattern)
+		}
+	}
+	if err := repo.AddPaths(idx, "", []string{"debug.log", "build"}, true); err != nil {
+		t.Fatalf("add with force: %s", err)
+	}
+	if want := ".gitignore a.go build/out.go debug.log src/c.go"; paths(idx) != want {
+		t.Fatalf("want %q, got %q", want, paths(idx))
+	}
+	// Tracked files are updated even if they are ignored.
+	if err := ioutil.WriteFile(filepath.Join(repo.workdir, "debug.log"), []byte("more\n"), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := repo.AddPaths(idx, "", []string{"."}, false); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if i, _ := idx.entry("debug.log"); !bytes.Equal(idx.Entries[i].Sha, hashObject("blob", []byte("more\n"))) {
+		t.Fatal("want the tracked ignored file updated")
+	}
+}
+
+func TestInteropAddStatData(t *testing.T) {
+	requireGit(t)
+	repo := newTestRepository(t)
+	for _, name := range []string{"a.go", "src/b.go"} {
+		full := filepath.Join(repo.workdir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte(name+"\n"), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	idx := &Index{Version: 2}
+	if err := repo.AddPaths(idx, "", []string{"."}, false); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if err := repo.WriteIndex(idx); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+	// Git compares all stat data without reading the files.
+	runGit(t, repo.workdir, "diff-files", "--quiet")
+}
@@ -0,0 +1,23 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// setStatData records the change time, device, inode and owner of the file
+// in the entry, which git compares with the worktree as well as the
+// modification time and size.
+func setStatData(e *IndexEntry, info os.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	e.Ctime = time.Unix(st.Ctimespec.Unix())
+	e.Dev, e.Ino = uint32(st.Dev), uint32(st.Ino)
+	e.Uid, e.Gid = st.Uid, st.Gid
+}
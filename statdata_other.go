@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os"
+
+// setStatData records the modification time as the change time of the
+// entry, because the other stat data is not available.
+func setStatData(e *IndexEntry, info os.FileInfo) {
+	e.Ctime = info.ModTime()
+}
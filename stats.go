@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// RepositoryStats describes the content of a repository.
+type RepositoryStats struct {
+	// Objects is the number of loose objects by their type.
+	Objects map[string]int
+	// LooseSize is the disk size of all loose objects, and Size the
+	// size of their inflated content.
+	LooseSize int64
+	Size      int64
+	// Packs cannot be read, so only their number and disk size are known.
+	Packs    int
+	PackSize int64
+	Refs     int
+
+	// BiggestBlobs is sorted by size, and DeepestTrees by depth, largest
+	// first.
+	BiggestBlobs []*ObjectStat
+	DeepestTrees []*ObjectStat
+
+	// BlobEntries is the number of blob entries of all trees, and
+	// DuplicateBlobs the number of blobs with more than one entry.
+	// DedupSize is the size of blob content that is stored once instead
+	// of for every entry, because blobs with the same content are the
+	// same object.
+	BlobEntries    int
+	DuplicateBlobs int
+	DedupSize      int64
+}
+
+// ObjectStat is a measure of a single object, the size of a blob or the
+// depth of a tree.
+type ObjectStat struct {
+	Sha   []byte
+	Value int64
+}
+
+// Stats scans all objects of the repository and returns their statistics,
+// with up to top biggest blobs and deepest trees. Objects of alternates are
+// not included. Loose objects are read in parallel.
+func (r *Repository) Stats(top int) (*RepositoryStats, error) {
+	stats := &RepositoryStats{Objects: make(map[string]int)}
+
+	refs, err := r.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("list refs: %w", err)
+	}
+	stats.Refs = len(refs)
+
+	packs, err := filepath.Glob(path.Join(r.objdir, "pack", "*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range packs {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("stat pack: %w", err)
+		}
+		stats.Packs++
+		stats.PackSize += info.Size()
+	}
+
+	type scanned struct {
+		sha      []byte
+		kind     string
+		diskSize int64
+		size     int64
+		subtrees [][]byte
+		blobs    [][]byte
+		err      error
+	}
+	paths := make(chan string)
+	results := make(chan scanned)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range paths {
+				sha, err := hex.DecodeString(path.Base(path.Dir(name)) + path.Base(name))
+				if err != nil || len(sha) != 20 {
+					// Not an object file.
+					continue
+				}
+				res := scanned{sha: sha}
+				info, err := os.Stat(name)
+				if err != nil {
+					res.err = fmt.Errorf("stat object: %w", err)
+					results <- res
+					continue
+				}
+				res.diskSize = info.Size()
+				kind, content, err := r.ReadRawObject(sha)
+				if err != nil {
+					res.err = fmt.Errorf("object %x: %w", sha, err)
+					results <- res
+					continue
+				}
+				res.kind, res.size = kind, int64(len(content))
+				if kind == "tree" {
+					var tree TreeObject
+					if err := tree.Deserialize(content); err != nil {
+						res.err = fmt.Errorf("tree %x: %w", sha, err)
+					}
+					for _, leaf := range tree.Leafs {
+						switch leaf.Mode {
+						case modeTree:
+							res.subtrees = append(res.subtrees, leaf.Sha)
+						case modeGitlink:
+						default:
+							res.blobs = append(res.blobs, leaf.Sha)
+						}
+					}
+				}
+				results <- res
+			}
+		}()
+	}
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(paths)
+		for i := 0; i < 256; i++ {
+			dir := path.Join(r.objdir, fmt.Sprintf("%02x", i))
+			entries, err := ioutil.ReadDir(dir)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				listErr <- fmt.Errorf("read objects directory: %w", err)
+				return
+			}
+			for _, e := range entries {
+				paths <- path.Join(dir, e.Name())
+			}
+		}
+		listErr <- nil
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	subtrees := make(map[string][][]byte)
+	entries := make(map[string]int)
+	var blobs []*ObjectStat
+	var scanErr error
+	for res := range results {
+		if res.err != nil {
+			if scanErr == nil {
+				scanErr = res.err
+			}
+			continue
+		}
+		stats.Objects[res.kind]++
+		stats.LooseSize += res.diskSize
+		stats.Size += res.size
+		switch res.kind {
+		case "blob":
+			blobs = append(blobs, &ObjectStat{Sha: res.sha, Value: res.size})
+		case "tree":
+			subtrees[string(res.sha)] = res.subtrees
+			for _, sha := range res.blobs {
+				entries[string(sha)]++
+			}
+		}
+	}
+	if err := <-listErr; err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
+
+	// The depth of a tree is one more than the depth of its deepest
+	// subtree. Subtrees that are missing are not counted.
+	depths := make(map[string]int64, len(subtrees))
+	var trees []*ObjectStat
+	for sha := range subtrees {
+		stack := []string{sha}
+		for len(stack) != 0 {
+			current := stack[len(stack)-1]
+			if _, ok := depths[current]; ok {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			depth, ready := int64(1), true
+			for _, sub := range subtrees[current] {
+				if _, ok := subtrees[string(sub)]; !ok {
+					continue
+				}
+				d, ok := depths[string(sub)]
+				if !ok {
+					stack = append(stack, string(sub))
+					ready = false
+					continue
+				}
+				if d+1 > depth {
+					depth = d + 1
+				}
+			}
+			if ready {
+				depths[current] = depth
+				stack = stack[:len(stack)-1]
+			}
+		}
+		trees = append(trees, &ObjectStat{Sha: []byte(sha), Value: depths[sha]})
+	}
+
+	// Sizes of blobs that are not loose are not known.
+	for _, b := range blobs {
+		if n := entries[string(b.Sha)]; n > 1 {
+			stats.DuplicateBlobs++
+			stats.DedupSize += int64(n-1) * b.Value
+		}
+	}
+	for _, n := range entries {
+		stats.BlobEntries += n
+	}
+
+	stats.BiggestBlobs = topObjectStats(blobs, top)
+	stats.DeepestTrees = topObjectStats(trees, top)
+	return stats, nil
+}
+
+// topObjectStats returns up to n stats with the largest values. Equal
+// values are ordered by hash, so that the result does not depend on the
+// scan order.
+func topObjectStats(stats []*ObjectStat, n int) []*ObjectStat {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Value != stats[j].Value {
+			return stats[i].Value > stats[j].Value
+		}
+		return string(stats[i].Sha) < string(stats[j].Sha)
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
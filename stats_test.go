@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	repo := newTestRepository(t)
+	small, err := repo.WriteObject("blob", []byte("small\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	big, err := repo.WriteObject("blob", bytes.Repeat([]byte("big\n"), 100))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	b := NewTreeBuilder(repo, nil)
+	if err := b.Insert("a/b/c/small.txt", modeBlob, small); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	if err := b.Insert("a/big.txt", modeBlob, big); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	// The same content in another directory is the same blob.
+	if err := b.Insert("copy/big.txt", modeBlob, big); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	root, err := b.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	// The test commit adds a blob and a tree of its own.
+	writeTestCommit(t, repo, "base")
+
+	stats, err := repo.Stats(1)
+	if err != nil {
+		t.Fatalf("stats: %s", err)
+	}
+	want := map[string]int{"blob": 3, "tree": 6, "commit": 1}
+	for kind, n := range want {
+		if stats.Objects[kind] != n {
+			t.Fatalf("want %d %s objects, got %d", n, kind, stats.Objects[kind])
+		}
+	}
+	if len(stats.BiggestBlobs) != 1 || !bytes.Equal(stats.BiggestBlobs[0].Sha, big) || stats.BiggestBlobs[0].Value != 400 {
+		t.Fatalf("unexpected biggest blobs %+v", stats.BiggestBlobs)
+	}
+	if len(stats.DeepestTrees) != 1 || !bytes.Equal(stats.DeepestTrees[0].Sha, root) || stats.DeepestTrees[0].Value != 4 {
+		t.Fatalf("unexpected deepest trees %+v", stats.DeepestTrees)
+	}
+	if stats.BlobEntries != 4 || stats.DuplicateBlobs != 1 || stats.DedupSize != 400 {
+		t.Fatalf("unexpected deduplication: %d entries, %d duplicates, %d bytes", stats.BlobEntries, stats.DuplicateBlobs, stats.DedupSize)
+	}
+	if stats.LooseSize == 0 || stats.Size == 0 {
+		t.Fatalf("unexpected sizes %d, %d", stats.LooseSize, stats.Size)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StatusEntry is the state of a path, with the codes of git status
+// --short.
+type StatusEntry struct {
+	Path string
+	// Staged is the change of the index against HEAD and Unstaged the
+	// change of the worktree against the index: ' ' for none, A, D, M or
+	// T. Untracked paths have both set to '?'. Both are set to the codes
+	// of the unmerged stages for unmerged paths, for example U and U if
+	// both sides modified the path.
+	Staged   byte
+	Unstaged byte
+}
+
+// Unmerged tells whether the path has a conflict to resolve.
+func (e *StatusEntry) Unmerged() bool {
+	switch string([]byte{e.Staged, e.Unstaged}) {
+	case "DD", "AU", "UD", "UA", "DU", "AA", "UU":
+		return true
+	}
+	return false
+}
+
+// Which untracked files Status reports.
+const (
+	// UntrackedNo leaves untracked files out.
+	UntrackedNo = "no"
+	// UntrackedNormal reports directories without tracked files as a
+	// single entry with a trailing slash.
+	UntrackedNormal = "normal"
+	// UntrackedAll reports every untracked file.
+	UntrackedAll = "all"
+)
+
+// unmergedCodes are the status codes of unmerged paths by the stages they
+// have: bit 0 is set for the base, bit 1 for ours and bit 2 for theirs.
+var unmergedCodes = [8]string{1: "DD", 2: "AU", 3: "UD", 4: "UA", 5: "DU", 6: "AA", 7: "UU"}
+
+// headTree returns the tree of the HEAD commit, or nil if there is none yet.
+func (r *Repository) headTree() (*TreeObject, error) {
+	_, head, err := r.headBranch()
+	if err != nil || head == nil {
+		return nil, err
+	}
+	c, err := r.readCommit(head)
+	if err != nil {
+		return nil, err
+	}
+	return r.commitTree(c)
+}
+
+// Status compares the HEAD tree with the index and the index with the
+// worktree, and lists untracked files that are not ignored by gitignore
+// rules. Tracked paths are sorted by path and followed by the sorted
+// untracked ones. Untracked is one of UntrackedNo, UntrackedNormal and
+// UntrackedAll.
+func (r *Repository) Status(untracked string) ([]*StatusEntry, error) {
+	tr, err := r.headTree()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := r.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	staged, err := r.DiffTreeIndex(tr, idx, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	unstaged, err := r.DiffIndexWorktree(idx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]*StatusEntry)
+	entry := func(name string) *StatusEntry {
+		e, ok := byPath[name]
+		if !ok {
+			e = &StatusEntry{Path: name, Staged: ' ', Unstaged: ' '}
+			byPath[name] = e
+		}
+		return e
+	}
+	unmerged := make(map[string]int)
+	for _, e := range idx.Entries {
+		if e.Stage != 0 {
+			unmerged[e.Path] |= 1 << (e.Stage - 1)
+		}
+	}
+	for _, c := range staged {
+		if c.Status == 'U' {
+			continue
+		}
+		if i, ok := idx.entry(c.Path); ok && idx.Entries[i].IntentToAdd {
+			// Not staged yet, reported as added in the worktree.
+			continue
+		}
+		entry(c.Path).Staged = c.Status
+	}
+	for _, c := range unstaged {
+		if c.Status != 'U' {
+			entry(c.Path).Unstaged = c.Status
+		}
+	}
+	for name, stages := range unmerged {
+		e := entry(name)
+		e.Staged, e.Unstaged = unmergedCodes[stages][0], unmergedCodes[stages][1]
+	}
+	entries := make([]*StatusEntry, 0, len(byPath))
+	for _, e := range byPath {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	if untracked == UntrackedNo {
+		return entries, nil
+	}
+	names, err := r.untrackedFiles(idx, untracked == UntrackedAll)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		entries = append(entries, &StatusEntry{Path: name, Staged: '?', Unstaged: '?'})
+	}
+	return entries, nil
+}
+
+// untrackedFiles returns sorted paths of worktree files that are neither in
+// the index nor ignored. Unless all is set, a directory without tracked
+// files is returned instead of its files, with a trailing slash. Nested
+// repositories are always returned as directories.
+func (r *Repository) untrackedFiles(idx *Index, all bool) ([]string, error) {
+	ignores, err := r.worktreeIgnores()
+	if err != nil {
+		return nil, err
+	}
+	wp, err := r.worktreePaths()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = filepath.Walk(r.workdir, func(full string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if full == r.workdir {
+			return nil
+		}
+		rel, err := filepath.Rel(r.workdir, full)
+		if err != nil {
+			return err
+		}
+		name := wp.name(filepath.ToSlash(rel))
+		if !info.IsDir() {
+			if wp.entry(idx, name) != nil {
+				return nil
+			}
+			if ignored, err := ignores.Ignored(name); err != nil || ignored {
+				return err
+			}
+			names = append(names, name)
+			return nil
+		}
+
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if ignored, err := ignores.Ignored(name + "/"); err != nil || ignored {
+			if err == nil {
+				err = filepath.SkipDir
+			}
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(full, ".git")); err == nil {
+			// Nested repositories are tracked as gitlinks.
+			if wp.entry(idx, name) == nil {
+				names = append(names, name+"/")
+			}
+			return filepath.SkipDir
+		}
+		if all || hasIndexEntriesIn(idx, name) {
+			return nil
+		}
+		// Directories with only ignored files are not reported.
+		if found, err := r.hasUntrackedFile(ignores, full, name); err != nil || found {
+			if found {
+				names = append(names, name+"/")
+			}
+			if err == nil {
+				err = filepath.SkipDir
+			}
+			return err
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// hasIndexEntriesIn tells whether the index tracks files in the directory.
+func hasIndexEntriesIn(idx *Index, dir string) bool {
+	i, _ := idx.entry(dir + "/")
+	return i < len(idx.Entries) && strings.HasPrefix(idx.Entries[i].Path, dir+"/")
+}
+
+// hasUntrackedFile tells whether an untracked directory has a file that is
+// not ignored.
+func (r *Repository) hasUntrackedFile(ignores *ignoreStack, dir, name string) (bool, error) {
+	errFound := filepath.SkipDir
+	found := false
+	err := filepath.Walk(dir, func(full string, info os.FileInfo, err error) error {
+		if err != nil || full == dir {
+			return err
+		}
+		rel, err := filepath.Rel(r.workdir, full)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if ignored, err := ignores.Ignored(rel + "/"); err != nil || ignored {
+				if err == nil {
+					err = filepath.SkipDir
+				}
+				return err
+			}
+			return nil
+		}
+		if ignored, err := ignores.Ignored(rel); err != nil || ignored {
+			return err
+		}
+		found = true
+		return errFound
+	})
+	if err != nil && !(found && err == errFound) {
+		return false, err
+	}
+	return found, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	repo := newTestRepository(t)
+	dir := repo.workdir
+	write := func(files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			full := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				t.Fatalf("mkdir: %s", err)
+			}
+			if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+				t.Fatalf("write %s: %s", name, err)
+			}
+		}
+	}
+	write(map[string]string{
+		"modified":        "old\n",
+		"deleted":         "old\n",
+		"staged":          "old\n",
+		"tracked/a":       "old\n",
+		".gitignore":      "*.log\nignored/\n",
+		"ignored/a":       "x\n",
+		"untracked/a.log": "x\n",
+	})
+	idx, err := repo.ReadIndex()
+	if err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	if err := repo.AddPaths(idx, "", []string{"modified", "deleted", "staged", "tracked", ".gitignore"}, false); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	tree, err := repo.WriteIndexTree(idx)
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	repo.config.Entries = append(repo.config.Entries,
+		&ConfigEntry{Section: "user", Key: "name", Value: "Test"},
+		&ConfigEntry{Section: "user", Key: "email", Value: "test@example.com"})
+	commit, err := repo.CreateCommit(tree, nil, "initial\n", nil)
+	if err != nil {
+		t.Fatalf("create commit: %s", err)
+	}
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: commit}); err != nil {
+		t.Fatalf("update ref: %s", err)
+	}
+
+	write(map[string]string{
+		"modified":        "new\n",
+		"staged":          "new\n",
+		"added":           "new\n",
+		"tracked/b":       "new\n",
+		"untracked/a":     "new\n",
+		"untracked/b/c":   "new\n",
+		"other.log":       "new\n",
+		"only-ignored/.x": "",
+	})
+	write(map[string]string{"only-ignored/a.log": "new\n"})
+	if err := os.Remove(filepath.Join(dir, "only-ignored", ".x")); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "deleted")); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	if err := repo.AddPaths(idx, "", []string{"staged", "added"}, false); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if err := repo.WriteIndex(idx); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+
+	cases := map[string]struct {
+		untracked string
+		want      []string
+	}{
+		"no untracked": {
+			untracked: UntrackedNo,
+			want:      []string{"A  added", " D deleted", " M modified", "M  staged"},
+		},
+		"normal": {
+			untracked: UntrackedNormal,
+			want:      []string{"A  added", " D deleted", " M modified", "M  staged", "?? tracked/b", "?? untracked/"},
+		},
+		"all": {
+			untracked: UntrackedAll,
+			want:      []string{"A  added", " D deleted", " M modified", "M  staged", "?? tracked/b", "?? untracked/a", "?? untracked/b/c"},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			entries, err := repo.Status(tc.untracked)
+			if err != nil {
+				t.Fatalf("status: %s", err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, string([]byte{e.Staged, e.Unstaged})+" "+e.Path)
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestStatusUnmerged(t *testing.T) {
+	repo := newTestRepository(t)
+	sha := hashObject("blob", []byte("x\n"))
+	idx := &Index{Version: 2}
+	for _, e := range []struct {
+		path   string
+		stages []int
+	}{
+		{"both-modified", []int{1, 2, 3}},
+		{"deleted-by-them", []int{1, 2}},
+		{"added-by-them", []int{3}},
+	} {
+		for _, stage := range e.stages {
+			idx.Entries = append(idx.Entries, &IndexEntry{Path: e.path, Mode: modeBlob, Sha: sha, Stage: stage})
+		}
+	}
+	if err := repo.WriteIndex(idx); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+	entries, err := repo.Status(UntrackedNo)
+	if err != nil {
+		t.Fatalf("status: %s", err)
+	}
+	var got []string
+	for _, e := range entries {
+		if !e.Unmerged() {
+			t.Errorf("%s: want unmerged", e.Path)
+		}
+		got = append(got, string([]byte{e.Staged, e.Unstaged})+" "+e.Path)
+	}
+	want := []string{"UA added-by-them", "UU both-modified", "UD deleted-by-them"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestStatusNul(t *testing.T) {
+	repo := newTestRepository(t)
+	for _, name := range []string{"tab\tname", "plain"} {
+		if err := ioutil.WriteFile(filepath.Join(repo.workdir, name), []byte("x\n"), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %s", err)
+	}
+	if err := os.Chdir(repo.workdir); err != nil {
+		t.Fatalf("chdir: %s", err)
+	}
+	defer os.Chdir(wd)
+
+	for args, want := range map[string]string{
+		"--porcelain": "?? plain\n?? \"tab\\tname\"\n",
+		"-z":          "?? plain\x00?? tab\tname\x00",
+	} {
+		var out bytes.Buffer
+		if err := cmdStatus(nil, &out, strings.Fields(args)); err != nil {
+			t.Fatalf("status %s: %s", args, err)
+		}
+		if out.String() != want {
+			t.Errorf("status %s: want %q, got %q", args, want, out.String())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// streamTransport talks to git-upload-pack over a byte stream, for example
+// a connection to git daemon or the standard streams of ssh. It can only
+// fetch.
+type streamTransport struct {
+	local *Repository
+	// name is the name of the transport in errors.
+	name    string
+	w       io.WriteCloser
+	rd      *bufio.Reader
+	refs    []*Ref
+	caps    []string
+	fetched bool
+	// tips are the negotiation tips, nil for all local references.
+	tips [][]byte
+	// v2 are the capabilities of a server of protocol version 2, nil
+	// for version 0. References are listed on first use, limited to the
+	// prefixes.
+	v2       map[string]string
+	prefixes []string
+	listed   bool
+	// wait, if set, is called once the stream is closed and returns the
+	// error of the process at the other end.
+	wait func() error
+}
+
+// newStreamTransport reads the advertisement of upload-pack from the
+// stream. The stream is closed if that fails.
+func newStreamTransport(local *Repository, name string, w io.WriteCloser, r io.Reader, wait func() error) (*streamTransport, error) {
+	t := &streamTransport{local: local, name: name, w: w, rd: bufio.NewReader(r), wait: wait}
+	var err error
+	t.refs, t.caps, t.v2, err = readUploadPackAdvertisement(t.rd)
+	if err != nil {
+		// The other end usually tells why it exited.
+		if cerr := t.close(); cerr != nil {
+			return nil, cerr
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *streamTransport) ListRefs() ([]*Ref, error) {
+	if t.v2 != nil && !t.listed {
+		refs, err := listRefsV2(t.w, t.rd, t.prefixes)
+		if err != nil {
+			return nil, err
+		}
+		t.refs, t.listed = refs, true
+	}
+	return t.refs, nil
+}
+
+func (t *streamTransport) SetRefPrefixes(prefixes []string) {
+	t.prefixes = prefixes
+}
+
+func (t *streamTransport) Fetch(refs []*Ref) error {
+	if t.fetched {
+		return fmt.Errorf("%s transport can fetch only once", t.name)
+	}
+	t.fetched = true
+	wants := make([][]byte, 0, len(refs))
+	for _, ref := range refs {
+		wants = append(wants, ref.Sha)
+	}
+	if t.v2 != nil {
+		return fetchPackV2(t.w, t.rd, t.local, wants, t.tips)
+	}
+	return fetchPack(t.w, t.rd, t.local, t.caps, wants, t.tips)
+}
+
+func (t *streamTransport) SetNegotiationTips(tips [][]byte) {
+	t.tips = tips
+}
+
+func (t *streamTransport) Push(changes []*RefChange, opts *PushOptions) error {
+	return fmt.Errorf("%s transport is read only", t.name)
+}
+
+func (t *streamTransport) Close() error {
+	if !t.fetched || t.v2 != nil {
+		// Tell the server that nothing is wanted, or that there are
+		// no more commands.
+		_ = writeFlushPkt(t.w)
+	}
+	return t.close()
+}
+
+func (t *streamTransport) close() error {
+	err := t.w.Close()
+	if t.wait != nil {
+		return t.wait()
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Submodule is an entry of the .gitmodules file.
+type Submodule struct {
+	Name   string
+	Path   string
+	URL    string
+	Branch string
+}
+
+// ReadSubmodules returns submodules declared in the .gitmodules file of
+// given worktree directory.
+func ReadSubmodules(workdir string) ([]*Submodule, error) {
+	conf, err := ReadConfigFile(filepath.Join(workdir, ".gitmodules"))
+	if err != nil {
+		return nil, err
+	}
+	var subs []*Submodule
+	for _, name := range conf.Subsections("submodule") {
+		path, ok := conf.Get("submodule", name, "path")
+		if !ok {
+			return nil, fmt.Errorf("submodule %q: no path", name)
+		}
+		if filepath.IsAbs(path) || strings.HasPrefix(filepath.Clean(path), "..") {
+			return nil, fmt.Errorf("submodule %q: path %q outside of the worktree", name, path)
+		}
+		sub := &Submodule{Name: name, Path: path}
+		sub.URL, _ = conf.Get("submodule", name, "url")
+		sub.Branch, _ = conf.Get("submodule", name, "branch")
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// submoduleGitDir returns the git directory of a submodule checked out in
+// dir. Submodules usually keep a .git file pointing to the directory inside
+// of the superproject's .git/modules. Empty string is returned if the
+// submodule is not populated.
+func submoduleGitDir(dir string) (string, error) {
+	gitpath := filepath.Join(dir, ".git")
+	if ok, err := isDir(gitpath); err != nil {
+		return "", err
+	} else if ok {
+		return gitpath, nil
+	}
+	raw, err := ioutil.ReadFile(gitpath)
+	if err != nil {
+		return "", nil
+	}
+	line := string(bytes.TrimSpace(raw))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return "", fmt.Errorf("invalid %q gitfile", gitpath)
+	}
+	gitdir := strings.TrimSpace(line[len("gitdir:"):])
+	if !filepath.IsAbs(gitdir) {
+		gitdir = filepath.Join(dir, gitdir)
+	}
+	return gitdir, nil
+}
+
+// checkoutSubmodules switches HEAD of every populated submodule to the
+// commit recorded for it in the tree of the commit. Same as git, the HEAD of
+// a submodule is detached, and nested submodules are switched too.
+func (r *Repository) checkoutSubmodules(commit []byte, force bool) error {
+	subs, err := ReadSubmodules(r.workdir)
+	if err != nil {
+		return fmt.Errorf("read submodules: %w", err)
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+	c, err := r.readCommit(commit)
+	if err != nil {
+		return err
+	}
+	tree, err := r.commitTree(c)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		leaf, err := r.lookupTreePath(tree, sub.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if leaf.Mode != modeGitlink {
+			continue
+		}
+		dir := filepath.Join(r.workdir, filepath.FromSlash(sub.Path))
+		gitdir, err := submoduleGitDir(dir)
+		if err != nil {
+			return fmt.Errorf("submodule %q: %w", sub.Name, err)
+		}
+		if gitdir == "" {
+			// Not populated.
+			continue
+		}
+		subrepo, err := openGitDir(gitdir, dir)
+		if err != nil {
+			return fmt.Errorf("submodule %q: %w", sub.Name, err)
+		}
+		if head, _ := readHeadCommit(gitdir); head != hex.EncodeToString(leaf.Sha) {
+			if err := subrepo.SwitchHead(leaf.Sha, "", force); err != nil {
+				return fmt.Errorf("submodule %q: %w", sub.Name, err)
+			}
+		}
+		if err := subrepo.checkoutSubmodules(leaf.Sha, force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHeadCommit returns the commit hash that HEAD of given git directory
+// points to, following a single level of symbolic reference.
+func readHeadCommit(gitdir string) (string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(gitdir, "HEAD"))
+	if err != nil {
+		return "", fmt.Errorf("read HEAD: %w", err)
+	}
+	head := string(bytes.TrimSpace(raw))
+	if !strings.HasPrefix(head, "ref:") {
+		return head, nil
+	}
+	ref := strings.TrimSpace(head[len("ref:"):])
+	if raw, err := ioutil.ReadFile(filepath.Join(gitdir, filepath.FromSlash(ref))); err == nil {
+		return string(bytes.TrimSpace(raw)), nil
+	}
+	refs := make(map[string][]byte)
+	if raw, err := ioutil.ReadFile(filepath.Join(gitdir, "packed-refs")); err == nil {
+		if err := parsePackedRefs(raw, refs); err != nil {
+			return "", fmt.Errorf("packed-refs: %w", err)
+		}
+	}
+	if sha, ok := refs[ref]; ok {
+		return fmt.Sprintf("%x", sha), nil
+	}
+	return "", fmt.Errorf("unborn branch %q", ref)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSubmodules(t *testing.T) {
+	cases := map[string]struct {
+		gitmodules string
+		want       []*Submodule
+		wantErr    bool
+	}{
+		"none": {},
+		"submodules": {
+			gitmodules: "[submodule \"lib\"]\n\tpath = vendor/lib\n\turl = https://example.com/lib.git\n\tbranch = main\n" +
+				"[submodule \"docs\"]\n\tpath = docs\n\turl = ../docs.git\n",
+			want: []*Submodule{
+				{Name: "lib", Path: "vendor/lib", URL: "https://example.com/lib.git", Branch: "main"},
+				{Name: "docs", Path: "docs", URL: "../docs.git"},
+			},
+		},
+		"no path": {
+			gitmodules: "[submodule \"lib\"]\n\turl = https://example.com/lib.git\n",
+			wantErr:    true,
+		},
+		"absolute path": {
+			gitmodules: "[submodule \"lib\"]\n\tpath = /etc\n",
+			wantErr:    true,
+		},
+		"parent path": {
+			gitmodules: "[submodule \"lib\"]\n\tpath = ../lib\n",
+			wantErr:    true,
+		},
+		"escaping path": {
+			gitmodules: "[submodule \"lib\"]\n\tpath = a/../../lib\n",
+			wantErr:    true,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gogit-test-")
+			if err != nil {
+				t.Fatalf("temp dir: %s", err)
+			}
+			defer os.RemoveAll(dir)
+			if tc.gitmodules != "" {
+				if err := ioutil.WriteFile(filepath.Join(dir, ".gitmodules"), []byte(tc.gitmodules), 0644); err != nil {
+					t.Fatalf("write .gitmodules: %s", err)
+				}
+			}
+
+			got, err := ReadSubmodules(dir)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read submodules: %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSubmoduleGitDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	abs := filepath.Join(dir, "modules", "abs")
+	cases := map[string]struct {
+		// gitfile is the content of the .git file, or empty for a .git
+		// directory.
+		gitfile string
+		noGit   bool
+		want    string
+		wantErr bool
+	}{
+		"directory":     {want: ".git"},
+		"relative file": {gitfile: "gitdir: ../modules/rel\n", want: "../modules/rel"},
+		"absolute file": {gitfile: "gitdir: " + abs + "\n", want: abs},
+		"not populated": {noGit: true},
+		"invalid file":  {gitfile: "modules/rel\n", wantErr: true},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			sub := filepath.Join(dir, strings.Replace(testName, " ", "-", -1))
+			if err := os.MkdirAll(sub, 0755); err != nil {
+				t.Fatalf("mkdir: %s", err)
+			}
+			switch {
+			case tc.noGit:
+			case tc.gitfile == "":
+				if err := os.Mkdir(filepath.Join(sub, ".git"), 0755); err != nil {
+					t.Fatalf("mkdir .git: %s", err)
+				}
+			default:
+				if err := ioutil.WriteFile(filepath.Join(sub, ".git"), []byte(tc.gitfile), 0644); err != nil {
+					t.Fatalf("write .git: %s", err)
+				}
+			}
+
+			got, err := submoduleGitDir(sub)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("git dir: %s", err)
+			}
+			want := tc.want
+			if want != "" && !filepath.IsAbs(want) {
+				want = filepath.Join(sub, want)
+			}
+			if got != want {
+				t.Fatalf("want %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestSubmoduleForeach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		t.Helper()
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+	libSha := strings.Repeat("1", 40)
+	deepSha := strings.Repeat("2", 40)
+	// The superproject has a populated lib submodule with its git
+	// directory in .git/modules, and an unpopulated docs submodule. lib
+	// has a nested deep submodule.
+	write(".gitmodules", "[submodule \"lib\"]\n\tpath = lib\n[submodule \"docs\"]\n\tpath = docs\n")
+	write(".git/modules/lib/HEAD", "ref: refs/heads/master\n")
+	write(".git/modules/lib/refs/heads/master", libSha+"\n")
+	write("lib/.git", "gitdir: ../.git/modules/lib\n")
+	write("lib/.gitmodules", "[submodule \"nested\"]\n\tpath = deep\n")
+	write("lib/deep/.git/HEAD", deepSha+"\n")
+	write("docs/README", "not populated\n")
+
+	command := `echo "$name $sm_path $displaypath $sha1 $toplevel $(pwd)"`
+	cases := map[string]struct {
+		recursive, quiet bool
+		want             []string
+	}{
+		"top level": {
+			want: []string{
+				"Entering 'lib'",
+				fmt.Sprintf("lib lib lib %s %s %s", libSha, dir, filepath.Join(dir, "lib")),
+			},
+		},
+		"recursive": {
+			recursive: true,
+			want: []string{
+				"Entering 'lib'",
+				fmt.Sprintf("lib lib lib %s %s %s", libSha, dir, filepath.Join(dir, "lib")),
+				"Entering 'lib/deep'",
+				fmt.Sprintf("nested deep lib/deep %s %s %s", deepSha, filepath.Join(dir, "lib"), filepath.Join(dir, "lib", "deep")),
+			},
+		},
+		"quiet": {
+			recursive: true,
+			quiet:     true,
+			want: []string{
+				fmt.Sprintf("lib lib lib %s %s %s", libSha, dir, filepath.Join(dir, "lib")),
+				fmt.Sprintf("nested deep lib/deep %s %s %s", deepSha, filepath.Join(dir, "lib"), filepath.Join(dir, "lib", "deep")),
+			},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := submoduleForeach(&b, dir, "", command, tc.recursive, tc.quiet); err != nil {
+				t.Fatalf("foreach: %s", err)
+			}
+			if want := strings.Join(tc.want, "\n") + "\n"; b.String() != want {
+				t.Fatalf("want:\n%s\ngot:\n%s", want, b.String())
+			}
+		})
+	}
+
+	if err := submoduleForeach(ioutil.Discard, dir, "", "exit 3", false, true); err == nil {
+		t.Fatal("want failing command error")
+	}
+}
+
+func TestCheckoutSubmodules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// commit writes a commit with the files, where a content starting with
+	// "gitlink " is the hash of a submodule commit.
+	commit := func(repo *Repository, files map[string]string) []byte {
+		t.Helper()
+		b := NewTreeBuilder(repo, nil)
+		for path, content := range files {
+			mode, sha := modeBlob, []byte(nil)
+			if strings.HasPrefix(content, "gitlink ") {
+				mode, sha = modeGitlink, []byte(content[len("gitlink "):])
+			} else if sha, err = repo.WriteObject("blob", []byte(content)); err != nil {
+				t.Fatalf("write blob: %s", err)
+			}
+			if err := b.Insert(path, mode, sha); err != nil {
+				t.Fatalf("insert %s: %s", path, err)
+			}
+		}
+		tree, err := b.Write()
+		if err != nil {
+			t.Fatalf("write tree: %s", err)
+		}
+		sha, err := repo.CreateCommit(tree, nil, "commit\n", nil)
+		if err != nil {
+			t.Fatalf("commit: %s", err)
+		}
+		return sha
+	}
+	create := func(path string) *Repository {
+		t.Helper()
+		repo, err := CreateRepository(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatalf("create repository: %s", err)
+		}
+		repo.config.Entries = append(repo.config.Entries,
+			&ConfigEntry{Section: "user", Key: "name", Value: "Test"},
+			&ConfigEntry{Section: "user", Key: "email", Value: "test@example.com"})
+		return repo
+	}
+	gitmodules := func(paths ...string) string {
+		var b strings.Builder
+		for _, p := range paths {
+			fmt.Fprintf(&b, "[submodule %q]\n\tpath = %s\n", p, p)
+		}
+		return b.String()
+	}
+
+	super := create("")
+	lib := create("lib")
+	deep := create("lib/deep")
+	deepOld := commit(deep, map[string]string{"file": "deep old\n"})
+	deepNew := commit(deep, map[string]string{"file": "deep new\n"})
+	libOld := commit(lib, map[string]string{"file": "lib old\n", ".gitmodules": gitmodules("deep"), "deep": "gitlink " + string(deepOld)})
+	libNew := commit(lib, map[string]string{"file": "lib new\n", ".gitmodules": gitmodules("deep"), "deep": "gitlink " + string(deepNew)})
+	if err := deep.SwitchHead(deepOld, "", false); err != nil {
+		t.Fatalf("switch deep: %s", err)
+	}
+	// The populated deep submodule is not tracked by lib yet.
+	if err := lib.SwitchHead(libOld, "", true); err != nil {
+		t.Fatalf("switch lib: %s", err)
+	}
+	// The docs submodule is not populated.
+	top := commit(super, map[string]string{
+		".gitmodules": gitmodules("lib", "docs"),
+		"lib":         "gitlink " + string(libNew),
+		"docs":        "gitlink " + string(bytes.Repeat([]byte{1}, 20)),
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, ".gitmodules"), []byte(gitmodules("lib", "docs")), 0644); err != nil {
+		t.Fatalf("write .gitmodules: %s", err)
+	}
+
+	if err := super.checkoutSubmodules(top, false); err != nil {
+		t.Fatalf("checkout submodules: %s", err)
+	}
+	for path, want := range map[string][]byte{"lib": libNew, "lib/deep": deepNew} {
+		repo, err := OpenRepository(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatalf("open %s: %s", path, err)
+		}
+		head, err := repo.ReadRef("HEAD")
+		if err != nil {
+			t.Fatalf("read %s HEAD: %s", path, err)
+		}
+		if head.Target != "" || !bytes.Equal(head.Sha, want) {
+			t.Fatalf("want %s HEAD detached at %x, got %+v", path, want, head)
+		}
+	}
+	for path, want := range map[string]string{"lib/file": "lib new\n", "lib/deep/file": "deep new\n"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil || string(got) != want {
+			t.Fatalf("want %s with %q, got %q (%v)", path, want, got, err)
+		}
+	}
+}
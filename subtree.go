@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SubtreeSplit extracts the history of the prefix directory into a new,
+// synthetic lineage of commits. Each new commit has the content of the
+// prefix directory as its root tree and keeps the author, committer and
+// message of the original commit. Commits that did not change the directory
+// are skipped. The result is deterministic, so splitting the same history
+// again produces the same commits.
+//
+// Returned hash is nil if the directory never existed in the history.
+func (r *Repository) SubtreeSplit(tip []byte, prefix string) ([]byte, error) {
+	// Map of original commit to its split counterpart. Nil value means
+	// that there is no split commit for the original one.
+	split := make(map[string][]byte)
+
+	type frame struct {
+		sha      []byte
+		commit   *CommitObject
+		parents  [][]byte
+		expanded bool
+	}
+	stack := []*frame{{sha: tip}}
+	for len(stack) != 0 {
+		f := stack[len(stack)-1]
+		if _, ok := split[string(f.sha)]; ok {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if !f.expanded {
+			c, err := r.readCommit(f.sha)
+			if err != nil {
+				return nil, fmt.Errorf("read commit %x: %w", f.sha, err)
+			}
+			f.commit = c
+			for _, p := range c.Header["parent"] {
+				sha, err := hex.DecodeString(p)
+				if err != nil {
+					return nil, fmt.Errorf("commit %x: invalid parent: %w", f.sha, err)
+				}
+				f.parents = append(f.parents, sha)
+				if _, ok := split[string(sha)]; !ok {
+					stack = append(stack, &frame{sha: sha})
+				}
+			}
+			f.expanded = true
+			continue
+		}
+		stack = stack[:len(stack)-1]
+
+		newSha, err := r.splitCommit(f.commit, f.parents, split, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("split %x: %w", f.sha, err)
+		}
+		split[string(f.sha)] = newSha
+	}
+	return split[string(tip)], nil
+}
+
+func (r *Repository) splitCommit(c *CommitObject, parents [][]byte, split map[string][]byte, prefix string) ([]byte, error) {
+	// Parents of the new commit are split counterparts of the original
+	// parents, without duplicates.
+	var newParents [][]byte
+	for _, p := range parents {
+		sp := split[string(p)]
+		if sp == nil {
+			continue
+		}
+		dup := false
+		for _, np := range newParents {
+			if bytes.Equal(np, sp) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			newParents = append(newParents, sp)
+		}
+	}
+
+	tr, err := r.commitTree(c)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := r.lookupTreePath(tr, prefix)
+	switch {
+	case errors.Is(err, os.ErrNotExist), err == nil && leaf.Mode != modeTree:
+		// Directory does not exist in this commit. Follow the first
+		// parent that had it, if any.
+		if len(newParents) == 0 {
+			return nil, nil
+		}
+		return newParents[0], nil
+	case err != nil:
+		return nil, err
+	}
+
+	// Skip commits that did not modify the directory.
+	if len(newParents) == 1 {
+		pc, err := r.readCommit(newParents[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(pc.Header["tree"]) != 0 && pc.Header["tree"][0] == hex.EncodeToString(leaf.Sha) {
+			return newParents[0], nil
+		}
+	}
+
+	header := map[string][]string{
+		"tree":      {hex.EncodeToString(leaf.Sha)},
+		"author":    c.Header["author"],
+		"committer": c.Header["committer"],
+	}
+	if enc, ok := c.Header["encoding"]; ok {
+		header["encoding"] = enc
+	}
+	for _, np := range newParents {
+		header["parent"] = append(header["parent"], hex.EncodeToString(np))
+	}
+	raw, err := (&CommitObject{Header: header, Comment: c.Comment}).Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+	return r.WriteObject("commit", raw)
+}
+
+// SubtreeAdd grafts the tree of commit under the prefix directory of the
+// tree of head, and writes a merge of head and commit with the result, the
+// same as git subtree add does. The prefix must not exist in head.
+func (r *Repository) SubtreeAdd(head, commit []byte, prefix, message string) ([]byte, error) {
+	hc, err := r.readCommit(head)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := r.commitTree(hc)
+	if err != nil {
+		return nil, err
+	}
+	switch _, err := r.lookupTreePath(tr, prefix); {
+	case err == nil:
+		return nil, fmt.Errorf("prefix %q already exists", prefix)
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	c, err := r.readCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Header["tree"]) == 0 {
+		return nil, fmt.Errorf("commit %x without tree", commit)
+	}
+	sub, err := hex.DecodeString(c.Header["tree"][0])
+	if err != nil {
+		return nil, fmt.Errorf("commit %x: invalid tree: %w", commit, err)
+	}
+
+	b := NewTreeBuilder(r, tr)
+	if err := b.Insert(strings.Trim(prefix, "/"), modeTree, sub); err != nil {
+		return nil, err
+	}
+	tree, err := b.Write()
+	if err != nil {
+		return nil, err
+	}
+	return r.CreateCommit(tree, [][]byte{head, commit}, message, nil)
+}
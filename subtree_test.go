@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// testSubtreeRepository creates a repository with an identity, and returns
+// it with a function writing commits with the given files.
+func testSubtreeRepository(t *testing.T) (*Repository, func(files map[string]string, message string, parents ...[]byte) []byte) {
+	t.Helper()
+	repo := newTestRepository(t)
+	repo.config.Entries = append(repo.config.Entries,
+		&ConfigEntry{Section: "user", Key: "name", Value: "Test"},
+		&ConfigEntry{Section: "user", Key: "email", Value: "test@example.com"})
+	commit := func(files map[string]string, message string, parents ...[]byte) []byte {
+		t.Helper()
+		b := NewTreeBuilder(repo, nil)
+		for path, content := range files {
+			sha, err := repo.WriteObject("blob", []byte(content))
+			if err != nil {
+				t.Fatalf("write blob: %s", err)
+			}
+			if err := b.Insert(path, modeBlob, sha); err != nil {
+				t.Fatalf("insert %s: %s", path, err)
+			}
+		}
+		tree, err := b.Write()
+		if err != nil {
+			t.Fatalf("write tree: %s", err)
+		}
+		sha, err := repo.CreateCommit(tree, parents, message, nil)
+		if err != nil {
+			t.Fatalf("commit: %s", err)
+		}
+		return sha
+	}
+	return repo, commit
+}
+
+func TestSubtreeSplit(t *testing.T) {
+	repo, commit := testSubtreeRepository(t)
+
+	// The history changes the lib directory in some commits only, and
+	// merges a side branch changing it too.
+	outside := commit(map[string]string{"README": "readme\n"}, "outside\n")
+	added := commit(map[string]string{"README": "readme\n", "lib/a": "a\n"}, "add lib\n", outside)
+	untouched := commit(map[string]string{"README": "changed\n", "lib/a": "a\n"}, "readme only\n", added)
+	side := commit(map[string]string{"README": "readme\n", "lib/a": "a\n", "lib/b": "b\n"}, "side\n", added)
+	merge := commit(map[string]string{"README": "changed\n", "lib/a": "a\n", "lib/b": "b\n"}, "merge\n", untouched, side)
+	changed := commit(map[string]string{"README": "changed\n", "lib/a": "a2\n", "lib/b": "b\n"}, "change lib\n", merge)
+
+	tip, err := repo.SubtreeSplit(changed, "lib")
+	if err != nil {
+		t.Fatalf("split: %s", err)
+	}
+	// The commit changing README only is skipped, so that the merge has
+	// the split "add lib" and "side" commits as parents. Commits outside
+	// the directory have no split counterpart.
+	graph := make(map[string][]string)
+	for queue := [][]byte{tip}; len(queue) != 0; queue = queue[1:] {
+		c, err := repo.readCommit(queue[0])
+		if err != nil {
+			t.Fatalf("read split commit: %s", err)
+		}
+		tr, err := repo.commitTree(c)
+		if err != nil {
+			t.Fatalf("read split tree: %s", err)
+		}
+		if leaf, err := repo.lookupTreePath(tr, "README"); err == nil {
+			t.Fatalf("want only the lib content, got %+v", leaf)
+		}
+		if _, ok := graph[c.Comment]; ok {
+			continue
+		}
+		graph[c.Comment] = nil
+		for _, p := range c.Header["parent"] {
+			sha, err := hex.DecodeString(p)
+			if err != nil {
+				t.Fatalf("invalid parent: %s", err)
+			}
+			pc, err := repo.readCommit(sha)
+			if err != nil {
+				t.Fatalf("read split commit: %s", err)
+			}
+			graph[c.Comment] = append(graph[c.Comment], pc.Comment)
+			queue = append(queue, sha)
+		}
+	}
+	want := map[string][]string{
+		"change lib\n": {"merge\n"},
+		"merge\n":      {"add lib\n", "side\n"},
+		"side\n":       {"add lib\n"},
+		"add lib\n":    nil,
+	}
+	if !reflect.DeepEqual(graph, want) {
+		t.Fatalf("want split history %q, got %q", want, graph)
+	}
+
+	c, err := repo.readCommit(tip)
+	if err != nil {
+		t.Fatalf("read split commit: %s", err)
+	}
+	tr, err := repo.commitTree(c)
+	if err != nil {
+		t.Fatalf("read split tree: %s", err)
+	}
+	leaf, err := repo.lookupTreePath(tr, "a")
+	if err != nil {
+		t.Fatalf("lookup a: %s", err)
+	}
+	if _, content, err := repo.ReadRawObject(leaf.Sha); err != nil || string(content) != "a2\n" {
+		t.Fatalf("want a2, got %q, %v", content, err)
+	}
+
+	again, err := repo.SubtreeSplit(changed, "lib/")
+	if err != nil {
+		t.Fatalf("split again: %s", err)
+	}
+	if !bytes.Equal(again, tip) {
+		t.Fatalf("want the same split %x, got %x", tip, again)
+	}
+
+	if tip, err := repo.SubtreeSplit(changed, "missing"); err != nil || tip != nil {
+		t.Fatalf("want no split of a missing directory, got %x, %v", tip, err)
+	}
+}
+
+func TestSubtreeAdd(t *testing.T) {
+	repo, commit := testSubtreeRepository(t)
+
+	head := commit(map[string]string{"README": "readme\n", "vendor/other": "other\n"}, "head\n")
+	lib := commit(map[string]string{"a": "a\n", "dir/b": "b\n"}, "lib\n")
+
+	merge, err := repo.SubtreeAdd(head, lib, "vendor/lib", "add lib\n")
+	if err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	c, err := repo.readCommit(merge)
+	if err != nil {
+		t.Fatalf("read merge: %s", err)
+	}
+	if want := []string{hex.EncodeToString(head), hex.EncodeToString(lib)}; len(c.Header["parent"]) != 2 ||
+		c.Header["parent"][0] != want[0] || c.Header["parent"][1] != want[1] {
+		t.Fatalf("want parents %q, got %q", want, c.Header["parent"])
+	}
+	tr, err := repo.commitTree(c)
+	if err != nil {
+		t.Fatalf("read merge tree: %s", err)
+	}
+	for path, want := range map[string]string{"README": "readme\n", "vendor/other": "other\n", "vendor/lib/a": "a\n", "vendor/lib/dir/b": "b\n"} {
+		leaf, err := repo.lookupTreePath(tr, path)
+		if err != nil {
+			t.Fatalf("lookup %s: %s", path, err)
+		}
+		if _, content, err := repo.ReadRawObject(leaf.Sha); err != nil || string(content) != want {
+			t.Fatalf("want %s with %q, got %q, %v", path, want, content, err)
+		}
+	}
+
+	// Splitting the added directory gives back the added commit's tree.
+	tip, err := repo.SubtreeSplit(merge, "vendor/lib")
+	if err != nil {
+		t.Fatalf("split: %s", err)
+	}
+	sc, err := repo.readCommit(tip)
+	if err != nil {
+		t.Fatalf("read split commit: %s", err)
+	}
+	lc, err := repo.readCommit(lib)
+	if err != nil {
+		t.Fatalf("read lib commit: %s", err)
+	}
+	if sc.Header["tree"][0] != lc.Header["tree"][0] {
+		t.Fatalf("want split tree %s, got %s", lc.Header["tree"][0], sc.Header["tree"][0])
+	}
+
+	if _, err := repo.SubtreeAdd(merge, lib, "vendor/lib", "again\n"); err == nil {
+		t.Fatal("want existing prefix error")
+	}
+	if _, err := repo.SubtreeAdd(head, lib, "README", "file\n"); err == nil {
+		t.Fatal("want existing file prefix error")
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Transport exchanges objects and references between the local repository
+// it was opened for and a remote repository.
+type Transport interface {
+	// ListRefs returns references advertised by the remote repository.
+	// HEAD is included with both the hash and the target set. Some
+	// transports do not know the hash of a reference before fetching it,
+	// in which case Sha is nil.
+	ListRefs() ([]*Ref, error)
+	// Fetch copies all objects reachable from given remote references,
+	// that are not yet present, into the local repository. Missing Sha of
+	// a reference is set once it is known.
+	Fetch(refs []*Ref) error
+	// Push sends objects required by changes from the local repository and
+	// updates the remote references. A transport that reports the status
+	// of each reference sets Rejected of changes that were refused. Nil
+	// options are the same as zero options.
+	Push(changes []*RefChange, opts *PushOptions) error
+	Close() error
+}
+
+// TransportFactory creates a transport between the local repository and a
+// remote URL.
+type TransportFactory func(local *Repository, url string) (Transport, error)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]TransportFactory{
+		"file": func(local *Repository, url string) (Transport, error) {
+			t, err := openLocalTransport(local, strings.TrimPrefix(url, "file://"))
+			if err != nil {
+				return nil, err
+			}
+			return t, nil
+		},
+		"git": func(local *Repository, url string) (Transport, error) {
+			t, err := openGitTransport(local, url)
+			if err != nil {
+				return nil, err
+			}
+			return t, nil
+		},
+		"ssh": func(local *Repository, url string) (Transport, error) {
+			t, err := openSSHTransport(local, url)
+			if err != nil {
+				return nil, err
+			}
+			return t, nil
+		},
+	}
+)
+
+// RegisterTransport makes OpenTransport use factory for URLs with given
+// scheme, for example "s3" for "s3://bucket/repo". Registering a scheme
+// again replaces the previous factory, which allows to override built-in
+// transports. Nil factory removes the registration.
+func RegisterTransport(scheme string, factory TransportFactory) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if factory == nil {
+		delete(transports, scheme)
+	} else {
+		transports[scheme] = factory
+	}
+}
+
+// OpenTransport returns a transport for given remote URL. URLs without a
+// scheme are local paths, except for the scp-like [user@]host:path form,
+// which is served by the ssh transport. The <transport>::<address> form and
+// URLs with a scheme that has no registered transport are served by the
+// git-remote-<transport> helper program. Error is returned if the
+// transport is not allowed by protocol.allow.
+func (r *Repository) OpenTransport(url string) (Transport, error) {
+	if err := r.checkProtocol(transportName(url)); err != nil {
+		return nil, err
+	}
+	if helper, address, ok := helperURL(url); ok {
+		return r.openHelper(helper, address)
+	}
+	scheme := "file"
+	if i := strings.Index(url, "://"); i >= 0 {
+		scheme = url[:i]
+	} else if isSCPLikeURL(url) {
+		scheme = "ssh"
+	}
+	transportsMu.RLock()
+	factory, ok := transports[scheme]
+	transportsMu.RUnlock()
+	if !ok {
+		return r.openHelper(scheme, url)
+	}
+	return factory(r, url)
+}
+
+func (r *Repository) openHelper(name, url string) (Transport, error) {
+	t, err := openHelperTransport(r, name, url)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// localTransport talks to a repository on the same file system. Objects are
+// copied directly between object directories.
+type localTransport struct {
+	local  *Repository
+	remote *Repository
+	url    string
+	// prefixes limit listed references, if set.
+	prefixes []string
+}
+
+func openLocalTransport(local *Repository, dir string) (*localTransport, error) {
+	dir = filepath.FromSlash(dir)
+	if filepath.Base(dir) == ".git" {
+		dir = filepath.Dir(dir)
+	}
+	if ok, err := isDir(filepath.Join(dir, ".git")); (err != nil || !ok) && !isBareRepository(dir) {
+		return nil, fmt.Errorf("%q does not appear to be a git repository", dir)
+	}
+	remote, err := OpenRepository(dir)
+	if err != nil {
+		return nil, fmt.Errorf("open remote repository: %w", err)
+	}
+	return &localTransport{local: local, remote: remote, url: dir}, nil
+}
+
+// ListRefs returns references of the remote repository, except for the ones
+// hidden by its transfer.hideRefs or uploadpack.hideRefs settings.
+func (t *localTransport) ListRefs() ([]*Ref, error) {
+	all, err := t.remote.uploadPackRefs()
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]*Ref, 0, len(all))
+	for _, ref := range all {
+		if ref.Name == "HEAD" || hasRefPrefix(ref.Name, t.prefixes) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+func (t *localTransport) SetRefPrefixes(prefixes []string) {
+	t.prefixes = prefixes
+}
+
+// uploadPackRefs returns the references upload-pack advertises: HEAD, with
+// both the target and the hash set, unless it has no commits yet, followed
+// by references not hidden by transfer.hideRefs or uploadpack.hideRefs.
+func (r *Repository) uploadPackRefs() ([]*Ref, error) {
+	all, err := r.refs.listRefs()
+	if err != nil {
+		return nil, err
+	}
+	hidden := r.hiddenRefs("uploadpack")
+	refs := make([]*Ref, 0, len(all))
+	for _, ref := range all {
+		if !hidden.hidden(ref.Name) {
+			refs = append(refs, ref)
+		}
+	}
+	head, err := r.ReadRef("HEAD")
+	switch {
+	case err == nil:
+		head.Sha, err = r.resolveRef("HEAD")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if head.Sha != nil {
+			refs = append([]*Ref{head}, refs...)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// Nothing to advertise.
+	default:
+		return nil, err
+	}
+	return refs, nil
+}
+
+// Fetch copies objects reachable from the references. Wanted objects must be
+// tips of references advertised by ListRefs, unless the uploadpack settings
+// of the remote repository allow more: allowTipSHA1InWant allows tips of
+// hidden references, allowReachableSHA1InWant objects reachable from
+// advertised references and allowAnySHA1InWant any object.
+func (t *localTransport) Fetch(refs []*Ref) error {
+	wants := make([][]byte, 0, len(refs))
+	for _, ref := range refs {
+		wants = append(wants, ref.Sha)
+	}
+	if err := t.checkWants(wants); err != nil {
+		return err
+	}
+	return copyObjects(t.remote, t.local, wants, "fetch", nil)
+}
+
+func (t *localTransport) checkWants(wants [][]byte) error {
+	config := t.remote.config
+	allowAny, err := config.Bool("uploadpack", "", "allowAnySHA1InWant", false)
+	if err != nil {
+		return err
+	}
+	allowReachable, err := config.Bool("uploadpack", "", "allowReachableSHA1InWant", false)
+	if err != nil {
+		return err
+	}
+	allowTip, err := config.Bool("uploadpack", "", "allowTipSHA1InWant", false)
+	if err != nil {
+		return err
+	}
+	if allowAny {
+		for _, sha := range wants {
+			if ok, err := t.remote.HasObject(sha); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("upload-pack: not our ref %x", sha)
+			}
+		}
+		return nil
+	}
+
+	advertised, err := t.ListRefs()
+	if err != nil {
+		return err
+	}
+	tips := make(map[string]struct{}, len(advertised))
+	for _, ref := range advertised {
+		tips[string(ref.Sha)] = struct{}{}
+	}
+	if allowTip {
+		all, err := t.remote.refs.listRefs()
+		if err != nil {
+			return err
+		}
+		for _, ref := range all {
+			tips[string(ref.Sha)] = struct{}{}
+		}
+	}
+	var rest [][]byte
+	for _, sha := range wants {
+		if _, ok := tips[string(sha)]; !ok {
+			rest = append(rest, sha)
+		}
+	}
+	if len(rest) == 0 {
+		return nil
+	}
+	if !allowReachable {
+		return fmt.Errorf("upload-pack: not our ref %x", rest[0])
+	}
+
+	// Only objects reachable from advertised references are allowed, so
+	// that history of hidden references stays private.
+	pending := make(map[string][]byte, len(rest))
+	for _, sha := range rest {
+		pending[string(sha)] = sha
+	}
+	from := make([][]byte, 0, len(advertised))
+	for _, ref := range advertised {
+		from = append(from, ref.Sha)
+	}
+	errAllFound := errors.New("all wants are reachable")
+	err = t.remote.WalkObjects(from, func(o *WalkedObject) error {
+		delete(pending, string(o.Sha))
+		if len(pending) == 0 {
+			return errAllFound
+		}
+		return nil
+	})
+	if err != nil && err != errAllFound {
+		return err
+	}
+	for _, sha := range rest {
+		if _, ok := pending[string(sha)]; ok {
+			return fmt.Errorf("upload-pack: not our ref %x", sha)
+		}
+	}
+	return nil
+}
+
+// Push updates remote references. Changes of references hidden by the
+// transfer.hideRefs or receive.hideRefs settings of the remote repository
+// are rejected. Hooks of the remote repository are run the same way git
+// receive-pack runs them: pre-receive can decline the whole push, update
+// each of the references, and post-receive is told about the updated
+// references. Push options are passed to the hooks if the remote
+// repository enables receive.advertisePushOptions, and a signed push
+// certificate if it sets receive.certNonceSeed.
+func (t *localTransport) Push(changes []*RefChange, opts *PushOptions) error {
+	if opts == nil {
+		opts = &PushOptions{}
+	}
+	var (
+		updates  []*RefUpdate
+		accepted []*RefChange
+		tips     [][]byte
+	)
+	hidden := t.remote.hiddenRefs("receive")
+	for _, c := range changes {
+		if hidden.hidden(c.Dst) {
+			c.Rejected = "deny updating a hidden ref"
+			continue
+		}
+		updates = append(updates, &RefUpdate{Name: c.Dst, Sha: c.New, OldSha: c.Old})
+		accepted = append(accepted, c)
+		if c.New != nil {
+			tips = append(tips, c.New)
+		}
+	}
+	if err := t.checkCurrentBranch(updates); err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	var env []string
+	if len(opts.Options) != 0 {
+		if ok, err := t.remote.config.Bool("receive", "", "advertisePushOptions", false); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("the receiving end does not support push options")
+		}
+		env = append(env, pushOptionsEnv(opts.Options)...)
+	}
+	if opts.Signed != PushSignedNever {
+		nonce, ok := t.remote.certNonce()
+		switch {
+		case ok:
+			cert, err := t.local.signPushCert(t.url, nonce, opts, accepted)
+			if err != nil {
+				return err
+			}
+			certEnv, err := t.remote.receivePushCert(cert, nonce, updates)
+			if err != nil {
+				return err
+			}
+			env = append(env, certEnv...)
+		case opts.Signed != PushSignedIfAsked:
+			return errors.New("the receiving end does not support --signed push")
+		}
+	}
+
+	var input bytes.Buffer
+	for _, u := range updates {
+		fmt.Fprintf(&input, "%s %s %s\n", rawDiffHash(u.OldSha), rawDiffHash(u.Sha), u.Name)
+	}
+	errDeclined := errors.New("pre-receive hook declined")
+	err := copyObjects(t.local, t.remote, tips, "receive", func(q *Quarantine) error {
+		if _, err := t.remote.runHook("pre-receive", input.Bytes(), append(env, q.Env()...)); err != nil {
+			return errDeclined
+		}
+		return nil
+	})
+	if err == errDeclined {
+		for _, c := range accepted {
+			c.Rejected = err.Error()
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	allowed := updates[:0]
+	input.Reset()
+	for i, u := range updates {
+		if _, err := t.remote.runHook("update", nil, env, u.Name, rawDiffHash(u.OldSha), rawDiffHash(u.Sha)); err != nil {
+			accepted[i].Rejected = "hook declined"
+			continue
+		}
+		allowed = append(allowed, u)
+		fmt.Fprintf(&input, "%s %s %s\n", rawDiffHash(u.OldSha), rawDiffHash(u.Sha), u.Name)
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	if err := t.remote.UpdateRefs(allowed...); err != nil {
+		return err
+	}
+	// The references are already updated, so failure of the hook changes
+	// nothing.
+	_, _ = t.remote.runHook("post-receive", input.Bytes(), env)
+	return nil
+}
+
+// checkCurrentBranch refuses to update the branch checked out in the remote
+// work tree, unless receive.denyCurrentBranch allows it.
+func (t *localTransport) checkCurrentBranch(updates []*RefUpdate) error {
+	if bare, err := t.remote.config.Bool("core", "", "bare", false); err != nil || bare {
+		return err
+	}
+	switch deny, _ := t.remote.config.Get("receive", "", "denyCurrentBranch"); deny {
+	case "", "refuse", "true":
+		// Default.
+	default:
+		return nil
+	}
+	head, err := t.remote.ReadRef("HEAD")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, u := range updates {
+		if u.Name == head.Target {
+			return fmt.Errorf("refusing to update checked out branch %s", u.Name)
+		}
+	}
+	return nil
+}
+
+func (t *localTransport) Close() error {
+	return nil
+}
+
+// receiveObjects stores objects written by receive in a quarantine. They
+// become visible in the repository only once the whole history reachable
+// from tips is known to be present, received trees are safe to check out,
+// received objects pass the checks enabled by <section>.fsckObjects, and
+// accept, if not nil, did not return an error. Section is "fetch" or
+// "receive".
+func receiveObjects(r *Repository, tips [][]byte, section string, receive func(incoming *Repository) error, accept func(q *Quarantine) error) error {
+	q, err := r.NewQuarantine()
+	if err != nil {
+		return err
+	}
+	incoming := q.Repository()
+	err = receive(incoming)
+	if err == nil {
+		err = incoming.CheckConnectivity(tips)
+	}
+	if err == nil {
+		err = incoming.checkTreeNames(tips, r)
+	}
+	if err == nil {
+		err = incoming.fsckReceived(tips, r, section)
+	}
+	if err == nil && accept != nil {
+		err = accept(q)
+	}
+	if err != nil {
+		if derr := q.Discard(); derr != nil {
+			return fmt.Errorf("%w (discard: %s)", err, derr)
+		}
+		return err
+	}
+	return q.Migrate()
+}
+
+// copyObjects copies loose objects reachable from tips that are missing in
+// the destination repository. The destination is assumed to already
+// contain all objects reachable from the objects it has.
+func copyObjects(src, dst *Repository, tips [][]byte, section string, accept func(q *Quarantine) error) error {
+	return receiveObjects(dst, tips, section, func(incoming *Repository) error {
+		return src.WalkObjects(tips, func(o *WalkedObject) error {
+			if ok, err := dst.HasObject(o.Sha); err != nil {
+				return err
+			} else if ok {
+				return SkipObject
+			}
+			if o.Missing {
+				return fmt.Errorf("object %x is missing", o.Sha)
+			}
+			if o.Corrupt != nil {
+				return o.Corrupt
+			}
+			return incoming.copyLooseObject(src, o.Sha)
+		})
+	}, accept)
+}
+
+// copyLooseObject writes an object read from another repository without
+// decompressing it. Packed objects of the other repository are written as
+// loose objects.
+func (r *Repository) copyLooseObject(src *Repository, sha []byte) error {
+	path, err := src.objectPath(sha)
+	if errors.Is(err, os.ErrNotExist) {
+		kind, content, err := src.ReadRawObject(sha)
+		if err != nil {
+			return err
+		}
+		_, err = r.WriteObject(kind, content)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read object: %w", err)
+	}
+	return r.writeLooseObject(sha, func(fd *os.File) error {
+		_, err := fd.Write(raw)
+		return err
+	})
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLocalTransportFetchAndPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream, err := CreateRepository(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatalf("create upstream repository: %s", err)
+	}
+	local, err := CreateRepository(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatalf("create local repository: %s", err)
+	}
+	first := writeTestCommit(t, upstream, "first")
+	second := writeTestCommit(t, upstream, "second", first)
+	if err := upstream.UpdateRefs(&RefUpdate{Name: "refs/heads/stable", Sha: second}); err != nil {
+		t.Fatalf("update upstream: %s", err)
+	}
+
+	tr, err := local.OpenTransport("file://" + filepath.ToSlash(upstream.workdir))
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	spec, err := ParseRefspec("refs/heads/*:refs/remotes/origin/*")
+	if err != nil {
+		t.Fatalf("parse refspec: %s", err)
+	}
+	// A dry run reports the changes without updating references.
+	changes, err := local.Fetch(tr, []*Refspec{spec}, &FetchOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run fetch: %s", err)
+	}
+	if len(changes) != 1 || changes[0].Dst != "refs/remotes/origin/stable" || !bytes.Equal(changes[0].New, second) {
+		t.Fatalf("want stable fetched, got %+v", changes)
+	}
+	if _, err := local.refs.readRef("refs/remotes/origin/stable"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want no reference after a dry run, got %v", err)
+	}
+	if _, err := local.Fetch(tr, []*Refspec{spec}, nil); err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	if err := local.CheckConnectivity([][]byte{second}); err != nil {
+		t.Fatalf("fetched history: %s", err)
+	}
+	assertRef(t, local, "refs/remotes/origin/stable", second)
+
+	// Diverged history is rejected unless forced.
+	other := writeTestCommit(t, local, "other", first)
+	if err := local.UpdateRefs(&RefUpdate{Name: "refs/heads/topic", Sha: other}); err != nil {
+		t.Fatalf("update local: %s", err)
+	}
+	push, err := ParseRefspec("refs/heads/topic:refs/heads/stable")
+	if err != nil {
+		t.Fatalf("parse refspec: %s", err)
+	}
+	changes, err = local.Push(tr, []*Refspec{push}, nil)
+	if err != nil {
+		t.Fatalf("push: %s", err)
+	}
+	if len(changes) != 1 || changes[0].Rejected != "non-fast-forward" {
+		t.Fatalf("want non-fast-forward rejection, got %+v", changes)
+	}
+	assertRef(t, upstream, "refs/heads/stable", second)
+
+	push.Force = true
+	changes, err = local.Push(tr, []*Refspec{push}, &PushOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run push: %s", err)
+	}
+	if len(changes) != 1 || !changes[0].Forced || changes[0].Rejected != "" {
+		t.Fatalf("want forced update, got %+v", changes)
+	}
+	assertRef(t, upstream, "refs/heads/stable", second)
+	assertHasObject(t, upstream, other, false)
+
+	if _, err := local.Push(tr, []*Refspec{push}, nil); err != nil {
+		t.Fatalf("forced push: %s", err)
+	}
+	assertRef(t, upstream, "refs/heads/stable", other)
+	assertHasObject(t, upstream, other, true)
+}
+
+func TestLocalTransportHideRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream, err := CreateRepository(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatalf("create upstream repository: %s", err)
+	}
+	local, err := CreateRepository(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatalf("create local repository: %s", err)
+	}
+	public := writeTestCommit(t, upstream, "public")
+	change := writeTestCommit(t, upstream, "change", public)
+	err = upstream.UpdateRefs(
+		&RefUpdate{Name: "refs/heads/master", Sha: public},
+		&RefUpdate{Name: "refs/changes/01/1/1", Sha: change},
+	)
+	if err != nil {
+		t.Fatalf("update upstream: %s", err)
+	}
+	fd, err := os.OpenFile(filepath.Join(upstream.gitdir, "config"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open config: %s", err)
+	}
+	fd.WriteString("[uploadpack]\nhideRefs = refs/changes\n[receive]\nhideRefs = refs/keep-around\n")
+	fd.Close()
+
+	tr, err := local.OpenTransport(upstream.workdir)
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	refs, err := tr.ListRefs()
+	if err != nil {
+		t.Fatalf("list refs: %s", err)
+	}
+	for _, ref := range refs {
+		if ref.Name == "refs/changes/01/1/1" {
+			t.Fatal("hidden reference advertised")
+		}
+	}
+	if err := tr.Fetch([]*Ref{{Name: "refs/changes/01/1/1", Sha: change}}); err == nil {
+		t.Fatal("hidden reference fetched")
+	}
+	assertHasObject(t, local, change, false)
+
+	spec, err := ParseRefspec("+refs/*:refs/remotes/origin/*")
+	if err != nil {
+		t.Fatalf("parse refspec: %s", err)
+	}
+	if _, err := local.Fetch(tr, []*Refspec{spec}, nil); err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	assertRef(t, local, "refs/remotes/origin/heads/master", public)
+
+	if err := local.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: public}); err != nil {
+		t.Fatalf("update local: %s", err)
+	}
+	push, err := ParseRefspec("refs/heads/master:refs/keep-around/x")
+	if err != nil {
+		t.Fatalf("parse refspec: %s", err)
+	}
+	changes, err := local.Push(tr, []*Refspec{push}, nil)
+	if err != nil {
+		t.Fatalf("push: %s", err)
+	}
+	if len(changes) != 1 || changes[0].Rejected != "deny updating a hidden ref" {
+		t.Fatalf("want hidden reference rejection, got %+v", changes)
+	}
+	if _, err := upstream.ReadRef("refs/keep-around/x"); err == nil {
+		t.Fatal("hidden reference updated by push")
+	}
+}
+
+func TestLocalTransportFetchByHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream, err := CreateRepository(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatalf("create upstream repository: %s", err)
+	}
+	first := writeTestCommit(t, upstream, "first")
+	second := writeTestCommit(t, upstream, "second", first)
+	change := writeTestCommit(t, upstream, "change", second)
+	err = upstream.UpdateRefs(
+		&RefUpdate{Name: "refs/heads/master", Sha: second},
+		&RefUpdate{Name: "refs/changes/01/1/1", Sha: change},
+	)
+	if err != nil {
+		t.Fatalf("update upstream: %s", err)
+	}
+	unreferenced := writeTestCommit(t, upstream, "unreferenced", second)
+
+	cases := map[string]struct {
+		config string
+		want   []byte
+		ok     bool
+	}{
+		"advertised tip": {
+			want: second,
+			ok:   true,
+		},
+		"not a tip": {
+			want: first,
+		},
+		"reachable": {
+			config: "allowReachableSHA1InWant = true\n",
+			want:   first,
+			ok:     true,
+		},
+		"reachable only from hidden reference": {
+			config: "allowReachableSHA1InWant = true\n",
+			want:   change,
+		},
+		"tip of hidden reference": {
+			config: "allowTipSHA1InWant = true\n",
+			want:   change,
+			ok:     true,
+		},
+		"any object": {
+			config: "allowAnySHA1InWant = true\n",
+			want:   unreferenced,
+			ok:     true,
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			config := "[core]\nrepositoryformatversion = 0\n[uploadpack]\nhideRefs = refs/changes\n" + tc.config
+			if err := ioutil.WriteFile(filepath.Join(upstream.gitdir, "config"), []byte(config), 0644); err != nil {
+				t.Fatalf("write config: %s", err)
+			}
+			local, err := CreateRepository(filepath.Join(dir, testName))
+			if err != nil {
+				t.Fatalf("create local repository: %s", err)
+			}
+			tr, err := local.OpenTransport(upstream.workdir)
+			if err != nil {
+				t.Fatalf("open transport: %s", err)
+			}
+			spec, err := ParseRefspec(fmt.Sprintf("%x:refs/heads/ci", tc.want))
+			if err != nil {
+				t.Fatalf("parse refspec: %s", err)
+			}
+			_, err = local.Fetch(tr, []*Refspec{spec}, nil)
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("want fetch to fail")
+				}
+				assertHasObject(t, local, tc.want, false)
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetch: %s", err)
+			}
+			assertRef(t, local, "refs/heads/ci", tc.want)
+		})
+	}
+}
+
+func TestLocalTransportPushHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit-test-")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream, err := CreateRepository(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatalf("create upstream repository: %s", err)
+	}
+	local, err := CreateRepository(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatalf("create local repository: %s", err)
+	}
+	fd, err := os.OpenFile(filepath.Join(upstream.gitdir, "config"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open config: %s", err)
+	}
+	fd.WriteString("[receive]\nadvertisePushOptions = true\ncertNonceSeed = secret\n[gpg]\nprogram = " + filepath.Join(dir, "gpg") + "\n")
+	fd.Close()
+
+	// The fake gpg signs anything and accepts any signature.
+	gpg := "#!/bin/sh\n" +
+		"if [ \"$2\" = -bsau ]; then\n" +
+		"  echo '-----BEGIN PGP SIGNATURE-----'\n" +
+		"  echo '-----END PGP SIGNATURE-----'\n" +
+		"  echo '[GNUPG:] SIG_CREATED D 1 2 00 1 ABCD' >&2\n" +
+		"else\n" +
+		"  echo '[GNUPG:] GOODSIG ABCD Test <test@example.com>'\n" +
+		"  echo '[GNUPG:] VALIDSIG ABCD'\n" +
+		"  echo '[GNUPG:] TRUST_FULLY'\n" +
+		"fi\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "gpg"), []byte(gpg), 0755); err != nil {
+		t.Fatalf("write gpg: %s", err)
+	}
+	// The hook records what it was told, and declines pushes with the
+	// "reject" option.
+	hook := "#!/bin/sh\n" +
+		"cat > " + filepath.Join(dir, "input") + "\n" +
+		"env | grep ^GIT_PUSH_ | sort > " + filepath.Join(dir, "env") + "\n" +
+		"test \"$GIT_PUSH_OPTION_0\" != reject\n"
+	if err := os.MkdirAll(filepath.Join(upstream.gitdir, "hooks"), 0755); err != nil {
+		t.Fatalf("create hooks directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upstream.gitdir, "hooks", "pre-receive"), []byte(hook), 0755); err != nil {
+		t.Fatalf("write hook: %s", err)
+	}
+	if local.config, err = ParseConfig(strings.NewReader("[user]\nname = Test\nemail = test@example.com\n[gpg]\nprogram = " + filepath.Join(dir, "gpg") + "\n")); err != nil {
+		t.Fatalf("parse config: %s", err)
+	}
+
+	head := writeTestCommit(t, local, "first")
+	if err := local.UpdateRefs(&RefUpdate{Name: "refs/heads/topic", Sha: head}); err != nil {
+		t.Fatalf("update local: %s", err)
+	}
+	push, err := ParseRefspec("refs/heads/topic:refs/heads/topic")
+	if err != nil {
+		t.Fatalf("parse refspec: %s", err)
+	}
+	tr, err := local.OpenTransport(upstream.workdir)
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	readEnv := func() string {
+		env, err := ioutil.ReadFile(filepath.Join(dir, "env"))
+		if err != nil {
+			t.Fatalf("read hook environment: %s", err)
+		}
+		return string(env)
+	}
+
+	changes, err := local.Push(tr, []*Refspec{push}, &PushOptions{Options: []string{"reject"}})
+	if err != nil {
+		t.Fatalf("push: %s", err)
+	}
+	if len(changes) != 1 || changes[0].Rejected != "pre-receive hook declined" {
+		t.Fatalf("want pre-receive rejection, got %+v", changes)
+	}
+	if _, err := upstream.ReadRef("refs/heads/topic"); err == nil {
+		t.Fatal("declined reference updated by push")
+	}
+	assertHasObject(t, upstream, head, false)
+	if want := "GIT_PUSH_OPTION_0=reject\nGIT_PUSH_OPTION_COUNT=1\n"; readEnv() != want {
+		t.Fatalf("want hook environment %q, got %q", want, readEnv())
+	}
+
+	changes, err = local.Push(tr, []*Refspec{push}, &PushOptions{Options: []string{"ci.skip"}, Signed: PushSignedAlways})
+	if err != nil {
+		t.Fatalf("push: %s", err)
+	}
+	if len(changes) != 1 || changes[0].Rejected != "" {
+		t.Fatalf("want accepted push, got %+v", changes)
+	}
+	assertRef(t, upstream, "refs/heads/topic", head)
+	input, err := ioutil.ReadFile(filepath.Join(dir, "input"))
+	if err != nil {
+		t.Fatalf("read hook input: %s", err)
+	}
+	if want := fmt.Sprintf("%040d %x refs/heads/topic\n", 0, head); string(input) != want {
+		t.Fatalf("want hook input %q, got %q", want, input)
+	}
+	env := readEnv()
+	for _, want := range []string{
+		"GIT_PUSH_CERT_KEY=ABCD\n",
+		"GIT_PUSH_CERT_NONCE_STATUS=OK\n",
+		"GIT_PUSH_CERT_STATUS=G\n",
+		"GIT_PUSH_OPTION_0=ci.skip\n",
+	} {
+		if !strings.Contains(env, want) {
+			t.Errorf("hook environment %q does not contain %q", env, want)
+		}
+	}
+	certSha := regexp.MustCompile(`GIT_PUSH_CERT=([0-9a-f]{40})`).FindStringSubmatch(env)
+	if certSha == nil {
+		t.Fatalf("no push certificate in hook environment %q", env)
+	}
+	sha, _ := hex.DecodeString(certSha[1])
+	_, cert, err := upstream.ReadRawObject(sha)
+	if err != nil {
+		t.Fatalf("read push certificate: %s", err)
+	}
+	if want := fmt.Sprintf("\n%040d %x refs/heads/topic\n-----BEGIN PGP SIGNATURE-----", 0, head); !bytes.Contains(cert, []byte(want)) {
+		t.Fatalf("push certificate %q does not record the update", cert)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(upstream.gitdir, "config"), nil, 0644); err != nil {
+		t.Fatalf("write config: %s", err)
+	}
+	if tr, err = local.OpenTransport(upstream.workdir); err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	if push, err = ParseRefspec("refs/heads/topic:refs/heads/other"); err != nil {
+		t.Fatalf("parse refspec: %s", err)
+	}
+	if _, err := local.Push(tr, []*Refspec{push}, &PushOptions{Options: []string{"x"}}); err == nil {
+		t.Fatal("push options sent to repository that does not accept them")
+	}
+	if _, err := local.Push(tr, []*Refspec{push}, &PushOptions{Signed: PushSignedAlways}); err == nil {
+		t.Fatal("signed push to repository that does not accept certificates")
+	}
+	if _, err := local.Push(tr, []*Refspec{push}, &PushOptions{Signed: PushSignedIfAsked}); err != nil {
+		t.Fatalf("push signed if asked: %s", err)
+	}
+	assertRef(t, upstream, "refs/heads/other", head)
+}
+
+func writeTestCommit(t *testing.T, repo *Repository, message string, parents ...[]byte) []byte {
+	t.Helper()
+	blob, err := repo.WriteObject("blob", []byte(message))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	tb := NewTreeBuilder(repo, nil)
+	if err := tb.Insert("file.txt", modeBlob, blob); err != nil {
+		t.Fatalf("insert: %s", err)
+	}
+	tree, err := tb.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	header := map[string][]string{
+		"tree":      {fmt.Sprintf("%x", tree)},
+		"author":    {"Test <test@example.com> 1600000000 +0000"},
+		"committer": {"Test <test@example.com> 1600000000 +0000"},
+	}
+	for _, p := range parents {
+		header["parent"] = append(header["parent"], fmt.Sprintf("%x", p))
+	}
+	raw, err := (&CommitObject{Header: header, Comment: message + "\n"}).Serialize()
+	if err != nil {
+		t.Fatalf("serialize commit: %s", err)
+	}
+	sha, err := repo.WriteObject("commit", raw)
+	if err != nil {
+		t.Fatalf("write commit: %s", err)
+	}
+	return sha
+}
+
+func assertRef(t *testing.T, repo *Repository, name string, want []byte) {
+	t.Helper()
+	ref, err := repo.ReadRef(name)
+	if err != nil {
+		t.Fatalf("read %s: %s", name, err)
+	}
+	if !bytes.Equal(ref.Sha, want) {
+		t.Fatalf("%s: want %x, got %x", name, want, ref.Sha)
+	}
+}
+
+func TestRegisterTransport(t *testing.T) {
+	want := &localTransport{}
+	RegisterTransport("test", func(local *Repository, url string) (Transport, error) {
+		if url != "test://repo" {
+			t.Errorf("unexpected %q url", url)
+		}
+		return want, nil
+	})
+	defer RegisterTransport("test", nil)
+
+	got, err := (&Repository{}).OpenTransport("test://repo")
+	if err != nil {
+		t.Fatalf("open transport: %s", err)
+	}
+	if got != want {
+		t.Fatalf("want registered transport, got %T", got)
+	}
+
+	RegisterTransport("test", nil)
+	if _, err := (&Repository{}).OpenTransport("test://repo"); err == nil {
+		t.Fatal("want error after removing the transport")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// TreeBuilder constructs and modifies tree objects. Entries are addressed by
+// their full, slash separated path. Intermediate subtrees are created when
+// needed and are loaded from the repository only when modified. Once all
+// changes are applied, Write stores every modified tree in the repository.
+type TreeBuilder struct {
+	repo *Repository
+	root *treeNode
+}
+
+type treeNode struct {
+	mode os.FileMode
+	sha  []byte
+
+	// children is nil for blobs and for trees that were not yet loaded.
+	children map[string]*treeNode
+	dirty    bool
+}
+
+// NewTreeBuilder returns a builder that starts with the content of the base
+// tree. Base can be nil to start with an empty tree.
+func NewTreeBuilder(repo *Repository, base *TreeObject) *TreeBuilder {
+	root := &treeNode{mode: modeTree, children: make(map[string]*treeNode), dirty: true}
+	if base != nil {
+		root.fill(base)
+	}
+	return &TreeBuilder{repo: repo, root: root}
+}
+
+func (n *treeNode) fill(tr *TreeObject) {
+	for _, leaf := range tr.Leafs {
+		n.children[leaf.Path] = &treeNode{mode: leaf.Mode, sha: leaf.Sha}
+	}
+}
+
+// load makes sure that children of a tree node are available.
+func (b *TreeBuilder) load(n *treeNode) error {
+	if n.children != nil {
+		return nil
+	}
+	n.children = make(map[string]*treeNode)
+	if n.sha == nil {
+		return nil
+	}
+	obj, err := b.repo.ReadObject(n.sha)
+	if err != nil {
+		return fmt.Errorf("read %x tree: %w", n.sha, err)
+	}
+	tr, ok := obj.(*TreeObject)
+	if !ok {
+		return fmt.Errorf("%x is not a tree object: %T", n.sha, obj)
+	}
+	n.fill(tr)
+	return nil
+}
+
+func splitTreePath(path string) ([]string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+	chunks := strings.Split(path, "/")
+	for _, c := range chunks {
+		switch c {
+		case "", ".", "..":
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+	}
+	return chunks, nil
+}
+
+// Insert adds or replaces an entry at given path. Any missing parent
+// directory is created. Non tree entries on the way are replaced.
+func (b *TreeBuilder) Insert(path string, mode os.FileMode, sha []byte) error {
+	chunks, err := splitTreePath(path)
+	if err != nil {
+		return err
+	}
+	if len(sha) != 20 {
+		return fmt.Errorf("invalid hash length: %d", len(sha))
+	}
+	node := b.root
+	for _, name := range chunks[:len(chunks)-1] {
+		if err := b.load(node); err != nil {
+			return err
+		}
+		node.dirty = true
+		child, ok := node.children[name]
+		if !ok || child.mode != modeTree {
+			child = &treeNode{mode: modeTree, children: make(map[string]*treeNode)}
+			node.children[name] = child
+		}
+		node = child
+	}
+	if err := b.load(node); err != nil {
+		return err
+	}
+	node.dirty = true
+	node.children[chunks[len(chunks)-1]] = &treeNode{mode: mode, sha: sha}
+	return nil
+}
+
+// Remove deletes an entry at given path, together with all its content if
+// it is a tree. Directories that become empty are removed as well. Removing
+// a path that does not exist returns os.ErrNotExist.
+func (b *TreeBuilder) Remove(path string) error {
+	chunks, err := splitTreePath(path)
+	if err != nil {
+		return err
+	}
+	if _, err := b.remove(b.root, chunks); err != nil {
+		return fmt.Errorf("remove %q: %w", path, err)
+	}
+	return nil
+}
+
+// remove returns true if the node becomes empty.
+func (b *TreeBuilder) remove(node *treeNode, chunks []string) (bool, error) {
+	if err := b.load(node); err != nil {
+		return false, err
+	}
+	child, ok := node.children[chunks[0]]
+	if !ok {
+		return false, os.ErrNotExist
+	}
+	if len(chunks) == 1 {
+		delete(node.children, chunks[0])
+	} else {
+		if child.mode != modeTree {
+			return false, os.ErrNotExist
+		}
+		empty, err := b.remove(child, chunks[1:])
+		if err != nil {
+			return false, err
+		}
+		if empty {
+			delete(node.children, chunks[0])
+		}
+	}
+	node.dirty = true
+	return len(node.children) == 0, nil
+}
+
+// Write stores all modified trees in the repository and returns the hash of
+// the root tree.
+func (b *TreeBuilder) Write() ([]byte, error) {
+	return b.write(b.root)
+}
+
+func (b *TreeBuilder) write(node *treeNode) ([]byte, error) {
+	if !node.dirty {
+		return node.sha, nil
+	}
+	var tr TreeObject
+	for name, child := range node.children {
+		sha := child.sha
+		if child.mode == modeTree {
+			s, err := b.write(child)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			sha = s
+		}
+		tr.Leafs = append(tr.Leafs, &TreeLeaf{Mode: child.mode, Path: name, Sha: sha})
+	}
+	sortTreeLeafs(tr.Leafs)
+	raw, err := tr.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("serialize tree: %w", err)
+	}
+	if err := b.repo.verifyNewObject("tree", raw); err != nil {
+		return nil, err
+	}
+	sha, err := b.repo.WriteObject("tree", raw)
+	if err != nil {
+		return nil, fmt.Errorf("write tree: %w", err)
+	}
+	node.sha = sha
+	node.dirty = false
+	return sha, nil
+}
+
+// sortTreeLeafs orders leafs the way git expects them in a tree object.
+// Names are compared byte-wise, with trees compared as if their name ended
+// with a slash.
+func sortTreeLeafs(leafs []*TreeLeaf) {
+	sort.Slice(leafs, func(i, j int) bool {
+		return treeLeafSortName(leafs[i]) < treeLeafSortName(leafs[j])
+	})
+}
+
+func treeLeafSortName(leaf *TreeLeaf) string {
+	if leaf.Mode == modeTree {
+		return leaf.Path + "/"
+	}
+	return leaf.Path
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestTreeBuilder(t *testing.T) {
+	repo := newTestRepository(t)
+	blob, err := repo.WriteObject("blob", []byte("hello\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+
+	b := NewTreeBuilder(repo, nil)
+	for _, path := range []string{"b.txt", "a/deep/x.txt", "a-b", "a.txt"} {
+		if err := b.Insert(path, modeBlob, blob); err != nil {
+			t.Fatalf("insert %q: %s", path, err)
+		}
+	}
+	// Trees are sorted as if the name ended with a slash, so "a" must go
+	// after "a-b" and "a.txt". Expected hash is what git write-tree
+	// produces for the same content.
+	assertTreeSha(t, b, "109bce3de87555a63fc357305defb36c298894c9")
+
+	// Removing the only file in a directory removes all empty parents.
+	if err := b.Remove("a/deep/x.txt"); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+	assertTreeSha(t, b, "977a76a4e0c3c3758fda6863b73ce3508a893d08")
+
+	if err := b.Remove("a/deep/x.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want not exist error, got %+v", err)
+	}
+}
+
+func assertTreeSha(t *testing.T, b *TreeBuilder, want string) {
+	t.Helper()
+	sha, err := b.Write()
+	if err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if got := hex.EncodeToString(sha); got != want {
+		t.Fatalf("want %s tree, got %s", want, got)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FileChange is a single entry of a raw diff. Missing side of an added or
+// deleted file has zero mode and nil hash. Hash of a worktree file that was
+// not hashed is nil as well.
+type FileChange struct {
+	Path    string
+	OldMode os.FileMode
+	NewMode os.FileMode
+	OldSha  []byte
+	NewSha  []byte
+	// Status is one of A (added), D (deleted), M (modified), T (type
+	// changed) and U (unmerged).
+	Status byte
+}
+
+// DiffTrees compares two trees and returns changed entries sorted by path.
+// Either tree can be nil, to compare against an empty tree. Unless
+// recursive, changed subtrees are reported as single entries.
+func (r *Repository) DiffTrees(a, b *TreeObject, recursive bool, ps *Pathspec) ([]*FileChange, error) {
+	var changes []*FileChange
+	if err := r.diffTrees(a, b, "", recursive, ps, &changes); err != nil {
+		return nil, err
+	}
+	sortFileChanges(changes)
+	return changes, nil
+}
+
+func (r *Repository) diffTrees(a, b *TreeObject, prefix string, recursive bool, ps *Pathspec, changes *[]*FileChange) error {
+	old := leafsByName(a)
+	cur := leafsByName(b)
+	names := make([]string, 0, len(old)+len(cur))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range cur {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		x, y := old[name], cur[name]
+		if x != nil && y != nil && sameLeaf(x, y) {
+			continue
+		}
+		path := prefix + name
+		// A file replaced by a directory, or the other way, is a deletion
+		// and an addition.
+		if x != nil && y != nil && (x.Mode == modeTree) != (y.Mode == modeTree) {
+			if err := r.diffTreeEntry(path, x, nil, recursive, ps, changes); err != nil {
+				return err
+			}
+			x = nil
+		}
+		if err := r.diffTreeEntry(path, x, y, recursive, ps, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffTreeEntry compares two versions of a tree entry. If one of them is a
+// tree, the other one is a tree as well or missing.
+func (r *Repository) diffTreeEntry(path string, x, y *TreeLeaf, recursive bool, ps *Pathspec, changes *[]*FileChange) error {
+	if (x != nil && x.Mode == modeTree) || (y != nil && y.Mode == modeTree) {
+		var a, b *TreeObject
+		var err error
+		if x != nil {
+			if a, err = r.readTree(x.Sha); err != nil {
+				return err
+			}
+		}
+		if y != nil {
+			if b, err = r.readTree(y.Sha); err != nil {
+				return err
+			}
+		}
+		if recursive {
+			return r.diffTrees(a, b, path+"/", recursive, ps, changes)
+		}
+		if !ps.Match(path) {
+			// Show the subtree if the pathspec selects anything that
+			// changed within it.
+			var sub []*FileChange
+			if err := r.diffTrees(a, b, path+"/", true, ps, &sub); err != nil {
+				return err
+			}
+			if len(sub) == 0 {
+				return nil
+			}
+		}
+		*changes = append(*changes, newFileChange(path, x, y))
+		return nil
+	}
+	if ps.Match(path) {
+		*changes = append(*changes, newFileChange(path, x, y))
+	}
+	return nil
+}
+
+func newFileChange(path string, x, y *TreeLeaf) *FileChange {
+	c := &FileChange{Path: path}
+	if x != nil {
+		c.OldMode, c.OldSha = x.Mode, x.Sha
+	}
+	if y != nil {
+		c.NewMode, c.NewSha = y.Mode, y.Sha
+	}
+	c.Status = changeStatus(c.OldMode, c.NewMode)
+	return c
+}
+
+func changeStatus(oldMode, newMode os.FileMode) byte {
+	switch {
+	case oldMode == 0:
+		return 'A'
+	case newMode == 0:
+		return 'D'
+	case modeType(oldMode) != modeType(newMode):
+		return 'T'
+	default:
+		return 'M'
+	}
+}
+
+// modeType returns the kind of entry, ignoring the executable bit.
+func modeType(mode os.FileMode) os.FileMode {
+	if mode == modeExec {
+		return modeBlob
+	}
+	return mode
+}
+
+// sortFileChanges sorts changes in the tree order, where directories are
+// compared as if their name ended with a slash.
+func sortFileChanges(changes []*FileChange) {
+	key := func(c *FileChange) string {
+		if c.OldMode == modeTree || c.NewMode == modeTree {
+			return c.Path + "/"
+		}
+		return c.Path
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return key(changes[i]) < key(changes[j])
+	})
+}
+
+// flattenTree returns all non tree entries of a tree by their full path.
+func (r *Repository) flattenTree(tr *TreeObject, prefix string, entries map[string]*TreeLeaf) error {
+	for _, leaf := range tr.Leafs {
+		path := prefix + leaf.Path
+		if leaf.Mode != modeTree {
+			entries[path] = &TreeLeaf{Mode: leaf.Mode, Path: path, Sha: leaf.Sha}
+			continue
+		}
+		sub, err := r.readTree(leaf.Sha)
+		if err != nil {
+			return err
+		}
+		if err := r.flattenTree(sub, path+"/", entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffTreeIndex compares a tree with the index. If worktree is set, index
+// entries are replaced by the worktree files they stage, which is what git
+// diff-index does without --cached. Tree can be nil.
+func (r *Repository) DiffTreeIndex(tr *TreeObject, idx *Index, worktree bool, ps *Pathspec) ([]*FileChange, error) {
+	old := make(map[string]*TreeLeaf)
+	if tr != nil {
+		if err := r.flattenTree(tr, "", old); err != nil {
+			return nil, err
+		}
+	}
+	var changes []*FileChange
+	seen := make(map[string]struct{}, len(idx.Entries))
+	for _, e := range idx.Entries {
+		if _, ok := seen[e.Path]; ok {
+			// Other stages of an unmerged entry.
+			continue
+		}
+		seen[e.Path] = struct{}{}
+		if !ps.Match(e.Path) {
+			continue
+		}
+		if e.Stage != 0 {
+			// Unmerged entries have no single content to compare.
+			changes = append(changes, &FileChange{Path: e.Path, Status: 'U'})
+			continue
+		}
+		y := &TreeLeaf{Mode: e.Mode, Path: e.Path, Sha: e.Sha}
+		if worktree {
+			var err error
+			if y, err = r.worktreeLeaf(e, idx); err != nil {
+				return nil, err
+			}
+		}
+		x := old[e.Path]
+		switch {
+		case x == nil && y == nil:
+			continue
+		case x != nil && y != nil && x.Mode == y.Mode && bytes.Equal(x.Sha, y.Sha):
+			continue
+		}
+		changes = append(changes, newFileChange(e.Path, x, y))
+	}
+	for path, x := range old {
+		if _, ok := seen[path]; !ok && ps.Match(path) {
+			changes = append(changes, newFileChange(path, x, nil))
+		}
+	}
+	sortFileChanges(changes)
+	return changes, nil
+}
+
+// DiffIndexWorktree compares index entries with the worktree files.
+// Modified files are reported with a nil new hash, because they are not
+// hashed unless needed to tell if they changed.
+func (r *Repository) DiffIndexWorktree(idx *Index, ps *Pathspec) ([]*FileChange, error) {
+	var changes []*FileChange
+	seen := make(map[string]struct{}, len(idx.Entries))
+	for _, e := range idx.Entries {
+		if _, ok := seen[e.Path]; ok || !ps.Match(e.Path) {
+			continue
+		}
+		seen[e.Path] = struct{}{}
+		if e.Stage != 0 {
+			changes = append(changes, &FileChange{Path: e.Path, Status: 'U'})
+			continue
+		}
+		x := &TreeLeaf{Mode: e.Mode, Path: e.Path, Sha: e.Sha}
+		y, err := r.worktreeLeaf(e, idx)
+		if err != nil {
+			return nil, err
+		}
+		if e.IntentToAdd && y != nil {
+			// The file is shown as added, although it is not staged.
+			x = nil
+		}
+		if x != nil && y != nil && x.Mode == y.Mode && bytes.Equal(x.Sha, y.Sha) {
+			continue
+		}
+		changes = append(changes, newFileChange(e.Path, x, y))
+	}
+	return changes, nil
+}
+
+// worktreeLeaf describes the worktree file of an index entry. Nil is
+// returned if the file does not exist. Returned hash is the hash stored in
+// the index if the file did not change, or nil if it did.
+func (r *Repository) worktreeLeaf(e *IndexEntry, idx *Index) (*TreeLeaf, error) {
+	if e.Mode == modeGitlink || e.AssumeValid || e.SkipWorktree {
+		return &TreeLeaf{Mode: e.Mode, Path: e.Path, Sha: e.Sha}, nil
+	}
+	full := filepath.Join(r.workdir, filepath.FromSlash(e.Path))
+	info, err := os.Lstat(full)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || isNotDir(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("stat %s: %w", e.Path, err)
+	}
+	leaf := &TreeLeaf{Path: e.Path}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		leaf.Mode = modeSymlink
+	case info.IsDir():
+		// Directory in place of a file.
+		return nil, nil
+	case e.Mode == modeBlob || e.Mode == modeExec:
+		leaf.Mode = e.Mode
+		if fileMode, err := r.config.Bool("core", "", "fileMode", true); err != nil {
+			return nil, err
+		} else if fileMode {
+			leaf.Mode = modeBlob
+			if info.Mode()&0111 != 0 {
+				leaf.Mode = modeExec
+			}
+		}
+	default:
+		leaf.Mode = modeBlob
+	}
+
+	// Files that changed at the same time the index was written might not
+	// be told apart by their stat data.
+	racy := !info.ModTime().Before(idx.ModTime)
+	if uint32(info.Size()) == e.Size && info.ModTime().Equal(e.Mtime) && !racy {
+		leaf.Sha = e.Sha
+		return leaf, nil
+	}
+	content, err := readWorktreeFile(full, info)
+	if err != nil {
+		return nil, err
+	}
+	if sha := hashObject("blob", content); bytes.Equal(sha, e.Sha) {
+		leaf.Sha = sha
+	}
+	return leaf, nil
+}
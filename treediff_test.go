@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTrees(t *testing.T) {
+	repo := newTestRepository(t)
+	writeTree := func(files map[string]string) *TreeObject {
+		t.Helper()
+		tb := NewTreeBuilder(repo, nil)
+		for name, content := range files {
+			blob, err := repo.WriteObject("blob", []byte(content))
+			if err != nil {
+				t.Fatalf("write blob: %s", err)
+			}
+			if err := tb.Insert(name, modeBlob, blob); err != nil {
+				t.Fatalf("insert: %s", err)
+			}
+		}
+		sha, err := tb.Write()
+		if err != nil {
+			t.Fatalf("write tree: %s", err)
+		}
+		tr, err := repo.readTree(sha)
+		if err != nil {
+			t.Fatalf("read tree: %s", err)
+		}
+		return tr
+	}
+	a := writeTree(map[string]string{"x": "1", "src/y": "2", "src/z": "3", "src.txt": "4"})
+	b := writeTree(map[string]string{"x": "changed", "src/y": "2", "src/n": "new", "src.txt/q": "5"})
+
+	cases := map[string]struct {
+		a, b      *TreeObject
+		recursive bool
+		pathspec  []string
+		want      []string
+	}{
+		"same trees": {
+			a: a, b: a,
+		},
+		"top level": {
+			a: a, b: b,
+			want: []string{"D src.txt", "A src.txt", "M src", "M x"},
+		},
+		"recursive": {
+			a: a, b: b, recursive: true,
+			want: []string{"D src.txt", "A src.txt/q", "A src/n", "D src/z", "M x"},
+		},
+		"pathspec within a subtree": {
+			a: a, b: b,
+			pathspec: []string{"src/z"},
+			want:     []string{"M src"},
+		},
+		"recursive pathspec": {
+			a: a, b: b, recursive: true,
+			pathspec: []string{"src"},
+			want:     []string{"A src/n", "D src/z"},
+		},
+		"against empty tree": {
+			b: a, recursive: true,
+			want: []string{"A src.txt", "A src/y", "A src/z", "A x"},
+		},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			ps, err := ParsePathspec("", tc.pathspec)
+			if err != nil {
+				t.Fatalf("pathspec: %s", err)
+			}
+			changes, err := repo.DiffTrees(tc.a, tc.b, tc.recursive, ps)
+			if err != nil {
+				t.Fatalf("diff trees: %s", err)
+			}
+			var got []string
+			for _, c := range changes {
+				got = append(got, fmt.Sprintf("%c %s", c.Status, c.Path))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// uiLogPage is the number of commits the log browser shows at once.
+const uiLogPage = 20
+
+// ui is an interactive interface for looking at changes, staging them and
+// browsing the history, in the style of git add --interactive. It reads
+// commands line by line, so that it works in any terminal and can be
+// scripted.
+type ui struct {
+	repo *Repository
+	in   *bufio.Scanner
+	out  *bufio.Writer
+	// files are the changes listed last, numbered from one.
+	files []*uiFile
+}
+
+// uiFile is a change of a file, either staged or not.
+type uiFile struct {
+	staged bool
+	change *FileChange
+}
+
+func cmdUI(input io.Reader, output io.Writer, args []string) error {
+	fl := flag.NewFlagSet("ui", flag.ContinueOnError)
+	if err := fl.Parse(args); err != nil {
+		return err
+	}
+	if fl.NArg() != 0 {
+		return errors.New("usage: ui")
+	}
+	repo, err := FindRepository(".")
+	if err != nil {
+		return fmt.Errorf("cannot open git repository: %w", err)
+	}
+	u := &ui{repo: repo, in: bufio.NewScanner(input), out: bufio.NewWriter(output)}
+	return u.run()
+}
+
+// prompt asks for a command and returns its fields. False is returned at
+// the end of the input.
+func (u *ui) prompt(prompt string) ([]string, bool) {
+	fmt.Fprintf(u.out, "%s> ", prompt)
+	u.out.Flush()
+	if !u.in.Scan() {
+		fmt.Fprintln(u.out)
+		return nil, false
+	}
+	return strings.Fields(u.in.Text()), true
+}
+
+func (u *ui) run() error {
+	defer u.out.Flush()
+	if err := u.showStatus(); err != nil {
+		return err
+	}
+	for {
+		fields, ok := u.prompt("What now")
+		if !ok {
+			return u.in.Err()
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		var err error
+		switch cmd, args := fields[0], fields[1:]; cmd {
+		case "s", "status":
+			err = u.showStatus()
+		case "a", "add", "stage":
+			err = u.toggle(args, false)
+		case "u", "unstage":
+			err = u.toggle(args, true)
+		case "d", "diff":
+			err = u.diff(args)
+		case "l", "log":
+			err = u.browseLog()
+		case "h", "help", "?":
+			u.help()
+		case "q", "quit":
+			return nil
+		default:
+			fmt.Fprintf(u.out, "unknown command %q, try help\n", cmd)
+		}
+		if err != nil {
+			// Mistakes of the user, and files changed while the
+			// interface runs, should not end it.
+			fmt.Fprintf(u.out, "error: %s\n", err)
+		}
+	}
+}
+
+func (u *ui) help() {
+	fmt.Fprint(u.out, `status           - list changed files
+stage <n>...     - stage the files, or all unstaged files without numbers
+unstage <n>...   - unstage the files, or all staged files without numbers
+diff <n>         - show changes of the file
+log              - browse the history of HEAD
+quit             - exit
+`)
+}
+
+func (u *ui) showStatus() error {
+	tr, err := u.repo.headTree()
+	if err != nil {
+		return err
+	}
+	idx, err := u.repo.ReadIndex()
+	if err != nil {
+		return err
+	}
+	staged, err := u.repo.DiffTreeIndex(tr, idx, false, nil)
+	if err != nil {
+		return err
+	}
+	unstaged, err := u.repo.DiffIndexWorktree(idx, nil)
+	if err != nil {
+		return err
+	}
+	quote, err := u.repo.pathQuoter()
+	if err != nil {
+		return err
+	}
+	u.files = u.files[:0]
+	for _, group := range []struct {
+		title   string
+		staged  bool
+		changes []*FileChange
+	}{{"Staged", true, staged}, {"Not staged", false, unstaged}} {
+		if len(group.changes) == 0 {
+			continue
+		}
+		fmt.Fprintf(u.out, "%s:\n", group.title)
+		for _, c := range group.changes {
+			u.files = append(u.files, &uiFile{staged: group.staged, change: c})
+			fmt.Fprintf(u.out, "%3d: %c %s\n", len(u.files), c.Status, quote(c.Path))
+		}
+	}
+	if len(u.files) == 0 {
+		fmt.Fprintln(u.out, "No changes.")
+	}
+	return nil
+}
+
+// selected returns the listed files with given numbers, or all listed files
+// that are staged or not, as asked, if there are no numbers.
+func (u *ui) selected(args []string, staged bool) ([]*uiFile, error) {
+	var files []*uiFile
+	if len(args) == 0 {
+		for _, f := range u.files {
+			if f.staged == staged {
+				files = append(files, f)
+			}
+		}
+		return files, nil
+	}
+	for _, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(u.files) {
+			return nil, fmt.Errorf("no file number %s", arg)
+		}
+		files = append(files, u.files[n-1])
+	}
+	return files, nil
+}
+
+// toggle stages or unstages the selected files and lists the changes again.
+func (u *ui) toggle(args []string, unstage bool) error {
+	files, err := u.selected(args, unstage)
+	if err != nil {
+		return err
+	}
+	unlock, err := u.repo.LockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	idx, err := u.repo.ReadIndex()
+	if err != nil {
+		return err
+	}
+	tr, err := u.repo.headTree()
+	if err != nil {
+		return err
+	}
+	attrs, err := u.repo.worktreeAttributes()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if unstage {
+			err = u.repo.unstageFile(idx, tr, f.change.Path)
+		} else {
+			err = u.repo.stageFile(idx, attrs, f.change.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := u.repo.WriteIndex(idx); err != nil {
+		return err
+	}
+	return u.showStatus()
+}
+
+// diff shows the patch of a listed file. Changes that are not staged are
+// compared with the worktree file, which is stored as a blob for that.
+func (u *ui) diff(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: diff <n>")
+	}
+	files, err := u.selected(args, false)
+	if err != nil {
+		return err
+	}
+	c := *files[0].change
+	if c.Status == 'U' {
+		return fmt.Errorf("%s is unmerged", c.Path)
+	}
+	if !files[0].staged && c.NewMode != 0 {
+		idx, err := u.repo.ReadIndex()
+		if err != nil {
+			return err
+		}
+		attrs, err := u.repo.worktreeAttributes()
+		if err != nil {
+			return err
+		}
+		if err := u.repo.stageFile(idx, attrs, c.Path); err != nil {
+			return err
+		}
+		if i, ok := idx.entry(c.Path); ok {
+			c.NewSha = idx.Entries[i].Sha
+		}
+	}
+	return u.repo.WritePatch(u.out, []*FileChange{&c})
+}
+
+// browseLog lists commits of HEAD a page at a time and shows the patch of
+// the chosen ones.
+func (u *ui) browseLog() error {
+	_, head, err := u.repo.headBranch()
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		fmt.Fprintln(u.out, "No commits yet.")
+		return nil
+	}
+	walk, err := u.repo.NewRevWalk([][]byte{head})
+	if err != nil {
+		return err
+	}
+	var commits []*WalkedCommit
+	more := func() error {
+		for n := 0; n < uiLogPage; n++ {
+			c, err := walk.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			commits = append(commits, c)
+			fmt.Fprintf(u.out, "%3d: %s %s\n", len(commits), shortHash(c.Sha), commitSubject(u.repo.displayCommit(c.Commit)))
+		}
+		return nil
+	}
+	if err := more(); err != nil {
+		return err
+	}
+	for {
+		fields, ok := u.prompt("log (<n> to show, m for more, b to go back)")
+		if !ok || len(fields) == 1 && (fields[0] == "b" || fields[0] == "back") {
+			return nil
+		}
+		if len(fields) != 1 {
+			continue
+		}
+		if fields[0] == "m" || fields[0] == "more" {
+			if err := more(); err != nil {
+				return err
+			}
+			continue
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n < 1 || n > len(commits) {
+			fmt.Fprintf(u.out, "no commit number %s\n", fields[0])
+			continue
+		}
+		if err := u.showCommit(commits[n-1]); err != nil {
+			return err
+		}
+	}
+}
+
+// showCommit writes the header and the message of the commit, followed by
+// its patch against the first parent.
+func (u *ui) showCommit(c *WalkedCommit) error {
+	fmt.Fprintf(u.out, "commit %x\n", c.Sha)
+	commit := u.repo.displayCommit(c.Commit)
+	if author := commit.Header["author"]; len(author) != 0 {
+		if id, err := parseIdent(author[0]); err == nil {
+			fmt.Fprintf(u.out, "Author: %s <%s>\nDate:   %s\n", id.Name, id.Email, id.When.Format("Mon Jan 2 15:04:05 2006 -0700"))
+		}
+	}
+	fmt.Fprintln(u.out)
+	for _, line := range strings.Split(strings.TrimRight(commit.Comment, "\n"), "\n") {
+		fmt.Fprintf(u.out, "    %s\n", line)
+	}
+	fmt.Fprintln(u.out)
+	tr, err := u.repo.commitTree(c.Commit)
+	if err != nil {
+		return err
+	}
+	var parent *TreeObject
+	if len(c.Parents) != 0 {
+		p, err := u.repo.readCommit(c.Parents[0])
+		if err != nil {
+			return err
+		}
+		if parent, err = u.repo.commitTree(p); err != nil {
+			return err
+		}
+	}
+	changes, err := u.repo.DiffTrees(parent, tr, true, nil)
+	if err != nil {
+		return err
+	}
+	return u.repo.WritePatch(u.out, changes)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUI(t *testing.T) {
+	repo := newTestRepository(t)
+	blobs := make(map[string][]byte)
+	b := NewTreeBuilder(repo, nil)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		sha, err := repo.WriteObject("blob", []byte(name+"\n"))
+		if err != nil {
+			t.Fatalf("write blob: %s", err)
+		}
+		if err := b.Insert(name, modeBlob, sha); err != nil {
+			t.Fatalf("insert %s: %s", name, err)
+		}
+		blobs[name] = sha
+	}
+	tree, err := b.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	repo.config.Entries = append(repo.config.Entries,
+		&ConfigEntry{Section: "user", Key: "name", Value: "Test"},
+		&ConfigEntry{Section: "user", Key: "email", Value: "test@example.com"})
+	commit, err := repo.CreateCommit(tree, nil, "add files\n", nil)
+	if err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if err := repo.SwitchHead(commit, "", false); err != nil {
+		t.Fatalf("switch head: %s", err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(repo.workdir, name), []byte(name+" changed\n"), 0644); err != nil {
+			t.Fatalf("write %s: %s", name, err)
+		}
+	}
+
+	// Files are numbered as listed after the previous command, staged ones
+	// first: once both are staged, unstaging the first leaves b.txt staged.
+	// Mistakes do not end the loop, and nothing after quit is run.
+	script := []string{
+		"stage 1",
+		"unstage",
+		"stage",
+		"unstage 1",
+		"stage 9",
+		"frobnicate",
+		"diff 2",
+		"log",
+		"1",
+		"b",
+		"quit",
+		"stage",
+	}
+	var out bytes.Buffer
+	u := &ui{repo: repo, in: bufio.NewScanner(strings.NewReader(strings.Join(script, "\n") + "\n")), out: bufio.NewWriter(&out)}
+	if err := u.run(); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	for _, want := range []string{
+		"Staged:\n  1: M b.txt\nNot staged:\n  2: M a.txt\n",
+		"error: no file number 9\n",
+		`unknown command "frobnicate", try help` + "\n",
+		"-a.txt\n+a.txt changed\n",
+		"  1: " + shortHash(commit) + " add files\n",
+		"    add files\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("want output with %q, got:\n%s", want, out.String())
+		}
+	}
+
+	changed, err := repo.WriteObject("blob", []byte("b.txt changed\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	idx, err := repo.ReadIndex()
+	if err != nil {
+		t.Fatalf("read index: %s", err)
+	}
+	want := map[string][]byte{"a.txt": blobs["a.txt"], "b.txt": changed}
+	if len(idx.Entries) != len(want) {
+		t.Fatalf("want %d index entries, got %d", len(want), len(idx.Entries))
+	}
+	for _, e := range idx.Entries {
+		if !bytes.Equal(e.Sha, want[e.Path]) {
+			t.Errorf("%s: want %x staged, got %x", e.Path, want[e.Path], e.Sha)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+// versionCompare compares two strings treating runs of digits as numbers,
+// so that "v1.2" sorts before "v1.10". It follows git's versioncmp, which
+// is strverscmp from glibc: a run of digits with leading zeros is treated
+// as a fractional part, so "1.01" sorts before "1.1".
+//
+// Suffixes are the versionsort.suffix values. A string with one of them at
+// the point where the two strings differ sorts before a string without,
+// so that with "-rc" configured, "v1.0-rc1" sorts before "v1.0". Strings
+// with different suffixes are ordered as the suffixes are listed.
+func versionCompare(s1, s2 string, suffixes []string) int {
+	// States of comparing digits: normal, integral part, fractional part
+	// and leading zeros.
+	const (
+		stateNormal   = 0
+		stateIntegral = 3
+		stateFraction = 6
+		stateZeros    = 9
+		resultCmp     = 2
+		resultLen     = 3
+	)
+	nextState := [...]int{
+		// x, d, 0
+		stateNormal, stateIntegral, stateZeros, // normal
+		stateNormal, stateIntegral, stateIntegral, // integral
+		stateNormal, stateFraction, stateFraction, // fraction
+		stateNormal, stateFraction, stateZeros, // zeros
+	}
+	resultType := [...]int{
+		// x/x, x/d, x/0, d/x, d/d, d/0, 0/x, 0/d, 0/0
+		resultCmp, resultCmp, resultCmp, resultCmp, resultLen, resultCmp, resultCmp, resultCmp, resultCmp, // normal
+		resultCmp, -1, -1, +1, resultLen, resultLen, +1, resultLen, resultLen, // integral
+		resultCmp, resultCmp, resultCmp, resultCmp, resultCmp, resultCmp, resultCmp, resultCmp, resultCmp, // fraction
+		resultCmp, +1, +1, -1, resultCmp, resultCmp, -1, resultCmp, resultCmp, // zeros
+	}
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	class := func(c byte) int {
+		switch {
+		case c == '0':
+			return 2
+		case isDigit(c):
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	if s1 == s2 {
+		return 0
+	}
+	i := 0
+	c1, c2 := at(s1, i), at(s2, i)
+	state := stateNormal + class(c1)
+	for c1 == c2 {
+		if i >= len(s1) || i >= len(s2) {
+			return len(s1) - len(s2)
+		}
+		state = nextState[state]
+		i++
+		c1, c2 = at(s1, i), at(s2, i)
+		state += class(c1)
+	}
+	diff := int(c1) - int(c2)
+
+	if diff, ok := swapPrereleases(s1, s2, i, suffixes); ok {
+		return diff
+	}
+
+	switch result := resultType[state*3+class(c2)]; result {
+	case resultCmp:
+		return diff
+	case resultLen:
+		for j := i + 1; ; j++ {
+			d1, d2 := isDigit(at(s1, j)), isDigit(at(s2, j))
+			switch {
+			case d1 && d2:
+				continue
+			case d1:
+				return 1
+			case d2:
+				return -1
+			default:
+				return diff
+			}
+		}
+	default:
+		return result
+	}
+}
+
+// swapPrereleases orders two strings by the suffixes found around offset,
+// the first position where the strings differ. It returns false if neither
+// of the strings has a suffix there, or if both have the same one.
+func swapPrereleases(s1, s2 string, offset int, suffixes []string) (int, bool) {
+	find := func(s string) int {
+		for i, suffix := range suffixes {
+			start := offset - len(suffix)
+			if start < 0 {
+				start = 0
+			}
+			for j := start; j <= offset && j <= len(s); j++ {
+				if len(s)-j >= len(suffix) && s[j:j+len(suffix)] == suffix {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	i1, i2 := find(s1), find(s2)
+	switch {
+	case i1 == i2:
+		// Neither has a suffix, or both have the same one and the caller
+		// decides by what follows it.
+		return 0, false
+	case i1 >= 0 && i2 >= 0:
+		return i1 - i2, true
+	case i1 >= 0:
+		return -1, true
+	default:
+		return 1, true
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestVersionCompare(t *testing.T) {
+	cases := map[string]struct {
+		a, b     string
+		suffixes []string
+		want     int
+	}{
+		"equal":                {a: "v1.2", b: "v1.2", want: 0},
+		"numeric":              {a: "v1.2", b: "v1.10", want: -1},
+		"numeric reversed":     {a: "v1.10", b: "v1.9", want: 1},
+		"major":                {a: "v2", b: "v1.10", want: 1},
+		"text":                 {a: "alpha", b: "beta", want: -1},
+		"prefix":               {a: "v1", b: "v1.0", want: -1},
+		"leading zero":         {a: "1.01", b: "1.1", want: -1},
+		"without suffix":       {a: "v1.0-rc1", b: "v1.0", want: 1},
+		"suffix":               {a: "v1.0-rc1", b: "v1.0", suffixes: []string{"-rc"}, want: -1},
+		"same suffix":          {a: "v1.0-rc2", b: "v1.0-rc10", suffixes: []string{"-rc"}, want: -1},
+		"suffix order":         {a: "v1.0-beta", b: "v1.0-alpha", suffixes: []string{"-alpha", "-beta"}, want: 1},
+		"suffix older release": {a: "v1.1-rc1", b: "v1.0", suffixes: []string{"-rc"}, want: 1},
+	}
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got := versionCompare(tc.a, tc.b, tc.suffixes)
+			switch {
+			case got < 0:
+				got = -1
+			case got > 0:
+				got = 1
+			}
+			if got != tc.want {
+				t.Fatalf("want %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// WalkedObject is passed to the WalkObjects callback for every reachable
+// object.
+type WalkedObject struct {
+	// Kind is the type of the object as known by the referrer. It is empty
+	// for walk tips, unless the object could be read.
+	Kind string
+	Sha  []byte
+
+	// Object is the content of a commit, tree or tag. Blobs are never read
+	// and missing objects have no content.
+	Object  Object
+	Missing bool
+	// Corrupt is the *CorruptObjectError of an object that exists, but
+	// cannot be read. Objects it refers to are not visited.
+	Corrupt error
+}
+
+// SkipObject can be returned by the WalkObjects callback to not visit
+// objects referenced by the current object. It is not returned as an error
+// by WalkObjects.
+var SkipObject = errors.New("skip object")
+
+// WalkObjects visits every object reachable from given tips exactly once.
+// Commits, trees and tags are read in order to find objects they refer to.
+// An object that does not exist or is corrupt is reported instead of
+// interrupting the walk. Submodule commits are not followed.
+func (r *Repository) WalkObjects(tips [][]byte, fn func(*WalkedObject) error) error {
+	type pending struct {
+		kind string
+		sha  []byte
+	}
+	var stack []pending
+	for _, sha := range tips {
+		stack = append(stack, pending{sha: sha})
+	}
+	seen := make(map[string]struct{})
+
+	for len(stack) != 0 {
+		next := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		key := string(next.sha)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		walked := WalkedObject{Kind: next.kind, Sha: next.sha}
+		if next.kind == "blob" {
+			ok, err := r.HasObject(next.sha)
+			if err != nil {
+				return err
+			}
+			walked.Missing = !ok
+			if err := fn(&walked); err != nil && err != SkipObject {
+				return err
+			}
+			continue
+		}
+
+		obj, err := r.ReadObject(next.sha)
+		switch {
+		case err == nil:
+			walked.Object = obj
+		case errors.Is(err, os.ErrNotExist):
+			walked.Missing = true
+			if err := fn(&walked); err != nil && err != SkipObject {
+				return err
+			}
+			continue
+		case errors.As(err, new(*CorruptObjectError)):
+			walked.Corrupt = err
+			if err := fn(&walked); err != nil && err != SkipObject {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("read %x: %w", next.sha, err)
+		}
+
+		// Referenced objects are pushed only after the callback accepted
+		// the current object.
+		var refs []pending
+		switch obj := obj.(type) {
+		case *CommitObject:
+			walked.Kind = "commit"
+			for _, tree := range obj.Header["tree"] {
+				sha, err := hex.DecodeString(tree)
+				if err != nil {
+					return fmt.Errorf("commit %x: invalid tree: %w", next.sha, err)
+				}
+				refs = append(refs, pending{kind: "tree", sha: sha})
+			}
+			for _, parent := range obj.Header["parent"] {
+				sha, err := hex.DecodeString(parent)
+				if err != nil {
+					return fmt.Errorf("commit %x: invalid parent: %w", next.sha, err)
+				}
+				refs = append(refs, pending{kind: "commit", sha: sha})
+			}
+		case *TreeObject:
+			walked.Kind = "tree"
+			for _, leaf := range obj.Leafs {
+				switch leaf.Mode {
+				case modeGitlink:
+					// Submodule commits live in another repository.
+				case modeTree:
+					refs = append(refs, pending{kind: "tree", sha: leaf.Sha})
+				default:
+					refs = append(refs, pending{kind: "blob", sha: leaf.Sha})
+				}
+			}
+		case *TagObject:
+			walked.Kind = "tag"
+			target := obj.Header["object"]
+			if len(target) == 0 {
+				return fmt.Errorf("tag %x: missing object", next.sha)
+			}
+			sha, err := hex.DecodeString(target[0])
+			if err != nil {
+				return fmt.Errorf("tag %x: invalid object: %w", next.sha, err)
+			}
+			var kind string
+			if t := obj.Header["type"]; len(t) != 0 {
+				kind = t[0]
+			}
+			refs = append(refs, pending{kind: kind, sha: sha})
+		case *BlobObject:
+			walked.Kind = "blob"
+		}
+		switch err := fn(&walked); err {
+		case nil:
+			stack = append(stack, refs...)
+		case SkipObject:
+			// Do not descend.
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// ConnectivityError is returned when some of the reachable objects are not
+// present in the repository. Corrupt objects are missing as well.
+type ConnectivityError struct {
+	Missing []*WalkedObject
+}
+
+func (e *ConnectivityError) Error() string {
+	return fmt.Sprintf("%d reachable objects are missing", len(e.Missing))
+}
+
+// CheckConnectivity ensures that all objects reachable from given tips are
+// present. It must be called before updating references to received
+// objects, so that a partially transferred history is never exposed.
+// A *ConnectivityError is returned if any object is missing.
+func (r *Repository) CheckConnectivity(tips [][]byte) error {
+	var missing []*WalkedObject
+	err := r.WalkObjects(tips, func(o *WalkedObject) error {
+		if o.Missing || o.Corrupt != nil {
+			missing = append(missing, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(missing) != 0 {
+		return &ConnectivityError{Missing: missing}
+	}
+	return nil
+}
+
+// IsAncestor returns true if commit ancestor is reachable from commit
+// descendant. A commit is an ancestor of itself. When both commits are in
+// the commit-graph, the walk does not continue below commits with a
+// generation number that is not greater than the one of ancestor, because
+// ancestor cannot be reachable from them.
+func (r *Repository) IsAncestor(ancestor, descendant []byte) (bool, error) {
+	genAncestor, cutoff := r.commitGeneration(ancestor)
+	if cutoff {
+		if gen, ok := r.commitGeneration(descendant); ok && gen < genAncestor {
+			return false, nil
+		}
+	}
+	stack := [][]byte{descendant}
+	seen := make(map[string]struct{})
+	for len(stack) != 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if bytes.Equal(sha, ancestor) {
+			return true, nil
+		}
+		if _, ok := seen[string(sha)]; ok {
+			continue
+		}
+		seen[string(sha)] = struct{}{}
+		if cutoff {
+			if gen, ok := r.commitGeneration(sha); ok && gen <= genAncestor {
+				continue
+			}
+		}
+
+		c, err := r.readCommit(sha)
+		if err != nil {
+			return false, err
+		}
+		for _, parent := range c.Header["parent"] {
+			p, err := hex.DecodeString(parent)
+			if err != nil {
+				return false, fmt.Errorf("commit %x: invalid parent: %w", sha, err)
+			}
+			stack = append(stack, p)
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestWalkObjects(t *testing.T) {
+	repo := newTestRepository(t)
+	dir := repo.workdir
+	blob, err := repo.WriteObject("blob", []byte("hello\n"))
+	if err != nil {
+		t.Fatalf("write blob: %s", err)
+	}
+	b := NewTreeBuilder(repo, nil)
+	for _, path := range []string{"a.txt", "dir/b.txt"} {
+		if err := b.Insert(path, modeBlob, blob); err != nil {
+			t.Fatalf("insert %q: %s", path, err)
+		}
+	}
+	// Submodule commits are not expected in this repository.
+	gitlink := bytes.Repeat([]byte{0xab}, 20)
+	if err := b.Insert("sub", modeGitlink, gitlink); err != nil {
+		t.Fatalf("insert submodule: %s", err)
+	}
+	tree, err := b.Write()
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	commit := func(parents ...[]byte) []byte {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "tree %x\n", tree)
+		for _, p := range parents {
+			fmt.Fprintf(&b, "parent %x\n", p)
+		}
+		b.WriteString("author Bob R <bobr@example.com> 1580755918 +0100\n")
+		b.WriteString("committer Bob R <bobr@example.com> 1580755918 +0100\n\n")
+		fmt.Fprintf(&b, "Commit %d\n", len(parents))
+		sha, err := repo.WriteObject("commit", b.Bytes())
+		if err != nil {
+			t.Fatalf("write commit: %s", err)
+		}
+		return sha
+	}
+	first := commit()
+	second := commit(first)
+	tag, err := repo.WriteObject("tag", []byte(fmt.Sprintf("object %x\ntype commit\ntag v1\ntagger Bob R <bobr@example.com> 1580755918 +0100\n\nFirst release\n", second)))
+	if err != nil {
+		t.Fatalf("write tag: %s", err)
+	}
+
+	var got []string
+	err = repo.WalkObjects([][]byte{tag, first}, func(o *WalkedObject) error {
+		got = append(got, fmt.Sprintf("%s %x %v", o.Kind, o.Sha, o.Missing))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk: %s", err)
+	}
+	// The tree and the blob are shared and visited once.
+	dirTree, err := repo.WriteObject("tree", append([]byte("100644 b.txt\x00"), blob...))
+	if err != nil {
+		t.Fatalf("write tree: %s", err)
+	}
+	want := []string{
+		fmt.Sprintf("tag %x false", tag),
+		fmt.Sprintf("commit %x false", second),
+		fmt.Sprintf("commit %x false", first),
+		fmt.Sprintf("tree %x false", tree),
+		fmt.Sprintf("tree %x false", dirTree),
+		fmt.Sprintf("blob %x false", blob),
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	if err := repo.CheckConnectivity([][]byte{tag}); err != nil {
+		t.Fatalf("check connectivity: %s", err)
+	}
+	s := hex.EncodeToString(blob)
+	if err := os.Remove(filepath.Join(dir, ".git", "objects", s[:2], s[2:])); err != nil {
+		t.Fatalf("remove blob: %s", err)
+	}
+	err = repo.CheckConnectivity([][]byte{tag})
+	var cerr *ConnectivityError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("want connectivity error, got %+v", err)
+	}
+	if len(cerr.Missing) != 1 || cerr.Missing[0].Kind != "blob" || !bytes.Equal(cerr.Missing[0].Sha, blob) {
+		t.Fatalf("want the blob missing, got %+v", cerr.Missing)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// watchInterval is how often Watch looks at the repository. Changes are
+// found by polling, which works on every file system, including network
+// ones that do not report changes.
+var watchInterval = time.Second
+
+// WatchEventKind tells what changed.
+type WatchEventKind int
+
+const (
+	// WatchRef is a reference that was created, updated or deleted.
+	WatchRef WatchEventKind = iota
+	// WatchHead is HEAD pointing to another branch, or resolving to
+	// another commit because its branch was updated.
+	WatchHead
+	// WatchIndex is the index that was written.
+	WatchIndex
+)
+
+func (k WatchEventKind) String() string {
+	switch k {
+	case WatchRef:
+		return "ref"
+	case WatchHead:
+		return "head"
+	case WatchIndex:
+		return "index"
+	}
+	return "unknown"
+}
+
+// WatchEvent is a change of the repository made on disk, by this or any
+// other process.
+type WatchEvent struct {
+	Kind WatchEventKind
+	// Name is the full name of the reference of WatchRef events.
+	Name string
+	// Old and New are the hashes of the reference, or the hashes HEAD
+	// resolves to. Old is nil if the reference was created and New is
+	// nil if it was deleted.
+	Old []byte
+	New []byte
+	// OldTarget and NewTarget are the branches of WatchHead events, empty
+	// for a detached HEAD.
+	OldTarget string
+	NewTarget string
+}
+
+// watchState is what Watch compares between polls.
+type watchState struct {
+	refs       map[string][]byte
+	headTarget string
+	head       []byte
+	index      indexStamp
+}
+
+// indexStamp identifies a version of the index file. The trailing checksum
+// tells apart versions written within the resolution of the modification
+// time.
+type indexStamp struct {
+	modTime  time.Time
+	size     int64
+	checksum [20]byte
+}
+
+// Watch reports changes of references, HEAD and the index, until the
+// context is done, when the channel is closed. Changes made between two
+// polls are reported together, so a reference updated twice is reported
+// once. A poll that fails, for example because a file is being replaced,
+// is retried at the next interval. The initial state is read before Watch
+// returns, so that all changes made after it returns are reported.
+func (r *Repository) Watch(ctx context.Context) <-chan WatchEvent {
+	events := make(chan WatchEvent)
+	prev, err := r.watchState()
+	go func() {
+		defer close(events)
+		for err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchInterval):
+			}
+			prev, err = r.watchState()
+		}
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			cur, err := r.watchState()
+			if err != nil {
+				continue
+			}
+			for _, e := range diffWatchStates(prev, cur) {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			prev = cur
+		}
+	}()
+	return events
+}
+
+func (r *Repository) watchState() (*watchState, error) {
+	refs, err := r.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+	s := &watchState{refs: refs}
+	head, err := r.ReadRef("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	s.headTarget = head.Target
+	if s.head, err = r.resolveRef("HEAD"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if s.index, err = r.indexStamp(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// indexStamp returns the stamp of the index file, or a zero stamp if there
+// is no index.
+func (r *Repository) indexStamp() (indexStamp, error) {
+	var stamp indexStamp
+	fd, err := os.Open(filepath.Join(r.gitdir, "index"))
+	if errors.Is(err, os.ErrNotExist) {
+		return stamp, nil
+	}
+	if err != nil {
+		return stamp, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return stamp, err
+	}
+	stamp.modTime, stamp.size = info.ModTime(), info.Size()
+	if stamp.size >= int64(len(stamp.checksum)) {
+		if _, err := fd.ReadAt(stamp.checksum[:], stamp.size-int64(len(stamp.checksum))); err != nil && err != io.EOF {
+			return stamp, err
+		}
+	}
+	return stamp, nil
+}
+
+// diffWatchStates returns the events that lead from one state to the other.
+// References are reported sorted by name, before HEAD and the index.
+func diffWatchStates(prev, cur *watchState) []WatchEvent {
+	var events []WatchEvent
+	names := make([]string, 0, len(cur.refs))
+	for name := range cur.refs {
+		names = append(names, name)
+	}
+	for name := range prev.refs {
+		if _, ok := cur.refs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		old, sha := prev.refs[name], cur.refs[name]
+		if !bytes.Equal(old, sha) {
+			events = append(events, WatchEvent{Kind: WatchRef, Name: name, Old: old, New: sha})
+		}
+	}
+	if prev.headTarget != cur.headTarget || !bytes.Equal(prev.head, cur.head) {
+		events = append(events, WatchEvent{
+			Kind:      WatchHead,
+			Old:       prev.head,
+			New:       cur.head,
+			OldTarget: prev.headTarget,
+			NewTarget: cur.headTarget,
+		})
+	}
+	if prev.index != cur.index {
+		events = append(events, WatchEvent{Kind: WatchIndex})
+	}
+	return events
+}
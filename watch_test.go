@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	repo := newTestRepository(t)
+	defer func(interval time.Duration) { watchInterval = interval }(watchInterval)
+	watchInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := repo.Watch(ctx)
+
+	commit := writeTestCommit(t, repo, "first")
+	if err := repo.UpdateRefs(&RefUpdate{Name: "refs/heads/master", Sha: commit}, &RefUpdate{Name: "refs/tags/v1", Sha: commit}); err != nil {
+		t.Fatalf("update refs: %s", err)
+	}
+	want := []WatchEvent{
+		{Kind: WatchRef, Name: "refs/heads/master", New: commit},
+		{Kind: WatchRef, Name: "refs/tags/v1", New: commit},
+		{Kind: WatchHead, New: commit, OldTarget: "refs/heads/master", NewTarget: "refs/heads/master"},
+	}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e.Kind != w.Kind || e.Name != w.Name || string(e.Old) != string(w.Old) || string(e.New) != string(w.New) || e.OldTarget != w.OldTarget || e.NewTarget != w.NewTarget {
+				t.Fatalf("want event %+v, got %+v", w, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %+v", w)
+		}
+	}
+
+	if err := repo.WriteIndex(&Index{Version: 2}); err != nil {
+		t.Fatalf("write index: %s", err)
+	}
+	select {
+	case e := <-events:
+		if e.Kind != WatchIndex {
+			t.Fatalf("want index event, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no index event")
+	}
+
+	cancel()
+	for range events {
+	}
+}